@@ -0,0 +1,227 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+const (
+	// delay between two writes of adopted leases, and most leases written
+	// at once: after a flush of redis, the renewing clients are adopted at
+	// no more than adoptBatchSize commits per adoptFlushInterval
+	adoptFlushInterval = 200 * time.Millisecond
+	adoptBatchSize     = 250
+)
+
+// adoption is an adopted lease waiting to be committed
+type adoption struct {
+	mac    string
+	record Record
+	// at is when the lease was adopted, for the history
+	at time.Time
+	// seq tells apart the successive records queued for the same MAC
+	seq uint64
+}
+
+// adoptionQueue holds the adopted leases until they are committed. The
+// client already believes it has its address, so unlike new allocations,
+// adoptions are answered at once and written shortly after, in batches,
+// sparing redis the burst of writes of all the clients renewing after it
+// lost its data.
+type adoptionQueue struct {
+	mu      sync.Mutex
+	pending map[string]adoption
+	order   []string
+	seq     uint64
+	// flushed is closed once the queue is written out on close
+	flushed chan struct{}
+}
+
+func newAdoptionQueue() adoptionQueue {
+	return adoptionQueue{pending: make(map[string]adoption), flushed: make(chan struct{})}
+}
+
+// add queues the record of mac, replacing the one already queued
+func (q *adoptionQueue) add(mac string, record Record, at time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.seq++
+	if prev, ok := q.pending[mac]; ok {
+		at = prev.at
+	}
+	q.pending[mac] = adoption{mac: mac, record: record, at: at, seq: q.seq}
+	q.order = append(q.order, mac)
+}
+
+// get returns the record queued for mac. Records are queued until they are
+// committed, so that a record missing from the storage is always found here.
+func (q *adoptionQueue) get(mac string) (*Record, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	a, ok := q.pending[mac]
+	if !ok {
+		return nil, false
+	}
+	rec := a.record
+	return &rec, true
+}
+
+// next returns up to n queued adoptions, oldest first, which stay queued
+// until done
+func (q *adoptionQueue) next(n int) []adoption {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var batch []adoption
+	seen := make(map[string]bool)
+	for len(q.order) > 0 && len(batch) < n {
+		mac := q.order[0]
+		q.order = q.order[1:]
+		if a, ok := q.pending[mac]; ok && !seen[mac] {
+			seen[mac] = true
+			batch = append(batch, a)
+		}
+	}
+	return batch
+}
+
+// done unqueues a committed adoption, unless a newer record of the MAC was
+// queued in the meantime
+func (q *adoptionQueue) done(a adoption) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if cur, ok := q.pending[a.mac]; ok && cur.seq == a.seq {
+		delete(q.pending, a.mac)
+	}
+}
+
+// forget unqueues the record of mac, whatever its version
+func (q *adoptionQueue) forget(mac string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, mac)
+}
+
+func (q *adoptionQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// CommitAllocations commits the records of several allocations in one
+// round trip, each like CommitAllocation. Returns the error of each commit.
+func (r *RedisProvider) CommitAllocations(batch []adoption) []error {
+	errs := make([]error, len(batch))
+	cmds := make([]*redis.Cmd, len(batch))
+	commit := func(pipe redis.Pipeliner) error {
+		for i := range batch {
+			record := &batch[i].record
+			recBytes, err := encodeRecord(record)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			cmds[i] = commitScript.EvalSha(context.TODO(), pipe,
+				[]string{r.ns.index + record.IP.String(), r.ns.main + batch[i].mac, r.ns.shadow + batch[i].mac},
+				batch[i].mac, string(recBytes),
+				ttlUntil(record.Expires.Add(10*time.Second)).Milliseconds(), ttlUntil(record.Expires).Milliseconds())
+		}
+		return nil
+	}
+	// the error of the pipeline is the one of its first failed command
+	_, err := r.rdb.Pipelined(context.TODO(), commit)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT ") {
+		// redis restarted since the script was last loaded, and lost it
+		// along with the data the adoptions are committed for
+		if err := commitScript.Load(context.TODO(), r.rdb).Err(); err == nil {
+			_, _ = r.rdb.Pipelined(context.TODO(), commit)
+		}
+	}
+	for i, cmd := range cmds {
+		if cmd != nil {
+			errs[i] = commitError(cmd.Err(), batch[i].record.IP)
+		}
+	}
+
+	if sec := r.getSecondary(); sec != nil {
+		_, err := sec.Pipelined(context.TODO(), func(pipe redis.Pipeliner) error {
+			for i, a := range batch {
+				if errs[i] != nil {
+					continue
+				}
+				recBytes, err := encodeRecord(&a.record)
+				if err != nil {
+					continue
+				}
+				pipe.Set(context.TODO(), r.ns.main+a.mac, string(recBytes), ttlUntil(a.record.Expires.Add(10*time.Second)))
+				pipe.Set(context.TODO(), r.ns.shadow+a.mac, "", ttlUntil(a.record.Expires))
+			}
+			return nil
+		})
+		if err != nil {
+			log.Warnf("could not mirror %d adopted records to secondary storage: %v", len(batch), err)
+		}
+	}
+	return errs
+}
+
+// adopt grants mac the lease of record, whose address the client already
+// uses and which was claimed, and queues its commit
+func (p *PluginState) adopt(mac string, record Record, now time.Time) {
+	p.adoptions.add(mac, record, now)
+	p.counters.adoptedLeases.Add(1)
+}
+
+// flushAdoptions commits the queued adoptions every adoptFlushInterval,
+// and all of them on close
+func (p *PluginState) flushAdoptions() {
+	defer close(p.adoptions.flushed)
+	ticker := time.NewTicker(adoptFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if batch := p.adoptions.next(adoptBatchSize); len(batch) > 0 {
+				p.commitAdoptions(batch)
+			}
+		case <-p.closing:
+			for batch := p.adoptions.next(adoptBatchSize); len(batch) > 0; batch = p.adoptions.next(adoptBatchSize) {
+				p.commitAdoptions(batch)
+			}
+			return
+		}
+	}
+}
+
+// commitAdoptions commits a batch of adoptions in one pipeline. Those that
+// failed for another reason than a conflict are retried one by one. A lease
+// that cannot be committed is taken back: the client is NAKed at its next
+// request and gets a new address.
+func (p *PluginState) commitAdoptions(batch []adoption) {
+	errs := p.storage.CommitAllocations(batch)
+	for i, a := range batch {
+		err := errs[i]
+		if err != nil && !errors.Is(err, ErrConflict) {
+			p.counters.adoptionFallbacks.Add(1)
+			err = p.storage.CommitAllocation(a.mac, &a.record)
+		}
+		p.noteWrite(err)
+		if err != nil {
+			log.Errorf("Could not commit adopted lease of %s for MAC %s: %v", a.record.IP, a.mac, err)
+			p.adoptions.forget(a.mac)
+			p.leases.remove(a.mac, a.record.IP)
+			if err := p.allocator.Free(net.IPNet{IP: a.record.IP, Mask: net.IPv4Mask(255, 255, 255, 255)}); err != nil {
+				log.Errorf("Could not roll back adoption of %s: %v", a.record.IP, err)
+			}
+			p.reassign.add(a.mac)
+			continue
+		}
+		p.adoptions.done(a)
+		p.appendHistory(a.mac, a.record.IP, a.at)
+	}
+}
@@ -0,0 +1,144 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestAdoptionQueue(t *testing.T) {
+	q := newAdoptionQueue()
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	ip := func(last byte) net.IP { return net.IPv4(10, 0, 40, last).To4() }
+	q.add("a", Record{IP: ip(1)}, t0)
+	q.add("b", Record{IP: ip(2)}, t0.Add(time.Second))
+	// a newer record of a keeps when it was adopted
+	q.add("a", Record{IP: ip(3)}, t0.Add(2*time.Second))
+	if rec, ok := q.get("a"); !ok || !rec.IP.Equal(ip(3)) {
+		t.Errorf("record of a %v", rec)
+	}
+
+	batch := q.next(10)
+	if len(batch) != 2 || batch[0].mac != "a" || batch[1].mac != "b" || !batch[0].at.Equal(t0) {
+		t.Fatalf("batch %+v", batch)
+	}
+	if q.len() != 2 {
+		t.Errorf("%d adoptions queued while committed, want 2", q.len())
+	}
+	// a record queued while the older one is committed stays queued
+	q.add("b", Record{IP: ip(4)}, t0)
+	q.done(batch[0])
+	q.done(batch[1])
+	if rec, ok := q.get("b"); !ok || !rec.IP.Equal(ip(4)) || q.len() != 1 {
+		t.Errorf("newer record of b %v left queued among %d", rec, q.len())
+	}
+	q.forget("b")
+	if q.len() != 0 || len(q.next(10)) != 0 {
+		t.Error("adoptions left after they were forgotten")
+	}
+}
+
+// commitTimes records when the commits of leases reach m
+type commitTimes struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (c *commitTimes) hook(peer *server.Peer, cmd string, args ...string) bool {
+	if cmd == "EVALSHA" || cmd == "EVAL" {
+		c.mu.Lock()
+		c.times = append(c.times, time.Now())
+		c.mu.Unlock()
+	}
+	return false
+}
+
+func (c *commitTimes) snapshot() []time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Time(nil), c.times...)
+}
+
+func TestFlushRecovery(t *testing.T) {
+	m := miniredis.RunT(t)
+	args := []string{"10.0.40.1", "10.0.42.254", "1h"}
+	p := startPlugin(t, m, args...)
+	const n = 2*adoptBatchSize + 50
+	ips := make(map[string]net.IP)
+	for i := 0; i < n; i++ {
+		mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, byte(i >> 8), byte(i)}.String()
+		ips[mac] = lease(t, p, mac)
+	}
+
+	// redis restarts empty, and every client renews at once
+	if err := p.storage.rdb.ScriptFlush(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	m.FlushAll()
+	p = startPlugin(t, m, args...)
+	commits := &commitTimes{}
+	m.Server().SetPreHook(commits.hook)
+	for mac, ip := range ips {
+		if typ := renewal(t, p, mac, ip); typ != dhcpv4.MessageTypeAck {
+			t.Fatalf("renewal of %s after the flush answered %s", ip, typ)
+		}
+	}
+	s := p.Stats()
+	if s.AdoptedLeases != n || s.AllocatedLeases != 0 {
+		t.Errorf("%d adopted and %d allocated leases, want %d adopted", s.AdoptedLeases, s.AllocatedLeases, n)
+	}
+	// the clients renewing again before the commit keep their lease
+	for mac, ip := range ips {
+		if typ := renewal(t, p, mac, ip); typ != dhcpv4.MessageTypeAck {
+			t.Fatalf("second renewal of %s answered %s", ip, typ)
+		}
+		break
+	}
+
+	eventually(t, "the commits", func() bool { return p.Stats().AdoptionsPending == 0 })
+	for mac, ip := range ips {
+		rec, err := p.storage.GetRecord(mac)
+		if err != nil || !rec.IP.Equal(ip) {
+			t.Fatalf("record of %s after the commits: %v, %v", mac, rec, err)
+		}
+	}
+	assertIndexed(t, m, p)
+	if s := p.Stats(); s.AdoptionFallbacks != 0 {
+		t.Errorf("%d commits retried alone", s.AdoptionFallbacks)
+	}
+
+	// one batch of commits per flush interval, the first one sent again
+	// once the script lost with the data is loaded again
+	times := commits.snapshot()
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	var bursts []int
+	for i := range times {
+		if i == 0 || times[i].Sub(times[i-1]) > adoptFlushInterval/4 {
+			bursts = append(bursts, 0)
+		}
+		bursts[len(bursts)-1]++
+	}
+	if len(bursts) < 3 {
+		t.Fatalf("commits sent in bursts of %v, want at least 3", bursts)
+	}
+	sum := 0
+	for i, b := range bursts {
+		sum += b
+		if b > adoptBatchSize && (i > 0 || b > 2*adoptBatchSize) {
+			t.Errorf("commits sent in bursts of %v, want at most %d each", bursts, adoptBatchSize)
+		}
+	}
+	if sum < n || sum > n+bursts[0]/2 {
+		t.Errorf("%d commits sent for %d adoptions", sum, n)
+	}
+}
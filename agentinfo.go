@@ -0,0 +1,142 @@
+package rangeredisplugin
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// decoder used when none is configured
+const defaultAgentDecoder = "ascii"
+
+// AgentInfoDecoder turns a raw relay agent (option 82) sub-option into the
+// normalized string stored on the Record.
+type AgentInfoDecoder func(raw []byte) (string, error)
+
+// agentInfoDecoders are the decoders selectable with the agent_decoder options
+var agentInfoDecoders = map[string]AgentInfoDecoder{
+	"ascii": decodeASCII,
+	"hex":   decodeHex,
+	"tlv":   decodeTLV,
+}
+
+// decodeASCII accepts printable ASCII only
+func decodeASCII(raw []byte) (string, error) {
+	if !isPrintable(raw) {
+		return "", errors.New("not printable ASCII")
+	}
+	return string(raw), nil
+}
+
+func decodeHex(raw []byte) (string, error) {
+	return hex.EncodeToString(raw), nil
+}
+
+// decodeTLV decodes the type/length/value layout used by most DSLAMs, e.g.
+// a remote-id made of a type 0 entry holding the subscriber MAC. Each entry
+// is rendered as type=value, where 6-byte values are rendered as a MAC
+// address and printable values as text.
+func decodeTLV(raw []byte) (string, error) {
+	var parts []string
+	for len(raw) > 0 {
+		if len(raw) < 2 {
+			return "", errors.New("truncated TLV header")
+		}
+		typ, length := raw[0], int(raw[1])
+		if len(raw) < 2+length {
+			return "", fmt.Errorf("TLV of type %d is truncated", typ)
+		}
+		val := raw[2 : 2+length]
+		raw = raw[2+length:]
+
+		var s string
+		switch {
+		case length == 6:
+			s = net.HardwareAddr(val).String()
+		case isPrintable(val):
+			s = string(val)
+		default:
+			s = hex.EncodeToString(val)
+		}
+		parts = append(parts, fmt.Sprintf("%d=%s", typ, s))
+	}
+	return strings.Join(parts, ";"), nil
+}
+
+func isPrintable(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func agentDecoderNames() []string {
+	names := make([]string, 0, len(agentInfoDecoders))
+	for name := range agentInfoDecoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// agentInfo is the decoded relay agent information of a request
+type agentInfo struct {
+	CircuitID string
+	RemoteID  string
+}
+
+// decodeAgentInfo decodes the circuit-id and remote-id sub-options of req
+// with the decoder selected for its relay. Data the decoder cannot handle
+// falls back to hex encoding. The values are sanitized and truncated.
+func (p *PluginState) decodeAgentInfo(req *dhcpv4.DHCPv4) agentInfo {
+	var info agentInfo
+	rai := req.RelayAgentInfo()
+	if rai == nil {
+		return info
+	}
+
+	decode := agentInfoDecoders[p.cfg.agentDecoder(req.GatewayIPAddr)]
+	normalize := func(raw []byte) string {
+		if len(raw) == 0 {
+			return ""
+		}
+		s, err := decode(raw)
+		if err != nil {
+			s = hex.EncodeToString(raw)
+		}
+		return sanitize(s, p.cfg.MaxAgentInfo)
+	}
+	info.CircuitID = normalize(rai.Get(dhcpv4.AgentCircuitIDSubOption))
+	info.RemoteID = normalize(rai.Get(dhcpv4.AgentRemoteIDSubOption))
+	return info
+}
+
+// agentDecoder returns the name of the decoder to use for a relay
+func (c *Config) agentDecoder(giaddr net.IP) string {
+	if name, ok := c.RelayAgentDecoders[giaddr.String()]; ok {
+		return name
+	}
+	if c.AgentDecoder != "" {
+		return c.AgentDecoder
+	}
+	return defaultAgentDecoder
+}
+
+// apply copies the decoded information to a record, reporting whether it changed
+func (a agentInfo) apply(rec *Record) bool {
+	if rec.CircuitID == a.CircuitID && rec.RemoteID == a.RemoteID {
+		return false
+	}
+	rec.CircuitID, rec.RemoteID = a.CircuitID, a.RemoteID
+	return true
+}
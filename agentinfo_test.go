@@ -0,0 +1,128 @@
+package rangeredisplugin
+
+import (
+	"net"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// sub-options as captured from relays
+var (
+	// Juniper MX, circuit-id of the interface and VLAN
+	juniperCircuit = []byte("ge-0/0/1.100:100")
+	// Nokia ISAM, circuit-id of the access line
+	isamCircuit = []byte("ISAM-1 atm 1/1/01/01:8.35")
+	// Cisco Catalyst, vlan-mod-port circuit-id: type 0, VLAN 100, module 1,
+	// port 5
+	ciscoCircuit = []byte{0x00, 0x04, 0x00, 0x64, 0x01, 0x05}
+	// Cisco Catalyst, remote-id: type 0, the MAC of the switch
+	ciscoRemote = []byte{0x00, 0x06, 0x00, 0x1b, 0x2b, 0x3c, 0x4d, 0x5e}
+	// Huawei MA5600, remote-id of the subscriber MAC with a line label
+	huaweiRemote = []byte{0x00, 0x06, 0x00, 0xe0, 0xfc, 0x12, 0x34, 0x56, 0x01, 0x09, 'a', 't', 'm', ' ', '0', '/', '2', '/', '7'}
+)
+
+func TestAgentInfoDecoders(t *testing.T) {
+	for _, tc := range []struct {
+		decoder string
+		raw     []byte
+		want    string
+		fails   bool
+	}{
+		{"ascii", juniperCircuit, "ge-0/0/1.100:100", false},
+		{"ascii", isamCircuit, "ISAM-1 atm 1/1/01/01:8.35", false},
+		{"ascii", ciscoCircuit, "", true},
+		{"ascii", []byte("line\x00"), "", true},
+		{"hex", ciscoCircuit, "000400640105", false},
+		{"hex", juniperCircuit, "67652d302f302f312e3130303a313030", false},
+		{"tlv", ciscoCircuit, "0=00640105", false},
+		{"tlv", ciscoRemote, "0=00:1b:2b:3c:4d:5e", false},
+		{"tlv", huaweiRemote, "0=00:e0:fc:12:34:56;1=atm 0/2/7", false},
+		{"tlv", []byte{0x01, 0x00}, "1=", false},
+		// a header without its value, and half a header
+		{"tlv", []byte{0x00, 0x06, 0x00, 0x1b}, "", true},
+		{"tlv", []byte{0x00, 0x02, 'a', 'b', 0x01}, "", true},
+		// ASCII is not a TLV
+		{"tlv", juniperCircuit, "", true},
+	} {
+		got, err := agentInfoDecoders[tc.decoder](tc.raw)
+		if (err != nil) != tc.fails || got != tc.want {
+			t.Errorf("%s(% x) = %q, %v, want %q (fails: %t)", tc.decoder, tc.raw, got, err, tc.want, tc.fails)
+		}
+	}
+}
+
+// relayed returns a DISCOVER from mac relayed by giaddr with the circuit-id
+// and remote-id sub-options given, nil for none
+func relayed(t *testing.T, mac string, giaddr net.IP, circuit, remote []byte) *dhcpv4.DHCPv4 {
+	t.Helper()
+	var subs []dhcpv4.Option
+	if circuit != nil {
+		subs = append(subs, dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, circuit))
+	}
+	if remote != nil {
+		subs = append(subs, dhcpv4.OptGeneric(dhcpv4.AgentRemoteIDSubOption, remote))
+	}
+	mods := []dhcpv4.Modifier{dhcpv4.WithGatewayIP(giaddr)}
+	if subs != nil {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(subs...)))
+	}
+	return newRequest(t, dhcpv4.MessageTypeDiscover, mac, mods...)
+}
+
+func TestDecoderSelection(t *testing.T) {
+	cfg, err := parseConfig([]string{"redis://localhost:6379/0", "10.5.0.10", "10.5.0.20", "1h",
+		"agent_decoder=tlv", "agent_decoder_relay=192.0.2.1:ascii,192.0.2.2:hex", "max_agent_info=20"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &PluginState{cfg: cfg}
+	const mac = "00:11:22:33:44:55"
+	ascii, hex, global := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), net.IPv4(192, 0, 2, 3)
+	for _, tc := range []struct {
+		name            string
+		giaddr          net.IP
+		circuit, remote []byte
+		want            agentInfo
+	}{
+		{"relay decoder", ascii, juniperCircuit, nil, agentInfo{CircuitID: "ge-0/0/1.100:100"}},
+		{"hex fallback", ascii, ciscoCircuit, ciscoRemote, agentInfo{CircuitID: "000400640105", RemoteID: "0006001b2b3c4d5e"}},
+		{"other relay decoder", hex, juniperCircuit, nil, agentInfo{CircuitID: "67652d302f302f312" + truncatedMark}},
+		{"global decoder", global, ciscoCircuit, huaweiRemote, agentInfo{CircuitID: "0=00640105", RemoteID: "0=00:e0:fc:12:34:" + truncatedMark}},
+		{"truncated", ascii, isamCircuit, nil, agentInfo{CircuitID: "ISAM-1 atm 1/1/01" + truncatedMark}},
+		{"no sub-options", global, nil, nil, agentInfo{}},
+	} {
+		req := relayed(t, mac, tc.giaddr, tc.circuit, tc.remote)
+		got := p.decodeAgentInfo(req)
+		// the truncation keeps the result within the bound
+		if got != tc.want || len(got.CircuitID) > 20 || len(got.RemoteID) > 20 {
+			t.Errorf("%s: %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAgentInfoStoredOnRecord(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.5.1.10", "10.5.1.20", "1h", "agent_decoder_relay=192.0.2.1:tlv")
+	const mac = "00:11:22:33:44:55"
+	relay := net.IPv4(192, 0, 2, 1)
+	offer := exchange(t, p, relayed(t, mac, relay, ciscoCircuit, ciscoRemote))
+	if offer == nil {
+		t.Fatal("no offer")
+	}
+	req := relayed(t, mac, relay, ciscoCircuit, ciscoRemote)
+	req.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeRequest))
+	req.UpdateOption(dhcpv4.OptRequestedIPAddress(offer.YourIPAddr))
+	if ack := exchange(t, p, req); ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("no ACK: %v", ack)
+	}
+
+	rec, err := p.storage.GetRecord(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.CircuitID != "0=00640105" || rec.RemoteID != "0=00:1b:2b:3c:4d:5e" {
+		t.Errorf("record holds circuit-id %q and remote-id %q", rec.CircuitID, rec.RemoteID)
+	}
+}
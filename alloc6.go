@@ -0,0 +1,115 @@
+package rangeredisplugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+// largest IPv6 range served, so that its bitmap stays within 2 MiB
+const maxRange6 = 1 << 24
+
+// rangeAllocator6 hands out the addresses of an IPv6 range, lowest first.
+// The allocators of coredhcp only serve whole prefixes.
+type rangeAllocator6 struct {
+	mu    sync.Mutex
+	start net.IP
+	size  uint64
+	used  []uint64
+}
+
+func newRangeAllocator6(start, end net.IP) (*rangeAllocator6, error) {
+	if start.To4() != nil || end.To4() != nil || start.To16() == nil || end.To16() == nil {
+		return nil, fmt.Errorf("invalid IPv6 range %s-%s", start, end)
+	}
+	if bytes.Compare(start.To16(), end.To16()) > 0 {
+		return nil, fmt.Errorf("start of range %s is after its end %s", start, end)
+	}
+	if !bytes.Equal(start.To16()[:8], end.To16()[:8]) {
+		return nil, fmt.Errorf("range %s-%s is larger than %d addresses", start, end, maxRange6)
+	}
+	size := binary.BigEndian.Uint64(end.To16()[8:]) - binary.BigEndian.Uint64(start.To16()[8:]) + 1
+	if size == 0 || size > maxRange6 {
+		return nil, fmt.Errorf("range %s-%s is larger than %d addresses", start, end, maxRange6)
+	}
+	return &rangeAllocator6{
+		start: start.To16(),
+		size:  size,
+		used:  make([]uint64, (size+63)/64),
+	}, nil
+}
+
+// offset returns the position of ip in the range
+func (a *rangeAllocator6) offset(ip net.IP) (uint64, bool) {
+	v6 := ip.To16()
+	if v6 == nil || ip.To4() != nil || !bytes.Equal(v6[:8], a.start[:8]) {
+		return 0, false
+	}
+	off := binary.BigEndian.Uint64(v6[8:]) - binary.BigEndian.Uint64(a.start[8:])
+	return off, off < a.size
+}
+
+// address returns the address at position off of the range
+func (a *rangeAllocator6) address(off uint64) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, a.start[:8])
+	binary.BigEndian.PutUint64(ip[8:], binary.BigEndian.Uint64(a.start[8:])+off)
+	return ip
+}
+
+func (a *rangeAllocator6) isUsed(off uint64) bool {
+	return a.used[off/64]&(1<<(off%64)) != 0
+}
+
+func (a *rangeAllocator6) contains(ip net.IP) bool {
+	_, ok := a.offset(ip)
+	return ok
+}
+
+// Allocate returns the hinted address if it is free, and the lowest free
+// address otherwise
+func (a *rangeAllocator6) Allocate(hint net.IPNet) (net.IPNet, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if off, ok := a.offset(hint.IP); ok && !a.isUsed(off) {
+		a.used[off/64] |= 1 << (off % 64)
+		return net.IPNet{IP: a.address(off), Mask: net.CIDRMask(128, 128)}, nil
+	}
+	for i, w := range a.used {
+		if w == ^uint64(0) {
+			continue
+		}
+		for b := uint64(0); b < 64; b++ {
+			off := uint64(i)*64 + b
+			if off >= a.size {
+				break
+			}
+			if w&(1<<b) == 0 {
+				a.used[i] |= 1 << b
+				return net.IPNet{IP: a.address(off), Mask: net.CIDRMask(128, 128)}, nil
+			}
+		}
+	}
+	return net.IPNet{}, allocators.ErrNoAddrAvail
+}
+
+// Free returns an address to the range
+func (a *rangeAllocator6) Free(n net.IPNet) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	off, ok := a.offset(n.IP)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrOutOfRange, n.IP)
+	}
+	if !a.isUsed(off) {
+		return &allocators.ErrDoubleFree{Loc: n}
+	}
+	a.used[off/64] &^= 1 << (off % 64)
+	return nil
+}
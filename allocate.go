@@ -0,0 +1,35 @@
+package rangeredisplugin
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+// The address passed to Allocate is only a hint: the allocators hand out
+// another one when it is taken, without an error. The helpers below make
+// the intent of each call explicit.
+
+// allocateExact allocates the address or prefix of want. If the allocator
+// hands out another one, it is freed and ErrAddressTaken returned, so that
+// nothing is left allocated on failure.
+func allocateExact(a allocators.Allocator, want net.IPNet) (net.IPNet, error) {
+	got, err := a.Allocate(want)
+	if err != nil {
+		return net.IPNet{}, err
+	}
+	if !got.IP.Equal(want.IP) {
+		if err := a.Free(got); err != nil {
+			log.Errorf("could not free %s, allocated instead of %s: %v", got.IP, want.IP, err)
+		}
+		return net.IPNet{}, fmt.Errorf("%w: %s", ErrAddressTaken, want.IP)
+	}
+	return got, nil
+}
+
+// allocatePreferred allocates the address or prefix of hint if it is free,
+// and any other one otherwise. An empty hint allocates any.
+func allocatePreferred(a allocators.Allocator, hint net.IPNet) (net.IPNet, error) {
+	return a.Allocate(hint)
+}
@@ -0,0 +1,77 @@
+package rangeredisplugin
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+)
+
+// exhaust allocates whatever is left in a, and returns how many it got
+func exhaust(a allocators.Allocator) int {
+	n := 0
+	for ; ; n++ {
+		if _, err := a.Allocate(net.IPNet{}); err != nil {
+			return n
+		}
+	}
+}
+
+func TestAllocateHelpers(t *testing.T) {
+	ip := func(last byte) net.IP { return net.IPv4(10, 0, 44, last).To4() }
+	_, delegation, _ := net.ParseCIDR("2001:db8:44::/48")
+	prefix := func(i byte) net.IP {
+		p := make(net.IP, net.IPv6len)
+		copy(p, delegation.IP)
+		p[6] = i
+		return p
+	}
+	for _, tc := range []struct {
+		name       string
+		new        func() (allocators.Allocator, error)
+		size       int
+		want, next net.IPNet
+	}{
+		{"ipv4", func() (allocators.Allocator, error) { return bitmap.NewIPv4Allocator(ip(10), ip(13)) },
+			4, net.IPNet{IP: ip(11)}, net.IPNet{IP: ip(13)}},
+		{"prefix", func() (allocators.Allocator, error) { return bitmap.NewBitmapAllocator(*delegation, 56) },
+			256, net.IPNet{IP: prefix(1), Mask: net.CIDRMask(56, 128)}, net.IPNet{IP: prefix(200), Mask: net.CIDRMask(56, 128)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := tc.new()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := allocateExact(a, tc.want)
+			if err != nil || !got.IP.Equal(tc.want.IP) {
+				t.Fatalf("allocateExact of %s: %s, %v", tc.want.IP, got.IP, err)
+			}
+
+			// the allocator substitutes another address for the one taken:
+			// allocateExact gives it back, allocatePreferred keeps it
+			if got, err := allocateExact(a, tc.want); !errors.Is(err, ErrAddressTaken) || got.IP != nil {
+				t.Errorf("allocateExact of the taken %s: %s, %v, want ErrAddressTaken", tc.want.IP, got.IP, err)
+			}
+			sub, err := allocatePreferred(a, tc.want)
+			if err != nil || sub.IP.Equal(tc.want.IP) {
+				t.Fatalf("allocatePreferred of the taken %s: %s, %v", tc.want.IP, sub.IP, err)
+			}
+			if got, err := allocatePreferred(a, tc.next); err != nil || !got.IP.Equal(tc.next.IP) {
+				t.Errorf("allocatePreferred of the free %s: %s, %v", tc.next.IP, got.IP, err)
+			}
+
+			// nothing leaked by the failed allocateExact: 3 allocated
+			if n := exhaust(a); n != tc.size-3 {
+				t.Errorf("%d left to allocate, want %d", n, tc.size-3)
+			}
+			if _, err := allocatePreferred(a, net.IPNet{}); err == nil {
+				t.Error("allocatePreferred from an exhausted pool succeeded")
+			}
+			if _, err := allocateExact(a, tc.want); err == nil {
+				t.Error("allocateExact from an exhausted pool succeeded")
+			}
+		})
+	}
+}
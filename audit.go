@@ -0,0 +1,189 @@
+package rangeredisplugin
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// kinds of inconsistencies found by the startup audit
+const (
+	IssueDuplicateIP   = "duplicate-ip"
+	IssueOutOfRange    = "out-of-range"
+	IssueMissingShadow = "missing-shadow"
+)
+
+// default percentage of inconsistent records tolerated in strict mode
+const defaultStrictThreshold = 1.0
+
+// AuditIssue is one inconsistency between the allocator and Redis
+type AuditIssue struct {
+	Kind   string
+	MAC    string
+	IP     net.IP
+	Detail string `json:",omitempty"`
+}
+
+// AuditReport is the outcome of checking the stored records against the
+// configuration of the instance
+type AuditReport struct {
+	Records int
+	// Pool is the fingerprint of the configured ranges, in the startup
+	// audit only
+	Pool   *PoolFingerprint `json:",omitempty"`
+	Issues []AuditIssue
+	// Frozen lists the bindings of the frozen addresses, which are no issue
+	Frozen []FrozenBinding `json:",omitempty"`
+	// Operations are the last logged operations on the addresses of the
+	// issues, if the operation log is enabled
+	Operations []OpLogEntry `json:",omitempty"`
+}
+
+// Inconsistent returns the number of records with at least one issue
+func (a *AuditReport) Inconsistent() int {
+	macs := make(map[string]bool)
+	for _, i := range a.Issues {
+		macs[i.MAC] = true
+	}
+	return len(macs)
+}
+
+// Percent returns the share of inconsistent records
+func (a *AuditReport) Percent() float64 {
+	if a.Records == 0 {
+		return 0
+	}
+	return 100 * float64(a.Inconsistent()) / float64(a.Records)
+}
+
+func (a *AuditReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d of %d records inconsistent (%.2f%%)", a.Inconsistent(), a.Records, a.Percent())
+	if a.Pool != nil {
+		fmt.Fprintf(&b, ", pool %s-%s of %d addresses", a.Pool.First, a.Pool.Last, a.Pool.Size)
+	}
+	for _, i := range a.Issues {
+		fmt.Fprintf(&b, "\n  %s: MAC %s IP %s", i.Kind, i.MAC, i.IP)
+		if i.Detail != "" {
+			fmt.Fprintf(&b, " (%s)", i.Detail)
+		}
+	}
+	for _, o := range a.Operations {
+		fmt.Fprintf(&b, "\n  #%d %s %s %s %s by %s", o.Seq, o.Time.Format(time.RFC3339Nano), o.Op, o.IP, o.MAC, o.Caller)
+		if o.Err != "" {
+			fmt.Fprintf(&b, ": %s", o.Err)
+		}
+	}
+	return b.String()
+}
+
+// audit checks the loaded records for duplicate IPs, addresses outside of the
+// range and missing shadow keys. Of several records sharing an IP, the one
+// expiring last is considered valid.
+func (p *PluginState) audit(records map[string]Record) (*AuditReport, error) {
+	report := &AuditReport{Records: len(records)}
+
+	macs := make([]string, 0, len(records))
+	for mac := range records {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+
+	owners := make(map[string]string)
+	for _, mac := range macs {
+		rec := records[mac]
+		if !p.inRange(rec.IP) && !rec.Static {
+			report.Issues = append(report.Issues, AuditIssue{Kind: IssueOutOfRange, MAC: mac, IP: rec.IP})
+			continue
+		}
+		other, ok := owners[rec.IP.String()]
+		if !ok {
+			owners[rec.IP.String()] = mac
+			continue
+		}
+		loser := mac
+		if rec.Expires.After(records[other].Expires) {
+			owners[rec.IP.String()], loser, other = mac, other, mac
+		}
+		report.Issues = append(report.Issues, AuditIssue{
+			Kind: IssueDuplicateIP, MAC: loser, IP: rec.IP,
+			Detail: "also held by " + other,
+		})
+	}
+
+	missing, err := p.storage.MissingShadows(macs)
+	if err != nil {
+		return nil, err
+	}
+	for _, mac := range missing {
+		report.Issues = append(report.Issues, AuditIssue{Kind: IssueMissingShadow, MAC: mac, IP: records[mac].IP})
+	}
+
+	return report, nil
+}
+
+// repair fixes the issues of an audit or consistency report: invalid records
+// are deleted and removed from records, missing keys are recreated, and the
+// allocator and the index are aligned with the records.
+func (p *PluginState) repair(report *AuditReport, records map[string]Record) {
+	for _, issue := range report.Issues {
+		switch issue.Kind {
+		case IssueOutOfRange, IssueDuplicateIP:
+			if err := p.storage.DeleteRecord(issue.MAC); err != nil {
+				log.Errorf("audit: could not delete record of MAC %s: %v", issue.MAC, err)
+			}
+			delete(records, issue.MAC)
+		case IssueMissingShadow, IssueIndexMismatch:
+			rec, ok := records[issue.MAC]
+			if !ok {
+				continue
+			}
+			if err := p.storage.SaveRecord(issue.MAC, &rec); err != nil {
+				log.Errorf("audit: could not restore keys of MAC %s: %v", issue.MAC, err)
+			}
+		case IssueNotAllocated:
+			rec, ok := records[issue.MAC]
+			if !ok {
+				continue
+			}
+			if !p.inRange(rec.IP) {
+				// a static address outside of the range has no allocator entry
+				p.leases.set(issue.MAC, rec.IP)
+				continue
+			}
+			if err := p.claim(issue.MAC, rec.IP); err != nil {
+				log.Errorf("audit: could not allocate %s to MAC %s: %v", rec.IP, issue.MAC, err)
+				continue
+			}
+			p.leases.set(issue.MAC, rec.IP)
+		case IssueAllocatedNoRecord:
+			p.freeLease(issue.MAC, issue.IP)
+		case IssueStaleIndex:
+			if err := p.storage.releaseIndex(issue.MAC, issue.IP); err != nil {
+				log.Errorf("audit: could not delete index entry of %s: %v", issue.IP, err)
+			}
+		case IssueOrphanShadow:
+			if err := p.storage.DeleteRecord(issue.MAC); err != nil {
+				log.Errorf("audit: could not delete shadow key of MAC %s: %v", issue.MAC, err)
+			}
+		case IssueDenied:
+			rec, ok := records[issue.MAC]
+			if !ok {
+				continue
+			}
+			if err := p.storage.DeleteRecord(issue.MAC); err != nil {
+				log.Errorf("audit: could not end the lease of denied MAC %s: %v", issue.MAC, err)
+				continue
+			}
+			delete(records, issue.MAC)
+			p.adoptions.forget(issue.MAC)
+			p.freeLease(issue.MAC, rec.IP)
+		case IssueQuarantineNoTTL:
+			if _, err := p.storage.Requarantine(issue.IP, p.cfg.QuarantineTime); err != nil {
+				log.Errorf("audit: could not set the expiry of the quarantine of %s: %v", issue.IP, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package rangeredisplugin
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// seedInconsistent stores 100 leases of the pool 10.8.0.1-10.8.0.200, of
+// which missing have lost their shadow key and duplicates share the
+// address of another lease, and returns the MAC addresses of the leases
+// without a shadow key
+func seedInconsistent(t *testing.T, m *miniredis.Miniredis, missing, duplicates int) []string {
+	t.Helper()
+	r := openStorage(t, m, StorageOptions{})
+	var shadowless []string
+	for i := 0; i < 100; i++ {
+		mac := fmt.Sprintf("00:11:22:33:00:%02x", i)
+		ip := fmt.Sprintf("10.8.0.%d", 1+i)
+		if i < duplicates {
+			// the lease of 50+i, expiring earlier, loses the address
+			ip = fmt.Sprintf("10.8.0.%d", 51+i)
+		}
+		if err := r.SaveRecord(mac, boundRecord(ip, time.Hour-time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if i >= 100-missing {
+			m.Del(r.ns.shadow + mac)
+			shadowless = append(shadowless, mac)
+		}
+	}
+	return shadowless
+}
+
+func TestStrictConsistency(t *testing.T) {
+	for _, tc := range []struct {
+		name                string
+		missing, duplicates int
+		refused             bool
+		want                string
+	}{
+		{"below the threshold", 3, 1, false, "4 of 100 records inconsistent (4.00%)"},
+		{"at the threshold", 3, 2, false, "5 of 100 records inconsistent (5.00%)"},
+		{"above the threshold", 4, 2, true, "6 of 100 records inconsistent (6.00%)"},
+		{"consistent", 0, 0, false, "0 of 100 records inconsistent (0.00%)"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := miniredis.RunT(t)
+			shadowless := seedInconsistent(t, m, tc.missing, tc.duplicates)
+			args := []string{redisURI(m), "10.8.0.1", "10.8.0.200", "1h", "strict_consistency=true", "strict_threshold=5"}
+
+			if tc.refused {
+				before := len(Instances())
+				_, err := setup4(args...)
+				if err == nil {
+					t.Fatal("setup4 succeeded above the threshold")
+				}
+				if !strings.Contains(err.Error(), tc.want) || strings.Count(err.Error(), IssueMissingShadow+":") != tc.missing ||
+					strings.Count(err.Error(), IssueDuplicateIP+":") != tc.duplicates {
+					t.Errorf("error does not report the issues: %v", err)
+				}
+				if len(Instances()) != before {
+					t.Error("refused instance registered")
+				}
+				// nothing was pruned
+				for _, mac := range shadowless {
+					if m.Exists(defaultKeySpace.shadow + mac) {
+						t.Errorf("shadow key of %s restored by a refused setup", mac)
+					}
+				}
+				if n := len(m.Keys()); n < 200-tc.missing {
+					t.Errorf("%d keys left, records deleted by a refused setup", n)
+				}
+				return
+			}
+
+			p := startPlugin(t, m, args[1:]...)
+			if got := p.startup.String(); !strings.HasPrefix(got, tc.want) {
+				t.Errorf("startup report %q, want %q", got, tc.want)
+			}
+			// repaired as usual
+			for _, mac := range shadowless {
+				if !m.Exists(p.storage.ns.shadow + mac) {
+					t.Errorf("shadow key of %s not restored", mac)
+				}
+			}
+			if n := p.leases.len(); n != 100-tc.duplicates {
+				t.Errorf("%d leases loaded, want %d", n, 100-tc.duplicates)
+			}
+		})
+	}
+}
+
+func TestInconsistencyToleratedWithoutStrictMode(t *testing.T) {
+	m := miniredis.RunT(t)
+	seedInconsistent(t, m, 30, 20)
+	p := startPlugin(t, m, "10.8.0.1", "10.8.0.200", "1h")
+	if pct := p.startup.Percent(); pct != 50 {
+		t.Errorf("startup report of %.2f%% inconsistent records, want 50%%", pct)
+	}
+}
@@ -0,0 +1,170 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// REDIS_BACKFILL_STATE_KEY holds the checkpoint of an interrupted backfill, in
+// the default namespace
+const REDIS_BACKFILL_STATE_KEY = "x:dhcp:backfill"
+
+// minimum time between two PTR lookups of a backfill
+const backfillLookupDelay = 50 * time.Millisecond
+
+// ErrBackfillRunning is returned when a backfill is started while one is
+// running
+var ErrBackfillRunning = errors.New("a hostname backfill is already running")
+
+// BackfillResult is the outcome of a hostname backfill
+type BackfillResult struct {
+	Scanned int
+	Filled  int
+}
+
+// backfillState is the resume point of a backfill, kept in redis
+type backfillState struct {
+	BackfillResult
+	Cursor uint64
+}
+
+// backfiller serializes the hostname backfills of a plugin instance
+type backfiller struct {
+	mu sync.Mutex
+}
+
+// UpdateRecord replaces the record of mac, keeping the expiry of its keys.
+// The shadow key is left alone. Returns ErrNotFound if the record is gone.
+func (r *RedisProvider) UpdateRecord(ctx context.Context, mac string, record *Record) error {
+	recBytes, err := encodeRecord(record)
+	if err != nil {
+		return err
+	}
+	err = r.rdb.SetArgs(ctx, r.ns.main+mac, string(recBytes), redis.SetArgs{KeepTTL: true, Mode: "XX"}).Err()
+	if err == redis.Nil {
+		return fmt.Errorf("%w: %s", ErrNotFound, mac)
+	}
+	return unavailable(err)
+}
+
+// ReadHostnames reads a mapping of MAC addresses to host names in CSV
+// format, one <mac>,<hostname> per line
+func ReadHostnames(r io.Reader) (map[string]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	cr.Comment = '#'
+
+	hostnames := make(map[string]string)
+	for {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			return hostnames, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		mac, err := net.ParseMAC(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		hostnames[mac.String()] = strings.TrimSpace(fields[1])
+	}
+}
+
+// BackfillHostnames fills the empty host names of the active leases, from
+// hostnames if given, a mapping of client keys to host names, and from the
+// PTR records of their addresses otherwise. Lookups are throttled, records
+// already holding a host name are never modified, and the expiry of the
+// leases is kept. The progress is checkpointed in redis: an interrupted run
+// resumes on the next call.
+func (p *PluginState) BackfillHostnames(ctx context.Context, hostnames map[string]string) (*BackfillResult, error) {
+	if !p.backfiller.mu.TryLock() {
+		return nil, ErrBackfillRunning
+	}
+	defer p.backfiller.mu.Unlock()
+
+	st := &backfillState{}
+	resumed, err := p.storage.loadCheckpoint(ctx, p.storage.ns.backfill, st)
+	if err != nil {
+		return nil, err
+	}
+	if resumed {
+		log.Infof("hostname backfill: resuming after %d records", st.Scanned)
+	}
+
+	for {
+		records, next, err := p.storage.ScanRecords(ctx, st.Cursor, exportChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		for mac, rec := range records {
+			st.Scanned++
+			if rec.Hostname != "" {
+				continue
+			}
+			name, err := p.backfillName(ctx, mac, rec.IP, hostnames)
+			if err != nil {
+				return nil, err
+			}
+			if name == "" {
+				continue
+			}
+			rec.Hostname = name
+			err = p.storage.UpdateRecord(ctx, mac, &rec)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("could not update lease of %s: %w", mac, err)
+			}
+			st.Filled++
+		}
+
+		st.Cursor = next
+		if st.Cursor == 0 {
+			break
+		}
+		if err := p.storage.saveCheckpoint(ctx, p.storage.ns.backfill, st); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.storage.clearCheckpoint(ctx, p.storage.ns.backfill); err != nil {
+		log.Warnf("hostname backfill: could not clear checkpoint: %v", err)
+	}
+	res := st.BackfillResult
+	log.Infof("hostname backfill: filled %d of %d leases", res.Filled, res.Scanned)
+	return &res, nil
+}
+
+// backfillName returns the host name of the client mac leasing ip, or an
+// empty string if it is unknown
+func (p *PluginState) backfillName(ctx context.Context, mac string, ip net.IP, hostnames map[string]string) (string, error) {
+	if hostnames != nil {
+		return sanitize(hostnames[mac], p.cfg.MaxHostname), nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-time.After(backfillLookupDelay):
+	}
+	lookupCtx, cancel := context.WithTimeout(ctx, p.cfg.PTRTimeout)
+	defer cancel()
+	names, err := p.ptr.lookup(lookupCtx, ip)
+	if err != nil || len(names) == 0 {
+		// a failing lookup leaves the record for the next run
+		return "", nil
+	}
+	return sanitize(names[0], p.cfg.MaxHostname), nil
+}
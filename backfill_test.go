@@ -0,0 +1,143 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestReadHostnames(t *testing.T) {
+	hostnames, err := ReadHostnames(strings.NewReader("# mac,hostname\n00-11-22-33-44-0A, laptop\n00:11:22:33:44:0b,printer\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hostnames) != 2 || hostnames["00:11:22:33:44:0a"] != "laptop" || hostnames["00:11:22:33:44:0b"] != "printer" {
+		t.Errorf("ReadHostnames: %v", hostnames)
+	}
+	for _, in := range []string{"not-a-mac,laptop\n", "00:11:22:33:44:0a\n", "00:11:22:33:44:0a,laptop,extra\n"} {
+		if _, err := ReadHostnames(strings.NewReader(in)); err == nil {
+			t.Errorf("ReadHostnames(%q) succeeded", in)
+		}
+	}
+}
+
+func TestBackfillHostnames(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.27.10", "10.0.27.20", "1h")
+	const named, resolved, unknown = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c"
+	ctx := context.Background()
+
+	ips := make(map[string]string)
+	for _, mac := range []string{named, resolved, unknown} {
+		ips[mac] = lease(t, p, mac).String()
+	}
+	rec, err := p.storage.GetRecord(named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Hostname = "kept"
+	if err := p.storage.UpdateRecord(ctx, named, rec); err != nil {
+		t.Fatal(err)
+	}
+	// the lookup of the named client would overwrite its host name
+	resolver := &fakeResolver{names: map[string][]string{
+		ips[named]:    {"other.example.com."},
+		ips[resolved]: {"desktop.example.com."},
+	}}
+	p.ptr.resolver = resolver
+
+	type expiry struct {
+		expires     time.Time
+		main, shadw time.Duration
+	}
+	expiries := func() map[string]expiry {
+		e := make(map[string]expiry)
+		for mac := range ips {
+			rec, err := p.storage.GetRecord(mac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e[mac] = expiry{rec.Expires, m.TTL(keyPrefix(p, "main") + mac), m.TTL(keyPrefix(p, "shadow") + mac)}
+		}
+		return e
+	}
+	before := expiries()
+
+	res, err := p.BackfillHostnames(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Scanned != 3 || res.Filled != 1 {
+		t.Errorf("backfill filled %d of %d leases, want 1 of 3", res.Filled, res.Scanned)
+	}
+	for mac, want := range map[string]string{named: "kept", resolved: "desktop.example.com", unknown: ""} {
+		if rec, err := p.storage.GetRecord(mac); err != nil || rec.Hostname != want {
+			t.Errorf("host name of %s: %v, %v, want %q", mac, rec, err, want)
+		}
+	}
+	if n := resolver.lookups.Load(); n != 2 {
+		t.Errorf("%d lookups, want 2 for the leases without host name", n)
+	}
+	for mac, e := range expiries() {
+		if e.main != before[mac].main || e.shadw != before[mac].shadw || !e.expires.Equal(before[mac].expires) {
+			t.Errorf("expiry of %s changed from %+v to %+v", mac, before[mac], e)
+		}
+	}
+	if m.Exists(REDIS_BACKFILL_STATE_KEY) {
+		t.Error("checkpoint left after the backfill")
+	}
+
+	// a second run changes nothing, the failed lookup is cached
+	if res, err = p.BackfillHostnames(ctx, nil); err != nil || res.Filled != 0 {
+		t.Errorf("second backfill: %+v, %v", res, err)
+	}
+	if n := resolver.lookups.Load(); n != 2 {
+		t.Errorf("%d lookups after the second backfill, want 2", n)
+	}
+
+	// the mapping is used instead of the resolver
+	if res, err = p.BackfillHostnames(ctx, map[string]string{named: "other", unknown: "printer"}); err != nil || res.Filled != 1 {
+		t.Errorf("backfill from a mapping: %+v, %v", res, err)
+	}
+	for mac, want := range map[string]string{named: "kept", unknown: "printer"} {
+		if rec, err := p.storage.GetRecord(mac); err != nil || rec.Hostname != want {
+			t.Errorf("host name of %s: %v, %v, want %q", mac, rec, err, want)
+		}
+	}
+	if n := resolver.lookups.Load(); n != 2 {
+		t.Errorf("%d lookups during a backfill from a mapping", n)
+	}
+}
+
+func TestBackfillResume(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.27.10", "10.0.27.20", "1h")
+	const mac = "00:11:22:33:44:0a"
+	ctx := context.Background()
+	lease(t, p, mac)
+
+	// an interrupted run, which filled 2 of 5 leases
+	st := &backfillState{BackfillResult: BackfillResult{Scanned: 5, Filled: 2}}
+	if err := p.storage.saveCheckpoint(ctx, REDIS_BACKFILL_STATE_KEY, st); err != nil {
+		t.Fatal(err)
+	}
+	res, err := p.BackfillHostnames(ctx, map[string]string{mac: "laptop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Scanned != 6 || res.Filled != 3 {
+		t.Errorf("resumed backfill filled %d of %d leases, want 3 of 6", res.Filled, res.Scanned)
+	}
+	if m.Exists(REDIS_BACKFILL_STATE_KEY) {
+		t.Error("checkpoint left after the resumed backfill")
+	}
+
+	p.backfiller.mu.Lock()
+	defer p.backfiller.mu.Unlock()
+	if _, err := p.BackfillHostnames(ctx, nil); err != ErrBackfillRunning {
+		t.Errorf("concurrent backfill: %v, want ErrBackfillRunning", err)
+	}
+}
@@ -0,0 +1,115 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// StorageCapabilities describes what a redis endpoint supports among the
+// features the plugin depends on
+type StorageCapabilities struct {
+	// Select is set if the endpoint serves databases other than 0
+	Select bool
+}
+
+// ErrClusterUnsupported means a uri points to a redis cluster. The scripts
+// committing a record along with its shadow key and index entry, and the
+// circuit quota, touch keys of several hash slots, which a cluster refuses.
+var ErrClusterUnsupported = errors.New("redis cluster is not supported")
+
+// isCluster reports whether rdb is connected to a node of a redis cluster
+func isCluster(ctx context.Context, rdb *redis.Client) bool {
+	info, err := rdb.Info(ctx, "cluster").Result()
+	return err == nil && strings.Contains(info, "cluster_enabled:1")
+}
+
+// detectCapabilities probes the endpoint of opt for database db, or for
+// database 1 if db is 0, which every endpoint serves. The probe is a SELECT
+// on a connection of its own, closed afterwards, so that the connections of
+// the clients stay on their database.
+func detectCapabilities(ctx context.Context, opt *redis.Options, db int) StorageCapabilities {
+	if db == 0 {
+		db = 1
+	}
+	probeOpt := *opt
+	probeOpt.DB = 0
+	probeOpt.PoolSize = 1
+	probe := redis.NewClient(&probeOpt)
+	defer probe.Close()
+
+	conn := probe.Conn()
+	defer conn.Close()
+	return StorageCapabilities{Select: conn.Select(ctx, db).Err() == nil}
+}
+
+// errNoDatabase means a uri selects a database the server does not serve
+var errNoDatabase = errors.New("database not served")
+
+// connect opens a client for opt, named option in the configuration, and
+// detects the capabilities of its endpoint. A database the endpoint does
+// not serve is reported as such rather than as a failed connection, and a
+// cluster is refused.
+func connect(opt *redis.Options, option string) (*redis.Client, StorageCapabilities, error) {
+	ctx := context.TODO()
+	rdb := redis.NewClient(opt)
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		if opt.DB == 0 {
+			return nil, StorageCapabilities{}, err
+		}
+		// probe on database 0, the selection may be what failed
+		probeOpt := *opt
+		probeOpt.DB = 0
+		probe := redis.NewClient(&probeOpt)
+		defer probe.Close()
+		if probe.Ping(ctx).Err() != nil {
+			return nil, StorageCapabilities{}, err
+		}
+		if isCluster(ctx, probe) {
+			return nil, StorageCapabilities{}, clusterError(option)
+		}
+		if derr := checkDatabase(detectCapabilities(ctx, opt, opt.DB), opt.DB, option); derr != nil {
+			return nil, StorageCapabilities{}, derr
+		}
+		return nil, StorageCapabilities{}, err
+	}
+	if isCluster(ctx, rdb) {
+		rdb.Close()
+		return nil, StorageCapabilities{}, clusterError(option)
+	}
+	caps := detectCapabilities(ctx, opt, opt.DB)
+	if err := checkDatabase(caps, opt.DB, option); err != nil {
+		rdb.Close()
+		return nil, caps, err
+	}
+	return rdb, caps, nil
+}
+
+func clusterError(option string) error {
+	return fmt.Errorf("%w: %s points to a node of a redis cluster, use a standalone or replicated server", ErrClusterUnsupported, option)
+}
+
+// checkDatabase fails if the endpoint cannot serve database db, naming
+// option as the culprit
+func checkDatabase(caps StorageCapabilities, db int, option string) error {
+	if db == 0 || caps.Select {
+		return nil
+	}
+	return fmt.Errorf("%w: %s selects database %d, but the server only serves database 0, drop the database from the uri",
+		errNoDatabase, option, db)
+}
+
+// expiredChannel returns the channel of the keyevent notifications of
+// expired keys of database db
+func expiredChannel(db int) string {
+	return fmt.Sprintf("__keyevent@%d__:expired", db)
+}
+
+// Capabilities returns what the primary endpoint supports
+func (r *RedisProvider) Capabilities() StorageCapabilities {
+	return r.caps
+}
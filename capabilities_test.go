@@ -0,0 +1,122 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/go-redis/redis/v9"
+)
+
+// emulate has m answer INFO as a node of a cluster if cluster is set, and
+// refuse to SELECT a database other than 0 unless databases is set
+func emulate(m *miniredis.Miniredis, cluster, databases bool) {
+	m.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		switch {
+		case cmd == "INFO" && cluster:
+			c.WriteBulk("# Cluster\r\ncluster_enabled:1\r\n")
+			return true
+		case cmd == "SELECT" && !databases && len(args) == 1 && args[0] != "0":
+			c.WriteError("ERR DB index is out of range")
+			return true
+		}
+		return false
+	})
+}
+
+func TestConnectStandalone(t *testing.T) {
+	m := miniredis.RunT(t)
+	rdb, caps, err := connect(&redis.Options{Addr: m.Addr()}, "uri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+	if !caps.Select {
+		t.Error("databases not detected")
+	}
+	// the probe leaves the connections of the client on their database
+	for i := 0; i < 10; i++ {
+		if err := rdb.Set(context.Background(), "k"+strconv.Itoa(i), "v", 0).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(m.DB(0).Keys()); n != 10 {
+		t.Errorf("%d keys in database 0, want 10", n)
+	}
+}
+
+func TestConnectWithoutDatabases(t *testing.T) {
+	m := miniredis.RunT(t)
+	emulate(m, false, false)
+
+	rdb, caps, err := connect(&redis.Options{Addr: m.Addr()}, "uri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb.Close()
+	if caps.Select {
+		t.Error("databases detected on a server serving database 0 only")
+	}
+
+	_, _, err = connect(&redis.Options{Addr: m.Addr(), DB: 2}, "history_uri")
+	if !errors.Is(err, errNoDatabase) {
+		t.Fatalf("got %v, want %v", err, errNoDatabase)
+	}
+}
+
+func TestConnectRefusesCluster(t *testing.T) {
+	m := miniredis.RunT(t)
+	emulate(m, true, false)
+	for _, db := range []int{0, 3} {
+		if _, _, err := connect(&redis.Options{Addr: m.Addr(), DB: db}, "uri"); !errors.Is(err, ErrClusterUnsupported) {
+			t.Errorf("database %d: got %v, want %v", db, err, ErrClusterUnsupported)
+		}
+	}
+}
+
+func TestHoldCircuitQuota(t *testing.T) {
+	m := miniredis.RunT(t)
+	r, err := InitStorage(redisURI(m), StorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	ctx := context.Background()
+	circuit := defaultKeySpace.circuitKey(nil, "port1")
+
+	hold := func(mac, mode string) bool {
+		t.Helper()
+		ok, err := r.HoldCircuit(ctx, circuit, mac, 2, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	for _, mac := range []string{"00:00:00:00:00:01", "00:00:00:00:00:02"} {
+		m.Set(REDIS_KEY_PREFIX+mac, "{}")
+		if !hold(mac, circuitHold) {
+			t.Fatalf("%s refused below the quota", mac)
+		}
+	}
+	if hold("00:00:00:00:00:03", circuitHold) {
+		t.Fatal("client let through over the quota")
+	}
+	if !hold("00:00:00:00:00:01", circuitHold) {
+		t.Error("member refused")
+	}
+
+	// the lease of a member ended without its release
+	m.Del(REDIS_KEY_PREFIX + "00:00:00:00:00:02")
+	if !hold("00:00:00:00:00:03", circuitPeek) {
+		t.Error("peek refused with room left by an ended lease")
+	}
+	if !hold("00:00:00:00:00:03", circuitHold) {
+		t.Error("client refused with room left by an ended lease")
+	}
+	if ok, _ := m.SIsMember(circuit, "00:00:00:00:00:02"); ok {
+		t.Error("member of an ended lease kept")
+	}
+}
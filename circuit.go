@@ -0,0 +1,121 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// REDIS_CIRCUIT_KEY_PREFIX prefixes the sets of the clients with a lease
+// on a relay circuit, keyed by <relay>:<circuit ID>, which the circuit
+// quota is enforced on. The circuit ID is the normalized one of option 82,
+// and the relay 0.0.0.0 for an agent leaving giaddr unset. It is the
+// prefix of the default namespace, see keySpace.
+const REDIS_CIRCUIT_KEY_PREFIX = "x:dhcp:circuit:"
+
+// Modes of holdCircuitScript
+const (
+	circuitHold  = "hold"
+	circuitForce = "force"
+	circuitPeek  = "peek"
+)
+
+// holdCircuitScript adds a client to the clients with a lease on a circuit,
+// unless they reach the quota; a client already among them is always let
+// through. The members whose record is gone are dropped before refusing
+// one, as a lease ending without its release, e.g. on a crash, leaves its
+// member behind. Mode force adds the client whatever the quota, and peek
+// only reports whether it would be added. The records of the members are
+// declared keys, as read before the script: a member added since is
+// counted live.
+// KEYS: circuit, records of its members. ARGV: client key, quota, prefix of
+// the records, mode.
+var holdCircuitScript = redis.NewScript(`
+if redis.call('SISMEMBER', KEYS[1], ARGV[1]) == 1 then
+	return 1
+end
+local quota = tonumber(ARGV[2])
+if ARGV[4] ~= 'force' and redis.call('SCARD', KEYS[1]) >= quota then
+	local declared = {}
+	for i = 2, #KEYS do
+		declared[KEYS[i]] = true
+	end
+	local live = 0
+	for _, m in ipairs(redis.call('SMEMBERS', KEYS[1])) do
+		local record = ARGV[3] .. m
+		if not declared[record] or redis.call('EXISTS', record) == 1 then
+			live = live + 1
+		elseif ARGV[4] ~= 'peek' then
+			redis.call('SREM', KEYS[1], m)
+		end
+	end
+	if live >= quota then
+		return 0
+	end
+end
+if ARGV[4] ~= 'peek' then
+	redis.call('SADD', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// circuitID names the circuit of a relay, <relay>:<circuit ID>
+func circuitID(relay net.IP, circuit string) string {
+	if relay == nil {
+		relay = net.IPv4zero
+	}
+	return relay.String() + ":" + circuit
+}
+
+// circuitKey returns the key of the circuit of a relay
+func (ns keySpace) circuitKey(relay net.IP, circuit string) string {
+	return ns.circuit + circuitID(relay, circuit)
+}
+
+// HoldCircuit counts the lease of mac on circuit, and reports false
+// without counting it if the leases of the circuit reach quota
+func (r *RedisProvider) HoldCircuit(ctx context.Context, circuit, mac string, quota int, mode string) (bool, error) {
+	members, err := r.rdb.SMembers(ctx, circuit).Result()
+	if err != nil {
+		return false, unavailable(err)
+	}
+	keys := make([]string, 0, len(members)+1)
+	keys = append(keys, circuit)
+	for _, m := range members {
+		keys = append(keys, r.ns.main+m)
+	}
+	n, err := holdCircuitScript.Run(ctx, r.rdb, keys, mac, quota, r.ns.main, mode).Int()
+	return n == 1, unavailable(err)
+}
+
+// ReleaseCircuit stops counting the lease of mac on circuit
+func (r *RedisProvider) ReleaseCircuit(ctx context.Context, circuit, mac string) error {
+	return unavailable(r.rdb.SRem(ctx, circuit, mac).Err())
+}
+
+// circuitAllows reports whether the circuit of req leaves room for a new
+// lease of mac, counting it if so unless mode is circuitPeek. A request
+// without a circuit ID is exempt. A failing redis lets the lease through.
+func (p *PluginState) circuitAllows(ctx context.Context, req *dhcpv4.DHCPv4, circuit, mac string, mode string) bool {
+	if p.cfg.CircuitQuota == 0 || circuit == "" {
+		return true
+	}
+	ok, err := p.storage.HoldCircuit(ctx, p.storage.ns.circuitKey(relayOf(req), circuit), mac, p.cfg.CircuitQuota, mode)
+	if err != nil {
+		log.Debugf("could not count the lease of MAC %s on circuit %s: %v", mac, circuit, err)
+		return true
+	}
+	return ok
+}
+
+// releaseCircuit stops counting the lease of rec on its circuit
+func (p *PluginState) releaseCircuit(mac string, rec *Record) {
+	if p.cfg.CircuitQuota == 0 || rec.CircuitID == "" {
+		return
+	}
+	if err := p.storage.ReleaseCircuit(context.TODO(), p.storage.ns.circuitKey(rec.Relay, rec.CircuitID), mac); err != nil {
+		log.Debugf("could not release the lease of MAC %s on circuit %s: %v", mac, rec.CircuitID, err)
+	}
+}
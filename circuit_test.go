@@ -0,0 +1,151 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// circuitRelay relays the requests of the circuit quota tests
+var circuitRelay = net.IPv4(10, 70, 0, 1).To4()
+
+// onCircuit returns a message of type typ from mac relayed by circuitRelay
+// from circuit, without option 82 if circuit is empty
+func onCircuit(t *testing.T, typ dhcpv4.MessageType, mac, circuit string, mods ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	t.Helper()
+	mods = append([]dhcpv4.Modifier{dhcpv4.WithGatewayIP(circuitRelay)}, mods...)
+	if circuit != "" {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(
+			dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte(circuit)))))
+	}
+	return newRequest(t, typ, mac, mods...)
+}
+
+// leaseOn has mac discover and request an address through circuit, and
+// returns the address acknowledged, nil if the DISCOVER got no offer
+func leaseOn(t *testing.T, p *PluginState, mac, circuit string) net.IP {
+	t.Helper()
+	offer := exchange(t, p, onCircuit(t, dhcpv4.MessageTypeDiscover, mac, circuit))
+	if offer == nil || offer.YourIPAddr.IsUnspecified() {
+		return nil
+	}
+	ack := exchange(t, p, onCircuit(t, dhcpv4.MessageTypeRequest, mac, circuit,
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(offer.YourIPAddr))))
+	if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("no ACK to %s: %v", mac, ack)
+	}
+	return ack.YourIPAddr
+}
+
+// members returns the clients counted on circuit, sorted
+func members(t *testing.T, m *miniredis.Miniredis, p *PluginState, circuit string) []string {
+	t.Helper()
+	key := p.storage.ns.circuitKey(circuitRelay, p.decodeAgentInfo(onCircuit(t, dhcpv4.MessageTypeDiscover, "00:00:00:00:00:00", circuit)).CircuitID)
+	if !m.Exists(key) {
+		return nil
+	}
+	got, err := m.Members(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestCircuitQuota(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.70.10", "10.0.70.20", "1h", "circuit_quota=2")
+	const a, b, c, d, e = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c", "00:11:22:33:44:0d", "00:11:22:33:44:0e"
+
+	ipA := leaseOn(t, p, a, "port1")
+	if ipA == nil || leaseOn(t, p, b, "port1") == nil {
+		t.Fatal("no lease under the quota")
+	}
+	if got := members(t, m, p, "port1"); len(got) != 2 || got[0] != a || got[1] != b {
+		t.Errorf("circuit holds %v", got)
+	}
+	// a new client over the quota is passed on to the next plugins
+	if ip := leaseOn(t, p, c, "port1"); ip != nil {
+		t.Errorf("%s leased over the quota", ip)
+	}
+	if _, err := p.storage.GetRecord(c); err == nil {
+		t.Errorf("record of %s written over the quota", c)
+	}
+	// other circuits and requests without option 82 are not bound by it
+	if leaseOn(t, p, c, "port2") == nil || leaseOn(t, p, d, "") == nil {
+		t.Error("no lease on another circuit or without a circuit")
+	}
+	// the evaluation predicts the refusal
+	hw, _ := net.ParseMAC(e)
+	ev, err := p.Evaluate(context.Background(), EvaluationRequest{MAC: hw, GatewayIP: circuitRelay, CircuitID: []byte("port1")})
+	if err != nil || ev.Action != ActionPass || ev.Reason != ReasonCircuitQuota {
+		t.Errorf("evaluation %v, %v", ev, err)
+	}
+
+	// renewals are exempt
+	if typ := exchange(t, p, onCircuit(t, dhcpv4.MessageTypeRequest, a, "port1", dhcpv4.WithClientIP(ipA))).MessageType(); typ != dhcpv4.MessageTypeAck {
+		t.Errorf("renewal answered %s", typ)
+	}
+
+	// a release and an expiry each make room for a new client
+	releaseLease(t, p, a, ipA)
+	if got := members(t, m, p, "port1"); len(got) != 1 || got[0] != b {
+		t.Errorf("circuit holds %v after the release", got)
+	}
+	if leaseOn(t, p, e, "port1") == nil {
+		t.Error("no lease after the release")
+	}
+	expire(t, m, p, b)
+	eventually(t, "the expiry", func() bool { return len(members(t, m, p, "port1")) == 1 })
+	if leaseOn(t, p, a, "port1") == nil {
+		t.Error("no lease after the expiry")
+	}
+
+	// a member whose record is gone, e.g. left behind by a crash, is
+	// dropped once the quota is reached
+	const f = "00:11:22:33:44:0f"
+	m.Del(p.storage.ns.main + e)
+	if leaseOn(t, p, f, "port1") == nil {
+		t.Error("no lease over a member without a record")
+	}
+	if got := members(t, m, p, "port1"); len(got) != 2 || got[0] != a || got[1] != f {
+		t.Errorf("circuit holds %v", got)
+	}
+}
+
+func TestCircuitQuotaNAK(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.71.10", "10.0.71.20", "1h", "circuit_quota=1", "circuit_quota_action=nak")
+	const a, b, c = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c"
+	if leaseOn(t, p, a, "port1") == nil {
+		t.Fatal("no lease under the quota")
+	}
+
+	// a DISCOVER over the quota is dropped, a REQUEST gets a NAK
+	if resp := exchange(t, p, onCircuit(t, dhcpv4.MessageTypeDiscover, b, "port1")); resp != nil {
+		t.Errorf("DISCOVER over the quota answered %s", resp.MessageType())
+	}
+	if resp := exchange(t, p, onCircuit(t, dhcpv4.MessageTypeRequest, b, "port1")); resp == nil || resp.MessageType() != dhcpv4.MessageTypeNak {
+		t.Errorf("REQUEST over the quota answered %v", resp)
+	}
+	hw, _ := net.ParseMAC(b)
+	ev, err := p.Evaluate(context.Background(), EvaluationRequest{MAC: hw, MessageType: dhcpv4.MessageTypeRequest, GatewayIP: circuitRelay, CircuitID: []byte("port1")})
+	if err != nil || ev.Action != ActionNAK || ev.Reason != ReasonCircuitQuota {
+		t.Errorf("evaluation %v, %v", ev, err)
+	}
+
+	// a client renewing an address unknown to redis keeps it, counted
+	// over the quota
+	ip := net.IPv4(10, 0, 71, 15).To4()
+	resp := exchange(t, p, onCircuit(t, dhcpv4.MessageTypeRequest, c, "port1", dhcpv4.WithClientIP(ip)))
+	if resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck || !resp.YourIPAddr.Equal(ip) {
+		t.Errorf("renewal of an unknown address answered %v", resp)
+	}
+	if got := members(t, m, p, "port1"); len(got) != 2 {
+		t.Errorf("circuit holds %v", got)
+	}
+}
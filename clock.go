@@ -0,0 +1,58 @@
+package rangeredisplugin
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Clock is the source of the current time of a plugin instance, replaceable
+// to simulate the passage of time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// instanceClock is the clock of an instance, the system clock until
+// replaced with SetClock while the instance runs
+type instanceClock struct {
+	v atomic.Value
+}
+
+// setClock is what an instanceClock holds, a clock of any type
+type setClock struct {
+	Clock
+	simulated bool
+}
+
+func newInstanceClock() *instanceClock {
+	c := &instanceClock{}
+	c.v.Store(setClock{Clock: systemClock{}})
+	return c
+}
+
+func (c *instanceClock) Now() time.Time {
+	return c.v.Load().(setClock).Now()
+}
+
+// simulated reports whether the clock was replaced with SetClock
+func (c *instanceClock) simulated() bool {
+	return c.v.Load().(setClock).simulated
+}
+
+// SetClock replaces the clock of the instance, e.g. with a simulated one
+// jumping from one request to the next. The jumps of such a clock are not
+// reported by the clock watchdog. The storage still derives the TTLs of the
+// keys from the system clock.
+func (p *PluginState) SetClock(clock Clock) {
+	p.clock.v.Store(setClock{Clock: clock, simulated: true})
+}
+
+// SetClock replaces the clock of the DHCPv6 instance, as for a DHCPv4 one
+func (p *PluginState6) SetClock(clock Clock) {
+	p.clock.v.Store(setClock{Clock: clock, simulated: true})
+}
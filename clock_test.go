@@ -0,0 +1,27 @@
+package rangeredisplugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestSetClockDrivesTheLeases(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.0.10", "10.0.0.20", "1h")
+	if !p.clock.simulated() {
+		t.Fatal("the clock set is not reported simulated")
+	}
+
+	advance(p, 48*time.Hour)
+	const mac = "00:11:22:33:44:55"
+	lease(t, p, mac)
+	rec, err := p.storage.GetRecord(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := p.clock.Now().Add(time.Hour); !rec.Expires.Equal(want) {
+		t.Errorf("lease expires %s, want %s", rec.Expires, want)
+	}
+}
@@ -0,0 +1,222 @@
+// Command demo checks that a redis server is fit for the range-redis plugin,
+// and shows the lifecycle of a lease through a coredhcp server. It starts a
+// server from a configuration running the server_id and range-redis
+// plugins, listening on 127.0.0.1:6767 and leasing in the demo namespace of
+// the database so that the leases of a live pool are left alone. It then
+// relays a client to it over UDP, as a relay agent at 127.0.0.1 would: the
+// client gets, renews and lets a short lease of 192.0.2.10 run out while
+// the replies and the lease events are printed.
+//
+// The redis URI is taken from REDIS_URI, redis://localhost:6379/0 if unset.
+// The server answers a relay agent on port 67, which the demo binds on the
+// loopback: it takes root or CAP_NET_BIND_SERVICE.
+//
+//	sudo REDIS_URI=redis://localhost:6379/0 go run ./cmd/demo
+//
+// It fails if redis does not publish the keyevent notifications of expired
+// keys, which the plugin needs to free the addresses of the leases ended.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/coredhcp/coredhcp/plugins/serverid"
+	"github.com/coredhcp/coredhcp/server"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+
+	rangeredisplugin "coredhcpcomplie/coredhcp-rangeredis"
+)
+
+const defaultURI = "redis://localhost:6379/0"
+
+// leaseTime is the lease of the demo, expiryTimeout the time its expiry
+// may take to be notified past its end, replyTimeout the time the server
+// may take to answer
+const (
+	leaseTime     = 3 * time.Second
+	expiryTimeout = 10 * time.Second
+	replyTimeout  = 5 * time.Second
+)
+
+// the addresses of the server and of the relay agent, which is also the
+// server identifier
+var (
+	serverAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6767}
+	relayAddr  = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: dhcpv4.ServerPort}
+)
+
+// configTemplate is the configuration of the server, given its listen
+// address, its identifier, the redis URI and the lease time
+const configTemplate = `server4:
+  listen:
+    - "%s"
+  plugins:
+    - server_id: %s
+    - range-redis: %s 192.0.2.10 192.0.2.19 %s prefix=demo
+`
+
+// the client of the demo
+var client = net.HardwareAddr{0x02, 0x00, 0x5e, 0x00, 0x00, 0x01}
+
+// events receives the lease events of every instance
+var events = make(chan rangeredisplugin.Event, 64)
+
+type eventSink struct{}
+
+func (eventSink) HandleEvent(ev rangeredisplugin.Event) {
+	select {
+	case events <- ev:
+	default:
+	}
+}
+
+func init() {
+	rangeredisplugin.RegisterEventSink(eventSink{})
+	for _, p := range []*plugins.Plugin{&serverid.Plugin, &rangeredisplugin.Plugin} {
+		if err := plugins.RegisterPlugin(p); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func main() {
+	uri := os.Getenv("REDIS_URI")
+	if uri == "" {
+		uri = defaultURI
+	}
+	if err := run(context.Background(), uri, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "demo:", err)
+		os.Exit(1)
+	}
+}
+
+// run checks the redis server of uri and plays the lifecycle of a lease
+// through a server using it, writing what happens to out
+func run(ctx context.Context, uri string, out io.Writer) error {
+	dir, err := os.MkdirTemp("", "demo")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+	conf := fmt.Sprintf(configTemplate, serverAddr, relayAddr.IP, uri, leaseTime)
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		return err
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		return fmt.Errorf("could not load the configuration: %w", err)
+	}
+	srv, err := server.Start(cfg)
+	if err != nil {
+		return fmt.Errorf("could not start the server: %w", err)
+	}
+	all := rangeredisplugin.Instances()
+	p := all[len(all)-1]
+	defer func() {
+		srv.Close()
+		p.Close(context.Background())
+	}()
+	fmt.Fprintf(out, "server listening on %s with:\n%s", serverAddr, conf)
+
+	err = p.Storage().CheckNotifications(ctx)
+	switch {
+	case errors.Is(err, rangeredisplugin.ErrNotificationsDisabled):
+		return fmt.Errorf("leases would never be freed: %w; run CONFIG SET notify-keyspace-events Ex or set it in redis.conf", err)
+	case err != nil:
+		// CONFIG is often disabled on managed offerings: the expiry tells
+		fmt.Fprintf(out, "could not read notify-keyspace-events (%v), checking the expiry of a lease instead\n", err)
+	default:
+		fmt.Fprintln(out, "notify-keyspace-events publishes the expired keys")
+	}
+
+	relay, err := net.ListenUDP("udp4", relayAddr)
+	if err != nil {
+		return fmt.Errorf("could not listen as the relay agent, which takes root or CAP_NET_BIND_SERVICE: %w", err)
+	}
+	defer relay.Close()
+
+	offer, err := exchange(relay, out, dhcpv4.MessageTypeDiscover)
+	if err != nil {
+		return err
+	}
+	ip := offer.YourIPAddr
+	if _, err := exchange(relay, out, dhcpv4.MessageTypeRequest,
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(offer.ServerIdentifier()))); err != nil {
+		return err
+	}
+	if _, err := exchange(relay, out, dhcpv4.MessageTypeRequest, dhcpv4.WithClientIP(ip)); err != nil {
+		return err
+	}
+
+	timeout := time.After(leaseTime + expiryTimeout)
+	for {
+		select {
+		case ev := <-events:
+			if ev.MAC != client.String() {
+				continue
+			}
+			fmt.Fprintf(out, "event %s %s\n", ev.Type, ev.IP)
+			if ev.Type == rangeredisplugin.EventExpire {
+				fmt.Fprintln(out, "redis is ready for the plugin")
+				return nil
+			}
+		case <-timeout:
+			return errors.New("the lease did not expire: redis published no keyevent notification of its expiry, " +
+				"check notify-keyspace-events")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// exchange relays a message of type typ from the client to the server, and
+// returns its answer
+func exchange(relay *net.UDPConn, out io.Writer, typ dhcpv4.MessageType, mods ...dhcpv4.Modifier) (*dhcpv4.DHCPv4, error) {
+	req, err := dhcpv4.New(append([]dhcpv4.Modifier{
+		dhcpv4.WithHwAddr(client),
+		dhcpv4.WithMessageType(typ),
+		dhcpv4.WithGatewayIP(relayAddr.IP),
+	}, mods...)...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := relay.WriteToUDP(req.ToBytes(), serverAddr); err != nil {
+		return nil, err
+	}
+	want := dhcpv4.MessageTypeAck
+	if typ == dhcpv4.MessageTypeDiscover {
+		want = dhcpv4.MessageTypeOffer
+	}
+
+	buf := make([]byte, 1500)
+	if err := relay.SetReadDeadline(time.Now().Add(replyTimeout)); err != nil {
+		return nil, err
+	}
+	for {
+		n, _, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%s of %s not answered: %w", typ, client, err)
+		}
+		answer, err := dhcpv4.FromBytes(buf[:n])
+		if err != nil || answer.TransactionID != req.TransactionID {
+			continue
+		}
+		if answer.MessageType() != want {
+			return nil, fmt.Errorf("%s of %s answered with a %s, want a %s", typ, client, answer.MessageType(), want)
+		}
+		fmt.Fprintf(out, "%s -> %s %s for %s from %s\n", typ, want, answer.YourIPAddr,
+			answer.IPAddressLeaseTime(0), answer.ServerIdentifier())
+		return answer, nil
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+)
+
+// notify has m answer CONFIG GET notify-keyspace-events with flags, and
+// publish the expiry of the shadow keys of the demo once they run out in
+// real time, which miniredis does not do on its own
+func notify(t *testing.T, m *miniredis.Miniredis, flags string) {
+	m.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd == "CONFIG" && len(args) == 2 && strings.EqualFold(args[0], "GET") {
+			c.WriteLen(2)
+			c.WriteBulk(args[1])
+			c.WriteBulk(flags)
+			return true
+		}
+		return false
+	})
+	if !strings.Contains(flags, "E") {
+		return
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		const main, shadow = "demo:02:00:5e:00:00:01", "s:demo:02:00:5e:00:00:01"
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+			m.FastForward(50 * time.Millisecond)
+			if m.Exists(main) && !m.Exists(shadow) {
+				m.Publish("__keyevent@0__:expired", shadow)
+				return
+			}
+		}
+	}()
+}
+
+func TestRun(t *testing.T) {
+	// the relay agent listens on port 67
+	if c, err := net.ListenUDP("udp4", relayAddr); err != nil {
+		t.Skipf("cannot listen as the relay agent: %v", err)
+	} else {
+		c.Close()
+	}
+	m := miniredis.RunT(t)
+	notify(t, m, "Ex")
+	var out bytes.Buffer
+	if err := run(context.Background(), "redis://"+m.Addr()+"/0", &out); err != nil {
+		t.Fatalf("run: %v\n%s", err, out.String())
+	}
+	for _, want := range []string{"server listening on 127.0.0.1:6767", "OFFER 192.0.2.10", "ACK 192.0.2.10", "event grant 192.0.2.10", "event expire 192.0.2.10", "ready"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestRunWithoutNotifications(t *testing.T) {
+	m := miniredis.RunT(t)
+	notify(t, m, "")
+	err := run(context.Background(), "redis://"+m.Addr()+"/0", &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "notify-keyspace-events") {
+		t.Errorf("run = %v, want an error naming notify-keyspace-events", err)
+	}
+}
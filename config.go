@@ -0,0 +1,1050 @@
+package rangeredisplugin
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Config holds the parsed arguments of a plugin instance
+type Config struct {
+	URI string
+	// Ranges are the ranges of the pool in allocation order, and Start and
+	// End the lowest and the highest address of them. A pool given as a
+	// subnet, CIDR, has a single range.
+	CIDR      *net.IPNet
+	Ranges    []ipRange
+	Start     net.IP
+	End       net.IP
+	LeaseTime time.Duration
+	// LeaseMin and LeaseMax bound the lease time a client asks for, both
+	// LeaseTime unless set
+	LeaseMin, LeaseMax time.Duration
+	// T1 and T2 are the renewal and rebinding times announced to the
+	// clients, as fractions of the lease time granted
+	T1, T2 float64
+
+	// SecondaryURI enables the dual-write migration mode when set
+	SecondaryURI string
+	// KeyPrefix names the namespace of the records in the storage
+	KeyPrefix string
+	// Faults enables the fault injection into the storage, for testing
+	Faults bool
+	// FreezeInterval is the interval of the synchronization of the freeze
+	// list, read from FreezeURL if set, 0 disabling the freeze
+	FreezeInterval time.Duration
+	FreezeURL      string
+	// NeighborInterface enables the ARP table pre-population on that interface
+	NeighborInterface string
+	// AgentDecoder is the default decoder of relay agent sub-options, and
+	// RelayAgentDecoders overrides it per relay address
+	AgentDecoder       string
+	RelayAgentDecoders map[string]string
+	// ExpireAt replaces the fixed lease time by a daily cutoff
+	ExpireAt *ExpireAtPolicy
+	// HistoryLength is the number of past bindings kept per MAC, stored in
+	// HistoryURI if set or in the primary otherwise
+	HistoryLength int
+	HistoryURI    string
+	// RecoverHistory seeds preferred addresses from the history when the
+	// lease keyspace is found empty at startup
+	RecoverHistory bool
+	RecoverLimit   int
+	// StrictConsistency refuses to start when the share of inconsistent
+	// records found by the startup audit exceeds StrictThreshold percent
+	StrictConsistency bool
+	StrictThreshold   float64
+	// ExportDir or ExportS3 is the destination of the lease exports, run
+	// every day at ExportHour:ExportMinute if ExportDaily is set
+	ExportDir    string
+	ExportS3     *S3ExportWriter
+	ExportDaily  bool
+	ExportHour   int
+	ExportMinute int
+	// Mask (option 1), Routers (option 3), MTU (option 26) and Routes
+	// (option 121) are sent to the clients, replacing the values set by
+	// earlier plugins if OptionsOverride is set
+	Mask            net.IPMask
+	Routers         []net.IP
+	MTU             int
+	Routes          []*dhcpv4.Route
+	OptionsOverride bool
+	// Relays selects the requests served by the relay they came through,
+	// every request by default
+	Relays RelaySelector
+	// CircuitQuota bounds the leases of the clients on a relay circuit, 0
+	// for no bound. A new client over the quota is passed on to the next
+	// plugins, or refused with a NAK, as CircuitQuotaAction says.
+	CircuitQuota       int
+	CircuitQuotaAction string
+	// RelayEcho copies the relay agent information (option 82) of the
+	// requests into the replies, as required by RFC 3046
+	RelayEcho bool
+	// NakMismatch refuses with a DHCPNAK the REQUESTs of a client with a
+	// lease asking for another address, which are otherwise acknowledged
+	// with the address of the lease
+	NakMismatch bool
+	// AcceptUnknownHWTypes serves clients of hardware types without a known
+	// address length, keyed by the hex of their address
+	AcceptUnknownHWTypes bool
+	// AllowedPrefixes are the MAC address prefixes served, longest first;
+	// empty to serve every client
+	AllowedPrefixes []string
+	// Exclusions are never leased; ExclusionPolicy tells what happens to
+	// their active leases
+	Exclusions      []ipRange
+	ExclusionPolicy string
+	// Preassigned tells what to do with the replies whose address was set
+	// by an earlier plugin
+	Preassigned string
+	// OverlapPolicy tells whether a range overlapping the range of another
+	// live instance fails the setup or is only logged
+	OverlapPolicy string
+	// PTRPolicy enables the check of the PTR record of new addresses
+	// against the client host name, with a budget of PTRTimeout
+	PTRPolicy  string
+	PTRTimeout time.Duration
+	// Cooldown is how long freed addresses are withheld before being
+	// handed out again, unless the pool is exhausted; 0 disables it
+	Cooldown time.Duration
+	// OfferHold is how long an address offered to a DISCOVER is held for
+	// the REQUEST of the client, before it returns to the pool; 0 leases
+	// it for the whole lease time right away
+	OfferHold time.Duration
+	// DenyCacheTime is how long a lookup of the denylist is cached
+	DenyCacheTime time.Duration
+	// IdleTime enables the idle reclaim of the leases of clients not seen
+	// for that long, probing at most IdleProbes of them per sweep.
+	// IdleUnprobed reclaims them without a registered probe.
+	IdleTime     time.Duration
+	IdleProbes   int
+	IdleUnprobed bool
+	// MaxLeases limits the active leases of the pool below its size, 0 for
+	// no limit
+	MaxLeases int
+	// MinPrefixLength is the shortest prefix accepted for a pool given as a
+	// CIDR, and GatewayFirst leaves its first address to the gateway
+	MinPrefixLength int
+	GatewayFirst    bool
+	// OfferInterval is how long after a grant or a renewal the DISCOVERs
+	// of a client are answered from memory; 0 disables it
+	OfferInterval time.Duration
+	// SlowPathLimit bounds the new allocations in progress, each waiting
+	// at most SlowPathWait for its turn; 0 disables the limit
+	SlowPathLimit int
+	SlowPathWait  time.Duration
+	// CacheLimit bounds each in-memory structure keyed by client, and the
+	// structures together are expected to stay within MemoryBudget bytes
+	CacheLimit   int
+	MemoryBudget int64
+	// MaxHostname and MaxAgentInfo bound the host names and the decoded
+	// relay agent sub-options stored on records, in bytes
+	MaxHostname  int
+	MaxAgentInfo int
+	// ExpiryTolerance is how close to now an expiry counts as past
+	ExpiryTolerance time.Duration
+	// PressureBands shorten the leases as the utilization of all the pools
+	// sharing the storage grows, sorted by threshold. A band is left once
+	// the utilization falls PressureHysteresis points below its threshold.
+	PressureBands      []PressureBand
+	PressureHysteresis float64
+	// CheckInvariants enables the invariant checker, which logs or panics
+	// on divergence according to its value
+	CheckInvariants string
+	// OpLog is the number of allocator and binding operations kept in the
+	// operation log, 0 disabling it. OpLogStream also appends them to a
+	// redis stream trimmed to about as many entries.
+	OpLog       int
+	OpLogStream bool
+	// PrivacyKey enables the privacy mode, pseudonymizing the clients on
+	// the outbound surfaces with a hash keyed by it
+	PrivacyKey string
+	// LogLabels adds the labels of a lease to the log line of its reply
+	LogLabels bool
+	// ClockJumpThreshold is the smallest wall clock step handled as a jump
+	ClockJumpThreshold time.Duration
+	// Direction is the order addresses are handed out in, DirectionUp
+	// starting from the bottom of the range and DirectionDown from the top
+	Direction string
+	// Allocator names the implementation of the allocator of the pool, see
+	// allocatorFactories
+	Allocator string
+	// Roaming is the policy applied to a client with a lease showing up
+	// behind another relay; FlapThreshold moves within FlapWindow raise a
+	// flap event whatever the policy
+	Roaming       string
+	FlapThreshold int
+	FlapWindow    time.Duration
+	// ImportPrecedence settles the conflicts of an import of ISC dhcpd
+	// leases with the leases in redis: ImportRedisWins or ImportWins
+	ImportPrecedence string
+	// QuarantineTime is how long an address found in conflict is withheld,
+	// and DeclineTime how long an address declined by a client is
+	QuarantineTime time.Duration
+	DeclineTime    time.Duration
+	// TraceTime is how long a client is traced for by default; the targets
+	// are shared with the other instances if TraceShared is set, and the
+	// traces stored in redis if TraceLog is set
+	TraceTime   time.Duration
+	TraceShared bool
+	TraceLog    bool
+	// MaxExtension bounds the remaining time a bulk extension may guarantee
+	MaxExtension time.Duration
+
+	expireAtSet bool
+	// applied is when the configuration was put in effect
+	applied time.Time
+
+	// args are the arguments the configuration was parsed from, and
+	// rangeArgs the range as given in them
+	args      []string
+	rangeArgs string
+}
+
+// configOptions maps every optional key=value argument to its parser
+var configOptions = map[string]func(c *Config, val string) error{
+	"secondary": func(c *Config, val string) error {
+		if val == "" {
+			return errors.New("uri cannot be empty")
+		}
+		c.SecondaryURI = val
+		return nil
+	},
+	"prefix": func(c *Config, val string) error {
+		prefix, err := parseNamespace(val)
+		if err != nil {
+			return err
+		}
+		c.KeyPrefix = prefix
+		return nil
+	},
+	"faults": func(c *Config, val string) error {
+		enabled, err := strconv.ParseBool(val)
+		if err != nil {
+			return errors.New("want true or false")
+		}
+		if enabled && !faultsAvailable {
+			return errors.New("fault injection needs a build with the faults tag")
+		}
+		c.Faults = enabled
+		return nil
+	},
+	"freeze_interval": func(c *Config, val string) error {
+		d, err := parseDuration(val, optionalLeaseBounds)
+		c.FreezeInterval = d
+		return err
+	},
+	"freeze_url": func(c *Config, val string) error {
+		u, err := url.Parse(val)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return errors.New("want an https:// url")
+		}
+		c.FreezeURL = val
+		return nil
+	},
+	"neighbor": func(c *Config, val string) error {
+		if val == "" {
+			return errors.New("interface name cannot be empty")
+		}
+		c.NeighborInterface = val
+		return nil
+	},
+	"agent_decoder": func(c *Config, val string) error {
+		if _, ok := agentInfoDecoders[val]; !ok {
+			return fmt.Errorf("unknown decoder %q, want one of: %s", val, strings.Join(agentDecoderNames(), ", "))
+		}
+		c.AgentDecoder = val
+		return nil
+	},
+	"agent_decoder_relay": func(c *Config, val string) error {
+		c.RelayAgentDecoders = make(map[string]string)
+		for _, entry := range strings.Split(val, ",") {
+			relay, name, ok := strings.Cut(entry, ":")
+			ip := net.ParseIP(relay)
+			if !ok || ip.To4() == nil {
+				return fmt.Errorf("invalid entry %q, want <relay IPv4>:<decoder>", entry)
+			}
+			if _, ok := agentInfoDecoders[name]; !ok {
+				return fmt.Errorf("unknown decoder %q, want one of: %s", name, strings.Join(agentDecoderNames(), ", "))
+			}
+			c.RelayAgentDecoders[ip.String()] = name
+		}
+		return nil
+	},
+	"expire_at": func(c *Config, val string) error {
+		var err error
+		e := c.expireAt()
+		e.Hour, e.Minute, err = parseCutoff(val)
+		c.expireAtSet = err == nil
+		return err
+	},
+	"expire_at_tz": func(c *Config, val string) error {
+		loc, err := time.LoadLocation(val)
+		if err != nil {
+			return err
+		}
+		c.expireAt().Location = loc
+		return nil
+	},
+	"expire_at_days": func(c *Config, val string) error {
+		days, err := parseWeekdays(val)
+		if err != nil {
+			return err
+		}
+		c.expireAt().Days = days
+		return nil
+	},
+	"expire_at_min": func(c *Config, val string) error {
+		d, err := parseDuration(val, leaseBounds)
+		c.expireAt().Min = d
+		return err
+	},
+	"history": func(c *Config, val string) error {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return errors.New("want a non-negative number of entries")
+		}
+		c.HistoryLength = n
+		return nil
+	},
+	"history_uri": func(c *Config, val string) error {
+		if val == "" {
+			return errors.New("uri cannot be empty")
+		}
+		c.HistoryURI = val
+		return nil
+	},
+	"recover": func(c *Config, val string) error {
+		if val != "history" {
+			return errors.New("the only supported recovery source is history")
+		}
+		c.RecoverHistory = true
+		return nil
+	},
+	"recover_limit": func(c *Config, val string) error {
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= 0 {
+			return errors.New("want a positive number of MAC addresses")
+		}
+		c.RecoverLimit = n
+		return nil
+	},
+	"strict_consistency": func(c *Config, val string) error {
+		b, err := strconv.ParseBool(val)
+		c.StrictConsistency = b
+		return err
+	},
+	"strict_threshold": func(c *Config, val string) error {
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil || f < 0 || f > 100 {
+			return errors.New("want a percentage between 0 and 100")
+		}
+		c.StrictThreshold = f
+		return nil
+	},
+	"export_dir": func(c *Config, val string) error {
+		if val == "" {
+			return errors.New("directory cannot be empty")
+		}
+		c.ExportDir = val
+		return nil
+	},
+	"export_s3": func(c *Config, val string) error {
+		w, err := parseS3URI(val)
+		c.ExportS3 = w
+		return err
+	},
+	"export_at": func(c *Config, val string) error {
+		var err error
+		c.ExportHour, c.ExportMinute, err = parseCutoff(val)
+		c.ExportDaily = err == nil
+		return err
+	},
+	"mtu": func(c *Config, val string) error {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 68 || n > 65535 {
+			return errors.New("want an MTU between 68 and 65535")
+		}
+		c.MTU = n
+		return nil
+	},
+	"mask": func(c *Config, val string) error {
+		var err error
+		c.Mask, err = parseMask(val)
+		return err
+	},
+	"router": func(c *Config, val string) error {
+		c.Routers = nil
+		for _, s := range strings.Split(val, ",") {
+			ip := net.ParseIP(s).To4()
+			if ip == nil {
+				return fmt.Errorf("invalid IPv4 router %q", s)
+			}
+			c.Routers = append(c.Routers, ip)
+		}
+		return nil
+	},
+	"routes": func(c *Config, val string) error {
+		var err error
+		c.Routes, err = parseRoutes(val)
+		return err
+	},
+	"options_override": func(c *Config, val string) error {
+		b, err := strconv.ParseBool(val)
+		c.OptionsOverride = b
+		return err
+	},
+	"exclude": func(c *Config, val string) error {
+		var err error
+		c.Exclusions, err = parseExclusions(val)
+		return err
+	},
+	"exclusion_policy": func(c *Config, val string) error {
+		if val != ExclusionDrain && val != ExclusionEvict {
+			return fmt.Errorf("want %s or %s", ExclusionDrain, ExclusionEvict)
+		}
+		c.ExclusionPolicy = val
+		return nil
+	},
+	"preassigned": func(c *Config, val string) error {
+		if val != PreassignedIgnore && val != PreassignedAdopt {
+			return fmt.Errorf("want %s or %s", PreassignedIgnore, PreassignedAdopt)
+		}
+		c.Preassigned = val
+		return nil
+	},
+	"overlap_policy": func(c *Config, val string) error {
+		if val != OverlapRefuse && val != OverlapWarn {
+			return fmt.Errorf("want %s or %s", OverlapRefuse, OverlapWarn)
+		}
+		c.OverlapPolicy = val
+		return nil
+	},
+	"ptr_check": func(c *Config, val string) error {
+		switch val {
+		case PTRPrefer, PTRWarn, PTRCleanup:
+			c.PTRPolicy = val
+			return nil
+		}
+		return fmt.Errorf("want %s, %s or %s", PTRPrefer, PTRWarn, PTRCleanup)
+	},
+	"ptr_timeout": func(c *Config, val string) error {
+		d, err := parseDuration(val, timeoutBounds)
+		c.PTRTimeout = d
+		return err
+	},
+	"cooldown": func(c *Config, val string) error {
+		d, err := parseDuration(val, nonNegativeBounds)
+		c.Cooldown = d
+		return err
+	},
+	"offer_hold": func(c *Config, val string) error {
+		d, err := parseDuration(val, optionalLeaseBounds)
+		c.OfferHold = d
+		return err
+	},
+	"deny_cache_time": func(c *Config, val string) error {
+		d, err := parseDuration(val, nonNegativeBounds)
+		c.DenyCacheTime = d
+		return err
+	},
+	"lease_min": func(c *Config, val string) error {
+		d, err := parseDuration(val, leaseBounds)
+		c.LeaseMin = d
+		return err
+	},
+	"lease_max": func(c *Config, val string) error {
+		d, err := parseDuration(val, leaseBounds)
+		c.LeaseMax = d
+		return err
+	},
+	"t1": func(c *Config, val string) error {
+		f, err := parseTimerFraction(val)
+		c.T1 = f
+		return err
+	},
+	"t2": func(c *Config, val string) error {
+		f, err := parseTimerFraction(val)
+		c.T2 = f
+		return err
+	},
+	"idle_reclaim": func(c *Config, val string) error {
+		d, err := parseDuration(val, optionalLeaseBounds)
+		c.IdleTime = d
+		return err
+	},
+	"idle_probes": func(c *Config, val string) error {
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= 0 {
+			return errors.New("want a positive number of probes")
+		}
+		c.IdleProbes = n
+		return nil
+	},
+	"idle_unprobed": func(c *Config, val string) error {
+		b, err := strconv.ParseBool(val)
+		c.IdleUnprobed = b
+		return err
+	},
+	"max_leases": func(c *Config, val string) error {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return errors.New("want a non-negative number of leases")
+		}
+		c.MaxLeases = n
+		return nil
+	},
+	"min_prefix": func(c *Config, val string) error {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 || n > maxPrefixLength {
+			return fmt.Errorf("want a prefix length up to %d", maxPrefixLength)
+		}
+		c.MinPrefixLength = n
+		return nil
+	},
+	"gateway_first": func(c *Config, val string) error {
+		b, err := strconv.ParseBool(val)
+		c.GatewayFirst = b
+		return err
+	},
+	"offer_interval": func(c *Config, val string) error {
+		d, err := parseDuration(val, nonNegativeBounds)
+		c.OfferInterval = d
+		return err
+	},
+	"slow_path_limit": func(c *Config, val string) error {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return errors.New("want a non-negative number of allocations")
+		}
+		c.SlowPathLimit = n
+		return nil
+	},
+	"cache_limit": func(c *Config, val string) error {
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= 0 {
+			return errors.New("want a positive number of entries")
+		}
+		c.CacheLimit = n
+		return nil
+	},
+	"expiry_tolerance": func(c *Config, val string) error {
+		d, err := parseDuration(val, nonNegativeBounds)
+		c.ExpiryTolerance = d
+		return err
+	},
+	"pressure_bands": func(c *Config, val string) error {
+		bands, err := parsePressureBands(val)
+		c.PressureBands = bands
+		return err
+	},
+	"pressure_hysteresis": func(c *Config, val string) error {
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil || f < 0 || f >= 100 {
+			return errors.New("want a number of percentage points between 0 and 100")
+		}
+		c.PressureHysteresis = f
+		return nil
+	},
+	"check_invariants": func(c *Config, val string) error {
+		switch val {
+		case InvariantsLog, InvariantsPanic:
+			c.CheckInvariants = val
+		default:
+			return fmt.Errorf("want %s or %s", InvariantsLog, InvariantsPanic)
+		}
+		return nil
+	},
+	"oplog": func(c *Config, val string) error {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return errors.New("want a non-negative number of operations")
+		}
+		c.OpLog = n
+		return nil
+	},
+	"oplog_stream": func(c *Config, val string) error {
+		b, err := strconv.ParseBool(val)
+		c.OpLogStream = b
+		return err
+	},
+	"privacy_key": func(c *Config, val string) error {
+		if len(val) < 16 {
+			return errors.New("want a secret of at least 16 characters")
+		}
+		c.PrivacyKey = val
+		return nil
+	},
+	"relay": func(c *Config, val string) error {
+		s, err := parseRelaySelector(val)
+		c.Relays = s
+		return err
+	},
+	"max_hostname": func(c *Config, val string) error {
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= len(truncatedMark) {
+			return fmt.Errorf("want a number of bytes above %d", len(truncatedMark))
+		}
+		c.MaxHostname = n
+		return nil
+	},
+	"max_agent_info": func(c *Config, val string) error {
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= len(truncatedMark) {
+			return fmt.Errorf("want a number of bytes above %d", len(truncatedMark))
+		}
+		c.MaxAgentInfo = n
+		return nil
+	},
+	"memory_budget": func(c *Config, val string) error {
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || n <= 0 {
+			return errors.New("want a positive number of MiB")
+		}
+		c.MemoryBudget = n << 20
+		return nil
+	},
+	"slow_path_wait": func(c *Config, val string) error {
+		d, err := parseDuration(val, durationBounds{max: time.Minute})
+		c.SlowPathWait = d
+		return err
+	},
+	"clock_jump_threshold": func(c *Config, val string) error {
+		d, err := parseDuration(val, durationBounds{min: time.Second, max: 24 * time.Hour})
+		c.ClockJumpThreshold = d
+		return err
+	},
+	"circuit_quota": func(c *Config, val string) error {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return errors.New("want a number of leases")
+		}
+		c.CircuitQuota = n
+		return nil
+	},
+	"circuit_quota_action": func(c *Config, val string) error {
+		if val != ActionPass && val != ActionNAK {
+			return fmt.Errorf("want %s or %s", ActionPass, ActionNAK)
+		}
+		c.CircuitQuotaAction = val
+		return nil
+	},
+	"allocator": func(c *Config, val string) error {
+		var err error
+		c.Allocator, err = parseAllocator(val)
+		return err
+	},
+	"direction": func(c *Config, val string) error {
+		if val != DirectionUp && val != DirectionDown {
+			return fmt.Errorf("want %s or %s", DirectionUp, DirectionDown)
+		}
+		c.Direction = val
+		return nil
+	},
+	"quarantine_time": func(c *Config, val string) error {
+		d, err := parseDuration(val, leaseBounds)
+		c.QuarantineTime = d
+		return err
+	},
+	"roaming": func(c *Config, val string) error {
+		switch val {
+		case RoamingAlert, RoamingFollow, RoamingHold:
+			c.Roaming = val
+		default:
+			return fmt.Errorf("want %s, %s or %s", RoamingAlert, RoamingFollow, RoamingHold)
+		}
+		return nil
+	},
+	"import_precedence": func(c *Config, val string) error {
+		switch val {
+		case ImportRedisWins, ImportWins:
+			c.ImportPrecedence = val
+		default:
+			return fmt.Errorf("want %s or %s", ImportRedisWins, ImportWins)
+		}
+		return nil
+	},
+	"flap_threshold": func(c *Config, val string) error {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 2 {
+			return errors.New("want a number of moves of at least 2")
+		}
+		c.FlapThreshold = n
+		return nil
+	},
+	"flap_window": func(c *Config, val string) error {
+		d, err := parseDuration(val, leaseBounds)
+		c.FlapWindow = d
+		return err
+	},
+	"decline_time": func(c *Config, val string) error {
+		d, err := parseDuration(val, leaseBounds)
+		c.DeclineTime = d
+		return err
+	},
+	"trace_time": func(c *Config, val string) error {
+		d, err := parseDuration(val, leaseBounds)
+		c.TraceTime = d
+		return err
+	},
+	"relay_echo": func(c *Config, val string) error {
+		b, err := strconv.ParseBool(val)
+		c.RelayEcho = b
+		return err
+	},
+	"nak_mismatch": func(c *Config, val string) error {
+		b, err := strconv.ParseBool(val)
+		c.NakMismatch = b
+		return err
+	},
+	"log_labels": func(c *Config, val string) error {
+		b, err := strconv.ParseBool(val)
+		c.LogLabels = b
+		return err
+	},
+	"trace_shared": func(c *Config, val string) error {
+		b, err := strconv.ParseBool(val)
+		c.TraceShared = b
+		return err
+	},
+	"trace_log": func(c *Config, val string) error {
+		b, err := strconv.ParseBool(val)
+		c.TraceLog = b
+		return err
+	},
+	"max_extension": func(c *Config, val string) error {
+		d, err := parseDuration(val, leaseBounds)
+		c.MaxExtension = d
+		return err
+	},
+	"allow_macs": func(c *Config, val string) error {
+		var err error
+		c.AllowedPrefixes, err = parseMACPrefixes(val)
+		return err
+	},
+	"unknown_hwtypes": func(c *Config, val string) error {
+		switch val {
+		case "accept":
+			c.AcceptUnknownHWTypes = true
+		case "reject":
+			c.AcceptUnknownHWTypes = false
+		default:
+			return errors.New("want accept or reject")
+		}
+		return nil
+	},
+}
+
+// namedArgs are the arguments that may be given by name instead of by
+// position, in their positional order
+var namedArgs = []string{"uri", "range", "lease"}
+
+func isNamedArg(key string) bool {
+	for _, name := range namedArgs {
+		if key == name {
+			return true
+		}
+	}
+	return false
+}
+
+// positional rewrites arguments given by name, e.g. uri=redis://...
+// range=10.0.0.10-10.0.0.200 lease=12h, into their positional form, the
+// options following them. A range of two addresses <start>-<end> is split
+// into two arguments if splitRange is set. Arguments given by position,
+// the first one being the uri, are returned unchanged.
+func positional(args []string, splitRange bool) ([]string, error) {
+	if len(args) == 0 {
+		return args, nil
+	}
+	if key, _, ok := strings.Cut(args[0], "="); !ok || !isNamedArg(key) {
+		return args, nil
+	}
+
+	named := make(map[string]string, len(namedArgs))
+	var options []string
+	for _, arg := range args {
+		key, val, ok := strings.Cut(arg, "=")
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("invalid argument %q, want key=value", redactArg(arg))
+		case !isNamedArg(key):
+			options = append(options, arg)
+			continue
+		case val == "":
+			return nil, fmt.Errorf("argument %q cannot be empty", key)
+		case key == "range" && !strings.ContainsAny(val, "-/"):
+			return nil, fmt.Errorf("invalid range %q, want <start>-<end> or a CIDR", val)
+		}
+		if _, dup := named[key]; dup {
+			return nil, fmt.Errorf("argument %q given twice", key)
+		}
+		named[key] = val
+	}
+
+	out := make([]string, 0, len(namedArgs)+1+len(options))
+	for _, key := range namedArgs {
+		val, ok := named[key]
+		if !ok {
+			return nil, fmt.Errorf("missing argument %q, want %s=...", key, strings.Join(namedArgs, "=... "))
+		}
+		if start, end, ok := strings.Cut(val, "-"); ok && key == "range" && splitRange {
+			out = append(out, start, end)
+			continue
+		}
+		out = append(out, val)
+	}
+	return append(out, options...), nil
+}
+
+// parseConfig parses the plugin arguments: four positional arguments
+// (uri, start IP, end IP, lease time), or three with a list of ranges
+// (uri, <start>-<end>,..., lease time) or a subnet (uri, CIDR, lease time),
+// followed by optional key=value pairs. The positional arguments may be
+// given by name instead, see positional.
+func parseConfig(args []string) (*Config, error) {
+	original := args
+	args, err := positional(args, false)
+	if err != nil {
+		return nil, err
+	}
+	n := 4
+	if len(args) > 1 && strings.ContainsAny(args[1], "-/") {
+		n = 3
+	}
+	if len(args) < n {
+		return nil, fmt.Errorf("invalid number of arguments, want: 4 (uri, start IP, end IP, lease time) or 3 (uri, ranges or CIDR, lease time), got: %d", len(args))
+	}
+
+	c := &Config{
+		args:               original,
+		URI:                args[0],
+		HistoryLength:      defaultHistoryLength,
+		RecoverLimit:       defaultRecoverLimit,
+		StrictThreshold:    defaultStrictThreshold,
+		ExclusionPolicy:    ExclusionDrain,
+		Preassigned:        PreassignedIgnore,
+		OverlapPolicy:      OverlapRefuse,
+		MaxExtension:       defaultMaxExtension,
+		QuarantineTime:     defaultQuarantineTime,
+		DeclineTime:        defaultQuarantineTime,
+		OfferHold:          defaultOfferHold,
+		DenyCacheTime:      defaultDenyCacheTime,
+		IdleProbes:         defaultIdleProbes,
+		Roaming:            RoamingAlert,
+		ImportPrecedence:   ImportRedisWins,
+		FlapThreshold:      defaultFlapThreshold,
+		FlapWindow:         defaultFlapWindow,
+		TraceTime:          defaultTraceTime,
+		PTRTimeout:         defaultPTRTimeout,
+		Direction:          DirectionUp,
+		Allocator:          defaultAllocator,
+		CircuitQuotaAction: ActionPass,
+		ClockJumpThreshold: defaultClockJumpThreshold,
+		RelayEcho:          true,
+		SlowPathWait:       defaultSlowPathWait,
+		CacheLimit:         defaultCacheLimit,
+		FreezeInterval:     defaultFreezeInterval,
+		MemoryBudget:       defaultMemoryBudget,
+		MaxHostname:        defaultMaxHostname,
+		ExpiryTolerance:    defaultExpiryTolerance,
+		PressureHysteresis: defaultPressureHysteresis,
+		MaxAgentInfo:       defaultMaxAgentInfo,
+		MinPrefixLength:    defaultMinPrefixLength,
+		T1:                 defaultT1,
+		T2:                 defaultT2,
+	}
+	if c.URI == "" {
+		return nil, errors.New("uri cannot be empty")
+	}
+	if strings.HasPrefix(c.URI, "file://") {
+		// the leases alone could live in a FileStore, but the reservations,
+		// quarantine, circuits, journal and coordination of the instances
+		// are kept in redis only
+		return nil, errors.New("file:// storage holds the lease records only (see OpenFileStore), the plugin needs a redis:// or rediss:// uri")
+	}
+	switch {
+	case strings.Contains(args[1], "/"):
+		if strings.ContainsAny(args[1], "-,") || net.ParseIP(args[2]) != nil {
+			return nil, errors.New("give the range either as a CIDR or as IP ranges, not both")
+		}
+		if _, c.CIDR, err = net.ParseCIDR(args[1]); err != nil || c.CIDR.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 subnet: %v", args[1])
+		}
+	case n == 3:
+		if c.Ranges, err = parseRanges(args[1]); err != nil {
+			return nil, err
+		}
+		c.Start, c.End = span(c.Ranges)
+	default:
+		if strings.Contains(args[2], "/") {
+			return nil, errors.New("give the range either as a CIDR or as IP ranges, not both")
+		}
+		c.Start = net.ParseIP(args[1])
+		if c.Start.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 address: %v", args[1])
+		}
+		c.End = net.ParseIP(args[2])
+		if c.End.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 address: %v", args[2])
+		}
+		if binary.BigEndian.Uint32(c.Start.To4()) >= binary.BigEndian.Uint32(c.End.To4()) {
+			return nil, errors.New("start of IP range has to be lower than the end of an IP range")
+		}
+		c.Ranges = []ipRange{{Start: c.Start.To4(), End: c.End.To4()}}
+	}
+	c.rangeArgs = args[1]
+	if n == 4 {
+		c.rangeArgs += " " + args[2]
+	}
+
+	if c.LeaseTime, err = parseDuration(args[n-1], leaseBounds); err != nil {
+		return nil, fmt.Errorf("invalid lease time: %w", err)
+	}
+
+	for _, arg := range args[n:] {
+		key, val, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid argument %q, want key=value", redactArg(arg))
+		}
+		parse, ok := configOptions[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown option %q, valid options are: %s", key, strings.Join(optionNames(), ", "))
+		}
+		if err := parse(c, val); err != nil {
+			return nil, fmt.Errorf("invalid value for option %q: %w", key, err)
+		}
+	}
+
+	if c.LeaseMin == 0 {
+		c.LeaseMin = c.LeaseTime
+	}
+	if c.LeaseMax == 0 {
+		c.LeaseMax = c.LeaseTime
+	}
+
+	if c.CIDR != nil {
+		r, err := cidrRange(c.CIDR, c.MinPrefixLength, c.GatewayFirst)
+		if err != nil {
+			return nil, err
+		}
+		c.Ranges = []ipRange{r}
+		c.Start, c.End = r.Start, r.End
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// validate checks the constraints spanning several options
+func (c *Config) validate() error {
+	if c.ExpireAt != nil && !c.expireAtSet {
+		return errors.New("the expire_at_* options require expire_at")
+	}
+	if c.OpLogStream && c.OpLog == 0 {
+		return errors.New("oplog_stream requires the operation log to be enabled")
+	}
+	if c.RecoverHistory && c.HistoryLength == 0 {
+		return errors.New("recover=history requires the history to be enabled")
+	}
+	if c.ExportDir != "" && c.ExportS3 != nil {
+		return errors.New("export_dir and export_s3 are mutually exclusive")
+	}
+	if c.ExportDaily && c.ExportDir == "" && c.ExportS3 == nil {
+		return errors.New("export_at requires export_dir or export_s3")
+	}
+	if c.T1 > c.T2 {
+		return fmt.Errorf("t1 %g is later than t2 %g", c.T1, c.T2)
+	}
+	if c.LeaseMin > c.LeaseMax {
+		return fmt.Errorf("lease_min %s is longer than lease_max %s", c.LeaseMin, c.LeaseMax)
+	}
+	if longest := c.longestLease(); c.IdleTime > 0 && c.IdleTime <= longest/2 {
+		// the clients renew at half the lease time
+		return fmt.Errorf("idle_reclaim must be longer than half the lease time, %s", longest/2)
+	}
+	if c.FreezeURL != "" && c.FreezeInterval == 0 {
+		return errors.New("freeze_url requires a freeze_interval")
+	}
+	if c.GatewayFirst && c.CIDR == nil {
+		return errors.New("gateway_first requires the range as a CIDR")
+	}
+	if c.IdleUnprobed && c.IdleTime == 0 {
+		return errors.New("idle_unprobed requires idle_reclaim")
+	}
+	for _, r := range c.Exclusions {
+		if !c.contains(r.Start) || !c.contains(r.End) {
+			return fmt.Errorf("exclusion %s-%s is outside of the range", r.Start, r.End)
+		}
+	}
+	if c.Mask != nil && !c.Start.To4().Mask(c.Mask).Equal(c.End.To4().Mask(c.Mask)) {
+		return fmt.Errorf("the range %s-%s does not fit in one subnet of mask %s", c.Start, c.End, net.IP(c.Mask))
+	}
+	for _, r := range c.Routes {
+		if subnet := c.subnet(); !subnet.Contains(r.Router) {
+			return fmt.Errorf("gateway %s of route %s is outside of the pool subnet %s", r.Router, r.Dest, subnet)
+		}
+	}
+	for _, r := range c.Routers {
+		if subnet := c.subnet(); !subnet.Contains(r) {
+			return fmt.Errorf("router %s is outside of the pool subnet %s", r, subnet)
+		}
+	}
+	return nil
+}
+
+// longestLease returns the longest lease time granted without an override
+func (c *Config) longestLease() time.Duration {
+	if c.LeaseMax > c.LeaseTime {
+		return c.LeaseMax
+	}
+	return c.LeaseTime
+}
+
+// expireAt returns the expire-at policy, creating it with defaults if needed
+func (c *Config) expireAt() *ExpireAtPolicy {
+	if c.ExpireAt == nil {
+		c.ExpireAt = &ExpireAtPolicy{Location: time.Local, Min: defaultExpireAtMin}
+	}
+	return c.ExpireAt
+}
+
+// contains reports whether ip lies inside one of the configured ranges
+func (c *Config) contains(ip net.IP) bool {
+	for _, r := range c.Ranges {
+		if r.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// size returns the number of addresses in the configured ranges, both
+// ends included, see rangeSemantics
+func (c *Config) size() int {
+	size := 0
+	for _, r := range c.Ranges {
+		size += int(binary.BigEndian.Uint32(r.End)-binary.BigEndian.Uint32(r.Start)) + 1
+	}
+	return size
+}
+
+func optionNames() []string {
+	names := make([]string, 0, len(configOptions))
+	for name := range configOptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
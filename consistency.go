@@ -0,0 +1,212 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+)
+
+// kinds of inconsistencies between the in-memory state and redis, found by
+// ConsistencyReport in addition to the ones of the startup audit
+const (
+	IssueNotAllocated      = "not-allocated"
+	IssueAllocatedNoRecord = "allocated-without-record"
+	IssueIndexMismatch     = "index-mismatch"
+	IssueStaleIndex        = "stale-index"
+	IssueOrphanShadow      = "orphan-shadow"
+	IssueQuarantineNoTTL   = "quarantine-without-expiry"
+	IssueDenied            = "denied"
+)
+
+// IndexEntries returns the reverse index, mapping IPs to MAC addresses
+func (r *RedisProvider) IndexEntries(ctx context.Context) (map[string]string, error) {
+	entries := make(map[string]string)
+	err := r.scanValues(ctx, r.ns.index, func(suffix, val string) {
+		entries[suffix] = val
+	})
+	return entries, err
+}
+
+// ShadowKeys returns the MAC addresses having a shadow key
+func (r *RedisProvider) ShadowKeys(ctx context.Context) ([]string, error) {
+	var macs []string
+	err := r.scanKeys(ctx, r.ns.shadow, func(keys []string) error {
+		for _, key := range keys {
+			macs = append(macs, key[len(r.ns.shadow):])
+		}
+		return nil
+	})
+	return macs, err
+}
+
+// QuarantineWithoutTTL returns the quarantined addresses that never expire
+func (r *RedisProvider) QuarantineWithoutTTL(ctx context.Context) ([]net.IP, error) {
+	var ips []net.IP
+	err := r.scanKeys(ctx, r.ns.quarantine, func(keys []string) error {
+		for _, key := range keys {
+			ttl, err := r.rdb.TTL(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			// -1 means the key exists without expiry
+			if ttl == -1 {
+				ips = append(ips, net.ParseIP(key[len(r.ns.quarantine):]))
+			}
+		}
+		return nil
+	})
+	return ips, err
+}
+
+// scanKeys calls fn with every batch of keys starting with prefix
+func (r *RedisProvider) scanKeys(ctx context.Context, prefix string, fn func(keys []string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := r.rdb.Scan(ctx, cursor, prefix+"*", 1000).Result()
+		if err != nil {
+			return unavailable(err)
+		}
+		if err := fn(keys); err != nil {
+			return unavailable(err)
+		}
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// scanValues calls fn with the value of every string key starting with
+// prefix, the key being passed without the prefix
+func (r *RedisProvider) scanValues(ctx context.Context, prefix string, fn func(suffix, val string)) error {
+	return r.scanKeys(ctx, prefix, func(keys []string) error {
+		if len(keys) == 0 {
+			return nil
+		}
+		vals, err := r.rdb.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, val := range vals {
+			if str, ok := val.(string); ok {
+				fn(keys[i][len(prefix):], str)
+			}
+		}
+		return nil
+	})
+}
+
+// ConsistencyReport compares the allocator, the records, their shadow keys,
+// the reverse index and the quarantine, without modifying anything. The
+// comparison is not atomic: requests served meanwhile can show up as
+// transient issues.
+func (p *PluginState) ConsistencyReport(ctx context.Context) (*AuditReport, map[string]Record, error) {
+	records, err := p.storage.GetAllRecords()
+	if err != nil {
+		return nil, nil, err
+	}
+	report, err := p.audit(records)
+	if err != nil {
+		return nil, nil, err
+	}
+	add := func(kind, mac string, ip net.IP, detail string) {
+		report.Issues = append(report.Issues, AuditIssue{Kind: kind, MAC: mac, IP: ip, Detail: detail})
+	}
+
+	held := p.leases.snapshot()
+	for mac, rec := range records {
+		switch ip, ok := held[mac]; {
+		case !ok:
+			add(IssueNotAllocated, mac, rec.IP, "")
+		case ip != rec.IP.String():
+			add(IssueNotAllocated, mac, rec.IP, "allocator holds "+ip)
+		}
+	}
+	for mac, ip := range held {
+		if _, ok := records[mac]; !ok {
+			add(IssueAllocatedNoRecord, mac, net.ParseIP(ip), "")
+		}
+	}
+
+	index, err := p.storage.IndexEntries(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for mac, rec := range records {
+		switch owner, ok := index[rec.IP.String()]; {
+		case !ok:
+			add(IssueIndexMismatch, mac, rec.IP, "no index entry")
+		case owner != mac:
+			add(IssueIndexMismatch, mac, rec.IP, "index names "+owner)
+		}
+	}
+	for ip, mac := range index {
+		if rec, ok := records[mac]; !ok || rec.IP.String() != ip {
+			add(IssueStaleIndex, mac, net.ParseIP(ip), "")
+		}
+	}
+
+	shadows, err := p.storage.ShadowKeys(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, mac := range shadows {
+		if _, ok := records[mac]; !ok {
+			add(IssueOrphanShadow, mac, nil, "")
+		}
+	}
+
+	denied, err := p.storage.DeniedMACs(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, mac := range denied {
+		if rec, ok := records[mac]; ok {
+			add(IssueDenied, mac, rec.IP, "")
+		}
+	}
+
+	quarantined, err := p.storage.QuarantineWithoutTTL(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, ip := range quarantined {
+		add(IssueQuarantineNoTTL, "", ip, "")
+	}
+
+	if report.Frozen, err = p.frozenBindings(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		a, b := report.Issues[i], report.Issues[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return strings.Compare(a.MAC, b.MAC) < 0
+	})
+	if p.oplog != nil {
+		ips := make(map[string]bool)
+		for _, i := range report.Issues {
+			if i.IP != nil {
+				ips[i.IP.String()] = true
+			}
+		}
+		report.Operations = p.oplog.touching(ips, opLogReportEntries)
+	}
+	return report, records, nil
+}
+
+// Reconcile fixes the issues found by ConsistencyReport, and returns them
+func (p *PluginState) Reconcile(ctx context.Context) (*AuditReport, error) {
+	report, records, err := p.ConsistencyReport(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.repair(report, records)
+	if n := p.reclaimIdle(ctx, records); n > 0 {
+		log.Infof("idle reclaim: %d leases shortened", n)
+	}
+	return report, nil
+}
@@ -0,0 +1,116 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+const consistencyGolden = "testdata/consistency.golden"
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// corrupt leases a client of the pool 10.0.15.10-30 for each kind of
+// inconsistency, and damages its state in redis or in memory
+func corrupt(t *testing.T, m *miniredis.Miniredis, p *PluginState) {
+	t.Helper()
+	ns := p.storage.ns
+	mac := func(i int) string { return net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, byte(i)}.String() }
+
+	// a consistent lease, reported by no issue
+	lease(t, p, mac(0))
+	// a record the allocator knows nothing of
+	if err := p.storage.SaveRecord(mac(1), boundRecord("10.0.15.30", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// an allocated address without a record
+	lease(t, p, mac(2))
+	m.Del(ns.main + mac(2))
+	m.Del(ns.shadow + mac(2))
+	m.Del(ns.index + "10.0.15.11")
+	// a record without its shadow key
+	lease(t, p, mac(3))
+	m.Del(ns.shadow + mac(3))
+	// an index entry naming another client, which holds no address
+	lease(t, p, mac(4))
+	m.Set(ns.index+"10.0.15.13", mac(5))
+	// a stale index entry
+	m.Set(ns.index+"10.0.15.29", mac(6))
+	// a shadow key without a record
+	m.Set(ns.shadow+mac(7), "")
+	// a lease of a denied client
+	lease(t, p, mac(8))
+	m.SAdd(REDIS_DENY_KEY, mac(8))
+	// a quarantine that never ends
+	m.Set(ns.quarantine+"10.0.15.28", mac(9))
+}
+
+func TestConsistencyReport(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.15.10", "10.0.15.30", "1h")
+	corrupt(t, m, p)
+
+	dump := m.Dump()
+	held := p.leases.snapshot()
+	report, _, err := p.ConsistencyReport(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Dump() != dump || len(p.leases.snapshot()) != len(held) {
+		t.Error("state modified by the report")
+	}
+
+	got, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+	if *update {
+		if err := os.WriteFile(consistencyGolden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(consistencyGolden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("report:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.15.10", "10.0.15.30", "1h")
+	corrupt(t, m, p)
+
+	// the reconciliation fixes what the report finds
+	found, _, err := p.ConsistencyReport(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed, err := p.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixed.Issues) != len(found.Issues) {
+		t.Errorf("%d issues reconciled, %d reported", len(fixed.Issues), len(found.Issues))
+	}
+	left, _, err := p.ConsistencyReport(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left.Issues) != 0 {
+		t.Errorf("issues left after the reconciliation: %s", left)
+	}
+	assertIndexed(t, m, p)
+	if ttl := m.TTL(p.storage.ns.quarantine + "10.0.15.28"); ttl != p.cfg.QuarantineTime {
+		t.Errorf("quarantine of 10.0.15.28 expires in %s, want %s", ttl, p.cfg.QuarantineTime)
+	}
+}
@@ -0,0 +1,384 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// REDIS_CONTROL_CHANNEL is the pub/sub channel operators publish commands to,
+// e.g. `PUBLISH dhcp:control cutover`.
+const REDIS_CONTROL_CHANNEL = "dhcp:control"
+
+// handleControl executes a command received on the control channel
+func (p *PluginState) handleControl(payload string) {
+	fields := strings.Fields(payload)
+	if len(fields) == 0 {
+		return
+	}
+
+	switch fields[0] {
+	case "cutover":
+		if err := p.storage.Cutover(); err != nil {
+			log.Errorf("control: cutover failed: %v", err)
+		}
+	case "recover-history":
+		if _, err := p.RecoverFromHistory(context.TODO()); err != nil {
+			log.Errorf("control: recovery from history failed: %v", err)
+		}
+	case "export":
+		go p.runExport(context.Background())
+	case "extend":
+		if len(fields) != 2 {
+			log.Warn("control: usage: extend <duration>")
+			return
+		}
+		d, err := parseDuration(fields[1], leaseBounds)
+		if err != nil {
+			log.Warnf("control: extend: %v", err)
+			return
+		}
+		go func() {
+			if _, err := p.BulkExtend(context.Background(), d); err != nil {
+				log.Errorf("control: bulk extension failed: %v", err)
+			}
+		}()
+	case "observed":
+		ip, mac, err := parseObservation(fields[1:])
+		if err != nil {
+			log.Warnf("control: invalid observation %q: %v", payload, err)
+			return
+		}
+		if err := p.Observe(ip, mac); err != nil {
+			log.Warnf("control: %v", err)
+		}
+	case "consistency-report":
+		report, _, err := p.ConsistencyReport(context.TODO())
+		if err != nil {
+			log.Errorf("control: consistency report failed: %v", err)
+			return
+		}
+		log.Infof("control: consistency report: %s", report)
+	case "reconcile":
+		report, err := p.Reconcile(context.TODO())
+		if err != nil {
+			log.Errorf("control: reconciliation failed: %v", err)
+			return
+		}
+		log.Infof("control: reconciled: %s", report)
+	case "trace":
+		if len(fields) < 2 || len(fields) > 3 {
+			log.Warn("control: usage: trace <mac> [duration]")
+			return
+		}
+		d := p.cfg.TraceTime
+		if len(fields) == 3 {
+			var err error
+			if d, err = parseDuration(fields[2], leaseBounds); err != nil {
+				log.Warnf("control: trace: %v", err)
+				return
+			}
+		}
+		key := fields[1]
+		if mac, err := net.ParseMAC(key); err == nil {
+			key = mac.String()
+		}
+		if !validClientKey(key) {
+			log.Warnf("control: invalid client %q", fields[1])
+			return
+		}
+		if err := p.Trace(key, d); err != nil {
+			log.Warnf("control: could not share trace target: %v", err)
+		}
+	case "label", "label-rule":
+		if len(fields) < 2 || len(fields) > 3 {
+			log.Warnf("control: usage: %s <mac|selector> [k=v,...]", fields[0])
+			return
+		}
+		var labels map[string]string
+		if len(fields) == 3 {
+			var err error
+			if labels, err = ParseLabels(fields[2]); err != nil {
+				log.Warnf("control: %v", err)
+				return
+			}
+		}
+		if fields[0] == "label-rule" {
+			if err := p.storage.SetLabelRule(context.TODO(), fields[1], labels); err != nil {
+				log.Warnf("control: could not set label rule %s: %v", fields[1], err)
+			}
+			return
+		}
+		key := fields[1]
+		if mac, err := net.ParseMAC(key); err == nil {
+			key = mac.String()
+		}
+		if err := p.SetLabels(key, labels); err != nil {
+			log.Warnf("control: could not label %s: %v", fields[1], err)
+		}
+	case "backfill-hostnames":
+		go func() {
+			if _, err := p.BackfillHostnames(context.Background(), nil); err != nil {
+				log.Errorf("control: hostname backfill failed: %v", err)
+			}
+		}()
+	case "prepare-shutdown":
+		go func() {
+			if err := p.PrepareShutdown(context.Background()); err != nil {
+				log.Errorf("control: could not prepare the handover: %v", err)
+			}
+		}()
+	case "lease-ramp":
+		// every instance receives the command, and stores the same ramp
+		if len(fields) == 2 && fields[1] == "cancel" {
+			if err := p.StopRamp(context.TODO()); err != nil {
+				log.Errorf("control: could not cancel the lease ramp: %v", err)
+			}
+			return
+		}
+		if len(fields) != 3 {
+			log.Warn("control: usage: lease-ramp <target> <deadline>|cancel")
+			return
+		}
+		ramp, err := ParseLeaseRamp(fields[1], fields[2])
+		if err != nil {
+			log.Warnf("control: %v", err)
+			return
+		}
+		if err := p.StartRamp(context.TODO(), ramp); err != nil {
+			log.Errorf("control: could not start the lease ramp: %v", err)
+		}
+	case "split":
+		// every instance receives the command: the source starts and
+		// finishes the split, every instance follows its abort
+		usage := "control: usage: split start <start>-<end> <target> [grace]|status|finish|abort"
+		if len(fields) < 2 {
+			log.Warn(usage)
+			return
+		}
+		switch fields[1] {
+		case "start":
+			if len(fields) < 4 || len(fields) > 5 {
+				log.Warn(usage)
+				return
+			}
+			sub, err := parseExclusions(fields[2])
+			if err != nil || len(sub) != 1 {
+				log.Warnf("control: invalid sub-range %q", fields[2])
+				return
+			}
+			if p.splitRole(&PoolSplit{Start: sub[0].Start, End: sub[0].End}) != SplitSource {
+				// the split of another pool
+				return
+			}
+			grace := defaultSplitGrace
+			if len(fields) == 5 {
+				if grace, err = parseDuration(fields[4], nonNegativeBounds); err != nil {
+					log.Warnf("control: split grace: %v", err)
+					return
+				}
+			}
+			if err := p.StartSplit(context.TODO(), sub[0].Start, sub[0].End, fields[3], grace); err != nil {
+				log.Errorf("control: could not start the split: %v", err)
+			}
+		case "status":
+			prog, err := p.sampleSplit(context.TODO())
+			if err != nil {
+				log.Errorf("control: could not sample the split: %v", err)
+				return
+			}
+			if prog != nil {
+				log.Infof("control: %s, %s: %d bindings taken over, %d left here, done: %t",
+					&prog.PoolSplit, prog.Role, prog.Moved, prog.Remaining, prog.Done)
+			}
+		case "finish":
+			if _, role := p.split.get(); role != SplitSource {
+				return
+			}
+			if err := p.FinishSplit(context.TODO()); err != nil {
+				log.Errorf("control: could not finish the split: %v", err)
+			}
+		case "abort":
+			if err := p.AbortSplit(context.TODO()); err != nil {
+				log.Errorf("control: could not abort the split: %v", err)
+			}
+		default:
+			log.Warn(usage)
+		}
+	case "evaluate":
+		if len(fields) < 2 || len(fields) > 3 {
+			log.Warn("control: usage: evaluate <mac> [requested-ip]")
+			return
+		}
+		hw, err := net.ParseMAC(fields[1])
+		if err != nil {
+			log.Warnf("control: invalid MAC %q: %v", fields[1], err)
+			return
+		}
+		er := EvaluationRequest{MAC: hw}
+		if len(fields) == 3 {
+			if er.RequestedIP = net.ParseIP(fields[2]).To4(); er.RequestedIP == nil {
+				log.Warnf("control: invalid address %q", fields[2])
+				return
+			}
+		}
+		ev, err := p.Evaluate(context.TODO(), er)
+		if err != nil {
+			log.Errorf("control: evaluation failed: %v", err)
+			return
+		}
+		log.Infof("control: evaluation of %s in %s: %s", hw, ev.Pool, ev)
+	case "lease-limit":
+		// lease-limit <n> for the pool, lease-limit global <n> for all
+		var err error
+		n := -1
+		switch {
+		case len(fields) == 2:
+			if n, err = strconv.Atoi(fields[1]); err == nil && n >= 0 {
+				p.SetPoolLeaseLimit(n)
+				return
+			}
+		case len(fields) == 3 && fields[1] == "global":
+			if n, err = strconv.Atoi(fields[2]); err == nil && n >= 0 {
+				if err := p.SetGlobalLeaseLimit(context.TODO(), n); err != nil {
+					log.Errorf("control: could not set the global lease limit: %v", err)
+				}
+				return
+			}
+		}
+		log.Warn("control: usage: lease-limit [global] <n>, 0 lifting the limit")
+	case "sync-freeze":
+		if p.cfg.FreezeInterval == 0 {
+			log.Warn("control: the freeze is disabled")
+			return
+		}
+		if err := p.syncFreeze(context.TODO()); err != nil {
+			log.Errorf("control: could not sync the freeze list: %v", err)
+		}
+	case "replay-oplog":
+		if p.oplog == nil {
+			log.Warn("control: the operation log is disabled")
+			return
+		}
+		entries := p.oplog.snapshot()
+		if len(fields) == 2 && fields[1] == "stream" {
+			var err error
+			if entries, err = p.storage.OpLog(context.TODO(), p.poolName()); err != nil {
+				log.Errorf("control: could not read the operation log: %v", err)
+				return
+			}
+		}
+		replay, err := ReplayOpLog(p.cfg, entries)
+		if err != nil {
+			log.Errorf("control: could not replay the operation log: %v", err)
+			return
+		}
+		log.Infof("control: operation log replayed: %s", replay)
+	case "reload-reservations":
+		if err := p.loadReservations(context.TODO()); err != nil {
+			log.Errorf("control: could not reload the reservations: %v", err)
+		}
+	case "reveal":
+		if len(fields) != 2 {
+			log.Warn("control: usage: reveal <pseudonym>")
+			return
+		}
+		if _, err := p.Reveal(context.TODO(), fields[1]); err != nil {
+			log.Warnf("control: could not reveal %s: %v", fields[1], err)
+			return
+		}
+		log.Infof("control: %s revealed in %s%s", fields[1], REDIS_REVEAL_KEY_PREFIX, strings.ToLower(fields[1]))
+	case "timeline":
+		if len(fields) != 2 {
+			log.Warn("control: usage: timeline <mac|client key|duid|pseudonym>")
+			return
+		}
+		t, err := p.Timeline(context.TODO(), fields[1])
+		if err != nil {
+			log.Errorf("control: could not reconstruct the timeline of %s: %v", fields[1], err)
+			return
+		}
+		b, err := json.Marshal(t)
+		if err != nil {
+			log.Errorf("control: could not encode the timeline of %s: %v", fields[1], err)
+			return
+		}
+		log.Infof("control: timeline of %s: %s", fields[1], b)
+	case "refusals":
+		if len(fields) != 2 {
+			log.Warn("control: usage: refusals <mac|duid>")
+			return
+		}
+		client := fields[1]
+		if strings.HasPrefix(client, pseudonymPrefix) {
+			var err error
+			if client, err = p.Reveal(context.TODO(), client); err != nil {
+				log.Warnf("control: could not reveal %s: %v", fields[1], err)
+				return
+			}
+		}
+		refusals, err := p.Refusals(context.TODO(), client)
+		if err != nil {
+			log.Errorf("control: could not get the refusals of %s: %v", fields[1], err)
+			return
+		}
+		b, err := json.Marshal(refusals)
+		if err != nil {
+			log.Errorf("control: could not encode the refusals of %s: %v", fields[1], err)
+			return
+		}
+		log.Infof("control: refusals of %s: %s", fields[1], b)
+	case "isc-leases":
+		if len(fields) != 3 || (fields[1] != "report" && fields[1] != "import") {
+			log.Warn("control: usage: isc-leases report|import <path>")
+			return
+		}
+		go func() {
+			rep, err := p.ImportISCLeases(context.Background(), fields[2], fields[1] == "import")
+			if err != nil {
+				log.Errorf("control: isc leases %s failed: %v", fields[1], err)
+				return
+			}
+			log.Infof("control: isc leases %s of %s: %s", fields[1], p.poolName(), rep)
+		}()
+	case "kill-switch":
+		if len(fields) < 3 || (fields[1] != "on" && fields[1] != "off") {
+			log.Warn("control: usage: kill-switch on|off global|<start>-<end> [by ...]")
+			return
+		}
+		scope := fields[2]
+		if scope != KillGlobal && scope != p.poolName() {
+			// the switch of another pool
+			return
+		}
+		by := "control channel"
+		if len(fields) > 3 {
+			by += ", " + sanitize(strings.Join(fields[3:], " "), defaultMaxAgentInfo)
+		}
+		var err error
+		if fields[1] == "on" {
+			err = p.Kill(context.TODO(), scope, by)
+		} else {
+			err = p.Unkill(context.TODO(), scope, by)
+		}
+		if err != nil {
+			log.Errorf("control: could not turn the kill switch %s %s: %v", scope, fields[1], err)
+		}
+	case "config":
+		b, err := json.Marshal(p.EffectiveConfig())
+		if err != nil {
+			log.Errorf("control: could not encode the configuration: %v", err)
+			return
+		}
+		log.Infof("control: configuration of %s: %s", p.poolName(), b)
+	case "handover-complete":
+		if len(fields) != 3 {
+			return
+		}
+		p.completeHandover(fields[1], fields[2])
+	default:
+		log.Warnf("control: unknown command %q", fields[0])
+	}
+}
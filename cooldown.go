@@ -0,0 +1,192 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// REDIS_COOLDOWN_KEY is the sorted set of the addresses in cooldown, scored
+// by the time they were freed in milliseconds, in the default namespace
+const REDIS_COOLDOWN_KEY = "c:dhcp:cooldown"
+
+// cooldownEntry is an address freed at Since, kept allocated until the
+// cooldown is over
+type cooldownEntry struct {
+	IP    net.IP
+	Since time.Time
+}
+
+// cooldownList holds the addresses in cooldown, oldest first
+type cooldownList struct {
+	mu      sync.Mutex
+	entries []cooldownEntry
+}
+
+func (c *cooldownList) push(ip net.IP, since time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = append(c.entries, cooldownEntry{IP: ip, Since: since})
+}
+
+func (c *cooldownList) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// snapshot returns the addresses in cooldown, oldest first
+func (c *cooldownList) snapshot() []cooldownEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]cooldownEntry(nil), c.entries...)
+}
+
+// popExpired removes and returns the addresses freed before t
+func (c *cooldownList) popExpired(t time.Time) []net.IP {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ips []net.IP
+	for len(c.entries) > 0 && c.entries[0].Since.Before(t) {
+		ips = append(ips, c.entries[0].IP)
+		c.entries = c.entries[1:]
+	}
+	return ips
+}
+
+// popOldest removes and returns the address in cooldown for the longest
+// time, or nil
+func (c *cooldownList) popOldest() net.IP {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) == 0 {
+		return nil
+	}
+	ip := c.entries[0].IP
+	c.entries = c.entries[1:]
+	return ip
+}
+
+// remove takes ip out of the cooldown, reporting whether it was in it
+func (c *cooldownList) remove(ip net.IP) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, e := range c.entries {
+		if e.IP.Equal(ip) {
+			c.entries = append(c.entries[:i], c.entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// AddCooldown records that ip was freed at t
+func (r *RedisProvider) AddCooldown(ip net.IP, t time.Time) error {
+	return unavailable(r.rdb.ZAdd(context.TODO(), r.ns.cooldown, redis.Z{
+		Score:  float64(t.UnixMilli()),
+		Member: ip.String(),
+	}).Err())
+}
+
+// RemoveCooldown forgets the cooldown of ips
+func (r *RedisProvider) RemoveCooldown(ips ...net.IP) error {
+	if len(ips) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(ips))
+	for i, ip := range ips {
+		members[i] = ip.String()
+	}
+	return unavailable(r.rdb.ZRem(context.TODO(), r.ns.cooldown, members...).Err())
+}
+
+// Cooldowns drops the cooldowns started before since, and returns the
+// others, oldest first
+func (r *RedisProvider) Cooldowns(ctx context.Context, since time.Time) ([]cooldownEntry, error) {
+	min := fmt.Sprint(since.UnixMilli())
+	if err := r.rdb.ZRemRangeByScore(ctx, r.ns.cooldown, "-inf", "("+min).Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	zs, err := r.rdb.ZRangeByScoreWithScores(ctx, r.ns.cooldown, &redis.ZRangeBy{Min: min, Max: "+inf"}).Result()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	entries := make([]cooldownEntry, 0, len(zs))
+	for _, z := range zs {
+		member, _ := z.Member.(string)
+		if ip := net.ParseIP(member).To4(); ip != nil {
+			entries = append(entries, cooldownEntry{IP: ip, Since: time.UnixMilli(int64(z.Score))})
+		}
+	}
+	return entries, nil
+}
+
+// coolDown puts a freed address in cooldown instead of returning it to the
+// allocator. Returns false if the cooldown is disabled.
+func (p *PluginState) coolDown(ip net.IP) bool {
+	if p.cfg.Cooldown == 0 {
+		return false
+	}
+	now := p.clock.Now()
+	p.cooldown.push(ip, now)
+	if err := p.storage.AddCooldown(ip, now); err != nil {
+		log.Warnf("could not persist the cooldown of %s: %v", ip, err)
+	}
+	return true
+}
+
+// releaseCooldown returns the addresses whose cooldown is over to the
+// allocator
+func (p *PluginState) releaseCooldown() {
+	ips := p.cooldown.popExpired(p.clock.Now().Add(-p.cfg.Cooldown))
+	for _, ip := range ips {
+		if p.withheld(ip) {
+			continue
+		}
+		if err := p.allocator.Free(net.IPNet{IP: ip, Mask: net.IPv4Mask(255, 255, 255, 255)}); err != nil {
+			log.Errorf("error when release ip %v, err: %v", ip, err)
+		}
+	}
+	if err := p.storage.RemoveCooldown(ips...); err != nil {
+		log.Warnf("could not clear the cooldown of %d addresses: %v", len(ips), err)
+	}
+}
+
+// takeCooldown hands out the address in cooldown for the longest time, for
+// when the pool is otherwise exhausted. Returns nil if there is none.
+func (p *PluginState) takeCooldown() net.IP {
+	ip := p.cooldown.popOldest()
+	if ip == nil {
+		return nil
+	}
+	if err := p.storage.RemoveCooldown(ip); err != nil {
+		log.Warnf("could not clear the cooldown of %s: %v", ip, err)
+	}
+	return ip
+}
+
+// restoreCooldown keeps the addresses whose cooldown is not over withheld
+// from the allocator, once the stored leases are loaded
+func (p *PluginState) restoreCooldown() error {
+	if p.cfg.Cooldown == 0 {
+		return nil
+	}
+	entries, err := p.storage.Cooldowns(context.TODO(), p.clock.Now().Add(-p.cfg.Cooldown))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !p.inRange(e.IP) || p.cfg.excluded(e.IP) || p.leases.macOf(e.IP) != "" {
+			continue
+		}
+		if _, err := allocateExact(p.allocator, net.IPNet{IP: e.IP}); err != nil {
+			continue
+		}
+		p.cooldown.push(e.IP, e.Since)
+	}
+	return nil
+}
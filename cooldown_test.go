@@ -0,0 +1,85 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// releaseLease has mac release its lease of ip
+func releaseLease(t *testing.T, p *PluginState, mac string, ip net.IP) {
+	t.Helper()
+	exchange(t, p, newRequest(t, dhcpv4.MessageTypeRelease, mac, dhcpv4.WithClientIP(ip)))
+}
+
+func TestCooldown(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.18.10", "10.0.18.12", "1h", "cooldown=10m")
+	const a, b = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+	ipA, ipB := lease(t, p, a), lease(t, p, b)
+
+	// a freed address is skipped while another one is free
+	releaseLease(t, p, a, ipA)
+	if got := lease(t, p, "00:11:22:33:44:0c"); got.Equal(ipA) {
+		t.Errorf("%s handed out again during its cooldown", ipA)
+	}
+
+	// once the pool is exhausted, the oldest address in cooldown is used
+	advance(p, time.Minute)
+	releaseLease(t, p, b, ipB)
+	if got := lease(t, p, "00:11:22:33:44:0d"); !got.Equal(ipA) {
+		t.Errorf("exhausted pool leased %s, want the oldest in cooldown %s", got, ipA)
+	}
+	if members, err := m.ZMembers(p.storage.ns.cooldown); err != nil || len(members) != 1 || members[0] != ipB.String() {
+		t.Errorf("stored cooldown %v, %v, want %s only", members, err, ipB)
+	}
+
+	// the address is back once its cooldown is over
+	advance(p, 10*time.Minute)
+	if got := lease(t, p, "00:11:22:33:44:0e"); !got.Equal(ipB) {
+		t.Errorf("leased %s after the cooldown, want %s", got, ipB)
+	}
+	if n := p.cooldown.len(); n != 0 {
+		t.Errorf("%d addresses left in cooldown", n)
+	}
+}
+
+func TestCooldownRestart(t *testing.T) {
+	m := miniredis.RunT(t)
+	a := startPlugin(t, m, "10.0.18.10", "10.0.18.12", "1h", "cooldown=10m")
+	const mac = "00:11:22:33:44:0a"
+	ip := lease(t, a, mac)
+	releaseLease(t, a, mac, ip)
+	if err := a.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next instance keeps withholding the address
+	b := startPlugin(t, m, "10.0.18.10", "10.0.18.12", "1h", "cooldown=10m")
+	if n := b.cooldown.len(); n != 1 {
+		t.Fatalf("%d addresses in cooldown after the restart, want 1", n)
+	}
+	for _, mac := range []string{"00:11:22:33:44:0b", "00:11:22:33:44:0c"} {
+		if got := lease(t, b, mac); got.Equal(ip) {
+			t.Errorf("%s handed out during its cooldown after the restart", ip)
+		}
+	}
+}
+
+func TestCooldownDisabled(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.18.10", "10.0.18.12", "1h")
+	const mac = "00:11:22:33:44:0a"
+	ip := lease(t, p, mac)
+	releaseLease(t, p, mac, ip)
+	if got := lease(t, p, "00:11:22:33:44:0b"); !got.Equal(ip) {
+		t.Errorf("leased %s, want the freed %s without a cooldown", got, ip)
+	}
+	if m.Exists(p.storage.ns.cooldown) {
+		t.Error("cooldown stored while disabled")
+	}
+}
@@ -0,0 +1,254 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// REDIS_LINK_KEY_PREFIX prefixes the links between the DHCPv4 and the
+// DHCPv6 leases of a host, keyed by MAC address with the DUID as value. A
+// link is set by the DHCPv6 instances when the DUID of a client carries
+// the MAC address of a DHCPv4 lease, and lives as long as a DHCPv6 lease.
+// The DHCPv6 instances have no namespace: they link the leases of the
+// default one.
+const REDIS_LINK_KEY_PREFIX = "x:dhcp:link:"
+
+const (
+	// size of the queue of the DUIDs to correlate
+	correlateQueueSize = 1024
+	// time a correlation is used before being recomputed
+	correlateRefresh = 30 * time.Second
+)
+
+// macFromDUID returns the Ethernet address a DUID-LLT or a DUID-LL carries.
+// The other DUIDs, e.g. DUID-EN or DUID-UUID, carry none and are never
+// correlated.
+func macFromDUID(id dhcpv6.DUID) (net.HardwareAddr, bool) {
+	var hwType iana.HWType
+	var addr net.HardwareAddr
+	switch d := id.(type) {
+	case *dhcpv6.DUIDLLT:
+		hwType, addr = d.HWType, d.LinkLayerAddr
+	case *dhcpv6.DUIDLL:
+		hwType, addr = d.HWType, d.LinkLayerAddr
+	default:
+		return nil, false
+	}
+	if hwType != iana.HWTypeEthernet || len(addr) != 6 {
+		return nil, false
+	}
+	return addr, true
+}
+
+// correlation is what a DHCPv6 client is known as on the DHCPv4 side
+type correlation struct {
+	// mac is the Ethernet address the DUID carries, empty if none
+	mac string
+	// linked is set when mac has a DHCPv4 lease
+	linked bool
+	// denied and labels are the policies of mac, only looked up when the
+	// instance propagates them
+	denied  bool
+	labels  map[string]string
+	checked time.Time
+}
+
+// correlator keeps the correlations of the DUIDs seen by a DHCPv6
+// instance. They are recomputed in the background, so that the handler
+// never waits for redis to learn about the DHCPv4 side.
+type correlator struct {
+	mu    sync.Mutex
+	known map[string]correlation
+	// queue holds the DUIDs to recompute, with the MAC address they carry
+	queue chan [2]string
+}
+
+func newCorrelator() *correlator {
+	return &correlator{known: make(map[string]correlation), queue: make(chan [2]string, correlateQueueSize)}
+}
+
+// correlation returns what is known of the DHCPv4 side of duid, queueing
+// its recomputation when unknown or older than correlateRefresh. A client
+// is served with what is known, nothing on its first request; a DUID
+// queued while the queue is full is queued again on its next request.
+func (p *PluginState6) correlation(duid string, id dhcpv6.DUID) correlation {
+	c := p.correlations
+	now := p.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	corr, ok := c.known[duid]
+	if ok && now.Sub(corr.checked) < correlateRefresh {
+		return corr
+	}
+	mac, ok := macFromDUID(id)
+	if !ok {
+		c.known[duid] = correlation{checked: now}
+		return c.known[duid]
+	}
+	select {
+	case c.queue <- [2]string{duid, mac.String()}:
+		// no other request queues it until recomputed
+		marked := corr
+		marked.checked = now
+		c.known[duid] = marked
+	default:
+	}
+	return corr
+}
+
+// correlateLoop recomputes the queued correlations, and forgets the ones of
+// the clients gone for a lease time
+func (p *PluginState6) correlateLoop() {
+	tick := time.NewTicker(correlateRefresh)
+	defer tick.Stop()
+	for {
+		select {
+		case req := <-p.correlations.queue:
+			p.correlate(req[0], req[1])
+		case <-tick.C:
+			now := p.clock.Now()
+			c := p.correlations
+			c.mu.Lock()
+			for duid, corr := range c.known {
+				if now.Sub(corr.checked) > p.LeaseTime+correlateRefresh {
+					delete(c.known, duid)
+				}
+			}
+			c.mu.Unlock()
+			dualStack.prune(now)
+		}
+	}
+}
+
+// correlate looks up the DHCPv4 lease and, if propagated, the policies of
+// the MAC address carried by duid, and links the leases of the host. A
+// failing lookup keeps what was known.
+func (p *PluginState6) correlate(duid, mac string) {
+	ctx := context.TODO()
+	c := p.correlations
+	c.mu.Lock()
+	corr := c.known[duid]
+	c.mu.Unlock()
+	corr.mac = mac
+
+	rec, err := p.storage.GetRecord(mac)
+	switch {
+	case err == nil:
+		corr.linked = true
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrCorruptRecord):
+		corr.linked = false
+	default:
+		log.Debugf("could not correlate DUID %s with MAC %s: %v", duid, mac, err)
+		return
+	}
+	if corr.linked {
+		expires := p.clock.Now().Add(p.LeaseTime)
+		if err := p.storage.SetLink(ctx, mac, duid, expires); err != nil {
+			log.Warnf("could not link DUID %s to MAC %s: %v", duid, mac, err)
+		}
+		dualStack.set(mac, duid, expires)
+	}
+	if p.cfg.PropagatePolicy {
+		// the denylist applies to the MAC address, leased or not
+		if denied, err := p.storage.Denied(ctx, mac); err != nil {
+			log.Debugf("denylist lookup of MAC %s failed: %v", mac, err)
+		} else {
+			corr.denied = denied
+		}
+		corr.labels = nil
+		if corr.linked {
+			corr.labels = rec.Labels
+		}
+	}
+	corr.checked = p.clock.Now()
+
+	c.mu.Lock()
+	c.known[duid] = corr
+	c.mu.Unlock()
+}
+
+// SetLink links the DHCPv4 lease of mac to the DHCPv6 lease of duid until
+// expires
+func (r *RedisProvider) SetLink(ctx context.Context, mac, duid string, expires time.Time) error {
+	return unavailable(r.rdb.Set(ctx, r.ns.link+mac, duid, ttlUntil(expires)).Err())
+}
+
+// Links returns the DUIDs linked to macs, in the same order, empty for the
+// ones without a link
+func (r *RedisProvider) Links(ctx context.Context, macs ...string) ([]string, error) {
+	if len(macs) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(macs))
+	for i, mac := range macs {
+		keys[i] = r.ns.link + mac
+	}
+	vals, err := r.rdb.MGet(ctx, keys...).Result()
+	if err != nil && err != redis.Nil {
+		return nil, unavailable(err)
+	}
+	links := make([]string, len(macs))
+	for i, v := range vals {
+		links[i], _ = v.(string)
+	}
+	return links, nil
+}
+
+// dualLink is a link of dualStack
+type dualLink struct {
+	duid    string
+	expires time.Time
+}
+
+// linkTable links the MAC addresses of the DHCPv4 clients to the DUIDs of
+// the DHCPv6 leases of the same hosts
+type linkTable struct {
+	mu    sync.Mutex
+	links map[string]dualLink
+}
+
+// dualStack holds the links set by the DHCPv6 instances of the process, so
+// that the DHCPv4 instances name them in their events without a round trip.
+// The links set by another server sharing the storage are only in redis.
+var dualStack = &linkTable{links: make(map[string]dualLink)}
+
+func (t *linkTable) set(mac, duid string, expires time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.links[mac] = dualLink{duid: duid, expires: expires}
+}
+
+func (t *linkTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.links)
+}
+
+// duidOf returns the DUID linked to mac, or an empty string
+func (t *linkTable) duidOf(mac string, now time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.links[mac]
+	if !ok || !now.Before(l.expires) {
+		return ""
+	}
+	return l.duid
+}
+
+// prune forgets the links expired by now
+func (t *linkTable) prune(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for mac, l := range t.links {
+		if !now.Before(l.expires) {
+			delete(t.links, mac)
+		}
+	}
+}
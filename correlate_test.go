@@ -0,0 +1,174 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestMacFromDUID(t *testing.T) {
+	hw, _ := net.ParseMAC("00:11:22:33:44:0a")
+	for _, c := range []struct {
+		name string
+		id   dhcpv6.DUID
+		mac  string
+	}{
+		{"DUID-LL", &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: hw}, "00:11:22:33:44:0a"},
+		{"DUID-LLT", &dhcpv6.DUIDLLT{HWType: iana.HWTypeEthernet, Time: 1, LinkLayerAddr: hw}, "00:11:22:33:44:0a"},
+		{"DUID-EN", &dhcpv6.DUIDEN{EnterpriseNumber: 32473, EnterpriseIdentifier: hw}, ""},
+		{"DUID-UUID", &dhcpv6.DUIDUUID{}, ""},
+		{"not Ethernet", &dhcpv6.DUIDLL{HWType: iana.HWTypeIEEE802, LinkLayerAddr: hw}, ""},
+		{"not 6 bytes", &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: hw[:4]}, ""},
+	} {
+		mac, ok := macFromDUID(c.id)
+		if ok != (c.mac != "") || (ok && mac.String() != c.mac) {
+			t.Errorf("%s: %s, %v, want %q", c.name, mac, ok, c.mac)
+		}
+	}
+}
+
+// linkOf requests an address for the DUID id until its record names its
+// DHCPv4 lease, the correlation being made in the background, and returns
+// the record
+func linkOf(t *testing.T, m *miniredis.Miniredis, h handler.Handler6, mac string, id dhcpv6.DUID) Record {
+	t.Helper()
+	var rec Record
+	eventually(t, "the link of "+mac, func() bool {
+		exchange6(t, h, dhcpv6.MessageTypeRequest, mac, dhcpv6.WithClientID(id))
+		v, err := m.Get(REDIS_V6_KEY_PREFIX + hex.EncodeToString(id.ToBytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(v), &rec); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Link != ""
+	})
+	return rec
+}
+
+func TestCorrelation(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.66.10", "10.0.66.20", "1h")
+	h := startPlugin6(t, m, "2001:db8::10", "2001:db8::20", "1h")
+	const a, b, c = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c"
+	lease(t, p, a)
+	lease(t, p, b)
+	events := recordEvents(p)
+
+	hwB, _ := net.ParseMAC(b)
+	for _, client := range []struct {
+		mac string
+		id  dhcpv6.DUID
+	}{
+		{a, duidOf(t, a)},
+		{b, &dhcpv6.DUIDLLT{HWType: iana.HWTypeEthernet, Time: 1, LinkLayerAddr: hwB}},
+	} {
+		duid := hex.EncodeToString(client.id.ToBytes())
+		if rec := linkOf(t, m, h, client.mac, client.id); rec.Link != client.mac {
+			t.Errorf("DHCPv6 lease of %s linked to %s", client.mac, rec.Link)
+		}
+		if got, _ := m.Get(REDIS_LINK_KEY_PREFIX + client.mac); got != duid {
+			t.Errorf("%s linked to %q, want %s", client.mac, got, duid)
+		}
+		assertTTL(t, m, REDIS_LINK_KEY_PREFIX+client.mac, time.Hour)
+
+		// the DHCPv4 side names the DHCPv6 lease in its events and timeline
+		renewal(t, p, client.mac, p.leases.ipOf(client.mac))
+		eventually(t, "the renewal of "+client.mac, func() bool {
+			for _, ev := range events.of(EventRenew) {
+				if ev.MAC == client.mac {
+					if ev.Link != duid {
+						t.Errorf("renewal of %s linked to %q, want %s", client.mac, ev.Link, duid)
+					}
+					return true
+				}
+			}
+			return false
+		})
+		tl, err := p.Timeline(context.Background(), client.mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		linked := false
+		for _, e := range tl.Entries {
+			linked = linked || e.Kind == TimelineLink && strings.Contains(e.Detail, duid)
+		}
+		if !linked {
+			t.Errorf("no link in the timeline of %s: %+v", client.mac, tl.Entries)
+		}
+	}
+
+	// a DUID-EN carries no MAC address, and a MAC address without a
+	// DHCPv4 lease is not linked
+	en := &dhcpv6.DUIDEN{EnterpriseNumber: 32473, EnterpriseIdentifier: []byte{1, 2, 3, 4}}
+	for _, id := range []dhcpv6.DUID{en, duidOf(t, c)} {
+		for i := 0; i < 3; i++ {
+			exchange6(t, h, dhcpv6.MessageTypeRequest, c, dhcpv6.WithClientID(id))
+			time.Sleep(20 * time.Millisecond)
+		}
+		var rec Record
+		v, _ := m.Get(REDIS_V6_KEY_PREFIX + hex.EncodeToString(id.ToBytes()))
+		if err := json.Unmarshal([]byte(v), &rec); err != nil || rec.Link != "" {
+			t.Errorf("DUID %x linked to %q: %v", id.ToBytes(), rec.Link, err)
+		}
+	}
+	if m.Exists(REDIS_LINK_KEY_PREFIX + c) {
+		t.Errorf("%s linked without a DHCPv4 lease", c)
+	}
+
+	// the exported leases name their DHCPv6 client
+	w := &memWriter{}
+	manifest, err := p.Export(context.Background(), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range w.chunks(manifest.ID) {
+		for _, line := range strings.Split(strings.TrimSpace(string(w.objects[name])), "\n") {
+			var l ExportedLease
+			if err := json.Unmarshal([]byte(line), &l); err != nil {
+				t.Fatal(err)
+			}
+			if l.DUID == "" {
+				t.Errorf("exported lease of %s without its DUID", l.MAC)
+			}
+		}
+	}
+}
+
+func TestPropagatePolicy(t *testing.T) {
+	m := miniredis.RunT(t)
+	const a, denied = "00:11:22:33:44:0a", "00:11:22:33:44:0d"
+	m.HSet(REDIS_LABELS_KEY, "mac:"+a, "site=lab")
+	m.SAdd(REDIS_DENY_KEY, denied)
+	p := startPlugin(t, m, "10.0.66.30", "10.0.66.40", "1h")
+	lease(t, p, a)
+
+	// without the flag, the link is made but the policies are not applied
+	h := startPlugin6(t, m, "2001:db8::10", "2001:db8::20", "1h")
+	if rec := linkOf(t, m, h, a, duidOf(t, a)); len(rec.Labels) != 0 {
+		t.Errorf("labels %v propagated without the flag", rec.Labels)
+	}
+	if exchange6(t, h, dhcpv6.MessageTypeRequest, denied) == nil {
+		t.Error("denied MAC dropped without the flag")
+	}
+
+	h = startPlugin6(t, m, "2001:db8::30", "2001:db8::40", "1h", "propagate_policy=true")
+	if rec := linkOf(t, m, h, a, duidOf(t, a)); rec.Labels["site"] != "lab" {
+		t.Errorf("labels %v, want those of the DHCPv4 lease", rec.Labels)
+	}
+	// the denylist applies to a MAC address without a DHCPv4 lease too,
+	// once correlated
+	eventually(t, "the denial", func() bool {
+		return exchange6(t, h, dhcpv6.MessageTypeRequest, denied) == nil
+	})
+}
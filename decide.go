@@ -0,0 +1,262 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// decision is what the plugin makes of a request given the record of its
+// client, before any of it is applied: handle4 applies it along with its
+// effects, and Evaluate reports it
+type decision struct {
+	// action, reason and detail are those of an Evaluation
+	action, reason, detail string
+	policies               []string
+	// record is the lease answered, nil for a new one
+	record *Record
+	// ended is the lease the request ends, for the reason endedBy
+	ended   *Record
+	endedBy string
+	// moved reports the binding taken over by the target of a split
+	moved bool
+	// reserved is the address reserved for the client. deferred is the one
+	// reserved for its circuit while leased to holder.
+	reserved net.IP
+	deferred net.IP
+	holder   string
+	// roam is the outcome of the roaming policy for roaming, the lease it
+	// was applied to, nil if the request never got that far
+	roaming       *Record
+	roam          roamOutcome
+	override      time.Duration
+	leaseTime     time.Duration
+	splitDeadline time.Time
+	frozen        bool
+	// admit marks a new lease, granted past the admission gates only. ip is
+	// the address reserved or requested, nil for one to allocate.
+	admit bool
+	ip    net.IP
+}
+
+func (d decision) drop(reason, detail string) decision {
+	d.action, d.reason, d.detail = ActionDrop, reason, detail
+	return d
+}
+
+func (d decision) nak(reason, detail string) decision {
+	d.action, d.reason, d.detail = ActionNAK, reason, detail
+	return d
+}
+
+// refuse NAKs a REQUEST and drops any other request
+func (d decision) refuse(req *dhcpv4.DHCPv4, reason, detail string) decision {
+	if req.MessageType() == dhcpv4.MessageTypeRequest {
+		return d.nak(reason, detail)
+	}
+	return d.drop(reason, detail)
+}
+
+func (d decision) answer(reason string, ip net.IP) decision {
+	d.action, d.reason, d.ip = ActionAnswer, reason, ip
+	return d
+}
+
+// decide makes the decision for req of the client mac, whose lease is
+// record or nil, server being the identifier of this server if known. It
+// only reads: nothing is allocated, stored, emitted or counted. The
+// admission of a new lease is left to the caller, see peekAdmission.
+func (p *PluginState) decide(ctx context.Context, req *dhcpv4.DHCPv4, mac string, record *Record, server net.IP) decision {
+	d := decision{record: record}
+	now := p.clock.Now()
+	isRequest := req.MessageType() == dhcpv4.MessageTypeRequest
+	want := requestedIP(req)
+
+	if selectsOther(req, server) {
+		// neither adopted nor NAKed: the address is the other server's,
+		// and the one offered here free again
+		if record != nil && record.offered() {
+			d.ended, d.endedBy, d.record = record, ReasonOtherServer, nil
+		}
+		return d.drop(ReasonOtherServer, fmt.Sprintf("selected server %s", req.ServerIdentifier()))
+	}
+	if isRequest && record != nil && record.offered() && !confirmsOffer(req, record, server) {
+		d.ended, d.endedBy, d.record = record, ReasonRequestedMismatch, nil
+		return d.nak(ReasonRequestedMismatch, fmt.Sprintf("requested %v, offered %s", want, record.IP))
+	}
+
+	if p.reassign.has(mac) && isRequest {
+		return d.nak(ReasonConflictMove, "moving off an address in conflict")
+	}
+	leave, moved, splitDeadline := p.splitLeaves(ctx, mac, record, want, now)
+	if leave {
+		d.moved = moved
+		return d.drop(ReasonSplit, "left to the target of the split")
+	}
+	d.splitDeadline = splitDeadline
+	if record != nil && p.cfg.excluded(record.IP) {
+		d.policies = append(d.policies, "exclude")
+		d.ended, d.endedBy, d.record = record, ReasonExcluded, nil
+		if isRequest {
+			return d.nak(ReasonExcluded, fmt.Sprintf("%s is excluded", record.IP))
+		}
+	}
+
+	reserved, err := p.storage.Reservation(ctx, mac)
+	if err != nil {
+		return d.drop(ReasonStorageError, err.Error())
+	}
+	if reserved == nil {
+		ip, holder, err := p.circuitReservation(ctx, req, p.decodeAgentInfo(req).CircuitID, mac)
+		switch {
+		case err != nil:
+			return d.drop(ReasonStorageError, err.Error())
+		case holder != "":
+			d.policies = append(d.policies, "circuit reservation of "+ip.String()+" deferred")
+			d.deferred, d.holder = ip, holder
+		default:
+			reserved = ip
+		}
+	}
+	if reserved != nil {
+		d.policies = append(d.policies, "reservation")
+		d.reserved = reserved
+		if d.record != nil && !d.record.IP.Equal(reserved) {
+			// the reservation changed since the lease was granted
+			d.ended, d.endedBy, d.record = d.record, ReasonReserved, nil
+		}
+		if want != nil && !want.Equal(reserved) {
+			return d.nak(ReasonRequestedMismatch, fmt.Sprintf("requested %s, reserved %s", want, reserved))
+		}
+	}
+	if d.record != nil && want != nil && !want.Equal(d.record.IP) && p.cfg.NakMismatch {
+		d.policies = append(d.policies, "nak_mismatch")
+		return d.nak(ReasonRequestedMismatch, fmt.Sprintf("requested %s, leasing %s", want, d.record.IP))
+	}
+	if d.record != nil {
+		relay := relayOf(req)
+		d.roaming, d.roam = d.record, p.roaming(relay, d.record)
+		switch d.roam {
+		case roamRefused:
+			d.policies = append(d.policies, "roaming="+RoamingHold)
+			return d.refuse(req, ReasonRoamingHold, fmt.Sprintf("held behind relay %s", d.record.Relay))
+		case roamEnded:
+			d.policies = append(d.policies, "roaming="+RoamingFollow)
+			d.ended, d.endedBy, d.record = d.record, ReasonRoamingFollow, nil
+			if isRequest {
+				return d.nak(ReasonRoamingFollow, fmt.Sprintf("moved to relay %s", relay))
+			}
+		}
+	}
+
+	d.override = p.leaseTimeOverride(ctx, mac)
+	d.leaseTime = p.leaseTime(now, d.override, p.requestedLeaseTime(req))
+	if !splitDeadline.IsZero() {
+		// the source of a split winds its bindings down like a lease ramp
+		d.policies = append(d.policies, "split")
+		ramp := LeaseRamp{Deadline: splitDeadline}
+		d.leaseTime = ramp.cap(now, d.leaseTime)
+	}
+	if d.override > 0 {
+		d.policies = append(d.policies, p.policyName(d.override))
+	} else if p.cfg.ExpireAt != nil {
+		d.policies = append(d.policies, "expire_at="+p.policyName(0))
+	}
+	if name := p.pressureName(); name != "" {
+		d.policies = append(d.policies, name)
+	}
+
+	if d.record != nil && p.frozen.has(d.record.IP) {
+		// a frozen binding is never extended: its holder keeps the address
+		// until the lease ends, and gets another one then
+		d.policies = append(d.policies, "frozen")
+		d.frozen = true
+		remaining := d.record.Expires.Sub(now)
+		if remaining < time.Second {
+			return d.drop(ReasonFrozen, d.record.IP.String())
+		}
+		d.leaseTime = remaining
+		return d.answer(ReasonRenewal, d.record.IP)
+	}
+	if d.record != nil {
+		return d.answer(ReasonRenewal, d.record.IP)
+	}
+
+	d.admit = true
+	if reserved != nil {
+		return d.answer(ReasonReserved, reserved)
+	}
+	if want != nil {
+		// a renewing client we have no record of keeps its address if it
+		// can be claimed, and is told to restart discovery otherwise
+		if err := p.claimable(mac, want); err != nil {
+			return d.nak(ReasonRequestedRefused, err.Error())
+		}
+		if p.withheld(want) {
+			return d.nak(ReasonRequestedRefused, fmt.Sprintf("%s is withheld", want))
+		}
+		quarantined, err := p.quarantinedSet(ctx)
+		if err != nil {
+			return d.drop(ReasonStorageError, err.Error())
+		}
+		if quarantined[want.String()] {
+			return d.nak(ReasonRequestedRefused, fmt.Sprintf("%s is quarantined", want))
+		}
+		return d.answer(ReasonRequestedAdopted, want)
+	}
+	return d.answer(ReasonAllocated, nil)
+}
+
+// peekAdmission returns the decision for a new lease of mac past the
+// admission gates, d itself if it passes them all. The handler takes the
+// same gates in the same order, counting the lease as it goes.
+func (p *PluginState) peekAdmission(ctx context.Context, req *dhcpv4.DHCPv4, mac string, d decision) decision {
+	if p.storageFull() {
+		return d.drop(ReasonStorageFull, "")
+	}
+	if p.handingOver() {
+		return d.drop(ReasonHandingOver, "")
+	}
+	if circuit := p.decodeAgentInfo(req).CircuitID; requestedIP(req) == nil && !p.circuitAllows(ctx, req, circuit, mac, circuitPeek) {
+		if p.cfg.CircuitQuotaAction == ActionPass {
+			d.action, d.reason, d.detail = ActionPass, ReasonCircuitQuota, circuit
+			return d
+		}
+		return d.refuse(req, ReasonCircuitQuota, circuit)
+	}
+	if reached, err := p.peekLeaseLimit(ctx); err != nil {
+		return d.drop(ReasonStorageError, err.Error())
+	} else if reached {
+		return d.drop(ReasonLeaseLimit, "")
+	}
+	return d
+}
+
+// turnDown answers req as d refuses it: with a NAK, with nothing, or with
+// the response of the earlier plugins passed on
+func (p *PluginState) turnDown(req, resp *dhcpv4.DHCPv4, mac string, d decision, tr *requestTrace) (*dhcpv4.DHCPv4, bool) {
+	detail := d.reason
+	if d.detail != "" {
+		detail += ": " + d.detail
+	}
+	p.refusals.note(mac, d.reason, d.detail)
+	switch d.action {
+	case ActionNAK:
+		log.Infof("NAK to %s of MAC %s: %s", req.MessageType(), mac, detail)
+		tr.step("NAK: %s", detail)
+		return nak(req, resp), true
+	case ActionPass:
+		tr.step("passed on: %s", detail)
+		return resp, false
+	}
+	if d.reason == ReasonStorageError {
+		log.Errorf("Dropping %s of MAC %s: %s", req.MessageType(), mac, detail)
+	} else {
+		log.Debugf("Dropping %s of MAC %s: %s", req.MessageType(), mac, detail)
+	}
+	tr.step("dropped: %s", detail)
+	return nil, true
+}
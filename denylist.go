@@ -0,0 +1,93 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// REDIS_DENY_KEY is the set of the MAC addresses refused service, e.g.
+// `SADD x:dhcp:deny 00:11:22:33:44:55`. Their requests are dropped, and
+// their leases are ended by the next reconciliation or when they expire.
+const REDIS_DENY_KEY = "x:dhcp:deny"
+
+// default lifetime of the cached denylist lookups
+const defaultDenyCacheTime = 10 * time.Second
+
+// Denied reports whether mac is in the denylist
+func (r *RedisProvider) Denied(ctx context.Context, mac string) (bool, error) {
+	ok, err := r.rdb.SIsMember(ctx, REDIS_DENY_KEY, mac).Result()
+	return ok, unavailable(err)
+}
+
+// DeniedMACs returns the MAC addresses of the denylist
+func (r *RedisProvider) DeniedMACs(ctx context.Context) ([]string, error) {
+	macs, err := r.rdb.SMembers(ctx, REDIS_DENY_KEY).Result()
+	return macs, unavailable(err)
+}
+
+// denyCacheEntry is a cached denylist lookup
+type denyCacheEntry struct {
+	denied  bool
+	expires time.Time
+}
+
+// denyList looks the denylist up with a cache, so that a change of the set
+// applies within the cache time without a round trip per packet
+type denyList struct {
+	mu    sync.Mutex
+	cache map[string]denyCacheEntry
+	// order is the order the entries were set in, oldest first
+	order arrivals[string]
+	// limit bounds the number of clients cached, 0 for no bound
+	limit int
+}
+
+func (d *denyList) len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.cache)
+}
+
+// denied reports whether mac is refused service. A failing lookup keeps the
+// last answer, or lets an unknown client through: an unavailable redis
+// fails the request anyway.
+func (p *PluginState) denied(mac string) bool {
+	now := p.clock.Now()
+	p.deny.mu.Lock()
+	e, ok := p.deny.cache[mac]
+	p.deny.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.denied
+	}
+
+	denied, err := p.storage.Denied(context.TODO(), mac)
+	if err != nil {
+		log.Debugf("denylist lookup of MAC %s failed: %v", mac, err)
+		return e.denied
+	}
+
+	p.deny.mu.Lock()
+	defer p.deny.mu.Unlock()
+	if p.deny.cache == nil {
+		p.deny.cache = make(map[string]denyCacheEntry)
+	}
+	if _, ok := p.deny.cache[mac]; !ok && p.deny.limit > 0 && len(p.deny.cache) >= p.deny.limit {
+		evictOldest(p.deny.cache, &p.deny.order)
+	}
+	p.deny.order.set(mac)
+	p.deny.cache[mac] = denyCacheEntry{denied: denied, expires: now.Add(p.cfg.DenyCacheTime)}
+	return denied
+}
+
+// prune forgets the lookups expired by now
+func (d *denyList) prune(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for mac, e := range d.cache {
+		if !now.Before(e.expires) {
+			delete(d.cache, mac)
+			d.order.remove(mac)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestDenylist(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.74.10", "10.0.74.20", "1h", "deny_cache_time=30s")
+	logs := captureLog(t)
+	const a, b = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+	discover := func(mac string) *dhcpv4.DHCPv4 {
+		return exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac))
+	}
+
+	m.SAdd(REDIS_DENY_KEY, a)
+	if offer := discover(a); offer != nil {
+		t.Fatalf("denied MAC offered %s", offer.YourIPAddr)
+	}
+	if !logs.logged("Ignoring DISCOVER from denied MAC " + a) {
+		t.Error("denial not logged")
+	}
+	hw, _ := net.ParseMAC(a)
+	if ev, err := p.Evaluate(context.Background(), EvaluationRequest{MAC: hw}); err != nil || ev.Reason != ReasonDenied {
+		t.Errorf("evaluation %v, %v", ev, err)
+	}
+
+	// a change of the set applies once the cached lookups expire
+	if discover(b) == nil {
+		t.Fatal("no offer to an allowed MAC")
+	}
+	m.SRem(REDIS_DENY_KEY, a)
+	m.SAdd(REDIS_DENY_KEY, b)
+	if discover(a) != nil || discover(b) == nil {
+		t.Error("denylist change applied before the cache time")
+	}
+	advance(p, 30*time.Second)
+	if discover(a) == nil {
+		t.Error("MAC removed from the denylist still refused")
+	}
+	if discover(b) != nil {
+		t.Error("MAC added to the denylist still served")
+	}
+}
+
+func TestDenylistEndsLeases(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.74.30", "10.0.74.31", "1h")
+	const a, b, c = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c"
+	ip := lease(t, p, a)
+	lease(t, p, c)
+
+	// the lease of a newly denied MAC is ended by the next reconciliation,
+	// and its address handed out again
+	m.SAdd(REDIS_DENY_KEY, a)
+	if _, err := p.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.storage.GetRecord(a); !errors.Is(err, ErrNotFound) {
+		t.Errorf("record of the denied MAC kept: %v", err)
+	}
+	if got := lease(t, p, b); !got.Equal(ip) {
+		t.Errorf("leased %s, want the freed %s", got, ip)
+	}
+}
@@ -0,0 +1,58 @@
+package rangeredisplugin
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+// Allocation directions of a pool
+const (
+	DirectionUp   = "up"
+	DirectionDown = "down"
+)
+
+// mirrorAllocator makes an allocator hand out addresses from the top of
+// the range down, by mirroring every address around the middle of the
+// range. Hints are mirrored too, so requested addresses are still honored.
+type mirrorAllocator struct {
+	inner      allocators.Allocator
+	start, end uint32
+}
+
+func newMirrorAllocator(inner allocators.Allocator, start, end net.IP) *mirrorAllocator {
+	return &mirrorAllocator{
+		inner: inner,
+		start: binary.BigEndian.Uint32(start.To4()),
+		end:   binary.BigEndian.Uint32(end.To4()),
+	}
+}
+
+// mirror maps an address of the range to its counterpart. Addresses outside
+// of the range are returned unchanged.
+func (m *mirrorAllocator) mirror(n net.IPNet) net.IPNet {
+	v4 := n.IP.To4()
+	if v4 == nil {
+		return n
+	}
+	ip := binary.BigEndian.Uint32(v4)
+	if ip < m.start || ip > m.end {
+		return n
+	}
+	out := make(net.IP, 4)
+	binary.BigEndian.PutUint32(out, m.start+m.end-ip)
+	return net.IPNet{IP: out, Mask: n.Mask}
+}
+
+func (m *mirrorAllocator) Allocate(hint net.IPNet) (net.IPNet, error) {
+	n, err := m.inner.Allocate(m.mirror(hint))
+	if err != nil {
+		return n, err
+	}
+	return m.mirror(n), nil
+}
+
+func (m *mirrorAllocator) Free(n net.IPNet) error {
+	return m.inner.Free(m.mirror(n))
+}
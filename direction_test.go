@@ -0,0 +1,72 @@
+package rangeredisplugin
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestDirectionDown(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.12.10", "10.0.12.20", "1h", "direction=down")
+	for i := 0; i < 5; i++ {
+		want := net.IPv4(10, 0, 12, byte(20-i))
+		if ip := lease(t, p, fmt.Sprintf("00:11:22:33:44:%02x", i)); !ip.Equal(want) {
+			t.Errorf("allocation %d: %s, want %s", i, ip, want)
+		}
+	}
+
+	// a preferred address is honored, a taken one falls back to the top
+	p.preferred.set(map[string]net.IP{
+		"00:11:22:33:44:10": net.IPv4(10, 0, 12, 12).To4(),
+		"00:11:22:33:44:11": net.IPv4(10, 0, 12, 20).To4(),
+	})
+	if ip := offered(t, p, "00:11:22:33:44:10"); !ip.Equal(net.IPv4(10, 0, 12, 12)) {
+		t.Errorf("preferred 10.0.12.12, offered %s", ip)
+	}
+	if ip := offered(t, p, "00:11:22:33:44:11"); !ip.Equal(net.IPv4(10, 0, 12, 15)) {
+		t.Errorf("preferred the taken 10.0.12.20, offered %s, want 10.0.12.15", ip)
+	}
+
+	// a released address is handed out again
+	if typ := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRelease, "00:11:22:33:44:00",
+		dhcpv4.WithClientIP(net.IPv4(10, 0, 12, 20)))); typ != nil {
+		t.Errorf("RELEASE answered %v", typ)
+	}
+	if ip := offered(t, p, "00:11:22:33:44:12"); !ip.Equal(net.IPv4(10, 0, 12, 20)) {
+		t.Errorf("offered %s after the release, want 10.0.12.20", ip)
+	}
+}
+
+func TestDirectionDownExhaustion(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.12.10", "10.0.12.20", "1h", "direction=down")
+	seen := make(map[string]bool)
+	for i := 0; i < 11; i++ {
+		ip := lease(t, p, fmt.Sprintf("00:11:22:33:44:%02x", i))
+		if seen[ip.String()] || !p.inRange(ip) {
+			t.Errorf("allocation %d: %s", i, ip)
+		}
+		seen[ip.String()] = true
+	}
+	if offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, "00:11:22:33:44:ff")); offer != nil {
+		t.Errorf("offer of %s from an exhausted pool", offer.YourIPAddr)
+	}
+	if _, err := p.allocate("00:11:22:33:44:ff"); err == nil {
+		t.Error("allocation from an exhausted pool")
+	}
+}
+
+func TestDirectionUp(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.12.10", "10.0.12.20", "1h", "direction=up")
+	for i := 0; i < 3; i++ {
+		want := net.IPv4(10, 0, 12, byte(10+i))
+		if ip := lease(t, p, fmt.Sprintf("00:11:22:33:44:%02x", i)); !ip.Equal(want) {
+			t.Errorf("allocation %d: %s, want %s", i, ip, want)
+		}
+	}
+}
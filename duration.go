@@ -0,0 +1,61 @@
+package rangeredisplugin
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// maxLeaseTime is the longest lease the lease time option (51) can carry,
+// its largest value meaning an infinite lease
+const maxLeaseTime = (math.MaxUint32 - 1) * time.Second
+
+// durationBounds are the values accepted for a duration: at least min and
+// at most max, if set, and 0 too if zero is set, usually to disable
+type durationBounds struct {
+	min, max time.Duration
+	zero     bool
+}
+
+var (
+	// leaseBounds are those of the lease times and the other durations
+	// counted in whole seconds by the clients or the TTLs
+	leaseBounds = durationBounds{min: time.Second, max: maxLeaseTime}
+	// optionalLeaseBounds are leaseBounds for a duration 0 disables
+	optionalLeaseBounds = durationBounds{min: time.Second, max: maxLeaseTime, zero: true}
+	// nonNegativeBounds are those of delays and cache times
+	nonNegativeBounds = durationBounds{max: maxLeaseTime}
+	// timeoutBounds are those of the timeouts of outgoing requests
+	timeoutBounds = durationBounds{min: time.Millisecond, max: time.Minute}
+)
+
+func (b durationBounds) String() string {
+	s := fmt.Sprintf("a duration from %s to %s", b.min, b.max)
+	if b.min <= 0 {
+		s = fmt.Sprintf("a duration up to %s", b.max)
+	}
+	if b.zero {
+		s = "0 or " + s
+	}
+	return s
+}
+
+// check fails if d is out of the bounds
+func (b durationBounds) check(d time.Duration) error {
+	if d == 0 && b.zero {
+		return nil
+	}
+	if d < b.min || d > b.max {
+		return fmt.Errorf("%s is out of range, want %s", d, b)
+	}
+	return nil
+}
+
+// parseDuration parses val as a duration within b
+func parseDuration(val string, b durationBounds) (time.Duration, error) {
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q, want %s", val, b)
+	}
+	return d, b.check(d)
+}
@@ -0,0 +1,90 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestDurationOptions(t *testing.T) {
+	max, over := maxLeaseTime.String(), (maxLeaseTime + time.Second).String()
+	lease := []string{"1s", max}
+	for _, tc := range []struct {
+		keys     []string
+		accepted []string
+		refused  []string
+	}{
+		{[]string{"freeze_interval", "offer_hold", "idle_reclaim"},
+			[]string{"0", "1s", max}, []string{"-1s", "500ms", over}},
+		{[]string{"expire_at_min", "lease_min", "lease_max", "quarantine_time", "flap_window", "decline_time", "trace_time", "max_extension"},
+			lease, []string{"0", "-5m", "500ms", "999ms", over}},
+		{[]string{"cooldown", "deny_cache_time", "offer_interval", "expiry_tolerance"},
+			[]string{"0", "1ns", max}, []string{"-1ns", over}},
+		{[]string{"ptr_timeout"}, []string{"1ms", "1m"}, []string{"0", "999us", "1m1s"}},
+		{[]string{"slow_path_wait"}, []string{"0", "1m"}, []string{"-1s", "1m1s"}},
+		{[]string{"clock_jump_threshold"}, []string{"1s", "24h"}, []string{"0", "999ms", "24h0m1s"}},
+	} {
+		for _, key := range tc.keys {
+			for _, val := range tc.accepted {
+				if err := configOptions[key](&Config{}, val); err != nil {
+					t.Errorf("%s=%s refused: %v", key, val, err)
+				}
+			}
+			for _, val := range tc.refused {
+				err := configOptions[key](&Config{}, val)
+				if err == nil || !strings.Contains(err.Error(), "want ") {
+					t.Errorf("%s=%s: %v, want an error giving the range", key, val, err)
+				}
+			}
+		}
+	}
+
+	// the errors name the field
+	args := []string{"redis://localhost/0", "10.0.50.10", "10.0.50.20"}
+	if _, err := parseConfig(append(args, "1h", "cooldown=-1m")); err == nil || !strings.Contains(err.Error(), `"cooldown"`) {
+		t.Errorf("negative cooldown: %v", err)
+	}
+	for _, val := range []string{"-5m", "500ms", "0", over} {
+		if _, err := parseConfig(append(args, val)); err == nil || !strings.Contains(err.Error(), "invalid lease time") {
+			t.Errorf("lease time %s: %v", val, err)
+		}
+	}
+	if c, err := parseConfig(append(args, max)); err != nil || c.LeaseTime != maxLeaseTime {
+		t.Errorf("longest lease time: %v", err)
+	}
+}
+
+func TestRuntimeDurations(t *testing.T) {
+	deadline := time.Now().Add(time.Hour).Format(time.RFC3339)
+	for _, target := range []string{"-5m", "500ms", "0"} {
+		if _, err := ParseLeaseRamp(target, deadline); err == nil {
+			t.Errorf("lease ramp to %s parsed", target)
+		}
+	}
+	if _, err := ParseLeaseRamp("1s", deadline); err != nil {
+		t.Error(err)
+	}
+	// a ramp stored by hand is checked as it is loaded
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.50.10", "10.0.50.20", "1h")
+	for target, valid := range map[time.Duration]bool{-5 * time.Minute: false, 500 * time.Millisecond: false, time.Minute: true} {
+		if err := p.storage.saveCheckpoint(context.Background(), p.storage.ns.ramp, &LeaseRamp{Target: target, Deadline: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.loadRamp(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := p.ramp.get(); (got != nil) != valid {
+			t.Errorf("stored ramp to %s loaded as %v", target, got)
+		}
+	}
+
+	for _, bands := range []string{"50:-5m", "50:500ms"} {
+		if _, err := parsePressureBands(bands); err == nil {
+			t.Errorf("pressure bands %s parsed", bands)
+		}
+	}
+}
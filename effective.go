@@ -0,0 +1,102 @@
+package rangeredisplugin
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// number of configurations kept per pool in the history
+const configHistorySize = 3
+
+// AppliedConfig is a configuration applied to a pool, secrets redacted
+type AppliedConfig struct {
+	Applied time.Time
+	Args    []string
+}
+
+// EffectiveConfig is the configuration an instance runs with, as resolved
+// from its arguments, secrets redacted
+type EffectiveConfig struct {
+	Pool    string
+	Applied time.Time
+	// Args are the arguments as given, and Defaults the options left out,
+	// which run with their default value
+	Args     []string
+	Defaults []string
+	// Config is the resolved configuration
+	Config Config
+	// History holds the last configurations applied to the pool in this
+	// process, the one in effect first
+	History []AppliedConfig
+}
+
+var (
+	configHistoryMu sync.Mutex
+	configHistory   = make(map[string][]AppliedConfig)
+)
+
+// recordConfig adds the configuration of an instance set up for pool to
+// the history of the pool
+func recordConfig(pool string, c *Config) {
+	configHistoryMu.Lock()
+	defer configHistoryMu.Unlock()
+
+	h := append([]AppliedConfig{{Applied: c.applied, Args: redactArgs(c.args)}}, configHistory[pool]...)
+	if len(h) > configHistorySize {
+		h = h[:configHistorySize]
+	}
+	configHistory[pool] = h
+}
+
+// redactArgs returns the arguments with their secrets redacted
+func redactArgs(args []string) []string {
+	out := make([]string, 0, len(args))
+	for _, arg := range args {
+		out = append(out, redactArg(arg))
+	}
+	return out
+}
+
+// redacted returns a copy of c whose secrets are redacted, sharing the
+// values that hold none
+func (c *Config) redacted() Config {
+	r := *c
+	r.URI = redactURI(c.URI)
+	r.SecondaryURI = redactURI(c.SecondaryURI)
+	r.HistoryURI = redactURI(c.HistoryURI)
+	r.PrivacyKey = redactSecret(c.PrivacyKey)
+	if c.ExportS3 != nil {
+		s3 := *c.ExportS3
+		s3.SecretKey = redactSecret(s3.SecretKey)
+		r.ExportS3 = &s3
+	}
+	return r
+}
+
+// EffectiveConfig returns the configuration the instance runs with
+func (p *PluginState) EffectiveConfig() *EffectiveConfig {
+	ec := &EffectiveConfig{
+		Pool:    p.poolName(),
+		Applied: p.cfg.applied,
+		Args:    redactArgs(p.cfg.args),
+		Config:  p.cfg.redacted(),
+	}
+	given := make(map[string]bool)
+	for _, arg := range p.cfg.args[4:] {
+		key, _, _ := strings.Cut(arg, "=")
+		given[key] = true
+	}
+	for name := range configOptions {
+		if !given[name] {
+			ec.Defaults = append(ec.Defaults, name)
+		}
+	}
+	sort.Strings(ec.Defaults)
+
+	configHistoryMu.Lock()
+	ec.History = append([]AppliedConfig(nil), configHistory[ec.Pool]...)
+	configHistoryMu.Unlock()
+	return ec
+}
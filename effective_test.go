@@ -0,0 +1,87 @@
+package rangeredisplugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestEffectiveConfig(t *testing.T) {
+	m := miniredis.RunT(t)
+	h := miniredis.RunT(t)
+	h.RequireAuth("s3cr3t")
+	history := "history_uri=redis://:s3cr3t@" + h.Addr() + "/0"
+	logs := captureLog(t)
+
+	// the pool is set up again with another cooldown each time, and the
+	// history keeps the last three
+	var p *PluginState
+	for i := 1; i <= 4; i++ {
+		if p != nil {
+			if err := p.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		p = startPlugin(t, m, "10.0.37.10", "10.0.37.20", "1h", history, fmt.Sprintf("cooldown=%dm", i))
+	}
+	ec := p.EffectiveConfig()
+	if ec.Pool != "10.0.37.10-10.0.37.20" || ec.Applied.IsZero() {
+		t.Errorf("effective configuration of pool %s applied at %s", ec.Pool, ec.Applied)
+	}
+	want := []string{redisURI(m), "10.0.37.10", "10.0.37.20", "1h", "history_uri=redis://:xxxxx@" + h.Addr() + "/0", "cooldown=4m"}
+	if fmt.Sprint(ec.Args) != fmt.Sprint(want) {
+		t.Errorf("arguments %q, want %q", ec.Args, want)
+	}
+
+	// the options left out run with their defaults, resolved in Config
+	defaults := strings.Join(ec.Defaults, " ")
+	for _, name := range []string{"expiry_tolerance", "lease_min", "roaming"} {
+		if !strings.Contains(" "+defaults+" ", " "+name+" ") {
+			t.Errorf("default %s not reported in %v", name, ec.Defaults)
+		}
+	}
+	for _, name := range []string{"cooldown", "history_uri"} {
+		if strings.Contains(" "+defaults+" ", " "+name+" ") {
+			t.Errorf("option %s given but reported as a default", name)
+		}
+	}
+	if ec.Config.Cooldown != 4*time.Minute || ec.Config.ExpiryTolerance != time.Second || ec.Config.LeaseTime != time.Hour {
+		t.Errorf("resolved cooldown %s, expiry tolerance %s and lease time %s", ec.Config.Cooldown, ec.Config.ExpiryTolerance, ec.Config.LeaseTime)
+	}
+	if ec.Config.HistoryURI != "redis://:xxxxx@"+h.Addr()+"/0" {
+		t.Errorf("history URI %q", ec.Config.HistoryURI)
+	}
+
+	if len(ec.History) != configHistorySize {
+		t.Fatalf("%d configurations in the history, want %d", len(ec.History), configHistorySize)
+	}
+	for i, applied := range ec.History {
+		if arg := applied.Args[len(applied.Args)-1]; arg != fmt.Sprintf("cooldown=%dm", 4-i) {
+			t.Errorf("configuration %d of the history ends with %s", i, arg)
+		}
+		if i > 0 && applied.Applied.After(ec.History[i-1].Applied) {
+			t.Errorf("configuration %d of the history applied after the one before", i)
+		}
+	}
+	if !ec.History[0].Applied.Equal(ec.Applied) {
+		t.Error("history does not start with the configuration in effect")
+	}
+
+	// the secret is in neither the bundle nor the log
+	var buf bytes.Buffer
+	if err := p.SupportBundle(context.Background(), &buf, true); err != nil {
+		t.Fatal(err)
+	}
+	p.handleControl("config")
+	if !logs.logged(`control: configuration of 10.0.37.10-10.0.37.20: {"Pool"`) {
+		t.Error("configuration not logged by the control command")
+	}
+	if strings.Contains(buf.String(), "s3cr3t") || logs.logged("s3cr3t") {
+		t.Error("secret of the history URI leaked")
+	}
+}
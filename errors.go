@@ -0,0 +1,50 @@
+package rangeredisplugin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors returned by the storage and allocation paths. They are wrapped with
+// context, so test for them with errors.Is.
+var (
+	// ErrNotFound means there is no record for the requested key
+	ErrNotFound = errors.New("record not found")
+	// ErrStorageUnavailable means redis could not be reached or failed
+	ErrStorageUnavailable = errors.New("storage unavailable")
+	// ErrCorruptRecord means a stored record could not be decoded
+	ErrCorruptRecord = errors.New("corrupt record")
+	// ErrPoolExhausted means there is no free address left in the pool
+	ErrPoolExhausted = errors.New("pool exhausted")
+	// ErrOutOfRange means an address does not belong to the pool
+	ErrOutOfRange = errors.New("address out of range")
+	// ErrStorageFull means redis refused a write because it reached its
+	// maxmemory limit. It always comes wrapped in ErrStorageUnavailable.
+	ErrStorageFull = errors.New("storage out of memory")
+	// ErrExcluded means an address is excluded from the pool
+	ErrExcluded = errors.New("address excluded")
+	// ErrFrozen means an address is frozen, never to be granted again
+	ErrFrozen = errors.New("address frozen")
+	// ErrConflict means an address is already leased to another client
+	ErrConflict = errors.New("address already leased")
+	// ErrAddressTaken means an address could not be allocated because it
+	// is already allocated
+	ErrAddressTaken = errors.New("address already allocated")
+	// ErrRecordTooLarge means a record exceeds the size allowed in redis
+	ErrRecordTooLarge = errors.New("record too large")
+	// ErrNoBinding means a DHCPv6 client renews a lease it does not have
+	ErrNoBinding = errors.New("no binding")
+)
+
+// unavailable wraps an error of the redis client as ErrStorageUnavailable,
+// and as ErrStorageFull too if redis is out of memory
+func unavailable(err error) error {
+	if err == nil {
+		return nil
+	}
+	if strings.HasPrefix(err.Error(), "OOM ") {
+		return fmt.Errorf("%w: %w: %w", ErrStorageUnavailable, ErrStorageFull, err)
+	}
+	return fmt.Errorf("%w: %w", ErrStorageUnavailable, err)
+}
@@ -0,0 +1,109 @@
+package rangeredisplugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v9"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestUnavailable(t *testing.T) {
+	if err := unavailable(nil); err != nil {
+		t.Errorf("unavailable(nil) = %v", err)
+	}
+
+	down := redis.ErrClosed
+	err := fmt.Errorf("could not renew: %w", unavailable(down))
+	if !errors.Is(err, ErrStorageUnavailable) || !errors.Is(err, down) || errors.Is(err, ErrStorageFull) {
+		t.Errorf("%v: not ErrStorageUnavailable wrapping the cause only", err)
+	}
+
+	oom := errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+	err = fmt.Errorf("setup: %w", fmt.Errorf("could not save: %w", unavailable(oom)))
+	if !errors.Is(err, ErrStorageUnavailable) || !errors.Is(err, ErrStorageFull) || !errors.Is(err, oom) {
+		t.Errorf("%v: not ErrStorageUnavailable and ErrStorageFull wrapping the cause", err)
+	}
+}
+
+func TestStorageErrors(t *testing.T) {
+	m := miniredis.RunT(t)
+	r := openStorage(t, m, StorageOptions{})
+	const mac, corrupt, noIP = "00:11:22:33:44:55", "00:11:22:33:44:66", "00:11:22:33:44:77"
+
+	if _, err := r.GetRecord(mac); !errors.Is(err, ErrNotFound) || errors.Is(err, ErrStorageUnavailable) {
+		t.Errorf("GetRecord of a missing record: %v, want ErrNotFound", err)
+	}
+
+	m.Set(r.ns.main+corrupt, "{")
+	_, err := r.GetRecord(corrupt)
+	var syntax *json.SyntaxError
+	if !errors.Is(err, ErrCorruptRecord) || !errors.As(err, &syntax) {
+		t.Errorf("GetRecord of undecodable JSON: %v, want ErrCorruptRecord wrapping the syntax error", err)
+	}
+	m.Set(r.ns.main+noIP, `{"Hostname":"x"}`)
+	if _, err := r.GetRecord(noIP); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("GetRecord of a record without IP: %v, want ErrCorruptRecord", err)
+	}
+	// enumerations skip the corrupt records
+	if all, err := r.GetAllRecords(); err != nil || len(all) != 0 {
+		t.Errorf("GetAllRecords = %v, %v, want no record", all, err)
+	}
+
+	m.SetError("ERR server is shutting down")
+	defer m.SetError("")
+	for name, err := range map[string]error{
+		"GetRecord":    func() error { _, err := r.GetRecord(mac); return err }(),
+		"SaveRecord":   r.SaveRecord(mac, boundRecord("10.0.0.10", time.Hour)),
+		"DeleteRecord": r.DeleteRecord(mac),
+		"GetAllRecords": func() error {
+			_, err := r.GetAllRecords()
+			return err
+		}(),
+		"LookupByIP": func() error { _, err := r.LookupByIP(net.IPv4(10, 0, 0, 10)); return err }(),
+	} {
+		if !errors.Is(err, ErrStorageUnavailable) || errors.Is(err, ErrNotFound) {
+			t.Errorf("%s with redis failing: %v, want ErrStorageUnavailable", name, err)
+		}
+	}
+
+	m.SetError("OOM command not allowed when used memory > 'maxmemory'.")
+	err = r.SaveRecord(mac, boundRecord("10.0.0.10", time.Hour))
+	if !errors.Is(err, ErrStorageUnavailable) || !errors.Is(err, ErrStorageFull) {
+		t.Errorf("SaveRecord with redis out of memory: %v, want ErrStorageFull", err)
+	}
+}
+
+func TestAllocationErrors(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.1.10", "10.0.1.12", "1h", "exclude=10.0.1.12")
+	const mac, other, last = "00:11:22:33:44:55", "00:11:22:33:44:66", "00:11:22:33:44:77"
+
+	if err := p.claim(mac, net.IPv4(10, 0, 2, 10).To4()); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("claim out of the range: %v, want ErrOutOfRange", err)
+	}
+	if err := p.claim(mac, net.IPv4(10, 0, 1, 12).To4()); !errors.Is(err, ErrExcluded) {
+		t.Errorf("claim of an excluded address: %v, want ErrExcluded", err)
+	}
+
+	ip := lease(t, p, other)
+	if _, err := allocateExact(p.allocator, net.IPNet{IP: ip}); !errors.Is(err, ErrAddressTaken) {
+		t.Errorf("allocateExact of an allocated address: %v, want ErrAddressTaken", err)
+	}
+	lease(t, p, last)
+	_, err := p.allocate(mac)
+	if !errors.Is(err, ErrPoolExhausted) || errors.Is(err, ErrStorageUnavailable) {
+		t.Errorf("allocate from an exhausted pool: %v, want ErrPoolExhausted", err)
+	}
+	if wrapped := fmt.Errorf("DISCOVER of %s: %w", mac, err); !errors.Is(wrapped, ErrPoolExhausted) {
+		t.Errorf("%v: ErrPoolExhausted lost by wrapping", wrapped)
+	}
+	if exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac)) != nil {
+		t.Error("offer from an exhausted pool")
+	}
+}
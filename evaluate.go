@@ -0,0 +1,324 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Actions an evaluation predicts for a request
+const (
+	// ActionAnswer means the request gets an offer or an acknowledgement
+	ActionAnswer = "answer"
+	// ActionNAK means the request is refused with a DHCPNAK
+	ActionNAK = "nak"
+	// ActionDrop means the request is dropped unanswered
+	ActionDrop = "drop"
+	// ActionPass means the request is passed on to the next plugins
+	// untouched
+	ActionPass = "pass"
+)
+
+// Reasons of the outcome of an evaluation
+const (
+	ReasonKillSwitch        = "kill-switch"
+	ReasonMessageType       = "message-type"
+	ReasonInvalidClient     = "invalid-client"
+	ReasonHandedOver        = "handed-over"
+	ReasonOfferCached       = "offer-cached"
+	ReasonStorageError      = "storage-error"
+	ReasonConflictMove      = "conflict-move"
+	ReasonExcluded          = "excluded"
+	ReasonFrozen            = "frozen"
+	ReasonRenewal           = "renewal"
+	ReasonStorageFull       = "storage-full"
+	ReasonHandingOver       = "handing-over"
+	ReasonRequestedAdopted  = "requested-adopted"
+	ReasonRequestedRefused  = "requested-refused"
+	ReasonRequestedMismatch = "requested-mismatch"
+	ReasonRecovered         = "recovered"
+	ReasonAllocated         = "allocated"
+	ReasonCooldownReused    = "cooldown-reused"
+	ReasonPoolExhausted     = "pool-exhausted"
+	ReasonAllocationUnknown = "allocation-unknown"
+	ReasonRoamingHold       = "roaming-hold"
+	ReasonRoamingFollow     = "roaming-follow"
+	ReasonRateLimited       = "rate-limited"
+	ReasonCommitFailed      = "commit-failed"
+	ReasonReserved          = "reserved"
+	ReasonDenied            = "denied"
+	ReasonSplit             = "split"
+	ReasonNotAllowed        = "not-allowed"
+	ReasonLeaseLimit        = "lease-limit"
+	ReasonRelay             = "relay"
+	ReasonCircuitQuota      = "circuit-quota"
+	ReasonOtherServer       = "other-server"
+	ReasonNoBinding         = "no-binding"
+)
+
+// EvaluationRequest describes a synthetic client request
+type EvaluationRequest struct {
+	MAC net.HardwareAddr
+	// MessageType defaults to a DISCOVER, or a REQUEST if RequestedIP is
+	// set
+	MessageType dhcpv4.MessageType
+	RequestedIP net.IP
+	GatewayIP   net.IP
+	VendorClass string
+	CircuitID   []byte
+	RemoteID    []byte
+}
+
+// Evaluation is the predicted outcome of a request
+type Evaluation struct {
+	Action    string
+	Reason    string
+	IP        net.IP
+	Pool      string
+	LeaseTime time.Duration
+	// Policies lists the policies that shaped the outcome
+	Policies []string
+	// Options lists the options the plugin would add to the reply
+	Options []dhcpv4.OptionCode
+	Labels  map[string]string
+	Detail  string
+}
+
+func (e *Evaluation) String() string {
+	s := fmt.Sprintf("%s (%s)", e.Action, e.Reason)
+	if e.IP != nil {
+		s += fmt.Sprintf(" %s for %s", e.IP, e.LeaseTime.Round(time.Second))
+	}
+	if len(e.Policies) > 0 {
+		s += fmt.Sprintf(" policies %v", e.Policies)
+	}
+	if len(e.Options) > 0 {
+		s += fmt.Sprintf(" options %v", e.Options)
+	}
+	if e.Detail != "" {
+		s += ": " + e.Detail
+	}
+	return s
+}
+
+// packet builds the DHCPv4 request described by r
+func (r EvaluationRequest) packet() (*dhcpv4.DHCPv4, error) {
+	mt := r.MessageType
+	if mt == dhcpv4.MessageTypeNone {
+		mt = dhcpv4.MessageTypeDiscover
+		if r.RequestedIP != nil {
+			mt = dhcpv4.MessageTypeRequest
+		}
+	}
+	mods := []dhcpv4.Modifier{dhcpv4.WithHwAddr(r.MAC), dhcpv4.WithMessageType(mt)}
+	if r.RequestedIP != nil {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(r.RequestedIP)))
+	}
+	if r.GatewayIP != nil {
+		mods = append(mods, dhcpv4.WithGatewayIP(r.GatewayIP))
+	}
+	if r.VendorClass != "" {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptClassIdentifier(r.VendorClass)))
+	}
+	var sub []dhcpv4.Option
+	if len(r.CircuitID) > 0 {
+		sub = append(sub, dhcpv4.Option{Code: dhcpv4.AgentCircuitIDSubOption, Value: dhcpv4.OptionGeneric{Data: r.CircuitID}})
+	}
+	if len(r.RemoteID) > 0 {
+		sub = append(sub, dhcpv4.Option{Code: dhcpv4.AgentRemoteIDSubOption, Value: dhcpv4.OptionGeneric{Data: r.RemoteID}})
+	}
+	if len(sub) > 0 {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(sub...)))
+	}
+	return dhcpv4.New(mods...)
+}
+
+// Evaluate predicts how the plugin would answer a request, making the
+// decision of the handler without any of its effects: nothing is
+// allocated, stored, emitted or cached, and no rate limit is consumed.
+// The address of a new lease is the one the allocator would pick if no
+// other request came first. The PTR check of new addresses is not run, and
+// a binding still to be taken over from the source of a split is answered.
+func (p *PluginState) Evaluate(ctx context.Context, er EvaluationRequest) (*Evaluation, error) {
+	req, err := er.packet()
+	if err != nil {
+		return nil, err
+	}
+	ev := &Evaluation{Pool: p.poolName()}
+	if !handledType(req.MessageType()) {
+		ev.Action, ev.Reason = ActionPass, ReasonMessageType
+		ev.Detail = req.MessageType().String()
+		return ev, nil
+	}
+
+	if ks := p.kill.active(); ks != nil {
+		ev.Action, ev.Reason, ev.Detail = ActionPass, ReasonKillSwitch, ks.String()
+		return ev, nil
+	}
+	if !p.selects(req) {
+		ev.Action, ev.Reason, ev.Detail = ActionPass, ReasonRelay, "serving "+p.cfg.Relays.String()
+		return ev, nil
+	}
+	if p.handedOver() {
+		return ev.drop(ReasonHandedOver), nil
+	}
+	if p.splitAborted() {
+		return ev.drop(ReasonSplit), nil
+	}
+	if _, ok := p.cfg.allowedPrefix(req.ClientHWAddr); !ok {
+		return ev.drop(ReasonNotAllowed), nil
+	}
+	mac, err := p.clientKey(req)
+	if err != nil {
+		ev.Detail = err.Error()
+		return ev.drop(ReasonInvalidClient), nil
+	}
+	// the storage rather than the cache of the handler, which may lag
+	if denied, err := p.storage.Denied(ctx, mac); err == nil && denied {
+		return ev.drop(ReasonDenied), nil
+	}
+	now := p.clock.Now()
+
+	if req.MessageType() == dhcpv4.MessageTypeDiscover {
+		if ip, expires, ok := p.offers.peek(mac, now, p.cfg.OfferInterval); ok && ip.Equal(p.leases.ipOf(mac)) {
+			ev.Policies = append(ev.Policies, "offer_interval")
+			return p.answer(ev, ReasonOfferCached, ip, expires.Sub(now)), nil
+		}
+	}
+
+	record, err := p.peekRecord(req, mac)
+	if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrCorruptRecord) {
+		ev.Detail = err.Error()
+		return ev.drop(ReasonStorageError), nil
+	}
+	if err != nil {
+		record = nil
+	}
+	d := p.decide(ctx, req, mac, record, nil)
+	if d.admit {
+		d = p.peekAdmission(ctx, req, mac, d)
+	}
+	ev.Policies = append(ev.Policies, d.policies...)
+	ev.Detail = d.detail
+	switch {
+	case d.action != ActionAnswer:
+		ev.Action, ev.Reason = d.action, d.reason
+		return ev, nil
+	case !d.admit:
+		ev.Labels = d.record.Labels
+		leaseTime := d.leaseTime
+		if remaining := d.record.Expires.Sub(now); remaining > leaseTime && !d.frozen && d.splitDeadline.IsZero() {
+			// leases extended past the lease time are announced as they are stored
+			leaseTime = remaining
+		}
+		return p.answer(ev, d.reason, d.ip, leaseTime), nil
+	}
+	ev.Labels = p.labelsFor(mac)
+	if d.ip != nil {
+		return p.answer(ev, d.reason, d.ip, d.leaseTime), nil
+	}
+	ip, reason, err := p.peekAllocation(ctx, mac)
+	if err != nil {
+		ev.Detail = err.Error()
+		return ev.drop(reason), nil
+	}
+	if p.cfg.Direction == DirectionDown {
+		ev.Policies = append(ev.Policies, "direction=down")
+	}
+	if p.cfg.PTRPolicy != "" && p.hostname(req) != "" {
+		ev.Policies = append(ev.Policies, "ptr_check="+p.cfg.PTRPolicy)
+	}
+	return p.answer(ev, reason, ip, d.leaseTime), nil
+}
+
+func (e *Evaluation) drop(reason string) *Evaluation {
+	e.Action, e.Reason = ActionDrop, reason
+	return e
+}
+
+func (e *Evaluation) nak(reason string) *Evaluation {
+	e.Action, e.Reason = ActionNAK, reason
+	return e
+}
+
+// answer completes ev with the binding of ip for leaseTime, and the options
+// the plugin would add
+func (p *PluginState) answer(ev *Evaluation, reason string, ip net.IP, leaseTime time.Duration) *Evaluation {
+	ev.Action, ev.Reason = ActionAnswer, reason
+	ev.IP = ip
+	ev.LeaseTime = leaseTime
+	resp, err := dhcpv4.New()
+	if err == nil {
+		ev.Options = p.applyOptions(resp)
+	}
+	return ev
+}
+
+// peekAllocation returns the address a new lease of mac would get, and the
+// reason it would get it. The scan mirrors the allocator: the lowest free
+// address, or the highest one for a pool allocating down, then the address
+// in cooldown for the longest time. The addresses withheld from the pool
+// are skipped, as the allocator holds them, and those other clients prefer
+// after a recovery come after the free ones.
+func (p *PluginState) peekAllocation(ctx context.Context, mac string) (net.IP, string, error) {
+	if ip := p.preferred.peek(mac); ip != nil && p.claimable(mac, ip) == nil && !p.withheld(ip) {
+		return ip, ReasonRecovered, nil
+	}
+
+	held, err := p.quarantinedSet(ctx)
+	if err != nil {
+		return nil, ReasonAllocationUnknown, err
+	}
+	// addresses whose cooldown is over would be returned to the allocator
+	cooling := p.cooldown.snapshot()
+	over := p.clock.Now().Add(-p.cfg.Cooldown)
+	for _, e := range cooling {
+		if !e.Since.Before(over) {
+			held[e.IP.String()] = true
+		}
+	}
+
+	var free, preferred net.IP
+	p.cfg.rangeAddresses(func(ip net.IP) bool {
+		if p.leases.macOf(ip) != "" || p.withheld(ip) || held[ip.String()] {
+			return true
+		}
+		if !p.preferred.otherThan(mac, ip) {
+			free = ip
+			return false
+		}
+		if preferred == nil {
+			preferred = ip
+		}
+		return true
+	})
+	if free == nil {
+		free = preferred
+	}
+	if free != nil {
+		return free, ReasonAllocated, nil
+	}
+	for _, e := range cooling {
+		if !e.Since.Before(over) && p.leases.macOf(e.IP) == "" && !p.withheld(e.IP) {
+			return e.IP, ReasonCooldownReused, nil
+		}
+	}
+	return nil, ReasonPoolExhausted, ErrPoolExhausted
+}
+
+// quarantinedSet returns the addresses in quarantine
+func (p *PluginState) quarantinedSet(ctx context.Context) (map[string]bool, error) {
+	ips, err := p.storage.QuarantinedIPs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		set[ip.String()] = true
+	}
+	return set, nil
+}
@@ -0,0 +1,144 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestEvaluateSkipsWithheldAddresses(t *testing.T) {
+	m := miniredis.RunT(t)
+	m.HSet(REDIS_RESERVATIONS_KEY, "00:11:22:33:44:99", "10.1.0.10")
+	p := startPlugin(t, m, "10.1.0.10", "10.1.0.20", "1h")
+	if err := p.freeze(context.Background(), net.IPv4(10, 1, 0, 11).To4()); err != nil {
+		t.Fatal(err)
+	}
+
+	const mac = "00:11:22:33:44:55"
+	hw, _ := net.ParseMAC(mac)
+	ev, err := p.Evaluate(context.Background(), EvaluationRequest{MAC: hw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := net.IPv4(10, 1, 0, 12).To4()
+	if ev.Action != ActionAnswer || !ev.IP.Equal(want) {
+		t.Fatalf("Evaluate: %s, want %s", ev, want)
+	}
+	offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac))
+	if offer == nil || !offer.YourIPAddr.Equal(ev.IP) {
+		t.Fatalf("offer %v, evaluated %s", offer, ev.IP)
+	}
+}
+
+func TestEvaluateHasNoEffects(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.1.1.10", "10.1.1.20", "1h", "roaming=follow")
+	leased := leaseThrough(t, p, "00:11:22:33:44:55", net.IPv4(192, 0, 2, 1))
+	before := m.Dump()
+
+	hw, _ := net.ParseMAC("00:11:22:33:44:55")
+	for _, er := range []EvaluationRequest{
+		{MAC: hw},
+		{MAC: hw, RequestedIP: leased, GatewayIP: net.IPv4(192, 0, 2, 2)},
+		{MAC: hw, GatewayIP: net.IPv4(192, 0, 2, 2)},
+		{MAC: net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x66}, RequestedIP: net.IPv4(10, 1, 1, 15)},
+	} {
+		if _, err := p.Evaluate(context.Background(), er); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after := m.Dump(); after != before {
+		t.Errorf("storage changed by Evaluate:\n%s\nwant\n%s", after, before)
+	}
+	for _, ip := range []net.IP{net.IPv4(10, 1, 1, 11).To4(), net.IPv4(10, 1, 1, 15).To4()} {
+		got, err := allocateExact(p.allocator, net.IPNet{IP: ip})
+		if err != nil {
+			t.Errorf("%s taken from the allocator by Evaluate: %v", ip, err)
+			continue
+		}
+		if err := p.allocator.Free(got); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ip := p.leases.ipOf("00:11:22:33:44:55"); !ip.Equal(leased) {
+		t.Errorf("lease table holds %s, want %s", ip, leased)
+	}
+}
+
+func TestEvaluateRoaming(t *testing.T) {
+	relayA, relayB := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+	for _, tc := range []struct {
+		roaming, start string
+		request        string
+		discover       string
+	}{
+		{RoamingHold, "10.1.2.10", ActionNAK + " " + ReasonRoamingHold, ActionDrop + " " + ReasonRoamingHold},
+		{RoamingFollow, "10.1.3.10", ActionNAK + " " + ReasonRoamingFollow, ActionAnswer + " " + ReasonAllocated},
+		{RoamingAlert, "10.1.4.10", ActionAnswer + " " + ReasonRenewal, ActionAnswer + " " + ReasonRenewal},
+	} {
+		t.Run(tc.roaming, func(t *testing.T) {
+			m := miniredis.RunT(t)
+			end := net.ParseIP(tc.start).To4()
+			end[3] += 10
+			p := startPlugin(t, m, tc.start, end.String(), "1h", "roaming="+tc.roaming)
+			const mac = "00:11:22:33:44:55"
+			leased := leaseThrough(t, p, mac, relayA)
+
+			hw, _ := net.ParseMAC(mac)
+			request := EvaluationRequest{MAC: hw, RequestedIP: leased, GatewayIP: relayB}
+			discover := EvaluationRequest{MAC: hw, GatewayIP: relayB}
+			for _, c := range []struct {
+				er   EvaluationRequest
+				want string
+			}{{request, tc.request}, {discover, tc.discover}} {
+				ev, err := p.Evaluate(context.Background(), c.er)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := ev.Action + " " + ev.Reason; got != c.want {
+					t.Errorf("Evaluate %v: %s, want %s", c.er.MessageType, ev, c.want)
+				}
+			}
+
+			// the handler agrees
+			ev, err := p.Evaluate(context.Background(), request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac,
+				dhcpv4.WithGatewayIP(relayB), dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(leased))))
+			if got := outcome(out); got != ev.Action {
+				t.Errorf("Handler4 %s, evaluated %s", got, ev)
+			}
+		})
+	}
+}
+
+// leaseThrough has mac lease an address through relay, and returns it
+func leaseThrough(t *testing.T, p *PluginState, mac string, relay net.IP) net.IP {
+	t.Helper()
+	offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac, dhcpv4.WithGatewayIP(relay)))
+	if offer == nil {
+		t.Fatalf("no offer to %s", mac)
+	}
+	ack := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac,
+		dhcpv4.WithGatewayIP(relay), dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(offer.YourIPAddr))))
+	if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("no ACK to %s: %v", mac, ack)
+	}
+	return ack.YourIPAddr
+}
+
+// outcome returns the action a reply of Handler4 amounts to
+func outcome(out *dhcpv4.DHCPv4) string {
+	switch {
+	case out == nil:
+		return ActionDrop
+	case out.MessageType() == dhcpv4.MessageTypeNak:
+		return ActionNAK
+	}
+	return ActionAnswer
+}
@@ -0,0 +1,167 @@
+package rangeredisplugin
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// size of the buffer between the handlers and the event dispatcher
+const eventQueueSize = 1024
+
+// EventType identifies what happened to a lease
+type EventType string
+
+const (
+	EventGrant  EventType = "grant"
+	EventRenew  EventType = "renew"
+	EventExpire EventType = "expire"
+	// EventOffer means an address was offered to a DISCOVER and is held
+	// for the REQUEST of the client, which grants it
+	EventOffer EventType = "offer"
+	// EventExternalReassignment means a record was rewritten by something
+	// other than this plugin instance
+	EventExternalReassignment EventType = "external-reassignment"
+	// EventExcluded means a lease was ended because its address is excluded
+	EventExcluded EventType = "excluded"
+	// EventFreeze means an address was frozen, with the client holding it
+	// if any, and EventUnfreeze that it returned to its normal lifecycle
+	EventFreeze   EventType = "freeze"
+	EventUnfreeze EventType = "unfreeze"
+	// EventConflict means another client was observed using an address,
+	// which is quarantined. MAC is the leaseholder, if any.
+	EventConflict EventType = "conflict"
+	// EventRoam means a client with a lease showed up behind another relay,
+	// and EventFlap that it did so too often within the flap window. The
+	// detail names the relays and the roaming policy applied.
+	EventRoam EventType = "roam"
+	EventFlap EventType = "flap"
+	// EventPTRMismatch means an address was granted although its PTR
+	// record names another host
+	EventPTRMismatch EventType = "ptr-mismatch"
+	// EventClockJump means the system clock was stepped, and the TTLs of
+	// the leases are re-synced from their expiry
+	EventClockJump EventType = "clock-jump"
+	// EventBulkExtend summarizes a bulk extension of the leases
+	EventBulkExtend EventType = "bulk-extend"
+	// EventIdle means the lease of a client not seen for the idle time was
+	// shortened to expire soon
+	EventIdle EventType = "idle"
+	// EventStorageFull means redis ran out of memory and new allocations
+	// are refused, until EventStorageRecovered. They carry no lease.
+	EventStorageFull      EventType = "storage-full"
+	EventStorageRecovered EventType = "storage-recovered"
+	// EventLeaseLimit means the active leases reached the lease limit of
+	// the pool or the global one, and new allocations are refused although
+	// addresses are free, until EventLeaseLimitLifted. They carry no lease.
+	EventLeaseLimit       EventType = "lease-limit"
+	EventLeaseLimitLifted EventType = "lease-limit-lifted"
+)
+
+// Event describes a change of a lease
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	MAC        string
+	IP         net.IP
+	PreviousIP net.IP `json:",omitempty"`
+	Detail     string `json:",omitempty"`
+	// Pressure is the pressure band a grant or a renewal was computed in
+	Pressure string `json:",omitempty"`
+	// Labels are the labels of the lease, see REDIS_LABELS_KEY
+	Labels map[string]string `json:",omitempty"`
+	// Link is the DUID of the DHCPv6 lease of the host, when a DHCPv6
+	// instance of the server correlated it, see REDIS_LINK_KEY_PREFIX
+	Link string `json:",omitempty"`
+}
+
+// EventSink receives the lease events of every plugin instance. HandleEvent
+// is called from a goroutine dedicated to the sink, and events are dropped
+// for that sink only while it falls behind.
+type EventSink interface {
+	HandleEvent(Event)
+}
+
+var (
+	sinksMu sync.RWMutex
+	sinks   []EventSink
+)
+
+// RegisterEventSink adds a sink receiving the events of all plugin instances
+func RegisterEventSink(s EventSink) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	sinks = append(sinks, s)
+}
+
+func registeredSinks() []EventSink {
+	sinksMu.RLock()
+	defer sinksMu.RUnlock()
+	return sinks
+}
+
+// emit queues an event for the sinks without ever blocking the caller
+func (p *PluginState) emit(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	select {
+	case p.events <- ev:
+	default:
+		p.counters.eventsDropped.Add(1)
+	}
+}
+
+// dispatchEvents fans the queued events out to the queue of every sink,
+// until the instance is closed
+func (p *PluginState) dispatchEvents() {
+	defer close(p.dispatched)
+
+	for {
+		select {
+		case ev := <-p.events:
+			log.Debugf("event %s: MAC %s IP %s", ev.Type, ev.MAC, ev.IP)
+			if ev.Link == "" && ev.MAC != "" {
+				ev.Link = dualStack.duidOf(ev.MAC, ev.Time)
+			}
+			// the single place the identities of the clients are
+			// replaced in the events in privacy mode
+			out := privacy.Load().event(ev)
+			for _, q := range p.sinkQueues() {
+				if q.local {
+					q.push(ev)
+				} else {
+					q.push(out)
+				}
+			}
+		case <-p.closing:
+			return
+		}
+	}
+}
+
+// sinkQueues returns the queues of the instance sinks and of the registered
+// sinks, starting a queue for the sinks registered since the last call
+func (p *PluginState) sinkQueues() []*sinkQueue {
+	p.queuesMu.Lock()
+	defer p.queuesMu.Unlock()
+
+	all := append(append([]EventSink(nil), p.sinks...), registeredSinks()...)
+	for i, s := range all[len(p.queues):] {
+		q := newSinkQueue(s)
+		q.local = len(p.queues)+i < len(p.sinks)
+		p.queues = append(p.queues, q)
+		go q.run()
+	}
+	return p.queues
+}
+
+// deliver hands an event to a sink, shielding the dispatcher from its panics
+func deliver(s EventSink, ev Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("event sink panicked on %s event: %v", ev.Type, r)
+		}
+	}()
+	s.HandleEvent(ev)
+}
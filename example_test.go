@@ -0,0 +1,143 @@
+package rangeredisplugin_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+
+	rangeredisplugin "coredhcpcomplie/coredhcp-rangeredis"
+)
+
+// latest returns the instance set up last
+func latest() *rangeredisplugin.PluginState {
+	all := rangeredisplugin.Instances()
+	return all[len(all)-1]
+}
+
+// serve passes a message of type typ from mac through the handler of p,
+// with the reply the server prepares for it, and describes the outcome
+func serve(p *rangeredisplugin.PluginState, typ dhcpv4.MessageType, mac string, mods ...dhcpv4.Modifier) string {
+	hw, _ := net.ParseMAC(mac)
+	req, err := dhcpv4.New(append([]dhcpv4.Modifier{dhcpv4.WithHwAddr(hw), dhcpv4.WithMessageType(typ)}, mods...)...)
+	if err != nil {
+		return err.Error()
+	}
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	if err != nil {
+		return err.Error()
+	}
+	reply := dhcpv4.MessageTypeAck
+	if typ == dhcpv4.MessageTypeDiscover {
+		reply = dhcpv4.MessageTypeOffer
+	}
+	resp.UpdateOption(dhcpv4.OptMessageType(reply))
+	out, _ := p.Handler4(req, resp)
+	if out == nil {
+		return "dropped"
+	}
+	return fmt.Sprintf("%s %s for %s", out.MessageType(), out.YourIPAddr, out.IPAddressLeaseTime(0))
+}
+
+// stepClock is a clock moved by hand
+type stepClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *stepClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *stepClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// An instance leases the range 10.9.0.10 to 10.9.0.20 for an hour from
+// database 0 of a redis server, here miniredis, with the addresses of the
+// leases ended kept out of the pool for a minute. The server sets it up
+// from its configuration with Plugin.Setup4:
+//
+//	server4:
+//	  plugins:
+//	    - range-redis: redis://localhost:6379/0 10.9.0.10 10.9.0.20 1h cooldown=1m
+//
+// Redis must publish the keyevent notifications of expired keys, with
+// notify-keyspace-events set to Ex, or the leases are never freed.
+func Example_setup() {
+	m := miniredis.NewMiniRedis()
+	if err := m.Start(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer m.Close()
+
+	_, err := rangeredisplugin.Plugin.Setup4("redis://"+m.Addr()+"/0", "10.9.0.10", "10.9.0.20", "1h", "cooldown=1m")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	p := latest()
+	defer p.Close(context.Background())
+
+	cfg := p.EffectiveConfig().Config
+	fmt.Println(cfg.Start, cfg.End, cfg.LeaseTime, cfg.Cooldown)
+	// Output: 10.9.0.10 10.9.0.20 1h0m0s 1m0s
+}
+
+// A client is granted an address of a pool of two, and renews it. Once a
+// second client has the other address, a third one gets nothing until the
+// lease of the first expires: redis then expires the shadow key of the
+// lease and notifies it, which miniredis does not do on its own.
+func ExamplePluginState_Handler4() {
+	m := miniredis.NewMiniRedis()
+	if err := m.Start(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer m.Close()
+
+	if _, err := rangeredisplugin.Plugin.Setup4("redis://"+m.Addr()+"/0", "10.9.1.10", "10.9.1.11", "1h"); err != nil {
+		fmt.Println(err)
+		return
+	}
+	p := latest()
+	defer p.Close(context.Background())
+	clock := &stepClock{now: time.Now()}
+	p.SetClock(clock)
+
+	const mac, second, other = "02:00:00:00:00:01", "02:00:00:00:00:02", "02:00:00:00:00:03"
+	fmt.Println("grant:", serve(p, dhcpv4.MessageTypeDiscover, mac))
+	fmt.Println("grant:", serve(p, dhcpv4.MessageTypeRequest, mac,
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 9, 1, 10)))))
+	clock.advance(30 * time.Minute)
+	fmt.Println("renewal:", serve(p, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithClientIP(net.IPv4(10, 9, 1, 10))))
+	fmt.Println("second:", serve(p, dhcpv4.MessageTypeDiscover, second))
+	fmt.Println("other:", serve(p, dhcpv4.MessageTypeDiscover, other))
+
+	clock.advance(2 * time.Hour)
+	m.Del("s:dhcp:" + mac)
+	m.Publish("__keyevent@0__:expired", "s:dhcp:"+mac)
+	// the expiry is handled in the background
+	outcome := "dropped"
+	for deadline := time.Now().Add(time.Second); outcome == "dropped" && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		outcome = serve(p, dhcpv4.MessageTypeDiscover, other)
+	}
+	fmt.Println("other after the expiry:", outcome)
+	// Output:
+	// grant: OFFER 10.9.1.10 for 1h0m0s
+	// grant: ACK 10.9.1.10 for 1h0m0s
+	// renewal: ACK 10.9.1.10 for 1h0m0s
+	// second: OFFER 10.9.1.11 for 1h0m0s
+	// other: dropped
+	// other after the expiry: OFFER 10.9.1.10 for 1h0m0s
+}
@@ -0,0 +1,109 @@
+package rangeredisplugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Policies applied to the active leases of excluded addresses
+const (
+	// ExclusionDrain keeps the lease until the client contacts us again:
+	// a REQUEST is then NAKed and a DISCOVER gets a new address
+	ExclusionDrain = "drain"
+	// ExclusionEvict deletes the lease at startup
+	ExclusionEvict = "evict"
+)
+
+// ipRange is an inclusive range of IPv4 addresses: Start and End are both
+// part of it, see rangeSemantics
+type ipRange struct {
+	Start net.IP
+	End   net.IP
+}
+
+func (r ipRange) contains(ip net.IP) bool {
+	v4 := ip.To4()
+	return v4 != nil && bytes.Compare(v4, r.Start) >= 0 && bytes.Compare(v4, r.End) <= 0
+}
+
+// parseExclusions parses a list of addresses and ranges in the format
+// <ip>|<start>-<end>,...
+func parseExclusions(val string) ([]ipRange, error) {
+	var ranges []ipRange
+	for _, entry := range strings.Split(val, ",") {
+		start, end, isRange := strings.Cut(entry, "-")
+		if !isRange {
+			end = start
+		}
+		r := ipRange{Start: net.ParseIP(start).To4(), End: net.ParseIP(end).To4()}
+		if r.Start == nil || r.End == nil || bytes.Compare(r.Start, r.End) > 0 {
+			return nil, fmt.Errorf("invalid exclusion %q, want <ip> or <start>-<end>", entry)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// excluded reports whether ip must never be leased
+func (c *Config) excluded(ip net.IP) bool {
+	for _, r := range c.Exclusions {
+		if r.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// evictExcluded deletes the stored leases of excluded addresses from redis
+// and from records under the evict policy, and only logs them otherwise.
+func (p *PluginState) evictExcluded(records map[string]Record) {
+	for mac, rec := range records {
+		if !p.cfg.excluded(rec.IP) {
+			continue
+		}
+		if p.cfg.ExclusionPolicy != ExclusionEvict {
+			log.Warnf("lease of %s for MAC %s is excluded, draining it", rec.IP, mac)
+			continue
+		}
+		if err := p.storage.DeleteRecord(mac); err != nil {
+			log.Errorf("could not evict excluded lease of %s for MAC %s: %v", rec.IP, mac, err)
+			continue
+		}
+		log.Warnf("lease of %s for MAC %s is excluded, evicted", rec.IP, mac)
+		delete(records, mac)
+		p.emit(Event{Type: EventExcluded, MAC: mac, IP: rec.IP, Detail: ExclusionEvict})
+	}
+}
+
+// reserveExclusions marks the excluded addresses as allocated, so that they
+// are never granted. Must run once the stored leases are loaded, as the
+// addresses still leased are already allocated.
+func (p *PluginState) reserveExclusions() {
+	for _, r := range p.cfg.Exclusions {
+		start, end := binary.BigEndian.Uint32(r.Start), binary.BigEndian.Uint32(r.End)
+		for n := start; n <= end && n >= start; n++ {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, n)
+			if p.leases.macOf(ip) != "" {
+				continue
+			}
+			if _, err := allocateExact(p.allocator, net.IPNet{IP: ip}); err != nil {
+				log.Errorf("could not reserve excluded address %s: %v", ip, err)
+			}
+		}
+	}
+}
+
+// drainExcluded ends the lease of mac on an excluded address, keeping the
+// address reserved
+func (p *PluginState) drainExcluded(mac string, record *Record) {
+	if err := p.storage.DeleteRecord(mac); err != nil {
+		log.Errorf("could not drain excluded lease of %s for MAC %s: %v", record.IP, mac, err)
+	}
+	p.leases.remove(mac, record.IP)
+	p.emit(Event{Type: EventExcluded, MAC: mac, IP: record.IP, Detail: ExclusionDrain})
+	log.Warnf("lease of %s for MAC %s is excluded, moving the client", record.IP, mac)
+}
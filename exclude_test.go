@@ -0,0 +1,161 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// excludeLeased leases the first two addresses of the pool 10.0.5.10-20 to
+// a and b, then restarts the instance with the address of a excluded
+// under policy
+func excludeLeased(t *testing.T, m *miniredis.Miniredis, a, b, policy string) *PluginState {
+	t.Helper()
+	p := startPlugin(t, m, "10.0.5.10", "10.0.5.20", "1h")
+	if ip := lease(t, p, a); !ip.Equal(net.IPv4(10, 0, 5, 10)) {
+		t.Fatalf("%s leased %s", a, ip)
+	}
+	lease(t, p, b)
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return startPlugin(t, m, "10.0.5.10", "10.0.5.20", "1h", "exclude=10.0.5.10", "exclusion_policy="+policy)
+}
+
+// renewal has mac renew ip, returning the type of the answer
+func renewal(t *testing.T, p *PluginState, mac string, ip net.IP) dhcpv4.MessageType {
+	t.Helper()
+	resp := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithClientIP(ip)))
+	if resp == nil {
+		return dhcpv4.MessageTypeNone
+	}
+	return resp.MessageType()
+}
+
+func TestExclusionDrain(t *testing.T) {
+	m := miniredis.RunT(t)
+	const a, b, other = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c"
+	p := excludeLeased(t, m, a, b, ExclusionDrain)
+	events := recordEvents(p)
+	excluded := net.IPv4(10, 0, 5, 10)
+
+	// the lease is kept until its client comes back
+	if mac := p.leases.macOf(excluded); mac != a {
+		t.Fatalf("excluded address held by %q, want %s", mac, a)
+	}
+	if ip := offered(t, p, other); ip.Equal(excluded) {
+		t.Error("excluded address offered to another client")
+	}
+
+	// the renewal in the middle of the transition is NAKed, moving the client
+	if typ := renewal(t, p, a, excluded); typ != dhcpv4.MessageTypeNak {
+		t.Errorf("renewal of an excluded address answered %s, want NAK", typ)
+	}
+	eventually(t, "the exclusion event", func() bool {
+		ev := events.of(EventExcluded)
+		return len(ev) == 1 && ev[0].MAC == a && ev[0].IP.Equal(excluded) && ev[0].Detail == ExclusionDrain
+	})
+	if _, err := p.storage.GetRecord(a); err == nil {
+		t.Error("record of the drained lease kept")
+	}
+	if ip := lease(t, p, a); ip.Equal(excluded) {
+		t.Error("excluded address granted again to its former client")
+	}
+	// the other leases renew as usual
+	if typ := renewal(t, p, b, net.IPv4(10, 0, 5, 11)); typ != dhcpv4.MessageTypeAck {
+		t.Errorf("renewal of %s answered %s, want ACK", b, typ)
+	}
+	assertNeverGranted(t, p, excluded)
+}
+
+func TestExclusionDrainExpiry(t *testing.T) {
+	m := miniredis.RunT(t)
+	const a, b = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+	p := excludeLeased(t, m, a, b, ExclusionDrain)
+	excluded := net.IPv4(10, 0, 5, 10)
+
+	// the lease ends without the client coming back
+	expire(t, m, p, a)
+	eventually(t, "the expiry", func() bool { return p.leases.macOf(excluded) == "" })
+	assertNeverGranted(t, p, excluded)
+}
+
+func TestExclusionEvict(t *testing.T) {
+	m := miniredis.RunT(t)
+	const a, b = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+	p := excludeLeased(t, m, a, b, ExclusionEvict)
+	excluded := net.IPv4(10, 0, 5, 10)
+
+	if _, err := p.storage.GetRecord(a); err == nil {
+		t.Error("record of the excluded lease not evicted")
+	}
+	if _, err := p.storage.LookupByIP(excluded); err == nil {
+		t.Error("index entry of the excluded lease not evicted")
+	}
+	if mac := p.leases.macOf(excluded); mac != "" {
+		t.Errorf("excluded address held by %s after the eviction", mac)
+	}
+	if _, err := p.storage.GetRecord(b); err != nil {
+		t.Errorf("lease of %s evicted: %v", b, err)
+	}
+	// a renewal from the client unaware of the eviction is NAKed
+	if typ := renewal(t, p, a, excluded); typ != dhcpv4.MessageTypeNak {
+		t.Errorf("renewal of an evicted address answered %s, want NAK", typ)
+	}
+	assertNeverGranted(t, p, excluded)
+}
+
+// assertNeverGranted has new clients discover until the pool 10.0.5.10-20
+// is exhausted, and checks that excluded is never offered
+func assertNeverGranted(t *testing.T, p *PluginState, excluded net.IP) {
+	t.Helper()
+	for i := 0; i < 11; i++ {
+		offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, fmt.Sprintf("00:11:22:33:55:%02x", i)))
+		if offer != nil && offer.YourIPAddr.Equal(excluded) {
+			t.Fatalf("excluded address %s offered", excluded)
+		}
+	}
+}
+
+func TestRequestedExcluded(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.77.10", "10.0.77.20", "1h", "exclude=10.0.77.12,10.0.77.15-10.0.77.16")
+	const mac = "00:11:22:33:44:0a"
+	hw, _ := net.ParseMAC(mac)
+
+	// a client cannot talk the plugin into leasing an excluded address,
+	// nor is it predicted to; other MAC addresses ask, past the NAK rate
+	// limit of the client
+	n := 0
+	for _, ip := range []net.IP{net.IPv4(10, 0, 77, 12), net.IPv4(10, 0, 77, 16)} {
+		if err := p.claimable(mac, ip); !errors.Is(err, ErrExcluded) {
+			t.Errorf("claimable(%s): %v", ip, err)
+		}
+		for _, mod := range []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)), dhcpv4.WithClientIP(ip)} {
+			n++
+			resp := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, fmt.Sprintf("00:11:22:33:55:%02x", n), mod))
+			if resp == nil || resp.MessageType() != dhcpv4.MessageTypeNak {
+				t.Errorf("request of %s answered %v, want a NAK", ip, resp)
+			}
+		}
+		ev, err := p.Evaluate(context.Background(), EvaluationRequest{MAC: hw, RequestedIP: ip})
+		if err != nil || ev.Action == ActionAnswer {
+			t.Errorf("evaluation of %s: %v, %v", ip, ev, err)
+		}
+		if owner := p.leases.macOf(ip); owner != "" {
+			t.Errorf("excluded %s leased to %s", ip, owner)
+		}
+	}
+
+	// an address next to them is granted
+	ip := net.IPv4(10, 0, 77, 13)
+	resp := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip))))
+	if resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck || !resp.YourIPAddr.Equal(ip) {
+		t.Errorf("request of %s answered %v", ip, resp)
+	}
+}
@@ -0,0 +1,25 @@
+package rangeredisplugin
+
+import "time"
+
+// default tolerance of the expiry comparisons
+const defaultExpiryTolerance = time.Second
+
+// endsBy reports whether a lease expiring at expires is over by t, give or
+// take tolerance. Expiries within tolerance after t count as over, so that
+// a notification arriving slightly early, or a clock a few hundred
+// milliseconds behind, does not keep a lease alive. Every comparison of an
+// expiry with the current time goes through it.
+func endsBy(expires, t time.Time, tolerance time.Duration) bool {
+	return !expires.After(t.Add(tolerance))
+}
+
+// endsBy is endsBy with the tolerance of the instance
+func (p *PluginState) endsBy(expires, t time.Time) bool {
+	return endsBy(expires, t, p.cfg.ExpiryTolerance)
+}
+
+// endsBy is endsBy with the tolerance of the storage
+func (r *RedisProvider) endsBy(expires, t time.Time) bool {
+	return endsBy(expires, t, r.tolerance)
+}
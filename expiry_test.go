@@ -0,0 +1,102 @@
+package rangeredisplugin
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestEndsBy(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 400*int(time.Millisecond), time.UTC)
+	for _, tc := range []struct {
+		name      string
+		expires   time.Time
+		tolerance time.Duration
+		want      bool
+	}{
+		{"past", now.Add(-time.Hour), time.Second, true},
+		{"exactly now", now, time.Second, true},
+		{"exactly now without tolerance", now, 0, true},
+		{"within the tolerance", now.Add(time.Second - time.Nanosecond), time.Second, true},
+		{"at the tolerance", now.Add(time.Second), time.Second, true},
+		{"past the tolerance", now.Add(time.Second + time.Nanosecond), time.Second, false},
+		{"before the tolerance", now.Add(-time.Second), time.Second, true},
+		{"after now without tolerance", now.Add(time.Nanosecond), 0, false},
+		// an expiry rounded to the second at write time, compared with the
+		// unrounded time it was computed from
+		{"rounded down", now.Round(time.Second), time.Second, true},
+		{"rounded up", now.Add(100 * time.Millisecond).Round(time.Second), time.Second, true},
+		{"rounded up without tolerance", now.Add(100 * time.Millisecond).Round(time.Second), 0, false},
+		{"future", now.Add(time.Hour), time.Second, false},
+	} {
+		if got := endsBy(tc.expires, now, tc.tolerance); got != tc.want {
+			t.Errorf("%s: endsBy(%s, %s, %s) = %t, want %t", tc.name, tc.expires.Format(time.StampMilli), now.Format(time.StampMilli), tc.tolerance, got, tc.want)
+		}
+	}
+}
+
+func TestExpiresFullPrecision(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.33.10", "10.0.33.20", "1h")
+	const mac = "00:11:22:33:44:0a"
+	// a clock in the middle of a second
+	advance(p, 1500*time.Millisecond-time.Duration(p.clock.Now().Nanosecond()))
+	lease(t, p, mac)
+	rec, err := p.storage.GetRecord(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := p.clock.Now().Add(time.Hour); !rec.Expires.Equal(want) {
+		t.Errorf("lease stored until %s, want %s", rec.Expires.Format(time.StampMicro), want.Format(time.StampMicro))
+	}
+
+	// the lease seconds sent are rounded
+	advance(p, 700*time.Millisecond)
+	req := newRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithClientIP(rec.IP))
+	ack := exchange(t, p, req)
+	if ack == nil || ack.IPAddressLeaseTime(0) != time.Hour {
+		t.Errorf("renewal answered %v", ack)
+	}
+}
+
+func TestExpiryTolerance(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.33.10", "10.0.33.20", "1h")
+	const early, renewed = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+	ips := map[string]net.IP{early: lease(t, p, early), renewed: lease(t, p, renewed)}
+	advance(p, time.Hour-500*time.Millisecond)
+
+	// a notification a little early ends the lease
+	p.handleExpired(p.storage.ns.shadow + early)
+	if holder := p.leases.macOf(ips[early]); holder != "" {
+		t.Errorf("%s still held by %s after its expiry within the tolerance", ips[early], holder)
+	}
+
+	// a lease renewed right as its shadow key expired is kept
+	if typ := renewal(t, p, renewed, ips[renewed]); typ != dhcpv4.MessageTypeAck {
+		t.Fatalf("renewal answered %s", typ)
+	}
+	p.handleExpired(p.storage.ns.shadow + renewed)
+	if holder := p.leases.macOf(ips[renewed]); holder != renewed {
+		t.Errorf("renewed %s held by %q after the expiry of the old lease", ips[renewed], holder)
+	}
+	if _, err := p.storage.GetRecord(renewed); err != nil {
+		t.Errorf("record of the renewed lease: %v", err)
+	}
+}
+
+func TestExpiryToleranceOption(t *testing.T) {
+	cfg, err := parseConfig([]string{"redis://localhost/0", "10.0.33.10", "10.0.33.20", "1h"})
+	if err != nil || cfg.ExpiryTolerance != time.Second {
+		t.Errorf("default tolerance: %v, %v", cfg, err)
+	}
+	if cfg, err = parseConfig([]string{"redis://localhost/0", "10.0.33.10", "10.0.33.20", "1h", "expiry_tolerance=0s"}); err != nil || cfg.ExpiryTolerance != 0 {
+		t.Errorf("no tolerance: %v, %v", cfg, err)
+	}
+	if _, err := parseConfig([]string{"redis://localhost/0", "10.0.33.10", "10.0.33.20", "1h", "expiry_tolerance=-1s"}); err == nil {
+		t.Error("negative tolerance accepted")
+	}
+}
@@ -0,0 +1,221 @@
+package rangeredisplugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// number of records per exported chunk
+	exportChunkSize = 1000
+	// minimum delay between two chunks, to keep the load on redis low
+	exportChunkDelay = 200 * time.Millisecond
+)
+
+// ErrExportRunning is returned when an export is started while one is running
+var ErrExportRunning = errors.New("an export is already running")
+
+// ExportWriter stores the objects produced by a lease export
+type ExportWriter interface {
+	Put(ctx context.Context, name string, data []byte) error
+}
+
+// ExportedLease is one line of an exported chunk
+type ExportedLease struct {
+	MAC string
+	Record
+	// DUID is the DHCPv6 client linked to the lease, see
+	// REDIS_LINK_KEY_PREFIX
+	DUID string `json:",omitempty"`
+}
+
+// ExportManifest is written once all chunks of an export are stored
+type ExportManifest struct {
+	ID       string
+	Started  time.Time
+	Finished time.Time
+	Chunks   int
+	Records  int
+	// SHA256 is the checksum of the concatenation of all chunks, in order
+	SHA256 string
+}
+
+// exportState is the resume point of an export, kept in redis
+type exportState struct {
+	ID      string
+	Started time.Time
+	Cursor  uint64
+	Chunks  int
+	Records int
+	// Hash is the marshaled state of the running checksum
+	Hash []byte
+}
+
+// FileExportWriter writes the export objects as files below Dir
+type FileExportWriter struct {
+	Dir string
+}
+
+// Put atomically writes data to the file name below the directory
+func (w *FileExportWriter) Put(ctx context.Context, name string, data []byte) error {
+	path := filepath.Join(w.Dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// exporter serializes the exports of a plugin instance
+type exporter struct {
+	mu sync.Mutex
+}
+
+// Export streams all leases in chunks to w, then writes a manifest. The
+// progress is checkpointed in redis after every chunk, so an interrupted
+// export resumes where it left off on the next call.
+func (p *PluginState) Export(ctx context.Context, w ExportWriter) (*ExportManifest, error) {
+	if !p.exporter.mu.TryLock() {
+		return nil, ErrExportRunning
+	}
+	defer p.exporter.mu.Unlock()
+
+	st := &exportState{}
+	resumed, err := p.storage.loadCheckpoint(ctx, p.storage.ns.export, st)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	if !resumed {
+		now := p.clock.Now()
+		st = &exportState{ID: now.UTC().Format("20060102T150405Z"), Started: now}
+	} else {
+		if err := hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(st.Hash); err != nil {
+			return nil, fmt.Errorf("invalid export checkpoint: %w", err)
+		}
+		log.Infof("export %s: resuming at chunk %d", st.ID, st.Chunks)
+	}
+
+	for {
+		records, next, err := p.storage.ScanRecords(ctx, st.Cursor, exportChunkSize)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(records) > 0 {
+			macs := make([]string, 0, len(records))
+			for mac := range records {
+				macs = append(macs, mac)
+			}
+			links, err := p.storage.Links(ctx, macs...)
+			if err != nil {
+				return nil, err
+			}
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			for i, mac := range macs {
+				if err := enc.Encode(ExportedLease{MAC: mac, Record: records[mac], DUID: links[i]}); err != nil {
+					return nil, err
+				}
+			}
+			// the single place the identities of the clients are
+			// replaced in the exports in privacy mode
+			chunk := privacy.Load().bytes(buf.Bytes())
+			name := fmt.Sprintf("%s/chunk-%05d.jsonl", st.ID, st.Chunks)
+			if err := w.Put(ctx, name, chunk); err != nil {
+				return nil, fmt.Errorf("could not write %s: %w", name, err)
+			}
+			hash.Write(chunk)
+			st.Chunks++
+			st.Records += len(records)
+		}
+
+		st.Cursor = next
+		if st.Cursor == 0 {
+			break
+		}
+		if st.Hash, err = hash.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+			return nil, err
+		}
+		if err := p.storage.saveCheckpoint(ctx, p.storage.ns.export, st); err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(exportChunkDelay):
+		}
+	}
+
+	m := &ExportManifest{
+		ID:       st.ID,
+		Started:  st.Started,
+		Finished: p.clock.Now(),
+		Chunks:   st.Chunks,
+		Records:  st.Records,
+		SHA256:   hex.EncodeToString(hash.Sum(nil)),
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Put(ctx, st.ID+"/manifest.json", data); err != nil {
+		return nil, fmt.Errorf("could not write manifest: %w", err)
+	}
+	if err := p.storage.clearCheckpoint(ctx, p.storage.ns.export); err != nil {
+		log.Warnf("export %s: could not clear checkpoint: %v", st.ID, err)
+	}
+
+	log.Infof("export %s: %d records in %d chunks", m.ID, m.Records, m.Chunks)
+	return m, nil
+}
+
+// exportWriter returns the writer configured for the instance, or nil
+func (p *PluginState) exportWriter() ExportWriter {
+	switch {
+	case p.cfg.ExportS3 != nil:
+		return p.cfg.ExportS3
+	case p.cfg.ExportDir != "":
+		return &FileExportWriter{Dir: p.cfg.ExportDir}
+	}
+	return nil
+}
+
+// runExport runs an export with the configured writer, logging the outcome
+func (p *PluginState) runExport(ctx context.Context) {
+	w := p.exportWriter()
+	if w == nil {
+		log.Warn("export: no export destination configured")
+		return
+	}
+	if _, err := p.Export(ctx, w); err != nil {
+		log.Errorf("export failed: %v", err)
+	}
+}
+
+// exportLoop runs an export every day at the configured time
+func (p *PluginState) exportLoop() {
+	for {
+		now := p.clock.Now()
+		next := time.Date(now.Year(), now.Month(), now.Day(), p.cfg.ExportHour, p.cfg.ExportMinute, 0, 0, now.Location())
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+		time.Sleep(next.Sub(now))
+		p.runExport(context.Background())
+	}
+}
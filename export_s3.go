@@ -0,0 +1,135 @@
+package rangeredisplugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// S3ExportWriter uploads the export objects to an S3-compatible object
+// storage, signing the requests with AWS signature version 4.
+type S3ExportWriter struct {
+	// Endpoint is the base URL of the service, e.g. https://s3.example.com
+	Endpoint  string
+	Bucket    string
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client `json:"-"`
+}
+
+// parseS3URI parses s3://<access key>:<secret key>@<host>/<bucket>[/<prefix>]
+// with the optional query parameters region (default us-east-1) and
+// insecure=true to use plain http.
+func parseS3URI(uri string) (*S3ExportWriter, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		// the error quotes the URI, keys included
+		return nil, errors.New(strings.ReplaceAll(err.Error(), uri, redactURI(uri)))
+	}
+	if u.Scheme != "s3" || u.Host == "" || u.User == nil {
+		return nil, errors.New("want s3://<access key>:<secret key>@<host>/<bucket>[/<prefix>]")
+	}
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if bucket == "" {
+		return nil, errors.New("bucket cannot be empty")
+	}
+	secret, _ := u.User.Password()
+
+	scheme := "https"
+	if u.Query().Get("insecure") == "true" {
+		scheme = "http"
+	}
+	region := u.Query().Get("region")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &S3ExportWriter{
+		Endpoint:  scheme + "://" + u.Host,
+		Bucket:    bucket,
+		Prefix:    prefix,
+		Region:    region,
+		AccessKey: u.User.Username(),
+		SecretKey: secret,
+		Client:    &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+// Put uploads data as the object name
+func (w *S3ExportWriter) Put(ctx context.Context, name string, data []byte) error {
+	objectPath := "/" + path.Join(w.Bucket, w.Prefix, name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, w.Endpoint+objectPath, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	w.sign(req, objectPath, data, time.Now().UTC())
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("upload of %s failed: %s: %s", name, resp.Status, body)
+	}
+	return nil
+}
+
+// sign adds the AWS signature version 4 headers to req
+func (w *S3ExportWriter) sign(req *http.Request, objectPath string, payload []byte, now time.Time) {
+	payloadHash := sha256Hex(payload)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("x-amz-date", amzDate)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		objectPath,
+		"",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + w.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+w.SecretKey), date)
+	key = hmacSHA256(key, w.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		w.AccessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,214 @@
+package rangeredisplugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// memWriter is an ExportWriter keeping the objects in memory. put, if set,
+// is called before each object is stored, and fails the write if it fails.
+type memWriter struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	put     func(name string) error
+}
+
+func (w *memWriter) Put(ctx context.Context, name string, data []byte) error {
+	if w.put != nil {
+		if err := w.put(name); err != nil {
+			return err
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.objects == nil {
+		w.objects = make(map[string][]byte)
+	}
+	w.objects[name] = append([]byte(nil), data...)
+	return nil
+}
+
+// chunks returns the names of the chunks of export id, in order
+func (w *memWriter) chunks(id string) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var names []string
+	for name := range w.objects {
+		if strings.HasPrefix(name, id+"/chunk-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// startExport sets up an instance with n leases, served by a redis
+// scanning in pages
+func startExport(t *testing.T, n int) *PluginState {
+	t.Helper()
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.9.0.0/16", "1h")
+	pagedScan(m)
+	for i := 0; i < n; i++ {
+		mac := fmt.Sprintf("00:11:22:33:%02x:%02x", i/256, i%256)
+		if err := p.storage.SaveRecord(mac, boundRecord(fmt.Sprintf("10.9.%d.%d", i/250, 1+i%250), time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+// verifyExport checks that the export described by manifest holds n leases
+// once each, and that its checksum is that of its chunks
+func verifyExport(t *testing.T, w *memWriter, manifest *ExportManifest, n int) {
+	t.Helper()
+	names := w.chunks(manifest.ID)
+	if len(names) != manifest.Chunks || manifest.Records != n {
+		t.Errorf("manifest of %d records in %d chunks, %d chunks written, want %d records",
+			manifest.Records, manifest.Chunks, len(names), n)
+	}
+	hash := sha256.New()
+	seen := make(map[string]bool)
+	for _, name := range names {
+		chunk := w.objects[name]
+		hash.Write(chunk)
+		sc := bufio.NewScanner(bytes.NewReader(chunk))
+		for sc.Scan() {
+			var l ExportedLease
+			if err := json.Unmarshal(sc.Bytes(), &l); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if seen[l.MAC] {
+				t.Errorf("%s exported twice", l.MAC)
+			}
+			seen[l.MAC] = true
+		}
+	}
+	if len(seen) != n {
+		t.Errorf("%d leases exported, want %d", len(seen), n)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != manifest.SHA256 {
+		t.Errorf("checksum %s of the chunks, manifest says %s", sum, manifest.SHA256)
+	}
+
+	var stored ExportManifest
+	if err := json.Unmarshal(w.objects[manifest.ID+"/manifest.json"], &stored); err != nil {
+		t.Fatalf("manifest: %v", err)
+	}
+	if stored.SHA256 != manifest.SHA256 || stored.Records != manifest.Records {
+		t.Errorf("manifest stored %+v, returned %+v", stored, *manifest)
+	}
+}
+
+func TestExport(t *testing.T) {
+	p := startExport(t, 2500)
+	w := &memWriter{}
+	start := time.Now()
+	manifest, err := p.Export(context.Background(), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Chunks != 3 {
+		t.Errorf("%d chunks, want 3", manifest.Chunks)
+	}
+	verifyExport(t, w, manifest, 2500)
+	// throttled between the chunks
+	if elapsed := time.Since(start); elapsed < 2*exportChunkDelay {
+		t.Errorf("exported in %s, want at least %s", elapsed, 2*exportChunkDelay)
+	}
+	if p.storage.rdb.Exists(context.Background(), REDIS_EXPORT_STATE_KEY).Val() != 0 {
+		t.Error("checkpoint left after the export")
+	}
+}
+
+func TestExportResumes(t *testing.T) {
+	p := startExport(t, 2500)
+	failed := errors.New("bucket unavailable")
+	w := &memWriter{put: func(name string) error {
+		if strings.HasSuffix(name, "chunk-00001.jsonl") {
+			return failed
+		}
+		return nil
+	}}
+	if _, err := p.Export(context.Background(), w); !errors.Is(err, failed) {
+		t.Fatalf("interrupted export: %v", err)
+	}
+
+	// the first chunk is not written again
+	var written []string
+	w.put = func(name string) error {
+		written = append(written, filepath.Base(name))
+		return nil
+	}
+	manifest, err := p.Export(context.Background(), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"chunk-00001.jsonl", "chunk-00002.jsonl", "manifest.json"}; strings.Join(written, " ") != strings.Join(want, " ") {
+		t.Errorf("resumed export wrote %v, want %v", written, want)
+	}
+	verifyExport(t, w, manifest, 2500)
+}
+
+func TestExportCancelled(t *testing.T) {
+	p := startExport(t, 2500)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &memWriter{put: func(name string) error {
+		if strings.HasSuffix(name, "chunk-00000.jsonl") {
+			cancel()
+		}
+		return nil
+	}}
+	if _, err := p.Export(ctx, w); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled export: %v", err)
+	}
+	if n := len(w.objects); n != 1 {
+		t.Errorf("%d objects written by the cancelled export, want 1", n)
+	}
+
+	w.put = nil
+	manifest, err := p.Export(context.Background(), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyExport(t, w, manifest, 2500)
+}
+
+func TestExportRunning(t *testing.T) {
+	p := startExport(t, 10)
+	p.exporter.mu.Lock()
+	defer p.exporter.mu.Unlock()
+	if _, err := p.Export(context.Background(), &memWriter{}); !errors.Is(err, ErrExportRunning) {
+		t.Errorf("concurrent export: %v, want ErrExportRunning", err)
+	}
+}
+
+func TestFileExportWriter(t *testing.T) {
+	w := &FileExportWriter{Dir: t.TempDir()}
+	if err := w.Put(context.Background(), "20260101T000000Z/chunk-00000.jsonl", []byte("{}\n")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(w.Dir, "20260101T000000Z", "chunk-00000.jsonl"))
+	if err != nil || string(data) != "{}\n" {
+		t.Errorf("file holds %q, %v", data, err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(w.Dir, "*", "*.tmp")); len(matches) != 0 {
+		t.Errorf("temporary files left: %v", matches)
+	}
+}
@@ -0,0 +1,110 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// default upper bound of the remaining lease time BulkExtend may guarantee
+const defaultMaxExtension = 24 * time.Hour
+
+var (
+	// ErrExtensionTooLong is returned when a bulk extension exceeds the
+	// configured maximum
+	ErrExtensionTooLong = errors.New("extension exceeds the configured maximum")
+	// ErrExtendRunning is returned when a bulk extension is started while
+	// one is running
+	ErrExtendRunning = errors.New("a bulk extension is already running")
+)
+
+// BulkExtendResult is the outcome of a bulk extension
+type BulkExtendResult struct {
+	// Until is the time every lease is guaranteed to last to
+	Until    time.Time
+	Scanned  int
+	Extended int
+}
+
+// extendState is the resume point of a bulk extension, kept in redis
+type extendState struct {
+	BulkExtendResult
+	Cursor uint64
+}
+
+// extender serializes the bulk extensions of a plugin instance
+type extender struct {
+	mu sync.Mutex
+}
+
+// BulkExtend pushes the expiry of every lease expiring within
+// minimumRemaining to that time, e.g. ahead of a redis maintenance window.
+// Leases are rewritten in throttled chunks and the progress is checkpointed
+// in redis: an interrupted run resumes on the next call, keeping the
+// deadline of the interrupted run.
+func (p *PluginState) BulkExtend(ctx context.Context, minimumRemaining time.Duration) (*BulkExtendResult, error) {
+	if minimumRemaining > p.cfg.MaxExtension {
+		return nil, fmt.Errorf("%w: %s > %s", ErrExtensionTooLong, minimumRemaining, p.cfg.MaxExtension)
+	}
+	if !p.extender.mu.TryLock() {
+		return nil, ErrExtendRunning
+	}
+	defer p.extender.mu.Unlock()
+
+	st := &extendState{}
+	resumed, err := p.storage.loadCheckpoint(ctx, p.storage.ns.extend, st)
+	if err != nil {
+		return nil, err
+	}
+	if resumed {
+		log.Infof("bulk extension: resuming extension until %s", st.Until)
+	} else {
+		st.Until = p.clock.Now().Add(minimumRemaining)
+	}
+
+	for {
+		records, next, err := p.storage.ScanRecords(ctx, st.Cursor, exportChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		for mac, rec := range records {
+			st.Scanned++
+			if !rec.Expires.Before(st.Until) {
+				continue
+			}
+			rec.Expires = st.Until
+			if err := p.storage.SaveRecord(mac, &rec); err != nil {
+				return nil, fmt.Errorf("could not extend lease of %s: %w", mac, err)
+			}
+			st.Extended++
+		}
+
+		st.Cursor = next
+		if st.Cursor == 0 {
+			break
+		}
+		if err := p.storage.saveCheckpoint(ctx, p.storage.ns.extend, st); err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(exportChunkDelay):
+		}
+	}
+
+	if err := p.storage.clearCheckpoint(ctx, p.storage.ns.extend); err != nil {
+		log.Warnf("bulk extension: could not clear checkpoint: %v", err)
+	}
+
+	res := st.BulkExtendResult
+	log.Infof("bulk extension: extended %d of %d leases until %s", res.Extended, res.Scanned, res.Until)
+	p.emit(Event{
+		Type:   EventBulkExtend,
+		Detail: fmt.Sprintf("extended %d of %d leases until %s", res.Extended, res.Scanned, res.Until.Format(time.RFC3339)),
+	})
+	return &res, nil
+}
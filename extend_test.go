@@ -0,0 +1,173 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestBulkExtend(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.7.10", "10.0.7.200", "1h")
+	events := recordEvents(p)
+	now := p.clock.Now()
+	expires := map[string]time.Time{
+		"00:11:22:33:44:01": now.Add(10 * time.Minute),
+		"00:11:22:33:44:02": now.Add(90 * time.Minute),
+		"00:11:22:33:44:03": now.Add(3 * time.Hour),
+		"00:11:22:33:44:04": now.Add(48 * time.Hour),
+	}
+	i := 0
+	for mac, exp := range expires {
+		i++
+		rec := Record{IP: net.IPv4(10, 0, 7, byte(10+i)).To4(), Expires: exp, State: StateBound}
+		if err := p.storage.SaveRecord(mac, &rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := p.BulkExtend(context.Background(), 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	until := now.Add(2 * time.Hour)
+	if !res.Until.Equal(until) || res.Scanned != 4 || res.Extended != 2 {
+		t.Errorf("result %+v, want 2 of 4 leases extended until %s", *res, until)
+	}
+	for mac, exp := range expires {
+		want := exp
+		if exp.Before(until) {
+			want = until
+		}
+		rec, err := p.storage.GetRecord(mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rec.Expires.Equal(want) {
+			t.Errorf("%s expires %s, want %s", mac, rec.Expires, want)
+		}
+		if ttl := m.TTL(p.storage.ns.shadow + mac); ttl < time.Until(want)-time.Minute {
+			t.Errorf("shadow key of %s expires in %s, before the lease", mac, ttl)
+		}
+	}
+	eventually(t, "the summary event", func() bool {
+		ev := events.of(EventBulkExtend)
+		return len(ev) == 1 && ev[0].Detail == fmt.Sprintf("extended 2 of 4 leases until %s", until.Format(time.RFC3339))
+	})
+}
+
+func TestBulkExtendRenewals(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.7.10", "10.0.7.200", "1h")
+	const mac = "00:11:22:33:44:55"
+	ip := lease(t, p, mac)
+	res, err := p.BulkExtend(context.Background(), 4*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client renewing is told the extended lease time, and keeps it
+	advance(p, 30*time.Minute)
+	ack := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithClientIP(ip)))
+	if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("renewal after the extension answered %v", ack)
+	}
+	if got, want := ack.IPAddressLeaseTime(0), res.Until.Sub(p.clock.Now()); got != want {
+		t.Errorf("renewal told a lease time of %s, want the %s left of the extension", got, want)
+	}
+	rec, err := p.storage.GetRecord(mac)
+	if err != nil || !rec.Expires.Equal(res.Until) {
+		t.Errorf("record after the renewal: %v, %v, want the extension kept", rec, err)
+	}
+
+	// past the extension, renewals grant the lease time again
+	advance(p, 4*time.Hour)
+	ack = exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithClientIP(ip)))
+	if ack == nil || ack.IPAddressLeaseTime(0) != time.Hour {
+		t.Errorf("renewal past the extension answered %v, want a lease time of 1h", ack)
+	}
+}
+
+func TestBulkExtendWhileRenewing(t *testing.T) {
+	p := startExport(t, 2500)
+	// a client renewing its lease while the extension runs
+	const mac = "00:11:22:33:00:00"
+	ip := net.IPv4(10, 9, 0, 1).To4()
+	done := make(chan error)
+	var res *BulkExtendResult
+	go func() {
+		var err error
+		res, err = p.BulkExtend(context.Background(), 3*time.Hour)
+		done <- err
+	}()
+	for i := 0; i < 5; i++ {
+		ack := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithClientIP(ip)))
+		if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck || !ack.YourIPAddr.Equal(ip) {
+			t.Fatalf("renewal during the extension answered %v", ack)
+		}
+		if lt := ack.IPAddressLeaseTime(0); lt < time.Hour || lt > 3*time.Hour {
+			t.Errorf("renewal during the extension told a lease time of %s", lt)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if res.Scanned != 2500 {
+		t.Errorf("%d leases scanned, want 2500", res.Scanned)
+	}
+	rec, err := p.storage.GetRecord(mac)
+	if err != nil || rec.Expires.Before(res.Until) || !rec.IP.Equal(ip) {
+		t.Errorf("record after the extension: %v, %v, want %s until %s at least", rec, err, ip, res.Until)
+	}
+}
+
+func TestBulkExtendLimits(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.7.10", "10.0.7.200", "1h", "max_extension=6h")
+	lease(t, p, "00:11:22:33:44:55")
+	if _, err := p.BulkExtend(context.Background(), 7*time.Hour); !errors.Is(err, ErrExtensionTooLong) {
+		t.Errorf("extension above the maximum: %v, want ErrExtensionTooLong", err)
+	}
+	rec, _ := p.storage.GetRecord("00:11:22:33:44:55")
+	if rec.Expires.After(p.clock.Now().Add(time.Hour)) {
+		t.Error("lease extended by a refused extension")
+	}
+
+	p.extender.mu.Lock()
+	_, err := p.BulkExtend(context.Background(), time.Hour)
+	p.extender.mu.Unlock()
+	if !errors.Is(err, ErrExtendRunning) {
+		t.Errorf("concurrent extension: %v, want ErrExtendRunning", err)
+	}
+}
+
+func TestBulkExtendResumes(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.7.10", "10.0.7.200", "1h")
+	const mac = "00:11:22:33:44:55"
+	lease(t, p, mac)
+
+	// an interrupted run keeps its deadline
+	until := p.clock.Now().Add(5 * time.Hour).Truncate(time.Second)
+	if err := p.storage.saveCheckpoint(context.Background(), REDIS_EXTEND_STATE_KEY,
+		&extendState{BulkExtendResult: BulkExtendResult{Until: until}}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := p.BulkExtend(context.Background(), 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Until.Equal(until) || res.Extended != 1 {
+		t.Errorf("resumed extension %+v, want 1 lease extended until %s", *res, until)
+	}
+	if m.Exists(REDIS_EXTEND_STATE_KEY) {
+		t.Error("checkpoint left after the extension")
+	}
+}
@@ -0,0 +1,146 @@
+package rangeredisplugin
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+)
+
+// defaultAllocator is the allocator of the pools not choosing one
+const defaultAllocator = "composite"
+
+// most addresses between the ranges the bitmap allocator holds, so that a
+// pool of far apart ranges does not allocate a bitmap spanning them
+const maxBitmapGap = 1 << 16
+
+// allocatorFactories maps the name of every allocator implementation, as
+// chosen with the allocator option, to its constructor. Every one honors
+// the allocators.Allocator contract and allocates in the direction of the
+// pool, within its ranges only.
+var allocatorFactories = map[string]func(c *Config) (allocators.Allocator, error){
+	"composite": newCompositeAllocator,
+	"bitmap":    newBitmapAllocator,
+}
+
+// allocatorNames returns the names of the allocator implementations, sorted
+func allocatorNames() []string {
+	names := make([]string, 0, len(allocatorFactories))
+	for name := range allocatorFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseAllocator checks that name is an allocator implementation
+func parseAllocator(name string) (string, error) {
+	if _, ok := allocatorFactories[name]; !ok {
+		return "", fmt.Errorf("unknown allocator, valid allocators are: %s", strings.Join(allocatorNames(), ", "))
+	}
+	return name, nil
+}
+
+// newAllocator returns the allocator of the ranges of c, built by the
+// implementation c chose
+func newAllocator(c *Config) (allocators.Allocator, error) {
+	name := c.Allocator
+	if name == "" {
+		name = defaultAllocator
+	}
+	factory, ok := allocatorFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown allocator %q", name)
+	}
+	return factory(c)
+}
+
+// newCompositeAllocator returns an allocator per range, tried in allocation
+// order, or the allocator of the range of a pool of one range
+func newCompositeAllocator(c *Config) (allocators.Allocator, error) {
+	a := &rangeAllocator{}
+	for _, r := range c.allocationOrder() {
+		bm, err := bitmap.NewIPv4Allocator(r.Start, r.End)
+		if err != nil {
+			return nil, fmt.Errorf("range %s-%s: %w", r.Start, r.End, err)
+		}
+		var inner allocators.Allocator = bm
+		if c.Direction == DirectionDown {
+			inner = newMirrorAllocator(inner, r.Start, r.End)
+		}
+		a.ranges = append(a.ranges, r)
+		a.inner = append(a.inner, inner)
+	}
+	if len(a.inner) == 1 {
+		return a.inner[0], nil
+	}
+	return a, nil
+}
+
+// newBitmapAllocator returns a single allocator spanning the first to the
+// last address of the pool, the addresses between its ranges held for
+// good. The ranges are allocated from lowest first, or highest first for
+// a pool allocating down, whatever their configured order. Only the
+// addresses of the ranges can be freed.
+func newBitmapAllocator(c *Config) (allocators.Allocator, error) {
+	ranges := append([]ipRange(nil), c.Ranges...)
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].Start.To4(), ranges[j].Start.To4()) < 0
+	})
+	var gaps []ipRange
+	held := 0
+	for i := 1; i < len(ranges); i++ {
+		g := ipRange{Start: offsetIP(ranges[i-1].End, 1), End: offsetIP(ranges[i].Start, -1)}
+		if bytes.Compare(g.Start, g.End) > 0 {
+			continue
+		}
+		gaps = append(gaps, g)
+		held += (&Config{Ranges: []ipRange{g}}).size()
+	}
+	if held > maxBitmapGap {
+		return nil, fmt.Errorf("%d addresses between the ranges, at most %d for the bitmap allocator", held, maxBitmapGap)
+	}
+
+	bm, err := bitmap.NewIPv4Allocator(c.Start, c.End)
+	if err != nil {
+		return nil, fmt.Errorf("range %s-%s: %w", c.Start, c.End, err)
+	}
+	var a allocators.Allocator = bm
+	if c.Direction == DirectionDown {
+		a = newMirrorAllocator(a, c.Start, c.End)
+	}
+	for _, g := range gaps {
+		for ip := g.Start; ; ip = offsetIP(ip, 1) {
+			if _, err := allocateExact(a, net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}); err != nil {
+				return nil, fmt.Errorf("could not hold %s between the ranges: %w", ip, err)
+			}
+			if ip.Equal(g.End) {
+				break
+			}
+		}
+	}
+	if len(gaps) > 0 {
+		return &spanAllocator{Allocator: a, ranges: ranges}, nil
+	}
+	return a, nil
+}
+
+// spanAllocator is an allocator spanning ranges and the addresses between
+// them. Those are held rather than freed, which would hand them out.
+type spanAllocator struct {
+	allocators.Allocator
+	ranges []ipRange
+}
+
+func (a *spanAllocator) Free(n net.IPNet) error {
+	for _, r := range a.ranges {
+		if r.contains(n.IP) {
+			return a.Allocator.Free(n)
+		}
+	}
+	return fmt.Errorf("%s is in none of the ranges", n.IP)
+}
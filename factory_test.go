@@ -0,0 +1,158 @@
+package rangeredisplugin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+// host returns ip as the IPNet allocators take
+func host(ip string) net.IPNet {
+	return net.IPNet{IP: net.ParseIP(ip).To4(), Mask: net.CIDRMask(32, 32)}
+}
+
+// TestAllocatorConformance runs the same scenarios against every allocator
+// implementation: the addresses handed out, their order, hints, frees and
+// exhaustion
+func TestAllocatorConformance(t *testing.T) {
+	for _, tc := range []struct {
+		name, ranges, direction string
+		// order is the allocation order of the addresses of the ranges
+		order string
+		// outside are addresses no allocation hands out nor frees
+		outside []string
+	}{
+		{"one range", "10.0.69.10-10.0.69.13", "up", "10.0.69.10 10.0.69.11 10.0.69.12 10.0.69.13",
+			[]string{"10.0.69.9", "10.0.69.14"}},
+		{"one range down", "10.0.69.10-10.0.69.13", "down", "10.0.69.13 10.0.69.12 10.0.69.11 10.0.69.10",
+			[]string{"10.0.69.9", "10.0.69.14"}},
+		{"ranges", "10.0.69.10-10.0.69.11,10.0.69.20-10.0.69.22", "up", "10.0.69.10 10.0.69.11 10.0.69.20 10.0.69.21 10.0.69.22",
+			[]string{"10.0.69.12", "10.0.69.19", "10.0.69.23"}},
+		{"ranges down", "10.0.69.10-10.0.69.11,10.0.69.20-10.0.69.22", "down", "10.0.69.22 10.0.69.21 10.0.69.20 10.0.69.11 10.0.69.10",
+			[]string{"10.0.69.12", "10.0.69.19", "10.0.69.9"}},
+		{"adjacent ranges", "10.0.69.10-10.0.69.11,10.0.69.12-10.0.69.13", "up", "10.0.69.10 10.0.69.11 10.0.69.12 10.0.69.13",
+			[]string{"10.0.69.14"}},
+	} {
+		for _, name := range allocatorNames() {
+			t.Run(name+"/"+tc.name, func(t *testing.T) {
+				c, err := parseConfig([]string{"redis://localhost/0", tc.ranges, "1h", "allocator=" + name, "direction=" + tc.direction})
+				if err != nil {
+					t.Fatal(err)
+				}
+				a, err := newAllocator(c)
+				if err != nil {
+					t.Fatal(err)
+				}
+				order := strings.Fields(tc.order)
+
+				// a hint outside of the ranges is not honored
+				for _, ip := range tc.outside {
+					n, err := a.Allocate(host(ip))
+					if err != nil || n.IP.String() != order[0] {
+						t.Errorf("hint %s: allocated %s, %v, want %s", ip, n.IP, err, order[0])
+					}
+					if err := a.Free(n); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				// the addresses are handed out in order, once each
+				var got []string
+				for range order {
+					n, err := a.Allocate(net.IPNet{})
+					if err != nil {
+						t.Fatalf("after %v: %v", got, err)
+					}
+					got = append(got, n.IP.String())
+				}
+				if fmt.Sprint(got) != fmt.Sprint(order) {
+					t.Errorf("allocated %v, want %v", got, order)
+				}
+				if n, err := a.Allocate(net.IPNet{}); !errors.Is(err, allocators.ErrNoAddrAvail) {
+					t.Errorf("exhausted allocator handed out %s, %v", n.IP, err)
+				}
+
+				// an address freed is handed out again, to its hint first
+				last := order[len(order)-1]
+				for _, ip := range []string{order[1], last} {
+					if err := a.Free(host(ip)); err != nil {
+						t.Errorf("free %s: %v", ip, err)
+					}
+				}
+				if n, err := a.Allocate(host(last)); err != nil || n.IP.String() != last {
+					t.Errorf("hint %s: allocated %s, %v", last, n.IP, err)
+				}
+				if n, err := a.Allocate(host(last)); err != nil || n.IP.String() != order[1] {
+					t.Errorf("hint of a used address: allocated %s, %v, want %s", n.IP, err, order[1])
+				}
+
+				// a free address cannot be freed again, nor one outside
+				// of the ranges, which would make it allocatable
+				if err := a.Free(host(order[1])); err != nil {
+					t.Fatal(err)
+				}
+				if err := a.Free(host(order[1])); err == nil {
+					t.Errorf("double free of %s", order[1])
+				}
+				for _, ip := range tc.outside {
+					if err := a.Free(host(ip)); err == nil {
+						t.Errorf("free of %s outside of the ranges", ip)
+					}
+				}
+				if n, err := a.Allocate(net.IPNet{}); err != nil || n.IP.String() != order[1] {
+					t.Errorf("allocated %s, %v, want %s", n.IP, err, order[1])
+				}
+				if n, err := a.Allocate(net.IPNet{}); err == nil {
+					t.Errorf("exhausted allocator handed out %s", n.IP)
+				}
+			})
+		}
+	}
+}
+
+func TestAllocatorOption(t *testing.T) {
+	if c, err := parseConfig([]string{"redis://localhost/0", "10.0.69.10", "10.0.69.20", "1h"}); err != nil || c.Allocator != defaultAllocator {
+		t.Errorf("default allocator %q, %v", c.Allocator, err)
+	}
+	_, err := parseConfig([]string{"redis://localhost/0", "10.0.69.10", "10.0.69.20", "1h", "allocator=redis"})
+	if want := "valid allocators are: bitmap, composite"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("unknown allocator: %v, want %q", err, want)
+	}
+
+	// the bitmap allocator does not span far apart ranges
+	c, err := parseConfig([]string{"redis://localhost/0", "10.0.0.1-10.0.0.10,10.2.0.1-10.2.0.10", "1h", "allocator=bitmap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newAllocator(c); err == nil || !strings.Contains(err.Error(), "between the ranges") {
+		t.Errorf("bitmap over far apart ranges: %v", err)
+	}
+	c.Allocator = defaultAllocator
+	if _, err := newAllocator(c); err != nil {
+		t.Errorf("composite over far apart ranges: %v", err)
+	}
+}
+
+func TestAllocatorPlugin(t *testing.T) {
+	for _, name := range allocatorNames() {
+		t.Run(name, func(t *testing.T) {
+			m := miniredis.RunT(t)
+			p := startPlugin(t, m, "10.0.69.10-10.0.69.11,10.0.69.20-10.0.69.20", "1h", "allocator="+name)
+			var got []string
+			for i := 0; i < 3; i++ {
+				got = append(got, lease(t, p, fmt.Sprintf("00:11:22:33:44:%02x", i)).String())
+			}
+			if want := "[10.0.69.10 10.0.69.11 10.0.69.20]"; fmt.Sprint(got) != want {
+				t.Errorf("leased %v, want %s", got, want)
+			}
+			if _, err := p.allocate("00:11:22:33:44:ff"); err == nil {
+				t.Error("allocation from an exhausted pool")
+			}
+		})
+	}
+}
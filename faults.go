@@ -0,0 +1,76 @@
+package rangeredisplugin
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrInjected is the error of the calls failed by an injected Fault
+var ErrInjected = errors.New("injected fault")
+
+// ErrFaultsDisabled is returned when programming faults into a storage
+// opened without the faults option, or in a build without the faults tag
+var ErrFaultsDisabled = errors.New("fault injection is not enabled")
+
+// Fault is a failure programmed into the primary endpoint of a storage, for
+// the resilience tests and the simulator. It applies to the calls from the
+// Nth matching one on, Times of them or all if Times is 0. A pipeline with
+// an affected call fails whole, as with a lost connection.
+type Fault struct {
+	// Command is the lower case name of the redis command affected, e.g.
+	// set or evalsha, all commands if empty
+	Command string
+	// KeyPrefix restricts the fault to the commands whose first key has it
+	KeyPrefix string
+	// Nth is the first matching call affected, counting from 1
+	Nth   int
+	Times int
+	// Delay holds the affected calls back, and Err then fails them unless
+	// nil
+	Delay time.Duration
+	Err   error
+}
+
+// InjectFault programs f into the storage
+func (r *RedisProvider) InjectFault(f Fault) error {
+	if r.faults == nil {
+		return ErrFaultsDisabled
+	}
+	if f.Nth < 1 {
+		f.Nth = 1
+	}
+	r.faults.add(f)
+	return nil
+}
+
+// InjectPartialWrite fails the write of the shadow key of the nth record
+// saved from now on outside of an allocation, whose main key is written
+func (r *RedisProvider) InjectPartialWrite(nth int) error {
+	return r.InjectFault(Fault{Command: "set", KeyPrefix: r.ns.shadow, Nth: nth, Times: 1, Err: ErrInjected})
+}
+
+// DropMessages drops the next n pub/sub messages before they reach the
+// listeners, e.g. expiry notifications
+func (r *RedisProvider) DropMessages(n int) error {
+	if r.faults == nil {
+		return ErrFaultsDisabled
+	}
+	r.faults.dropNext(n)
+	return nil
+}
+
+// ClearFaults removes the faults programmed and the messages to drop
+func (r *RedisProvider) ClearFaults() {
+	if r.faults != nil {
+		r.faults.clear()
+	}
+}
+
+// InjectedFaults returns the number of calls failed or delayed and of
+// messages dropped so far
+func (r *RedisProvider) InjectedFaults() uint64 {
+	if r.faults == nil {
+		return 0
+	}
+	return r.faults.injected()
+}
@@ -0,0 +1,141 @@
+//go:build faults
+
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// faultsAvailable is set in builds with the faults tag only
+const faultsAvailable = true
+
+// faultInjector applies the faults programmed into a storage. It is a
+// redis.Hook of the primary endpoint.
+type faultInjector struct {
+	mu     sync.Mutex
+	faults []*activeFault
+	drop   int
+	count  uint64
+}
+
+// activeFault is a fault and the number of calls it matched so far
+type activeFault struct {
+	Fault
+	seen int
+}
+
+func (r *RedisProvider) enableFaults() {
+	r.faults = &faultInjector{}
+	r.rdb.AddHook(r.faults)
+	log.Warn("fault injection enabled, for testing only")
+}
+
+func (fi *faultInjector) add(f Fault) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.faults = append(fi.faults, &activeFault{Fault: f})
+}
+
+func (fi *faultInjector) dropNext(n int) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.drop += n
+}
+
+// dropMessage reports whether the next pub/sub message is dropped
+func (fi *faultInjector) dropMessage() bool {
+	if fi == nil {
+		return false
+	}
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if fi.drop == 0 {
+		return false
+	}
+	fi.drop--
+	fi.count++
+	return true
+}
+
+func (fi *faultInjector) clear() {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.faults, fi.drop = nil, 0
+}
+
+func (fi *faultInjector) injected() uint64 {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.count
+}
+
+// match counts cmd against the faults, returning the first one affecting
+// it, nil if none does
+func (fi *faultInjector) match(cmd redis.Cmder) *Fault {
+	key, _ := firstKey(cmd)
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	for _, f := range fi.faults {
+		if f.Command != "" && f.Command != cmd.Name() || !strings.HasPrefix(key, f.KeyPrefix) {
+			continue
+		}
+		f.seen++
+		if f.seen >= f.Nth && (f.Times == 0 || f.seen < f.Nth+f.Times) {
+			fi.count++
+			return &f.Fault
+		}
+	}
+	return nil
+}
+
+// apply holds back and fails cmd as programmed
+func (fi *faultInjector) apply(ctx context.Context, cmd redis.Cmder) error {
+	f := fi.match(cmd)
+	if f == nil {
+		return nil
+	}
+	if f.Delay > 0 {
+		select {
+		case <-time.After(f.Delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return f.Err
+}
+
+func (fi *faultInjector) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (fi *faultInjector) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := fi.apply(ctx, cmd); err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (fi *faultInjector) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			if err := fi.apply(ctx, cmd); err != nil {
+				for _, c := range cmds {
+					c.SetErr(err)
+				}
+				return err
+			}
+		}
+		return next(ctx, cmds)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !faults
+
+package rangeredisplugin
+
+// faultsAvailable is set in builds with the faults tag only
+const faultsAvailable = false
+
+// faultInjector is never created without the faults tag, leaving the
+// storage with no hook and these methods with nothing to do
+type faultInjector struct{}
+
+func (r *RedisProvider) enableFaults() {}
+
+func (*faultInjector) add(Fault)         {}
+func (*faultInjector) dropNext(int)      {}
+func (*faultInjector) dropMessage() bool { return false }
+func (*faultInjector) clear()            {}
+func (*faultInjector) injected() uint64  { return 0 }
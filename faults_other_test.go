@@ -0,0 +1,31 @@
+//go:build !faults
+
+package rangeredisplugin
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestFaultsDisabled(t *testing.T) {
+	if _, err := parseConfig([]string{"redis://localhost:6379/0", "10.0.53.10", "10.0.53.20", "1h", "faults=true"}); err == nil {
+		t.Error("faults=true accepted without the faults tag")
+	}
+
+	m := miniredis.RunT(t)
+	r := openStorage(t, m, StorageOptions{Faults: true})
+	if err := r.InjectFault(Fault{Command: "set", Err: ErrInjected}); !errors.Is(err, ErrFaultsDisabled) {
+		t.Errorf("InjectFault: %v, want %v", err, ErrFaultsDisabled)
+	}
+	if err := r.DropMessages(1); !errors.Is(err, ErrFaultsDisabled) {
+		t.Errorf("DropMessages: %v, want %v", err, ErrFaultsDisabled)
+	}
+	if err := r.SaveRecord("00:11:22:33:44:0a", boundRecord("10.0.53.10", 0)); err != nil {
+		t.Errorf("write with no fault: %v", err)
+	}
+	if n := r.InjectedFaults(); n != 0 {
+		t.Errorf("%d faults injected", n)
+	}
+}
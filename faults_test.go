@@ -0,0 +1,122 @@
+//go:build faults
+
+package rangeredisplugin
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestInjectFault(t *testing.T) {
+	m := miniredis.RunT(t)
+	r := openStorage(t, m, StorageOptions{Faults: true})
+	const mac = "00:11:22:33:44:0a"
+
+	// the second write of a main key fails, once
+	if err := r.InjectFault(Fault{Command: "set", KeyPrefix: r.ns.main, Nth: 2, Times: 1, Err: ErrInjected}); err != nil {
+		t.Fatalf("InjectFault: %v", err)
+	}
+	for i, want := range []bool{true, false, true} {
+		err := r.SaveRecord(mac, boundRecord("10.0.53.10", time.Hour))
+		if (err == nil) != want {
+			t.Errorf("save %d: %v", i+1, err)
+		}
+		if err != nil && !errors.Is(err, ErrStorageUnavailable) {
+			t.Errorf("injected failure not reported as unavailable: %v", err)
+		}
+	}
+	if n := r.InjectedFaults(); n != 1 {
+		t.Errorf("%d faults injected, want 1", n)
+	}
+
+	// a delay without an error only holds the calls back
+	r.ClearFaults()
+	if err := r.InjectFault(Fault{Command: "get", Delay: 50 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := r.GetRecord(mac); err != nil {
+		t.Errorf("delayed read failed: %v", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("read returned after %s, want the delay", d)
+	}
+
+	r.ClearFaults()
+	if err := r.SaveRecord(mac, boundRecord("10.0.53.10", time.Hour)); err != nil {
+		t.Errorf("write after ClearFaults: %v", err)
+	}
+	if n := r.InjectedFaults(); n != 2 {
+		t.Errorf("%d faults injected, want 2", n)
+	}
+}
+
+func TestInjectPartialWrite(t *testing.T) {
+	m := miniredis.RunT(t)
+	r := openStorage(t, m, StorageOptions{Faults: true})
+	const a, b = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+
+	if err := r.InjectPartialWrite(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SaveRecord(a, boundRecord("10.0.53.10", time.Hour)); err != nil {
+		t.Fatalf("save of %s: %v", a, err)
+	}
+	if err := r.SaveRecord(b, boundRecord("10.0.53.11", time.Hour)); err == nil {
+		t.Errorf("save of %s without its shadow key succeeded", b)
+	}
+	if !m.Exists(r.ns.main + b) {
+		t.Errorf("main key of %s not written", b)
+	}
+	missing, err := r.MissingShadows([]string{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 || missing[0] != b {
+		t.Errorf("missing shadows %v, want [%s]", missing, b)
+	}
+}
+
+func TestDropMessages(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.53.10", "10.0.53.20", "1h", "faults=true")
+	const a, b = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+	lease(t, p, a)
+	lease(t, p, b)
+
+	if err := p.Storage().DropMessages(1); err != nil {
+		t.Fatal(err)
+	}
+	expire(t, m, p, a)
+	expire(t, m, p, b)
+	eventually(t, "the expiry of "+b, func() bool { return p.leases.ipOf(b) == nil })
+	if p.leases.ipOf(a) == nil {
+		t.Errorf("lease of %s freed by a dropped notification", a)
+	}
+	if n := p.Storage().InjectedFaults(); n != 1 {
+		t.Errorf("%d faults injected, want 1", n)
+	}
+}
+
+func TestInjectFaultPipeline(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.53.10", "10.0.53.20", "1h", "faults=true")
+	const mac = "00:11:22:33:44:0a"
+
+	// the allocation fails with its script, and succeeds once cleared
+	if err := p.Storage().InjectFault(Fault{Command: "evalsha", Err: ErrInjected}); err != nil {
+		t.Fatal(err)
+	}
+	if offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac)); offer != nil {
+		t.Errorf("offer of %s with the allocation failing", offer.YourIPAddr)
+	}
+	p.Storage().ClearFaults()
+	lease(t, p, mac)
+	if p.Storage().InjectedFaults() == 0 {
+		t.Error("no fault injected")
+	}
+}
@@ -0,0 +1,395 @@
+package rangeredisplugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// fileGrace is how long a record stays readable past its Expires, as
+	// the main key outlives the shadow key in redis
+	fileGrace = 10 * time.Second
+	// fileSweepInterval is how often the expiry index is looked at
+	fileSweepInterval = 250 * time.Millisecond
+)
+
+var (
+	fileDBsMu sync.Mutex
+	fileDBs   = make(map[string]*fileDB)
+)
+
+// fileDB is a bbolt file shared by the stores of its namespaces: bbolt
+// locks the file for the process opening it
+type fileDB struct {
+	path string
+	db   *bolt.DB
+	refs int
+}
+
+// FileStore keeps the lease records of a namespace in a local bbolt file,
+// for a single server running without redis. It implements LeaseStore
+// only: the features coordinating instances or relying on other redis keys
+// have no file counterpart.
+//
+// A namespace has two buckets: <prefix>records holds the records, each
+// after its position in the enumerations and its due time, and
+// <prefix>expiry is the timer index, keyed by due time then key. An entry
+// of the index is first due at the Expires of its record, to notify it,
+// then again fileGrace later, to delete it.
+type FileStore struct {
+	file    *fileDB
+	records []byte
+	expiry  []byte
+	clock   *instanceClock
+
+	mu        sync.Mutex
+	receivers map[chan string]struct{}
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+var _ LeaseStore = (*FileStore)(nil)
+
+// Phases of an entry of the expiry index
+const (
+	phaseNotify byte = iota
+	phasePurge
+)
+
+// OpenFileStore returns the store of the namespace prefix in the bbolt file
+// at path, opening the file on first use. Stores of the same file share it.
+// Every call must be paired with a Close.
+func OpenFileStore(path, prefix string) (*FileStore, error) {
+	fileDBsMu.Lock()
+	defer fileDBsMu.Unlock()
+
+	f, ok := fileDBs[path]
+	if !ok {
+		db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			return nil, unavailable(err)
+		}
+		f = &fileDB{path: path, db: db}
+		fileDBs[path] = f
+	}
+
+	s := &FileStore{
+		file:      f,
+		records:   []byte(prefix + "records"),
+		expiry:    []byte(prefix + "expiry"),
+		clock:     newInstanceClock(),
+		receivers: make(map[chan string]struct{}),
+		done:      make(chan struct{}),
+	}
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(s.records); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(s.expiry)
+		return err
+	})
+	if err != nil {
+		if !ok {
+			f.db.Close()
+			delete(fileDBs, path)
+		}
+		return nil, unavailable(err)
+	}
+	f.refs++
+
+	s.wg.Add(1)
+	go s.sweep()
+	return s, nil
+}
+
+// Close stops the expiries of the store, closing its Expired channels,
+// and closes the file with its last store
+func (s *FileStore) Close() error {
+	close(s.done)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	for ch := range s.receivers {
+		delete(s.receivers, ch)
+		close(ch)
+	}
+	s.mu.Unlock()
+
+	fileDBsMu.Lock()
+	defer fileDBsMu.Unlock()
+	s.file.refs--
+	if s.file.refs > 0 {
+		return nil
+	}
+	delete(fileDBs, s.file.path)
+	return s.file.db.Close()
+}
+
+// SetClock replaces the clock the expiries are computed with, e.g. with a
+// simulated one
+func (s *FileStore) SetClock(clock Clock) {
+	s.clock.v.Store(setClock{Clock: clock, simulated: true})
+}
+
+// stored is the value of a record in the file: its position in the
+// enumerations, its due time, then the record
+type stored struct {
+	seq uint64
+	due time.Time
+	rec []byte
+}
+
+func (v stored) encode() []byte {
+	b := make([]byte, 16, 16+len(v.rec))
+	binary.BigEndian.PutUint64(b, v.seq)
+	binary.BigEndian.PutUint64(b[8:], uint64(v.due.UnixNano()))
+	return append(b, v.rec...)
+}
+
+func decodeStored(b []byte) (stored, bool) {
+	if len(b) < 16 {
+		return stored{}, false
+	}
+	return stored{
+		seq: binary.BigEndian.Uint64(b),
+		due: time.Unix(0, int64(binary.BigEndian.Uint64(b[8:]))),
+		rec: b[16:],
+	}, true
+}
+
+// expiryKey is the key of the index entry of mac due at t
+func expiryKey(t time.Time, mac string) []byte {
+	k := make([]byte, 8, 8+len(mac))
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	return append(k, mac...)
+}
+
+// dueTime returns when a record expiring at expires is notified, at least
+// a second ahead of now as in redis
+func dueTime(expires, now time.Time) time.Time {
+	if min := now.Add(time.Second); expires.Before(min) {
+		return min
+	}
+	return expires
+}
+
+// GetRecord returns the record of mac, ErrNotFound past its grace period
+func (s *FileStore) GetRecord(mac string) (*Record, error) {
+	var record *Record
+	err := s.file.db.View(func(tx *bolt.Tx) error {
+		v, ok := decodeStored(tx.Bucket(s.records).Get([]byte(mac)))
+		if !ok || !s.clock.Now().Before(v.due.Add(fileGrace)) {
+			return fmt.Errorf("%w: %s", ErrNotFound, mac)
+		}
+		record = &Record{}
+		if err := json.Unmarshal(v.rec, record); err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrCorruptRecord, mac, err)
+		}
+		if record.IP == nil {
+			return fmt.Errorf("%w: %s: no IP address", ErrCorruptRecord, mac)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, storeError(err)
+	}
+	return record, nil
+}
+
+// SaveRecord replaces the record of mac, and its entry in the expiry index
+func (s *FileStore) SaveRecord(mac string, record *Record) error {
+	recBytes, err := encodeRecord(record)
+	if err != nil {
+		return err
+	}
+	return storeError(s.file.db.Update(func(tx *bolt.Tx) error {
+		records, expiry := tx.Bucket(s.records), tx.Bucket(s.expiry)
+		v, ok := decodeStored(records.Get([]byte(mac)))
+		if ok {
+			unindex(expiry, mac, v.due)
+		} else if v.seq, err = records.NextSequence(); err != nil {
+			return err
+		}
+		v.due, v.rec = dueTime(record.Expires, s.clock.Now()), recBytes
+		if err := records.Put([]byte(mac), v.encode()); err != nil {
+			return err
+		}
+		return expiry.Put(expiryKey(v.due, mac), []byte{phaseNotify})
+	}))
+}
+
+// DeleteRecord removes the record of mac without notifying its expiry
+func (s *FileStore) DeleteRecord(mac string) error {
+	return storeError(s.file.db.Update(func(tx *bolt.Tx) error {
+		return s.delete(tx, mac)
+	}))
+}
+
+func (s *FileStore) delete(tx *bolt.Tx, mac string) error {
+	records := tx.Bucket(s.records)
+	v, ok := decodeStored(records.Get([]byte(mac)))
+	if !ok {
+		return nil
+	}
+	unindex(tx.Bucket(s.expiry), mac, v.due)
+	return records.Delete([]byte(mac))
+}
+
+// unindex removes the entry of mac due at due from the expiry index, in
+// either phase
+func unindex(expiry *bolt.Bucket, mac string, due time.Time) {
+	expiry.Delete(expiryKey(due, mac))
+	expiry.Delete(expiryKey(due.Add(fileGrace), mac))
+}
+
+// ScanRecords returns the records from position cursor on, in the order
+// they were first saved. A record keeps its position when saved again, so
+// that an enumeration misses none of the records living through it.
+func (s *FileStore) ScanRecords(ctx context.Context, cursor uint64, count int64) (map[string]Record, uint64, error) {
+	records := make(map[string]Record)
+	var next uint64
+	err := s.file.db.View(func(tx *bolt.Tx) error {
+		// the positions are spread over the keys: collect the ones ahead
+		// of the cursor, then keep the count lowest
+		type entry struct {
+			seq uint64
+			mac string
+			rec Record
+		}
+		var batch []entry
+		now := s.clock.Now()
+		err := tx.Bucket(s.records).ForEach(func(k, b []byte) error {
+			v, ok := decodeStored(b)
+			if !ok || v.seq < cursor || !now.Before(v.due.Add(fileGrace)) {
+				return nil
+			}
+			var rec Record
+			if json.Unmarshal(v.rec, &rec) != nil || rec.IP == nil {
+				return nil
+			}
+			batch = append(batch, entry{v.seq, string(k), rec})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Slice(batch, func(i, j int) bool { return batch[i].seq < batch[j].seq })
+		if int64(len(batch)) > count {
+			next = batch[count].seq
+			batch = batch[:count]
+		}
+		for _, e := range batch {
+			records[e.mac] = e.rec
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, storeError(err)
+	}
+	return records, next, ctx.Err()
+}
+
+// Expired delivers the keys of the records reaching their Expires until the
+// returned function is called. A receiver falling behind misses expiries.
+func (s *FileStore) Expired() (<-chan string, func()) {
+	ch := make(chan string, listenerBuffer)
+	s.mu.Lock()
+	s.receivers[ch] = struct{}{}
+	s.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if _, ok := s.receivers[ch]; ok {
+				delete(s.receivers, ch)
+				close(ch)
+			}
+		})
+	}
+}
+
+// sweep handles the entries of the expiry index as they come due
+func (s *FileStore) sweep() {
+	defer s.wg.Done()
+	t := time.NewTicker(fileSweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+		expired, err := s.due(s.clock.Now())
+		if err != nil {
+			log.Warnf("could not sweep the expiries of %s: %v", s.file.path, err)
+			continue
+		}
+		s.mu.Lock()
+		for _, mac := range expired {
+			for ch := range s.receivers {
+				select {
+				case ch <- mac:
+				default:
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// due advances the entries of the index due by now: a record reaching its
+// Expires is returned, to be notified, and its entry moved to the end of
+// its grace period; a record past it is deleted
+func (s *FileStore) due(now time.Time) ([]string, error) {
+	var expired []string
+	err := s.file.db.Update(func(tx *bolt.Tx) error {
+		expiry := tx.Bucket(s.expiry)
+		end := expiryKey(now, "")
+		type entry struct{ key, phase []byte }
+		var entries []entry
+		c := expiry.Cursor()
+		for k, v := c.First(); k != nil && bytes.Compare(k[:8], end) <= 0; k, v = c.Next() {
+			entries = append(entries, entry{bytes.Clone(k), bytes.Clone(v)})
+		}
+		for _, e := range entries {
+			if err := expiry.Delete(e.key); err != nil {
+				return err
+			}
+			mac := string(e.key[8:])
+			if len(e.phase) == 1 && e.phase[0] == phasePurge {
+				if err := s.delete(tx, mac); err != nil {
+					return err
+				}
+				continue
+			}
+			due := time.Unix(0, int64(binary.BigEndian.Uint64(e.key)))
+			if err := expiry.Put(expiryKey(due.Add(fileGrace), mac), []byte{phasePurge}); err != nil {
+				return err
+			}
+			expired = append(expired, mac)
+		}
+		return nil
+	})
+	return expired, err
+}
+
+// storeError reports the failures of the file as ErrStorageUnavailable, and
+// the errors of the records as they are
+func storeError(err error) error {
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrCorruptRecord) || errors.Is(err, ErrRecordTooLarge) {
+		return err
+	}
+	return unavailable(err)
+}
@@ -0,0 +1,60 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.db")
+	clock := newFakeClock(time.Now())
+	s, err := OpenFileStore(path, "dhcp:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetClock(clock)
+	const mac = "00:11:22:33:44:55"
+	rec := boundRecord("10.0.80.10", 2*time.Second)
+	if err := s.SaveRecord(mac, rec); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the records and their expiries survive a restart: an expiry due while
+	// the server was down is notified once it is back
+	s, err = OpenFileStore(path, "dhcp:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetClock(clock)
+	expired, stop := s.Expired()
+	defer stop()
+	if got, err := s.GetRecord(mac); err != nil || !got.IP.Equal(rec.IP) {
+		t.Fatalf("record after the restart: %v, %v", got, err)
+	}
+	clock.Advance(3 * time.Second)
+	select {
+	case got := <-expired:
+		if got != mac {
+			t.Errorf("expiry of %s, want %s", got, mac)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no expiry after the restart")
+	}
+	if batch, next, err := s.ScanRecords(context.Background(), 0, 10); err != nil || next != 0 || len(batch) != 1 {
+		t.Errorf("enumerated %v, %d, %v within the grace period", batch, next, err)
+	}
+}
+
+func TestFileURI(t *testing.T) {
+	_, err := parseConfig([]string{"file:///var/lib/coredhcp/leases.db", "10.0.80.10", "10.0.80.20", "1h"})
+	if err == nil || !strings.Contains(err.Error(), "holds the lease records only") {
+		t.Errorf("file:// uri: %v", err)
+	}
+}
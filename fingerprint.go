@@ -0,0 +1,190 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// REDIS_POOL_FINGERPRINT_KEY_PREFIX prefixes the fingerprints of the pools,
+// keyed by pool name, see PoolFingerprint
+const REDIS_POOL_FINGERPRINT_KEY_PREFIX = "x:dhcp:pool:"
+
+// rangeSemantics names how a range is read: both its start and its end
+// are part of it, so that 10.0.0.1-10.0.0.10 holds 10 addresses. Every
+// build must read ranges this way; the fingerprints record it so that a
+// build that does not is caught at startup.
+const rangeSemantics = "inclusive"
+
+// PoolFingerprint describes the addresses a configuration resolves to. It
+// is stored per pool, and compared at startup with the one of the previous
+// run, so that a build reading the same ranges differently shows up as a
+// change of configuration instead of silently pruning leases.
+type PoolFingerprint struct {
+	// Given is the range as given in the arguments, and Ranges the ranges
+	// it resolved to, <start>-<end>,...
+	Given     string
+	Ranges    string
+	Semantics string
+	First     net.IP
+	Last      net.IP
+	Size      int
+	// Digest is the SHA-256 of the fields above
+	Digest string
+}
+
+// fingerprint returns the fingerprint of the ranges of c
+func (c *Config) fingerprint() PoolFingerprint {
+	ranges := make([]string, 0, len(c.Ranges))
+	for _, r := range c.Ranges {
+		ranges = append(ranges, r.Start.String()+"-"+r.End.String())
+	}
+	f := PoolFingerprint{
+		Given:     c.rangeArgs,
+		Ranges:    strings.Join(ranges, ","),
+		Semantics: rangeSemantics,
+		First:     c.Start,
+		Last:      c.End,
+		Size:      c.size(),
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s %s %s %s %s %d", f.Given, f.Ranges, f.Semantics, f.First, f.Last, f.Size)))
+	f.Digest = hex.EncodeToString(sum[:])
+	return f
+}
+
+// PoolFingerprint returns the fingerprint stored for pool, or nil
+func (r *RedisProvider) PoolFingerprint(ctx context.Context, pool string) (*PoolFingerprint, error) {
+	val, err := r.rdb.Get(ctx, REDIS_POOL_FINGERPRINT_KEY_PREFIX+pool).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	var f PoolFingerprint
+	if err := json.Unmarshal([]byte(val), &f); err != nil {
+		return nil, fmt.Errorf("invalid fingerprint of pool %s: %w", pool, err)
+	}
+	return &f, nil
+}
+
+// SetPoolFingerprint stores the fingerprint of pool
+func (r *RedisProvider) SetPoolFingerprint(ctx context.Context, pool string, f PoolFingerprint) error {
+	val, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return unavailable(r.rdb.Set(ctx, REDIS_POOL_FINGERPRINT_KEY_PREFIX+pool, val, 0).Err())
+}
+
+// checkFingerprint compares the fingerprint of the configuration with the
+// one of the previous run of the pool, logging any change, then stores it
+func (p *PluginState) checkFingerprint(ctx context.Context) (PoolFingerprint, error) {
+	cur := p.cfg.fingerprint()
+	prev, err := p.storage.PoolFingerprint(ctx, p.poolName())
+	if err != nil {
+		return cur, err
+	}
+	if prev != nil && prev.Digest != cur.Digest {
+		log.Warnf("configuration change: pool %s resolved to %s, %d addresses (%s), was %s, %d addresses (%s)",
+			p.poolName(), cur.Ranges, cur.Size, cur.Semantics, prev.Ranges, prev.Size, prev.Semantics)
+		if d := endpointDrift(prev, &cur, len(p.cfg.Ranges)); d != "" {
+			log.Warnf("pool %s: %s. The leases of the addresses in one reading and not the other "+
+				"are pruned or handed out twice; run the build that wrote the previous fingerprint, "+
+				"or check the ranges, before serving", p.poolName(), d)
+		}
+	}
+	return cur, p.storage.SetPoolFingerprint(ctx, p.poolName(), cur)
+}
+
+// endpointDrift explains a change of fingerprint where the range is given
+// alike but resolves to a size differing by exactly the endpoints of its n
+// ranges, the mark of a build reading them as exclusive of their start or
+// end. Returns an empty string for any other change.
+func endpointDrift(prev, cur *PoolFingerprint, n int) string {
+	if prev.Given != cur.Given || prev.Size == cur.Size {
+		return ""
+	}
+	diff := cur.Size - prev.Size
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff != n && diff != 2*n {
+		return ""
+	}
+	return fmt.Sprintf("the previous run read the same range %q as %d addresses, %d here: "+
+		"it likely read the range ends as %s instead of %s (first %s, last %s there; first %s, last %s here)",
+		cur.Given, prev.Size, cur.Size, otherSemantics(prev, cur), rangeSemantics, prev.First, prev.Last, cur.First, cur.Last)
+}
+
+// otherSemantics names the reading of the previous run, as recorded or as
+// deduced from its size
+func otherSemantics(prev, cur *PoolFingerprint) string {
+	if prev.Semantics != "" && prev.Semantics != rangeSemantics {
+		return prev.Semantics
+	}
+	if prev.Size < cur.Size {
+		return "exclusive"
+	}
+	return "wider than inclusive"
+}
+
+// checkRangeSemantics verifies that the allocator of c reads the ranges as
+// rangeSemantics: both ends of every range can be allocated, and the
+// addresses right outside of them are not handed out for them
+func checkRangeSemantics(c *Config) error {
+	a, err := newAllocator(c)
+	if err != nil {
+		return err
+	}
+	for _, r := range c.Ranges {
+		ends := []net.IP{r.Start}
+		if !r.End.Equal(r.Start) {
+			ends = append(ends, r.End)
+		}
+		for _, ip := range ends {
+			if _, err := allocateExact(a, net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}); err != nil {
+				return fmt.Errorf("range %s-%s: the allocator does not hand out %s: %w", r.Start, r.End, ip, err)
+			}
+		}
+		for _, ip := range []net.IP{offsetIP(r.Start, -1), offsetIP(r.End, 1)} {
+			if ip == nil || c.contains(ip) {
+				continue
+			}
+			n, err := a.Allocate(net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)})
+			if err != nil {
+				continue
+			}
+			if n.IP.Equal(ip) {
+				return fmt.Errorf("range %s-%s: the allocator hands out %s, outside of it", r.Start, r.End, ip)
+			}
+			// another address of the pool, handed out instead: the ends
+			// of the next ranges must stay free for their own check
+			if err := a.Free(n); err != nil {
+				return fmt.Errorf("range %s-%s: could not free %s: %w", r.Start, r.End, n.IP, err)
+			}
+		}
+	}
+	return nil
+}
+
+// offsetIP returns the IPv4 address d after ip, or nil past either end of
+// the address space
+func offsetIP(ip net.IP, d int64) net.IP {
+	v := int64(binary.BigEndian.Uint32(ip.To4())) + d
+	if v < 0 || v > math.MaxUint32 {
+		return nil
+	}
+	out := make(net.IP, 4)
+	binary.BigEndian.PutUint32(out, uint32(v))
+	return out
+}
@@ -0,0 +1,126 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRangeSize(t *testing.T) {
+	for _, tc := range []struct {
+		args        []string
+		first, last string
+		size        int
+	}{
+		{[]string{"10.0.59.1", "10.0.59.10"}, "10.0.59.1", "10.0.59.10", 10},
+		{[]string{"10.0.59.250", "10.0.60.5"}, "10.0.59.250", "10.0.60.5", 12},
+		{[]string{"10.0.59.1-10.0.59.4,10.0.59.10-10.0.59.10"}, "10.0.59.1", "10.0.59.10", 5},
+		// ranges filled by their ends, the probes around them fall over
+		// to the next ones
+		{[]string{"10.0.59.1-10.0.59.2,10.0.59.10-10.0.59.10,10.0.59.20-10.0.59.21"}, "10.0.59.1", "10.0.59.21", 5},
+		{[]string{"10.0.59.0/29"}, "10.0.59.1", "10.0.59.6", 6},
+	} {
+		c, err := parseConfig(append(append([]string{"redis://localhost/0"}, tc.args...), "1h"))
+		if err != nil {
+			t.Fatalf("%v: %v", tc.args, err)
+		}
+		f := c.fingerprint()
+		if f.First.String() != tc.first || f.Last.String() != tc.last || f.Size != tc.size || f.Semantics != rangeSemantics {
+			t.Errorf("%v: fingerprint %+v, want %s-%s of %d", tc.args, f, tc.first, tc.last, tc.size)
+		}
+		if f.Given != strings.Join(tc.args, " ") {
+			t.Errorf("%v: given as %q", tc.args, f.Given)
+		}
+		if err := checkRangeSemantics(c); err != nil {
+			t.Errorf("%v: %v", tc.args, err)
+		}
+
+		// the allocator hands out exactly the addresses of the ranges
+		a, err := newAllocator(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := exhaust(a); n != tc.size {
+			t.Errorf("%v: %d addresses allocated, want %d", tc.args, n, tc.size)
+		}
+	}
+}
+
+func TestFingerprintChange(t *testing.T) {
+	m := miniredis.RunT(t)
+	logs := captureLog(t)
+	p := startPlugin(t, m, "10.0.59.10", "10.0.59.20", "1h")
+	if f := p.startup.Pool; f == nil || f.Size != 11 || !f.Last.Equal(net.IPv4(10, 0, 59, 20)) {
+		t.Fatalf("startup pool %+v", f)
+	}
+	if !strings.Contains(p.startup.String(), "pool 10.0.59.10-10.0.59.20 of 11 addresses") {
+		t.Errorf("startup report %q", p.startup)
+	}
+	stored, err := p.storage.PoolFingerprint(context.Background(), p.poolName())
+	if err != nil || stored == nil || stored.Digest != p.startup.Pool.Digest {
+		t.Fatalf("stored fingerprint %+v: %v", stored, err)
+	}
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// restart runs the pool again after a run that stored prev
+	restart := func(prev PoolFingerprint) {
+		t.Helper()
+		val, err := json.Marshal(prev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Set(REDIS_POOL_FINGERPRINT_KEY_PREFIX+p.poolName(), string(val))
+		logs.calls = nil
+		q := startPlugin(t, m, "10.0.59.10", "10.0.59.20", "1h")
+		if err := q.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the same configuration changes nothing
+	restart(*stored)
+	if logs.logged("configuration change") {
+		t.Error("change logged for the same configuration")
+	}
+
+	// a build reading the end as exclusive
+	exclusive := *stored
+	exclusive.Size, exclusive.Last, exclusive.Digest = 10, net.IPv4(10, 0, 59, 19).To4(), "other"
+	restart(exclusive)
+	if !logs.logged("configuration change: pool "+p.poolName()) || !logs.logged("likely read the range ends as exclusive instead of inclusive") {
+		t.Errorf("logged %v", logs.calls)
+	}
+
+	// another range is a change, but no drift
+	moved := exclusive
+	moved.Given = "10.0.59.10 10.0.59.19"
+	restart(moved)
+	if !logs.logged("configuration change") || logs.logged("likely read") {
+		t.Errorf("logged %v", logs.calls)
+	}
+}
+
+func TestEndpointDrift(t *testing.T) {
+	prev := &PoolFingerprint{Given: "10.0.59.1-10.0.59.10,10.0.59.20-10.0.59.30", Size: 21}
+	for _, tc := range []struct {
+		size int
+		want string
+	}{
+		{21, ""},
+		{19, "wider than inclusive"},
+		{23, "exclusive"},
+		{25, "exclusive"},
+		{24, ""},
+	} {
+		cur := &PoolFingerprint{Given: prev.Given, Size: tc.size}
+		got := endpointDrift(prev, cur, 2)
+		if tc.want == "" && got != "" || tc.want != "" && !strings.Contains(got, "as "+tc.want+" instead") {
+			t.Errorf("size %d: %q, want %q", tc.size, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package rangeredisplugin
+
+import "container/list"
+
+// default bound of each in-memory structure keyed by client
+const defaultCacheLimit = 65536
+
+// default budget of the in-memory structures, in bytes
+const defaultMemoryBudget = 64 << 20
+
+// rough size of an entry of the in-memory structures, key included
+const entryFootprint = 160
+
+// arrivals keeps the keys of a bounded map in the order they were last
+// set, so that a full map evicts its oldest entry rather than an arbitrary
+// one: a flood of new clients then pushes out the clients it displaced
+// first, never the ones just seen. The zero value is ready to use; every
+// key deleted from the map must be removed from it.
+type arrivals[K comparable] struct {
+	order *list.List
+	at    map[K]*list.Element
+}
+
+// set records that k was set last
+func (a *arrivals[K]) set(k K) {
+	if a.order == nil {
+		a.order, a.at = list.New(), make(map[K]*list.Element)
+	}
+	if e, ok := a.at[k]; ok {
+		a.order.MoveToBack(e)
+		return
+	}
+	a.at[k] = a.order.PushBack(k)
+}
+
+// remove forgets k, deleted from the map
+func (a *arrivals[K]) remove(k K) {
+	if e, ok := a.at[k]; ok {
+		a.order.Remove(e)
+		delete(a.at, k)
+	}
+}
+
+// evictOldest deletes the entry of m set the longest ago, to make room in a
+// full map
+func evictOldest[K comparable, V any](m map[K]V, a *arrivals[K]) {
+	if a.order == nil || a.order.Len() == 0 {
+		return
+	}
+	k := a.order.Remove(a.order.Front()).(K)
+	delete(a.at, k)
+	delete(m, k)
+}
+
+// structureSizes returns the number of entries of each in-memory structure
+func (p *PluginState) structureSizes() map[string]int {
+	return map[string]int{
+		"leases":        p.leases.len(),
+		"offers":        p.offers.len(),
+		"replies":       p.replies.len(),
+		"naks":          p.naks.len(),
+		"trace-targets": p.traced.len(),
+		"ptr-cache":     p.ptr.len(),
+		"reassignments": p.reassign.len(),
+		"preferred":     p.preferred.len(),
+		"cooldown":      p.cooldown.len(),
+		"relay-flaps":   p.flaps.len(),
+		"adoptions":     p.adoptions.len(),
+		"reservations":  p.reserved.len(),
+		"denylist":      p.deny.len(),
+		"observed":      p.observed.len(),
+		"frozen":        p.frozen.len(),
+		"split":         p.split.len(),
+		"oplog":         p.oplog.len(),
+		"recent-errors": len(RecentErrors()),
+		"links":         dualStack.len(),
+	}
+}
+
+// estimatedFootprint estimates the memory used by the in-memory structures
+func estimatedFootprint(sizes map[string]int) int64 {
+	var n int64
+	for _, s := range sizes {
+		n += int64(s) * entryFootprint
+	}
+	return n
+}
+
+// checkMemoryBudget warns when the in-memory structures are estimated to
+// use more than the memory budget
+func (p *PluginState) checkMemoryBudget() {
+	sizes := p.structureSizes()
+	if used := estimatedFootprint(sizes); used > p.cfg.MemoryBudget {
+		log.Warnf("in-memory structures use ~%d bytes, over the budget of %d bytes: %v",
+			used, p.cfg.MemoryBudget, sizes)
+	}
+}
@@ -0,0 +1,169 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestSpoofedMACFlood(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.25.10", "10.0.25.20", "1h", "cache_limit=100", "offer_interval=1m")
+	const mac = "00:11:22:33:44:0a"
+	ip := lease(t, p, mac)
+
+	n := 20000
+	if testing.Short() {
+		n = 2000
+	}
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	for i := 0; i < n; i++ {
+		spoofed := net.HardwareAddr{0x02, 0xff, byte(i >> 16), byte(i >> 8), byte(i), 0}.String()
+		// the DISCOVERs exhaust the pool, the renewals of the address of
+		// the legitimate client are NAKed
+		req := newRequest(t, dhcpv4.MessageTypeDiscover, spoofed)
+		if i%2 == 1 {
+			req = newRequest(t, dhcpv4.MessageTypeRequest, spoofed, dhcpv4.WithClientIP(ip))
+		}
+		exchange(t, p, req)
+		if i%1000 == 0 {
+			if got := renewal(t, p, mac, ip); got != dhcpv4.MessageTypeAck {
+				t.Fatalf("renewal during the flood answered %s", got)
+			}
+		}
+		if i%5000 == 0 {
+			// the flood goes on past the offers held
+			advance(p, time.Minute)
+		}
+	}
+
+	for name, size := range p.Stats().Structures {
+		if size > 100 && name != "leases" && name != "recent-errors" {
+			t.Errorf("%s holds %d entries, over the limit of 100", name, size)
+		}
+	}
+	if got := renewal(t, p, mac, ip); got != dhcpv4.MessageTypeAck {
+		t.Errorf("renewal after the flood answered %s", got)
+	}
+
+	var after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	if grown := int64(after.HeapAlloc) - int64(before.HeapAlloc); grown > 32<<20 {
+		t.Errorf("heap grew by %d bytes during the flood", grown)
+	}
+}
+
+func TestEstimatedFootprint(t *testing.T) {
+	sizes := map[string]int{"offers": 10, "naks": 5}
+	if got := estimatedFootprint(sizes); got != 15*entryFootprint {
+		t.Errorf("footprint of 15 entries %d, want %d", got, 15*entryFootprint)
+	}
+}
+
+func TestEvictOldest(t *testing.T) {
+	m := make(map[string]int)
+	var order arrivals[string]
+	for i, k := range []string{"a", "b", "c", "d"} {
+		order.set(k)
+		m[k] = i
+	}
+	// a set again is the newest, c deleted is forgotten
+	order.set("a")
+	delete(m, "c")
+	order.remove("c")
+
+	for _, want := range []string{"b", "d", "a"} {
+		evictOldest(m, &order)
+		if _, ok := m[want]; ok {
+			t.Fatalf("evicted %v, want %s gone", m, want)
+		}
+	}
+	if len(m) != 0 || len(order.at) != 0 {
+		t.Errorf("%v left, %d keys ordered", m, len(order.at))
+	}
+	evictOldest(m, &order)
+}
+
+func TestCachesKeepTheNewest(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.85.10", "10.0.85.20", "1h", "cache_limit=3")
+	ctx := context.Background()
+	now := p.clock.Now()
+	macOf := func(i int) string { return net.HardwareAddr{0x02, 0, 0, 0, 0, byte(i)}.String() }
+	ipOf := func(i int) net.IP { return net.IPv4(10, 0, 85, byte(100+i)).To4() }
+	names := make(map[string][]string)
+	for i := 0; i < 20; i++ {
+		names[ipOf(i).String()] = []string{"host.example.com."}
+	}
+	p.ptr.resolver = &fakeResolver{names: names}
+
+	has := func(mu *sync.Mutex, ok func() bool) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return ok()
+	}
+	for _, tc := range []struct {
+		name string
+		add  func(i int)
+		has  func(i int) bool
+	}{
+		{"offers",
+			func(i int) { p.offers.set(macOf(i), ipOf(i), now.Add(time.Hour), now) },
+			func(i int) bool {
+				return has(&p.offers.mu, func() bool { _, ok := p.offers.entries[macOf(i)]; return ok })
+			}},
+		{"replies",
+			func(i int) { p.replies.claim(replyKey{mac: macOf(i)}, now) },
+			func(i int) bool {
+				return has(&p.replies.mu, func() bool { _, ok := p.replies.entries[replyKey{mac: macOf(i)}]; return ok })
+			}},
+		{"naks",
+			func(i int) { p.naks.allow(macOf(i), now) },
+			func(i int) bool { return has(&p.naks.mu, func() bool { _, ok := p.naks.last[macOf(i)]; return ok }) }},
+		{"denylist",
+			func(i int) { p.denied(macOf(i)) },
+			func(i int) bool { return has(&p.deny.mu, func() bool { _, ok := p.deny.cache[macOf(i)]; return ok }) }},
+		{"trace-targets",
+			func(i int) { p.traced.add(macOf(i), time.Now().Add(time.Hour)) },
+			func(i int) bool {
+				return has(&p.traced.mu, func() bool { _, ok := p.traced.targets[macOf(i)]; return ok })
+			}},
+		{"ptr-cache",
+			func(i int) {
+				if _, err := p.ptr.lookup(ctx, ipOf(i)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			func(i int) bool {
+				return has(&p.ptr.mu, func() bool { _, ok := p.ptr.cache[ipOf(i).String()]; return ok })
+			}},
+		{"observed",
+			func(i int) { p.observed.set(macOf(i), now) },
+			func(i int) bool { return !p.observed.get(macOf(i)).IsZero() }},
+		{"relay-flaps",
+			func(i int) { p.flaps.note(macOf(i), now, time.Minute) },
+			func(i int) bool { return has(&p.flaps.mu, func() bool { _, ok := p.flaps.moves[macOf(i)]; return ok }) }},
+	} {
+		for i := 0; i < 20; i++ {
+			tc.add(i)
+		}
+		for i := 0; i < 20; i++ {
+			if want := i >= 17; tc.has(i) != want {
+				t.Errorf("%s: client %d kept %v, want %v", tc.name, i, tc.has(i), want)
+			}
+		}
+		if got := p.Stats().Structures[tc.name]; got != 3 {
+			t.Errorf("%s holds %d entries, want 3", tc.name, got)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package rangeredisplugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// REDIS_FREEZE_KEY is the set of the frozen addresses, e.g.
+// `SADD x:dhcp:freeze 10.0.0.12`, unless freeze_url names another source.
+// A frozen address is never granted again, and its binding is kept until
+// it is unfrozen. Other namespaces have a freeze set of their own, e.g.
+// x:site-a:freeze.
+const REDIS_FREEZE_KEY = "x:dhcp:freeze"
+
+// REDIS_FROZEN_KEY is the hash of the bindings of the frozen addresses, by
+// address, see FrozenBinding, in the default namespace
+const REDIS_FROZEN_KEY = "x:dhcp:frozen"
+
+const (
+	// default interval of the synchronization of the freeze list
+	defaultFreezeInterval = time.Minute
+	// time given to the freeze list endpoint, and the largest list read
+	freezeFetchTimeout = 10 * time.Second
+	maxFreezeListSize  = 1 << 20
+)
+
+// FrozenBinding is the binding of a frozen address when it was frozen
+type FrozenBinding struct {
+	IP net.IP
+	// MAC and Record are the client holding the address and its lease then,
+	// empty for an address that was free
+	MAC    string  `json:",omitempty"`
+	Record *Record `json:",omitempty"`
+	Since  time.Time
+	// Ended is when the lease ended, the binding being a tombstone from then
+	// on, which the address is never recycled from
+	Ended time.Time `json:",omitempty"`
+}
+
+// FreezeList returns the addresses of the freeze set
+func (r *RedisProvider) FreezeList(ctx context.Context) ([]string, error) {
+	ips, err := r.rdb.SMembers(ctx, r.ns.freeze).Result()
+	return ips, unavailable(err)
+}
+
+// Freeze records binding, unless its address is frozen already
+func (r *RedisProvider) Freeze(ctx context.Context, binding *FrozenBinding) error {
+	b, err := json.Marshal(binding)
+	if err != nil {
+		return err
+	}
+	return unavailable(r.rdb.HSetNX(ctx, r.ns.frozen, binding.IP.String(), string(b)).Err())
+}
+
+// Thaw forgets the binding of the frozen address ip
+func (r *RedisProvider) Thaw(ctx context.Context, ip net.IP) error {
+	return unavailable(r.rdb.HDel(ctx, r.ns.frozen, ip.String()).Err())
+}
+
+// FrozenBindings returns the bindings of the frozen addresses
+func (r *RedisProvider) FrozenBindings(ctx context.Context) ([]FrozenBinding, error) {
+	vals, err := r.rdb.HGetAll(ctx, r.ns.frozen).Result()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	bindings := make([]FrozenBinding, 0, len(vals))
+	for ip, v := range vals {
+		var b FrozenBinding
+		if err := json.Unmarshal([]byte(v), &b); err != nil {
+			log.Warnf("ignoring the corrupt frozen binding of %s: %v", ip, err)
+			continue
+		}
+		bindings = append(bindings, b)
+	}
+	return bindings, nil
+}
+
+// Tombstone marks the lease of the frozen address ip to mac as ended at t
+func (r *RedisProvider) Tombstone(ctx context.Context, ip net.IP, mac string, t time.Time) error {
+	v, err := r.rdb.HGet(ctx, r.ns.frozen, ip.String()).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return unavailable(err)
+	}
+	var b FrozenBinding
+	if err := json.Unmarshal([]byte(v), &b); err != nil {
+		return fmt.Errorf("%w: frozen binding of %s: %w", ErrCorruptRecord, ip, err)
+	}
+	if b.MAC != mac || !b.Ended.IsZero() {
+		return nil
+	}
+	b.Ended = t
+	nb, err := json.Marshal(&b)
+	if err != nil {
+		return err
+	}
+	return unavailable(r.rdb.HSet(ctx, r.ns.frozen, ip.String(), string(nb)).Err())
+}
+
+// frozenIPs holds the frozen addresses of the pool
+type frozenIPs struct {
+	mu  sync.Mutex
+	ips map[string]bool
+	// outcome of the last synchronization
+	synced  time.Time
+	lastErr string
+}
+
+func (f *frozenIPs) has(ip net.IP) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ips[ip.String()]
+}
+
+func (f *frozenIPs) set(ip net.IP, frozen bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !frozen {
+		delete(f.ips, ip.String())
+		return
+	}
+	if f.ips == nil {
+		f.ips = make(map[string]bool)
+	}
+	f.ips[ip.String()] = true
+}
+
+func (f *frozenIPs) list() []net.IP {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ips := make([]net.IP, 0, len(f.ips))
+	for s := range f.ips {
+		ips = append(ips, net.ParseIP(s).To4())
+	}
+	return ips
+}
+
+func (f *frozenIPs) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.ips)
+}
+
+// FreezeStatus describes the frozen addresses of the pool
+type FreezeStatus struct {
+	Source string
+	// Addresses counts the frozen addresses, Leased those still leased to
+	// the client holding them when they were frozen
+	Addresses int
+	Leased    int
+	Synced    time.Time `json:",omitempty"`
+	LastError string    `json:",omitempty"`
+}
+
+func (p *PluginState) freezeStatus() *FreezeStatus {
+	if p.cfg.FreezeInterval == 0 {
+		return nil
+	}
+	s := &FreezeStatus{Source: p.freezeSource()}
+	for _, ip := range p.frozen.list() {
+		s.Addresses++
+		if p.leases.macOf(ip) != "" {
+			s.Leased++
+		}
+	}
+	p.frozen.mu.Lock()
+	defer p.frozen.mu.Unlock()
+	s.Synced, s.LastError = p.frozen.synced, p.frozen.lastErr
+	return s
+}
+
+func (p *PluginState) freezeSource() string {
+	if p.cfg.FreezeURL != "" {
+		return redactURI(p.cfg.FreezeURL)
+	}
+	return p.storage.ns.freeze
+}
+
+// fetchFreezeList reads the freeze list from its source: the freeze set, or
+// the endpoint of freeze_url serving one address per line, # starting a
+// comment
+func (p *PluginState) fetchFreezeList(ctx context.Context) ([]string, error) {
+	if p.cfg.FreezeURL == "" {
+		return p.storage.FreezeList(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, freezeFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.cfg.FreezeURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("freeze list endpoint answered %s", resp.Status)
+	}
+	var ips []string
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxFreezeListSize))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			ips = append(ips, line)
+		}
+	}
+	return ips, scanner.Err()
+}
+
+// syncFreeze applies the freeze list: the addresses of the range added to it
+// are frozen, those removed from it unfrozen. A list that cannot be read
+// leaves the frozen addresses as they are.
+func (p *PluginState) syncFreeze(ctx context.Context) error {
+	list, err := p.fetchFreezeList(ctx)
+	p.frozen.mu.Lock()
+	p.frozen.lastErr = ""
+	if err != nil {
+		p.frozen.lastErr = err.Error()
+	} else {
+		p.frozen.synced = p.clock.Now()
+	}
+	p.frozen.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool, len(list))
+	for _, s := range list {
+		ip := net.ParseIP(strings.TrimSpace(s)).To4()
+		if ip == nil {
+			log.Warnf("ignoring invalid frozen address %q", s)
+			continue
+		}
+		if !p.inRange(ip) {
+			continue
+		}
+		wanted[ip.String()] = true
+		if !p.frozen.has(ip) {
+			if err := p.freeze(ctx, ip); err != nil {
+				log.Errorf("could not freeze %s: %v", ip, err)
+			}
+		}
+	}
+	for _, ip := range p.frozen.list() {
+		if !wanted[ip.String()] {
+			if err := p.unfreeze(ctx, ip); err != nil {
+				log.Errorf("could not unfreeze %s: %v", ip, err)
+			}
+		}
+	}
+	return nil
+}
+
+// freeze withholds ip from allocation for good, recording its binding. A
+// lease of the address runs to its end without being extended.
+func (p *PluginState) freeze(ctx context.Context, ip net.IP) error {
+	binding := &FrozenBinding{IP: ip, Since: p.clock.Now()}
+	if mac := p.leases.macOf(ip); mac != "" {
+		rec, err := p.storage.GetRecord(mac)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		binding.MAC, binding.Record = mac, rec
+	}
+	if err := p.storage.Freeze(ctx, binding); err != nil {
+		return err
+	}
+	// frozen first, so that a lease ending meanwhile keeps the address
+	p.frozen.set(ip, true)
+	if binding.MAC == "" && !p.cfg.excluded(ip) && !p.reserved.has(ip) {
+		if _, err := allocateExact(p.allocator, net.IPNet{IP: ip}); err != nil && !errors.Is(err, ErrAddressTaken) {
+			log.Warnf("could not withhold frozen %s from the allocator: %v", ip, err)
+		}
+	}
+	log.Infof("%s frozen, leased to %q", ip, binding.MAC)
+	p.emit(Event{Type: EventFreeze, MAC: binding.MAC, IP: ip})
+	return nil
+}
+
+// unfreeze returns ip to its normal lifecycle: a free address goes back to
+// the allocator, a lease is extended again at its next renewal
+func (p *PluginState) unfreeze(ctx context.Context, ip net.IP) error {
+	if err := p.storage.Thaw(ctx, ip); err != nil {
+		return err
+	}
+	p.frozen.set(ip, false)
+	switch {
+	case p.leases.macOf(ip) != "":
+	case p.withheld(ip):
+		p.keepForSplit(ip)
+	default:
+		if err := p.allocator.Free(net.IPNet{IP: ip, Mask: net.IPv4Mask(255, 255, 255, 255)}); err != nil {
+			log.Errorf("could not return unfrozen %s to the pool: %v", ip, err)
+		}
+	}
+	log.Infof("%s unfrozen", ip)
+	p.emit(Event{Type: EventUnfreeze, IP: ip})
+	return nil
+}
+
+// tombstone records that the lease of the frozen address ip to mac ended
+func (p *PluginState) tombstone(mac string, ip net.IP) {
+	if err := p.storage.Tombstone(context.TODO(), ip, mac, p.clock.Now()); err != nil {
+		log.Warnf("could not record the end of the frozen lease of %s for %s: %v", ip, mac, err)
+	}
+}
+
+// frozenBindings returns the bindings of the frozen addresses of the pool,
+// by address
+func (p *PluginState) frozenBindings(ctx context.Context) ([]FrozenBinding, error) {
+	all, err := p.storage.FrozenBindings(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var bindings []FrozenBinding
+	for _, b := range all {
+		if p.frozen.has(b.IP) {
+			bindings = append(bindings, b)
+		}
+	}
+	sort.Slice(bindings, func(i, j int) bool { return bytes.Compare(bindings[i].IP.To16(), bindings[j].IP.To16()) < 0 })
+	return bindings, nil
+}
+
+// loadFreeze withholds the addresses of the range frozen when the instance
+// stopped, once the stored leases are loaded, then syncs the freeze list
+func (p *PluginState) loadFreeze(ctx context.Context) error {
+	bindings, err := p.storage.FrozenBindings(ctx)
+	if err != nil {
+		return err
+	}
+	for _, b := range bindings {
+		ip := b.IP.To4()
+		if ip == nil || !p.inRange(ip) {
+			continue
+		}
+		p.frozen.set(ip, true)
+		if p.leases.macOf(ip) == "" && !p.cfg.excluded(ip) && !p.reserved.has(ip) {
+			if _, err := allocateExact(p.allocator, net.IPNet{IP: ip}); err != nil && !errors.Is(err, ErrAddressTaken) {
+				log.Warnf("could not withhold frozen %s from the allocator: %v", ip, err)
+			}
+		}
+	}
+	if err := p.syncFreeze(ctx); err != nil {
+		// the addresses frozen before stay so until the list can be read
+		log.Warnf("could not sync the freeze list from %s: %v", p.freezeSource(), err)
+	}
+	log.Infof("%d addresses frozen", p.frozen.len())
+	return nil
+}
+
+// freezeLoop synchronizes the freeze list every freeze interval
+func (p *PluginState) freezeLoop() {
+	ticker := time.NewTicker(p.cfg.FreezeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.syncFreeze(context.TODO()); err != nil {
+				log.Warnf("could not sync the freeze list from %s: %v", p.freezeSource(), err)
+			}
+		case <-p.closing:
+			return
+		}
+	}
+}
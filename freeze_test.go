@@ -0,0 +1,141 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestFreeze(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.55.10", "10.0.55.12", "1h")
+	events := recordEvents(p)
+	const a, b, c = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c"
+	ipA, ipB := lease(t, p, a), lease(t, p, b)
+	free := net.IPv4(10, 0, 55, 12).To4()
+
+	// an active lease and a free address
+	m.SAdd(REDIS_FREEZE_KEY, ipA.String(), free.String(), "10.0.99.1", "bogus")
+	p.handleControl("sync-freeze")
+	eventually(t, "the freeze events", func() bool { return len(events.of(EventFreeze)) == 2 })
+	if s := p.Stats().Frozen; s == nil || s.Addresses != 2 || s.Leased != 1 || s.LastError != "" {
+		t.Errorf("frozen stats %+v, want 2 addresses, 1 leased", s)
+	}
+	if offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, c)); offer != nil {
+		t.Errorf("frozen %s offered to %s", offer.YourIPAddr, c)
+	}
+
+	// the frozen lease runs to its end without being extended
+	advance(p, 10*time.Minute)
+	if ack := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, a, dhcpv4.WithClientIP(ipA))); ack == nil ||
+		ack.MessageType() != dhcpv4.MessageTypeAck || ack.IPAddressLeaseTime(0) > 50*time.Minute {
+		t.Errorf("renewal of the frozen lease: %v", ack)
+	}
+	if ack := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, b, dhcpv4.WithClientIP(ipB))); ack == nil || ack.IPAddressLeaseTime(0) != time.Hour {
+		t.Errorf("renewal of a lease not frozen: %v", ack)
+	}
+
+	// and its binding is kept as a tombstone, the address never recycled
+	expire(t, m, p, a)
+	eventually(t, "the expiry", func() bool { return p.leases.macOf(ipA) == "" })
+	if offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, c)); offer != nil {
+		t.Errorf("frozen %s offered to %s after the expiry", offer.YourIPAddr, c)
+	}
+	report, _, err := p.ConsistencyReport(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Frozen) != 2 {
+		t.Fatalf("frozen bindings %+v, want 2", report.Frozen)
+	}
+	if bA := report.Frozen[0]; !bA.IP.Equal(ipA) || bA.MAC != a || bA.Record == nil || bA.Ended.IsZero() {
+		t.Errorf("binding of %s: %+v, want the ended lease of %s", ipA, bA, a)
+	}
+	if bFree := report.Frozen[1]; !bFree.IP.Equal(free) || bFree.MAC != "" || !bFree.Ended.IsZero() {
+		t.Errorf("binding of free %s: %+v", free, bFree)
+	}
+
+	// a list that cannot be read changes nothing
+	m.Del(REDIS_FREEZE_KEY)
+	m.Set(REDIS_FREEZE_KEY, "not a set")
+	p.handleControl("sync-freeze")
+	if s := p.Stats().Frozen; s.Addresses != 2 || s.LastError == "" {
+		t.Errorf("frozen stats %+v after a failed sync", s)
+	}
+
+	// unfreezing returns both addresses to the pool
+	m.Del(REDIS_FREEZE_KEY)
+	p.handleControl("sync-freeze")
+	eventually(t, "the unfreeze events", func() bool { return len(events.of(EventUnfreeze)) == 2 })
+	got := map[string]bool{}
+	for _, mac := range []string{c, "00:11:22:33:44:0d"} {
+		got[lease(t, p, mac).String()] = true
+	}
+	if !got[ipA.String()] || !got[free.String()] {
+		t.Errorf("leases of %v after the unfreeze, want %s and %s", got, ipA, free)
+	}
+	if bindings, _ := p.storage.FrozenBindings(context.Background()); len(bindings) != 0 {
+		t.Errorf("bindings %+v kept after the unfreeze", bindings)
+	}
+}
+
+func TestUnfreezeLease(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.55.20", "10.0.55.30", "1h")
+	const mac = "00:11:22:33:44:0a"
+	ip := lease(t, p, mac)
+
+	m.SAdd(REDIS_FREEZE_KEY, ip.String())
+	p.handleControl("sync-freeze")
+	advance(p, 10*time.Minute)
+	if got := renewal(t, p, mac, ip); got != dhcpv4.MessageTypeAck {
+		t.Fatalf("renewal of the frozen lease answered %s", got)
+	}
+	if rec, _ := p.storage.GetRecord(mac); rec.Expires.Sub(p.clock.Now()) > 50*time.Minute {
+		t.Errorf("frozen lease extended to %s", rec.Expires)
+	}
+
+	// the lease is extended again at its next renewal
+	m.SRem(REDIS_FREEZE_KEY, ip.String())
+	p.handleControl("sync-freeze")
+	if got := renewal(t, p, mac, ip); got != dhcpv4.MessageTypeAck {
+		t.Fatalf("renewal of the unfrozen lease answered %s", got)
+	}
+	if rec, _ := p.storage.GetRecord(mac); rec.Expires.Sub(p.clock.Now()).Round(time.Second) != time.Hour {
+		t.Errorf("unfrozen lease expiring at %s, not extended", rec.Expires)
+	}
+	if s := p.Stats().Frozen; s.Addresses != 0 {
+		t.Errorf("frozen stats %+v after the unfreeze", s)
+	}
+}
+
+func TestFreezeRestart(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.55.40", "10.0.55.41", "1h")
+	free := net.IPv4(10, 0, 55, 41).To4()
+	lease(t, p, "00:11:22:33:44:0b")
+	m.SAdd(REDIS_FREEZE_KEY, free.String())
+	p.handleControl("sync-freeze")
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart keeps the frozen addresses while the list cannot be read
+	m.Del(REDIS_FREEZE_KEY)
+	m.Set(REDIS_FREEZE_KEY, "not a set")
+	q := startPlugin(t, m, "10.0.55.40", "10.0.55.41", "1h")
+	if !q.frozen.has(free) {
+		t.Fatalf("%s not frozen after the restart", free)
+	}
+	if offer := exchange(t, q, newRequest(t, dhcpv4.MessageTypeDiscover, "00:11:22:33:44:0a")); offer != nil {
+		t.Errorf("frozen %s offered after the restart", offer.YourIPAddr)
+	}
+
+	if _, err := parseConfig([]string{redisURI(m), "10.0.55.40", "10.0.55.41", "1h", "freeze_url=http://example.com/frozen"}); err == nil {
+		t.Error("freeze_url over http accepted")
+	}
+}
@@ -0,0 +1,67 @@
+package rangeredisplugin
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// minimum time between two allocation attempts while redis is out of memory
+const storageFullRetryInterval = 10 * time.Second
+
+// storageFull tracks whether redis refuses writes for lack of memory. New
+// allocations are refused meanwhile, apart from one attempt per
+// storageFullRetryInterval which probes whether writes work again.
+type storageFull struct {
+	mu    sync.Mutex
+	full  bool
+	since time.Time
+	probe time.Time
+}
+
+// allowAllocation reports whether a new allocation may be attempted
+func (p *PluginState) allowAllocation() bool {
+	p.full.mu.Lock()
+	defer p.full.mu.Unlock()
+	if !p.full.full {
+		return true
+	}
+	if time.Since(p.full.probe) < storageFullRetryInterval {
+		return false
+	}
+	p.full.probe = time.Now()
+	return true
+}
+
+// storageFull reports whether redis is known to be out of memory
+func (p *PluginState) storageFull() bool {
+	p.full.mu.Lock()
+	defer p.full.mu.Unlock()
+	return p.full.full
+}
+
+// noteWrite updates the out of memory state from the outcome of a write,
+// alerting when it changes
+func (p *PluginState) noteWrite(err error) {
+	full := errors.Is(err, ErrStorageFull)
+	if err != nil && !full {
+		// other failures tell nothing about the memory of redis
+		return
+	}
+
+	p.full.mu.Lock()
+	defer p.full.mu.Unlock()
+	if full == p.full.full {
+		return
+	}
+	p.full.full = full
+	if full {
+		p.full.since = time.Now()
+		p.full.probe = p.full.since
+		log.Errorf("redis is out of memory, refusing new allocations until writes succeed again: %v", err)
+		p.emit(Event{Type: EventStorageFull, Detail: err.Error()})
+		return
+	}
+	log.Infof("redis accepts writes again after %s, resuming allocations", time.Since(p.full.since).Round(time.Second))
+	p.emit(Event{Type: EventStorageRecovered})
+}
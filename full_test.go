@@ -0,0 +1,93 @@
+package rangeredisplugin
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// outOfMemory makes m refuse the writes as redis does at maxmemory with
+// the noeviction policy, also from a script, until the returned function
+// is called. Reads and deletions still work.
+func outOfMemory(m *miniredis.Miniredis) func() {
+	m.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd != "SET" && cmd != "EXPIRE" && cmd != "PEXPIRE" {
+			return false
+		}
+		c.WriteError("OOM command not allowed when used memory > 'maxmemory'.")
+		return true
+	})
+	return func() { m.Server().SetPreHook(nil) }
+}
+
+func TestStorageFull(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.4.10", "10.0.4.20", "1h")
+	events := recordEvents(p)
+	const a, b, c = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c"
+	ip := lease(t, p, a)
+
+	restore := outOfMemory(m)
+	if offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, b)); offer != nil {
+		t.Errorf("offer of %s not persisted", offer.YourIPAddr)
+	}
+	if !p.storageFull() {
+		t.Fatal("out of memory error not noticed")
+	}
+	eventually(t, "the alert", func() bool { return len(events.of(EventStorageFull)) == 1 })
+
+	// further allocations are not attempted, renewals are answered
+	if offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, c)); offer != nil {
+		t.Errorf("offer of %s while out of memory", offer.YourIPAddr)
+	}
+	ack := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, a, dhcpv4.WithClientIP(ip)))
+	if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck || !ack.YourIPAddr.Equal(ip) {
+		t.Errorf("renewal while out of memory answered %v", ack)
+	}
+	if n := len(events.of(EventStorageFull)); n != 1 {
+		t.Errorf("%d alerts, want 1", n)
+	}
+
+	// the next probe succeeds once redis accepts writes again
+	restore()
+	p.full.mu.Lock()
+	p.full.probe = time.Now().Add(-storageFullRetryInterval)
+	p.full.mu.Unlock()
+	// no unpersisted address was kept in the allocator
+	if got := lease(t, p, b); !got.Equal(net.IPv4(10, 0, 4, 11)) {
+		t.Errorf("leased %s after the recovery, want 10.0.4.11", got)
+	}
+	if p.storageFull() {
+		t.Error("still out of memory after a successful write")
+	}
+	eventually(t, "the recovery event", func() bool { return len(events.of(EventStorageRecovered)) == 1 })
+	assertIndexed(t, m, p)
+}
+
+func TestStorageFullProbe(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.4.10", "10.0.4.20", "1h")
+	defer outOfMemory(m)()
+	const mac = "00:11:22:33:44:0a"
+
+	for i := 0; i < 3; i++ {
+		exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac))
+	}
+	// a single allocation was attempted, and rolled back
+	if ip, err := p.allocate(mac); err != nil || !ip.Equal(net.IPv4(10, 0, 4, 10)) {
+		t.Errorf("allocate after the failures: %s, %v, want 10.0.4.10", ip, err)
+	}
+	if p.allowAllocation() {
+		t.Error("allocation allowed before the probe interval")
+	}
+	p.full.mu.Lock()
+	p.full.probe = time.Now().Add(-storageFullRetryInterval)
+	p.full.mu.Unlock()
+	if !p.allowAllocation() || p.allowAllocation() {
+		t.Error("not a single probe allowed after the interval")
+	}
+}
@@ -0,0 +1,261 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// REDIS_HANDOVER_KEY:<start>-<end> holds the ID of an instance handing its
+// pool over to a successor, and REDIS_SNAPSHOT_KEY:<start>-<end> the
+// records it left for it. Whoever deletes the handover key while it holds
+// that ID decides the outcome: the successor taking over, or the outgoing
+// instance giving up. Both are those of the default namespace, see
+// keySpace.
+const (
+	REDIS_HANDOVER_KEY = "x:dhcp:handover"
+	REDIS_SNAPSHOT_KEY = "x:dhcp:snapshot"
+)
+
+// how long the outgoing instance waits for a successor before it resumes
+// allocating. The handover key outlives it, so that it is still there for
+// the outgoing instance to give up.
+const handoverTimeout = 5 * time.Minute
+
+// ErrHandoverRunning is returned when a handover is prepared while one is
+// in progress
+var ErrHandoverRunning = errors.New("a handover is already in progress")
+
+// ErrForeignSnapshot means the handover snapshot found was not left for the
+// pool by the instance handing it over, e.g. one of an earlier version
+var ErrForeignSnapshot = errors.New("handover snapshot of another pool or instance")
+
+// handoverSnapshot is the snapshot of the records an instance hands over,
+// naming its pool and the instance
+type handoverSnapshot struct {
+	Pool    string
+	ID      string
+	Records map[string]Record
+}
+
+// handoverKeys returns the handover and snapshot keys of pool
+func (ns keySpace) handoverKeys(pool string) []string {
+	return []string{ns.handover + ":" + pool, ns.snapshot + ":" + pool}
+}
+
+// endHandoverScript deletes the handover key if it holds the given ID and
+// announces the successor on the control channel, if there is one.
+// KEYS: handover, snapshot. ARGV: outgoing ID, control channel, message
+var endHandoverScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('DEL', KEYS[1], KEYS[2])
+if ARGV[3] ~= '' then
+	redis.call('PUBLISH', ARGV[2], ARGV[3])
+end
+return 1
+`)
+
+// handover is the state of an instance handing over to its successor
+type handover struct {
+	mu       sync.Mutex
+	id       string
+	deadline time.Time
+	done     chan struct{}
+}
+
+// BeginHandover marks a handover of pool by instance id, failing if another
+// one is in progress
+func (r *RedisProvider) BeginHandover(ctx context.Context, pool, id string) error {
+	ok, err := r.rdb.SetNX(ctx, r.ns.handoverKeys(pool)[0], id, 2*handoverTimeout).Result()
+	if err != nil {
+		return unavailable(err)
+	}
+	if !ok {
+		return ErrHandoverRunning
+	}
+	return nil
+}
+
+// SaveSnapshot stores the records of pool for the successor of instance id
+func (r *RedisProvider) SaveSnapshot(ctx context.Context, pool, id string, records map[string]Record) error {
+	val, err := json.Marshal(handoverSnapshot{Pool: pool, ID: id, Records: records})
+	if err != nil {
+		return err
+	}
+	return unavailable(r.rdb.Set(ctx, r.ns.handoverKeys(pool)[1], val, 2*handoverTimeout).Err())
+}
+
+// LoadHandover returns the ID of the instance handing pool over and the
+// records it left, or an empty ID if there is no handover to take. A
+// snapshot left by another instance or for another pool is rejected with
+// ErrForeignSnapshot.
+func (r *RedisProvider) LoadHandover(ctx context.Context, pool string) (string, map[string]Record, error) {
+	vals, err := r.rdb.MGet(ctx, r.ns.handoverKeys(pool)...).Result()
+	if err != nil {
+		return "", nil, unavailable(err)
+	}
+	id, _ := vals[0].(string)
+	val, _ := vals[1].(string)
+	if id == "" || val == "" {
+		// no handover, or the snapshot is still being written
+		return "", nil, nil
+	}
+	var snap handoverSnapshot
+	if err := json.Unmarshal([]byte(val), &snap); err != nil {
+		return "", nil, fmt.Errorf("%w: handover snapshot: %v", ErrCorruptRecord, err)
+	}
+	if snap.Pool != pool || snap.ID != id {
+		return "", nil, fmt.Errorf("%w: snapshot of %q by %q, handover of %s by %s", ErrForeignSnapshot, snap.Pool, snap.ID, pool, id)
+	}
+	return id, snap.Records, nil
+}
+
+// EndHandover deletes the handover of pool by instance id, announcing
+// successor on the control channel unless it is empty. Returns false if the
+// handover was already ended by the other side.
+func (r *RedisProvider) EndHandover(ctx context.Context, pool, id, successor string) (bool, error) {
+	msg := ""
+	if successor != "" {
+		msg = "handover-complete " + id + " " + successor
+	}
+	n, err := endHandoverScript.Run(ctx, r.rdb, r.ns.handoverKeys(pool),
+		id, REDIS_CONTROL_CHANNEL, msg).Int()
+	if err != nil {
+		return false, unavailable(err)
+	}
+	return n == 1, nil
+}
+
+// PrepareShutdown starts handing the pool over to a successor: new
+// allocations stop, and the records are left in a snapshot for the
+// successor to load. Renewals are served until the successor takes over,
+// which closes HandedOver. If no successor shows up within five minutes,
+// allocations resume.
+func (p *PluginState) PrepareShutdown(ctx context.Context) error {
+	id := p.id
+	if err := p.storage.BeginHandover(ctx, p.poolName(), id); err != nil {
+		return err
+	}
+	p.handover.mu.Lock()
+	p.handover.id = id
+	p.handover.deadline = time.Now().Add(handoverTimeout)
+	p.handover.mu.Unlock()
+	log.Infof("handover %s: new allocations stopped, waiting for a successor", id)
+
+	records, err := p.storage.GetAllRecords()
+	if err == nil {
+		err = p.storage.SaveSnapshot(ctx, p.poolName(), id, records)
+	}
+	if err != nil {
+		p.abortHandover(ctx)
+		return fmt.Errorf("could not save the handover snapshot: %w", err)
+	}
+	log.Infof("handover %s: snapshot of %d records saved", id, len(records))
+	return nil
+}
+
+// HandedOver is closed once a successor took over from the instance, which
+// then ignores all requests and notifications and should exit
+func (p *PluginState) HandedOver() <-chan struct{} {
+	return p.handover.done
+}
+
+func (p *PluginState) handedOver() bool {
+	select {
+	case <-p.handover.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// handingOver reports whether new leases are withheld for a successor
+func (p *PluginState) handingOver() bool {
+	p.handover.mu.Lock()
+	id, deadline := p.handover.id, p.handover.deadline
+	p.handover.mu.Unlock()
+	return id != "" && (p.handedOver() || time.Now().Before(deadline))
+}
+
+// allowNewLeases reports whether new leases may be granted: not while
+// handing over, unless the successor failed to show up in time
+func (p *PluginState) allowNewLeases() bool {
+	p.handover.mu.Lock()
+	id := p.handover.id
+	p.handover.mu.Unlock()
+
+	if id == "" {
+		return true
+	}
+	if p.handingOver() {
+		return false
+	}
+	return p.abortHandover(context.TODO())
+}
+
+// abortHandover gives up the handover in progress, unless the successor
+// took over meanwhile. Returns true if it was given up.
+func (p *PluginState) abortHandover(ctx context.Context) bool {
+	p.handover.mu.Lock()
+	defer p.handover.mu.Unlock()
+
+	ended, err := p.storage.EndHandover(ctx, p.poolName(), p.handover.id, "")
+	if err != nil {
+		log.Errorf("handover %s: could not give up: %v", p.handover.id, err)
+		return false
+	}
+	if !ended {
+		// the successor won, its announcement is on its way
+		return false
+	}
+	log.Warnf("handover %s: no successor took over, resuming allocations", p.handover.id)
+	p.handover.id = ""
+	return true
+}
+
+// completeHandover handles the announcement of a successor taking over
+func (p *PluginState) completeHandover(id, successor string) {
+	p.handover.mu.Lock()
+	defer p.handover.mu.Unlock()
+
+	if id != p.handover.id || p.handedOver() {
+		return
+	}
+	log.Infof("handover %s: %s took over", id, successor)
+	close(p.handover.done)
+}
+
+// takeOver loads the snapshot of an instance handing the pool over, if
+// there is one. Records whose lease ended since the snapshot are dropped.
+// Returns the ID of the outgoing instance, or an empty one. A foreign
+// snapshot is ignored: the records are then loaded from the storage, and
+// no instance is taken over from.
+func (p *PluginState) takeOver(ctx context.Context) (string, map[string]Record, error) {
+	id, records, err := p.storage.LoadHandover(ctx, p.poolName())
+	if errors.Is(err, ErrForeignSnapshot) {
+		log.Warnf("ignoring the handover: %v", err)
+		return "", nil, nil
+	}
+	if err != nil || id == "" {
+		return "", nil, err
+	}
+	macs := make([]string, 0, len(records))
+	for mac := range records {
+		macs = append(macs, mac)
+	}
+	ended, err := p.storage.MissingShadows(macs)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, mac := range ended {
+		delete(records, mac)
+	}
+	return id, records, nil
+}
@@ -0,0 +1,85 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestHandover(t *testing.T) {
+	m := miniredis.RunT(t)
+	old := startPlugin(t, m, "10.0.0.10", "10.0.0.20", "1h")
+	const mac = "00:11:22:33:44:55"
+	ip := lease(t, old, mac)
+
+	if err := old.PrepareShutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if old.allowNewLeases() {
+		t.Error("new leases allowed while handing over")
+	}
+
+	successor := startPlugin(t, m, "10.0.0.10", "10.0.0.20", "1h")
+	if got := successor.leases.ipOf(mac); !got.Equal(ip) {
+		t.Errorf("successor loaded %s for %s, want %s", got, mac, ip)
+	}
+	select {
+	case <-old.HandedOver():
+	case <-time.After(time.Second):
+		t.Fatal("the outgoing instance was not told about its successor")
+	}
+	for _, key := range old.storage.ns.handoverKeys(old.poolName()) {
+		if m.Exists(key) {
+			t.Errorf("%s left after the handover", key)
+		}
+	}
+}
+
+func TestHandoverOfAnotherPool(t *testing.T) {
+	m := miniredis.RunT(t)
+	old := startPlugin(t, m, "10.0.0.10", "10.0.0.20", "1h")
+	if err := old.PrepareShutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	other := startPlugin(t, m, "10.0.0.30", "10.0.0.40", "1h")
+	if !m.Exists(old.storage.ns.handoverKeys(old.poolName())[0]) {
+		t.Fatal("an instance of another pool ended the handover")
+	}
+	if old.handedOver() {
+		t.Error("an instance of another pool took over")
+	}
+	if !other.allowNewLeases() {
+		t.Error("the instance of another pool does not allocate")
+	}
+}
+
+func TestForeignSnapshotRejected(t *testing.T) {
+	m := miniredis.RunT(t)
+	const pool = "10.0.0.10-10.0.0.20"
+	keys := defaultKeySpace.handoverKeys(pool)
+	snap, err := json.Marshal(handoverSnapshot{Pool: pool, ID: "earlier", Records: map[string]Record{
+		"00:11:22:33:44:55": {Expires: time.Now().Add(time.Hour)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Set(keys[0], "outgoing")
+	m.Set(keys[1], string(snap))
+
+	p := startPlugin(t, m, "10.0.0.10", "10.0.0.20", "1h")
+	if p.leases.len() != 0 {
+		t.Error("records of a foreign snapshot loaded")
+	}
+	if got, _ := m.Get(keys[0]); got != "outgoing" {
+		t.Errorf("handover of another instance ended: %q", got)
+	}
+
+	if _, _, err := p.storage.LoadHandover(context.Background(), pool); !errors.Is(err, ErrForeignSnapshot) {
+		t.Fatalf("got %v, want %v", err, ErrForeignSnapshot)
+	}
+}
@@ -0,0 +1,218 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// fakeClock is a Clock moved forward by the test only
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// redisURI returns the URI of database 0 of m
+func redisURI(m *miniredis.Miniredis) string {
+	return "redis://" + m.Addr() + "/0"
+}
+
+// startPlugin sets up an instance against m, configured with args after
+// the URI, and closes it at the end of the test. Its clock is a fakeClock
+// starting now. miniredis publishes no keyevent notifications, see expire.
+func startPlugin(t testing.TB, m *miniredis.Miniredis, args ...string) *PluginState {
+	t.Helper()
+	if _, err := setup4(append([]string{redisURI(m)}, args...)...); err != nil {
+		t.Fatalf("setup4: %v", err)
+	}
+	all := Instances()
+	p := all[len(all)-1]
+	p.SetClock(newFakeClock(time.Now()))
+	t.Cleanup(func() {
+		if err := p.Close(context.Background()); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	})
+	return p
+}
+
+// newRequest returns a message of type typ from mac, with the modifiers
+// applied after
+func newRequest(t testing.TB, typ dhcpv4.MessageType, mac string, mods ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	t.Helper()
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := dhcpv4.New(append([]dhcpv4.Modifier{dhcpv4.WithHwAddr(hw), dhcpv4.WithMessageType(typ)}, mods...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// exchange passes req through Handler4 with the reply coredhcp prepares
+// for it, and returns the reply, nil if dropped
+func exchange(t testing.TB, p *PluginState, req *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	t.Helper()
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
+	case dhcpv4.MessageTypeRequest:
+		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+	}
+	out, _ := p.Handler4(req, resp)
+	return out
+}
+
+// lease has mac discover and request an address, and returns the address
+// acknowledged
+func lease(t testing.TB, p *PluginState, mac string) net.IP {
+	t.Helper()
+	offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac))
+	if offer == nil {
+		t.Fatalf("no offer to %s", mac)
+	}
+	ack := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(offer.YourIPAddr))))
+	if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("no ACK to %s: %v", mac, ack)
+	}
+	return ack.YourIPAddr
+}
+
+// advance moves the clock of p forward by d
+func advance(p *PluginState, d time.Duration) {
+	p.clock.v.Load().(setClock).Clock.(*fakeClock).Advance(d)
+}
+
+// expire ends the lease of mac the way redis does: the clock of p moves
+// past its expiry, its shadow key expires, and the keyevent notification
+// miniredis does not publish is published
+func expire(t *testing.T, m *miniredis.Miniredis, p *PluginState, mac string) {
+	t.Helper()
+	rec, err := p.storage.GetRecord(mac)
+	if err != nil {
+		t.Fatalf("no record of %s to expire: %v", mac, err)
+	}
+	if d := rec.Expires.Sub(p.clock.Now()); d >= 0 {
+		advance(p, d+time.Second)
+	}
+	m.Del(p.storage.ns.shadow + mac)
+	m.Publish("__keyevent@0__:expired", p.storage.ns.shadow+mac)
+}
+
+// eventually fails the test unless cond holds within a second
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// eventRecorder is an EventSink keeping the events it receives
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) HandleEvent(ev Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+// of returns the events of type typ received so far
+func (r *eventRecorder) of(typ EventType) []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []Event
+	for _, ev := range r.events {
+		if ev.Type == typ {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+// recordEvents returns a sink of p receiving its events from now on
+func recordEvents(p *PluginState) *eventRecorder {
+	r := &eventRecorder{}
+	p.queuesMu.Lock()
+	p.sinks = append(p.sinks, r)
+	p.queuesMu.Unlock()
+	return r
+}
+
+// pagedScan makes m answer SCAN in pages of COUNT keys, as redis does for
+// large keyspaces: miniredis returns all the keys at once
+func pagedScan(m *miniredis.Miniredis) {
+	m.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd != "SCAN" || len(args) == 0 {
+			return false
+		}
+		cursor, err := strconv.Atoi(args[0])
+		if err != nil {
+			return false
+		}
+		pattern, count := "*", 10
+		for i := 1; i+1 < len(args); i += 2 {
+			switch strings.ToUpper(args[i]) {
+			case "MATCH":
+				pattern = args[i+1]
+			case "COUNT":
+				count, _ = strconv.Atoi(args[i+1])
+			}
+		}
+		var keys []string
+		for _, key := range m.Keys() {
+			if ok, _ := path.Match(pattern, key); ok {
+				keys = append(keys, key)
+			}
+		}
+		next := cursor + count
+		if next >= len(keys) {
+			next = 0
+		}
+		page := keys[min(cursor, len(keys)):min(cursor+count, len(keys))]
+		c.WriteLen(2)
+		c.WriteBulk(strconv.Itoa(next))
+		c.WriteLen(len(page))
+		for _, key := range page {
+			c.WriteBulk(key)
+		}
+		return true
+	})
+}
@@ -0,0 +1,90 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// Health statuses reported by PluginState.Health
+const (
+	HealthOK        = "ok"
+	HealthNotReady  = "not-ready"
+	HealthUnhealthy = "unhealthy"
+)
+
+// Health describes whether a plugin instance is able to serve requests
+type Health struct {
+	Status string
+	Ready  bool
+	Error  string `json:",omitempty"`
+	// Pool holds the connection pool statistics of the primary endpoint
+	Pool *redis.PoolStats `json:",omitempty"`
+	// Clock reports the system clock jumps seen since startup
+	Clock ClockStatus
+	// Storage holds the capabilities of the primary endpoint
+	Storage StorageCapabilities
+	// KillSwitch is the kill switch in effect, if any
+	KillSwitch *KillSwitch `json:",omitempty"`
+}
+
+var (
+	instancesMu sync.Mutex
+	instances   []*PluginState
+)
+
+// Instances returns the plugin instances set up so far
+func Instances() []*PluginState {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	return append([]*PluginState(nil), instances...)
+}
+
+func registerInstance(p *PluginState) {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	instances = append(instances, p)
+}
+
+// WaitForReady blocks until the instance is subscribed to expiry
+// notifications, has reloaded its leases and started its background
+// goroutines, or until ctx is done.
+func (p *PluginState) WaitForReady(ctx context.Context) error {
+	select {
+	case <-p.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *PluginState) isReady() bool {
+	select {
+	case <-p.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// Health reports the status of the instance. An instance that is still
+// starting up is reported as not ready rather than unhealthy.
+func (p *PluginState) Health(ctx context.Context) Health {
+	if !p.isReady() {
+		return Health{Status: HealthNotReady}
+	}
+	h := Health{
+		Status:     HealthOK,
+		Ready:      true,
+		Pool:       p.storage.PoolStats(),
+		Clock:      p.watchdog.Status(),
+		Storage:    p.storage.Capabilities(),
+		KillSwitch: p.kill.active(),
+	}
+	if err := p.storage.Ping(ctx); err != nil {
+		h.Status = HealthUnhealthy
+		h.Error = err.Error()
+	}
+	return h
+}
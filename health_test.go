@@ -0,0 +1,68 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestNoExpiryMissedAfterSetup(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			m := miniredis.RunT(t)
+			const mac = "00:11:22:33:44:55"
+			before := openStorage(t, m, StorageOptions{})
+			if err := before.SaveRecord(mac, boundRecord("10.4.0.12", time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+
+			// published as soon as setup returns
+			p := startPlugin(t, m, "10.4.0.10", "10.4.0.20", "1h")
+			expire(t, m, p, mac)
+			eventually(t, "the reloaded lease to be freed", func() bool { return p.leases.ipOf(mac) == nil })
+		})
+	}
+}
+
+func TestWaitForReady(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.4.1.10", "10.4.1.20", "1h")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.WaitForReady(ctx); err != nil {
+		t.Errorf("WaitForReady after setup: %v", err)
+	}
+	if h := p.Health(ctx); h.Status != HealthOK || !h.Ready {
+		t.Errorf("Health after setup: %+v", h)
+	}
+
+	// an instance still starting up
+	starting := &PluginState{ready: make(chan struct{})}
+	short, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := starting.WaitForReady(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitForReady while starting: %v", err)
+	}
+	if h := starting.Health(ctx); h.Status != HealthNotReady || h.Ready {
+		t.Errorf("Health while starting: %+v", h)
+	}
+	close(starting.ready)
+	if err := starting.WaitForReady(ctx); err != nil {
+		t.Errorf("WaitForReady once started: %v", err)
+	}
+}
+
+func TestHealthUnhealthy(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.4.2.10", "10.4.2.20", "1h")
+	m.SetError("LOADING redis is loading the dataset in memory")
+	h := p.Health(context.Background())
+	m.SetError("")
+	if h.Status != HealthUnhealthy || !h.Ready || h.Error == "" {
+		t.Errorf("Health with redis failing: %+v", h)
+	}
+}
@@ -0,0 +1,82 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// REDIS_HISTORY_KEY_PREFIX prefixes the per-MAC lists of past bindings, in the default
+// namespace
+const REDIS_HISTORY_KEY_PREFIX = "h:dhcp:"
+
+// number of past bindings kept per MAC address by default
+const defaultHistoryLength = 5
+
+// HistoryEntry is one past binding of a MAC address
+type HistoryEntry struct {
+	IP   net.IP
+	Time time.Time
+}
+
+// AppendHistory records that mac was granted ip, keeping only the most
+// recent bindings.
+func (r *RedisProvider) AppendHistory(mac string, ip net.IP, t time.Time) error {
+	if r.historyLength <= 0 {
+		return nil
+	}
+	entry, err := json.Marshal(HistoryEntry{IP: ip, Time: t})
+	if err != nil {
+		return err
+	}
+
+	key := r.ns.history + mac
+	_, err = r.history.TxPipelined(context.TODO(), func(pipe redis.Pipeliner) error {
+		pipe.LPush(context.TODO(), key, entry)
+		pipe.LTrim(context.TODO(), key, 0, int64(r.historyLength-1))
+		return nil
+	})
+	return err
+}
+
+// appendHistory records that mac was granted ip at t, logging failures
+func (p *PluginState) appendHistory(mac string, ip net.IP, t time.Time) {
+	if err := p.storage.AppendHistory(mac, ip, t); err != nil {
+		log.Warnf("Could not record history for MAC %s: %v", mac, err)
+	}
+}
+
+// LatestBindings returns the most recent binding of up to limit MAC
+// addresses found in the history.
+func (r *RedisProvider) LatestBindings(ctx context.Context, limit int) (map[string]net.IP, error) {
+	bindings := make(map[string]net.IP)
+	var cursor uint64
+	for len(bindings) < limit {
+		keys, next, err := r.history.Scan(ctx, cursor, r.ns.history+"*", 1000).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if len(bindings) >= limit {
+				break
+			}
+			val, err := r.history.LIndex(ctx, key, 0).Result()
+			if err != nil {
+				continue
+			}
+			var entry HistoryEntry
+			if err := json.Unmarshal([]byte(val), &entry); err != nil || entry.IP == nil {
+				continue
+			}
+			bindings[key[len(r.ns.history):]] = entry.IP
+		}
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+	return bindings, nil
+}
@@ -0,0 +1,107 @@
+package rangeredisplugin
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// ErrHardwareAddress means a request carries a hardware address that does
+// not match its declared hardware type
+var ErrHardwareAddress = errors.New("invalid hardware address")
+
+// hwAddrLengths maps the known hardware types to the length of their
+// address. Infiniband clients send no address (RFC 4390), and are keyed on
+// their client identifier.
+var hwAddrLengths = map[iana.HWType]int{
+	iana.HWTypeEthernet:             6,
+	iana.HWTypeExperimentalEthernet: 6,
+	iana.HWTypeIEEE802:              6,
+	iana.HWTypeEUI64:                8,
+	iana.HWTypeInfiniband:           0,
+}
+
+// clientKey returns the canonical identifier of the client sending req,
+// which keys its lease. Ethernet addresses keep their usual notation so
+// that existing records stay valid; other types are prefixed with their
+// type number, so that addresses of different types never collide.
+func (p *PluginState) clientKey(req *dhcpv4.DHCPv4) (string, error) {
+	hw := req.ClientHWAddr
+	want, known := hwAddrLengths[req.HWType]
+	switch {
+	case !known && !p.cfg.AcceptUnknownHWTypes:
+		return "", fmt.Errorf("%w: unsupported hardware type %d", ErrHardwareAddress, req.HWType)
+	case known && len(hw) != want:
+		return "", fmt.Errorf("%w: %s address of %d bytes, want %d", ErrHardwareAddress, req.HWType, len(hw), want)
+	}
+
+	if req.HWType == iana.HWTypeEthernet {
+		return hw.String(), nil
+	}
+	if len(hw) == 0 {
+		id := req.Options.Get(dhcpv4.OptionClientIdentifier)
+		if len(id) == 0 {
+			return "", fmt.Errorf("%w: %s client without client identifier", ErrHardwareAddress, req.HWType)
+		}
+		return fmt.Sprintf("%d-id-%x", req.HWType, id), nil
+	}
+	return fmt.Sprintf("%d-%x", req.HWType, []byte(hw)), nil
+}
+
+// validClientKey reports whether key is in one of the canonical forms
+// returned by clientKey
+func validClientKey(key string) bool {
+	if mac, err := net.ParseMAC(key); err == nil {
+		return len(mac) == 6 && mac.String() == key
+	}
+
+	htype, addr, ok := strings.Cut(key, "-")
+	if !ok {
+		return false
+	}
+	n, err := strconv.ParseUint(htype, 10, 8)
+	if err != nil || n == 0 || strconv.FormatUint(n, 10) != htype {
+		return false
+	}
+	addr = strings.TrimPrefix(addr, "id-")
+	b, err := hex.DecodeString(addr)
+	return err == nil && len(b) > 0 && hex.EncodeToString(b) == addr
+}
+
+// parseMACPrefixes parses a list of MAC address prefixes of one to six
+// bytes, e.g. aa:bb:cc,AA-BB-CC-DD, into their canonical lowercase form
+// with colons, longest first
+func parseMACPrefixes(val string) ([]string, error) {
+	var prefixes []string
+	for _, entry := range strings.Split(val, ",") {
+		b, err := hex.DecodeString(strings.NewReplacer(":", "", "-", "").Replace(entry))
+		if err != nil || len(b) == 0 || len(b) > 6 || strings.Count(entry, ":")+strings.Count(entry, "-") != len(b)-1 {
+			return nil, fmt.Errorf("invalid MAC prefix %q, want one to six bytes like aa:bb:cc", entry)
+		}
+		prefixes = append(prefixes, net.HardwareAddr(b).String())
+	}
+	sort.SliceStable(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	return prefixes, nil
+}
+
+// allowedPrefix returns the longest allowed prefix hw matches. Without
+// allowed prefixes, every address is allowed and the prefix is empty.
+func (c *Config) allowedPrefix(hw net.HardwareAddr) (string, bool) {
+	if len(c.AllowedPrefixes) == 0 {
+		return "", true
+	}
+	mac := hw.String()
+	for _, prefix := range c.AllowedPrefixes {
+		if strings.HasPrefix(mac, prefix) {
+			return prefix, true
+		}
+	}
+	return "", false
+}
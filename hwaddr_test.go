@@ -0,0 +1,205 @@
+package rangeredisplugin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// packet returns a DISCOVER of hardware type htype and address chaddr, as
+// parsed from the wire
+func packet(t *testing.T, htype iana.HWType, chaddr []byte, mods ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	t.Helper()
+	req, err := dhcpv4.New(append([]dhcpv4.Modifier{dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover)}, mods...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.HWType = htype
+	req.ClientHWAddr = chaddr
+	parsed, err := dhcpv4.FromBytes(req.ToBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+// assertEchoed checks that the hardware fields of the reply to req are
+// those of req, on the wire
+func assertEchoed(t *testing.T, req, resp *dhcpv4.DHCPv4) {
+	t.Helper()
+	wire := resp.ToBytes()
+	if iana.HWType(wire[1]) != req.HWType || int(wire[2]) != len(req.ClientHWAddr) ||
+		!bytes.Equal(wire[28:28+len(req.ClientHWAddr)], req.ClientHWAddr) {
+		t.Errorf("reply of htype %d hlen %d chaddr %x, want %d %d %x",
+			wire[1], wire[2], wire[28:28+wire[2]], req.HWType, len(req.ClientHWAddr), []byte(req.ClientHWAddr))
+	}
+}
+
+func TestHardwareTypes(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.3.10", "10.0.3.200", "1h")
+	ethernet := []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	guid := []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77}
+	clientID := append([]byte{0xff, 0x00, 0x00, 0x00, 0x00}, bytes.Repeat([]byte{0xab}, 20)...)
+
+	for _, tc := range []struct {
+		name string
+		req  *dhcpv4.DHCPv4
+		key  string
+	}{
+		{"ethernet", packet(t, iana.HWTypeEthernet, ethernet), "00:11:22:33:44:55"},
+		// an EUI-64 starting with the same bytes gets a lease of its own
+		{"eui-64", packet(t, iana.HWTypeEUI64, guid), "27-0011223344556677"},
+		// Infiniband clients send no address but a client identifier
+		{"infiniband", packet(t, iana.HWTypeInfiniband, nil,
+			dhcpv4.WithOption(dhcpv4.OptClientIdentifier(clientID))), "32-id-" + hex.EncodeToString(clientID)},
+	} {
+		offer := exchange(t, p, tc.req)
+		if offer == nil {
+			t.Errorf("%s: no offer", tc.name)
+			continue
+		}
+		assertEchoed(t, tc.req, offer)
+		if ip := p.leases.ipOf(tc.key); !ip.Equal(offer.YourIPAddr) {
+			t.Errorf("%s: lease of %s on %s, want %s", tc.name, tc.key, ip, offer.YourIPAddr)
+		}
+	}
+	if n := p.leases.len(); n != 3 {
+		t.Errorf("%d leases for three clients", n)
+	}
+	if n := p.Stats().RejectedHardwareAddresses; n != 0 {
+		t.Errorf("%d hardware addresses rejected", n)
+	}
+}
+
+func TestMalformedHardwareAddresses(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.3.10", "10.0.3.200", "1h")
+	for i, tc := range []struct {
+		name string
+		req  *dhcpv4.DHCPv4
+	}{
+		{"short ethernet", packet(t, iana.HWTypeEthernet, []byte{0x00, 0x11, 0x22, 0x33})},
+		{"long ethernet", packet(t, iana.HWTypeEthernet, []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77})},
+		{"infiniband with an address", packet(t, iana.HWTypeInfiniband, bytes.Repeat([]byte{0x11}, 16))},
+		{"infiniband without client identifier", packet(t, iana.HWTypeInfiniband, nil)},
+		{"unknown type", packet(t, iana.HWType(99), []byte{0x01, 0x02, 0x03})},
+	} {
+		if resp := exchange(t, p, tc.req); resp != nil {
+			t.Errorf("%s: answered %v", tc.name, resp)
+		}
+		if n := p.Stats().RejectedHardwareAddresses; n != uint64(i+1) {
+			t.Errorf("%s: %d hardware addresses rejected, want %d", tc.name, n, i+1)
+		}
+	}
+	if n := p.leases.len(); n != 0 {
+		t.Errorf("%d leases for malformed addresses", n)
+	}
+}
+
+func TestUnknownHardwareTypesAccepted(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.3.10", "10.0.3.200", "1h", "unknown_hwtypes=accept")
+	req := packet(t, iana.HWType(99), []byte{0x01, 0x02, 0x03})
+	offer := exchange(t, p, req)
+	if offer == nil {
+		t.Fatal("no offer to an unknown hardware type")
+	}
+	assertEchoed(t, req, offer)
+	if ip := p.leases.ipOf("99-010203"); !ip.Equal(offer.YourIPAddr) {
+		t.Errorf("lease on %s, want %s keyed by hex", ip, offer.YourIPAddr)
+	}
+}
+
+func TestValidClientKey(t *testing.T) {
+	for key, want := range map[string]bool{
+		"00:11:22:33:44:55":       true,
+		"27-0011223344556677":     true,
+		"32-id-ff00000000abab":    true,
+		"00:11:22:33:44:55:66:77": false,
+		"00-11-22-33-44-55":       false,
+		"00:11:22:33:44:AA":       false,
+		"027-0011":                false,
+		"0-0011":                  false,
+		"256-0011":                false,
+		"27-":                     false,
+		"27-0G":                   false,
+		"27-00AA":                 false,
+	} {
+		if got := validClientKey(key); got != want {
+			t.Errorf("validClientKey(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestAllowedPrefix(t *testing.T) {
+	prefixes, err := parseMACPrefixes("AA-BB-CC,aa:bb:cc:dd,00:11:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(prefixes); got != "[aa:bb:cc:dd aa:bb:cc 00:11:22]" {
+		t.Errorf("parsed %s", got)
+	}
+	for _, val := range []string{"", "aa:bb:cc:", "aabb:cc", "aa:bb:cc:dd:ee:ff:00", "zz:bb", "aa:bb,"} {
+		if _, err := parseMACPrefixes(val); err == nil {
+			t.Errorf("parseMACPrefixes(%q) succeeded", val)
+		}
+	}
+
+	c := &Config{AllowedPrefixes: prefixes}
+	for _, tc := range []struct {
+		mac, prefix string
+		ok          bool
+	}{
+		{"00:11:22:33:44:55", "00:11:22", true},
+		// the 4-byte prefix wins over the 3-byte one it extends
+		{"aa:bb:cc:dd:00:01", "aa:bb:cc:dd", true},
+		{"AA:BB:CC:DE:00:01", "aa:bb:cc", true},
+		{"00:11:23:33:44:55", "", false},
+	} {
+		hw, _ := net.ParseMAC(tc.mac)
+		if prefix, ok := c.allowedPrefix(hw); prefix != tc.prefix || ok != tc.ok {
+			t.Errorf("allowedPrefix(%s) = %q, %t, want %q, %t", tc.mac, prefix, ok, tc.prefix, tc.ok)
+		}
+	}
+	// no list serves every client
+	hw, _ := net.ParseMAC("00:11:23:33:44:55")
+	if _, ok := (&Config{}).allowedPrefix(hw); !ok {
+		t.Error("address refused without a list")
+	}
+}
+
+func TestAllowMACs(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.47.10", "10.0.47.20", "1h", "allow_macs=00:11:22,AA:BB:CC:DD")
+	if ip := lease(t, p, "aa:bb:cc:dd:00:01"); ip == nil {
+		t.Error("allowed client not served")
+	}
+	lease(t, p, "00:11:22:33:44:0a")
+
+	// the others are dropped before redis is queried
+	var commands atomic.Int32
+	m.Server().SetPreHook(func(*server.Peer, string, ...string) bool {
+		commands.Add(1)
+		return false
+	})
+	for _, mac := range []string{"aa:bb:cc:de:00:01", "00:11:23:33:44:0a"} {
+		if offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac)); offer != nil {
+			t.Errorf("%s offered %s", mac, offer.YourIPAddr)
+		}
+	}
+	if n := commands.Load(); n != 0 {
+		t.Errorf("%d redis commands for the clients dropped", n)
+	}
+	if s := p.Stats(); s.DisallowedHardwareAddresses != 2 || s.AllocatedLeases != 2 {
+		t.Errorf("%d requests dropped and %d leases", s.DisallowedHardwareAddresses, s.AllocatedLeases)
+	}
+}
@@ -0,0 +1,179 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// remaining lifetime of a binding reclaimed from an idle client
+	idleGrace = 5 * time.Minute
+	// default number of liveness probes of a sweep, and the time each
+	// probe is given
+	defaultIdleProbes = 32
+	idleProbeTimeout  = 2 * time.Second
+)
+
+// LivenessProbe tells whether the holder of a lease still answers, e.g. by
+// ARP or ICMP. Probe reports false only when the address got no answer.
+type LivenessProbe interface {
+	Probe(ctx context.Context, ip net.IP, mac string) (bool, error)
+}
+
+var (
+	probeMu sync.RWMutex
+	probe   LivenessProbe
+)
+
+// RegisterLivenessProbe sets the probe the idle reclaim of all plugin
+// instances confirms idle clients with
+func RegisterLivenessProbe(lp LivenessProbe) {
+	probeMu.Lock()
+	defer probeMu.Unlock()
+	probe = lp
+}
+
+func registeredProbe() LivenessProbe {
+	probeMu.RLock()
+	defer probeMu.RUnlock()
+	return probe
+}
+
+// idleStale reports whether the last time record was seen is old enough to
+// be refreshed, so that the idle reclaim never mistakes a client renewing
+// for a client gone
+func (p *PluginState) idleStale(record *Record, now time.Time) bool {
+	return p.cfg.IdleTime > 0 && now.Sub(record.LastSeen) > p.cfg.IdleTime/2
+}
+
+// observedHolders holds the last ARP observation of the leaseholders, which
+// proves them alive without a probe
+type observedHolders struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+	// order is the order the entries were set in, oldest first
+	order arrivals[string]
+	// limit bounds the number of clients tracked, 0 for no bound
+	limit int
+}
+
+func (o *observedHolders) set(mac string, now time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.seen == nil {
+		o.seen = make(map[string]time.Time)
+	}
+	if _, ok := o.seen[mac]; !ok && o.limit > 0 && len(o.seen) >= o.limit {
+		evictOldest(o.seen, &o.order)
+	}
+	o.order.set(mac)
+	o.seen[mac] = now
+}
+
+func (o *observedHolders) get(mac string) time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.seen[mac]
+}
+
+// prune forgets the observations older than before
+func (o *observedHolders) prune(before time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for mac, t := range o.seen {
+		if t.Before(before) {
+			delete(o.seen, mac)
+			o.order.remove(mac)
+		}
+	}
+}
+
+func (o *observedHolders) len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.seen)
+}
+
+// reclaimIdle shortens the bindings of records whose client was not seen
+// for the idle time, so that they expire within idleGrace. A binding is
+// only shortened once the registered probe got no answer, or without a
+// probe under idle_unprobed; it is never freed before it expires. Returns
+// the number of bindings shortened.
+func (p *PluginState) reclaimIdle(ctx context.Context, records map[string]Record) int {
+	if p.cfg.IdleTime <= 0 {
+		return 0
+	}
+	lp := registeredProbe()
+	if lp == nil && !p.cfg.IdleUnprobed {
+		return 0
+	}
+	now := p.clock.Now()
+	idleSince := now.Add(-p.cfg.IdleTime)
+	p.observed.prune(idleSince)
+
+	probes, reclaimed := 0, 0
+	for mac, rec := range records {
+		switch {
+		case !p.inRange(rec.IP) || rec.Static || rec.offered() || p.reserved.has(rec.IP):
+			continue
+		case rec.LastSeen.IsZero() || rec.LastSeen.After(idleSince):
+			// records stored before LastSeen existed are never reclaimed
+			continue
+		case !rec.Expires.After(now.Add(idleGrace)):
+			continue
+		case p.observed.get(mac).After(idleSince):
+			continue
+		}
+		if lp != nil {
+			if probes >= p.cfg.IdleProbes {
+				log.Debugf("idle reclaim: probe budget of %d spent, %s left for the next sweep", p.cfg.IdleProbes, rec.IP)
+				continue
+			}
+			probes++
+			probeCtx, cancel := context.WithTimeout(ctx, idleProbeTimeout)
+			alive, err := lp.Probe(probeCtx, rec.IP, mac)
+			cancel()
+			if err != nil {
+				log.Warnf("idle reclaim: could not probe %s leased to MAC %s: %v", rec.IP, mac, err)
+				continue
+			}
+			if alive {
+				continue
+			}
+		}
+		shortened, err := p.shortenIdle(mac, rec.IP, now)
+		if err != nil {
+			log.Errorf("idle reclaim: %v", err)
+			continue
+		}
+		if shortened {
+			reclaimed++
+		}
+	}
+	p.counters.idleReclaims.Add(uint64(reclaimed))
+	return reclaimed
+}
+
+// shortenIdle makes the binding of mac to ip expire within idleGrace, if
+// the client was still not seen since the sweep read its record
+func (p *PluginState) shortenIdle(mac string, ip net.IP, now time.Time) (bool, error) {
+	rec, err := p.storage.GetRecord(mac)
+	if err != nil {
+		return false, fmt.Errorf("could not read the record of MAC %s: %w", mac, err)
+	}
+	if !rec.IP.Equal(ip) || rec.LastSeen.After(now.Add(-p.cfg.IdleTime)) {
+		return false, nil
+	}
+	last := rec.LastSeen
+	rec.Expires = now.Add(idleGrace)
+	if err := p.storage.SaveRecord(mac, rec); err != nil {
+		return false, fmt.Errorf("could not shorten the lease of %s for MAC %s: %w", ip, mac, err)
+	}
+	log.Infof("idle reclaim: lease of %s for MAC %s, last seen %s, ends at %s",
+		ip, mac, last.Format(time.RFC3339), rec.Expires.Format(time.RFC3339))
+	p.emit(Event{Type: EventIdle, MAC: mac, IP: ip, Labels: rec.Labels, Detail: "last seen " + last.Format(time.RFC3339)})
+	return true, nil
+}
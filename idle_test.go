@@ -0,0 +1,127 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// fakeProbe answers the liveness probes of the addresses in alive
+type fakeProbe struct {
+	mu     sync.Mutex
+	alive  map[string]bool
+	probed []string
+}
+
+func (f *fakeProbe) Probe(ctx context.Context, ip net.IP, mac string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.probed = append(f.probed, mac)
+	return f.alive[ip.String()], nil
+}
+
+// withProbe registers lp for the test
+func withProbe(t *testing.T, lp LivenessProbe) {
+	RegisterLivenessProbe(lp)
+	t.Cleanup(func() { RegisterLivenessProbe(nil) })
+}
+
+// sweepIdle runs the idle reclaim of p over all its records
+func sweepIdle(t *testing.T, p *PluginState) int {
+	t.Helper()
+	records, err := p.storage.GetAllRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.reclaimIdle(context.Background(), records)
+}
+
+func TestIdleReclaim(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.49.10", "10.0.49.20", "12h", "idle_reclaim=7h")
+	events := recordEvents(p)
+	const alive, gone, renewing = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c"
+	ipAlive, ipGone := lease(t, p, alive), lease(t, p, gone)
+	ipRenewing := lease(t, p, renewing)
+	lp := &fakeProbe{alive: map[string]bool{ipAlive.String(): true}}
+	withProbe(t, lp)
+
+	// nothing is idle yet
+	advance(p, 4*time.Hour)
+	renewal(t, p, renewing, ipRenewing)
+	if n := sweepIdle(t, p); n != 0 || len(lp.probed) != 0 {
+		t.Errorf("%d reclaimed, %v probed before the idle time", n, lp.probed)
+	}
+
+	// the client answering keeps its lease, the silent one does not
+	advance(p, 4*time.Hour)
+	if n := sweepIdle(t, p); n != 1 || len(lp.probed) != 2 {
+		t.Errorf("%d reclaimed, %v probed, want 1 and 2", n, lp.probed)
+	}
+	now := p.clock.Now()
+	if rec, err := p.storage.GetRecord(gone); err != nil || !rec.Expires.Equal(now.Add(idleGrace)) {
+		t.Errorf("record of the silent client %+v: %v, want it ending at %s", rec, err, now.Add(idleGrace))
+	}
+	if rec, err := p.storage.GetRecord(alive); err != nil || !rec.Expires.After(now.Add(time.Hour)) {
+		t.Errorf("record of the client answering %+v: %v", rec, err)
+	}
+	// it is only shortened, the address stays leased until it expires
+	if holder := p.leases.macOf(ipGone); holder != gone {
+		t.Errorf("%s leased to %q once reclaimed", ipGone, holder)
+	}
+	eventually(t, "the idle event", func() bool { return len(events.of(EventIdle)) == 1 })
+	if ev := events.of(EventIdle)[0]; ev.MAC != gone || !ev.IP.Equal(ipGone) {
+		t.Errorf("idle event %+v", ev)
+	}
+	if n := p.Stats().IdleReclaims; n != 1 {
+		t.Errorf("%d reclaims in the stats", n)
+	}
+
+	// a shortened lease is not probed again
+	lp.probed = nil
+	if n := sweepIdle(t, p); n != 0 || len(lp.probed) != 1 {
+		t.Errorf("%d reclaimed, %v probed on the next sweep", n, lp.probed)
+	}
+}
+
+func TestIdleReclaimUnprobed(t *testing.T) {
+	for _, unprobed := range []bool{false, true} {
+		m := miniredis.RunT(t)
+		args := []string{"10.0.49.10", "10.0.49.20", "12h", "idle_reclaim=7h"}
+		if unprobed {
+			args = append(args, "idle_unprobed=true")
+		}
+		p := startPlugin(t, m, args...)
+		lease(t, p, "00:11:22:33:44:0a")
+		advance(p, 8*time.Hour)
+		// without a probe, the last request alone only counts if allowed
+		want := 0
+		if unprobed {
+			want = 1
+		}
+		if n := sweepIdle(t, p); n != want {
+			t.Errorf("idle_unprobed=%t: %d reclaimed, want %d", unprobed, n, want)
+		}
+	}
+}
+
+func TestIdleProbeBudget(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.49.10", "10.0.49.20", "12h", "idle_reclaim=7h", "idle_probes=2")
+	lp := &fakeProbe{}
+	withProbe(t, lp)
+	for i := 0; i < 3; i++ {
+		lease(t, p, net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, byte(i)}.String())
+	}
+	advance(p, 8*time.Hour)
+	if n := sweepIdle(t, p); n != 2 || len(lp.probed) != 2 {
+		t.Errorf("%d reclaimed, %d probed, want 2 within the budget", n, len(lp.probed))
+	}
+	if n := sweepIdle(t, p); n != 1 || len(lp.probed) != 3 {
+		t.Errorf("%d reclaimed, %d probed by the next sweep, want the last one", n, len(lp.probed))
+	}
+}
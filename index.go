@@ -0,0 +1,158 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// REDIS_INDEX_KEY_PREFIX prefixes the reverse index entries of the default
+// namespace, mapping a leased IP address to the MAC address holding it
+const REDIS_INDEX_KEY_PREFIX = "i:dhcp:"
+
+// commitScript writes the reverse index entry, the record and its shadow key
+// in one step, refusing if the index names another MAC. A script is not
+// rolled back by redis: a write failing undoes those before it, so that
+// the index entry and the record exist together or not at all. Its keys
+// are in different hash slots, one reason redis clusters are refused, see
+// ErrClusterUnsupported.
+// KEYS: index, main, shadow. ARGV: mac, record, main TTL (ms), shadow TTL (ms)
+var commitScript = redis.NewScript(`
+local owner = redis.call('GET', KEYS[1])
+if owner and owner ~= ARGV[1] then
+	return redis.error_reply('CONFLICT ' .. owner)
+end
+local prev, ttl = redis.call('GET', KEYS[2]), redis.call('PTTL', KEYS[2])
+local function undo(reply)
+	if not owner then
+		redis.call('DEL', KEYS[1])
+	end
+	if prev and ttl > 0 then
+		redis.call('SET', KEYS[2], prev, 'PX', ttl)
+	elseif prev then
+		redis.call('SET', KEYS[2], prev)
+	else
+		redis.call('DEL', KEYS[2])
+	end
+	return reply
+end
+local reply = redis.pcall('SET', KEYS[1], ARGV[1], 'PX', ARGV[3])
+if type(reply) == 'table' and reply.err then
+	return reply
+end
+reply = redis.pcall('SET', KEYS[2], ARGV[2], 'PX', ARGV[3])
+if type(reply) == 'table' and reply.err then
+	return undo(reply)
+end
+reply = redis.pcall('SET', KEYS[3], '', 'PX', ARGV[4])
+if type(reply) == 'table' and reply.err then
+	return undo(reply)
+end
+return 1
+`)
+
+// releaseIndexScript deletes an index entry if it still names the MAC
+// KEYS: index. ARGV: mac
+var releaseIndexScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// deleteScript deletes a record, its shadow key and its index entry if it
+// still names the MAC, in one command so that none outlives the others
+// KEYS: main, shadow, index. ARGV: mac
+var deleteScript = redis.NewScript(`
+if redis.call('GET', KEYS[3]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1], KEYS[2], KEYS[3])
+end
+return redis.call('DEL', KEYS[1], KEYS[2])
+`)
+
+// CommitAllocation persists the record of a new allocation together with its
+// reverse index entry, atomically. Fails with ErrConflict if the index says
+// the address is leased to another MAC; nothing is written in that case.
+func (r *RedisProvider) CommitAllocation(mac string, record *Record) error {
+	recBytes, err := encodeRecord(record)
+	if err != nil {
+		return err
+	}
+
+	mainTTL := ttlUntil(record.Expires.Add(10 * time.Second))
+	err = commitScript.Run(context.TODO(), r.rdb,
+		[]string{r.ns.index + record.IP.String(), r.ns.main + mac, r.ns.shadow + mac},
+		mac, string(recBytes), mainTTL.Milliseconds(), ttlUntil(record.Expires).Milliseconds()).Err()
+	if err := commitError(err, record.IP); err != nil {
+		return err
+	}
+
+	if sec := r.getSecondary(); sec != nil {
+		if err := r.saveRecord(sec, mac, record); err != nil {
+			log.Warnf("could not mirror record for %s to secondary storage: %v", mac, err)
+		}
+	}
+	return nil
+}
+
+// commitError maps the error of commitScript committing ip
+func commitError(err error, ip net.IP) error {
+	if err == nil {
+		return nil
+	}
+	if owner, ok := strings.CutPrefix(err.Error(), "CONFLICT "); ok {
+		return fmt.Errorf("%w: %s is indexed to %s", ErrConflict, ip, owner)
+	}
+	return unavailable(err)
+}
+
+// refreshIndex points the index entry of the record's IP at mac and aligns
+// its TTL with the main key.
+func (r *RedisProvider) refreshIndex(mac string, record *Record) error {
+	return r.rdb.Set(context.TODO(), r.ns.index+record.IP.String(), mac,
+		ttlUntil(record.Expires.Add(10*time.Second))).Err()
+}
+
+// deleteIndexed deletes the record of mac, its shadow key and the index
+// entry of ip if held by mac
+func (r *RedisProvider) deleteIndexed(mac string, ip net.IP) error {
+	return deleteScript.Run(context.TODO(), r.rdb,
+		[]string{r.ns.main + mac, r.ns.shadow + mac, r.ns.index + ip.String()}, mac).Err()
+}
+
+// releaseIndex removes the index entry of ip if it is still held by mac
+func (r *RedisProvider) releaseIndex(mac string, ip net.IP) error {
+	return releaseIndexScript.Run(context.TODO(), r.rdb, []string{r.ns.index + ip.String()}, mac).Err()
+}
+
+// LookupByIP returns the MAC address an IP is leased to, according to the
+// reverse index. Returns ErrNotFound if the address is not leased.
+func (r *RedisProvider) LookupByIP(ip net.IP) (string, error) {
+	mac, err := r.rdb.Get(context.TODO(), r.ns.index+ip.String()).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", fmt.Errorf("%w: %s", ErrNotFound, ip)
+		}
+		return "", unavailable(err)
+	}
+	return mac, nil
+}
+
+// RebuildIndex writes the index entries of all records, replacing whatever
+// they held. Used at startup, once the records have been audited.
+func (r *RedisProvider) RebuildIndex(records map[string]Record) error {
+	_, err := r.rdb.Pipelined(context.TODO(), func(pipe redis.Pipeliner) error {
+		for mac, rec := range records {
+			pipe.Set(context.TODO(), r.ns.index+rec.IP.String(), mac, ttlUntil(rec.Expires.Add(10*time.Second)))
+		}
+		return nil
+	})
+	if err != nil {
+		return unavailable(err)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package rangeredisplugin
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// failWrites makes m fail the SET of the keys with prefix and the DEL of
+// any, also when called from a script, until the returned function is
+// called
+func failWrites(m *miniredis.Miniredis, prefix string) func() {
+	m.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		keys := args
+		switch {
+		case cmd == "SET" && len(args) > 0:
+			keys = args[:1]
+		case cmd != "DEL":
+			return false
+		}
+		for _, key := range keys {
+			if strings.HasPrefix(key, prefix) {
+				c.WriteError("ERR injected failure")
+				return true
+			}
+		}
+		return false
+	})
+	return func() { m.Server().SetPreHook(nil) }
+}
+
+// keyPrefix returns the prefix of the index, main or shadow keys of p
+func keyPrefix(p *PluginState, key string) string {
+	return map[string]string{"index": p.storage.ns.index, "main": p.storage.ns.main, "shadow": p.storage.ns.shadow}[key]
+}
+
+// assertIndexed checks that an index entry exists for every record of p
+// and names its MAC, and that every index entry has its record
+func assertIndexed(t *testing.T, m *miniredis.Miniredis, p *PluginState) {
+	t.Helper()
+	ns := p.storage.ns
+	records := make(map[string]string)
+	for _, key := range m.Keys() {
+		if !strings.HasPrefix(key, ns.main) {
+			continue
+		}
+		var rec Record
+		val, _ := m.Get(key)
+		if err := json.Unmarshal([]byte(val), &rec); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		mac := key[len(ns.main):]
+		records[rec.IP.String()] = mac
+		if owner, err := m.Get(ns.index + rec.IP.String()); err != nil || owner != mac {
+			t.Errorf("record of %s for %s indexed to %q", mac, rec.IP, owner)
+		}
+	}
+	for _, key := range m.Keys() {
+		if ip, ok := strings.CutPrefix(key, ns.index); ok && records[ip] == "" {
+			owner, _ := m.Get(key)
+			t.Errorf("index entry of %s for %s without a record", ip, owner)
+		}
+	}
+}
+
+func TestCommitWriteFailures(t *testing.T) {
+	for _, key := range []string{"index", "main", "shadow"} {
+		t.Run(key, func(t *testing.T) {
+			m := miniredis.RunT(t)
+			p := startPlugin(t, m, "10.5.0.10", "10.5.0.20", "1h")
+			const mac = "00:11:22:33:44:55"
+			prefix := keyPrefix(p, key)
+
+			restore := failWrites(m, prefix)
+			if offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac)); offer != nil {
+				t.Errorf("offer of %s with the %s write failing", offer.YourIPAddr, key)
+			}
+			restore()
+			assertIndexed(t, m, p)
+			if ip := p.leases.ipOf(mac); ip != nil {
+				t.Errorf("%s held by %s after a failed commit", ip, mac)
+			}
+
+			// the allocation was rolled back
+			if ip := lease(t, p, mac); !ip.Equal(net.IPv4(10, 5, 0, 10)) {
+				t.Errorf("leased %s after the failure, want 10.5.0.10", ip)
+			}
+			assertIndexed(t, m, p)
+		})
+	}
+}
+
+func TestRenewalWriteFailures(t *testing.T) {
+	for _, key := range []string{"index", "main", "shadow"} {
+		t.Run(key, func(t *testing.T) {
+			m := miniredis.RunT(t)
+			p := startPlugin(t, m, "10.5.0.10", "10.5.0.20", "1h")
+			const mac = "00:11:22:33:44:55"
+			ip := lease(t, p, mac)
+			prefix := keyPrefix(p, key)
+
+			// a renewal not persisted is answered all the same, the record
+			// keeping its expiry
+			restore := failWrites(m, prefix)
+			ack := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithClientIP(ip)))
+			restore()
+			if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck {
+				t.Errorf("renewal with the %s write failing answered %v, want an ACK", key, ack)
+			}
+			assertIndexed(t, m, p)
+		})
+	}
+}
+
+func TestReleaseWriteFailures(t *testing.T) {
+	for _, key := range []string{"index", "main"} {
+		t.Run(key, func(t *testing.T) {
+			m := miniredis.RunT(t)
+			p := startPlugin(t, m, "10.5.0.10", "10.5.0.20", "1h")
+			const mac = "00:11:22:33:44:55"
+			ip := lease(t, p, mac)
+			prefix := keyPrefix(p, key)
+
+			restore := failWrites(m, prefix)
+			exchange(t, p, newRequest(t, dhcpv4.MessageTypeRelease, mac, dhcpv4.WithClientIP(ip)))
+			restore()
+			assertIndexed(t, m, p)
+		})
+	}
+}
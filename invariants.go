@@ -0,0 +1,162 @@
+package rangeredisplugin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sort"
+	"sync"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+// Policies applied when the invariant checker finds a divergence
+const (
+	// InvariantsLog logs the divergence with the state of the model
+	InvariantsLog = "log"
+	// InvariantsPanic panics, for tests and simulations
+	InvariantsPanic = "panic"
+)
+
+// refModel is an independent model of the allocator and of the bindings,
+// updated along with them by the invariant checker. Every mutation is
+// checked against it. It is only set up when the checker is enabled, the
+// hooks cost a nil check otherwise.
+type refModel struct {
+	mu        sync.Mutex
+	allocated map[string]bool
+	// owners maps the bound addresses to their MAC, holds the reverse
+	owners  map[string]string
+	holds   map[string]string
+	inRange func(net.IP) bool
+	policy  string
+}
+
+func newRefModel(policy string, inRange func(net.IP) bool) *refModel {
+	return &refModel{
+		allocated: make(map[string]bool),
+		owners:    make(map[string]string),
+		holds:     make(map[string]string),
+		inRange:   inRange,
+		policy:    policy,
+	}
+}
+
+// fail reports a divergence, with the model state of ip. Called with the
+// lock held.
+func (m *refModel) fail(ip string, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	detail := fmt.Sprintf("invariant violated: %s (model: %s allocated=%t bound to %q, %d allocated, %d bound)",
+		msg, ip, m.allocated[ip], m.owners[ip], len(m.allocated), len(m.owners))
+	if m.policy == InvariantsPanic {
+		panic(detail)
+	}
+	log.Errorf("%s\n%s", detail, debug.Stack())
+}
+
+// allocate records the outcome of an allocation
+func (m *refModel) allocate(n net.IPNet, err error) {
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ip := n.IP.String()
+	if m.allocated[ip] {
+		m.fail(ip, "allocator handed out %s, which is allocated", ip)
+	}
+	m.allocated[ip] = true
+}
+
+// free records the outcome of a free
+func (m *refModel) free(n net.IPNet, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ip := n.IP.String()
+	var double *allocators.ErrDoubleFree
+	switch {
+	case err == nil && !m.allocated[ip]:
+		m.fail(ip, "allocator freed %s, which is not allocated", ip)
+	case errors.As(err, &double) && m.allocated[ip]:
+		m.fail(ip, "allocator refused to free %s as a double free, but it is allocated", ip)
+	}
+	if err == nil {
+		delete(m.allocated, ip)
+	}
+}
+
+// bind records that mac holds ip
+func (m *refModel) bind(mac string, ip net.IP) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := ip.String()
+	if owner, ok := m.owners[key]; ok && owner != mac {
+		m.fail(key, "%s bound to %s while bound to %s", key, mac, owner)
+	}
+	if m.inRange(ip) && !m.allocated[key] {
+		m.fail(key, "%s bound to %s without being allocated", key, mac)
+	}
+	if old, ok := m.holds[mac]; ok && m.owners[old] == mac {
+		delete(m.owners, old)
+	}
+	m.holds[mac] = key
+	m.owners[key] = mac
+}
+
+// unbind records that mac no longer holds ip
+func (m *refModel) unbind(mac string, ip net.IP) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := ip.String()
+	if m.holds[mac] != key {
+		return
+	}
+	delete(m.holds, mac)
+	if m.owners[key] == mac {
+		delete(m.owners, key)
+	}
+}
+
+// diff compares the model with the stored records: every record in the
+// range needs exactly one allocated binding, and every binding a record
+func (m *refModel) diff(records map[string]Record) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var diffs []string
+	for mac, rec := range records {
+		ip := rec.IP.String()
+		if m.holds[mac] != ip {
+			diffs = append(diffs, fmt.Sprintf("model: %s holds %s in redis but %q in the model", mac, ip, m.holds[mac]))
+		}
+		if m.inRange(rec.IP) && !m.allocated[ip] {
+			diffs = append(diffs, fmt.Sprintf("model: %s is leased to %s in redis but not allocated", ip, mac))
+		}
+	}
+	for mac, ip := range m.holds {
+		if _, ok := records[mac]; !ok {
+			diffs = append(diffs, fmt.Sprintf("model: %s holds %s without a record", mac, ip))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+// checkedAllocator reports every mutation of an allocator to the model
+type checkedAllocator struct {
+	inner allocators.Allocator
+	model *refModel
+}
+
+func (a *checkedAllocator) Allocate(hint net.IPNet) (net.IPNet, error) {
+	n, err := a.inner.Allocate(hint)
+	a.model.allocate(n, err)
+	return n, err
+}
+
+func (a *checkedAllocator) Free(n net.IPNet) error {
+	err := a.inner.Free(n)
+	a.model.free(n, err)
+	return err
+}
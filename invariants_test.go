@@ -0,0 +1,143 @@
+package rangeredisplugin
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+func TestRefModel(t *testing.T) {
+	inRange := func(ip net.IP) bool { return ip[len(ip)-1] < 100 }
+	ip := func(last byte) net.IP { return net.IPv4(10, 0, 32, last).To4() }
+	n := func(last byte) net.IPNet { return net.IPNet{IP: ip(last)} }
+	for _, tc := range []struct {
+		name string
+		ops  func(m *refModel)
+		want string
+	}{
+		{"consistent", func(m *refModel) {
+			m.allocate(n(10), nil)
+			m.bind("a", ip(10))
+			m.unbind("a", ip(10))
+			m.free(n(10), nil)
+			// outside of the range, without allocation
+			m.bind("b", ip(200))
+		}, ""},
+		{"allocated twice", func(m *refModel) {
+			m.allocate(n(10), nil)
+			m.allocate(n(10), nil)
+		}, "which is allocated"},
+		{"freed unallocated", func(m *refModel) {
+			m.free(n(10), nil)
+		}, "which is not allocated"},
+		{"double free of an allocated address", func(m *refModel) {
+			m.allocate(n(10), nil)
+			m.free(n(10), &allocators.ErrDoubleFree{Loc: n(10)})
+		}, "as a double free"},
+		{"bound twice", func(m *refModel) {
+			m.allocate(n(10), nil)
+			m.bind("a", ip(10))
+			m.bind("b", ip(10))
+		}, "while bound to a"},
+		{"bound unallocated", func(m *refModel) {
+			m.bind("a", ip(10))
+		}, "without being allocated"},
+		{"rebound after a move", func(m *refModel) {
+			m.allocate(n(10), nil)
+			m.allocate(n(11), nil)
+			m.bind("a", ip(10))
+			m.bind("a", ip(11))
+			m.bind("b", ip(10))
+		}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func() {
+				got, _ := recover().(string)
+				if tc.want == "" && got != "" || !strings.Contains(got, tc.want) {
+					t.Errorf("panic %q, want %q", got, tc.want)
+				}
+			}()
+			tc.ops(newRefModel(InvariantsPanic, inRange))
+		})
+	}
+}
+
+func TestRefModelDiff(t *testing.T) {
+	m := newRefModel(InvariantsPanic, func(net.IP) bool { return true })
+	a, b := net.IPv4(10, 0, 32, 10).To4(), net.IPv4(10, 0, 32, 11).To4()
+	m.allocate(net.IPNet{IP: a}, nil)
+	m.bind("00:11:22:33:44:0a", a)
+	records := map[string]Record{
+		"00:11:22:33:44:0a": {IP: a},
+		"00:11:22:33:44:0b": {IP: b},
+	}
+	diffs := m.diff(records)
+	if len(diffs) != 2 || !strings.Contains(diffs[0], "holds 10.0.32.11 in redis") || !strings.Contains(diffs[1], "10.0.32.11 is leased") {
+		t.Errorf("diff %q", diffs)
+	}
+	delete(records, "00:11:22:33:44:0b")
+	delete(records, "00:11:22:33:44:0a")
+	if diffs := m.diff(records); len(diffs) != 1 || !strings.Contains(diffs[0], "without a record") {
+		t.Errorf("diff %q", diffs)
+	}
+}
+
+func TestInvariantCheckerDisabled(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.32.10", "10.0.32.20", "1h")
+	if _, wrapped := p.allocator.(*checkedAllocator); wrapped || p.model != nil || p.leases.model != nil {
+		t.Error("invariant checker set up while disabled")
+	}
+}
+
+func TestInvariantChecker(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.32.10", "10.0.32.20", "1h", "check_invariants=panic")
+	if _, wrapped := p.allocator.(*checkedAllocator); !wrapped {
+		t.Fatal("allocator not checked")
+	}
+
+	// grants, renewals, releases and expiries, until the pool is exhausted
+	for round := 0; round < 5; round++ {
+		ips := make(map[string]net.IP)
+		for i := 0; i < 11; i++ {
+			mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, byte(round), byte(i)}.String()
+			ips[mac] = lease(t, p, mac)
+		}
+		i := 0
+		for mac, ip := range ips {
+			switch i % 3 {
+			case 0:
+				renewal(t, p, mac, ip)
+				expire(t, m, p, mac)
+			case 1:
+				releaseLease(t, p, mac, ip)
+			default:
+				expire(t, m, p, mac)
+			}
+			i++
+		}
+		eventually(t, "the expiries", func() bool { return p.leases.len() == 0 })
+		// the records expire soon after the shadow keys
+		for _, key := range m.Keys() {
+			if strings.HasPrefix(key, keyPrefix(p, "main")) || strings.HasPrefix(key, keyPrefix(p, "index")) {
+				m.Del(key)
+			}
+		}
+	}
+
+	const mac = "00:11:22:33:44:0a"
+	lease(t, p, mac)
+	report, err := p.CheckInvariants()
+	if err != nil || len(report.Violations) != 0 {
+		t.Fatalf("violations after the rounds: %v, %v", report, err)
+	}
+	// a record lost behind the back of the plugin
+	m.Del(keyPrefix(p, "main") + mac)
+	if report, err = p.CheckInvariants(); err != nil || !strings.Contains(strings.Join(report.Violations, "\n"), "model: "+mac+" holds") {
+		t.Errorf("violations after a record was lost: %v, %v", report, err)
+	}
+}
@@ -0,0 +1,419 @@
+package rangeredisplugin
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Precedences of an import over the records already in redis
+const (
+	// ImportRedisWins keeps the record in redis, skipping the binding
+	ImportRedisWins = "redis"
+	// ImportWins ends the conflicting leases in redis for the binding
+	ImportWins = "import"
+)
+
+// ISCLease is a lease block of an ISC dhcpd leases file
+type ISCLease struct {
+	IP     net.IP
+	Starts time.Time
+	// Ends is zero for a lease that never ends
+	Ends time.Time
+	// MAC is the hardware ethernet address, "" for other hardware types
+	MAC      string
+	Hostname string
+	// State is the binding state, "abandoned" for leases marked as such,
+	// or "" if the file predates binding states
+	State string
+}
+
+// ParseISCLeases parses an ISC dhcpd leases file. dhcpd appends a lease
+// block on every change, so an address may have several: the last one is
+// the current binding. Declarations other than IPv4 leases are skipped.
+func ParseISCLeases(r io.Reader) ([]ISCLease, error) {
+	toks, err := iscTokens(r)
+	if err != nil {
+		return nil, err
+	}
+	var leases []ISCLease
+	for i := 0; i < len(toks); {
+		if toks[i] != "lease" || i+2 >= len(toks) || toks[i+2] != "{" {
+			i = skipISCStatement(toks, i)
+			continue
+		}
+		ip := net.ParseIP(toks[i+1]).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid lease address %q", toks[i+1])
+		}
+		l := ISCLease{IP: ip}
+		i += 3
+		for i < len(toks) && toks[i] != "}" {
+			end := i
+			for end < len(toks) && toks[end] != ";" && toks[end] != "{" && toks[end] != "}" {
+				end++
+			}
+			if end < len(toks) && toks[end] == "{" {
+				// e.g. an `on commit` block
+				i = skipISCStatement(toks, i)
+				continue
+			}
+			if err := l.set(toks[i:end]); err != nil {
+				return nil, fmt.Errorf("lease %s: %v", ip, err)
+			}
+			i = end
+			if i < len(toks) && toks[i] == ";" {
+				i++
+			}
+		}
+		if i >= len(toks) {
+			return nil, fmt.Errorf("lease %s: unterminated block", ip)
+		}
+		i++
+		leases = append(leases, l)
+	}
+	return leases, nil
+}
+
+// set applies a statement of a lease block
+func (l *ISCLease) set(st []string) error {
+	if len(st) == 0 {
+		return nil
+	}
+	var err error
+	switch st[0] {
+	case "starts":
+		l.Starts, err = parseISCTime(st[1:])
+	case "ends":
+		l.Ends, err = parseISCTime(st[1:])
+	case "hardware":
+		if len(st) != 3 {
+			return fmt.Errorf("invalid hardware statement %q", strings.Join(st, " "))
+		}
+		l.MAC = ""
+		if st[1] == "ethernet" {
+			mac, err := net.ParseMAC(st[2])
+			if err != nil || len(mac) != 6 {
+				return fmt.Errorf("invalid hardware ethernet address %q", st[2])
+			}
+			l.MAC = mac.String()
+		}
+	case "client-hostname":
+		if len(st) == 2 {
+			l.Hostname = st[1]
+		}
+	case "binding":
+		if len(st) == 3 && st[1] == "state" {
+			l.State = st[2]
+		}
+	case "abandoned":
+		// written by versions before binding states
+		l.State = "abandoned"
+	}
+	return err
+}
+
+// parseISCTime parses the time of a starts or ends statement: either
+// `<weekday> <yyyy/mm/dd> <hh:mm:ss>` in UTC, `epoch <seconds>` or `never`
+func parseISCTime(f []string) (time.Time, error) {
+	switch {
+	case len(f) == 1 && f[0] == "never":
+		return time.Time{}, nil
+	case len(f) == 2 && f[0] == "epoch":
+		s, err := strconv.ParseInt(f[1], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid epoch time %q", f[1])
+		}
+		return time.Unix(s, 0).UTC(), nil
+	case len(f) == 3:
+		t, err := time.Parse("2006/01/02 15:04:05", f[1]+" "+f[2])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time %q", strings.Join(f, " "))
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", strings.Join(f, " "))
+}
+
+// iscTokens splits a leases file into words, quoted strings, braces and
+// semicolons, dropping the comments
+func iscTokens(r io.Reader) ([]string, error) {
+	var toks []string
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		for i := 0; i < len(line); {
+			c := line[i]
+			switch {
+			case c == '#':
+				i = len(line)
+			case unicode.IsSpace(rune(c)):
+				i++
+			case c == '{' || c == '}' || c == ';':
+				toks = append(toks, string(c))
+				i++
+			case c == '"':
+				end := i + 1
+				for end < len(line) && line[end] != '"' {
+					if line[end] == '\\' {
+						end++
+					}
+					end++
+				}
+				if end >= len(line) {
+					return nil, fmt.Errorf("unterminated string in %q", line)
+				}
+				s, err := strconv.Unquote(line[i : end+1])
+				if err != nil {
+					s = line[i+1 : end]
+				}
+				toks = append(toks, s)
+				i = end + 1
+			default:
+				end := i
+				for end < len(line) && !strings.ContainsRune("{};\"# \t\r", rune(line[end])) {
+					end++
+				}
+				toks = append(toks, line[i:end])
+				i = end
+			}
+		}
+	}
+	return toks, sc.Err()
+}
+
+// skipISCStatement returns the index of the token following the statement
+// or block starting at i
+func skipISCStatement(toks []string, i int) int {
+	depth := 0
+	for ; i < len(toks); i++ {
+		switch toks[i] {
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth <= 0 {
+				return i + 1
+			}
+		case ";":
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return i
+}
+
+// ISCImportReport sums up the bindings of a leases file and what an import
+// does, or would do, with them
+type ISCImportReport struct {
+	File string
+	// Blocks is the number of lease blocks, Bindings the number of
+	// addresses they are about: the last block of each is its binding
+	Blocks   int
+	Bindings int
+	// Active bindings are granted and not yet ended, Expired ones ended
+	// or were freed or released, Abandoned ones were found in use by
+	// dhcpd. Superseded counts the active bindings of a MAC holding a more
+	// recent one.
+	Active     int
+	Expired    int
+	Abandoned  int
+	Superseded int
+	// Unsupported counts the active bindings of another hardware type than
+	// ethernet, OutOfRange those outside of the pool or excluded
+	Unsupported int
+	OutOfRange  int
+	// Conflicts counts the active bindings whose MAC or address holds
+	// another lease in redis, Unchanged those already in redis
+	Conflicts int
+	Unchanged int
+	// Importable bindings are written by an import, which counts them in
+	// Imported once written and in Failed otherwise
+	Importable int
+	Imported   int
+	Failed     int
+}
+
+func (r *ISCImportReport) String() string {
+	return fmt.Sprintf("%s: %d blocks, %d bindings: %d active, %d expired, %d abandoned, %d superseded; "+
+		"%d unsupported, %d out of range, %d conflicting, %d unchanged, %d importable, %d imported, %d failed",
+		r.File, r.Blocks, r.Bindings, r.Active, r.Expired, r.Abandoned, r.Superseded,
+		r.Unsupported, r.OutOfRange, r.Conflicts, r.Unchanged, r.Importable, r.Imported, r.Failed)
+}
+
+// ImportISCLeases reads the leases file of an ISC dhcpd at path and
+// reports on its bindings. If apply is set, the active bindings of the
+// pool are imported as leases ending when they end in dhcpd, so that
+// clients keep their address across the migration. The conflicts with the
+// leases in redis are settled by the import precedence. Importing the same
+// file again changes nothing.
+func (p *PluginState) ImportISCLeases(ctx context.Context, path string, apply bool) (*ISCImportReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	blocks, err := ParseISCLeases(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	rep := &ISCImportReport{File: path, Blocks: len(blocks)}
+	current := make(map[string]ISCLease)
+	var order []string
+	for _, l := range blocks {
+		key := l.IP.String()
+		if _, ok := current[key]; !ok {
+			order = append(order, key)
+		}
+		current[key] = l
+	}
+	rep.Bindings = len(order)
+
+	now := p.clock.Now()
+	latest := make(map[string]ISCLease)
+	var active []ISCLease
+	for _, key := range order {
+		l := current[key]
+		switch {
+		case l.State == "abandoned":
+			rep.Abandoned++
+			continue
+		case (l.State != "" && l.State != "active") || (!l.Ends.IsZero() && !l.Ends.After(now.Add(time.Second))):
+			rep.Expired++
+			continue
+		}
+		rep.Active++
+		if l.MAC == "" {
+			rep.Unsupported++
+			continue
+		}
+		if prev, ok := latest[l.MAC]; ok {
+			rep.Superseded++
+			if !l.Starts.After(prev.Starts) {
+				continue
+			}
+		}
+		latest[l.MAC] = l
+	}
+	for _, key := range order {
+		if l := current[key]; l.MAC != "" && latest[l.MAC].IP.Equal(l.IP) {
+			active = append(active, l)
+		}
+	}
+
+	for _, l := range active {
+		if err := ctx.Err(); err != nil {
+			return rep, err
+		}
+		if !p.inRange(l.IP) || p.cfg.excluded(l.IP) {
+			rep.OutOfRange++
+			continue
+		}
+		conflicts, unchanged, err := p.importConflicts(l)
+		if err != nil {
+			return rep, err
+		}
+		switch {
+		case unchanged:
+			rep.Unchanged++
+			continue
+		case len(conflicts) > 0:
+			rep.Conflicts++
+			if p.cfg.ImportPrecedence != ImportWins {
+				log.Infof("isc import: skipping %s for %s: %s", l.IP, l.MAC, strings.Join(conflicts, ", "))
+				continue
+			}
+		}
+		rep.Importable++
+		if !apply {
+			continue
+		}
+		if err := p.importISCLease(l, now); err != nil {
+			log.Errorf("isc import: could not import %s for %s: %v", l.IP, l.MAC, err)
+			rep.Failed++
+			continue
+		}
+		rep.Imported++
+	}
+	return rep, nil
+}
+
+// importConflicts returns the leases in redis conflicting with l: another
+// lease of its MAC, or a lease of its address to another MAC. unchanged is
+// set if l is the lease of its MAC already.
+func (p *PluginState) importConflicts(l ISCLease) ([]string, bool, error) {
+	var conflicts []string
+	rec, err := p.storage.GetRecord(l.MAC)
+	switch {
+	case err == nil && rec.IP.Equal(l.IP):
+		return nil, true, nil
+	case err == nil:
+		conflicts = append(conflicts, fmt.Sprintf("%s leases %s", l.MAC, rec.IP))
+	case !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrCorruptRecord):
+		return nil, false, err
+	}
+	owner, err := p.storage.LookupByIP(l.IP)
+	switch {
+	case err == nil && owner != l.MAC:
+		conflicts = append(conflicts, fmt.Sprintf("%s is leased to %s", l.IP, owner))
+	case err != nil && !errors.Is(err, ErrNotFound):
+		return nil, false, err
+	}
+	return conflicts, false, nil
+}
+
+// importISCLease ends the leases in the way of l and grants it
+func (p *PluginState) importISCLease(l ISCLease, now time.Time) error {
+	if rec, err := p.storage.GetRecord(l.MAC); err == nil {
+		if err := p.storage.DeleteRecord(l.MAC); err != nil {
+			return err
+		}
+		p.freeLease(l.MAC, rec.IP)
+	}
+	if owner, err := p.storage.LookupByIP(l.IP); err == nil && owner != l.MAC {
+		if err := p.storage.DeleteRecord(owner); err != nil {
+			return err
+		}
+		p.freeLease(owner, l.IP)
+	}
+
+	if err := p.claim(l.MAC, l.IP); err != nil {
+		return err
+	}
+	expires := l.Ends
+	if expires.IsZero() {
+		expires = now.Add(p.leaseTime(now, 0, 0))
+	}
+	rec := Record{
+		IP:       l.IP,
+		Expires:  expires,
+		Policy:   "isc-import",
+		Pool:     p.poolName(),
+		Hostname: sanitize(l.Hostname, p.cfg.MaxHostname),
+		Labels:   p.labelsFor(l.MAC),
+		State:    StateBound,
+	}
+	err := p.storage.CommitAllocation(l.MAC, &rec)
+	p.noteWrite(err)
+	if err != nil {
+		if err := p.allocator.Free(net.IPNet{IP: l.IP, Mask: net.IPv4Mask(255, 255, 255, 255)}); err != nil {
+			log.Errorf("Could not roll back allocation of %s: %v", l.IP, err)
+		}
+		return err
+	}
+	p.leases.set(l.MAC, l.IP)
+	p.appendHistory(l.MAC, l.IP, l.Starts)
+	p.emit(Event{Type: EventGrant, MAC: l.MAC, IP: l.IP, Detail: "isc-import", Labels: rec.Labels})
+	return nil
+}
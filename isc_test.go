@@ -0,0 +1,202 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const iscFixture = "testdata/dhcpd.leases"
+
+func TestParseISCLeases(t *testing.T) {
+	f, err := os.Open(iscFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	leases, err := ParseISCLeases(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the lease6 declaration is skipped
+	if len(leases) != 13 {
+		t.Fatalf("%d lease blocks, want 13", len(leases))
+	}
+	last := make(map[string]ISCLease)
+	blocks := make(map[string]int)
+	for _, l := range leases {
+		last[l.IP.String()] = l
+		blocks[l.IP.String()]++
+	}
+	if blocks["192.168.1.10"] != 2 || blocks["192.168.1.11"] != 2 {
+		t.Errorf("blocks per address %v, want 2 for 192.168.1.10 and 192.168.1.11", blocks)
+	}
+
+	for _, tc := range []struct {
+		ip, mac, hostname, state string
+		ends                     time.Time
+	}{
+		{"192.168.1.10", "00:11:22:33:44:55", "laptop-01", "active", time.Date(2099, 1, 1, 20, 0, 0, 0, time.UTC)},
+		{"192.168.1.11", "00:11:22:33:44:66", "", "free", time.Date(2024, 1, 3, 9, 0, 0, 0, time.UTC)},
+		{"192.168.1.12", "", "", "abandoned", time.Date(2099, 1, 1, 20, 0, 0, 0, time.UTC)},
+		{"192.168.1.13", "", "", "abandoned", time.Date(2099, 1, 1, 20, 0, 0, 0, time.UTC)},
+		{"192.168.1.14", "aa:bb:cc:dd:ee:01", "printer hall", "active", time.Unix(4070980800, 0)},
+		{"192.168.1.15", "aa:bb:cc:dd:ee:02", "café", "active", time.Time{}},
+		{"192.168.1.19", "", "", "active", time.Date(2099, 1, 1, 20, 0, 0, 0, time.UTC)},
+	} {
+		l, ok := last[tc.ip]
+		if !ok {
+			t.Errorf("no lease of %s", tc.ip)
+			continue
+		}
+		if l.MAC != tc.mac || l.Hostname != tc.hostname || l.State != tc.state || !l.Ends.Equal(tc.ends) {
+			t.Errorf("lease of %s = %+v, want MAC %q, hostname %q, state %q, ends %s",
+				tc.ip, l, tc.mac, tc.hostname, tc.state, tc.ends)
+		}
+	}
+}
+
+func TestParseISCLeasesErrors(t *testing.T) {
+	for _, in := range []string{
+		"lease 192.168.1.300 {\n}\n",
+		"lease 192.168.1.10 {\n  starts 3 2024/01/03;\n}\n",
+		"lease 192.168.1.10 {\n  hardware ethernet 00:11:22;\n}\n",
+		"lease 192.168.1.10 {\n  binding state active;\n",
+		"lease 192.168.1.10 {\n  client-hostname \"open;\n}\n",
+	} {
+		if _, err := ParseISCLeases(strings.NewReader(in)); err == nil {
+			t.Errorf("ParseISCLeases(%q) succeeded", in)
+		}
+	}
+}
+
+// startImport sets up an instance for the pool of the fixture
+func startImport(t *testing.T, m *miniredis.Miniredis, args ...string) *PluginState {
+	t.Helper()
+	return startPlugin(t, m, append([]string{"192.168.1.10", "192.168.1.100", "1h"}, args...)...)
+}
+
+func TestImportISCLeasesReport(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startImport(t, m)
+	before := m.Dump()
+
+	rep, err := p.ImportISCLeases(context.Background(), iscFixture, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ISCImportReport{
+		File: iscFixture, Blocks: 13, Bindings: 11,
+		// 192.168.1.10, .14, .15, .16, .17, .19 and 10.0.0.5
+		Active: 7,
+		// released 192.168.1.11 and ended 192.168.1.18
+		Expired: 2, Abandoned: 2, Superseded: 1,
+		Unsupported: 1, OutOfRange: 1,
+		// 192.168.1.10, .14, .15 and .17
+		Importable: 4,
+	}
+	if *rep != want {
+		t.Errorf("report %s\nwant %s", rep, &want)
+	}
+	if after := m.Dump(); after != before {
+		t.Errorf("the report changed the storage:\n%s", after)
+	}
+}
+
+func TestImportISCLeases(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startImport(t, m)
+
+	rep, err := p.ImportISCLeases(context.Background(), iscFixture, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Imported != 4 || rep.Failed != 0 {
+		t.Fatalf("import: %s", rep)
+	}
+	for _, tc := range []struct {
+		mac, ip, hostname string
+		expires           time.Time
+	}{
+		{"00:11:22:33:44:55", "192.168.1.10", "laptop-01", time.Date(2099, 1, 1, 20, 0, 0, 0, time.UTC)},
+		{"aa:bb:cc:dd:ee:01", "192.168.1.14", "printer hall", time.Unix(4070980800, 0)},
+		// a lease that never ends gets the lease time of the pool
+		{"aa:bb:cc:dd:ee:02", "192.168.1.15", "café", p.clock.Now().Add(time.Hour)},
+		// the most recent binding of the MAC
+		{"aa:bb:cc:dd:ee:03", "192.168.1.17", "", time.Date(2099, 1, 1, 20, 0, 0, 0, time.UTC)},
+	} {
+		rec, err := p.storage.GetRecord(tc.mac)
+		if err != nil {
+			t.Errorf("no record of %s: %v", tc.mac, err)
+			continue
+		}
+		if rec.IP.String() != tc.ip || rec.Hostname != tc.hostname || !rec.Expires.Equal(tc.expires) {
+			t.Errorf("record of %s = %s %q until %s, want %s %q until %s",
+				tc.mac, rec.IP, rec.Hostname, rec.Expires, tc.ip, tc.hostname, tc.expires)
+		}
+		if owner := p.leases.macOf(net.ParseIP(tc.ip)); owner != tc.mac {
+			t.Errorf("%s leased to %q in the lease table, want %s", tc.ip, owner, tc.mac)
+		}
+	}
+
+	// importing the same file again changes nothing
+	before := m.Dump()
+	rep, err = p.ImportISCLeases(context.Background(), iscFixture, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Unchanged != 4 || rep.Importable != 0 || rep.Imported != 0 {
+		t.Errorf("second import: %s", rep)
+	}
+	if after := m.Dump(); after != before {
+		t.Errorf("the second import changed the storage:\n%s\nwant\n%s", after, before)
+	}
+}
+
+func TestImportISCLeasesPrecedence(t *testing.T) {
+	const holder = "00:11:22:33:44:77"
+	for _, tc := range []struct {
+		precedence, owner string
+		importable        int
+	}{
+		{ImportRedisWins, holder, 3},
+		{ImportWins, "00:11:22:33:44:55", 4},
+	} {
+		t.Run(tc.precedence, func(t *testing.T) {
+			m := miniredis.RunT(t)
+			p := startImport(t, m, "import_precedence="+tc.precedence)
+			// the first address of the pool, also 00:11:22:33:44:55's in dhcpd
+			if ip := lease(t, p, holder); !ip.Equal(net.IPv4(192, 168, 1, 10)) {
+				t.Fatalf("%s leased %s", holder, ip)
+			}
+
+			rep, err := p.ImportISCLeases(context.Background(), iscFixture, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rep.Conflicts != 1 || rep.Importable != tc.importable || rep.Imported != tc.importable {
+				t.Errorf("import: %s", rep)
+			}
+			owner, err := p.storage.LookupByIP(net.IPv4(192, 168, 1, 10).To4())
+			if err != nil || owner != tc.owner {
+				t.Errorf("192.168.1.10 leased to %q (%v), want %s", owner, err, tc.owner)
+			}
+			if tc.owner != holder {
+				if _, err := p.storage.GetRecord(holder); err == nil {
+					t.Errorf("the lease of %s was not ended", holder)
+				}
+				// the holder moves on to another address
+				offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, holder))
+				if offer == nil || offer.YourIPAddr.Equal(net.IPv4(192, 168, 1, 10)) {
+					t.Errorf("offer %v to %s", offer, holder)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// REDIS_JOURNAL_KEY is the hash of the frees started by the GC and not
+// completed yet, keyed by MAC address, in the default namespace
+const REDIS_JOURNAL_KEY = "j:dhcp:journal"
+
+const (
+	// maximum number of pending entries, beyond which frees are not journaled
+	journalMaxEntries = 10000
+	// age beyond which a pending entry is discarded instead of replayed
+	journalMaxAge = 24 * time.Hour
+)
+
+// journalEntry is a free started by the GC
+type journalEntry struct {
+	IP   net.IP
+	Time time.Time
+}
+
+// JournalFree records that the lease of mac on ip is being freed
+func (r *RedisProvider) JournalFree(ctx context.Context, mac string, ip net.IP) error {
+	n, err := r.rdb.HLen(ctx, r.ns.journal).Result()
+	if err != nil {
+		return unavailable(err)
+	}
+	if n >= journalMaxEntries {
+		log.Warnf("GC journal is full with %d pending entries, not journaling the free of %s", n, ip)
+		return nil
+	}
+	val, err := json.Marshal(journalEntry{IP: ip, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	return unavailable(r.rdb.HSet(ctx, r.ns.journal, mac, val).Err())
+}
+
+// CompleteFree marks the free of the lease of mac as done
+func (r *RedisProvider) CompleteFree(ctx context.Context, mac string) error {
+	return unavailable(r.rdb.HDel(ctx, r.ns.journal, mac).Err())
+}
+
+// pendingFrees returns the journaled frees that were never completed
+func (r *RedisProvider) pendingFrees(ctx context.Context) (map[string]journalEntry, error) {
+	vals, err := r.rdb.HGetAll(ctx, r.ns.journal).Result()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	entries := make(map[string]journalEntry, len(vals))
+	for mac, val := range vals {
+		var e journalEntry
+		if err := json.Unmarshal([]byte(val), &e); err != nil || e.IP == nil {
+			log.Warnf("discarding invalid GC journal entry for %s", mac)
+			entries[mac] = journalEntry{}
+			continue
+		}
+		entries[mac] = e
+	}
+	return entries, nil
+}
+
+// replayJournal completes the frees interrupted by a crash, once the stored
+// leases are loaded into records. The leases freed are removed from records.
+// Replaying a free that was completed is a no-op.
+func (p *PluginState) replayJournal(ctx context.Context, records map[string]Record) error {
+	entries, err := p.storage.pendingFrees(ctx)
+	if err != nil {
+		return err
+	}
+	for mac, e := range entries {
+		switch {
+		case e.IP == nil:
+		case time.Since(e.Time) > journalMaxAge:
+			log.Warnf("discarding stale GC journal entry of %s for %s", e.IP, mac)
+		default:
+			if p.replayFree(mac, e.IP) {
+				delete(records, mac)
+			}
+		}
+		if err := p.storage.CompleteFree(ctx, mac); err != nil {
+			return err
+		}
+	}
+	if len(entries) > 0 {
+		log.Infof("replayed %d interrupted frees from the GC journal", len(entries))
+	}
+	return nil
+}
+
+// replayFree completes an interrupted free of the lease of mac on ip,
+// unless the lease was renewed in the meantime. Returns false if the lease
+// is kept.
+func (p *PluginState) replayFree(mac string, ip net.IP) bool {
+	if rec, err := p.storage.GetRecord(mac); err == nil && !p.endsBy(rec.Expires, p.clock.Now()) {
+		return false
+	}
+	if err := p.storage.DeleteRecord(mac); err != nil {
+		log.Warnf("could not delete expired record of %s: %v", mac, err)
+	}
+	if p.leases.macOf(ip) != mac {
+		// not reloaded, so not allocated either
+		return true
+	}
+	p.freeLease(mac, ip)
+	return true
+}
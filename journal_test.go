@@ -0,0 +1,130 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+)
+
+// crashAfterJournal makes m fail every command once the free of a lease was
+// journaled, as if the process died right after, until the returned
+// function is called
+func crashAfterJournal(m *miniredis.Miniredis, p *PluginState) func() {
+	var crashed atomic.Bool
+	m.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if crashed.Load() {
+			c.WriteError("ERR injected crash")
+			return true
+		}
+		if cmd == "HSET" && len(args) > 0 && args[0] == p.storage.ns.journal {
+			crashed.Store(true)
+		}
+		return false
+	})
+	return func() { m.Server().SetPreHook(nil) }
+}
+
+// endLease rewrites the record of mac on ip to end now, as if its lease ran
+// out
+func endLease(t *testing.T, p *PluginState, mac string, ip net.IP) {
+	t.Helper()
+	if err := p.storage.SaveRecord(mac, &Record{IP: ip, Expires: p.clock.Now(), State: StateBound}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	m := miniredis.RunT(t)
+	a := startPlugin(t, m, "10.0.14.10", "10.0.14.20", "1h")
+	const mac = "00:11:22:33:44:55"
+	ip := lease(t, a, mac)
+	endLease(t, a, mac, ip)
+
+	// the process dies between the journal and the free
+	recovered := crashAfterJournal(m, a)
+	m.Del(a.storage.ns.shadow + mac)
+	a.handleExpired(a.storage.ns.shadow + mac)
+	recovered()
+	if !m.Exists(a.storage.ns.journal) {
+		t.Fatal("free not journaled")
+	}
+	if !m.Exists(a.storage.ns.main + mac) {
+		t.Fatal("record deleted before the crash")
+	}
+	if err := a.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next instance completes the free
+	b := startPlugin(t, m, "10.0.14.10", "10.0.14.20", "1h")
+	if m.Exists(b.storage.ns.journal) {
+		t.Error("journal entry left after the replay")
+	}
+	if _, err := b.storage.GetRecord(mac); err == nil {
+		t.Error("record of the freed lease left after the replay")
+	}
+	if holder := b.leases.macOf(ip); holder != "" {
+		t.Errorf("%s still held by %s after the replay", ip, holder)
+	}
+	assertIndexed(t, m, b)
+	if got := lease(t, b, "00:11:22:33:44:66"); !got.Equal(ip) {
+		t.Errorf("new client leased %s, want the freed %s", got, ip)
+	}
+}
+
+func TestJournalReplayRenewed(t *testing.T) {
+	m := miniredis.RunT(t)
+	a := startPlugin(t, m, "10.0.14.10", "10.0.14.20", "1h")
+	const mac = "00:11:22:33:44:55"
+	ip := lease(t, a, mac)
+	if err := a.storage.JournalFree(context.Background(), mac, ip); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lease was renewed after the free was journaled, and is kept
+	b := startPlugin(t, m, "10.0.14.10", "10.0.14.20", "1h")
+	if m.Exists(b.storage.ns.journal) {
+		t.Error("journal entry left after the replay")
+	}
+	if holder := b.leases.macOf(ip); holder != mac {
+		t.Errorf("%s held by %q after the replay, want %s", ip, holder, mac)
+	}
+	if rec, err := b.storage.GetRecord(mac); err != nil || !rec.IP.Equal(ip) {
+		t.Errorf("record after the replay: %v, %v", rec, err)
+	}
+}
+
+func TestJournalReplayStale(t *testing.T) {
+	m := miniredis.RunT(t)
+	a := startPlugin(t, m, "10.0.14.10", "10.0.14.20", "1h")
+	const mac = "00:11:22:33:44:55"
+	ip := lease(t, a, mac)
+	endLease(t, a, mac, ip)
+	val, err := json.Marshal(journalEntry{IP: ip, Time: time.Now().Add(-journalMaxAge - time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.HSet(a.storage.ns.journal, mac, string(val))
+	m.HSet(a.storage.ns.journal, "00:11:22:33:44:66", "garbage")
+	if err := a.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// invalid and stale entries are discarded, not replayed
+	b := startPlugin(t, m, "10.0.14.10", "10.0.14.20", "1h")
+	if m.Exists(b.storage.ns.journal) {
+		t.Error("journal entries left after the replay")
+	}
+	if _, err := b.storage.GetRecord(mac); err != nil {
+		t.Errorf("record of a stale entry deleted: %v", err)
+	}
+}
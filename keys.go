@@ -0,0 +1,105 @@
+package rangeredisplugin
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// legacyKeys generate the keys a client may have been recorded under by
+// earlier versions, most recent format first. A change of clientKey adds
+// the previous format here, so that existing leases survive the upgrade.
+var legacyKeys = []func(req *dhcpv4.DHCPv4) string{
+	// before the hardware type prefix, every address was keyed in its
+	// colon notation
+	func(req *dhcpv4.DHCPv4) string {
+		if req.HWType == iana.HWTypeEthernet || len(req.ClientHWAddr) == 0 {
+			return ""
+		}
+		return req.ClientHWAddr.String()
+	},
+}
+
+// keyCandidates returns the keys the record of the client of req keyed key
+// is looked up under: key first, then the legacy keys of the client
+func keyCandidates(req *dhcpv4.DHCPv4, key string) []string {
+	keys := []string{key}
+	seen := map[string]bool{key: true}
+	for _, legacy := range legacyKeys {
+		if k := legacy(req); k != "" && !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// ResolveRecord returns the record stored under the first of keys holding
+// one, and that key. A record found under another key than keys[0] is
+// rewritten under keys[0] and its old key deleted, so that it is only ever
+// found under the current key from then on. Returns ErrNotFound if no key
+// holds a record.
+func (r *RedisProvider) ResolveRecord(keys []string) (*Record, string, error) {
+	for i, key := range keys {
+		record, err := r.GetRecord(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil || i == 0 {
+			return record, key, err
+		}
+		if err := r.migrateRecord(key, keys[0], record); err != nil {
+			log.Warnf("could not move the record of %s from %s: %v", keys[0], key, err)
+		}
+		return record, key, nil
+	}
+	return nil, "", fmt.Errorf("%w: %s", ErrNotFound, keys[0])
+}
+
+// migrateRecord moves record from the key from to the key to
+func (r *RedisProvider) migrateRecord(from, to string, record *Record) error {
+	if err := r.SaveRecord(to, record); err != nil {
+		return err
+	}
+	// the index entry now names the new key, which DeleteRecord would drop
+	if err := r.deleteRecord(r.rdb, from); err != nil {
+		return unavailable(err)
+	}
+	if sec := r.getSecondary(); sec != nil {
+		if err := r.deleteRecord(sec, from); err != nil {
+			log.Warnf("could not mirror deletion of %s to secondary storage: %v", from, err)
+		}
+	}
+	log.Infof("record of %s moved from its legacy key %s", to, from)
+	return nil
+}
+
+// lookupRecord returns the record of the client of req keyed mac, found
+// under its current key or one of its legacy keys. The lease of a record
+// found under a legacy key moves to mac in memory too.
+func (p *PluginState) lookupRecord(req *dhcpv4.DHCPv4, mac string) (*Record, error) {
+	record, key, err := p.storage.ResolveRecord(keyCandidates(req, mac))
+	if err != nil || key == mac {
+		return record, err
+	}
+	p.counters.migratedKeys.Add(1)
+	if p.leases.macOf(record.IP) == key {
+		p.leases.remove(key, record.IP)
+		p.leases.set(mac, record.IP)
+	}
+	return record, nil
+}
+
+// peekRecord is lookupRecord without side effects, for the evaluations
+func (p *PluginState) peekRecord(req *dhcpv4.DHCPv4, mac string) (*Record, error) {
+	var err error
+	for _, key := range keyCandidates(req, mac) {
+		var record *Record
+		if record, err = p.storage.GetRecord(key); !errors.Is(err, ErrNotFound) {
+			return record, err
+		}
+	}
+	return nil, err
+}
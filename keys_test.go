@@ -0,0 +1,78 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestKeyCandidates(t *testing.T) {
+	ethernet := []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x0a}
+	eui64 := []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77}
+	clientID := dhcpv4.WithOption(dhcpv4.OptClientIdentifier([]byte{0xff, 1, 2, 3, 4}))
+	for _, tc := range []struct {
+		name string
+		req  *dhcpv4.DHCPv4
+		want string
+	}{
+		{"ethernet", packet(t, iana.HWTypeEthernet, ethernet), "[00:11:22:33:44:0a]"},
+		// the colon notation of the address, before the hardware type
+		{"eui-64", packet(t, iana.HWTypeEUI64, eui64), "[27-0011223344556677 00:11:22:33:44:55:66:77]"},
+		{"infiniband", packet(t, iana.HWTypeInfiniband, nil, clientID), "[32-id-ff01020304]"},
+	} {
+		p := &PluginState{}
+		key, err := p.clientKey(tc.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(keyCandidates(tc.req, key)); got != tc.want {
+			t.Errorf("%s: candidates %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLegacyKeyMigration(t *testing.T) {
+	m := miniredis.RunT(t)
+	args := []string{"10.0.48.10", "10.0.48.20", "1h"}
+	p := startPlugin(t, m, args...)
+	req := packet(t, iana.HWTypeEUI64, []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77})
+	const key, legacy = "27-0011223344556677", "00:11:22:33:44:55:66:77"
+	ip := net.IPv4(10, 0, 48, 15).To4()
+
+	// the lease of an earlier version, loaded at startup
+	rec := Record{IP: ip, Expires: time.Now().Add(time.Hour)}
+	if err := p.storage.CommitAllocation(legacy, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p = startPlugin(t, m, args...)
+
+	offer := exchange(t, p, req)
+	if offer == nil || !offer.YourIPAddr.Equal(ip) {
+		t.Fatalf("client of a legacy key offered %v, want %s", offer, ip)
+	}
+	if m.Exists(keyPrefix(p, "main")+legacy) || m.Exists(keyPrefix(p, "shadow")+legacy) {
+		t.Error("legacy key left")
+	}
+	if got, err := p.storage.GetRecord(key); err != nil || !got.IP.Equal(ip) {
+		t.Errorf("record under the current key %v: %v", got, err)
+	}
+	if holder := p.leases.macOf(ip); holder != key {
+		t.Errorf("%s leased to %q in memory", ip, holder)
+	}
+	assertIndexed(t, m, p)
+
+	// found under the current key from then on
+	exchange(t, p, req)
+	if n := p.Stats().MigratedKeys; n != 1 {
+		t.Errorf("%d keys migrated, want 1", n)
+	}
+}
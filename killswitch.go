@@ -0,0 +1,193 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// REDIS_KILL_KEY is set to stop every instance of the default namespace
+// from answering, and REDIS_KILL_KEY:<start>-<end> to stop the instances of
+// one pool. Any value turns the switch on; a value that is not a stored
+// KillSwitch names who set it, e.g. `SET x:dhcp:kill "alice: upstream
+// conflict"`.
+const REDIS_KILL_KEY = "x:dhcp:kill"
+
+// KillGlobal is the scope of the kill switch of all the pools
+const KillGlobal = "global"
+
+// interval between two reads of the kill switch keys, which catches the
+// switches set in redis directly rather than through the control channel
+const killSwitchPollInterval = 5 * time.Second
+
+// KillSwitch is an active kill switch: the instances in its scope pass
+// every DHCPv4 packet on untouched
+type KillSwitch struct {
+	// Scope is KillGlobal or the pool of the switch, <start>-<end>
+	Scope string
+	// By names who or what turned the switch on, if known
+	By    string `json:",omitempty"`
+	Since time.Time
+}
+
+func (k *KillSwitch) String() string {
+	s := "kill switch " + k.Scope
+	if k.By != "" {
+		s += " (by " + k.By + ")"
+	}
+	return s
+}
+
+// killKey returns the key of the kill switch of scope
+func (ns keySpace) killKey(scope string) string {
+	if scope == KillGlobal {
+		return ns.kill
+	}
+	return ns.kill + ":" + scope
+}
+
+// killSwitch holds the switches applying to a plugin instance
+type killSwitch struct {
+	mu     sync.Mutex
+	global *KillSwitch
+	pool   *KillSwitch
+}
+
+// active returns the switch in effect, the global one first, or nil
+func (k *killSwitch) active() *KillSwitch {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.global != nil {
+		return k.global
+	}
+	return k.pool
+}
+
+// SetKillSwitch turns the kill switch of a scope on
+func (r *RedisProvider) SetKillSwitch(ctx context.Context, ks *KillSwitch) error {
+	return r.saveCheckpoint(ctx, r.ns.killKey(ks.Scope), ks)
+}
+
+// ClearKillSwitch turns the kill switch of a scope off
+func (r *RedisProvider) ClearKillSwitch(ctx context.Context, scope string) error {
+	return r.clearCheckpoint(ctx, r.ns.killKey(scope))
+}
+
+// LoadKillSwitches returns the global switch and the switch of pool, nil
+// for those turned off
+func (r *RedisProvider) LoadKillSwitches(ctx context.Context, pool string) (*KillSwitch, *KillSwitch, error) {
+	vals, err := r.rdb.MGet(ctx, r.ns.killKey(KillGlobal), r.ns.killKey(pool)).Result()
+	if err != nil {
+		return nil, nil, unavailable(err)
+	}
+	var switches [2]*KillSwitch
+	for i, scope := range []string{KillGlobal, pool} {
+		val, ok := vals[i].(string)
+		if !ok {
+			continue
+		}
+		ks := &KillSwitch{}
+		if err := json.Unmarshal([]byte(val), ks); err != nil || ks.Scope != scope {
+			// set by hand
+			ks = &KillSwitch{Scope: scope, By: sanitize(val, defaultMaxAgentInfo)}
+		}
+		switches[i] = ks
+	}
+	return switches[0], switches[1], nil
+}
+
+// poolName names the pool of the instance in the kill switch keys
+func (p *PluginState) poolName() string {
+	return fmt.Sprintf("%s-%s", p.cfg.Start, p.cfg.End)
+}
+
+// Kill turns the kill switch of scope on, for every instance sharing the
+// storage. by names who or what triggered it, and may be empty.
+func (p *PluginState) Kill(ctx context.Context, scope, by string) error {
+	ks := &KillSwitch{Scope: scope, By: by, Since: p.clock.Now()}
+	if err := p.storage.SetKillSwitch(ctx, ks); err != nil {
+		return err
+	}
+	p.applyKillSwitch(scope, ks, by)
+	return nil
+}
+
+// Unkill turns the kill switch of scope off
+func (p *PluginState) Unkill(ctx context.Context, scope, by string) error {
+	if err := p.storage.ClearKillSwitch(ctx, scope); err != nil {
+		return err
+	}
+	p.applyKillSwitch(scope, nil, by)
+	return nil
+}
+
+// applyKillSwitch records the switch of scope, nil if it is off, and logs
+// the change, if any, with what triggered it
+func (p *PluginState) applyKillSwitch(scope string, ks *KillSwitch, trigger string) {
+	p.kill.mu.Lock()
+	cur := &p.kill.pool
+	if scope == KillGlobal {
+		cur = &p.kill.global
+	}
+	was := *cur
+	if ks != nil && was != nil {
+		// keep when it was turned on first
+		p.kill.mu.Unlock()
+		return
+	}
+	*cur = ks
+	p.kill.mu.Unlock()
+
+	if trigger == "" {
+		trigger = "unknown"
+	}
+	switch {
+	case ks != nil && was == nil:
+		log.Warnf("%s activated for pool %s, triggered by %s: passing every packet on", ks, p.poolName(), trigger)
+	case ks == nil && was != nil:
+		log.Warnf("%s deactivated for pool %s, triggered by %s: answering again", was, p.poolName(), trigger)
+	}
+}
+
+// loadKillSwitches follows the switches stored in redis. The changes are
+// attributed to the flag keys, or to who the stored switches name.
+func (p *PluginState) loadKillSwitches(ctx context.Context) error {
+	global, pool, err := p.storage.LoadKillSwitches(ctx, p.poolName())
+	if err != nil {
+		return err
+	}
+	for _, s := range []struct {
+		scope string
+		ks    *KillSwitch
+	}{{KillGlobal, global}, {p.poolName(), pool}} {
+		trigger := "redis key " + p.storage.ns.killKey(s.scope)
+		if s.ks != nil {
+			if s.ks.Since.IsZero() {
+				s.ks.Since = p.clock.Now()
+			}
+			if s.ks.By != "" {
+				trigger += ", set by " + s.ks.By
+			}
+		}
+		p.applyKillSwitch(s.scope, s.ks, trigger)
+	}
+	return nil
+}
+
+// watchKillSwitches rereads the kill switches until the instance closes
+func (p *PluginState) watchKillSwitches() {
+	ticker := time.NewTicker(killSwitchPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.loadKillSwitches(context.TODO()); err != nil {
+				log.Warnf("could not read the kill switches: %v", err)
+			}
+		case <-p.closing:
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// answers reports whether p offers an address to mac
+func answers(t *testing.T, p *PluginState, mac string) bool {
+	t.Helper()
+	offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac))
+	return offer != nil && !offer.YourIPAddr.IsUnspecified()
+}
+
+func TestKillSwitch(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.34.10", "10.0.34.20", "1h")
+	other := startPlugin(t, m, "10.0.34.100", "10.0.34.110", "1h")
+	ctx := context.Background()
+	logs := captureLog(t)
+	const a, b = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+	ip := lease(t, p, a)
+
+	// the switch of one pool, through the control channel
+	p.handleControl("kill-switch on " + p.poolName() + " alice upstream conflict")
+	ks := p.Health(ctx).KillSwitch
+	if ks == nil || ks.Scope != p.poolName() || ks.By != "control channel, alice upstream conflict" {
+		t.Fatalf("kill switch %+v in the health", ks)
+	}
+	if !logs.logged("activated for pool " + p.poolName() + ", triggered by control channel, alice") {
+		t.Error("activation not logged")
+	}
+	if !m.Exists(p.storage.ns.killKey(p.poolName())) {
+		t.Error("switch not stored")
+	}
+	if answers(t, p, b) {
+		t.Error("offer while the switch is on")
+	}
+	if resp := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, a, dhcpv4.WithClientIP(ip))); resp == nil || !resp.YourIPAddr.IsUnspecified() {
+		t.Errorf("renewal answered %v while the switch is on", resp)
+	}
+	if _, err := p.storage.GetRecord(b); err == nil {
+		t.Error("record stored while the switch is on")
+	}
+	if s := p.Stats(); s.KillSwitch == nil || s.KillSwitchPassed != 2 {
+		t.Errorf("stats %v with %d packets passed, want 2", s.KillSwitch, s.KillSwitchPassed)
+	}
+	if !answers(t, other, b) {
+		t.Error("other pool stopped by the switch of the first")
+	}
+	// the switch of another pool is ignored
+	other.handleControl("kill-switch off " + p.poolName())
+	if p.kill.active() == nil {
+		t.Fatal("switch turned off through another pool")
+	}
+
+	p.handleControl("kill-switch off " + p.poolName() + " bob")
+	if p.Health(ctx).KillSwitch != nil || m.Exists(p.storage.ns.killKey(p.poolName())) {
+		t.Error("switch left on")
+	}
+	if !logs.logged("deactivated for pool " + p.poolName() + ", triggered by control channel, bob") {
+		t.Error("deactivation not logged")
+	}
+	if !answers(t, p, b) {
+		t.Error("no offer after the switch was turned off")
+	}
+
+	// the global switch, set by hand in redis
+	m.Set(REDIS_KILL_KEY, "carol: incident 42")
+	for _, p := range []*PluginState{p, other} {
+		if err := p.loadKillSwitches(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if ks := p.kill.active(); ks == nil || ks.Scope != KillGlobal || ks.By != "carol: incident 42" {
+			t.Errorf("switch %+v read from the key", ks)
+		}
+		if answers(t, p, "00:11:22:33:44:0c") {
+			t.Errorf("offer from %s while the global switch is on", p.poolName())
+		}
+	}
+	if !logs.logged("triggered by redis key " + REDIS_KILL_KEY + ", set by carol: incident 42") {
+		t.Error("activation by the key not logged")
+	}
+	m.Del(REDIS_KILL_KEY)
+	if err := other.loadKillSwitches(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if other.kill.active() != nil || !answers(t, other, "00:11:22:33:44:0c") {
+		t.Error("switch left on after the key was deleted")
+	}
+}
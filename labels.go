@@ -0,0 +1,154 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// REDIS_LABELS_KEY is the hash of the label rules applied to new leases. Its
+// fields select the leases, "mac:<client key>", "oui:<aa:bb:cc>" or
+// "pool:<start>-<end>", and its values are the labels as k=v,k=v. The more
+// specific selector wins for a label set by several rules.
+const REDIS_LABELS_KEY = "l:dhcp:labels"
+
+// limits of the labels of a record
+const (
+	maxLabels          = 16
+	maxLabelKeyLength  = 64
+	maxLabelValueBytes = 256
+)
+
+// ErrInvalidLabels means labels exceed the limits or are malformed
+var ErrInvalidLabels = errors.New("invalid labels")
+
+// validateLabels checks labels against the limits
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("%w: %d labels, at most %d allowed", ErrInvalidLabels, len(labels), maxLabels)
+	}
+	for k, v := range labels {
+		if k == "" || len(k) > maxLabelKeyLength || strings.ContainsAny(k, "=, ") {
+			return fmt.Errorf("%w: key %q", ErrInvalidLabels, k)
+		}
+		if len(v) > maxLabelValueBytes || strings.Contains(v, ",") || strings.IndexFunc(v, unicode.IsControl) >= 0 {
+			return fmt.Errorf("%w: value of %q", ErrInvalidLabels, k)
+		}
+	}
+	return nil
+}
+
+// ParseLabels parses labels written as k=v,k=v
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if s == "" {
+		return labels, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: %q is not k=v", ErrInvalidLabels, kv)
+		}
+		labels[k] = v
+	}
+	return labels, validateLabels(labels)
+}
+
+// formatLabels writes labels as k=v,k=v, sorted by key
+func formatLabels(labels map[string]string) string {
+	kvs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+// SetLabelRule sets the labels given to the new leases matching selector,
+// or removes the rule if labels is empty
+func (r *RedisProvider) SetLabelRule(ctx context.Context, selector string, labels map[string]string) error {
+	if len(labels) == 0 {
+		return unavailable(r.rdb.HDel(ctx, REDIS_LABELS_KEY, selector).Err())
+	}
+	if err := validateLabels(labels); err != nil {
+		return err
+	}
+	return unavailable(r.rdb.HSet(ctx, REDIS_LABELS_KEY, selector, formatLabels(labels)).Err())
+}
+
+// labelRules returns the rules of the given selectors, in the same order.
+// Missing rules are nil.
+func (r *RedisProvider) labelRules(ctx context.Context, selectors ...string) ([]map[string]string, error) {
+	vals, err := r.rdb.HMGet(ctx, REDIS_LABELS_KEY, selectors...).Result()
+	if err != nil && err != redis.Nil {
+		return nil, unavailable(err)
+	}
+	rules := make([]map[string]string, len(selectors))
+	for i, v := range vals {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if rules[i], err = ParseLabels(s); err != nil {
+			log.Warnf("ignoring label rule %s: %v", selectors[i], err)
+			rules[i] = nil
+		}
+	}
+	return rules, nil
+}
+
+// labelsFor returns the labels of a new lease of mac, from the rules of its
+// pool, its OUI and its MAC address. Labels never influence the allocation,
+// they are looked up once the address is chosen.
+func (p *PluginState) labelsFor(mac string) map[string]string {
+	selectors := []string{fmt.Sprintf("pool:%s-%s", p.cfg.Start, p.cfg.End)}
+	if hw, err := net.ParseMAC(mac); err == nil && len(hw) == 6 {
+		selectors = append(selectors, "oui:"+hw[:3].String())
+	}
+	selectors = append(selectors, "mac:"+mac)
+
+	rules, err := p.storage.labelRules(context.TODO(), selectors...)
+	if err != nil {
+		log.Warnf("could not look up the labels of MAC %s: %v", mac, err)
+		return nil
+	}
+	var labels map[string]string
+	for _, rule := range rules {
+		for k, v := range rule {
+			if labels == nil {
+				labels = make(map[string]string)
+			}
+			labels[k] = v
+		}
+	}
+	if len(labels) > maxLabels {
+		log.Warnf("dropping the labels of MAC %s: %v", mac, validateLabels(labels))
+		return nil
+	}
+	return labels
+}
+
+// SetLabels replaces the labels of the lease of mac, which must exist.
+// Empty labels remove them all.
+func (p *PluginState) SetLabels(mac string, labels map[string]string) error {
+	if err := validateLabels(labels); err != nil {
+		return err
+	}
+	record, err := p.storage.GetRecord(mac)
+	if err != nil {
+		return err
+	}
+	record.Labels = labels
+	if len(labels) == 0 {
+		record.Labels = nil
+	}
+	err = p.storage.SaveRecord(mac, record)
+	p.noteWrite(err)
+	return err
+}
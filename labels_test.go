@@ -0,0 +1,115 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestLabelsJSON(t *testing.T) {
+	// a record written before labels existed
+	old := `{"IP":"10.0.26.10","Expires":"2026-01-01T00:00:00Z","State":"bound"}`
+	var rec Record
+	if err := json.Unmarshal([]byte(old), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Labels != nil {
+		t.Errorf("labels %v decoded from an unlabeled record", rec.Labels)
+	}
+	b, err := encodeRecord(&rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "Labels") {
+		t.Errorf("unlabeled record encoded with labels: %s", b)
+	}
+
+	rec.Labels = map[string]string{"site": "fra1"}
+	if b, err = encodeRecord(&rec); err != nil {
+		t.Fatal(err)
+	}
+	var back Record
+	if err := json.Unmarshal(b, &back); err != nil || back.Labels["site"] != "fra1" {
+		t.Errorf("labels lost in %s: %v", b, err)
+	}
+}
+
+func TestLabelLimits(t *testing.T) {
+	many := make([]string, maxLabels+1)
+	for i := range many {
+		many[i] = fmt.Sprintf("k%d=v", i)
+	}
+	for _, s := range []string{
+		strings.Join(many, ","),
+		strings.Repeat("k", maxLabelKeyLength+1) + "=v",
+		"site=" + strings.Repeat("v", maxLabelValueBytes+1),
+		"=v",
+		"site",
+		"site=fra\n1",
+		"si te=fra1",
+	} {
+		if _, err := ParseLabels(s); !errors.Is(err, ErrInvalidLabels) {
+			t.Errorf("ParseLabels(%.40q): %v, want ErrInvalidLabels", s, err)
+		}
+	}
+	labels, err := ParseLabels("site=fra1,owner=teamX,empty=")
+	if err != nil || len(labels) != 3 || labels["owner"] != "teamX" {
+		t.Errorf("ParseLabels: %v, %v", labels, err)
+	}
+	if got := formatLabels(labels); got != "empty=,owner=teamX,site=fra1" {
+		t.Errorf("formatLabels: %q", got)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.26.10", "10.0.26.20", "1h")
+	events := recordEvents(p)
+	const mac, other = "00:11:22:33:44:0a", "00:11:22:33:55:0b"
+	ctx := context.Background()
+	for selector, labels := range map[string]string{
+		"pool:10.0.26.10-10.0.26.20": "site=fra1,owner=pool",
+		"oui:00:11:22":               "owner=oui",
+		"mac:" + mac:                 "owner=teamX",
+	} {
+		l, _ := ParseLabels(labels)
+		if err := p.storage.SetLabelRule(ctx, selector, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.storage.SetLabelRule(ctx, "mac:"+other, map[string]string{"bad key": "v"}); !errors.Is(err, ErrInvalidLabels) {
+		t.Errorf("invalid rule: %v, want ErrInvalidLabels", err)
+	}
+
+	// the most specific rule wins, and the labels do not change the address
+	ip := lease(t, p, mac)
+	if want := "10.0.26.10"; ip.String() != want {
+		t.Errorf("labeled client leased %s, want %s", ip, want)
+	}
+	rec, err := p.storage.GetRecord(mac)
+	if err != nil || formatLabels(rec.Labels) != "owner=teamX,site=fra1" {
+		t.Fatalf("labels of the lease: %v, %v", rec, err)
+	}
+	eventually(t, "the labeled grant event", func() bool {
+		ev := events.of(EventGrant)
+		return len(ev) == 1 && formatLabels(ev[0].Labels) == "owner=teamX,site=fra1"
+	})
+
+	// labels set by the operator are kept across renewals
+	p.handleControl("label 00-11-22-33-44-0A owner=teamY")
+	if typ := renewal(t, p, mac, ip); typ != dhcpv4.MessageTypeAck {
+		t.Fatalf("renewal answered %s", typ)
+	}
+	if rec, err = p.storage.GetRecord(mac); err != nil || formatLabels(rec.Labels) != "owner=teamY" {
+		t.Errorf("labels after the renewal: %v, %v", rec, err)
+	}
+	if err := p.SetLabels(other, map[string]string{"site": "fra1"}); err == nil {
+		t.Error("labels set on a client without lease")
+	}
+}
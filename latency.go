@@ -0,0 +1,272 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+const (
+	// one command in latencySampleRate is timed; failures are all counted
+	latencySampleRate = 8
+	// timed commands slower than that are kept for the support bundle, the
+	// last slowCommandsKept of them, of which the slowest are reported
+	slowCommandThreshold = 10 * time.Millisecond
+	slowCommandsKept     = 64
+	slowCommandsReported = 20
+)
+
+// LatencyBounds are the upper bounds of the buckets of CommandLatency
+var LatencyBounds = []time.Duration{
+	250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second,
+}
+
+// CommandLatency is the latency breakdown of a redis command, measured from
+// the client: network and server time together. Connections are timed
+// apart, as "dial", and pipelines as a whole, as "pipeline".
+type CommandLatency struct {
+	// Sampled counts the timed calls, and Errors all the failed ones
+	Sampled uint64
+	Errors  uint64
+	Total   time.Duration
+	Max     time.Duration
+	// Buckets counts the timed calls by latency, bounded by LatencyBounds,
+	// the last one counting the slower calls
+	Buckets []uint64
+}
+
+// SlowCommand is a timed redis command slower than slowCommandThreshold
+type SlowCommand struct {
+	Time time.Time
+	Name string
+	// KeyPrefix is the prefix of the first key, which leaves the client out
+	KeyPrefix string `json:",omitempty"`
+	Duration  time.Duration
+	Failed    bool `json:",omitempty"`
+}
+
+// keyPrefixes returns the prefixes and the keys of the plugin, those of the
+// records in namespace ns, longest first
+func keyPrefixes(ns keySpace) []string {
+	prefixes := []string{
+		ns.main, ns.shadow, ns.index, ns.override,
+		ns.quarantine, ns.circuit, ns.cooldown, ns.journal, ns.kill, ns.ramp,
+		ns.handover, ns.snapshot, ns.split, ns.splitMoved,
+		ns.freeze, ns.frozen, ns.leaseLimit, ns.leaseCounts,
+		ns.export, ns.extend, ns.backfill, ns.link, ns.history,
+		REDIS_REGISTRY_KEY_PREFIX,
+		REDIS_REFUSALS_KEY_PREFIX, REDIS_TRACE_KEY_PREFIX, REDIS_V6_KEY_PREFIX,
+		REDIS_V6_SHADOW_KEY_PREFIX, REDIS_PD_KEY_PREFIX, REDIS_PD_SHADOW_KEY_PREFIX,
+		REDIS_LABELS_KEY, REDIS_RESERVATIONS_KEY,
+		REDIS_TRACE_TARGETS_KEY, REDIS_DENY_KEY,
+	}
+	sort.SliceStable(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	return prefixes
+}
+
+// firstKey returns the first key of cmd, false for a command without keys
+func firstKey(cmd redis.Cmder) (string, bool) {
+	args := cmd.Args()
+	pos := 1
+	switch cmd.Name() {
+	case "eval", "evalsha":
+		// EVALSHA <sha> <numkeys> <key>...
+		if len(args) < 3 || toInt(args[2]) == 0 {
+			return "", false
+		}
+		pos = 3
+	}
+	if len(args) <= pos {
+		return "", false
+	}
+	key, ok := args[pos].(string)
+	return key, ok
+}
+
+// keyPrefixOf returns the prefix of the first key of cmd among prefixes,
+// "other" for a foreign key
+func keyPrefixOf(cmd redis.Cmder, prefixes []string) string {
+	key, ok := firstKey(cmd)
+	if !ok {
+		return ""
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return prefix
+		}
+	}
+	return "other"
+}
+
+func toInt(v interface{}) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case int64:
+		return int(n)
+	case string:
+		i, _ := strconv.Atoi(n)
+		return i
+	}
+	return 0
+}
+
+// failed reports whether err is a failure, a missing key being none
+func failed(err error) bool {
+	return err != nil && err != redis.Nil
+}
+
+// latencyHook times a sample of the commands of the clients it is added
+// to. It is a redis.Hook, which every client variant accepts.
+type latencyHook struct {
+	calls atomic.Uint64
+	// prefixes are the key prefixes the commands are reported by
+	prefixes []string
+
+	mu       sync.Mutex
+	commands map[string]*CommandLatency
+	slow     []SlowCommand
+	next     int
+}
+
+func newLatencyHook(ns keySpace) *latencyHook {
+	return &latencyHook{prefixes: keyPrefixes(ns), commands: make(map[string]*CommandLatency)}
+}
+
+// sampled reports whether the next call is timed
+func (h *latencyHook) sampled() bool {
+	return h.calls.Add(1)%latencySampleRate == 0
+}
+
+func (h *latencyHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := next(ctx, network, addr)
+		h.record("dial", "", time.Since(start), err)
+		return conn, err
+	}
+}
+
+func (h *latencyHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if !h.sampled() {
+			err := next(ctx, cmd)
+			if failed(err) {
+				h.fail(cmd.Name())
+			}
+			return err
+		}
+		start := time.Now()
+		err := next(ctx, cmd)
+		h.record(cmd.Name(), keyPrefixOf(cmd, h.prefixes), time.Since(start), err)
+		return err
+	}
+}
+
+func (h *latencyHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if !h.sampled() {
+			err := next(ctx, cmds)
+			if failed(err) {
+				h.fail("pipeline")
+			}
+			return err
+		}
+		start := time.Now()
+		err := next(ctx, cmds)
+		h.record("pipeline", "", time.Since(start), err)
+		return err
+	}
+}
+
+// entry returns the latency of command name, under h.mu
+func (h *latencyHook) entry(name string) *CommandLatency {
+	c, ok := h.commands[name]
+	if !ok {
+		c = &CommandLatency{Buckets: make([]uint64, len(LatencyBounds)+1)}
+		h.commands[name] = c
+	}
+	return c
+}
+
+// fail counts a failed call of command name that was not timed
+func (h *latencyHook) fail(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entry(name).Errors++
+}
+
+// record adds a timed call of command name
+func (h *latencyHook) record(name, prefix string, d time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := h.entry(name)
+	c.Sampled++
+	if failed(err) {
+		c.Errors++
+	}
+	c.Total += d
+	if d > c.Max {
+		c.Max = d
+	}
+	c.Buckets[sort.Search(len(LatencyBounds), func(i int) bool { return d <= LatencyBounds[i] })]++
+
+	if d < slowCommandThreshold {
+		return
+	}
+	s := SlowCommand{Time: time.Now(), Name: name, KeyPrefix: prefix, Duration: d, Failed: failed(err)}
+	if len(h.slow) < slowCommandsKept {
+		h.slow = append(h.slow, s)
+		return
+	}
+	h.slow[h.next] = s
+	h.next = (h.next + 1) % slowCommandsKept
+}
+
+// latencies returns a copy of the latency of every command
+func (h *latencyHook) latencies() map[string]CommandLatency {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make(map[string]CommandLatency, len(h.commands))
+	for name, c := range h.commands {
+		cp := *c
+		cp.Buckets = append([]uint64(nil), c.Buckets...)
+		out[name] = cp
+	}
+	return out
+}
+
+// slowest returns the slowest of the recent slow commands, slowest first
+func (h *latencyHook) slowest() []SlowCommand {
+	h.mu.Lock()
+	out := append([]SlowCommand(nil), h.slow...)
+	h.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Duration > out[j].Duration })
+	if len(out) > slowCommandsReported {
+		out = out[:slowCommandsReported]
+	}
+	return out
+}
+
+// CommandLatencies returns the latency breakdown of the redis commands
+// by name
+func (r *RedisProvider) CommandLatencies() map[string]CommandLatency {
+	return r.latency.latencies()
+}
+
+// SlowCommands returns the slowest recent redis commands, slowest first
+func (r *RedisProvider) SlowCommands() []SlowCommand {
+	return r.latency.slowest()
+}
@@ -0,0 +1,104 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/go-redis/redis/v9"
+)
+
+func TestLatencyHook(t *testing.T) {
+	m := miniredis.RunT(t)
+	h := newLatencyHook(defaultKeySpace)
+	rdb := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	rdb.AddHook(h)
+	ctx := context.Background()
+	const mac = "00:11:22:33:44:0a"
+	key := defaultKeySpace.main + mac
+
+	// one call in latencySampleRate is timed, a missing key is no failure
+	for i := 0; i < 2*latencySampleRate; i++ {
+		rdb.Get(ctx, key)
+	}
+	// the failures are all counted, timed or not
+	m.Set("string", "x")
+	for i := 0; i < latencySampleRate; i++ {
+		rdb.LPush(ctx, "string", "x")
+	}
+	rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := 0; i < latencySampleRate; i++ {
+			pipe.Set(ctx, key, "x", 0)
+		}
+		return nil
+	})
+
+	got := h.latencies()
+	if c := got["get"]; c.Sampled != 2 || c.Errors != 0 || c.Total <= 0 || c.Max <= 0 || sum(c.Buckets) != 2 {
+		t.Errorf("get latency %+v", c)
+	}
+	if c := got["lpush"]; c.Sampled != 1 || c.Errors != latencySampleRate {
+		t.Errorf("lpush latency %+v", c)
+	}
+	if c := got["dial"]; c.Sampled != 1 {
+		t.Errorf("dial latency %+v", c)
+	}
+	// a pipeline is one call, not timed here, and its commands none
+	if _, ok := got["pipeline"]; ok || got["set"].Sampled != 0 {
+		t.Errorf("pipeline timed: %+v", got)
+	}
+
+	// the slow commands are kept with the prefix of their key only
+	m.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd == "GET" {
+			time.Sleep(2 * slowCommandThreshold)
+		}
+		return false
+	})
+	for i := 0; i < latencySampleRate; i++ {
+		rdb.Get(ctx, key)
+	}
+	rdb.Get(ctx, "foreign")
+	slow := h.slowest()
+	if len(slow) != 1 || slow[0].Name != "get" || slow[0].KeyPrefix != defaultKeySpace.main ||
+		slow[0].Duration < 2*slowCommandThreshold || slow[0].Failed {
+		t.Fatalf("slow commands %+v", slow)
+	}
+	if strings.Contains(slow[0].KeyPrefix, mac) {
+		t.Error("client named by the slow commands")
+	}
+	if c := h.latencies()["get"]; c.Buckets[len(c.Buckets)-1] != 0 || c.Max < 2*slowCommandThreshold {
+		t.Errorf("get latency after the slow one %+v", c)
+	}
+}
+
+func TestKeyPrefixOf(t *testing.T) {
+	prefixes := keyPrefixes(defaultKeySpace)
+	ctx := context.Background()
+	for _, tc := range []struct {
+		cmd  redis.Cmder
+		want string
+	}{
+		{redis.NewStringCmd(ctx, "get", defaultKeySpace.shadow+"00:11:22:33:44:0a"), defaultKeySpace.shadow},
+		{redis.NewCmd(ctx, "evalsha", "sha", 2, defaultKeySpace.index+"10.0.0.1", "k"), defaultKeySpace.index},
+		{redis.NewCmd(ctx, "evalsha", "sha", 0, "arg"), ""},
+		{redis.NewStringCmd(ctx, "ping"), ""},
+		{redis.NewStringCmd(ctx, "get", "foreign"), "other"},
+	} {
+		if got := keyPrefixOf(tc.cmd, prefixes); got != tc.want {
+			t.Errorf("keyPrefixOf(%v) = %q, want %q", tc.cmd.Args(), got, tc.want)
+		}
+	}
+}
+
+func sum(counts []uint64) uint64 {
+	var n uint64
+	for _, c := range counts {
+		n += c
+	}
+	return n
+}
@@ -0,0 +1,256 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// REDIS_LEASE_LIMIT_KEY holds the limit of the active leases of all the
+// instances sharing the storage, e.g. `SET x:dhcp:lease-limit 5000`. Every
+// instance picks a change up at its next heartbeat. The instances of
+// another namespace share a limit of their own, e.g. x:site-a:lease-limit.
+const REDIS_LEASE_LIMIT_KEY = "x:dhcp:lease-limit"
+
+// REDIS_LEASE_COUNTS_KEY is the hash of the active leases of the live
+// instances, by instance ID, which the global limit is enforced on. Each
+// instance sets its own count at every heartbeat, and counts its new
+// allocations in between; the frees are counted at the next heartbeat. It
+// is named after the namespace as REDIS_LEASE_LIMIT_KEY.
+const REDIS_LEASE_COUNTS_KEY = "x:dhcp:lease-counts"
+
+// reserveLeaseScript counts a new lease of an instance, unless the leases
+// of the live instances already reach the limit.
+// KEYS: counts. ARGV: instance ID, limit, live instance IDs...
+var reserveLeaseScript = redis.NewScript(`
+local total = 0
+for i = 3, #ARGV do
+	total = total + tonumber(redis.call('HGET', KEYS[1], ARGV[i]) or '0')
+end
+if total >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('HINCRBY', KEYS[1], ARGV[1], 1)
+return 1
+`)
+
+// LeaseLimit returns the global lease limit, 0 if there is none
+func (r *RedisProvider) LeaseLimit(ctx context.Context) (int, error) {
+	n, err := r.rdb.Get(ctx, r.ns.leaseLimit).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, unavailable(err)
+}
+
+// SetLeaseLimit sets the global lease limit, or lifts it if n is 0
+func (r *RedisProvider) SetLeaseLimit(ctx context.Context, n int) error {
+	if n == 0 {
+		return unavailable(r.rdb.Del(ctx, r.ns.leaseLimit).Err())
+	}
+	return unavailable(r.rdb.Set(ctx, r.ns.leaseLimit, n, 0).Err())
+}
+
+// SyncLeaseCount sets the count of the active leases of instance id, and
+// drops the counts of the instances not in live
+func (r *RedisProvider) SyncLeaseCount(ctx context.Context, id string, n int, live []string) error {
+	ids, err := r.rdb.HKeys(ctx, r.ns.leaseCounts).Result()
+	if err != nil {
+		return unavailable(err)
+	}
+	alive := make(map[string]bool, len(live))
+	for _, l := range live {
+		alive[l] = true
+	}
+	_, err = r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, other := range ids {
+			if !alive[other] && other != id {
+				pipe.HDel(ctx, r.ns.leaseCounts, other)
+			}
+		}
+		pipe.HSet(ctx, r.ns.leaseCounts, id, n)
+		return nil
+	})
+	return unavailable(err)
+}
+
+// ReserveLease counts a new lease of instance id, and reports false
+// without counting it if the leases of the live instances reach limit
+func (r *RedisProvider) ReserveLease(ctx context.Context, id string, limit int, live []string) (bool, error) {
+	args := make([]interface{}, 0, len(live)+2)
+	args = append(args, id, limit)
+	for _, l := range live {
+		args = append(args, l)
+	}
+	n, err := reserveLeaseScript.Run(ctx, r.rdb, []string{r.ns.leaseCounts}, args...).Int()
+	return n == 1, unavailable(err)
+}
+
+// ActiveLeases returns the active leases of the live instances
+func (r *RedisProvider) ActiveLeases(ctx context.Context, live []string) (int, error) {
+	if len(live) == 0 {
+		return 0, nil
+	}
+	counts, err := r.rdb.HMGet(ctx, r.ns.leaseCounts, live...).Result()
+	if err != nil {
+		return 0, unavailable(err)
+	}
+	total := 0
+	for _, c := range counts {
+		if s, ok := c.(string); ok {
+			n, _ := strconv.Atoi(s)
+			total += n
+		}
+	}
+	return total, nil
+}
+
+// leaseLimits holds the limits of the active leases, of the pool and of all
+// the instances sharing the storage, 0 for none
+type leaseLimits struct {
+	pool   atomic.Int64
+	global atomic.Int64
+
+	mu      sync.Mutex
+	live    []string
+	reached bool
+}
+
+func (l *leaseLimits) liveIDs() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.live
+}
+
+// LeaseLimitStatus describes the lease limits in effect
+type LeaseLimitStatus struct {
+	Pool   int `json:",omitempty"`
+	Global int `json:",omitempty"`
+	// Reached is set while new allocations are refused, and Refusals
+	// counts them
+	Reached  bool
+	Refusals uint64
+}
+
+func (p *PluginState) leaseLimitStatus() *LeaseLimitStatus {
+	pool, global := p.limits.pool.Load(), p.limits.global.Load()
+	if pool == 0 && global == 0 {
+		return nil
+	}
+	p.limits.mu.Lock()
+	defer p.limits.mu.Unlock()
+	return &LeaseLimitStatus{
+		Pool:     int(pool),
+		Global:   int(global),
+		Reached:  p.limits.reached,
+		Refusals: p.counters.leaseLimitRefusals.Load(),
+	}
+}
+
+// SetPoolLeaseLimit sets the limit of the active leases of the pool, or
+// lifts it if n is 0. It applies to the next allocation.
+func (p *PluginState) SetPoolLeaseLimit(n int) {
+	p.limits.pool.Store(int64(n))
+	log.Infof("lease limit of the pool set to %d", n)
+}
+
+// SetGlobalLeaseLimit sets the limit of the active leases of all the
+// instances sharing the storage, or lifts it if n is 0. It applies here at
+// once, and on the other instances at their next heartbeat.
+func (p *PluginState) SetGlobalLeaseLimit(ctx context.Context, n int) error {
+	if err := p.storage.SetLeaseLimit(ctx, n); err != nil {
+		return err
+	}
+	return p.syncLeaseLimit(ctx)
+}
+
+// syncLeaseLimit picks up the global lease limit, and publishes the count
+// of the leases of the instance if there is one
+func (p *PluginState) syncLeaseLimit(ctx context.Context) error {
+	limit, err := p.storage.LeaseLimit(ctx)
+	if err != nil {
+		return err
+	}
+	if limit > 0 {
+		regs, err := p.storage.Registrations(ctx)
+		if err != nil {
+			return err
+		}
+		live := make([]string, 0, len(regs)+1)
+		self := false
+		for _, reg := range regs {
+			live = append(live, reg.ID)
+			self = self || reg.ID == p.id
+		}
+		if !self {
+			live = append(live, p.id)
+		}
+		if err := p.storage.SyncLeaseCount(ctx, p.id, p.leases.len(), live); err != nil {
+			return err
+		}
+		p.limits.mu.Lock()
+		p.limits.live = live
+		p.limits.mu.Unlock()
+	}
+	if was := p.limits.global.Swap(int64(limit)); was != int64(limit) {
+		log.Infof("global lease limit set to %d", limit)
+	}
+	return nil
+}
+
+// leaseLimitReached reports whether a new lease exceeds the limit of the
+// pool or the global one, counting it against the global limit otherwise.
+// A failing count lets the lease through: the allocation fails anyway
+// with an unavailable redis.
+func (p *PluginState) leaseLimitReached(ctx context.Context) bool {
+	reached := false
+	if pool := p.limits.pool.Load(); pool > 0 && int64(p.leases.len()) >= pool {
+		reached = true
+	} else if global := p.limits.global.Load(); global > 0 {
+		ok, err := p.storage.ReserveLease(ctx, p.id, int(global), p.limits.liveIDs())
+		if err != nil {
+			log.Debugf("could not count the lease against the global limit: %v", err)
+		}
+		reached = err == nil && !ok
+	}
+	p.noteLeaseLimit(reached)
+	return reached
+}
+
+// peekLeaseLimit is leaseLimitReached without counting the lease
+func (p *PluginState) peekLeaseLimit(ctx context.Context) (bool, error) {
+	if pool := p.limits.pool.Load(); pool > 0 && int64(p.leases.len()) >= pool {
+		return true, nil
+	}
+	global := p.limits.global.Load()
+	if global == 0 {
+		return false, nil
+	}
+	n, err := p.storage.ActiveLeases(ctx, p.limits.liveIDs())
+	return n >= int(global), err
+}
+
+// noteLeaseLimit updates the limit state from the outcome of a check,
+// alerting when it changes
+func (p *PluginState) noteLeaseLimit(reached bool) {
+	if reached {
+		p.counters.leaseLimitRefusals.Add(1)
+	}
+	p.limits.mu.Lock()
+	defer p.limits.mu.Unlock()
+	if reached == p.limits.reached {
+		return
+	}
+	p.limits.reached = reached
+	if reached {
+		log.Warnf("lease limit reached (pool %d, global %d), refusing new allocations although addresses are free",
+			p.limits.pool.Load(), p.limits.global.Load())
+		p.emit(Event{Type: EventLeaseLimit})
+		return
+	}
+	log.Infof("below the lease limit again, resuming allocations")
+	p.emit(Event{Type: EventLeaseLimitLifted})
+}
@@ -0,0 +1,101 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestPoolLeaseLimit(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.51.10", "10.0.51.20", "1h", "max_leases=2")
+	events := recordEvents(p)
+	const a, b, c = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c"
+	ipA := lease(t, p, a)
+	lease(t, p, b)
+
+	// new allocations are refused with free addresses left, not renewals
+	if offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, c)); offer != nil {
+		t.Errorf("offer of %s past the limit", offer.YourIPAddr)
+	}
+	if typ := renewal(t, p, a, ipA); typ != dhcpv4.MessageTypeAck {
+		t.Errorf("renewal at the limit answered %s", typ)
+	}
+	if s := p.Stats().LeaseLimit; s == nil || !s.Reached || s.Pool != 2 || s.Refusals != 1 {
+		t.Errorf("lease limit %+v", s)
+	}
+	if s := p.Stats().Refusals; s.Reasons[ReasonLeaseLimit] != 1 || s.Reasons[ReasonPoolExhausted] != 0 {
+		t.Errorf("refusals %s, want one for the lease limit", s)
+	}
+	eventually(t, "the alert", func() bool { return len(events.of(EventLeaseLimit)) == 1 })
+
+	// raised at runtime, the limit applies to the next allocation
+	p.handleControl("lease-limit 3")
+	if ip := lease(t, p, c); ip == nil {
+		t.Error("no lease once the limit was raised")
+	}
+	eventually(t, "the end of the alert", func() bool { return len(events.of(EventLeaseLimitLifted)) == 1 })
+	if s := p.Stats().LeaseLimit; s == nil || s.Reached || s.Pool != 3 {
+		t.Errorf("lease limit %+v once raised", s)
+	}
+}
+
+func TestGlobalLeaseLimit(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.51.10", "10.0.51.20", "1h")
+	q := startPlugin(t, m, "10.0.51.100", "10.0.51.110", "1h")
+	ctx := context.Background()
+	mac := func(i int) string { return net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, byte(i)}.String() }
+	discover := func(p *PluginState, mac string) *dhcpv4.DHCPv4 {
+		return exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac))
+	}
+	ip0 := lease(t, p, mac(0))
+	if err := p.SetGlobalLeaseLimit(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	// q picks the limit up at its heartbeat
+	if err := q.syncLeaseLimit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	lease(t, q, mac(1))
+	lease(t, p, mac(2))
+
+	// the leases of both instances count
+	for _, p := range []*PluginState{p, q} {
+		if offer := discover(p, mac(3)); offer != nil {
+			t.Errorf("offer of %s past the global limit", offer.YourIPAddr)
+		}
+		if s := p.Stats().LeaseLimit; s == nil || !s.Reached || s.Global != 3 {
+			t.Errorf("lease limit %+v", s)
+		}
+	}
+	if n, err := p.storage.ActiveLeases(ctx, p.limits.liveIDs()); err != nil || n != 3 {
+		t.Errorf("%d active leases counted: %v", n, err)
+	}
+
+	// a free is counted at the next heartbeat of its instance
+	releaseLease(t, p, mac(0), ip0)
+	if offer := discover(q, mac(3)); offer != nil {
+		t.Errorf("offer of %s before the free was counted", offer.YourIPAddr)
+	}
+	if err := p.syncLeaseLimit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	lease(t, q, mac(3))
+
+	// lifted, by redis for every instance
+	p.handleControl("lease-limit global 0")
+	if m.Exists(REDIS_LEASE_LIMIT_KEY) {
+		t.Error("global limit left in redis")
+	}
+	if err := q.syncLeaseLimit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	lease(t, q, mac(4))
+	if s := q.Stats().LeaseLimit; s != nil {
+		t.Errorf("lease limit %+v once lifted", s)
+	}
+}
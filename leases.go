@@ -0,0 +1,100 @@
+package rangeredisplugin
+
+import (
+	"net"
+	"sync"
+)
+
+// leaseTable is the in-memory view of which MAC address holds which IP
+type leaseTable struct {
+	mu    sync.RWMutex
+	byMAC map[string]string
+	byIP  map[string]string
+	// model is the reference model of the invariant checker, or nil
+	model *refModel
+	// oplog is the operation log, or nil
+	oplog *opLog
+}
+
+func newLeaseTable() *leaseTable {
+	return &leaseTable{
+		byMAC: make(map[string]string),
+		byIP:  make(map[string]string),
+	}
+}
+
+// set records that mac holds ip, replacing any previous binding of mac
+func (t *leaseTable) set(mac string, ip net.IP) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if old, ok := t.byMAC[mac]; ok && t.byIP[old] == mac {
+		delete(t.byIP, old)
+	}
+	t.byMAC[mac] = ip.String()
+	t.byIP[ip.String()] = mac
+	if t.model != nil {
+		t.model.bind(mac, ip)
+	}
+	if t.oplog != nil {
+		t.oplog.record(OpBind, ip, nil, mac, nil)
+	}
+}
+
+// remove drops the binding of mac to ip, if it is still the current one
+func (t *leaseTable) remove(mac string, ip net.IP) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.byMAC[mac] != ip.String() {
+		return
+	}
+	delete(t.byMAC, mac)
+	if t.byIP[ip.String()] == mac {
+		delete(t.byIP, ip.String())
+	}
+	if t.model != nil {
+		t.model.unbind(mac, ip)
+	}
+	if t.oplog != nil {
+		t.oplog.record(OpUnbind, ip, nil, mac, nil)
+	}
+}
+
+// ipOf returns the IP held by mac, or nil
+func (t *leaseTable) ipOf(mac string) net.IP {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if ip, ok := t.byMAC[mac]; ok {
+		return net.ParseIP(ip).To4()
+	}
+	return nil
+}
+
+// macOf returns the MAC holding ip, or an empty string
+func (t *leaseTable) macOf(ip net.IP) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.byIP[ip.String()]
+}
+
+func (t *leaseTable) len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return len(t.byMAC)
+}
+
+// snapshot returns a copy of the bindings, mapping MAC addresses to IPs
+func (t *leaseTable) snapshot() map[string]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	m := make(map[string]string, len(t.byMAC))
+	for mac, ip := range t.byMAC {
+		m[mac] = ip
+	}
+	return m
+}
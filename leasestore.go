@@ -0,0 +1,66 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// LeaseStore holds the lease records. Any store must keep the semantics
+// the plugin relies on, pinned by storagetest.RunConformance:
+//   - records are keyed by the canonical client key, and a missing record is
+//     reported as ErrNotFound, a failing store as ErrStorageUnavailable and
+//     an undecodable record as ErrCorruptRecord
+//   - a record lives until its Expires, at least one second ahead; the end
+//     of its life is notified once, and the record stays readable for 10
+//     more seconds so the notification can be handled
+//   - saving a record replaces it whole, deleting it is idempotent and
+//     produces no expiry notification; a record too large for the store is
+//     refused with ErrRecordTooLarge, keeping the one stored before
+//   - enumerations are unordered and may return a record twice, but never
+//     miss one that exists during the whole enumeration
+//   - stores of distinct namespaces sharing a backend never see each
+//     other's records nor expiries
+type LeaseStore interface {
+	GetRecord(mac string) (*Record, error)
+	SaveRecord(mac string, record *Record) error
+	DeleteRecord(mac string) error
+	// ScanRecords returns one batch of an enumeration starting with cursor
+	// 0 and complete when the returned cursor is 0 again
+	ScanRecords(ctx context.Context, cursor uint64, count int64) (map[string]Record, uint64, error)
+	// Expired delivers the keys of the records reaching their Expires
+	// until the returned function is called
+	Expired() (<-chan string, func())
+}
+
+var _ LeaseStore = (*RedisProvider)(nil)
+
+// Expired delivers the MAC addresses of the records whose shadow key
+// expired, taken from the keyevent notifications of the provider. A
+// receiver falling behind misses expiries as a Listener does.
+func (r *RedisProvider) Expired() (<-chan string, func()) {
+	l, unlisten := r.Listen()
+	out := make(chan string, listenerBuffer)
+	done := make(chan struct{})
+	go func() {
+		defer close(out)
+		for msg := range l.C {
+			mac, ok := strings.CutPrefix(msg.Payload, r.ns.shadow)
+			if msg.Channel == REDIS_CONTROL_CHANNEL || !ok {
+				continue
+			}
+			select {
+			case out <- mac:
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return out, func() {
+		once.Do(func() {
+			close(done)
+			unlisten()
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// REDIS_REFUSALS_KEY_PREFIX prefixes the per-client lists of the last
+// refusals, keyed by MAC address or DUID
+const REDIS_REFUSALS_KEY_PREFIX = "l:dhcp:refused:"
+
+const (
+	// number of refusals kept per client, and how long after the last one
+	refusalsKept = 20
+	refusalsTTL  = 7 * 24 * time.Hour
+	// size of the queue of the refusals to write
+	refusalQueueSize = 1024
+)
+
+// Refusal records that a client was not served: refused with a NAK or a
+// status code, or dropped. The reasons are those of the evaluations.
+type Refusal struct {
+	Client string
+	Reason string
+	Pool   string
+	Time   time.Time
+	Detail string `json:",omitempty"`
+}
+
+// AppendRefusal adds ref to the refusals of its client, keeping the last
+// refusalsKept
+func (r *RedisProvider) AppendRefusal(ref Refusal) error {
+	b, err := json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+	key := REDIS_REFUSALS_KEY_PREFIX + ref.Client
+	_, err = r.rdb.TxPipelined(context.TODO(), func(pipe redis.Pipeliner) error {
+		pipe.LPush(context.TODO(), key, b)
+		pipe.LTrim(context.TODO(), key, 0, refusalsKept-1)
+		pipe.Expire(context.TODO(), key, refusalsTTL)
+		return nil
+	})
+	return unavailable(err)
+}
+
+// Refusals returns the last refusals of client, most recent first
+func (r *RedisProvider) Refusals(ctx context.Context, client string) ([]Refusal, error) {
+	entries, err := r.rdb.LRange(ctx, REDIS_REFUSALS_KEY_PREFIX+client, 0, -1).Result()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	refusals := make([]Refusal, 0, len(entries))
+	for _, e := range entries {
+		var ref Refusal
+		if err := json.Unmarshal([]byte(e), &ref); err != nil {
+			log.Warnf("ignoring undecodable refusal of %s: %v", client, err)
+			continue
+		}
+		refusals = append(refusals, ref)
+	}
+	return refusals, nil
+}
+
+// refusalLedger counts the refusals of an instance by reason, and writes
+// them to redis in the background. Refusals often come with a failing
+// redis, so a full queue drops them rather than slow the handler down.
+type refusalLedger struct {
+	storage *RedisProvider
+	pool    string
+	// clock stamps the refusals, the clock of the instance so that they
+	// sort with its other records in a timeline
+	clock   Clock
+	queue   chan Refusal
+	mu      sync.Mutex
+	counts  map[string]uint64
+	dropped atomic.Uint64
+}
+
+func newRefusalLedger(storage *RedisProvider, pool string, clock Clock) *refusalLedger {
+	return &refusalLedger{
+		storage: storage,
+		pool:    pool,
+		clock:   clock,
+		queue:   make(chan Refusal, refusalQueueSize),
+		counts:  make(map[string]uint64),
+	}
+}
+
+// note records that client was refused for reason
+func (l *refusalLedger) note(client, reason, detail string) {
+	l.mu.Lock()
+	l.counts[reason]++
+	l.mu.Unlock()
+
+	select {
+	case l.queue <- Refusal{Client: client, Reason: reason, Pool: l.pool, Time: l.clock.Now(), Detail: detail}:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// run writes the queued refusals until stop is closed
+func (l *refusalLedger) run(stop <-chan struct{}) {
+	for {
+		select {
+		case ref := <-l.queue:
+			if err := l.storage.AppendRefusal(ref); err != nil {
+				l.dropped.Add(1)
+				log.Debugf("could not record the refusal of %s: %v", ref.Client, err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// RefusalStats holds the refusals of an instance by reason, and the number
+// of them that could not be written to redis
+type RefusalStats struct {
+	Reasons map[string]uint64
+	Dropped uint64
+}
+
+func (l *refusalLedger) stats() RefusalStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st := RefusalStats{Reasons: make(map[string]uint64, len(l.counts)), Dropped: l.dropped.Load()}
+	for reason, n := range l.counts {
+		st.Reasons[reason] = n
+	}
+	return st
+}
+
+func (st RefusalStats) String() string {
+	counts := make([]string, 0, len(st.Reasons))
+	for reason, n := range st.Reasons {
+		counts = append(counts, fmt.Sprintf("%s=%d", reason, n))
+	}
+	sort.Strings(counts)
+	return fmt.Sprintf("%s, %d not recorded", strings.Join(counts, " "), st.Dropped)
+}
+
+// Refusals returns the last refusals of a client by any instance sharing
+// the storage, most recent first. client is a MAC address or a DUID in hex.
+func (p *PluginState) Refusals(ctx context.Context, client string) ([]Refusal, error) {
+	if mac, err := net.ParseMAC(client); err == nil && len(mac) == 6 {
+		client = mac.String()
+	}
+	return p.storage.Refusals(ctx, strings.ToLower(client))
+}
@@ -0,0 +1,154 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// failCommands makes m fail the commands cmd with an argument starting
+// with prefix, until the hook is replaced
+func failCommands(m *miniredis.Miniredis, cmd, prefix string) {
+	m.Server().SetPreHook(func(c *server.Peer, name string, args ...string) bool {
+		if !strings.EqualFold(name, cmd) {
+			return false
+		}
+		for _, arg := range args {
+			if strings.HasPrefix(arg, prefix) {
+				c.WriteError("ERR injected failure")
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// ledgerOf returns the refusals of client, most recent first, once the
+// writer recorded n of them
+func ledgerOf(t *testing.T, m *miniredis.Miniredis, client string, n int) []Refusal {
+	t.Helper()
+	key := REDIS_REFUSALS_KEY_PREFIX + client
+	eventually(t, "the refusals of "+client, func() bool {
+		entries, _ := m.List(key)
+		return len(entries) >= n
+	})
+	entries, _ := m.List(key)
+	refusals := make([]Refusal, len(entries))
+	for i, e := range entries {
+		if err := json.Unmarshal([]byte(e), &refusals[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return refusals
+}
+
+func TestRefusalLedger(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.45.10", "10.0.45.12", "1h", "roaming=hold")
+	const pool = "10.0.45.10-10.0.45.12"
+	mac := func(last byte) string { return net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, last}.String() }
+	discover := func(mac string) *dhcpv4.DHCPv4 {
+		return exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac))
+	}
+	outside := dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(192, 0, 2, 9)))
+
+	for _, tc := range []struct {
+		name, mac string
+		// refuse has the client refused, and reports whether it was answered
+		refuse func(mac string) *dhcpv4.DHCPv4
+		reason string
+	}{
+		{"denied", mac(0x0a), func(mac string) *dhcpv4.DHCPv4 {
+			m.SAdd(REDIS_DENY_KEY, mac)
+			return discover(mac)
+		}, ReasonDenied},
+		{"NAK", mac(0x0b), func(mac string) *dhcpv4.DHCPv4 {
+			return exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac, outside))
+		}, ReasonRequestedRefused},
+		{"storage error", mac(0x0c), func(mac string) *dhcpv4.DHCPv4 {
+			failCommands(m, "GET", keyPrefix(p, "main")+mac)
+			defer m.Server().SetPreHook(nil)
+			return discover(mac)
+		}, ReasonStorageError},
+		{"commit failed", mac(0x0d), func(mac string) *dhcpv4.DHCPv4 {
+			failCommands(m, "EVALSHA", keyPrefix(p, "main")+mac)
+			defer m.Server().SetPreHook(nil)
+			return discover(mac)
+		}, ReasonCommitFailed},
+		{"roaming hold", mac(0x0e), func(mac string) *dhcpv4.DHCPv4 {
+			ip := leaseThrough(t, p, mac, relayA)
+			return requestThrough(t, p, mac, ip, relayB)
+		}, ReasonRoamingHold},
+		{"exhausted", mac(0x0f), func(mac string) *dhcpv4.DHCPv4 {
+			lease(t, p, mac[:15]+"1f")
+			lease(t, p, mac[:15]+"2f")
+			return discover(mac)
+		}, ReasonPoolExhausted},
+	} {
+		resp := tc.refuse(tc.mac)
+		if resp != nil && resp.MessageType() != dhcpv4.MessageTypeNak {
+			t.Errorf("%s: answered %s", tc.name, resp.MessageType())
+		}
+		refusals := ledgerOf(t, m, tc.mac, 1)
+		if len(refusals) != 1 {
+			t.Errorf("%s: %d refusals recorded, want 1: %+v", tc.name, len(refusals), refusals)
+			continue
+		}
+		if ref := refusals[0]; ref.Client != tc.mac || ref.Reason != tc.reason || ref.Pool != pool || ref.Time.IsZero() {
+			t.Errorf("%s: refusal %+v, want reason %s", tc.name, ref, tc.reason)
+		}
+	}
+
+	// a NAK repeated too soon is dropped instead
+	if resp := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac(0x0b), outside)); resp != nil {
+		t.Errorf("NAK repeated too soon answered %s", resp.MessageType())
+	}
+	if refusals := ledgerOf(t, m, mac(0x0b), 2); len(refusals) != 2 || refusals[0].Reason != ReasonRateLimited {
+		t.Errorf("refusals after a repeated NAK %+v", refusals)
+	}
+
+	st := p.Stats().Refusals
+	for reason, n := range map[string]uint64{ReasonDenied: 1, ReasonRequestedRefused: 1, ReasonRateLimited: 1, ReasonStorageError: 1,
+		ReasonCommitFailed: 1, ReasonRoamingHold: 1, ReasonPoolExhausted: 1} {
+		if st.Reasons[reason] != n {
+			t.Errorf("%d refusals for %s, want %d", st.Reasons[reason], reason, n)
+		}
+	}
+	if len(st.Reasons) != 7 || st.Dropped != 0 {
+		t.Errorf("refusals %s", st)
+	}
+	refusals, err := p.Refusals(context.Background(), strings.ToUpper(mac(0x0a)))
+	if err != nil || len(refusals) != 1 || refusals[0].Reason != ReasonDenied {
+		t.Errorf("Refusals of %s: %+v, %v", mac(0x0a), refusals, err)
+	}
+}
+
+func TestRefusalLedger6(t *testing.T) {
+	m := miniredis.RunT(t)
+	h := startPlugin6(t, m, "2001:db8:45::10", "2001:db8:45::11", "1h", "propagate_policy=true")
+	const a, b, c = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c"
+	duid := func(mac string) string { return hex.EncodeToString(duidOf(t, mac).ToBytes()) }
+
+	// the denylist applies once the DUID is correlated with the MAC
+	leased6(t, exchange6(t, h, dhcpv6.MessageTypeRequest, a))
+	m.SAdd(REDIS_DENY_KEY, c)
+	eventually(t, "the denial", func() bool { return exchange6(t, h, dhcpv6.MessageTypeSolicit, c) == nil })
+	exchange6(t, h, dhcpv6.MessageTypeRequest, b)
+	for client, reason := range map[string]string{b: ReasonPoolExhausted, c: ReasonDenied} {
+		refusals := ledgerOf(t, m, duid(client), 1)
+		if len(refusals) != 1 || refusals[0].Reason != reason || refusals[0].Pool != "2001:db8:45::10-2001:db8:45::11" {
+			t.Errorf("refusals of %s %+v, want one for %s", client, refusals, reason)
+		}
+	}
+	if m.Exists(REDIS_REFUSALS_KEY_PREFIX + duid(a)) {
+		t.Errorf("refusal recorded for the client served")
+	}
+}
@@ -0,0 +1,53 @@
+package rangeredisplugin
+
+import "time"
+
+// default time a new allocation waits for a slot of the slow path limiter
+const defaultSlowPathWait = 100 * time.Millisecond
+
+// slowPathLimiter bounds the number of new allocations in progress, which
+// may probe DNS and retry on redis, so that a burst of them does not hold
+// every handler goroutine of the server. Renewals do not go through it.
+type slowPathLimiter struct {
+	slots chan struct{}
+}
+
+func newSlowPathLimiter(n int) slowPathLimiter {
+	if n == 0 {
+		return slowPathLimiter{}
+	}
+	return slowPathLimiter{slots: make(chan struct{}, n)}
+}
+
+// acquire takes a slot, waiting at most wait. Returns false if none freed
+// up in time; an unbounded limiter always succeeds.
+func (l slowPathLimiter) acquire(wait time.Duration) bool {
+	if l.slots == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// release returns a slot taken by acquire
+func (l slowPathLimiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// inUse returns the number of slots taken
+func (l slowPathLimiter) inUse() int {
+	return len(l.slots)
+}
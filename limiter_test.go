@@ -0,0 +1,101 @@
+package rangeredisplugin
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// stall makes m hold the scripts naming mac, such as the commit of its
+// allocations, until the returned function is first called
+func stall(m *miniredis.Miniredis, mac string) func() {
+	unblock := make(chan struct{})
+	m.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd != "EVALSHA" && cmd != "EVAL" {
+			return false
+		}
+		for _, arg := range args {
+			if strings.Contains(arg, mac) {
+				<-unblock
+				break
+			}
+		}
+		return false
+	})
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.Server().SetPreHook(nil)
+			close(unblock)
+		})
+	}
+}
+
+func TestSlowPathLimit(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.22.10", "10.0.22.20", "1h", "slow_path_limit=1", "slow_path_wait=200ms")
+	const renewing, slow = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+	ip := lease(t, p, renewing)
+
+	// a new allocation stuck on slow storage takes the only slot
+	resume := stall(m, slow)
+	defer resume()
+	req := newRequest(t, dhcpv4.MessageTypeDiscover, slow)
+	resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan *dhcpv4.DHCPv4)
+	go func() {
+		out, _ := p.Handler4(req, resp)
+		done <- out
+	}()
+	eventually(t, "the slot taken", func() bool { return p.slowPath.inUse() == 1 })
+
+	// other new allocations are refused after the wait
+	start := time.Now()
+	if offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, "00:11:22:33:44:0c")); offer != nil {
+		t.Errorf("offer of %s with the limiter saturated", offer.YourIPAddr)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("allocation refused after %s, want the wait of 200ms", elapsed)
+	}
+
+	// renewals bypass the limiter
+	start = time.Now()
+	if typ := renewal(t, p, renewing, ip); typ != dhcpv4.MessageTypeAck {
+		t.Errorf("renewal answered %s with the limiter saturated", typ)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("renewal took %s with the limiter saturated", elapsed)
+	}
+
+	if s := p.Stats(); s.SlowPathInUse != 1 || s.SlowPathRejected != 1 {
+		t.Errorf("stats: %d slow path slots in use and %d rejected, want 1 and 1", s.SlowPathInUse, s.SlowPathRejected)
+	}
+
+	resume()
+	if offer := <-done; offer == nil {
+		t.Error("no offer once the storage resumed")
+	}
+	if n := p.slowPath.inUse(); n != 0 {
+		t.Errorf("%d slots in use after the allocation", n)
+	}
+}
+
+func TestSlowPathUnlimited(t *testing.T) {
+	l := newSlowPathLimiter(0)
+	for i := 0; i < 100; i++ {
+		if !l.acquire(0) {
+			t.Fatal("unbounded limiter refused a slot")
+		}
+	}
+	if n := l.inUse(); n != 0 {
+		t.Errorf("unbounded limiter reports %d slots in use", n)
+	}
+}
@@ -0,0 +1,168 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+const (
+	// number of keys per category passed to MEMORY USAGE
+	memorySampleSize = 64
+	// minimum time between two sampling runs
+	memorySampleInterval = 5 * time.Minute
+)
+
+// ErrMemoryUnsupported is returned when the server does not implement MEMORY USAGE
+var ErrMemoryUnsupported = errors.New("redis server does not support the MEMORY command")
+
+// MemoryCategory holds the estimated memory usage of one family of keys
+type MemoryCategory struct {
+	Keys           int64
+	Sampled        int64
+	SampledBytes   int64
+	EstimatedBytes int64
+}
+
+// AverageBytes returns the mean memory usage of a single key in the category
+func (c MemoryCategory) AverageBytes() int64 {
+	if c.Sampled == 0 {
+		return 0
+	}
+	return c.SampledBytes / c.Sampled
+}
+
+// MemoryReport is the result of one sampling run over the plugin's keyspace
+type MemoryReport struct {
+	Time       time.Time
+	Categories map[string]MemoryCategory
+}
+
+// TotalBytes returns the extrapolated memory usage of all categories
+func (m *MemoryReport) TotalBytes() int64 {
+	var total int64
+	for _, c := range m.Categories {
+		total += c.EstimatedBytes
+	}
+	return total
+}
+
+// PerRecordBytes returns the average cost of one lease, i.e. one main key
+// plus its shadow key.
+func (m *MemoryReport) PerRecordBytes() int64 {
+	return m.Categories["main"].AverageBytes() + m.Categories["shadow"].AverageBytes()
+}
+
+type memorySampler struct {
+	mu          sync.Mutex
+	unsupported bool
+	last        *MemoryReport
+}
+
+// keyCategories maps the name of each key family owned by the plugin to its prefix
+func (r *RedisProvider) keyCategories() map[string]string {
+	categories := map[string]string{
+		"main":    r.ns.main,
+		"shadow":  r.ns.shadow,
+		"reverse": r.ns.index,
+	}
+	if r.history == r.rdb {
+		categories["history"] = r.ns.history
+	}
+	return categories
+}
+
+// LastMemoryReport returns the most recent memory report, or nil if none is available.
+func (r *RedisProvider) LastMemoryReport() *MemoryReport {
+	r.mem.mu.Lock()
+	defer r.mem.mu.Unlock()
+	return r.mem.last
+}
+
+// MemoryUsage samples MEMORY USAGE over a bounded random subset of the keys of
+// every category and extrapolates the totals. Runs are throttled: within
+// memorySampleInterval of the previous run, the cached report is returned.
+func (r *RedisProvider) MemoryUsage(ctx context.Context) (*MemoryReport, error) {
+	r.mem.mu.Lock()
+	defer r.mem.mu.Unlock()
+
+	if r.mem.unsupported {
+		return nil, ErrMemoryUnsupported
+	}
+	if r.mem.last != nil && time.Since(r.mem.last.Time) < memorySampleInterval {
+		return r.mem.last, nil
+	}
+
+	report := &MemoryReport{
+		Time:       time.Now(),
+		Categories: make(map[string]MemoryCategory),
+	}
+	for name, prefix := range r.keyCategories() {
+		cat, err := r.sampleCategory(ctx, prefix)
+		if err != nil {
+			if isUnknownCommand(err) {
+				log.Warn("MEMORY command is not supported by redis, memory accounting disabled")
+				r.mem.unsupported = true
+				return nil, ErrMemoryUnsupported
+			}
+			return nil, err
+		}
+		report.Categories[name] = cat
+	}
+
+	r.mem.last = report
+	return report, nil
+}
+
+func (r *RedisProvider) sampleCategory(ctx context.Context, prefix string) (MemoryCategory, error) {
+	var (
+		cat    MemoryCategory
+		sample []string
+		cursor uint64
+	)
+
+	// reservoir-sample the keys while counting them
+	for {
+		keys, next, err := r.rdb.Scan(ctx, cursor, prefix+"*", 1000).Result()
+		if err != nil {
+			return cat, err
+		}
+		for _, key := range keys {
+			cat.Keys++
+			if len(sample) < memorySampleSize {
+				sample = append(sample, key)
+			} else if i := rand.Int63n(cat.Keys); i < memorySampleSize {
+				sample[i] = key
+			}
+		}
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+
+	for _, key := range sample {
+		size, err := r.rdb.MemoryUsage(ctx, key).Result()
+		if err != nil {
+			if err == redis.Nil {
+				// key expired in the meantime
+				continue
+			}
+			return cat, err
+		}
+		cat.Sampled++
+		cat.SampledBytes += size
+	}
+	cat.EstimatedBytes = cat.AverageBytes() * cat.Keys
+
+	return cat, nil
+}
+
+func isUnknownCommand(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "unknown command")
+}
@@ -0,0 +1,92 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+)
+
+func TestMemoryUsage(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.9.0.0/16", "1h")
+	const n = 100
+	for i := 0; i < n; i++ {
+		mac := fmt.Sprintf("00:11:22:33:%02x:%02x", i/256, i%256)
+		if err := p.storage.SaveRecord(mac, boundRecord(fmt.Sprintf("10.9.0.%d", 1+i), time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// past the throttle of the sampling at setup
+	p.storage.mem.last.Time = time.Now().Add(-memorySampleInterval)
+
+	report, err := p.storage.MemoryUsage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"main", "shadow"} {
+		c := report.Categories[name]
+		if c.Keys != n || c.Sampled != memorySampleSize || c.SampledBytes <= 0 || c.EstimatedBytes != c.AverageBytes()*n {
+			t.Errorf("%s keys: %+v", name, c)
+		}
+	}
+	if report.PerRecordBytes() <= 0 || report.TotalBytes() < report.Categories["main"].EstimatedBytes {
+		t.Errorf("%d bytes per record, %d in total", report.PerRecordBytes(), report.TotalBytes())
+	}
+	if p.Stats().Memory != report || p.storage.LastMemoryReport() != report {
+		t.Error("report not kept for the stats")
+	}
+
+	// runs within the interval return the last report
+	if again, err := p.storage.MemoryUsage(context.Background()); err != nil || again != report {
+		t.Errorf("throttled run sampled again: %v", err)
+	}
+
+	// the startup report gives the cost of a lease, to size a larger pool
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	logs := captureLog(t)
+	startPlugin(t, m, "10.9.0.0/16", "1h")
+	if !logs.logged("bytes per lease record") {
+		t.Error("no cost of a lease at startup")
+	}
+}
+
+func TestMemoryUsageUnsupported(t *testing.T) {
+	m := miniredis.RunT(t)
+	var calls atomic.Int32
+	m.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if !strings.EqualFold(cmd, "MEMORY") {
+			return false
+		}
+		calls.Add(1)
+		c.WriteError("ERR unknown command 'MEMORY'")
+		return true
+	})
+	p := startPlugin(t, m, "10.9.0.0/16", "1h")
+	if err := p.storage.SaveRecord("00:11:22:33:44:55", boundRecord("10.9.0.1", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// the sampling at setup found no key to pass to MEMORY
+	p.storage.mem.last = nil
+
+	// the sampling is given up for good at the first refusal
+	for i := 0; i < 2; i++ {
+		if _, err := p.storage.MemoryUsage(context.Background()); !errors.Is(err, ErrMemoryUnsupported) {
+			t.Errorf("run %d: %v", i, err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("MEMORY sent %d times", n)
+	}
+	if p.Stats().Memory != nil {
+		t.Error("memory report without MEMORY")
+	}
+}
@@ -0,0 +1,102 @@
+package rangeredisplugin
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// keySpace holds the keys of a namespace: the prefixes of the main key, the
+// shadow key and the reverse index entry of the records, and the keys of
+// the state kept per instance. Instances sharing a redis database with
+// different namespaces never see each other's records nor state. The
+// default namespace dhcp: names the keys as before namespaces existed.
+type keySpace struct {
+	main, shadow, index string
+	// override prefixes the lease time overrides of the clients
+	override string
+	// journal, cooldown, ramp, handover and snapshot are the keys of the
+	// state of the same name, split and splitMoved those of a pool split,
+	// and quarantine, circuit and kill prefix the quarantined addresses,
+	// the circuits and the kill switches
+	journal, cooldown, ramp   string
+	handover, snapshot        string
+	split, splitMoved         string
+	quarantine, circuit, kill string
+	// freeze and frozen are the freeze set and the bindings it froze,
+	// leaseLimit and leaseCounts the limit of the active leases and their
+	// counts, export, extend and backfill the checkpoints of the runs of
+	// the same name
+	freeze, frozen           string
+	leaseLimit, leaseCounts  string
+	export, extend, backfill string
+	// link prefixes the links to the DHCPv6 leases, history the past
+	// bindings of the clients
+	link, history string
+}
+
+func newKeySpace(prefix string) keySpace {
+	return keySpace{
+		main:       prefix,
+		shadow:     "s:" + prefix,
+		index:      "i:" + prefix,
+		override:   "o:" + prefix + "leasetime:",
+		journal:    "j:" + prefix + "journal",
+		cooldown:   "c:" + prefix + "cooldown",
+		ramp:       "x:" + prefix + "ramp",
+		handover:   "x:" + prefix + "handover",
+		snapshot:   "x:" + prefix + "snapshot",
+		split:      "x:" + prefix + "split",
+		splitMoved: "x:" + prefix + "split:moved",
+		quarantine: "q:" + prefix,
+		circuit:    "x:" + prefix + "circuit:",
+		kill:       "x:" + prefix + "kill",
+
+		freeze:      "x:" + prefix + "freeze",
+		frozen:      "x:" + prefix + "frozen",
+		leaseLimit:  "x:" + prefix + "lease-limit",
+		leaseCounts: "x:" + prefix + "lease-counts",
+		export:      "x:" + prefix + "export",
+		extend:      "x:" + prefix + "extend",
+		backfill:    "x:" + prefix + "backfill",
+		link:        "x:" + prefix + "link:",
+		history:     "h:" + prefix,
+	}
+}
+
+var defaultKeySpace = newKeySpace(REDIS_KEY_PREFIX)
+
+// reservedNamespaces are the first segments of the other keys of the
+// plugin, which a namespace must not take
+var reservedNamespaces = map[string]bool{
+	"c": true, "h": true, "i": true, "j": true, "l": true, "o": true, "q": true,
+	"r": true, "s": true, "t": true, "x": true, "dhcp6": true, "dhcp6pd": true,
+}
+
+// parseNamespace parses the name of a namespace, e.g. site-a, into the
+// prefix of its main keys, site-a:
+func parseNamespace(val string) (string, error) {
+	name := strings.TrimSuffix(val, ":")
+	if name == "" || strings.IndexFunc(name, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.')
+	}) >= 0 {
+		return "", fmt.Errorf("invalid prefix %q, want letters, digits, '-', '_' or '.'", val)
+	}
+	if reservedNamespaces[name] {
+		return "", fmt.Errorf("prefix %q is used by other keys of the plugin", val)
+	}
+	return name + ":", nil
+}
+
+// recordKey reports whether key is the main, shadow or index key of a
+// record, or a quarantined address, of any namespace
+func recordKey(key string) bool {
+	for _, p := range []string{"i:", "q:"} {
+		if rest, ok := strings.CutPrefix(key, p); ok {
+			_, ip, ok := strings.Cut(rest, ":")
+			return ok && net.ParseIP(ip) != nil
+		}
+	}
+	_, mac, ok := strings.Cut(strings.TrimPrefix(key, "s:"), ":")
+	return ok && validClientKey(mac)
+}
@@ -0,0 +1,159 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestNewKeySpaceDefault(t *testing.T) {
+	ns := defaultKeySpace
+	for got, want := range map[string]string{
+		ns.main:                         REDIS_KEY_PREFIX,
+		ns.shadow:                       REDIS_SHADOW_KEY_PREFIX,
+		ns.index:                        REDIS_INDEX_KEY_PREFIX,
+		ns.override:                     REDIS_LEASE_TIME_KEY_PREFIX,
+		ns.journal:                      REDIS_JOURNAL_KEY,
+		ns.cooldown:                     REDIS_COOLDOWN_KEY,
+		ns.quarantine:                   REDIS_QUARANTINE_KEY_PREFIX,
+		ns.circuit:                      REDIS_CIRCUIT_KEY_PREFIX,
+		ns.kill:                         REDIS_KILL_KEY,
+		ns.ramp:                         REDIS_RAMP_KEY,
+		ns.handover:                     REDIS_HANDOVER_KEY,
+		ns.snapshot:                     REDIS_SNAPSHOT_KEY,
+		ns.split:                        REDIS_SPLIT_KEY,
+		ns.splitMoved:                   REDIS_SPLIT_MOVED_KEY,
+		ns.freeze:                       REDIS_FREEZE_KEY,
+		ns.frozen:                       REDIS_FROZEN_KEY,
+		ns.leaseLimit:                   REDIS_LEASE_LIMIT_KEY,
+		ns.leaseCounts:                  REDIS_LEASE_COUNTS_KEY,
+		ns.export:                       REDIS_EXPORT_STATE_KEY,
+		ns.extend:                       REDIS_EXTEND_STATE_KEY,
+		ns.backfill:                     REDIS_BACKFILL_STATE_KEY,
+		ns.link:                         REDIS_LINK_KEY_PREFIX,
+		ns.history:                      REDIS_HISTORY_KEY_PREFIX,
+		ns.killKey("10.0.0.1-10.0.0.9"): REDIS_KILL_KEY + ":10.0.0.1-10.0.0.9",
+	} {
+		if got != want {
+			t.Errorf("default namespace names %q, want %q", got, want)
+		}
+	}
+}
+
+func TestNamespacesKeepTheirState(t *testing.T) {
+	m := miniredis.RunT(t)
+	a := startPlugin(t, m, "10.0.0.10", "10.0.0.20", "1h", "prefix=site-a")
+	b := startPlugin(t, m, "10.0.0.30", "10.0.0.40", "1h", "prefix=site-b")
+	ctx := context.Background()
+	ip := net.IPv4(10, 0, 0, 12).To4()
+
+	if _, err := a.storage.Quarantine(ip, "00:11:22:33:44:55", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.storage.AddCooldown(ip, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.storage.JournalFree(ctx, "00:11:22:33:44:55", ip); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.storage.SetKillSwitch(ctx, &KillSwitch{Scope: KillGlobal}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.storage.BeginHandover(ctx, a.poolName(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"q:site-a:10.0.0.12", "c:site-a:cooldown", "j:site-a:journal", "x:site-a:kill", "x:site-a:handover:10.0.0.10-10.0.0.20"} {
+		if !m.Exists(key) {
+			t.Errorf("%s not written", key)
+		}
+	}
+
+	if ips, err := b.storage.QuarantinedIPs(ctx); err != nil || len(ips) != 0 {
+		t.Errorf("site-b sees the quarantine of site-a: %v, %v", ips, err)
+	}
+	if global, _, err := b.storage.LoadKillSwitches(ctx, b.poolName()); err != nil || global != nil {
+		t.Errorf("site-b sees the kill switch of site-a: %v, %v", global, err)
+	}
+	if err := b.storage.BeginHandover(ctx, a.poolName(), "b"); err != nil {
+		t.Errorf("site-b blocked by the handover of site-a: %v", err)
+	}
+
+	b.handleExpired("q:site-a:10.0.0.12")
+	if b.counters.ignoredNotifications.Load() != 0 {
+		t.Error("quarantine of another namespace counted as a foreign key")
+	}
+}
+
+func TestNamespacesKeepTheirRuns(t *testing.T) {
+	m := miniredis.RunT(t)
+	a := startPlugin(t, m, "10.0.85.10", "10.0.85.20", "1h", "prefix=site-a")
+	b := startPlugin(t, m, "10.0.85.30", "10.0.85.40", "1h", "prefix=site-b")
+	ctx := context.Background()
+	mac := "00:11:22:33:44:55"
+	ip := net.IPv4(10, 0, 85, 12).To4()
+
+	m.SAdd("x:site-a:freeze", ip.String())
+	if err := a.storage.Freeze(ctx, &FrozenBinding{IP: ip, MAC: mac}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.storage.SetLeaseLimit(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.storage.SyncLeaseCount(ctx, "a", 3, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{a.storage.ns.export, a.storage.ns.extend, a.storage.ns.backfill} {
+		if err := a.storage.saveCheckpoint(ctx, key, exportState{Cursor: 7}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.storage.AppendHistory(mac, ip, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.storage.SetLink(ctx, mac, "00:01:00:01", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{
+		"x:site-a:frozen", "x:site-a:lease-limit", "x:site-a:lease-counts",
+		"x:site-a:export", "x:site-a:extend", "x:site-a:backfill",
+		"h:site-a:" + mac, "x:site-a:link:" + mac,
+	} {
+		if !m.Exists(key) {
+			t.Errorf("%s not written", key)
+		}
+	}
+
+	if ips, err := a.storage.FreezeList(ctx); err != nil || len(ips) != 1 {
+		t.Errorf("site-a lost its freeze set: %v, %v", ips, err)
+	}
+	if ips, err := b.storage.FreezeList(ctx); err != nil || len(ips) != 0 {
+		t.Errorf("site-b sees the freeze set of site-a: %v, %v", ips, err)
+	}
+	if frozen, err := b.storage.FrozenBindings(ctx); err != nil || len(frozen) != 0 {
+		t.Errorf("site-b sees the frozen bindings of site-a: %v, %v", frozen, err)
+	}
+	if n, err := b.storage.LeaseLimit(ctx); err != nil || n != 0 {
+		t.Errorf("site-b sees the lease limit of site-a: %d, %v", n, err)
+	}
+	if n, err := b.storage.ActiveLeases(ctx, []string{"a"}); err != nil || n != 0 {
+		t.Errorf("site-b counts the leases of site-a: %d, %v", n, err)
+	}
+	for _, key := range []string{b.storage.ns.export, b.storage.ns.extend, b.storage.ns.backfill} {
+		var st exportState
+		if resumed, err := b.storage.loadCheckpoint(ctx, key, &st); err != nil || resumed {
+			t.Errorf("site-b resumes the checkpoint %s of site-a: %v", key, err)
+		}
+	}
+	if bindings, err := a.storage.LatestBindings(ctx, 10); err != nil || !bindings[mac].Equal(ip) {
+		t.Errorf("site-a lost its history: %v, %v", bindings, err)
+	}
+	if bindings, err := b.storage.LatestBindings(ctx, 10); err != nil || len(bindings) != 0 {
+		t.Errorf("site-b sees the history of site-a: %v, %v", bindings, err)
+	}
+	if links, err := b.storage.Links(ctx, mac); err != nil || links[0] != "" {
+		t.Errorf("site-b sees the links of site-a: %v, %v", links, err)
+	}
+}
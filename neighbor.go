@@ -0,0 +1,54 @@
+package rangeredisplugin
+
+import "net"
+
+// NeighborAction tells a NeighborHook what happened to a binding
+type NeighborAction int
+
+const (
+	// NeighborAdd is passed when a lease is granted
+	NeighborAdd NeighborAction = iota
+	// NeighborRefresh is passed when a lease is renewed
+	NeighborRefresh
+	// NeighborDelete is passed when a lease is freed
+	NeighborDelete
+)
+
+func (a NeighborAction) String() string {
+	switch a {
+	case NeighborAdd:
+		return "add"
+	case NeighborRefresh:
+		return "refresh"
+	case NeighborDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// NeighborHook is invoked with every binding change, e.g. to pre-populate the
+// ARP table of an access router. It runs on its own event queue, so its
+// failures never affect the DHCP answer. Register it with RegisterEventSink.
+type NeighborHook func(mac net.HardwareAddr, ip net.IP, action NeighborAction)
+
+// HandleEvent makes a NeighborHook usable as an EventSink
+func (h NeighborHook) HandleEvent(ev Event) {
+	mac, err := net.ParseMAC(ev.MAC)
+	if err != nil {
+		return
+	}
+
+	switch ev.Type {
+	case EventGrant:
+		h(mac, ev.IP, NeighborAdd)
+	case EventRenew:
+		h(mac, ev.IP, NeighborRefresh)
+	case EventExpire, EventExcluded, EventConflict:
+		h(mac, ev.IP, NeighborDelete)
+	case EventExternalReassignment:
+		if ev.PreviousIP != nil && !ev.PreviousIP.Equal(ev.IP) {
+			h(mac, ev.PreviousIP, NeighborDelete)
+		}
+		h(mac, ev.IP, NeighborAdd)
+	}
+}
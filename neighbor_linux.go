@@ -0,0 +1,140 @@
+//go:build linux
+
+package rangeredisplugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// neighbor table constants from linux/neighbour.h
+const (
+	ndaDst        = 1
+	ndaLLAddr     = 2
+	nudStale      = 0x04
+	sizeofNdMsg   = 12
+	sizeofRtAttr  = 4
+	netlinkBufLen = 4096
+)
+
+// netlinkNeighbors writes the neighbor entries of one interface via rtnetlink.
+// Writing requires CAP_NET_ADMIN.
+type netlinkNeighbors struct {
+	mu      sync.Mutex
+	fd      int
+	seq     uint32
+	ifindex int
+}
+
+// newNeighborWriter returns a NeighborHook maintaining the ARP entries of
+// the granted leases on the interface ifname.
+func newNeighborWriter(ifname string) (NeighborHook, error) {
+	ifi, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("could not open netlink socket: %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("could not bind netlink socket: %w", err)
+	}
+
+	n := &netlinkNeighbors{fd: fd, ifindex: ifi.Index}
+	return n.update, nil
+}
+
+func (n *netlinkNeighbors) update(mac net.HardwareAddr, ip net.IP, action NeighborAction) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.seq++
+	msg := neighborMessage(n.ifindex, mac, ip, action, n.seq)
+	if err := syscall.Sendto(n.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		log.Warnf("neighbor: could not %s entry %s %s: %v", action, ip, mac, err)
+		return
+	}
+	if err := n.readAck(); err != nil && !(action == NeighborDelete && err == syscall.ENOENT) {
+		log.Warnf("neighbor: could not %s entry %s %s: %v", action, ip, mac, err)
+	}
+}
+
+// readAck waits for the kernel acknowledgement of the last request
+func (n *netlinkNeighbors) readAck() error {
+	buf := make([]byte, netlinkBufLen)
+	for {
+		nr, _, err := syscall.Recvfrom(n.fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:nr])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != n.seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return syscall.EINVAL
+			}
+			if errno := -int32(binary.NativeEndian.Uint32(m.Data[:4])); errno != 0 {
+				return syscall.Errno(errno)
+			}
+			return nil
+		}
+	}
+}
+
+// neighborMessage builds an RTM_NEWNEIGH (or RTM_DELNEIGH for deletions)
+// request for ip and mac on the interface ifindex.
+func neighborMessage(ifindex int, mac net.HardwareAddr, ip net.IP, action NeighborAction, seq uint32) []byte {
+	msgType := uint16(syscall.RTM_NEWNEIGH)
+	flags := uint16(syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE)
+	state := uint16(nudStale)
+	if action == NeighborDelete {
+		msgType = syscall.RTM_DELNEIGH
+		flags = syscall.NLM_F_REQUEST | syscall.NLM_F_ACK
+		state = 0
+	}
+
+	b := make([]byte, syscall.SizeofNlMsghdr, 64)
+	ne := binary.NativeEndian
+
+	// struct ndmsg
+	nd := make([]byte, sizeofNdMsg)
+	nd[0] = syscall.AF_INET
+	ne.PutUint32(nd[4:8], uint32(ifindex))
+	ne.PutUint16(nd[8:10], state)
+	b = append(b, nd...)
+
+	b = appendAttr(b, ndaDst, ip.To4())
+	if action != NeighborDelete {
+		b = appendAttr(b, ndaLLAddr, mac)
+	}
+
+	ne.PutUint32(b[0:4], uint32(len(b)))
+	ne.PutUint16(b[4:6], msgType)
+	ne.PutUint16(b[6:8], flags)
+	ne.PutUint32(b[8:12], seq)
+	return b
+}
+
+// appendAttr appends a 4-byte aligned rtattr to b
+func appendAttr(b []byte, typ uint16, data []byte) []byte {
+	hdr := make([]byte, sizeofRtAttr)
+	binary.NativeEndian.PutUint16(hdr[0:2], uint16(sizeofRtAttr+len(data)))
+	binary.NativeEndian.PutUint16(hdr[2:4], typ)
+	b = append(b, hdr...)
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,81 @@
+//go:build linux
+
+package rangeredisplugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestNeighborMessage(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	ip := net.IPv4(192, 0, 2, 10)
+	for _, tc := range []struct {
+		action NeighborAction
+		typ    uint16
+		flags  uint16
+		state  uint16
+		attrs  map[uint16][]byte
+	}{
+		{NeighborAdd, syscall.RTM_NEWNEIGH,
+			syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE, nudStale,
+			map[uint16][]byte{ndaDst: ip.To4(), ndaLLAddr: mac}},
+		{NeighborRefresh, syscall.RTM_NEWNEIGH,
+			syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE, nudStale,
+			map[uint16][]byte{ndaDst: ip.To4(), ndaLLAddr: mac}},
+		{NeighborDelete, syscall.RTM_DELNEIGH,
+			syscall.NLM_F_REQUEST | syscall.NLM_F_ACK, 0,
+			map[uint16][]byte{ndaDst: ip.To4()}},
+	} {
+		b := neighborMessage(7, mac, ip, tc.action, 42)
+		msgs, err := syscall.ParseNetlinkMessage(b)
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("%s: %d messages, %v", tc.action, len(msgs), err)
+		}
+		h := msgs[0].Header
+		if int(h.Len) != len(b) || h.Type != tc.typ || h.Flags != tc.flags || h.Seq != 42 {
+			t.Errorf("%s: header %+v, want type %d flags %#x seq 42 len %d", tc.action, h, tc.typ, tc.flags, len(b))
+		}
+
+		nd := msgs[0].Data[:sizeofNdMsg]
+		ne := binary.NativeEndian
+		if nd[0] != syscall.AF_INET || ne.Uint32(nd[4:8]) != 7 || ne.Uint16(nd[8:10]) != tc.state {
+			t.Errorf("%s: ndmsg % x, want family inet, ifindex 7, state %#x", tc.action, nd, tc.state)
+		}
+
+		attrs := msgs[0].Data[sizeofNdMsg:]
+		got := make(map[uint16][]byte)
+		for len(attrs) > 0 {
+			l := ne.Uint16(attrs[0:2])
+			got[ne.Uint16(attrs[2:4])] = attrs[sizeofRtAttr:l]
+			// attributes are 4-byte aligned
+			l = (l + 3) &^ 3
+			if int(l) > len(attrs) {
+				t.Fatalf("%s: attribute overruns the message", tc.action)
+			}
+			attrs = attrs[l:]
+		}
+		if len(got) != len(tc.attrs) {
+			t.Errorf("%s: %d attributes, want %d", tc.action, len(got), len(tc.attrs))
+		}
+		for typ, want := range tc.attrs {
+			if !bytes.Equal(got[typ], want) {
+				t.Errorf("%s: attribute %d = % x, want % x", tc.action, typ, got[typ], want)
+			}
+		}
+	}
+}
+
+func TestAppendAttrPads(t *testing.T) {
+	b := appendAttr(nil, ndaLLAddr, []byte{1, 2, 3, 4, 5, 6})
+	want := make([]byte, 12)
+	binary.NativeEndian.PutUint16(want[0:2], 10)
+	binary.NativeEndian.PutUint16(want[2:4], ndaLLAddr)
+	copy(want[4:], []byte{1, 2, 3, 4, 5, 6})
+	if !bytes.Equal(b, want) {
+		t.Errorf("appendAttr = % x, want % x", b, want)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package rangeredisplugin
+
+import "errors"
+
+func newNeighborWriter(ifname string) (NeighborHook, error) {
+	return nil, errors.New("neighbor table updates are only supported on linux")
+}
@@ -0,0 +1,99 @@
+package rangeredisplugin
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// neighborCalls records the calls of a NeighborHook as "action ip mac"
+type neighborCalls struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (n *neighborCalls) hook(mac net.HardwareAddr, ip net.IP, action NeighborAction) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.calls = append(n.calls, fmt.Sprintf("%s %s %s", action, ip, mac))
+}
+
+func (n *neighborCalls) get() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string(nil), n.calls...)
+}
+
+func TestNeighborHookDispatch(t *testing.T) {
+	const mac = "00:11:22:33:44:55"
+	ip, prev := net.IPv4(10, 3, 0, 10), net.IPv4(10, 3, 0, 11)
+	for _, tc := range []struct {
+		ev   Event
+		want []string
+	}{
+		{Event{Type: EventGrant, MAC: mac, IP: ip}, []string{"add 10.3.0.10 " + mac}},
+		{Event{Type: EventRenew, MAC: mac, IP: ip}, []string{"refresh 10.3.0.10 " + mac}},
+		{Event{Type: EventExpire, MAC: mac, IP: ip}, []string{"delete 10.3.0.10 " + mac}},
+		{Event{Type: EventExcluded, MAC: mac, IP: ip}, []string{"delete 10.3.0.10 " + mac}},
+		{Event{Type: EventConflict, MAC: mac, IP: ip}, []string{"delete 10.3.0.10 " + mac}},
+		{Event{Type: EventExternalReassignment, MAC: mac, IP: ip, PreviousIP: prev},
+			[]string{"delete 10.3.0.11 " + mac, "add 10.3.0.10 " + mac}},
+		// a rewrite rejected keeps the entry
+		{Event{Type: EventExternalReassignment, MAC: mac, IP: ip, PreviousIP: ip}, []string{"add 10.3.0.10 " + mac}},
+		{Event{Type: EventOffer, MAC: mac, IP: ip}, nil},
+		{Event{Type: EventFreeze, MAC: mac, IP: ip}, nil},
+		{Event{Type: EventStorageFull}, nil},
+		// redacted identities are not MAC addresses
+		{Event{Type: EventGrant, MAC: "mac-5f3a", IP: ip}, nil},
+	} {
+		var n neighborCalls
+		NeighborHook(n.hook).HandleEvent(tc.ev)
+		if got := n.get(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s event: calls %q, want %q", tc.ev.Type, got, tc.want)
+		}
+	}
+}
+
+func TestNeighborHookFollowsTheLeases(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.3.1.10", "10.3.1.20", "1h")
+	var n neighborCalls
+	p.queuesMu.Lock()
+	p.sinks = append(p.sinks, NeighborHook(n.hook))
+	p.queuesMu.Unlock()
+
+	const mac = "00:11:22:33:44:55"
+	ip := lease(t, p, mac)
+	advance(p, time.Minute)
+	exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithClientIP(ip)))
+	expire(t, m, p, mac)
+
+	want := []string{"add " + ip.String() + " " + mac, "refresh " + ip.String() + " " + mac, "delete " + ip.String() + " " + mac}
+	eventually(t, "the neighbor updates", func() bool { return len(n.get()) >= len(want) })
+	if got := n.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("calls %q, want %q", got, want)
+	}
+}
+
+func TestFailingNeighborHookKeepsAnswering(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.3.2.10", "10.3.2.20", "1h")
+	block := make(chan struct{})
+	defer close(block)
+	p.queuesMu.Lock()
+	p.sinks = append(p.sinks,
+		NeighborHook(func(net.HardwareAddr, net.IP, NeighborAction) { panic("netlink") }),
+		NeighborHook(func(net.HardwareAddr, net.IP, NeighborAction) { <-block }))
+	p.queuesMu.Unlock()
+
+	// the hooks run on queues of their own: the handler never waits for them
+	for i := 0; i < 5; i++ {
+		lease(t, p, fmt.Sprintf("00:11:22:33:44:%02x", i))
+	}
+}
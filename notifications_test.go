@@ -0,0 +1,66 @@
+package rangeredisplugin
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestForeignExpiryNotifications(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.6.10", "10.0.6.20", "1h")
+	const mac = "00:11:22:33:44:0a"
+	ip := lease(t, p, mac)
+
+	for i, key := range []string{
+		// the shadow key prefix embedded in the keys of other applications
+		"app:s:dhcp:" + mac,
+		"s:s:dhcp:" + mac,
+		"cache:s:dhcp:",
+		// empty or malformed remainders
+		"s:dhcp:",
+		"s:dhcp:" + mac + ":extra",
+		"s:dhcp:" + mac + ":10.0.6.10",
+		"s:dhcp:00:11:22:33:44:0A",
+		"s:dhcp:00-11-22-33-44-0a",
+		"s:dhcp:00:11:22:33:44",
+		"s:dhcp:../" + mac,
+		"s:dhcp: " + mac,
+		"s:dhcp:1-",
+		"s:dhcp:01-zz",
+		"s:dhcp:256-0011",
+		// unicode garbage
+		"s:dhcp:ｍａｃ",
+		"s:dhcp:00:11:22:33:44:0ä",
+		"s:dhcp:‮" + mac,
+		"s:dhcp:\xff\xfe",
+		"\x00s:dhcp:" + mac,
+	} {
+		p.handleExpired(key)
+		if n := p.Stats().IgnoredNotifications; n != uint64(i+1) {
+			t.Errorf("%q: %d notifications ignored, want %d", key, n, i+1)
+		}
+	}
+	if holder := p.leases.macOf(ip); holder != mac {
+		t.Errorf("%s held by %q after the foreign notifications, want %s", ip, holder, mac)
+	}
+	if _, err := p.storage.GetRecord(mac); err != nil {
+		t.Errorf("record of %s lost: %v", mac, err)
+	}
+
+	// the keys of other namespaces and our other keys are not counted
+	ignored := p.Stats().IgnoredNotifications
+	for _, key := range []string{"s:site-b:" + mac, "i:site-b:10.0.6.10", "dhcp:" + mac, "i:dhcp:10.0.6.10"} {
+		p.handleExpired(key)
+	}
+	if n := p.Stats().IgnoredNotifications; n != ignored {
+		t.Errorf("%d notifications of our own keys counted as foreign", n-ignored)
+	}
+	if holder := p.leases.macOf(ip); holder != mac {
+		t.Errorf("%s held by %q after the notifications of other keys, want %s", ip, holder, mac)
+	}
+
+	// the lease still ends with its own shadow key
+	expire(t, m, p, mac)
+	eventually(t, "the expiry", func() bool { return p.leases.macOf(ip) == "" })
+}
@@ -0,0 +1,141 @@
+package rangeredisplugin
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// default time an address offered to a DISCOVER is held for the REQUEST
+// of the client
+const defaultOfferHold = 30 * time.Second
+
+// offerEntry is the last binding granted or renewed for a client
+type offerEntry struct {
+	ip      net.IP
+	expires time.Time
+	at      time.Time
+	hits    int
+}
+
+// offerCache answers the DISCOVERs of clients that were granted or renewed a
+// lease less than the offer interval ago, without going to redis
+type offerCache struct {
+	mu      sync.Mutex
+	entries map[string]*offerEntry
+	// order is the order the entries were set in, oldest first
+	order arrivals[string]
+	// limit bounds the number of clients remembered, 0 for no bound
+	limit int
+	// tolerance is the tolerance of the expiry comparisons
+	tolerance time.Duration
+}
+
+// set records that mac was granted ip until expires at now
+func (c *offerCache) set(mac string, ip net.IP, expires, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]*offerEntry)
+	}
+	if _, ok := c.entries[mac]; !ok && c.limit > 0 && len(c.entries) >= c.limit {
+		evictOldest(c.entries, &c.order)
+	}
+	c.order.set(mac)
+	c.entries[mac] = &offerEntry{ip: ip, expires: expires, at: now}
+}
+
+// get returns the binding of mac if it was recorded less than interval
+// before now, and how many times it was served from the cache so far
+func (c *offerCache) get(mac string, now time.Time, interval time.Duration) (net.IP, time.Time, int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[mac]
+	if !ok {
+		return nil, time.Time{}, 0, false
+	}
+	if now.Sub(e.at) >= interval || endsBy(e.expires, now, c.tolerance) {
+		delete(c.entries, mac)
+		c.order.remove(mac)
+		return nil, time.Time{}, 0, false
+	}
+	e.hits++
+	return e.ip, e.expires, e.hits, true
+}
+
+// peek is get without counting a hit nor forgetting a stale binding
+func (c *offerCache) peek(mac string, now time.Time, interval time.Duration) (net.IP, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[mac]
+	if !ok || now.Sub(e.at) >= interval || endsBy(e.expires, now, c.tolerance) {
+		return nil, time.Time{}, false
+	}
+	return e.ip, e.expires, true
+}
+
+// drop forgets the binding of mac
+func (c *offerCache) drop(mac string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, mac)
+	c.order.remove(mac)
+}
+
+func (c *offerCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// prune forgets the bindings recorded interval before now or earlier
+func (c *offerCache) prune(now time.Time, interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for mac, e := range c.entries {
+		if now.Sub(e.at) >= interval {
+			delete(c.entries, mac)
+			c.order.remove(mac)
+		}
+	}
+}
+
+// cachedOffer returns the binding to offer to a client sending a DISCOVER
+// shortly after its lease was granted or renewed. The binding must still be
+// the one held by the client, so that changed or freed leases are never
+// served from the cache. The last return value is true for the first answer
+// from the cache only.
+func (p *PluginState) cachedOffer(mac string, now time.Time) (net.IP, time.Duration, bool, bool) {
+	if p.cfg.OfferInterval == 0 {
+		return nil, 0, false, false
+	}
+	ip, expires, hits, ok := p.offers.get(mac, now, p.cfg.OfferInterval)
+	if !ok {
+		return nil, 0, false, false
+	}
+	if !ip.Equal(p.leases.ipOf(mac)) {
+		p.offers.drop(mac)
+		return nil, 0, false, false
+	}
+	return ip, expires.Sub(now), hits == 1, true
+}
+
+// offerHold returns how long an offer is held, within leaseTime
+func (p *PluginState) offerHold(leaseTime time.Duration) time.Duration {
+	if p.cfg.OfferHold < leaseTime {
+		return p.cfg.OfferHold
+	}
+	return leaseTime
+}
+
+// noteOffer records the binding just granted or renewed for mac
+func (p *PluginState) noteOffer(mac string, record *Record, now time.Time) {
+	if p.cfg.OfferInterval == 0 || record.offered() {
+		// an offer is not a lease yet, its expiry is the offer hold
+		return
+	}
+	p.offers.set(mac, record.IP, record.Expires, now)
+}
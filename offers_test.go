@@ -0,0 +1,228 @@
+package rangeredisplugin
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// countCommands counts the commands m receives naming mac in a key or an
+// argument, until the returned function is called
+func countCommands(m *miniredis.Miniredis, mac string) (*atomic.Int32, func()) {
+	var n atomic.Int32
+	m.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		for _, arg := range args {
+			if strings.Contains(arg, mac) {
+				n.Add(1)
+				break
+			}
+		}
+		return false
+	})
+	return &n, func() { m.Server().SetPreHook(nil) }
+}
+
+func TestOfferInterval(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.20.10", "10.0.20.20", "1h", "offer_interval=10s")
+	const mac = "00:11:22:33:44:0a"
+	ip := lease(t, p, mac)
+
+	// rapid DISCOVERs with fresh xids are answered without redis
+	ops, done := countCommands(m, mac)
+	defer done()
+	xids := make(map[dhcpv4.TransactionID]bool)
+	for i := 0; i < 20; i++ {
+		req := newRequest(t, dhcpv4.MessageTypeDiscover, mac)
+		xids[req.TransactionID] = true
+		offer := exchange(t, p, req)
+		if offer == nil || !offer.YourIPAddr.Equal(ip) {
+			t.Fatalf("DISCOVER %d answered %v, want an offer of %s", i, offer, ip)
+		}
+		if lt := offer.IPAddressLeaseTime(0); lt <= 0 || lt > time.Hour {
+			t.Errorf("offer from the cache with a lease time of %s", lt)
+		}
+		advance(p, 400*time.Millisecond)
+	}
+	if len(xids) < 2 {
+		t.Fatal("the DISCOVERs share their xid")
+	}
+	if n := ops.Load(); n != 0 {
+		t.Errorf("%d redis commands for the DISCOVERs within the interval", n)
+	}
+
+	// past the interval, the DISCOVERs go to redis again
+	advance(p, 10*time.Second)
+	if offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac)); offer == nil || !offer.YourIPAddr.Equal(ip) {
+		t.Fatalf("DISCOVER past the interval answered %v", offer)
+	}
+	if ops.Load() == 0 {
+		t.Error("DISCOVER past the interval answered from the cache")
+	}
+}
+
+func TestOfferIntervalInvalidation(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.20.10", "10.0.20.20", "1h", "offer_interval=10s")
+	const mac = "00:11:22:33:44:0a"
+
+	// a released lease is not offered from the cache
+	ip := lease(t, p, mac)
+	releaseLease(t, p, mac, ip)
+	if _, _, _, ok := p.cachedOffer(mac, p.clock.Now()); ok {
+		t.Error("released lease offered from the cache")
+	}
+
+	// nor is a lease whose binding changed
+	ip = lease(t, p, mac)
+	p.leases.remove(mac, ip)
+	if _, _, _, ok := p.cachedOffer(mac, p.clock.Now()); ok {
+		t.Error("changed binding offered from the cache")
+	}
+	if n := p.offers.len(); n != 0 {
+		t.Errorf("%d bindings cached", n)
+	}
+}
+
+func TestOfferIntervalDisabled(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.20.10", "10.0.20.20", "1h")
+	const mac = "00:11:22:33:44:0a"
+	lease(t, p, mac)
+	ops, done := countCommands(m, mac)
+	defer done()
+	exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac))
+	if ops.Load() == 0 {
+		t.Error("DISCOVER answered from the cache without offer_interval")
+	}
+}
+
+func TestOfferHold(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.20.10", "10.0.20.20", "1h")
+	events := recordEvents(p)
+	const a, b, c = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c"
+	state := func(mac string) string {
+		t.Helper()
+		rec, err := p.storage.GetRecord(mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec.State
+	}
+
+	// the DISCOVER holds the address for a short time
+	offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, a))
+	if offer == nil || offer.IPAddressLeaseTime(0) != time.Hour {
+		t.Fatalf("DISCOVER answered %v", offer)
+	}
+	if s := state(a); s != StateOffered {
+		t.Errorf("record %s after the DISCOVER", s)
+	}
+	assertTTL(t, m, keyPrefix(p, "shadow")+a, defaultOfferHold)
+
+	// the REQUEST binds it for the lease time
+	ack := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, a, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(offer.YourIPAddr))))
+	if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("REQUEST answered %v", ack)
+	}
+	if s := state(a); s != StateBound {
+		t.Errorf("record %s after the REQUEST", s)
+	}
+	assertTTL(t, m, keyPrefix(p, "shadow")+a, time.Hour)
+	eventually(t, "the offer and grant events", func() bool {
+		return len(events.of(EventOffer)) == 1 && len(events.of(EventGrant)) == 1
+	})
+
+	// a bound lease is never held as an offer again
+	advance(p, 10*time.Minute)
+	exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, a))
+	if s := state(a); s != StateBound {
+		t.Errorf("record %s after a DISCOVER of the bound client", s)
+	}
+	if ttl := m.TTL(keyPrefix(p, "shadow") + a); ttl < 50*time.Minute {
+		t.Errorf("bound lease shortened to %s by a DISCOVER", ttl)
+	}
+
+	// an offer never requested returns to the pool when it expires
+	held := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, b)).YourIPAddr
+	expire(t, m, p, b)
+	eventually(t, "the expiry of the offer", func() bool { return p.leases.macOf(held) == "" })
+	m.Del(keyPrefix(p, "main") + b)
+	m.Del(keyPrefix(p, "index") + held.String())
+	if got := lease(t, p, c); !got.Equal(held) {
+		t.Errorf("leased %s after the offer expired, want %s", got, held)
+	}
+}
+
+func TestOfferHoldDisabled(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.20.10", "10.0.20.20", "1h", "offer_hold=0s")
+	const mac = "00:11:22:33:44:0a"
+	exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac))
+	if rec, err := p.storage.GetRecord(mac); err != nil || rec.State != StateBound {
+		t.Errorf("record %+v after a DISCOVER without offer hold: %v", rec, err)
+	}
+	assertTTL(t, m, keyPrefix(p, "shadow")+mac, time.Hour)
+}
+
+func TestOfferHoldNotTakenUp(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.84.10", "10.0.84.11", "1h")
+	ours, other := net.IPv4(10, 0, 84, 1).To4(), net.IPv4(10, 0, 84, 2).To4()
+	const a, b, c, d = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c", "00:11:22:33:44:0d"
+	discover := func(mac string) net.IP {
+		t.Helper()
+		offer := exchangeWith(t, p, ours, newRequest(t, dhcpv4.MessageTypeDiscover, mac))
+		if offer == nil {
+			t.Fatalf("no offer to %s", mac)
+		}
+		return offer.YourIPAddr
+	}
+	request := func(mac string, ip, server net.IP) *dhcpv4.DHCPv4 {
+		return exchangeWith(t, p, ours, newRequest(t, dhcpv4.MessageTypeRequest, mac,
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)), dhcpv4.WithOption(dhcpv4.OptServerIdentifier(server))))
+	}
+	assertWithdrawn := func(mac string, ip net.IP) {
+		t.Helper()
+		if _, err := p.storage.GetRecord(mac); !errors.Is(err, ErrNotFound) {
+			t.Errorf("offer of %s to %s kept: %v", ip, mac, err)
+		}
+		if holder := p.leases.macOf(ip); holder != "" {
+			t.Errorf("%s held by %q", ip, holder)
+		}
+	}
+
+	// the client chose another server: the offer is withdrawn silently
+	held := discover(a)
+	if resp := request(a, held, other); resp != nil {
+		t.Errorf("REQUEST to another server answered %s", resp.MessageType())
+	}
+	assertWithdrawn(a, held)
+	if got := lease(t, p, b); !got.Equal(held) {
+		t.Errorf("leased %s, want the withdrawn %s", got, held)
+	}
+
+	// the client asks for another address than the one offered
+	held = discover(c)
+	if resp := request(c, net.IPv4(10, 0, 84, 12), ours); resp == nil || resp.MessageType() != dhcpv4.MessageTypeNak {
+		t.Errorf("REQUEST of another address answered %v, want a NAK", resp)
+	}
+	assertWithdrawn(c, held)
+
+	// only the REQUEST of the offer, to this server, binds it
+	held = discover(d)
+	if ack := request(d, held, ours); ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck || !ack.YourIPAddr.Equal(held) {
+		t.Fatalf("REQUEST of the offer answered %v", ack)
+	}
+	if rec, err := p.storage.GetRecord(d); err != nil || rec.State != StateBound {
+		t.Errorf("record %+v after the REQUEST: %v", rec, err)
+	}
+}
@@ -0,0 +1,355 @@
+package rangeredisplugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/go-redis/redis/v9"
+)
+
+// REDIS_OPLOG_KEY_PREFIX prefixes the streams the operation logs of the
+// pools are appended to, see OpLogEntry
+const REDIS_OPLOG_KEY_PREFIX = "j:dhcp:oplog:"
+
+// Operations recorded by the operation log
+const (
+	OpAllocate = "allocate"
+	OpFree     = "free"
+	OpBind     = "bind"
+	OpUnbind   = "unbind"
+)
+
+const (
+	// size of the queue of the entries to append to the stream
+	opLogQueueSize = 1024
+	// most entries appended to the stream in one round trip
+	opLogBatch = 128
+	// number of frames of the caller path of an entry
+	opLogDepth = 4
+	// number of entries attached to a consistency report
+	opLogReportEntries = 50
+)
+
+// OpLogEntry is one mutation of the allocator or of the bindings. The
+// allocations and frees of a log starting at the first operation of an
+// instance replay deterministically against a fresh allocator, see
+// ReplayOpLog.
+type OpLogEntry struct {
+	// Seq numbers the operations of an instance from 1
+	Seq  uint64
+	Time time.Time
+	Op   string
+	IP   net.IP `json:",omitempty"`
+	// Hint is the address asked of the allocator by an allocation
+	Hint net.IP `json:",omitempty"`
+	MAC  string `json:",omitempty"`
+	// Reason is the function of the plugin the mutation was made for, e.g.
+	// freeLease, and Caller the functions leading to it, innermost first
+	Reason string
+	Caller string
+	Err    string `json:",omitempty"`
+}
+
+// opLog keeps the last operations of the allocator and of the bindings in
+// a ring, and queues them for the stream if enabled. It is only set up
+// when enabled, the hooks cost a nil check otherwise.
+type opLog struct {
+	mu      sync.Mutex
+	entries []OpLogEntry
+	next    int
+	seq     uint64
+	// clock stamps the entries, the clock of the instance so that they
+	// sort with its other records in a timeline
+	clock Clock
+	// stream queues the entries to append to the stream, nil if disabled
+	stream  chan OpLogEntry
+	dropped atomic.Uint64
+}
+
+func newOpLog(size int, stream bool, clock Clock) *opLog {
+	l := &opLog{entries: make([]OpLogEntry, 0, size), clock: clock}
+	if stream {
+		l.stream = make(chan OpLogEntry, opLogQueueSize)
+	}
+	return l
+}
+
+// record logs an operation on ip
+func (l *opLog) record(op string, ip, hint net.IP, mac string, err error) {
+	e := OpLogEntry{Time: l.clock.Now(), Op: op, IP: ip, Hint: hint, MAC: mac}
+	e.Reason, e.Caller = callerPath()
+	if err != nil {
+		e.Err = err.Error()
+	}
+
+	l.mu.Lock()
+	l.seq++
+	e.Seq = l.seq
+	if len(l.entries) < cap(l.entries) {
+		l.entries = append(l.entries, e)
+	} else {
+		l.entries[l.next] = e
+		l.next = (l.next + 1) % len(l.entries)
+	}
+	l.mu.Unlock()
+
+	if l.stream != nil {
+		select {
+		case l.stream <- e:
+		default:
+			l.dropped.Add(1)
+		}
+	}
+}
+
+// opLogPackage prefixes the names of the functions of the package in the
+// frames: its import path, not its name
+var opLogPackage = reflect.TypeOf(opLog{}).PkgPath() + "."
+
+// callerPath returns the innermost function of the plugin outside of the
+// allocator and binding helpers, and the path of up to opLogDepth
+// functions leading to it
+func callerPath() (string, string) {
+	var pcs [16]uintptr
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs[:])])
+	var path []string
+	for len(path) < opLogDepth {
+		f, more := frames.Next()
+		if rest, ok := strings.CutPrefix(f.Function, opLogPackage); ok {
+			rest = strings.TrimPrefix(rest, "(*PluginState).")
+			switch {
+			case strings.HasPrefix(rest, "(*loggedAllocator)"), strings.HasPrefix(rest, "(*leaseTable)"),
+				strings.HasPrefix(rest, "(*checkedAllocator)"), rest == "allocateExact", rest == "allocatePreferred",
+				rest == "unbind":
+			default:
+				path = append(path, rest)
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	if len(path) == 0 {
+		return "", ""
+	}
+	return path[0], strings.Join(path, " < ")
+}
+
+// snapshot returns the logged entries, oldest first
+func (l *opLog) snapshot() []OpLogEntry {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]OpLogEntry, 0, len(l.entries))
+	out = append(out, l.entries[l.next:]...)
+	return append(out, l.entries[:l.next]...)
+}
+
+// touching returns the last n entries on one of ips, oldest first
+func (l *opLog) touching(ips map[string]bool, n int) []OpLogEntry {
+	all := l.snapshot()
+	var out []OpLogEntry
+	for i := len(all) - 1; i >= 0 && len(out) < n; i-- {
+		if ips[all[i].IP.String()] {
+			out = append(out, all[i])
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+func (l *opLog) len() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+// streamDropped returns the number of entries not appended to the stream
+func (l *opLog) streamDropped() uint64 {
+	if l == nil {
+		return 0
+	}
+	return l.dropped.Load()
+}
+
+// loggedAllocator records every mutation of an allocator in the log
+type loggedAllocator struct {
+	inner allocators.Allocator
+	log   *opLog
+}
+
+func (a *loggedAllocator) Allocate(hint net.IPNet) (net.IPNet, error) {
+	n, err := a.inner.Allocate(hint)
+	a.log.record(OpAllocate, n.IP, hint.IP, "", err)
+	return n, err
+}
+
+func (a *loggedAllocator) Free(n net.IPNet) error {
+	err := a.inner.Free(n)
+	a.log.record(OpFree, n.IP, nil, "", err)
+	return err
+}
+
+// AppendOpLog appends entries to the stream of the operation log of pool,
+// trimmed to about maxLen entries
+func (r *RedisProvider) AppendOpLog(ctx context.Context, pool string, entries []OpLogEntry, maxLen int) error {
+	_, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, e := range entries {
+			val, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: REDIS_OPLOG_KEY_PREFIX + pool,
+				MaxLen: int64(maxLen),
+				Approx: true,
+				Values: []any{"op", val},
+			})
+		}
+		return nil
+	})
+	return unavailable(err)
+}
+
+// OpLog returns the entries of the stream of the operation log of pool
+// since the last start of an instance, oldest first
+func (r *RedisProvider) OpLog(ctx context.Context, pool string) ([]OpLogEntry, error) {
+	msgs, err := r.rdb.XRange(ctx, REDIS_OPLOG_KEY_PREFIX+pool, "-", "+").Result()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	var entries []OpLogEntry
+	for _, m := range msgs {
+		val, _ := m.Values["op"].(string)
+		var e OpLogEntry
+		if err := json.Unmarshal([]byte(val), &e); err != nil {
+			log.Warnf("skipping invalid operation log entry %s: %v", m.ID, err)
+			continue
+		}
+		if e.Seq == 1 {
+			entries = entries[:0]
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// opLogLoop appends the logged operations to the stream until the plugin
+// closes
+func (p *PluginState) opLogLoop() {
+	batch := make([]OpLogEntry, 0, opLogBatch)
+	for {
+		select {
+		case e := <-p.oplog.stream:
+			batch = append(batch[:0], e)
+		case <-p.closing:
+			return
+		}
+		for len(batch) < opLogBatch && len(p.oplog.stream) > 0 {
+			batch = append(batch, <-p.oplog.stream)
+		}
+		if err := p.storage.AppendOpLog(context.TODO(), p.poolName(), batch, p.cfg.OpLog); err != nil {
+			p.oplog.dropped.Add(uint64(len(batch)))
+			log.Warnf("could not append %d entries to the operation log: %v", len(batch), err)
+		}
+	}
+}
+
+// OpLogReplay is the outcome of replaying an operation log
+type OpLogReplay struct {
+	Ops int
+	// Divergences lists the operations whose outcome differs from the
+	// logged one, empty if the replay reproduced the log
+	Divergences []string
+	// Allocated and Bindings are the state the log leads to
+	Allocated []net.IP
+	Bindings  map[string]net.IP
+}
+
+// ReplayOpLog re-executes the allocations and frees of entries against a
+// fresh allocator of cfg, checking that each has the logged outcome, and
+// rebuilds the bindings. The log must start at the first operation of an
+// instance.
+func ReplayOpLog(cfg *Config, entries []OpLogEntry) (*OpLogReplay, error) {
+	if len(entries) > 0 && entries[0].Seq != 1 {
+		return nil, fmt.Errorf("the log starts at operation %d, the earlier ones are missing", entries[0].Seq)
+	}
+	a, err := newAllocator(cfg)
+	if err != nil {
+		return nil, err
+	}
+	out := &OpLogReplay{Bindings: make(map[string]net.IP)}
+	allocated := make(map[string]net.IP)
+	diverge := func(e OpLogEntry, format string, args ...any) {
+		out.Divergences = append(out.Divergences,
+			fmt.Sprintf("#%d %s by %s: %s", e.Seq, e.Op, e.Reason, fmt.Sprintf(format, args...)))
+	}
+	for _, e := range entries {
+		switch e.Op {
+		case OpAllocate:
+			n, err := a.Allocate(net.IPNet{IP: e.Hint})
+			switch {
+			case (err != nil) != (e.Err != ""):
+				diverge(e, "got error %v, logged %q", err, e.Err)
+			case err == nil && !n.IP.Equal(e.IP):
+				diverge(e, "got %s, logged %s", n.IP, e.IP)
+			}
+			if err == nil {
+				allocated[n.IP.String()] = n.IP
+			}
+		case OpFree:
+			err := a.Free(net.IPNet{IP: e.IP, Mask: net.IPv4Mask(255, 255, 255, 255)})
+			if (err != nil) != (e.Err != "") {
+				diverge(e, "got error %v, logged %q", err, e.Err)
+			}
+			if err == nil {
+				delete(allocated, e.IP.String())
+			}
+		case OpBind:
+			out.Bindings[e.MAC] = e.IP
+		case OpUnbind:
+			if out.Bindings[e.MAC].Equal(e.IP) {
+				delete(out.Bindings, e.MAC)
+			}
+		default:
+			diverge(e, "unknown operation")
+			continue
+		}
+		out.Ops++
+	}
+	for _, ip := range allocated {
+		out.Allocated = append(out.Allocated, ip)
+	}
+	sort.Slice(out.Allocated, func(i, j int) bool {
+		return bytes.Compare(out.Allocated[i].To16(), out.Allocated[j].To16()) < 0
+	})
+	return out, nil
+}
+
+func (r *OpLogReplay) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d operations replayed, %d divergent, %d allocated, %d bound",
+		r.Ops, len(r.Divergences), len(r.Allocated), len(r.Bindings))
+	for _, d := range r.Divergences {
+		fmt.Fprintf(&b, "\n  %s", d)
+	}
+	return b.String()
+}
@@ -0,0 +1,132 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestOpLog(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.56.10", "10.0.56.20", "1h", "oplog=64", "oplog_stream=true")
+	const a, b = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+	ipA, ipB := lease(t, p, a), lease(t, p, b)
+	releaseLease(t, p, b, ipB)
+
+	entries := p.oplog.snapshot()
+	var ops []string
+	for i, e := range entries {
+		if e.Seq != uint64(i+1) {
+			t.Errorf("entry %d numbered %d", i, e.Seq)
+		}
+		if e.Reason == "" || !strings.HasPrefix(e.Caller, e.Reason) {
+			t.Errorf("entry %d made for %q by %q", e.Seq, e.Reason, e.Caller)
+		}
+		ops = append(ops, e.Op+" "+e.IP.String()+" "+e.MAC)
+	}
+	want := []string{
+		OpAllocate + " " + ipA.String() + " ", OpBind + " " + ipA.String() + " " + a,
+		OpAllocate + " " + ipB.String() + " ", OpBind + " " + ipB.String() + " " + b,
+		OpFree + " " + ipB.String() + " ", OpUnbind + " " + ipB.String() + " " + b,
+	}
+	if strings.Join(ops, "\n") != strings.Join(want, "\n") {
+		t.Errorf("operations:\n%s\nwant:\n%s", strings.Join(ops, "\n"), strings.Join(want, "\n"))
+	}
+
+	// the log replays to the state of the instance
+	replay, err := ReplayOpLog(p.cfg, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replay.Divergences) != 0 || replay.Ops != len(want) {
+		t.Errorf("replay: %s", replay)
+	}
+	if len(replay.Allocated) != 1 || !replay.Allocated[0].Equal(ipA) || len(replay.Bindings) != 1 || !replay.Bindings[a].Equal(ipA) {
+		t.Errorf("replayed state %v %v, want %s bound to %s", replay.Allocated, replay.Bindings, ipA, a)
+	}
+
+	// and so does the stream
+	eventually(t, "the stream", func() bool {
+		stored, err := p.storage.OpLog(context.Background(), p.poolName())
+		return err == nil && len(stored) == len(entries)
+	})
+	stored, _ := p.storage.OpLog(context.Background(), p.poolName())
+	if replay, err := ReplayOpLog(p.cfg, stored); err != nil || len(replay.Divergences) != 0 {
+		t.Errorf("replay of the stream: %v %v", replay, err)
+	}
+
+	// an outcome that differs is reported
+	tampered := append([]OpLogEntry(nil), entries...)
+	tampered[2].IP = net.IPv4(10, 0, 56, 20).To4()
+	if replay, err := ReplayOpLog(p.cfg, tampered); err != nil || len(replay.Divergences) != 1 || !strings.Contains(replay.Divergences[0], "#3 allocate") {
+		t.Errorf("replay of a tampered log: %v %v", replay, err)
+	}
+	if _, err := ReplayOpLog(p.cfg, entries[1:]); err == nil {
+		t.Error("replay of a log missing its start succeeded")
+	}
+}
+
+func TestOpLogBounded(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.56.30", "10.0.56.40", "1h", "oplog=4")
+	for _, mac := range []string{"00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c"} {
+		lease(t, p, mac)
+	}
+	entries := p.oplog.snapshot()
+	if len(entries) != 4 || entries[0].Seq != 3 || entries[3].Seq != 6 {
+		t.Errorf("entries %+v, want the operations 3 to 6", entries)
+	}
+	if stats := p.Stats(); stats.Structures["oplog"] != 4 {
+		t.Errorf("structures %v, want 4 operations", stats.Structures)
+	}
+}
+
+func TestOpLogReport(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.56.50", "10.0.56.60", "1h", "oplog=64")
+	const a, b = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+	lease(t, p, a)
+	ipB := lease(t, p, b)
+
+	// the address of b is allocated without a record
+	m.Del(p.storage.ns.main + b)
+	m.Del(p.storage.ns.shadow + b)
+	m.Del(p.storage.ns.index + ipB.String())
+	report, _, err := p.ConsistencyReport(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Operations) != 2 {
+		t.Fatalf("operations %+v, want the allocation and binding of %s", report.Operations, ipB)
+	}
+	for _, e := range report.Operations {
+		if !e.IP.Equal(ipB) {
+			t.Errorf("operation on %s attached to the report", e.IP)
+		}
+	}
+}
+
+// BenchmarkOpLog measures the cost of the operation log on the handling of
+// a full lease cycle
+func BenchmarkOpLog(b *testing.B) {
+	for _, args := range [][]string{nil, {"oplog=1024"}} {
+		name := "off"
+		if args != nil {
+			name = "on"
+		}
+		b.Run(name, func(b *testing.B) {
+			m := miniredis.RunT(b)
+			p := startPlugin(b, m, append([]string{"10.0.56.100", "10.0.56.200", "1h"}, args...)...)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, byte(i >> 8), byte(i)}.String()
+				ip := lease(b, p, mac)
+				exchange(b, p, newRequest(b, dhcpv4.MessageTypeRelease, mac, dhcpv4.WithClientIP(ip)))
+			}
+		})
+	}
+}
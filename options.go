@@ -0,0 +1,169 @@
+package rangeredisplugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// parseRoutes parses a list of classless static routes in the format
+// <destination CIDR>:<gateway>,...
+func parseRoutes(val string) ([]*dhcpv4.Route, error) {
+	var routes []*dhcpv4.Route
+	for _, entry := range strings.Split(val, ",") {
+		dest, gw, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid route %q, want <destination CIDR>:<gateway>", entry)
+		}
+		_, ipNet, err := net.ParseCIDR(dest)
+		if err != nil || ipNet.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 destination %q", dest)
+		}
+		router := net.ParseIP(gw).To4()
+		if router == nil {
+			return nil, fmt.Errorf("invalid IPv4 gateway %q", gw)
+		}
+		routes = append(routes, &dhcpv4.Route{Dest: ipNet, Router: router})
+	}
+	return routes, nil
+}
+
+// parseMask parses a subnet mask, dotted or as a prefix length, e.g.
+// 255.255.255.0 or 24
+func parseMask(val string) (net.IPMask, error) {
+	if n, err := strconv.Atoi(val); err == nil {
+		if n < 1 || n > 32 {
+			return nil, fmt.Errorf("invalid prefix length %d", n)
+		}
+		return net.CIDRMask(n, 32), nil
+	}
+	ip := net.ParseIP(val).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid subnet mask %q", val)
+	}
+	mask := net.IPMask(ip)
+	if ones, _ := mask.Size(); ones == 0 {
+		return nil, fmt.Errorf("subnet mask %s is not contiguous", val)
+	}
+	return mask, nil
+}
+
+// subnet returns the subnet of the mask option, or else the subnet the
+// range was given as, or else the smallest network containing it
+func (c *Config) subnet() *net.IPNet {
+	if c.Mask != nil {
+		return &net.IPNet{IP: c.Start.To4().Mask(c.Mask), Mask: c.Mask}
+	}
+	if c.CIDR != nil {
+		return c.CIDR
+	}
+	start := binary.BigEndian.Uint32(c.Start.To4())
+	end := binary.BigEndian.Uint32(c.End.To4())
+	ones := bits.LeadingZeros32(start ^ end)
+	mask := net.CIDRMask(ones, 32)
+	return &net.IPNet{IP: c.Start.To4().Mask(mask), Mask: mask}
+}
+
+// applyOptions adds the DHCP options configured for the pool to resp.
+// Options already set by an earlier plugin are kept unless the override
+// flag is set. Returns the options added.
+func (p *PluginState) applyOptions(resp *dhcpv4.DHCPv4) []dhcpv4.OptionCode {
+	var added []dhcpv4.OptionCode
+	set := func(opt dhcpv4.Option) {
+		if resp.Options.Has(opt.Code) && !p.cfg.OptionsOverride {
+			return
+		}
+		resp.Options.Update(opt)
+		added = append(added, opt.Code)
+	}
+	if p.cfg.Mask != nil {
+		set(dhcpv4.OptSubnetMask(p.cfg.Mask))
+	}
+	if len(p.cfg.Routers) > 0 {
+		set(dhcpv4.OptRouter(p.cfg.Routers...))
+	}
+	if p.cfg.MTU != 0 {
+		set(dhcpv4.Option{Code: dhcpv4.OptionInterfaceMTU, Value: dhcpv4.Uint16(p.cfg.MTU)})
+	}
+	if len(p.cfg.Routes) > 0 {
+		set(dhcpv4.OptClasslessStaticRoute(p.cfg.Routes...))
+	}
+	return added
+}
+
+// echoRelayInfo copies the relay agent information option of a request
+// into its reply, unchanged, so that the relay can match the reply and
+// strip the option before forwarding it (RFC 3046 section 2.2). This
+// includes the requests of a relay agent inserting the option without
+// setting giaddr, e.g. a snooping switch. The option is removed from the
+// other replies, which the dhcpv4 package builds with a copy of it.
+func (p *PluginState) echoRelayInfo(req, resp *dhcpv4.DHCPv4) {
+	raw := req.Options.Get(dhcpv4.OptionRelayAgentInformation)
+	if raw == nil || !p.cfg.RelayEcho {
+		resp.Options.Del(dhcpv4.OptionRelayAgentInformation)
+		return
+	}
+	resp.Options.Update(dhcpv4.OptGeneric(dhcpv4.OptionRelayAgentInformation, raw))
+}
+
+// minMessageSize is the size of the datagrams every client accepts, which
+// the maximum message size option cannot lower (RFC 2132 section 9.10)
+const minMessageSize = 576
+
+// udpIPHeaders is the size of the IP and UDP headers of a reply, which
+// count in the maximum message size
+const udpIPHeaders = 28
+
+// essentialOptions are the options fitReply never drops: those the client
+// needs to use its lease, and the relay agent information the relay needs
+// to forward the reply
+var essentialOptions = map[uint8]bool{
+	dhcpv4.OptionDHCPMessageType.Code():        true,
+	dhcpv4.OptionServerIdentifier.Code():       true,
+	dhcpv4.OptionIPAddressLeaseTime.Code():     true,
+	dhcpv4.OptionRenewTimeValue.Code():         true,
+	dhcpv4.OptionRebindingTimeValue.Code():     true,
+	dhcpv4.OptionSubnetMask.Code():             true,
+	dhcpv4.OptionRouter.Code():                 true,
+	dhcpv4.OptionRelayAgentInformation.Code():  true,
+	dhcpv4.OptionMaximumDHCPMessageSize.Code(): true,
+}
+
+// fitReply drops the other options of resp, highest code first, until it
+// fits the maximum message size of req, minMessageSize if unset. The reply
+// is measured with its relay agent information: the relay strips it after,
+// but it is in the reply sent. A reply carrying the essential options only
+// is sent as it is, even over the size. Returns the options dropped.
+func fitReply(req, resp *dhcpv4.DHCPv4) []dhcpv4.OptionCode {
+	limit := minMessageSize
+	if n, err := req.MaxMessageSize(); err == nil && int(n) > limit {
+		limit = int(n)
+	}
+	limit -= udpIPHeaders
+	if len(resp.ToBytes()) <= limit {
+		return nil
+	}
+	codes := make([]int, 0, len(resp.Options))
+	for code := range resp.Options {
+		if !essentialOptions[code] {
+			codes = append(codes, int(code))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(codes)))
+	var dropped []dhcpv4.OptionCode
+	for _, code := range codes {
+		opt := dhcpv4.GenericOptionCode(code)
+		resp.Options.Del(opt)
+		dropped = append(dropped, opt)
+		if len(resp.ToBytes()) <= limit {
+			break
+		}
+	}
+	return dropped
+}
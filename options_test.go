@@ -0,0 +1,354 @@
+package rangeredisplugin
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestClasslessStaticRouteEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		routes string
+		want   []byte
+	}{
+		// the default route has no significant octet
+		{"0.0.0.0/0:10.3.0.1", []byte{0, 10, 3, 0, 1}},
+		{"10.0.0.0/8:10.3.0.1", []byte{8, 10, 10, 3, 0, 1}},
+		{"172.16.0.0/12:10.3.0.1", []byte{12, 172, 16, 10, 3, 0, 1}},
+		{"192.168.100.0/22:10.3.0.1", []byte{22, 192, 168, 100, 10, 3, 0, 1}},
+		{"192.168.1.128/25:10.3.0.254", []byte{25, 192, 168, 1, 128, 10, 3, 0, 254}},
+		{"172.16.5.4/32:10.3.0.1", []byte{32, 172, 16, 5, 4, 10, 3, 0, 1}},
+		// the host bits of the destination are not sent
+		{"10.17.3.0/12:10.3.0.1", []byte{12, 10, 16, 10, 3, 0, 1}},
+		{"10.0.0.0/8:10.3.0.1,0.0.0.0/0:10.3.0.254", []byte{8, 10, 10, 3, 0, 1, 0, 10, 3, 0, 254}},
+	} {
+		cfg, err := parseConfig([]string{"redis://localhost/0", "10.3.0.10", "10.3.0.200", "1h", "routes=" + tc.routes})
+		if err != nil {
+			t.Errorf("%s: %v", tc.routes, err)
+			continue
+		}
+		resp, _ := dhcpv4.New()
+		(&PluginState{cfg: cfg}).applyOptions(resp)
+		if got := resp.Options.Get(dhcpv4.OptionClasslessStaticRoute); !bytes.Equal(got, tc.want) {
+			t.Errorf("%s encoded as %v, want %v", tc.routes, got, tc.want)
+		}
+	}
+}
+
+func TestRouteOptionErrors(t *testing.T) {
+	for _, tc := range []struct {
+		opt, want string
+	}{
+		{"routes=10.0.0.0/8", "want <destination CIDR>:<gateway>"},
+		{"routes=10.0.0.0:10.3.0.1", "invalid IPv4 destination"},
+		{"routes=2001:db8::/32:10.3.0.1", "invalid IPv4 destination"},
+		{"routes=10.0.0.0/8:gateway", "invalid IPv4 gateway"},
+		{"routes=10.0.0.0/8:10.4.0.1", "gateway 10.4.0.1 of route 10.0.0.0/8 is outside of the pool subnet"},
+		{"mtu=67", "want an MTU between 68 and 65535"},
+		{"mtu=65536", "want an MTU between 68 and 65535"},
+		{"mask=0", "invalid prefix length 0"},
+		{"mask=33", "invalid prefix length 33"},
+		{"mask=255.0.255.0", "is not contiguous"},
+		{"mask=netmask", "invalid subnet mask"},
+		{"mask=25", "does not fit in one subnet of mask 255.255.255.128"},
+		{"router=gateway", "invalid IPv4 router"},
+		{"router=10.3.0.1,2001:db8::1", "invalid IPv4 router"},
+		{"router=10.4.0.1", "router 10.4.0.1 is outside of the pool subnet"},
+	} {
+		_, err := parseConfig([]string{"redis://localhost/0", "10.3.0.10", "10.3.0.200", "1h", tc.opt})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: %v, want %q", tc.opt, err, tc.want)
+		}
+	}
+}
+
+func TestPoolOptions(t *testing.T) {
+	m := miniredis.RunT(t)
+	const mac = "00:11:22:33:44:55"
+	vpn := startPlugin(t, m, "10.3.0.10", "10.3.0.200", "1h", "mtu=1400", "routes=10.0.0.0/8:10.3.0.1")
+	offer := exchange(t, vpn, newRequest(t, dhcpv4.MessageTypeDiscover, mac))
+	if offer == nil {
+		t.Fatal("no offer")
+	}
+	if got := offer.Options.Get(dhcpv4.OptionInterfaceMTU); !bytes.Equal(got, []byte{0x05, 0x78}) {
+		t.Errorf("MTU option %v, want 1400", got)
+	}
+	if got := offer.Options.Get(dhcpv4.OptionClasslessStaticRoute); !bytes.Equal(got, []byte{8, 10, 10, 3, 0, 1}) {
+		t.Errorf("routes option %v", got)
+	}
+
+	// a pool without them sends none
+	plain := startPlugin(t, m, "10.2.0.10", "10.2.0.200", "1h")
+	offer = exchange(t, plain, newRequest(t, dhcpv4.MessageTypeDiscover, mac))
+	if offer == nil {
+		t.Fatal("no offer")
+	}
+	if offer.Options.Has(dhcpv4.OptionInterfaceMTU) || offer.Options.Has(dhcpv4.OptionClasslessStaticRoute) {
+		t.Errorf("options of another pool sent: %v", offer.Options)
+	}
+}
+
+func TestParseMask(t *testing.T) {
+	for val, want := range map[string]int{"24": 24, "255.255.255.0": 24, "255.255.0.0": 16, "32": 32, "255.255.255.255": 32, "1": 1} {
+		mask, err := parseMask(val)
+		if err != nil {
+			t.Errorf("%s: %v", val, err)
+			continue
+		}
+		if ones, bits := mask.Size(); ones != want || bits != 32 {
+			t.Errorf("%s parsed as /%d of %d bits, want /%d", val, ones, bits, want)
+		}
+	}
+}
+
+func TestMaskSubnet(t *testing.T) {
+	// the mask widens the subnet of the routers and the route gateways
+	// beyond the smallest one containing the range
+	cfg, err := parseConfig([]string{"redis://localhost/0", "10.3.0.10", "10.3.0.200", "1h",
+		"mask=16", "router=10.3.255.254,10.3.1.1", "routes=10.0.0.0/8:10.3.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subnet := cfg.subnet(); subnet.String() != "10.3.0.0/16" {
+		t.Errorf("subnet %s, want 10.3.0.0/16", subnet)
+	}
+	if _, err := parseConfig([]string{"redis://localhost/0", "10.3.0.10", "10.3.0.200", "1h", "router=10.3.1.1"}); err == nil {
+		t.Error("router outside of the range subnet accepted without a mask")
+	}
+}
+
+func TestPoolMaskAndRouters(t *testing.T) {
+	m := miniredis.RunT(t)
+	const mac = "00:11:22:33:44:0a"
+	vlanA := startPlugin(t, m, "10.0.66.10", "10.0.66.20", "1h", "relay=10.66.0.1", "mask=24", "router=10.0.66.1")
+	vlanB := startPlugin(t, m, "10.0.67.10", "10.0.67.20", "1h", "relay=10.67.0.1", "mask=255.255.254.0", "router=10.0.66.1,10.0.67.1")
+	plain := startPlugin(t, m, "10.0.68.10", "10.0.68.20", "1h", "relay=10.68.0.1")
+
+	// each pool selected by relay sends those of its VLAN, in offers and
+	// acks alike
+	for _, tc := range []struct {
+		p       *PluginState
+		relay   net.IP
+		mask    []byte
+		routers []byte
+	}{
+		{vlanA, net.IPv4(10, 66, 0, 1), []byte{255, 255, 255, 0}, []byte{10, 0, 66, 1}},
+		{vlanB, net.IPv4(10, 67, 0, 1), []byte{255, 255, 254, 0}, []byte{10, 0, 66, 1, 10, 0, 67, 1}},
+		{plain, net.IPv4(10, 68, 0, 1), nil, nil},
+	} {
+		offer := exchange(t, tc.p, newRequest(t, dhcpv4.MessageTypeDiscover, mac, dhcpv4.WithGatewayIP(tc.relay)))
+		if offer == nil {
+			t.Fatalf("no offer through %s", tc.relay)
+		}
+		ack := requestThrough(t, tc.p, mac, offer.YourIPAddr, tc.relay)
+		if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck {
+			t.Fatalf("no ack through %s: %v", tc.relay, ack)
+		}
+		for _, reply := range []*dhcpv4.DHCPv4{offer, ack} {
+			if got := reply.Options.Get(dhcpv4.OptionSubnetMask); !bytes.Equal(got, tc.mask) {
+				t.Errorf("%s through %s: mask %v, want %v", reply.MessageType(), tc.relay, got, tc.mask)
+			}
+			if got := reply.Options.Get(dhcpv4.OptionRouter); !bytes.Equal(got, tc.routers) {
+				t.Errorf("%s through %s: routers %v, want %v", reply.MessageType(), tc.relay, got, tc.routers)
+			}
+		}
+	}
+}
+
+func TestPoolOptionsOverride(t *testing.T) {
+	earlier := dhcpv4.Option{Code: dhcpv4.OptionInterfaceMTU, Value: dhcpv4.Uint16(1500)}
+	for _, tc := range []struct {
+		override string
+		want     []byte
+	}{
+		{"false", []byte{0x05, 0xdc}},
+		{"true", []byte{0x05, 0x78}},
+	} {
+		cfg, err := parseConfig([]string{"redis://localhost/0", "10.3.0.10", "10.3.0.200", "1h", "mtu=1400", "options_override=" + tc.override})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, _ := dhcpv4.New(dhcpv4.WithOption(earlier))
+		(&PluginState{cfg: cfg}).applyOptions(resp)
+		if got := resp.Options.Get(dhcpv4.OptionInterfaceMTU); !bytes.Equal(got, tc.want) {
+			t.Errorf("options_override=%s: MTU option %v, want %v", tc.override, got, tc.want)
+		}
+	}
+}
+
+func TestMaskAndRoutersOverride(t *testing.T) {
+	// set by an earlier plugin, e.g. the netmask and router plugins
+	earlier := []dhcpv4.Modifier{
+		dhcpv4.WithOption(dhcpv4.OptSubnetMask(net.CIDRMask(16, 32))),
+		dhcpv4.WithOption(dhcpv4.OptRouter(net.IPv4(10, 3, 0, 254))),
+	}
+	for _, tc := range []struct {
+		override      string
+		mask, routers []byte
+	}{
+		{"false", []byte{255, 255, 0, 0}, []byte{10, 3, 0, 254}},
+		{"true", []byte{255, 255, 255, 0}, []byte{10, 3, 0, 1}},
+	} {
+		cfg, err := parseConfig([]string{"redis://localhost/0", "10.3.0.10", "10.3.0.200", "1h",
+			"mask=24", "router=10.3.0.1", "options_override=" + tc.override})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, _ := dhcpv4.New(earlier...)
+		added := (&PluginState{cfg: cfg}).applyOptions(resp)
+		if got := resp.Options.Get(dhcpv4.OptionSubnetMask); !bytes.Equal(got, tc.mask) {
+			t.Errorf("options_override=%s: mask %v, want %v", tc.override, got, tc.mask)
+		}
+		if got := resp.Options.Get(dhcpv4.OptionRouter); !bytes.Equal(got, tc.routers) {
+			t.Errorf("options_override=%s: routers %v, want %v", tc.override, got, tc.routers)
+		}
+		if (len(added) == 2) != (tc.override == "true") {
+			t.Errorf("options_override=%s: options %v added", tc.override, added)
+		}
+	}
+}
+
+func TestRelayInfoEcho(t *testing.T) {
+	// a circuit id and a remote id, in the order and encoding of the relay
+	info := []byte{1, 4, 'e', 't', 'h', '0', 2, 3, 0xaa, 0xbb, 0xcc}
+	relayed := dhcpv4.WithGatewayIP(net.IPv4(10, 0, 21, 1))
+	withInfo := dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionRelayAgentInformation, info))
+	for _, tc := range []struct {
+		name   string
+		echo   string
+		mods   []dhcpv4.Modifier
+		echoed bool
+	}{
+		{"relayed", "true", []dhcpv4.Modifier{relayed, withInfo}, true},
+		{"relayed without the option", "true", []dhcpv4.Modifier{relayed}, false},
+		{"inserted without giaddr", "true", []dhcpv4.Modifier{withInfo}, true},
+		{"not relayed", "true", nil, false},
+		{"echo disabled", "false", []dhcpv4.Modifier{relayed, withInfo}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := miniredis.RunT(t)
+			p := startPlugin(t, m, "10.0.21.10", "10.0.21.200", "1h", "mtu=1400", "relay_echo="+tc.echo)
+			req := packet(t, iana.HWTypeEthernet, []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}, tc.mods...)
+			offer := exchange(t, p, req)
+			if offer == nil {
+				t.Fatal("no offer")
+			}
+			wire, err := dhcpv4.FromBytes(offer.ToBytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := wire.Options.Get(dhcpv4.OptionRelayAgentInformation)
+			if tc.echoed && !bytes.Equal(got, info) {
+				t.Errorf("relay agent information %x, want %x", got, info)
+			}
+			if !tc.echoed && got != nil {
+				t.Errorf("relay agent information %x echoed", got)
+			}
+			if !wire.Options.Has(dhcpv4.OptionInterfaceMTU) {
+				t.Error("options of the pool left out")
+			}
+		})
+	}
+}
+
+func TestRelayInfoEchoRequest(t *testing.T) {
+	m := miniredis.RunT(t)
+	// the request of another address than the lease is NAKed
+	p := startPlugin(t, m, "10.0.64.10", "10.0.64.20", "1h", "nak_mismatch=true")
+	info := []byte{1, 5, 'g', 'e', '0', '/', '1', 2, 2, 0x0a, 0x0b}
+	withInfo := dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionRelayAgentInformation, info))
+	const mac = "00:11:22:33:44:0a"
+
+	// echoed returns the relay agent information of the reply to req, as
+	// sent
+	echoed := func(req *dhcpv4.DHCPv4) (dhcpv4.MessageType, []byte) {
+		t.Helper()
+		reply := exchange(t, p, req)
+		if reply == nil {
+			t.Fatal("no reply")
+		}
+		wire, err := dhcpv4.FromBytes(reply.ToBytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wire.MessageType(), wire.Options.Get(dhcpv4.OptionRelayAgentInformation)
+	}
+	ip := lease(t, p, mac)
+	for _, tc := range []struct {
+		name string
+		req  *dhcpv4.DHCPv4
+		typ  dhcpv4.MessageType
+	}{
+		{"ack", newRequest(t, dhcpv4.MessageTypeRequest, mac, withInfo, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip))), dhcpv4.MessageTypeAck},
+		{"nak", newRequest(t, dhcpv4.MessageTypeRequest, mac, withInfo, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 64, 99)))), dhcpv4.MessageTypeNak},
+	} {
+		typ, got := echoed(tc.req)
+		if typ != tc.typ || !bytes.Equal(got, info) {
+			t.Errorf("%s: %s with relay agent information %x, want %s with %x", tc.name, typ, got, tc.typ, info)
+		}
+	}
+	if _, got := echoed(newRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)))); got != nil {
+		t.Errorf("relay agent information %x added", got)
+	}
+}
+
+func TestRelayInfoSurvivesMaxMessageSize(t *testing.T) {
+	m := miniredis.RunT(t)
+	var routes []string
+	for i := 0; i < 25; i++ {
+		routes = append(routes, fmt.Sprintf("10.%d.0.0/24:10.0.85.1", 100+i))
+	}
+	p := startPlugin(t, m, "10.0.85.10", "10.0.85.20", "1h", "mask=24", "mtu=1400",
+		"routes="+strings.Join(routes, ","))
+	// a long circuit id, as some switches insert
+	info := append([]byte{1, 100}, bytes.Repeat([]byte{'c'}, 100)...)
+	withInfo := dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionRelayAgentInformation, info))
+	const mac = "00:11:22:33:44:0a"
+
+	for _, tc := range []struct {
+		name    string
+		size    uint16
+		limit   int
+		trimmed bool
+	}{
+		{"large", 1500, 1500, false},
+		// below the minimum, which every client accepts anyway
+		{"small", 300, minMessageSize, true},
+		{"minimum", minMessageSize, minMessageSize, true},
+	} {
+		req := newRequest(t, dhcpv4.MessageTypeDiscover, mac, withInfo,
+			dhcpv4.WithOption(dhcpv4.OptMaxMessageSize(tc.size)))
+		offer := exchange(t, p, req)
+		if offer == nil {
+			t.Fatalf("%s: no offer", tc.name)
+		}
+		raw := offer.ToBytes()
+		if len(raw)+udpIPHeaders > tc.limit {
+			t.Errorf("%s: offer of %d bytes over %d", tc.name, len(raw)+udpIPHeaders, tc.limit)
+		}
+		wire, err := dhcpv4.FromBytes(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := wire.Options.Get(dhcpv4.OptionRelayAgentInformation); !bytes.Equal(got, info) {
+			t.Errorf("%s: relay agent information %x, want %x", tc.name, got, info)
+		}
+		for _, opt := range []dhcpv4.OptionCode{dhcpv4.OptionIPAddressLeaseTime, dhcpv4.OptionSubnetMask, dhcpv4.OptionDHCPMessageType} {
+			if !wire.Options.Has(opt) {
+				t.Errorf("%s: %s dropped", tc.name, opt)
+			}
+		}
+		if got := wire.Options.Has(dhcpv4.OptionClasslessStaticRoute); got == tc.trimmed {
+			t.Errorf("%s: routes kept %v, want %v", tc.name, got, !tc.trimmed)
+		}
+	}
+	if n := p.Stats().TrimmedReplies; n != 2 {
+		t.Errorf("%d replies trimmed, want 2", n)
+	}
+}
@@ -0,0 +1,59 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// REDIS_LEASE_TIME_KEY_PREFIX prefixes the lease time overrides of the
+// clients of the default namespace, e.g.
+// `SET o:dhcp:leasetime:aa:bb:cc:dd:ee:ff 168h`. An override replaces the
+// lease time and the expire-at policy of the pool for that client, from its
+// next request on; the lease ramp and the pressure bands still cap it.
+const REDIS_LEASE_TIME_KEY_PREFIX = "o:dhcp:leasetime:"
+
+// overridePolicy prefixes the policy of the records granted with an override
+const overridePolicy = "lease-time "
+
+// LeaseTimeOverride returns the lease time override of mac as stored, ""
+// if it has none
+func (r *RedisProvider) LeaseTimeOverride(ctx context.Context, mac string) (string, error) {
+	val, err := r.rdb.Get(ctx, r.ns.override+mac).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return val, unavailable(err)
+}
+
+// leaseTimeOverride returns the lease time override of mac, 0 if it has
+// none. An invalid override is logged and ignored, and so is a failing
+// read, granting the lease time of the pool.
+func (p *PluginState) leaseTimeOverride(ctx context.Context, mac string) time.Duration {
+	val, err := p.storage.LeaseTimeOverride(ctx, mac)
+	if err != nil {
+		log.Warnf("could not read the lease time override of MAC %s: %v", mac, err)
+		return 0
+	}
+	if val == "" {
+		return 0
+	}
+	d, err := parseDuration(val, leaseBounds)
+	if err != nil {
+		log.Warnf("ignoring the lease time override of MAC %s: %v", mac, err)
+		return 0
+	}
+	return d
+}
+
+// overrideChanged reports whether record was granted under another
+// override than override, or under none, so that the change applies at the
+// renewal even if it shortens the lease
+func (p *PluginState) overrideChanged(record *Record, override time.Duration) bool {
+	if override == 0 && !strings.HasPrefix(record.Policy, overridePolicy) {
+		return false
+	}
+	return record.Policy != p.policyName(override)
+}
@@ -0,0 +1,57 @@
+package rangeredisplugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestLeaseTimeOverride(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.53.10", "10.0.53.20", "1h")
+	const a, b = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+
+	// check renews the lease of a and checks the lease time granted
+	check := func(what string, want time.Duration, policy string) {
+		t.Helper()
+		ip := p.leases.ipOf(a)
+		ack := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, a, dhcpv4.WithClientIP(ip)))
+		if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck {
+			t.Fatalf("%s: no ACK: %v", what, ack)
+		}
+		if got := ack.IPAddressLeaseTime(0); got != want {
+			t.Errorf("%s: lease time %s in the reply, want %s", what, got, want)
+		}
+		rec, err := p.storage.GetRecord(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.Expires.Sub(p.clock.Now()).Round(time.Second); got != want {
+			t.Errorf("%s: record expiring in %s, want %s", what, got, want)
+		}
+		if rec.Policy != policy {
+			t.Errorf("%s: policy %q, want %q", what, rec.Policy, policy)
+		}
+	}
+
+	m.Set(p.storage.ns.override+a, "8h")
+	lease(t, p, a)
+	check("override", 8*time.Hour, "lease-time 8h0m0s")
+	if offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, b)); offer == nil || offer.IPAddressLeaseTime(0) != time.Hour {
+		t.Errorf("offer to a client without override: %v", offer)
+	}
+
+	// a change applies at the renewal, even shortening the lease
+	m.Set(p.storage.ns.override+a, "30m")
+	check("shortened", 30*time.Minute, "lease-time 30m0s")
+
+	m.Set(p.storage.ns.override+a, "soon")
+	check("invalid", time.Hour, "")
+
+	m.Set(p.storage.ns.override+a, "4h")
+	check("restored", 4*time.Hour, "lease-time 4h0m0s")
+	m.Del(p.storage.ns.override + a)
+	check("removed", time.Hour, "")
+}
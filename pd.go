@@ -0,0 +1,132 @@
+package rangeredisplugin
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// Records of the delegated prefixes are keyed by DUID like the addresses,
+// under prefixes of their own
+const (
+	REDIS_PD_KEY_PREFIX        = "dhcp6pd:"
+	REDIS_PD_SHADOW_KEY_PREFIX = "s:dhcp6pd:"
+)
+
+var kindPrefix = v6Kind{name: "prefix", prefix: REDIS_PD_KEY_PREFIX, shadow: REDIS_PD_SHADOW_KEY_PREFIX}
+
+// pool6 is the allocator of one kind of DHCPv6 lease: the addresses of a
+// range, or the prefixes of a given length within a delegation prefix
+type pool6 struct {
+	kind      v6Kind
+	allocator allocators.Allocator
+	// delegation and length are set for a pool of prefixes
+	delegation *net.IPNet
+	length     int
+	// addresses is set for a pool of addresses
+	addresses *rangeAllocator6
+}
+
+func newAddressPool6(start, end net.IP) (*pool6, error) {
+	a, err := newRangeAllocator6(start, end)
+	if err != nil {
+		return nil, err
+	}
+	return &pool6{kind: kindAddress, allocator: a, addresses: a}, nil
+}
+
+func newPrefixPool6(delegation *net.IPNet, length int) (*pool6, error) {
+	a, err := bitmap.NewBitmapAllocator(*delegation, length)
+	if err != nil {
+		return nil, err
+	}
+	return &pool6{kind: kindPrefix, allocator: a, delegation: delegation, length: length}, nil
+}
+
+// fits reports whether the lease of rec belongs to the pool. A prefix of
+// another length, e.g. stored before the length was changed, does not.
+func (p *pool6) fits(rec Record) bool {
+	if p.addresses != nil {
+		return rec.PrefixLength == 0 && p.addresses.contains(rec.IP)
+	}
+	return rec.PrefixLength == p.length && p.delegation.Contains(rec.IP)
+}
+
+// net returns the address or the prefix leased by rec
+func (p *pool6) net(rec Record) net.IPNet {
+	if p.addresses != nil {
+		return net.IPNet{IP: rec.IP, Mask: net.CIDRMask(128, 128)}
+	}
+	return net.IPNet{IP: rec.IP.Mask(net.CIDRMask(p.length, 128)), Mask: net.CIDRMask(p.length, 128)}
+}
+
+// record returns a new record leasing n
+func (p *pool6) record(n net.IPNet) *Record {
+	if p.addresses != nil {
+		return &Record{IP: n.IP}
+	}
+	return &Record{IP: n.IP, PrefixLength: p.length}
+}
+
+// answerIAPD returns the IA_PD answering ia with the prefix delegated to
+// duid. An exhausted pool is answered with the NoPrefixAvail status. The
+// prefixes a renewing client lists that are not its delegation, such as a
+// prefix that no longer fits the pool, are returned with zero lifetimes so
+// that the client stops using them.
+func (p *PluginState6) answerIAPD(duid string, ia *dhcpv6.OptIAPD, renewing bool, corr correlation) (*dhcpv6.OptIAPD, error) {
+	out := &dhcpv6.OptIAPD{IaId: ia.IaId}
+	record, stale, err := p.lease(p.prefixes, duid, renewing, corr)
+	if errors.Is(err, ErrNoBinding) {
+		log.Infof("No IPv6 prefix to renew for DUID %s", duid)
+		p.refusals.note(duid, ReasonNoBinding, "NoBinding")
+		out.Options.Add(&dhcpv6.OptStatusCode{StatusCode: iana.StatusNoBinding, StatusMessage: "no binding"})
+		return out, nil
+	}
+	if err != nil && !errors.Is(err, ErrPoolExhausted) {
+		return nil, err
+	}
+
+	var current *net.IPNet
+	if err == nil {
+		n := p.prefixes.net(*record)
+		current = &n
+	}
+	if renewing {
+		listed := ia.Options.Prefixes()
+		if stale != nil && stale.PrefixLength > 0 {
+			n := prefixOf(*stale)
+			listed = append(listed, &dhcpv6.OptIAPrefix{Prefix: &n})
+		}
+		seen := make(map[string]bool)
+		for _, pfx := range listed {
+			if pfx.Prefix == nil || seen[pfx.Prefix.String()] ||
+				(current != nil && pfx.Prefix.String() == current.String()) {
+				continue
+			}
+			seen[pfx.Prefix.String()] = true
+			out.Options.Add(&dhcpv6.OptIAPrefix{Prefix: pfx.Prefix})
+		}
+	}
+
+	if current == nil {
+		log.Warnf("Could not delegate IPv6 prefix to DUID %s: %v", duid, err)
+		p.refusals.note(duid, ReasonPoolExhausted, "NoPrefixAvail")
+		out.Options.Add(&dhcpv6.OptStatusCode{StatusCode: iana.StatusNoPrefixAvail, StatusMessage: "no prefixes available"})
+		return out, nil
+	}
+	lease := record.Expires.Sub(p.clock.Now()).Round(time.Second)
+	out.T1, out.T2 = lease/2, lease*4/5
+	out.Options.Add(&dhcpv6.OptIAPrefix{PreferredLifetime: lease, ValidLifetime: lease, Prefix: current})
+	log.Printf("found IPv6 prefix %s for DUID %s", current, duid)
+	return out, nil
+}
+
+// prefixOf returns the prefix of a record, whatever pool it was leased from
+func prefixOf(rec Record) net.IPNet {
+	return net.IPNet{IP: rec.IP.Mask(net.CIDRMask(rec.PrefixLength, 128)), Mask: net.CIDRMask(rec.PrefixLength, 128)}
+}
@@ -0,0 +1,131 @@
+package rangeredisplugin
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// withPrefixes asks for an IA_PD listing the given prefixes
+func withPrefixes(t *testing.T, prefixes ...string) dhcpv6.Modifier {
+	t.Helper()
+	var opts []*dhcpv6.OptIAPrefix
+	for _, s := range prefixes {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts = append(opts, &dhcpv6.OptIAPrefix{Prefix: n})
+	}
+	return dhcpv6.WithIAPD([4]byte{0, 0, 0, 2}, opts...)
+}
+
+// delegated returns the prefixes of the IA_PD of resp by their lifetime
+func delegated(t *testing.T, resp *dhcpv6.Message) map[string]time.Duration {
+	t.Helper()
+	if resp == nil {
+		t.Fatal("message dropped")
+	}
+	ia := resp.Options.OneIAPD()
+	if ia == nil {
+		t.Fatal("no IA_PD in the reply")
+	}
+	got := make(map[string]time.Duration)
+	for _, pfx := range ia.Options.Prefixes() {
+		got[pfx.Prefix.String()] = pfx.ValidLifetime
+	}
+	return got
+}
+
+func TestPrefixDelegation(t *testing.T) {
+	m := miniredis.RunT(t)
+	// 4 prefixes of /56
+	args := []string{"2001:db8::10", "2001:db8::20", "1h", "delegate=2001:db8:100::/54", "delegate_length=56"}
+	h := startPlugin6(t, m, args...)
+	const a, b = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+
+	// an address and a prefix in one packet
+	resp := exchange6(t, h, dhcpv6.MessageTypeRequest, a, withPrefixes(t))
+	if ip := leased6(t, resp); !ip.Equal(net.ParseIP("2001:db8::10")) {
+		t.Errorf("leased %s along with the prefix", ip)
+	}
+	if got := delegated(t, resp); len(got) != 1 || got["2001:db8:100::/56"] != time.Hour {
+		t.Errorf("delegated %v, want 2001:db8:100::/56 for 1h", got)
+	}
+	ia := resp.Options.OneIAPD()
+	if ia.IaId != [4]byte{0, 0, 0, 2} || ia.T1 != 30*time.Minute || ia.T2 != 48*time.Minute {
+		t.Errorf("IA_PD answered IAID %x with T1 %s and T2 %s", ia.IaId, ia.T1, ia.T2)
+	}
+	duid := hex.EncodeToString(duidOf(t, a).ToBytes())
+	for _, key := range []string{REDIS_PD_KEY_PREFIX + duid, REDIS_PD_SHADOW_KEY_PREFIX + duid, REDIS_V6_KEY_PREFIX + duid} {
+		if !m.Exists(key) {
+			t.Errorf("no key %s", key)
+		}
+	}
+
+	// a renewal keeps the prefix, and other prefixes listed get zero lifetimes
+	resp = exchange6(t, h, dhcpv6.MessageTypeRenew, a, withPrefixes(t, "2001:db8:100::/56", "2001:db8:200::/56"))
+	if got := delegated(t, resp); len(got) != 2 || got["2001:db8:100::/56"] != time.Hour || got["2001:db8:200::/56"] != 0 {
+		t.Errorf("renewal delegated %v", got)
+	}
+
+	// the rest of the pool, then NoPrefixAvail while addresses are left
+	for i := 1; i < 4; i++ {
+		mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x45, byte(i)}.String()
+		if got := delegated(t, exchange6(t, h, dhcpv6.MessageTypeRequest, mac, withPrefixes(t))); len(got) != 1 {
+			t.Fatalf("client %d delegated %v", i, got)
+		}
+	}
+	resp = exchange6(t, h, dhcpv6.MessageTypeSolicit, b, withPrefixes(t))
+	if got := delegated(t, resp); len(got) != 0 {
+		t.Errorf("delegated %v from an exhausted pool", got)
+	}
+	if st := resp.Options.OneIAPD().Options.Status(); st == nil || st.StatusCode != iana.StatusNoPrefixAvail {
+		t.Errorf("exhausted pool answered status %v", st)
+	}
+	if ip := leased6(t, resp); ip == nil {
+		t.Error("no address leased along with the exhausted pool")
+	}
+
+	// the prefixes are reloaded by a new instance
+	h = startPlugin6(t, m, args...)
+	if got := delegated(t, exchange6(t, h, dhcpv6.MessageTypeSolicit, b, withPrefixes(t))); len(got) != 0 {
+		t.Errorf("delegated %v after a reload", got)
+	}
+
+	// RELEASE frees the prefix
+	exchange6(t, h, dhcpv6.MessageTypeRelease, a, withPrefixes(t, "2001:db8:100::/56"))
+	if m.Exists(REDIS_PD_KEY_PREFIX + duid) {
+		t.Error("record of the released prefix left")
+	}
+	if got := delegated(t, exchange6(t, h, dhcpv6.MessageTypeRequest, b, withPrefixes(t))); got["2001:db8:100::/56"] != time.Hour {
+		t.Errorf("delegated %v after the release, want the released prefix", got)
+	}
+}
+
+func TestPrefixNoLongerFits(t *testing.T) {
+	m := miniredis.RunT(t)
+	h := startPlugin6(t, m, "2001:db8::10", "2001:db8::20", "1h", "delegate=2001:db8:100::/54", "delegate_length=56")
+	const a = "00:11:22:33:44:0a"
+	if got := delegated(t, exchange6(t, h, dhcpv6.MessageTypeRequest, a, withPrefixes(t))); len(got) != 1 {
+		t.Fatalf("delegated %v", got)
+	}
+
+	// the length changes; the renewal gets a new prefix and the old one is
+	// withdrawn, even if the client does not list it
+	h = startPlugin6(t, m, "2001:db8::10", "2001:db8::20", "1h", "delegate=2001:db8:100::/54", "delegate_length=60")
+	resp := exchange6(t, h, dhcpv6.MessageTypeRenew, a, withPrefixes(t))
+	if got := delegated(t, resp); len(got) != 2 || got["2001:db8:100::/60"] != time.Hour || got["2001:db8:100::/56"] != 0 {
+		t.Errorf("renewal after the length changed delegated %v", got)
+	}
+	// the stale record was replaced, the next renewal only has the new prefix
+	resp = exchange6(t, h, dhcpv6.MessageTypeRenew, a, withPrefixes(t, "2001:db8:100::/60"))
+	if got := delegated(t, resp); len(got) != 1 || got["2001:db8:100::/60"] != time.Hour {
+		t.Errorf("second renewal delegated %v", got)
+	}
+}
@@ -1,23 +1,26 @@
 package rangeredisplugin
 
 import (
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
 	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/coredhcp/coredhcp/plugins/allocators"
-	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+	"github.com/go-redis/redis/v9"
 	"github.com/insomniacslk/dhcp/dhcpv4"
-	"github.com/insomniacslk/dhcp/dhcpv6"
 )
 
-var log = logger.GetLogger("plugins/range-redis")
+var log = recordingLogger{
+	pluginLogger: logger.GetLogger("plugins/range-redis"),
+	recent:       newErrorRing(recentErrorsSize),
+}
 
 // Note that importing the plugin is not enough to use it: you have to
 // explicitly specify the intention to use it in the `config.yml` file, in the
@@ -39,154 +42,1001 @@ var Plugin = plugins.Plugin{
 // PluginState is the data held by an instance of the range plugin
 type PluginState struct {
 	LeaseTime time.Duration
+	cfg       *Config
 	storage   *RedisProvider
 	allocator allocators.Allocator
+	leases    *leaseTable
+	events    chan Event
+	sinks     []EventSink
+	queuesMu  sync.Mutex
+	queues    []*sinkQueue
+	closing   chan struct{}
+	closeOnce sync.Once
+	// dispatched is closed once the event dispatcher has returned
+	dispatched   chan struct{}
+	counters     counters
+	ready        chan struct{}
+	clock        *instanceClock
+	preferred    *preferredIPs
+	exporter     exporter
+	extender     extender
+	backfiller   backfiller
+	observations rateLimiter
+	reassign     reassignments
+	traced       traceTargets
+	watchdog     clockWatchdog
+	naks         nakLimiter
+	flaps        flapTracker
+	slowPath     slowPathLimiter
+	offers       offerCache
+	replies      replyCache
+	cooldown     cooldownList
+	ptr          ptrChecker
+	full         storageFull
+	// model is the reference model of the invariant checker, or nil
+	model *refModel
+	// oplog is the operation log, or nil
+	oplog    *opLog
+	ramp     leaseRamp
+	pressure pressure
+	// startup is the report of the startup audit
+	startup  *AuditReport
+	handover handover
+	kill     killSwitch
+	// adoptions holds the adopted leases until they are committed
+	adoptions adoptionQueue
+	refusals  *refusalLedger
+	reserved  reservedIPs
+	deny      denyList
+	observed  observedHolders
+	limits    leaseLimits
+	frozen    frozenIPs
+	split     poolSplit
+	// id names the instance in the registry and in handovers
+	id           string
+	registration Registration
+
+	// unlisten stops the notifications of the storage, see Close
+	unlisten func()
+	// listener receives the notifications, and swept is the count of its
+	// dropped ones the leases were last swept for, see sweepDropped
+	listener *Listener
+	swept    uint64
 }
 
 // Handler4 handles DHCPv4 packets for the range plugin
 func (p *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	record, err := p.storage.GetRecord(req.ClientHWAddr.String())
+	if p.kill.active() != nil {
+		p.counters.killSwitchPassed.Add(1)
+		return resp, false
+	}
+	if !handledType(req.MessageType()) {
+		// e.g. an INFORM, for the next plugins: the client has an address
+		// and only wants options, so nothing is allocated nor stored
+		p.counters.typePassed.Add(1)
+		return resp, false
+	}
+	if !p.selects(req) {
+		// for the instance serving the relay, if any
+		p.counters.relayPassed.Add(1)
+		return resp, false
+	}
+	// a copy of a request handled a moment ago only gets the same reply
+	key := replyKey{mac: req.ClientHWAddr.String(), xid: req.TransactionID, typ: req.MessageType()}
+	entry, seen := p.replies.claim(key, p.clock.Now())
+	if seen {
+		p.counters.replayedReplies.Add(1)
+		log.Debugf("replaying the reply to %s %s of MAC %s", req.MessageType(), req.TransactionID, req.ClientHWAddr)
+		return entry.replay()
+	}
+	var out *dhcpv4.DHCPv4
+	stop := true
+	defer func() { entry.complete(out, stop) }()
+
+	out, stop = p.handle4(req, resp)
+	if out != nil {
+		// once all other options are set, so that it is never left out
+		p.echoRelayInfo(req, out)
+		if dropped := fitReply(req, out); len(dropped) > 0 {
+			p.counters.trimmedReplies.Add(1)
+			log.Debugf("dropped options %v of the %s to MAC %s over its maximum message size",
+				dropped, out.MessageType(), req.ClientHWAddr)
+		}
+	}
+	return out, stop
+}
+
+func (p *PluginState) handle4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if p.handedOver() || p.splitAborted() {
+		return nil, true
+	}
+	if _, ok := p.cfg.allowedPrefix(req.ClientHWAddr); !ok {
+		// dropped before anything is looked up
+		p.counters.disallowedHWAddrs.Add(1)
+		log.Debugf("Dropping request %s of MAC %s: not an allowed prefix", req.TransactionID, req.ClientHWAddr)
+		return nil, true
+	}
+	mac, err := p.clientKey(req)
 	if err != nil {
-		log.Errorf("Could not get record for %s: %v", req.ClientHWAddr.String(), err)
+		p.counters.rejectedHWAddrs.Add(1)
+		log.Warnf("Dropping request %s: %v", req.TransactionID, err)
+		return nil, true
+	}
+	tr := p.startTrace(req, mac)
+	defer tr.finish()
+	tr.step("pool %s-%s", p.cfg.Start, p.cfg.End)
+
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeRelease:
+		// neither is ever answered
+		p.release(req, mac, tr)
+		return nil, true
+	case dhcpv4.MessageTypeDecline:
+		p.decline(req, mac, tr)
+		return nil, true
+	}
+
+	if p.denied(mac) {
+		log.Infof("Ignoring %s from denied MAC %s", req.MessageType(), mac)
+		tr.step("dropped: denied")
+		p.refusals.note(mac, ReasonDenied, "")
+		return nil, true
+	}
+
+	if ip := preassigned(resp); ip != nil {
+		// never hand out a second address to a client served by an
+		// earlier plugin, e.g. with a static lease
+		tr.step("%s assigned by an earlier plugin, passing on", ip)
+		p.adoptPreassigned(mac, ip)
+		return resp, false
+	}
+
+	if req.MessageType() == dhcpv4.MessageTypeDiscover {
+		if ip, remaining, first, ok := p.cachedOffer(mac, p.clock.Now()); ok {
+			tr.step("offer interval: answering %s from cache", ip)
+			shapeReply(req, resp, resp.MessageType())
+			resp.YourIPAddr = ip
+			setLeaseTime(resp, remaining, p.cfg.T1, p.cfg.T2)
+			p.applyOptions(resp)
+			if first {
+				log.Infof("MAC %s keeps discovering right after its lease, answering from cache", mac)
+			}
+			return resp, false
+		}
+	}
+
+	// an adopted lease is found among the adoptions until it is committed
+	record, adopted := p.adoptions.get(mac)
+	if !adopted {
+		record, err = p.lookupRecord(req, mac)
+	}
+	switch {
+	case adopted:
+		tr.step("adopted record found: %s until %s", record.IP, record.Expires.Format(time.RFC3339))
+	case err == nil:
+		tr.step("record found: %s until %s", record.IP, record.Expires.Format(time.RFC3339))
+	case errors.Is(err, ErrNotFound):
+		tr.step("no record")
+	case errors.Is(err, ErrCorruptRecord):
+		log.Warnf("Discarding record for %s: %v", mac, err)
+		tr.step("corrupt record discarded: %v", err)
+	default:
+		log.Errorf("Could not get record for %s: %v", mac, err)
+		tr.step("dropped: %v", err)
+		p.refusals.note(mac, ReasonStorageError, err.Error())
 		return nil, true
 	}
 
-	if record.IP == nil {
+	if !p.takeOverBinding(mac, record) {
+		tr.step("dropped: binding not taken over from the source of the split")
+		p.refusals.note(mac, ReasonSplit, record.IP.String())
+		return nil, true
+	}
+	d := p.decide(context.TODO(), req, mac, record, resp.ServerIdentifier())
+	// a move off an address in conflict is asked once
+	p.reassign.take(mac)
+	if d.moved {
+		// the address stays withheld for the target
+		p.leases.remove(mac, record.IP)
+	}
+	if d.ended != nil {
+		switch d.endedBy {
+		case ReasonExcluded:
+			p.drainExcluded(mac, d.ended)
+			tr.step("%s is excluded, lease ended", d.ended.IP)
+		case ReasonReserved:
+			if err := p.storage.DeleteRecord(mac); err != nil {
+				log.Errorf("Could not end lease of %s for MAC %s reserved %s: %v", d.ended.IP, mac, d.reserved, err)
+				tr.step("dropped: %v", err)
+				p.refusals.note(mac, ReasonStorageError, err.Error())
+				return nil, true
+			}
+			p.adoptions.forget(mac)
+			p.freeLease(mac, d.ended.IP)
+			tr.step("lease of %s ended for the reservation", d.ended.IP)
+		case ReasonOtherServer, ReasonRequestedMismatch:
+			// the offer is not taken up: its address is free again
+			if err := p.endLease(mac, d.ended, false); err != nil && !errors.Is(err, errNotFreed) {
+				log.Errorf("Could not withdraw offer of %s for MAC %s: %v", d.ended.IP, mac, err)
+			}
+			tr.step("offer of %s withdrawn", d.ended.IP)
+		}
+	}
+	agent := p.decodeAgentInfo(req)
+	if d.deferred != nil {
+		// withheld from the dynamic clients once the lease of the holder ends
+		if err := p.holdForCircuit(circuitID(relayOf(req), agent.CircuitID), d.deferred); err != nil {
+			log.Errorf("could not withhold %s reserved for circuit %s: %v", d.deferred, agent.CircuitID, err)
+		}
+		tr.step("%s reserved for circuit %s, deferred: leased to %s", d.deferred, agent.CircuitID, d.holder)
+	}
+	if d.reserved != nil {
+		tr.step("%s reserved", d.reserved)
+	}
+	relayMoved := false
+	if d.roaming != nil {
+		prev := d.roaming.Relay
+		switch p.roam(req, mac, d.roaming, d.roam, tr) {
+		case roamRefused:
+			if d.roam != roamRefused {
+				// the lease could not be ended
+				d = d.refuse(req, ReasonRoamingHold, fmt.Sprintf("held behind relay %s", prev))
+			}
+		case roamStay:
+			relayMoved = !d.roaming.Relay.Equal(prev)
+		}
+	}
+	if !d.admit && d.action != ActionAnswer {
+		return p.turnDown(req, resp, mac, d, tr)
+	}
+	record = d.record
+	if want := requestedIP(req); record != nil && want != nil && !want.Equal(record.IP) {
+		tr.step("requested %s, answering the lease of %s", want, record.IP)
+	}
+
+	hostname := p.hostname(req)
+	now := p.clock.Now()
+	override, leaseTime := d.override, d.leaseTime
+	if override > 0 {
+		tr.step("lease time overridden to %s", override)
+	}
+	if requested := p.requestedLeaseTime(req); requested > 0 {
+		tr.step("lease time %s requested", requested)
+	}
+	if !d.splitDeadline.IsZero() {
+		tr.step("split: lease capped to %s", leaseTime)
+	}
+
+	if record == nil {
 		// Allocating new address since there isn't one allocated
-		log.Printf("MAC address %s is new, leasing new IPv4 address", req.ClientHWAddr.String())
-		ip, err := p.allocator.Allocate(net.IPNet{})
-		if err != nil {
-			log.Errorf("Could not allocate IP for MAC %s: %v", req.ClientHWAddr.String(), err)
+		log.Printf("MAC address %s is new, leasing new IPv4 address", mac)
+		if !p.allowAllocation() {
+			log.Warnf("Not allocating IP for MAC %s: redis is out of memory", mac)
+			tr.step("dropped: redis is out of memory")
+			p.refusals.note(mac, ReasonStorageFull, "")
+			return nil, true
+		}
+		if !p.allowNewLeases() {
+			log.Infof("Not allocating IP for MAC %s: handing over to a successor", mac)
+			tr.step("dropped: handing over")
+			p.refusals.note(mac, ReasonHandingOver, "")
+			return nil, true
+		}
+		// a client renewing an address unknown to the storage keeps it,
+		// and is counted whatever the quota
+		mode := circuitHold
+		if requestedIP(req) != nil {
+			mode = circuitForce
+		}
+		if !p.circuitAllows(context.TODO(), req, agent.CircuitID, mac, mode) {
+			log.Infof("Not allocating IP for MAC %s: quota of circuit %s reached", mac, agent.CircuitID)
+			p.refusals.note(mac, ReasonCircuitQuota, agent.CircuitID)
+			switch {
+			case p.cfg.CircuitQuotaAction == ActionPass:
+				tr.step("passed on: quota of circuit %s reached", agent.CircuitID)
+				return resp, false
+			case req.MessageType() == dhcpv4.MessageTypeRequest:
+				tr.step("NAK: quota of circuit %s reached", agent.CircuitID)
+				return nak(req, resp), true
+			}
+			tr.step("dropped: quota of circuit %s reached", agent.CircuitID)
 			return nil, true
 		}
+		if p.leaseLimitReached(context.TODO()) {
+			log.Infof("Not allocating IP for MAC %s: lease limit reached", mac)
+			tr.step("dropped: lease limit reached")
+			p.refusals.note(mac, ReasonLeaseLimit, "")
+			return nil, true
+		}
+		if !p.slowPath.acquire(p.cfg.SlowPathWait) {
+			p.counters.slowPathRejected.Add(1)
+			log.Warnf("Not allocating IP for MAC %s: too many allocations in progress", mac)
+			tr.step("dropped: too many allocations in progress")
+			p.refusals.note(mac, ReasonRateLimited, "slow path")
+			return nil, true
+		}
+		defer p.slowPath.release()
+		var ip net.IP
+		// adopting for an address the client already uses, allocated for
+		// one taken from the allocator by this request, rolled back if the
+		// lease cannot be committed
+		adopting, allocated := false, false
+		switch {
+		case d.action == ActionNAK:
+			if !p.naks.allow(mac, now) {
+				tr.step("dropped: NAK rate limit")
+				p.refusals.note(mac, ReasonRateLimited, "NAK")
+				return nil, true
+			}
+			return p.turnDown(req, resp, mac, d, tr)
+		case d.action != ActionAnswer:
+			return p.turnDown(req, resp, mac, d, tr)
+		case d.reason == ReasonReserved:
+			if err := p.claimReserved(mac, d.ip); err != nil {
+				log.Errorf("Could not claim %s reserved for MAC %s: %v", d.ip, mac, err)
+				tr.step("dropped: cannot claim reserved %s: %v", d.ip, err)
+				p.refusals.note(mac, ReasonAllocationUnknown, err.Error())
+				return nil, true
+			}
+			ip = d.ip
+			tr.step("reserved %s for a new lease of %s", ip, leaseTime)
+		case d.reason == ReasonRequestedAdopted:
+			// claimed only now, another request may have come first
+			if err := p.claim(mac, d.ip); err != nil {
+				tr.step("cannot adopt requested %s: %v", d.ip, err)
+				if !p.naks.allow(mac, now) {
+					tr.step("dropped: NAK rate limit")
+					p.refusals.note(mac, ReasonRateLimited, "NAK")
+					return nil, true
+				}
+				return p.turnDown(req, resp, mac, d.nak(ReasonRequestedRefused, err.Error()), tr)
+			}
+			ip = d.ip
+			adopting = true
+			log.Infof("MAC %s keeps its unrecorded address %s", mac, ip)
+			tr.step("adopted requested %s for a new lease of %s", ip, leaseTime)
+		default:
+			ip, err = p.allocateChecked(mac, hostname)
+			if err != nil {
+				if errors.Is(err, ErrPoolExhausted) {
+					log.Warnf("Could not allocate IP for MAC %s: %v", mac, err)
+				} else {
+					log.Errorf("Could not allocate IP for MAC %s: %v", mac, err)
+				}
+				tr.step("dropped: allocation failed: %v", err)
+				if errors.Is(err, ErrPoolExhausted) {
+					p.refusals.note(mac, ReasonPoolExhausted, "")
+				} else {
+					p.refusals.note(mac, ReasonAllocationUnknown, err.Error())
+				}
+				return nil, true
+			}
+			allocated = true
+			tr.step("allocated %s for a new lease of %s", ip, leaseTime)
+		}
 		rec := Record{
-			IP:      ip.IP.To4(),
-			Expires: time.Now().Add(p.LeaseTime),
+			IP:       ip,
+			Expires:  now.Add(leaseTime),
+			Policy:   p.policyName(override),
+			Pressure: p.pressureName(),
+			Relay:    relayOf(req),
+			Hostname: hostname,
+			Labels:   p.labelsFor(mac),
+			State:    StateBound,
+			Static:   !p.inRange(ip),
+			LastSeen: now,
+			Pool:     p.poolName(),
 		}
-		err = p.storage.SaveIPAddress(req.ClientHWAddr, &rec)
-		if err != nil {
-			log.Errorf("SaveIPAddress for MAC %s failed: %v", req.ClientHWAddr.String(), err)
+		if req.MessageType() == dhcpv4.MessageTypeDiscover && p.cfg.OfferHold > 0 {
+			// held for the REQUEST of the client only, which grants it
+			rec.State = StateOffered
+			rec.Expires = now.Add(p.offerHold(leaseTime))
+		}
+		agent.apply(&rec)
+		if adopting {
+			// the client already uses the address: it is answered at once
+			// and the lease committed along with the other adoptions
+			p.adopt(mac, rec, now)
+			tr.step("adoption queued for commit")
+		} else {
+			// the lease is only granted once record and index are both committed
+			err = p.storage.CommitAllocation(mac, &rec)
+			p.noteWrite(err)
+			if err != nil {
+				log.Errorf("Could not commit lease of %s for MAC %s: %v", ip, mac, err)
+				// a reserved address stays withheld for its client
+				if allocated {
+					if err := p.allocator.Free(net.IPNet{IP: ip, Mask: net.IPv4Mask(255, 255, 255, 255)}); err != nil {
+						log.Errorf("Could not roll back allocation of %s: %v", ip, err)
+					}
+				}
+				tr.step("dropped: commit failed: %v", err)
+				p.refusals.note(mac, ReasonCommitFailed, err.Error())
+				return nil, true
+			}
+			p.counters.allocatedLeases.Add(1)
+			if rec.offered() {
+				tr.step("offer committed until %s", rec.Expires.Format(time.RFC3339))
+			} else {
+				tr.step("lease committed")
+				p.appendHistory(mac, rec.IP, now)
+			}
 		}
 		record = &rec
+		p.leases.set(mac, record.IP)
+		if record.offered() {
+			p.emit(Event{Type: EventOffer, MAC: mac, IP: record.IP, Labels: record.Labels})
+		} else {
+			p.emit(Event{Type: EventGrant, MAC: mac, IP: record.IP, Labels: record.Labels, Pressure: record.Pressure})
+		}
+	} else if d.frozen {
+		tr.step("%s frozen, kept until %s", record.IP, record.Expires.Format(time.RFC3339))
 	} else {
+		// an offer is granted by the REQUEST of the client, and held again
+		// by another DISCOVER; a bound lease is never made an offer again
+		granted := record.offered() && req.MessageType() == dhcpv4.MessageTypeRequest
+		expires := now.Add(leaseTime)
+		if record.offered() && !granted {
+			expires = now.Add(p.offerHold(leaseTime))
+		}
+		changed := p.reconcileExternalChange(mac, record)
+		changed = agent.apply(record) || changed || relayMoved || granted
+		if hostname != "" && hostname != record.Hostname {
+			record.Hostname = hostname
+			changed = true
+		}
+		changed = p.idleStale(record, now) || changed
+		changed = p.overrideChanged(record, override) || changed
+		// the source of a split shortens the leases of the sub-range
+		shortened := !d.splitDeadline.IsZero() && record.Expires.After(expires)
 		// Ensure we extend the existing lease at least past when the one we're giving expires
-		if record.Expires.Before(time.Now().Add(p.LeaseTime)) {
-			record.Expires = time.Now().Add(p.LeaseTime).Round(time.Second)
-			err := p.storage.SaveIPAddress(req.ClientHWAddr, record)
-			if err != nil {
-				log.Errorf("Could not persist lease for MAC %s: %v", req.ClientHWAddr.String(), err)
+		if changed || shortened || p.endsBy(record.Expires, expires) {
+			record.Expires = expires
+			record.LastSeen = now
+			if granted {
+				record.State = StateBound
 			}
+			record.Policy = p.policyName(override)
+			record.Pressure = p.pressureName()
+			record.Pool = p.poolName()
+			var err error
+			if adopted {
+				p.adoptions.add(mac, *record, now)
+			} else {
+				err = p.storage.SaveRecord(mac, record)
+				p.noteWrite(err)
+			}
+			switch {
+			case err != nil && granted:
+				// the offer would run out under the client
+				log.Errorf("Could not grant offered %s to MAC %s: %v", record.IP, mac, err)
+				tr.step("dropped: grant of %s not persisted: %v", record.IP, err)
+				p.refusals.note(mac, ReasonCommitFailed, err.Error())
+				return nil, true
+			case err != nil:
+				log.Errorf("Could not persist lease for MAC %s: %v", mac, err)
+				tr.step("renewal of %s not persisted: %v", record.IP, err)
+			case granted:
+				tr.step("offer of %s granted until %s", record.IP, record.Expires.Format(time.RFC3339))
+				p.appendHistory(mac, record.IP, now)
+			default:
+				tr.step("renewed %s until %s", record.IP, record.Expires.Format(time.RFC3339))
+			}
+		} else {
+			tr.step("kept %s until %s", record.IP, record.Expires.Format(time.RFC3339))
+		}
+		// leases extended past the lease time are announced as they are stored
+		if remaining := record.Expires.Sub(now); remaining > leaseTime {
+			leaseTime = remaining
+		}
+		switch {
+		case granted:
+			p.emit(Event{Type: EventGrant, MAC: mac, IP: record.IP, Labels: record.Labels, Pressure: record.Pressure})
+		case record.offered():
+			p.emit(Event{Type: EventOffer, MAC: mac, IP: record.IP, Labels: record.Labels})
+		default:
+			p.emit(Event{Type: EventRenew, MAC: mac, IP: record.IP, Labels: record.Labels, Pressure: record.Pressure})
 		}
 	}
+	p.noteOffer(mac, record, now)
+	shapeReply(req, resp, resp.MessageType())
 	resp.YourIPAddr = record.IP
-	resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(p.LeaseTime.Round(time.Second)))
-	log.Printf("found IP address %s for MAC %s", record.IP, req.ClientHWAddr.String())
+	setLeaseTime(resp, leaseTime, p.cfg.T1, p.cfg.T2)
+	if added := p.applyOptions(resp); len(added) > 0 {
+		tr.step("options added: %v", added)
+	}
+	tr.step("answering %s for %s", record.IP, leaseTime.Round(time.Second))
+	if p.cfg.LogLabels && len(record.Labels) > 0 {
+		log.Printf("found IP address %s for MAC %s [%s]", record.IP, mac, formatLabels(record.Labels))
+	} else {
+		log.Printf("found IP address %s for MAC %s", record.IP, mac)
+	}
 	return resp, false
 }
 
-func setup4(args ...string) (handler.Handler4, error) {
-	var (
-		err error
-		p   PluginState
-	)
+// inRange reports whether ip belongs to the pool of this instance
+func (p *PluginState) inRange(ip net.IP) bool {
+	return p.cfg.contains(ip)
+}
 
-	if len(args) < 4 {
-		return nil, fmt.Errorf("invalid number of arguments, want: 4 (uri, start IP, end IP, lease time), got: %d", len(args))
-	}
-	uri := args[0]
-	if uri == "" {
-		return nil, errors.New("uri cannot be empty")
+// foreign reports whether rec is the lease of another instance sharing the
+// storage: an address outside of our ranges, or a static address written
+// by another pool. Static addresses recorded before the pools were have
+// no pool, and are everyone's.
+func (p *PluginState) foreign(rec *Record) bool {
+	if !p.storage.shared() && !p.splitTarget() {
+		return false
 	}
-	ipRangeStart := net.ParseIP(args[1])
-	if ipRangeStart.To4() == nil {
-		return nil, fmt.Errorf("invalid IPv4 address: %v", args[1])
+	if rec.Static {
+		return rec.Pool != "" && rec.Pool != p.poolName()
 	}
-	ipRangeEnd := net.ParseIP(args[2])
-	if ipRangeEnd.To4() == nil {
-		return nil, fmt.Errorf("invalid IPv4 address: %v", args[2])
+	return !p.inRange(rec.IP)
+}
+
+func setup4(args ...string) (handler.Handler4, error) {
+	p := &PluginState{
+		ready:      make(chan struct{}),
+		closing:    make(chan struct{}),
+		dispatched: make(chan struct{}),
+		clock:      newInstanceClock(),
+		preferred:  &preferredIPs{},
+		ptr:        ptrChecker{resolver: net.DefaultResolver},
+		handover:   handover{done: make(chan struct{})},
+		adoptions:  newAdoptionQueue(),
+		id:         newInstanceID(),
 	}
-	if binary.BigEndian.Uint32(ipRangeStart.To4()) >= binary.BigEndian.Uint32(ipRangeEnd.To4()) {
-		return nil, errors.New("start of IP range has to be lower than the end of an IP range")
+
+	cfg, err := parseConfig(args)
+	if err != nil {
+		return nil, err
 	}
+	p.cfg = cfg
+	p.LeaseTime = cfg.LeaseTime
+	p.leases = newLeaseTable()
+	p.events = make(chan Event, eventQueueSize)
+	p.slowPath = newSlowPathLimiter(cfg.SlowPathLimit)
+	p.naks.limit = cfg.CacheLimit
+	p.flaps.limit = cfg.CacheLimit
+	p.offers.limit = cfg.CacheLimit
+	p.replies.limit = cfg.CacheLimit
+	p.traced.limit = cfg.CacheLimit
+	p.ptr.limit = cfg.CacheLimit
+	p.deny.limit = cfg.CacheLimit
+	p.observed.limit = cfg.CacheLimit
+	p.offers.tolerance = cfg.ExpiryTolerance
 
-	p.allocator, err = bitmap.NewIPv4Allocator(ipRangeStart, ipRangeEnd)
+	p.allocator, err = newAllocator(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("could not create an allocator: %w", err)
 	}
+	if err := checkRangeSemantics(cfg); err != nil {
+		return nil, fmt.Errorf("the allocator disagrees with the %s ranges: %w", rangeSemantics, err)
+	}
+	if cfg.CheckInvariants != "" {
+		p.model = newRefModel(cfg.CheckInvariants, cfg.contains)
+		p.allocator = &checkedAllocator{inner: p.allocator, model: p.model}
+		p.leases.model = p.model
+	}
+	if cfg.PrivacyKey != "" {
+		if err := enablePrivacy(cfg.PrivacyKey); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.OpLog > 0 {
+		p.oplog = newOpLog(cfg.OpLog, cfg.OpLogStream, p.clock)
+		p.allocator = &loggedAllocator{inner: p.allocator, log: p.oplog}
+		p.leases.oplog = p.oplog
+	}
 
-	p.LeaseTime, err = time.ParseDuration(args[3])
-	if err != nil {
-		return nil, fmt.Errorf("invalid lease duration: %v", args[3])
+	if cfg.NeighborInterface != "" {
+		hook, err := newNeighborWriter(cfg.NeighborInterface)
+		if err != nil {
+			return nil, fmt.Errorf("could not set up neighbor table updates: %w", err)
+		}
+		p.sinks = append(p.sinks, hook)
 	}
 
-	p.storage, err = InitStorage(uri)
+	p.storage, err = AcquireStorage(cfg.URI, StorageOptions{
+		SecondaryURI:    cfg.SecondaryURI,
+		HistoryURI:      cfg.HistoryURI,
+		HistoryLength:   cfg.HistoryLength,
+		ExpiryTolerance: cfg.ExpiryTolerance,
+		KeyPrefix:       cfg.KeyPrefix,
+		Faults:          cfg.Faults,
+	})
 	if err != nil {
 		return nil, err
 	}
+	p.refusals = newRefusalLedger(p.storage, p.poolName(), p.clock)
+	if cfg.OpLogStream {
+		go p.opLogLoop()
+	}
+	// listen right away, so that no notification is missed during the reload
+	notifications, unlisten := p.storage.Listen()
+	defer func() {
+		if p.unlisten == nil {
+			if p.registration.ID != "" {
+				p.storage.Unregister(context.TODO(), p.id)
+			}
+			unlisten()
+			ReleaseStorage(p.storage)
+		}
+	}()
 
-	records, err := p.storage.GetAllRecords()
+	if err := p.storage.CheckNotifications(context.TODO()); err != nil {
+		if errors.Is(err, ErrNotificationsDisabled) {
+			log.Errorf("expired leases will not be freed: %v", err)
+		} else {
+			// CONFIG is often disabled on managed offerings
+			log.Warnf("could not verify the keyspace notification settings: %v", err)
+		}
+	}
+
+	outgoing, records, err := p.takeOver(context.TODO())
 	if err != nil {
+		return nil, fmt.Errorf("could not load the handover snapshot: %v", err)
+	}
+	if err := p.loadSplit(context.TODO()); err != nil {
+		return nil, fmt.Errorf("could not load the pool split: %v", err)
+	}
+	if err := p.register(context.TODO(), outgoing); err != nil {
+		return nil, fmt.Errorf("could not register the instance: %w", err)
+	}
+	fingerprint, err := p.checkFingerprint(context.TODO())
+	if err != nil {
+		return nil, fmt.Errorf("could not check the pool fingerprint: %w", err)
+	}
+	if outgoing != "" {
+		log.Infof("taking over from %s", outgoing)
+	} else if records, err = p.storage.GetAllRecords(); err != nil {
 		return nil, fmt.Errorf("could not load records: %v", err)
 	}
 
-	log.Printf("Loaded %d DHCPv4 leases from %s", len(*records), uri)
+	// the other instances own the records outside of our range
+	for mac, rec := range records {
+		if p.foreign(&rec) {
+			delete(records, mac)
+		}
+	}
+	for mac, rec := range records {
+		if cfg.inGap(rec.IP) && !rec.Static {
+			// e.g. a range dropped from the configuration, or served by
+			// another instance
+			log.Warnf("lease of %s for MAC %s is in none of the ranges, skipping it", rec.IP, mac)
+			delete(records, mac)
+		}
+	}
+	log.Printf("Loaded %d DHCPv4 leases from %s", len(records), redactURI(cfg.URI))
+
+	p.sampleMemory()
 
-	for _, v := range *records {
-		ip, err := p.allocator.Allocate(net.IPNet{IP: v.IP})
+	report, err := p.audit(records)
+	if err != nil {
+		return nil, fmt.Errorf("could not audit records: %v", err)
+	}
+	report.Pool = &fingerprint
+	p.startup = report
+	if len(report.Issues) > 0 {
+		if cfg.StrictConsistency && report.Percent() > cfg.StrictThreshold {
+			return nil, fmt.Errorf("strict consistency: inconsistency above %.2f%%: %s", cfg.StrictThreshold, report)
+		}
+		log.Warnf("startup audit: %s", report)
+		p.repair(report, records)
+	}
+
+	p.evictExcluded(records)
+	for mac, v := range records {
+		if !p.inRange(v.IP) {
+			// only static addresses are left outside of the range
+			p.leases.set(mac, v.IP)
+			continue
+		}
+		if _, err := allocateExact(p.allocator, net.IPNet{IP: v.IP}); err != nil {
+			// e.g. another record of the same address the audit kept
+			log.Errorf("could not re-allocate %s leased to MAC %s, leaving it out: %v", v.IP, mac, err)
+			continue
+		}
+		p.leases.set(mac, v.IP)
+	}
+	if err := p.replayJournal(context.TODO(), records); err != nil {
+		return nil, fmt.Errorf("could not replay the GC journal: %v", err)
+	}
+	if err := p.loadReservations(context.TODO()); err != nil {
+		return nil, fmt.Errorf("could not load the reservations: %v", err)
+	}
+	if cfg.FreezeInterval > 0 {
+		if err := p.loadFreeze(context.TODO()); err != nil {
+			return nil, fmt.Errorf("could not load the frozen addresses: %v", err)
+		}
+		go p.freezeLoop()
+	}
+	p.limits.pool.Store(int64(cfg.MaxLeases))
+	if err := p.syncLeaseLimit(context.TODO()); err != nil {
+		return nil, fmt.Errorf("could not load the lease limit: %v", err)
+	}
+	p.reserveExclusions()
+	if _, role := p.split.get(); role == SplitSource {
+		p.withholdSplit()
+	}
+	if err := p.restoreQuarantine(); err != nil {
+		return nil, fmt.Errorf("could not restore quarantined addresses: %v", err)
+	}
+	if err := p.restoreCooldown(); err != nil {
+		return nil, fmt.Errorf("could not restore the cooldown of freed addresses: %v", err)
+	}
+	if err := p.loadRamp(context.TODO()); err != nil {
+		return nil, fmt.Errorf("could not load the lease ramp: %v", err)
+	}
+	if err := p.loadKillSwitches(context.TODO()); err != nil {
+		return nil, fmt.Errorf("could not load the kill switches: %v", err)
+	}
+	if cfg.TraceShared {
+		if err := p.loadTraceTargets(); err != nil {
+			log.Warnf("could not load the shared trace targets: %v", err)
+		}
+	}
+	if err := p.storage.RebuildIndex(records); err != nil {
+		return nil, fmt.Errorf("could not rebuild the reverse index: %v", err)
+	}
+
+	if cfg.RecoverHistory && len(records) == 0 {
+		if _, err := p.RecoverFromHistory(context.TODO()); err != nil {
+			log.Errorf("recovery from history failed: %v", err)
+		}
+	}
+
+	if outgoing != "" {
+		// from here on, we are the one allocating
+		ok, err := p.storage.EndHandover(context.TODO(), p.poolName(), outgoing, p.id)
 		if err != nil {
-			return nil, fmt.Errorf("failed to re-allocate leased ip %v: %v", v.IP.String(), err)
+			return nil, fmt.Errorf("could not take over from %s: %v", outgoing, err)
 		}
-		if ip.IP.String() != v.IP.String() {
-			return nil, fmt.Errorf("allocator did not re-allocate requested leased ip %v: %v", v.IP.String(), ip.String())
+		if !ok {
+			return nil, fmt.Errorf("could not take over from %s: it gave up the handover", outgoing)
 		}
 	}
 
-	// Launch a goroutine to gc the IP lease
-	go func() {
-		ch := p.storage.SubExp.Channel()
-		defer p.storage.SubExp.Close()
+	// Launch a goroutine to gc the IP lease and serve the control channel
+	p.listener = notifications
+	go p.watchNotifications(notifications.C)
+	p.unlisten = unlisten
 
-		for msg := range ch {
-			if !strings.HasPrefix(msg.Payload, REDIS_SHADOW_KEY_PREFIX) {
-				continue
-			}
+	go p.summaryLoop()
+	go p.heartbeat()
+	go p.watchKillSwitches()
+	go p.watchClock()
+	go p.dispatchEvents()
+	go p.flushAdoptions()
+	go p.refusals.run(p.closing)
+	if cfg.ExportDaily {
+		go p.exportLoop()
+	}
 
-			mac := msg.Payload[len(REDIS_SHADOW_KEY_PREFIX):]
-			record, err := p.storage.GetRecord(mac)
-			if err != nil {
-				log.Errorln("error when getting expired record", err)
-				continue
-			}
+	registerInstance(p)
+	p.cfg.applied = time.Now()
+	recordConfig(p.poolName(), p.cfg)
+	close(p.ready)
 
-			err = p.allocator.Free(net.IPNet{
-				IP:   record.IP,
-				Mask: net.IPv4Mask(255, 255, 255, 255),
-			})
+	return p.Handler4, nil
+}
 
-			if err != nil {
-				log.Errorf("error when release ip %v, err: %v", record.IP, err)
+// watchNotifications consumes the pub/sub messages of the storage: expiry
+// notifications of shadow keys and control commands. The leases are swept
+// for the notifications dropped in the same goroutine, so that a lease is
+// never freed by both.
+func (p *PluginState) watchNotifications(ch <-chan *redis.Message) {
+	tick := time.NewTicker(heartbeatInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			if msg.Channel == REDIS_CONTROL_CHANNEL {
+				p.handleControl(msg.Payload)
 				continue
 			}
+			p.handleExpired(msg.Payload)
+		case <-tick.C:
+			if err := p.sweepDropped(); err != nil {
+				log.Warnf("could not sweep the leases for dropped notifications: %v", err)
+			}
+		}
+	}
+}
 
-			log.Infof("IP lease %s for MAC address %s is expire.", record.IP, mac)
+// sweepDropped frees the leases whose shadow key expired while their
+// notification was dropped for the instance falling behind, see fanOut.
+// A dropped control command is lost.
+func (p *PluginState) sweepDropped() error {
+	dropped := p.listener.Dropped()
+	if dropped == p.swept {
+		return nil
+	}
+	log.Warnf("%d notifications dropped, sweeping the leases for ended ones", dropped-p.swept)
+	bindings := p.leases.snapshot()
+	macs := make([]string, 0, len(bindings))
+	for mac := range bindings {
+		macs = append(macs, mac)
+	}
+	ended, err := p.storage.MissingShadows(macs)
+	if err != nil {
+		return err
+	}
+	for _, mac := range ended {
+		p.handleExpired(p.storage.ns.shadow + mac)
+	}
+	p.swept = dropped
+	return nil
+}
+
+// handleExpired returns the IP of an expired lease to the allocator
+func (p *PluginState) handleExpired(key string) {
+	if p.handedOver() {
+		return
+	}
+	ns := p.storage.ns
+	if strings.HasPrefix(key, ns.main) || strings.HasPrefix(key, ns.index) {
+		// our other keys expire along with the shadow keys
+		return
+	}
+	if strings.HasPrefix(key, REDIS_V6_KEY_PREFIX) || strings.HasPrefix(key, REDIS_V6_SHADOW_KEY_PREFIX) ||
+		strings.HasPrefix(key, REDIS_PD_KEY_PREFIX) || strings.HasPrefix(key, REDIS_PD_SHADOW_KEY_PREFIX) {
+		// DHCPv6 leases are freed by the DHCPv6 instances
+		return
+	}
+	if strings.HasPrefix(key, ns.quarantine) {
+		p.releaseQuarantine(key)
+		return
+	}
+	mac, ok := strings.CutPrefix(key, ns.shadow)
+	if !ok && recordKey(key) {
+		// the notifications of all the namespaces come on the same channel
+		log.Debugf("ignoring expiry of %q of another namespace", key)
+		return
+	}
+	if !ok || !validClientKey(mac) {
+		p.counters.ignoredNotifications.Add(1)
+		log.Debugf("ignoring expiry of foreign key %q", key)
+		return
+	}
+	record, err := p.storage.GetRecord(mac)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			log.Warnf("expired lease of MAC %s has no record left", mac)
+		} else {
+			log.Errorln("error when getting expired record", err)
 		}
-	}()
+		return
+	}
+	if p.foreign(record) {
+		// the lease of another instance sharing the storage
+		return
+	}
+	if !p.endsBy(record.Expires, p.clock.Now()) {
+		// renewed right as the shadow key expired, which set it again
+		log.Debugf("lease of %s for MAC %s was renewed, not freeing it", record.IP, mac)
+		return
+	}
 
-	return p.Handler4, nil
+	// journal the free, so that it is completed on restart if we crash
+	ctx := context.TODO()
+	if err := p.storage.JournalFree(ctx, mac, record.IP); err != nil {
+		log.Warnf("could not journal the free of %s for %s: %v", record.IP, mac, err)
+	}
+	if !p.freeLease(mac, record.IP) {
+		return
+	}
+	p.releaseCircuit(mac, record)
+	if err := p.storage.CompleteFree(ctx, mac); err != nil {
+		log.Warnf("could not complete the free of %s for %s in the journal: %v", record.IP, mac, err)
+	}
+
+	if record.offered() {
+		log.Infof("IP %s offered to MAC address %s was never requested.", record.IP, mac)
+		return
+	}
+	log.Infof("IP lease %s for MAC address %s is expire.", record.IP, mac)
 }
 
-// Handler6 handles DHCPv6 packets for the plugin.
-func Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
-	log.Warnf("skipped DHCPv6 packet: %s", req.Summary())
-	// return the unmodified response, and false. This means that the next
-	// plugin in the chain will be called, and the unmodified response packet
-	// will be used as its input.
-	return resp, false
+// release ends the lease of mac on a DHCPRELEASE, returning its address
+// to the pool right away rather than when the lease runs out. A release of
+// another address than the one recorded for mac is ignored.
+func (p *PluginState) release(req *dhcpv4.DHCPv4, mac string, tr *requestTrace) {
+	record, err := p.storage.GetRecord(mac)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Errorf("Could not get record for %s to release: %v", mac, err)
+		}
+		tr.step("release ignored: %v", err)
+		return
+	}
+	if !record.IP.Equal(req.ClientIPAddr) {
+		log.Warnf("MAC %s releases %s but is leased %s, ignoring", mac, req.ClientIPAddr, record.IP)
+		tr.step("release of %s ignored: leased %s", req.ClientIPAddr, record.IP)
+		return
+	}
+	if p.foreign(record) {
+		// the lease of another instance sharing the storage
+		tr.step("release of %s ignored: not in the pool", record.IP)
+		return
+	}
+	if err := p.endLease(mac, record, false); err != nil {
+		if !errors.Is(err, errNotFreed) {
+			log.Errorf("Could not release %s for MAC %s: %v", record.IP, mac, err)
+			tr.step("release of %s failed: %v", record.IP, err)
+		}
+		return
+	}
+	tr.step("released %s", record.IP)
+	log.Infof("IP lease %s for MAC address %s is released.", record.IP, mac)
 }
 
-// setup6 is the setup function to initialize the handler for DHCPv6
-// traffic.
-func setup6(args ...string) (handler.Handler6, error) {
-	log.Warn("this plugin currently does not support DHCPv6.")
-	return Handler6, nil
+// errNotFreed means the allocator refused the address of an ended lease
+var errNotFreed = errors.New("address not freed")
+
+// endLease ends the lease of mac recorded as record, the way a client
+// ending it does: its record is deleted, its address returned to the
+// allocator, or kept out of it if withhold is set, and its binding, index
+// entry and circuit membership are dropped. The caller leaves the leases of
+// other instances alone, see foreign.
+func (p *PluginState) endLease(mac string, record *Record, withhold bool) error {
+	if err := p.storage.DeleteRecord(mac); err != nil {
+		return err
+	}
+	if withhold {
+		p.unbind(mac, record.IP)
+	} else if !p.freeLease(mac, record.IP) {
+		return errNotFreed
+	}
+	p.releaseCircuit(mac, record)
+	return nil
+}
+
+// withheld reports whether ip stays out of the allocator when no client
+// holds it: a static address outside of the range, which has no allocator
+// entry, an excluded or frozen address, one reserved for a client or a
+// circuit, or one of a sub-range split off. Every path returning an
+// address to the allocator checks it.
+func (p *PluginState) withheld(ip net.IP) bool {
+	return !p.inRange(ip) || p.cfg.excluded(ip) || p.reserved.has(ip) || p.frozen.has(ip) || p.splitOff(ip)
+}
+
+// freeLease returns ip to the allocator and drops its binding to mac.
+// Returns false if the allocator refused to free it.
+func (p *PluginState) freeLease(mac string, ip net.IP) bool {
+	if p.frozen.has(ip) {
+		// a frozen address is never recycled, its binding being kept
+		p.tombstone(mac, ip)
+	}
+	switch {
+	case p.withheld(ip):
+		// an address of the sub-range split off is noted for its release
+		p.keepForSplit(ip)
+	case p.coolDown(ip):
+		// recently freed addresses stay withheld until their cooldown is over
+	default:
+		err := p.allocator.Free(net.IPNet{
+			IP:   ip,
+			Mask: net.IPv4Mask(255, 255, 255, 255),
+		})
+
+		if err != nil {
+			log.Errorf("error when release ip %v, err: %v", ip, err)
+			return false
+		}
+	}
+	p.unbind(mac, ip)
+	p.emit(Event{Type: EventExpire, MAC: mac, IP: ip})
+	return true
+}
+
+// unbind drops the binding of ip to mac, in memory and in the index
+func (p *PluginState) unbind(mac string, ip net.IP) {
+	if err := p.storage.releaseIndex(mac, ip); err != nil {
+		log.Warnf("could not release index entry of %s for %s: %v", ip, mac, err)
+	}
+	p.leases.remove(mac, ip)
+	p.offers.drop(mac)
 }
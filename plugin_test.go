@@ -0,0 +1,40 @@
+package rangeredisplugin
+
+import (
+	"net"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestInform(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.43.10", "10.0.43.20", "1h")
+	dump := m.Dump()
+
+	// a client with a static address asking for its options
+	static := net.IPv4(192, 0, 2, 50).To4()
+	req := newRequest(t, dhcpv4.MessageTypeInform, "00:11:22:33:44:0a", dhcpv4.WithClientIP(static))
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, stop := p.Handler4(req, resp)
+	if stop || out != resp || !out.YourIPAddr.IsUnspecified() {
+		t.Errorf("inform not passed on with yiaddr unset: %s", out.Summary())
+	}
+	if m.Dump() != dump {
+		t.Error("redis modified by the inform")
+	}
+	if n := p.leases.len(); n != 0 {
+		t.Errorf("%d leases after the inform", n)
+	}
+	if n := p.Stats().TypePassed; n != 1 {
+		t.Errorf("%d messages passed on, want 1", n)
+	}
+	// the first address of the pool is still free in the allocator
+	if ip := lease(t, p, "00:11:22:33:44:0b"); !ip.Equal(net.IPv4(10, 0, 43, 10)) {
+		t.Errorf("first lease after the inform got %s", ip)
+	}
+}
@@ -0,0 +1,136 @@
+package rangeredisplugin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// default minimum lease granted by the expire-at policy
+const defaultExpireAtMin = time.Hour
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ExpireAtPolicy makes leases expire at a daily cutoff time instead of after
+// a fixed duration, so that the pool fully recycles overnight.
+type ExpireAtPolicy struct {
+	Hour, Minute int
+	Location     *time.Location
+	// Days the cutoff applies on; all days when empty
+	Days map[time.Weekday]bool
+	// Min is the shortest lease granted, for clients showing up just before
+	// the cutoff
+	Min time.Duration
+}
+
+// parseCutoff parses a time of day in the form HH:MM
+func parseCutoff(val string) (int, int, error) {
+	t, err := time.Parse("15:04", val)
+	if err != nil {
+		return 0, 0, errors.New("want a time of day as HH:MM")
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// parseWeekdays parses a comma-separated list of day names like mon,tue,wed
+func parseWeekdays(val string) (map[time.Weekday]bool, error) {
+	days := make(map[time.Weekday]bool)
+	for _, name := range strings.Split(val, ",") {
+		d, ok := weekdayNames[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q, want one of sun, mon, tue, wed, thu, fri, sat", name)
+		}
+		days[d] = true
+	}
+	return days, nil
+}
+
+// nextCutoff returns the first cutoff strictly after now
+func (e *ExpireAtPolicy) nextCutoff(now time.Time) time.Time {
+	local := now.In(e.Location)
+	for i := 0; i <= 7; i++ {
+		day := local.AddDate(0, 0, i)
+		cutoff := time.Date(day.Year(), day.Month(), day.Day(), e.Hour, e.Minute, 0, 0, e.Location)
+		if !cutoff.After(now) {
+			continue
+		}
+		if len(e.Days) == 0 || e.Days[cutoff.Weekday()] {
+			return cutoff
+		}
+	}
+	// unreachable with at least one valid day
+	return now.Add(24 * time.Hour)
+}
+
+// LeaseTime returns the lease to grant at now
+func (e *ExpireAtPolicy) LeaseTime(now time.Time) time.Duration {
+	d := e.nextCutoff(now).Sub(now)
+	if d < e.Min {
+		return e.Min
+	}
+	return d
+}
+
+func (e *ExpireAtPolicy) String() string {
+	return fmt.Sprintf("expire-at %02d:%02d %s", e.Hour, e.Minute, e.Location)
+}
+
+// leaseTime returns the duration of a lease granted at now, according to the
+// lease time override of the client if not 0, or else the lease policy of
+// the pool or the lease time requested if not 0, then the lease ramp in
+// progress and the pressure band in effect.
+func (p *PluginState) leaseTime(now time.Time, override, requested time.Duration) time.Duration {
+	d := p.LeaseTime
+	switch {
+	case override > 0:
+		d = override
+	case p.cfg.ExpireAt != nil:
+		d = p.cfg.ExpireAt.LeaseTime(now)
+	case requested > 0:
+		d = requested
+	}
+	if ramp := p.ramp.get(); ramp != nil {
+		d = ramp.cap(now, d)
+	}
+	if band := p.pressure.band(); band != nil && band.LeaseTime < d {
+		d = band.LeaseTime
+	}
+	return d
+}
+
+// requestedLeaseTime returns the lease time the client of req asks for in
+// option 51, within lease_min and lease_max, 0 if it asks for none
+func (p *PluginState) requestedLeaseTime(req *dhcpv4.DHCPv4) time.Duration {
+	d := req.IPAddressLeaseTime(0)
+	switch {
+	case d <= 0:
+		return 0
+	case d < p.cfg.LeaseMin:
+		return p.cfg.LeaseMin
+	case d > p.cfg.LeaseMax:
+		return p.cfg.LeaseMax
+	}
+	return d
+}
+
+// policyName returns the description of the lease policy stored on records
+func (p *PluginState) policyName(override time.Duration) string {
+	if override > 0 {
+		return overridePolicy + override.String()
+	}
+	if p.cfg.ExpireAt != nil {
+		return p.cfg.ExpireAt.String()
+	}
+	return ""
+}
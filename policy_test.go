@@ -0,0 +1,148 @@
+package rangeredisplugin
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func berlin(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestExpireAtLeaseTime(t *testing.T) {
+	loc := berlin(t)
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2026, month, day, hour, min, 0, 0, loc)
+	}
+	weekdays, err := parseWeekdays("mon,tue,wed,thu,fri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	daily := &ExpireAtPolicy{Hour: 18, Location: loc, Min: time.Hour}
+	business := &ExpireAtPolicy{Hour: 18, Location: loc, Min: time.Hour, Days: weekdays}
+	for _, tc := range []struct {
+		name   string
+		policy *ExpireAtPolicy
+		now    time.Time
+		want   time.Duration
+	}{
+		{"morning", daily, at(time.June, 10, 9, 0), 9 * time.Hour},
+		{"just before the cutoff", daily, at(time.June, 10, 17, 59), time.Hour},
+		{"at the cutoff", daily, at(time.June, 10, 18, 0), 24 * time.Hour},
+		{"after the cutoff", daily, at(time.June, 10, 19, 30), 22*time.Hour + 30*time.Minute},
+		{"across midnight", daily, at(time.June, 10, 23, 59), 18*time.Hour + time.Minute},
+		{"year end", daily, time.Date(2026, time.December, 31, 20, 0, 0, 0, loc), 22 * time.Hour},
+		// the night the clocks go forward lasts an hour less, the night they
+		// go back an hour more
+		{"spring forward", daily, at(time.March, 28, 18, 0), 23 * time.Hour},
+		{"spring forward, after the change", daily, at(time.March, 29, 3, 0), 15 * time.Hour},
+		{"fall back", daily, at(time.October, 24, 18, 0), 25 * time.Hour},
+		{"fall back, before the change", daily, at(time.October, 25, 1, 0), 18 * time.Hour},
+		// 2026-06-12 is a Friday
+		{"friday evening", business, at(time.June, 12, 18, 30), 71*time.Hour + 30*time.Minute},
+		{"saturday", business, at(time.June, 13, 12, 0), 54 * time.Hour},
+		{"weekend across the spring change", business, at(time.March, 27, 18, 0), 71 * time.Hour},
+	} {
+		if got := tc.policy.LeaseTime(tc.now); got != tc.want {
+			t.Errorf("%s (%s): %s, want %s", tc.name, tc.now, got, tc.want)
+		}
+	}
+}
+
+func TestExpireAtHandler(t *testing.T) {
+	loc := berlin(t)
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.6.0.10", "10.6.0.20", "24h",
+		"expire_at=18:00", "expire_at_tz=Europe/Berlin", "expire_at_min=1h")
+	// the day before the clocks go forward
+	p.SetClock(newFakeClock(time.Date(2026, time.March, 28, 9, 0, 0, 0, loc)))
+
+	const mac = "00:11:22:33:44:55"
+	ip := lease(t, p, mac)
+	assertLease := func(when string, wantExpires time.Time) {
+		t.Helper()
+		rec, err := p.storage.GetRecord(mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rec.Expires.Equal(wantExpires) || rec.Policy != "expire-at 18:00 Europe/Berlin" {
+			t.Errorf("%s: record expires %s by %q, want %s", when, rec.Expires.In(loc), rec.Policy, wantExpires)
+		}
+	}
+	assertLease("grant", time.Date(2026, time.March, 28, 18, 0, 0, 0, loc))
+
+	renewal := func(when string, d time.Duration, wantTime time.Duration, wantExpires time.Time) {
+		t.Helper()
+		advance(p, d)
+		ack := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithClientIP(ip)))
+		if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck {
+			t.Fatalf("%s: no ACK: %v", when, ack)
+		}
+		if got := ack.IPAddressLeaseTime(0); got != wantTime {
+			t.Errorf("%s: lease time %s, want %s", when, got, wantTime)
+		}
+		assertLease(when, wantExpires)
+	}
+	// 17:30, the floor applies
+	renewal("before the cutoff", 8*time.Hour+30*time.Minute, time.Hour, time.Date(2026, time.March, 28, 18, 30, 0, 0, loc))
+	// 18:15, rolled to the next cutoff, across the change
+	renewal("after the cutoff", 45*time.Minute, 22*time.Hour+45*time.Minute, time.Date(2026, time.March, 29, 18, 0, 0, 0, loc))
+	// 08:00 summer time
+	renewal("next morning", 12*time.Hour+45*time.Minute, 10*time.Hour, time.Date(2026, time.March, 29, 18, 0, 0, 0, loc))
+}
+
+func TestRequestedLeaseTime(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.54.10", "10.0.54.20", "1h", "lease_min=30m", "lease_max=4h")
+	for i, tc := range []struct {
+		requested, want time.Duration
+	}{
+		{0, time.Hour},
+		{2 * time.Hour, 2 * time.Hour},
+		{10 * time.Minute, 30 * time.Minute},
+		{12 * time.Hour, 4 * time.Hour},
+	} {
+		mac := "00:11:22:33:44:0" + string(rune('a'+i))
+		var mods []dhcpv4.Modifier
+		if tc.requested > 0 {
+			mods = append(mods, dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(tc.requested)))
+		}
+		offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac, mods...))
+		if offer == nil {
+			t.Fatalf("no offer to %s", mac)
+		}
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(offer.YourIPAddr)))
+		ack := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac, mods...))
+		if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck {
+			t.Fatalf("no ACK to %s: %v", mac, ack)
+		}
+		if got := ack.IPAddressLeaseTime(0); got != tc.want {
+			t.Errorf("%s requested: %s granted, want %s", tc.requested, got, tc.want)
+		}
+		// the keys expire when the client was told
+		assertTTL(t, m, p.storage.ns.shadow+mac, tc.want)
+		assertTTL(t, m, p.storage.ns.main+mac, tc.want+10*time.Second)
+	}
+
+	// an override takes precedence
+	const mac = "00:11:22:33:44:1a"
+	m.Set(p.storage.ns.override+mac, "8h")
+	lt := dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(2 * time.Hour))
+	offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac, lt))
+	if offer == nil || offer.IPAddressLeaseTime(0) != 8*time.Hour {
+		t.Errorf("offer with an override: %v", offer)
+	}
+
+	if _, err := parseConfig([]string{redisURI(m), "10.0.54.10", "10.0.54.20", "1h", "lease_min=2h", "lease_max=30m"}); err == nil {
+		t.Error("lease_min above lease_max accepted")
+	}
+}
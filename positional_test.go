@@ -0,0 +1,128 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestPositional(t *testing.T) {
+	for _, tc := range []struct {
+		args       string
+		splitRange bool
+		want       string
+	}{
+		// in any order, the options following
+		{"lease=1h cooldown=1m range=10.0.0.10-10.0.0.20 uri=redis://localhost/0", false,
+			"redis://localhost/0 10.0.0.10-10.0.0.20 1h cooldown=1m"},
+		{"uri=redis://localhost/0 range=10.0.0.10-10.0.0.20,10.0.1.10-10.0.1.20 lease=1h", false,
+			"redis://localhost/0 10.0.0.10-10.0.0.20,10.0.1.10-10.0.1.20 1h"},
+		{"uri=redis://localhost/0 range=10.0.0.0/24 lease=1h", true, "redis://localhost/0 10.0.0.0/24 1h"},
+		{"uri=redis://localhost/0 range=2001:db8::10-2001:db8::20 lease=1h", true,
+			"redis://localhost/0 2001:db8::10 2001:db8::20 1h"},
+		// the uri keeps its own = signs
+		{"uri=redis://localhost/0?pool_size=5 range=10.0.0.10-10.0.0.20 lease=1h", false,
+			"redis://localhost/0?pool_size=5 10.0.0.10-10.0.0.20 1h"},
+		// the positional form is left alone, even with named options after
+		{"redis://localhost/0 10.0.0.10 10.0.0.20 1h lease=2h", false, "redis://localhost/0 10.0.0.10 10.0.0.20 1h lease=2h"},
+		{"cooldown=1m uri=redis://localhost/0", false, "cooldown=1m uri=redis://localhost/0"},
+	} {
+		got, err := positional(strings.Fields(tc.args), tc.splitRange)
+		if err != nil || strings.Join(got, " ") != tc.want {
+			t.Errorf("%s: %q, %v, want %q", tc.args, got, err, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		args, want string
+	}{
+		{"uri=redis://localhost/0 range=10.0.0.10-10.0.0.20", `missing argument "lease"`},
+		{"uri=redis://localhost/0 lease=1h", `missing argument "range"`},
+		{"range=10.0.0.10-10.0.0.20 lease=1h", `missing argument "uri"`},
+		{"uri=redis://localhost/0 range=10.0.0.10-10.0.0.20 lease=1h lease=2h", `argument "lease" given twice`},
+		{"uri= range=10.0.0.10-10.0.0.20 lease=1h", `argument "uri" cannot be empty`},
+		{"uri=redis://localhost/0 range=10.0.0.10 lease=1h", `invalid range "10.0.0.10"`},
+		{"uri=redis://localhost/0 10.0.0.10-10.0.0.20 lease=1h", `invalid argument "10.0.0.10-10.0.0.20", want key=value`},
+	} {
+		if _, err := positional(strings.Fields(tc.args), false); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: %v, want %q", tc.args, err, tc.want)
+		}
+	}
+}
+
+func TestNamedArgs(t *testing.T) {
+	named := []string{"lease=12h", "uri=redis://localhost/0", "range=10.0.79.10-10.0.79.200", "cooldown=1m"}
+	c, err := parseConfig(named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := parseConfig([]string{"redis://localhost/0", "10.0.79.10", "10.0.79.200", "12h", "cooldown=1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.URI != legacy.URI || c.LeaseTime != legacy.LeaseTime || c.Cooldown != legacy.Cooldown ||
+		fmt.Sprint(c.Ranges) != fmt.Sprint(legacy.Ranges) {
+		t.Errorf("named arguments parsed as %+v, want %+v", c, legacy)
+	}
+	// the arguments are kept as given
+	if strings.Join(c.args, " ") != strings.Join(named, " ") {
+		t.Errorf("arguments kept as %q", c.args)
+	}
+
+	// the errors of the values and of the options are those of the
+	// positional form
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"uri=redis://localhost/0", "range=10.0.79.0/24", "lease=forever"}, "invalid lease time"},
+		{[]string{"uri=redis://localhost/0", "range=10.0.79.200-10.0.79.10", "lease=1h"}, "has to be lower than its end"},
+		{[]string{"uri=redis://localhost/0", "range=10.0.79.0/24", "lease=1h", "site=site1"}, `unknown option "site"`},
+	} {
+		if _, err := parseConfig(tc.args); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%v: %v, want %q", tc.args, err, tc.want)
+		}
+	}
+}
+
+func TestNamedArgs6(t *testing.T) {
+	c, err := parseConfig6([]string{"uri=redis://localhost/0", "range=2001:db8::10-2001:db8::20", "lease=1h", "rapid_commit=true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Start.Equal(net.ParseIP("2001:db8::10")) || !c.End.Equal(net.ParseIP("2001:db8::20")) || c.LeaseTime != time.Hour || !c.RapidCommit {
+		t.Errorf("parsed %+v", c)
+	}
+	if _, err := parseConfig6([]string{"range=2001:db8::/112", "lease=1h", "uri=redis://localhost/0"}); err != nil {
+		t.Errorf("prefix by name: %v", err)
+	}
+	if _, err := parseConfig6([]string{"uri=redis://localhost/0", "range=2001:db8::/112"}); err == nil || !strings.Contains(err.Error(), `missing argument "lease"`) {
+		t.Errorf("missing lease: %v", err)
+	}
+}
+
+func TestNamedArgsPlugin(t *testing.T) {
+	m := miniredis.RunT(t)
+	if _, err := setup4("uri="+redisURI(m), "range=10.0.79.10-10.0.79.11", "lease=1h"); err != nil {
+		t.Fatal(err)
+	}
+	all := Instances()
+	p := all[len(all)-1]
+	p.SetClock(newFakeClock(time.Now()))
+	t.Cleanup(func() {
+		if err := p.Close(context.Background()); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	})
+	if ip := lease(t, p, "00:11:22:33:44:55"); !ip.Equal(net.IPv4(10, 0, 79, 10)) {
+		t.Errorf("leased %s", ip)
+	}
+	if _, err := p.storage.GetRecord("00:11:22:33:44:55"); err != nil {
+		t.Errorf("no record in the redis given by name: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Policies applied to the replies whose address was set by an earlier
+// plugin, e.g. a static lease
+const (
+	// PreassignedIgnore passes the reply on unmodified
+	PreassignedIgnore = "ignore"
+	// PreassignedAdopt also records the address as leased to the client,
+	// so that it is never handed out to another and its expiry is tracked.
+	// Addresses outside of the range are recorded without allocator entry.
+	PreassignedAdopt = "adopt"
+)
+
+// preassigned returns the address an earlier plugin put in resp, or nil
+func preassigned(resp *dhcpv4.DHCPv4) net.IP {
+	ip := resp.YourIPAddr.To4()
+	if ip == nil || ip.IsUnspecified() {
+		return nil
+	}
+	return ip
+}
+
+// adoptPreassigned records that mac holds ip, assigned by an earlier plugin,
+// if the policy asks for it. A lease of another address held by mac ends.
+func (p *PluginState) adoptPreassigned(mac string, ip net.IP) {
+	if p.cfg.Preassigned != PreassignedAdopt || p.cfg.excluded(ip) {
+		return
+	}
+	now := p.clock.Now()
+	override := p.leaseTimeOverride(context.TODO(), mac)
+	rec := Record{IP: ip, Expires: now.Add(p.leaseTime(now, override, 0)), Policy: p.policyName(override), Pressure: p.pressureName(), Static: true, Pool: p.poolName()}
+
+	held := p.leases.ipOf(mac)
+	if ip.Equal(held) {
+		if old, err := p.storage.GetRecord(mac); err == nil {
+			rec.Labels = old.Labels
+		}
+		err := p.storage.SaveRecord(mac, &rec)
+		p.noteWrite(err)
+		if err != nil {
+			log.Errorf("Could not persist adopted lease of %s for MAC %s: %v", ip, mac, err)
+		}
+		return
+	}
+
+	if err := p.claimStatic(mac, ip); err != nil {
+		log.Warnf("Could not adopt %s assigned to MAC %s by an earlier plugin: %v", ip, mac, err)
+		return
+	}
+	if held != nil {
+		if err := p.storage.DeleteRecord(mac); err != nil {
+			log.Errorf("Could not end lease of %s for MAC %s: %v", held, mac, err)
+		}
+		p.freeLease(mac, held)
+	}
+	rec.Labels = p.labelsFor(mac)
+	err := p.storage.CommitAllocation(mac, &rec)
+	p.noteWrite(err)
+	if err != nil {
+		log.Errorf("Could not commit adopted lease of %s for MAC %s: %v", ip, mac, err)
+		if !p.inRange(ip) {
+			return
+		}
+		if err := p.allocator.Free(net.IPNet{IP: ip, Mask: net.IPv4Mask(255, 255, 255, 255)}); err != nil {
+			log.Errorf("Could not roll back allocation of %s: %v", ip, err)
+		}
+		return
+	}
+	p.leases.set(mac, ip)
+	log.Infof("Adopted %s assigned to MAC %s by an earlier plugin", ip, mac)
+	p.emit(Event{Type: EventGrant, MAC: mac, IP: ip, Detail: "preassigned", Labels: rec.Labels})
+}
+
+// claimStatic claims a static address for mac. Outside of the range, it
+// only has to be free of other leases.
+func (p *PluginState) claimStatic(mac string, ip net.IP) error {
+	if p.inRange(ip) {
+		return p.claim(mac, ip)
+	}
+	if owner := p.leases.macOf(ip); owner != "" && owner != mac {
+		return fmt.Errorf("%s is leased to %s", ip, owner)
+	}
+	return nil
+}
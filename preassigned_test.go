@@ -0,0 +1,149 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// chained passes a DISCOVER of mac through a plugin setting yiaddr to ip,
+// then through p, and returns the reply
+func chained(t *testing.T, p *PluginState, mac string, ip net.IP) *dhcpv4.DHCPv4 {
+	t.Helper()
+	req := newRequest(t, dhcpv4.MessageTypeDiscover, mac)
+	resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the earlier plugin, e.g. file
+	resp.YourIPAddr = ip
+	out, stop := p.Handler4(req, resp)
+	if out == nil || stop {
+		t.Fatalf("reply to %s dropped or stopped", mac)
+	}
+	return out
+}
+
+func TestPreassignedIgnored(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.24.10", "10.0.24.20", "1h")
+	for i, ip := range []net.IP{net.IPv4(10, 0, 24, 15).To4(), net.IPv4(192, 168, 1, 5).To4()} {
+		mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, byte(i)}.String()
+		if out := chained(t, p, mac, ip); !out.YourIPAddr.Equal(ip) {
+			t.Errorf("yiaddr %s set by the earlier plugin replaced with %s", ip, out.YourIPAddr)
+		}
+		if _, err := p.storage.GetRecord(mac); err == nil {
+			t.Errorf("record of %s, served by the earlier plugin", mac)
+		}
+	}
+	if n := p.leases.len(); n != 0 {
+		t.Errorf("%d addresses allocated for clients of the earlier plugin", n)
+	}
+	// the address in the range is still free
+	if ip, err := allocateExact(p.allocator, net.IPNet{IP: net.IPv4(10, 0, 24, 15).To4()}); err != nil {
+		t.Errorf("address set by the earlier plugin allocated: %v, %v", ip, err)
+	}
+}
+
+func TestPreassignedAdopted(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.24.10", "10.0.24.20", "1h", "preassigned=adopt")
+	inside, outside := net.IPv4(10, 0, 24, 15).To4(), net.IPv4(192, 168, 1, 5).To4()
+	const a, b = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+
+	for mac, ip := range map[string]net.IP{a: inside, b: outside} {
+		if out := chained(t, p, mac, ip); !out.YourIPAddr.Equal(ip) {
+			t.Errorf("yiaddr %s set by the earlier plugin replaced with %s", ip, out.YourIPAddr)
+		}
+		rec, err := p.storage.GetRecord(mac)
+		if err != nil || !rec.IP.Equal(ip) || !rec.Static {
+			t.Errorf("record of %s: %v, %v, want a static lease of %s", mac, rec, err, ip)
+		}
+		if holder := p.leases.macOf(ip); holder != mac {
+			t.Errorf("%s held by %q, want %s", ip, holder, mac)
+		}
+	}
+	if n := p.leases.len(); n != 2 {
+		t.Errorf("%d leases, want the 2 adopted only", n)
+	}
+	assertIndexed(t, m, p)
+
+	// the adopted address in the range is never handed out to another
+	for i := 0; i < 10; i++ {
+		if got := lease(t, p, net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x55, byte(i)}.String()); got.Equal(inside) {
+			t.Fatalf("adopted %s leased to another client", inside)
+		}
+	}
+
+	// the same assignment again only renews the adopted lease
+	chained(t, p, a, inside)
+	if n := p.leases.len(); n != 12 {
+		t.Errorf("%d leases after the adopted one was assigned again, want 12", n)
+	}
+}
+
+func TestStaticBindings(t *testing.T) {
+	m := miniredis.RunT(t)
+	args := []string{"10.0.24.10", "10.0.24.20", "1h", "preassigned=adopt"}
+	p := startPlugin(t, m, args...)
+	inside, moved, outside := net.IPv4(10, 0, 24, 15).To4(), net.IPv4(192, 168, 2, 5).To4(), net.IPv4(192, 168, 2, 6).To4()
+	const a, b, c, d = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c", "00:11:22:33:44:0d"
+	for mac, ip := range map[string]net.IP{a: inside, b: moved, c: outside} {
+		chained(t, p, mac, ip)
+	}
+	lease(t, p, d)
+
+	assertStats := func(p *PluginState, dynamic, static int) {
+		t.Helper()
+		s := p.Stats()
+		if s.DynamicLeases != dynamic || s.StaticLeases != static || s.Leases != dynamic+static {
+			t.Errorf("%d leases, %d dynamic and %d static, want %d dynamic and %d static",
+				s.Leases, s.DynamicLeases, s.StaticLeases, dynamic, static)
+		}
+		if n := p.leases.len(); n != s.Leases {
+			t.Errorf("%d leases held, %d reported", n, s.Leases)
+		}
+	}
+	assertStats(p, 2, 2)
+	assertIndexed(t, m, p)
+
+	// a static address outside of the range expires without allocator
+	expire(t, m, p, c)
+	eventually(t, "the expiry of the static lease", func() bool { return p.leases.macOf(outside) == "" })
+	assertStats(p, 2, 1)
+	for _, e := range log.recent.snapshot() {
+		if strings.Contains(e.Message, outside.String()) {
+			t.Errorf("error logged for the static lease: %s", e.Message)
+		}
+	}
+	// the record and index entry expire soon after the shadow key
+	m.Del(keyPrefix(p, "main") + c)
+	m.Del(keyPrefix(p, "index") + outside.String())
+
+	// the statics are reloaded at startup
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p = startPlugin(t, m, args...)
+	assertStats(p, 2, 1)
+	if holder := p.leases.macOf(moved); holder != b {
+		t.Errorf("%s held by %q after a restart, want %s", moved, holder, b)
+	}
+	if ip, err := allocateExact(p.allocator, net.IPNet{IP: inside}); err == nil {
+		t.Errorf("static %s free in the allocator after a restart", ip.IP)
+	}
+
+	// a static address moved inside of the range takes a slot
+	into := net.IPv4(10, 0, 24, 16).To4()
+	chained(t, p, b, into)
+	eventually(t, "the moved static lease", func() bool { return p.leases.macOf(into) == b })
+	assertStats(p, 3, 0)
+	if ip, err := allocateExact(p.allocator, net.IPNet{IP: into}); err == nil {
+		t.Errorf("static %s moved inside of the range free in the allocator", ip.IP)
+	}
+	assertIndexed(t, m, p)
+}
@@ -0,0 +1,151 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default width of the hysteresis below the threshold of a pressure band
+const defaultPressureHysteresis = 5.0
+
+// PressureBand shortens the leases to LeaseTime while the utilization of
+// all the pools sharing the storage is at least Threshold percent
+type PressureBand struct {
+	Threshold float64
+	LeaseTime time.Duration
+}
+
+func (b PressureBand) String() string {
+	return fmt.Sprintf("pressure>=%s%%", strconv.FormatFloat(b.Threshold, 'f', -1, 64))
+}
+
+// parsePressureBands parses bands written as <percent>:<lease time>,...
+// and sorts them by threshold
+func parsePressureBands(val string) ([]PressureBand, error) {
+	var bands []PressureBand
+	for _, b := range strings.Split(val, ",") {
+		pct, lease, ok := strings.Cut(b, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid band %q, want <percent>:<lease time>", b)
+		}
+		t, err := strconv.ParseFloat(pct, 64)
+		if err != nil || t <= 0 || t > 100 {
+			return nil, fmt.Errorf("invalid threshold %q, want a percentage above 0", pct)
+		}
+		d, err := parseDuration(lease, leaseBounds)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lease time of band %q: %w", b, err)
+		}
+		bands = append(bands, PressureBand{Threshold: t, LeaseTime: d})
+	}
+	sort.Slice(bands, func(i, j int) bool { return bands[i].Threshold < bands[j].Threshold })
+	for i := 1; i < len(bands); i++ {
+		if bands[i].Threshold == bands[i-1].Threshold {
+			return nil, fmt.Errorf("two bands at %s%%", strconv.FormatFloat(bands[i].Threshold, 'f', -1, 64))
+		}
+	}
+	return bands, nil
+}
+
+// PressureStatus is the last sampled utilization of all the pools sharing
+// the storage, and the band it put the instance in
+type PressureStatus struct {
+	Sampled     time.Time
+	Leases      int
+	Size        int
+	Utilization float64
+	// Band is the band in effect, nil below the lowest one
+	Band *PressureBand `json:",omitempty"`
+}
+
+// pressure holds the band of a plugin instance. The band only changes on
+// a sample: it is entered once the utilization reaches its threshold, and
+// left once it falls below its threshold by the hysteresis, so that lease
+// times do not flap around a threshold.
+type pressure struct {
+	mu     sync.Mutex
+	level  int
+	status *PressureStatus
+}
+
+// band returns the band in effect, or nil
+func (s *pressure) band() *PressureBand {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status == nil {
+		return nil
+	}
+	return s.status.Band
+}
+
+func (s *pressure) get() *PressureStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// nextLevel returns the number of bands in effect at util, coming from
+// level
+func nextLevel(bands []PressureBand, hysteresis float64, level int, util float64) int {
+	for level < len(bands) && util >= bands[level].Threshold {
+		level++
+	}
+	for level > 0 && util < bands[level-1].Threshold-hysteresis {
+		level--
+	}
+	return level
+}
+
+// samplePressure sums the leases and sizes registered by the live instances
+// and moves the instance to the band of their utilization
+func (p *PluginState) samplePressure(ctx context.Context) error {
+	regs, err := p.storage.Registrations(ctx)
+	if err != nil {
+		return err
+	}
+	st := &PressureStatus{Sampled: p.clock.Now()}
+	for _, reg := range regs {
+		st.Leases += reg.Leases
+		st.Size += reg.Size
+	}
+	if st.Size == 0 {
+		return errors.New("no live instance registered a pool size")
+	}
+	st.Utilization = 100 * float64(st.Leases) / float64(st.Size)
+
+	bands := p.cfg.PressureBands
+	p.pressure.mu.Lock()
+	was := p.pressure.level
+	p.pressure.level = nextLevel(bands, p.cfg.PressureHysteresis, was, st.Utilization)
+	level := p.pressure.level
+	if level > 0 {
+		st.Band = &bands[level-1]
+	}
+	p.pressure.status = st
+	p.pressure.mu.Unlock()
+
+	switch {
+	case level == was:
+	case level == 0:
+		log.Infof("utilization of all pools at %.1f%% (%d/%d): back to the configured lease time",
+			st.Utilization, st.Leases, st.Size)
+	default:
+		log.Warnf("utilization of all pools at %.1f%% (%d/%d): %s, leases shortened to %s",
+			st.Utilization, st.Leases, st.Size, st.Band, st.Band.LeaseTime)
+	}
+	return nil
+}
+
+// pressureName returns the band stored on records and events, or ""
+func (p *PluginState) pressureName() string {
+	if b := p.pressure.band(); b != nil {
+		return b.String()
+	}
+	return ""
+}
@@ -0,0 +1,145 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestParsePressureBands(t *testing.T) {
+	bands, err := parsePressureBands("80:10m,50:30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(bands); got != "[pressure>=50% pressure>=80%]" || bands[0].LeaseTime != 30*time.Minute {
+		t.Errorf("parsed %s", got)
+	}
+	for _, val := range []string{"50", "0:10m", "101:10m", "50:forever", "50:10m,50:5m"} {
+		if _, err := parsePressureBands(val); err == nil {
+			t.Errorf("parsePressureBands(%q) succeeded", val)
+		}
+	}
+}
+
+func TestNextLevel(t *testing.T) {
+	bands := []PressureBand{{Threshold: 50}, {Threshold: 80}}
+	for _, tc := range []struct {
+		level int
+		util  float64
+		want  int
+	}{
+		{0, 49.9, 0},
+		{0, 50, 1},
+		{0, 95, 2},
+		{1, 79, 1},
+		{1, 45, 1},
+		{1, 44.9, 0},
+		{2, 75, 2},
+		{2, 74.9, 1},
+		{2, 10, 0},
+		{2, 100, 2},
+	} {
+		if got := nextLevel(bands, 5, tc.level, tc.util); got != tc.want {
+			t.Errorf("nextLevel from %d at %.1f%% = %d, want %d", tc.level, tc.util, got, tc.want)
+		}
+	}
+}
+
+// beat does what the heartbeats of the instances do: each registers its
+// lease count, then samples the utilization of all the pools
+func beat(t *testing.T, instances ...*PluginState) {
+	t.Helper()
+	for _, p := range instances {
+		p.registration.Leases = p.leases.len()
+		if err := p.storage.Register(context.Background(), p.registration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range instances {
+		if err := p.samplePressure(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPressure(t *testing.T) {
+	m := miniredis.RunT(t)
+	args := []string{"1h", "pressure_bands=50:30m,80:10m"}
+	p := startPlugin(t, m, append([]string{"10.0.36.10", "10.0.36.19"}, args...)...)
+	q := startPlugin(t, m, append([]string{"10.0.36.100", "10.0.36.109"}, args...)...)
+	events := recordEvents(q)
+	ips := make(map[string]net.IP)
+	grant := func(p *PluginState, mac string, want time.Duration) {
+		t.Helper()
+		ips[mac] = lease(t, p, mac)
+		assertTTL(t, m, keyPrefix(p, "shadow")+mac, want)
+	}
+	// probe checks the lease time and band of a grant on q, then releases
+	// it before the next sample. Renewals do not shorten the leases they
+	// renew, so only grants follow a band right away.
+	probe := func(want time.Duration, band string) {
+		t.Helper()
+		const mac = "00:11:22:33:44:ff"
+		grant(q, mac, want)
+		if rec, err := q.storage.GetRecord(mac); err != nil || rec.Pressure != band {
+			t.Errorf("grant in band %q, want %q: %v", rec.Pressure, band, err)
+		}
+		releaseLease(t, q, mac, ips[mac])
+	}
+	macP := func(i int) string { return net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x0a, byte(i)}.String() }
+	macQ := func(i int) string { return net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x0b, byte(i)}.String() }
+
+	// 4 of the 20 addresses, then 10: the bands apply from the next sample
+	for i := 0; i < 10; i++ {
+		grant(p, macP(i), time.Hour)
+		if i == 3 {
+			beat(t, p, q)
+			if s := q.Stats().Pressure; s == nil || s.Leases != 4 || s.Size != 20 || s.Band != nil {
+				t.Errorf("pressure %+v at 4 leases", s)
+			}
+		}
+	}
+	beat(t, p, q)
+	for i := 0; i < 6; i++ {
+		grant(q, macQ(i), 30*time.Minute)
+	}
+	probe(30*time.Minute, "pressure>=50%")
+
+	// 80%: the band is shared by all the instances
+	beat(t, p, q)
+	for _, p := range []*PluginState{p, q} {
+		if s := p.Stats().Pressure; s == nil || s.Utilization != 80 || s.Band == nil || s.Band.LeaseTime != 10*time.Minute {
+			t.Errorf("pressure %+v at 16 leases", s)
+		}
+	}
+	probe(10*time.Minute, "pressure>=80%")
+	eventually(t, "the grant event", func() bool {
+		grants := events.of(EventGrant)
+		return len(grants) == 8 && grants[7].Pressure == "pressure>=80%"
+	})
+
+	// the band is kept down to 75%, left below
+	releaseLease(t, q, macQ(5), ips[macQ(5)])
+	beat(t, p, q)
+	probe(10*time.Minute, "pressure>=80%")
+	releaseLease(t, q, macQ(4), ips[macQ(4)])
+	beat(t, p, q)
+	probe(30*time.Minute, "pressure>=50%")
+
+	// down to 45%, then below
+	for i := 0; i < 4; i++ {
+		releaseLease(t, q, macQ(i), ips[macQ(i)])
+	}
+	releaseLease(t, p, macP(0), ips[macP(0)])
+	beat(t, p, q)
+	if b := q.pressure.band(); b == nil || b.Threshold != 50 {
+		t.Errorf("band %v at 45%%", b)
+	}
+	releaseLease(t, p, macP(1), ips[macP(1)])
+	beat(t, p, q)
+	probe(time.Hour, "")
+}
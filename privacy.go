@@ -0,0 +1,146 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// REDIS_REVEAL_KEY_PREFIX prefixes the answers to the reveal control
+// command, mapping a pseudonym to the client it stands for
+const REDIS_REVEAL_KEY_PREFIX = "x:dhcp:reveal:"
+
+const (
+	// prefix of the pseudonyms of the clients
+	pseudonymPrefix = "anon-"
+	// time the answer to a reveal command is kept
+	revealTTL = 5 * time.Minute
+)
+
+// clientPattern matches the identities of the clients in text: hardware
+// addresses, client keys and DUIDs in hex, the latter at least as long as a
+// DUID-LL. A pseudonym is matched whole, so that it is left as it is.
+var clientPattern = regexp.MustCompile(`(?i)(?:\b` + pseudonymPrefix + `)?\b(?:` +
+	`[0-9a-f]{2}(?:[:-][0-9a-f]{2}){5,19}|\d+-(?:id-)?[0-9a-f]{4,}|(?:[0-9a-f]{2}){10,130})\b`)
+
+// pseudonymizer replaces the identities of the clients with a keyed hash,
+// stable for a given key so that the outbound surfaces can still be
+// correlated. A nil pseudonymizer leaves them as they are.
+type pseudonymizer struct {
+	key []byte
+}
+
+// privacy is the pseudonymizer of the outbound surfaces of the process,
+// set by the first instance with a privacy key. The log is shared by all
+// the instances, so they must agree on it.
+var privacy atomic.Pointer[pseudonymizer]
+
+// enablePrivacy installs the pseudonymizer with key for the process
+func enablePrivacy(key string) error {
+	ps := &pseudonymizer{key: []byte(key)}
+	if !privacy.CompareAndSwap(nil, ps) && !hmac.Equal(privacy.Load().key, ps.key) {
+		return errors.New("another instance runs with a different privacy_key")
+	}
+	return nil
+}
+
+// client returns the pseudonym of the client identified by id
+func (ps *pseudonymizer) client(id string) string {
+	if ps == nil || id == "" {
+		return id
+	}
+	mac := hmac.New(sha256.New, ps.key)
+	mac.Write([]byte(canonicalClient(id)))
+	return pseudonymPrefix + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// text replaces the identities of the clients found in s
+func (ps *pseudonymizer) text(s string) string {
+	if ps == nil {
+		return s
+	}
+	return clientPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if len(m) > len(pseudonymPrefix) && strings.EqualFold(m[:len(pseudonymPrefix)], pseudonymPrefix) {
+			return m
+		}
+		return ps.client(m)
+	})
+}
+
+// bytes replaces the identities of the clients found in b
+func (ps *pseudonymizer) bytes(b []byte) []byte {
+	if ps == nil {
+		return b
+	}
+	return []byte(ps.text(string(b)))
+}
+
+// event returns ev with the identities of the clients replaced
+func (ps *pseudonymizer) event(ev Event) Event {
+	if ps == nil {
+		return ev
+	}
+	ev.MAC = ps.client(ev.MAC)
+	ev.Link = ps.client(ev.Link)
+	ev.Detail = ps.text(ev.Detail)
+	if ev.Labels != nil {
+		labels := make(map[string]string, len(ev.Labels))
+		for k, v := range ev.Labels {
+			labels[k] = ps.text(v)
+		}
+		ev.Labels = labels
+	}
+	return ev
+}
+
+// canonicalClient returns the form of a client identity the pseudonym is
+// computed on, so that the same client gets the same one however written
+func canonicalClient(id string) string {
+	id = strings.ToLower(id)
+	if strings.Count(id, "-") >= 5 && !strings.Contains(id, ":") {
+		id = strings.ReplaceAll(id, "-", ":")
+	}
+	return id
+}
+
+// revealPrefixes are the keys of the clients the reveal command searches,
+// in the namespace ns
+func revealPrefixes(ns keySpace) []string {
+	return []string{ns.main, REDIS_V6_KEY_PREFIX, REDIS_PD_KEY_PREFIX, REDIS_REFUSALS_KEY_PREFIX}
+}
+
+// Reveal returns the client a pseudonym of the outbound surfaces stands
+// for, searched among the clients having a lease or a refusal in the
+// storage. The answer is also stored under REDIS_REVEAL_KEY_PREFIX for a
+// few minutes, so that an operator with access to redis can read it.
+func (p *PluginState) Reveal(ctx context.Context, pseudonym string) (string, error) {
+	ps := privacy.Load()
+	if ps == nil {
+		return "", errors.New("the privacy mode is disabled")
+	}
+	pseudonym = strings.ToLower(pseudonym)
+	var found string
+	for _, prefix := range revealPrefixes(p.storage.ns) {
+		err := p.storage.scanKeys(ctx, prefix, func(keys []string) error {
+			for _, key := range keys {
+				if id := key[len(prefix):]; found == "" && ps.client(id) == pseudonym {
+					found = id
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		if found != "" {
+			return found, unavailable(p.storage.rdb.Set(ctx, REDIS_REVEAL_KEY_PREFIX+pseudonym, found, revealTTL).Err())
+		}
+	}
+	return "", ErrNotFound
+}
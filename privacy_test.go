@@ -0,0 +1,111 @@
+package rangeredisplugin
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// withPrivacy clears the pseudonymizer of the process at the end of the
+// test
+func withPrivacy(t *testing.T) {
+	t.Cleanup(func() { privacy.Store(nil) })
+}
+
+func TestPseudonymizer(t *testing.T) {
+	ps := &pseudonymizer{key: []byte("secret")}
+	const mac = "00:11:22:33:44:0a"
+	anon := ps.client(mac)
+	if !strings.HasPrefix(anon, pseudonymPrefix) || len(anon) != len(pseudonymPrefix)+16 {
+		t.Fatalf("pseudonym %q", anon)
+	}
+	// the same client however written, another one or another key differ
+	for _, id := range []string{"00:11:22:33:44:0A", "00-11-22-33-44-0a"} {
+		if got := ps.client(id); got != anon {
+			t.Errorf("pseudonym of %s is %s, want %s", id, got, anon)
+		}
+	}
+	if ps.client("00:11:22:33:44:0b") == anon || (&pseudonymizer{key: []byte("other")}).client(mac) == anon {
+		t.Error("pseudonym shared by another client or key")
+	}
+
+	const duid = "000300010011223344aa"
+	in := "lease of 10.0.58.10 to " + mac + ", key 1-0011223344aa, duid " + duid + ", " + anon
+	want := "lease of 10.0.58.10 to " + anon + ", key " + ps.client("1-0011223344aa") + ", duid " + ps.client(duid) + ", " + anon
+	if got := ps.text(in); got != want {
+		t.Errorf("text:\n%s\nwant:\n%s", got, want)
+	}
+
+	// a nil pseudonymizer leaves everything as it is
+	var none *pseudonymizer
+	if none.client(mac) != mac || none.text(in) != in {
+		t.Error("identities replaced out of privacy mode")
+	}
+	ev := Event{Type: EventExpire, MAC: mac, Detail: "from " + mac}
+	if got := ps.event(ev); got.MAC != anon || got.Detail != "from "+anon || ev.MAC != mac {
+		t.Errorf("event %+v", got)
+	}
+}
+
+func TestPrivacy(t *testing.T) {
+	withPrivacy(t)
+	global := &eventRecorder{}
+	RegisterEventSink(global)
+	t.Cleanup(func() {
+		sinksMu.Lock()
+		sinks = sinks[:len(sinks)-1]
+		sinksMu.Unlock()
+	})
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.58.10", "10.0.58.20", "1h", "privacy_key=0123456789abcdef", "oplog=64")
+	local := recordEvents(p)
+	const a, b = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+	anonA, anonB := privacy.Load().client(a), privacy.Load().client(b)
+	lease(t, p, a)
+
+	// the sinks of the instance get the clients in clear, the others not
+	lease(t, p, b)
+	eventually(t, "the grants", func() bool { return len(local.of(EventGrant)) == 2 && len(global.of(EventGrant)) == 2 })
+	if got := local.of(EventGrant)[1].MAC; got != b {
+		t.Errorf("local sink got %s", got)
+	}
+	if got := global.of(EventGrant)[1].MAC; got != anonB {
+		t.Errorf("registered sink got %s, want %s", got, anonB)
+	}
+
+	// the exports and the support bundle
+	w := &memWriter{}
+	manifest, err := p.Export(context.Background(), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := w.objects[w.chunks(manifest.ID)[0]]
+	if !bytes.Contains(chunk, []byte(anonA)) || bytes.Contains(chunk, []byte(a)) {
+		t.Errorf("exported %s", chunk)
+	}
+	m.Del(p.storage.ns.main + a)
+	var bundle bytes.Buffer
+	if err := p.SupportBundle(context.Background(), &bundle, true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(bundle.String(), anonA) || strings.Contains(bundle.String(), a) {
+		t.Errorf("support bundle without the pseudonym of %s, or with its MAC", a)
+	}
+
+	// the reveal command answers in redis
+	p.handleControl("reveal " + strings.ToUpper(anonB))
+	if got, _ := m.Get(REDIS_REVEAL_KEY_PREFIX + anonB); got != b {
+		t.Errorf("%s revealed as %q, want %s", anonB, got, b)
+	}
+	if _, err := p.Reveal(context.Background(), privacy.Load().client("00:11:22:33:44:0c")); err != ErrNotFound {
+		t.Errorf("reveal of an unknown client: %v", err)
+	}
+
+	// the instances of the process share the key
+	if _, err := setup4(redisURI(m), "10.0.58.30", "10.0.58.40", "1h", "privacy_key=fedcba9876543210"); err == nil {
+		t.Error("instance with another privacy key set up")
+	}
+}
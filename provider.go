@@ -0,0 +1,164 @@
+package rangeredisplugin
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// size of the per-instance buffer of pub/sub messages
+const listenerBuffer = 1024
+
+var (
+	providersMu sync.Mutex
+	providers   = make(map[string]*RedisProvider)
+)
+
+// providerKey normalizes the connection parameters of a provider, so that
+// URIs written differently but reaching the same database share a provider
+func providerKey(connStr string, opts StorageOptions) (string, error) {
+	opt, err := parseURI(connStr)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s|%d|%s|%s|%t|%s|%s|%d|%s|%s|%t", opt.Addr, opt.DB, opt.Username, opt.Password,
+		opt.TLSConfig != nil, opts.SecondaryURI, opts.HistoryURI, opts.HistoryLength, opts.ExpiryTolerance, opts.KeyPrefix, opts.Faults), nil
+}
+
+// AcquireStorage returns the provider connected to connStr with opts,
+// creating it on first use. Instances with the same connection parameters
+// share one provider, hence one connection pool and one subscription. Every
+// call must be paired with a ReleaseStorage.
+func AcquireStorage(connStr string, opts StorageOptions) (*RedisProvider, error) {
+	key, err := providerKey(connStr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	if r, ok := providers[key]; ok {
+		r.refs++
+		log.Infof("sharing storage %s with %d other instances", redactURI(connStr), r.refs-1)
+		return r, nil
+	}
+	r, err := InitStorage(connStr, opts)
+	if err != nil {
+		return nil, err
+	}
+	r.key, r.refs = key, 1
+	providers[key] = r
+	go r.fanOut()
+	return r, nil
+}
+
+// ReleaseStorage drops a reference to r, closing it with the last one
+func ReleaseStorage(r *RedisProvider) error {
+	providersMu.Lock()
+	r.refs--
+	last := r.refs == 0
+	if last {
+		delete(providers, r.key)
+	}
+	providersMu.Unlock()
+
+	if !last {
+		return nil
+	}
+	return r.Close()
+}
+
+// shared reports whether other instances use the provider too
+func (r *RedisProvider) shared() bool {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	return r.refs > 1
+}
+
+// Listener receives the pub/sub messages of a provider, see Listen
+type Listener struct {
+	// C delivers the messages, in order
+	C  <-chan *redis.Message
+	ch chan *redis.Message
+	// dropped counts the messages dropped while C was full
+	dropped atomic.Uint64
+}
+
+// Dropped returns the number of messages dropped for the listener, 0 for
+// no listener
+func (l *Listener) Dropped() uint64 {
+	if l == nil {
+		return 0
+	}
+	return l.dropped.Load()
+}
+
+// Listen registers a new receiver of the pub/sub messages of the provider.
+// Each receiver gets every message, in order, as long as it keeps up. The
+// returned function unregisters it and closes its channel.
+func (r *RedisProvider) Listen() (*Listener, func()) {
+	ch := make(chan *redis.Message, listenerBuffer)
+	l := &Listener{C: ch, ch: ch}
+
+	r.listenMu.Lock()
+	if r.listeners == nil {
+		r.listeners = make(map[*Listener]struct{})
+	}
+	r.listeners[l] = struct{}{}
+	r.listenMu.Unlock()
+
+	var once sync.Once
+	return l, func() {
+		once.Do(func() {
+			r.listenMu.Lock()
+			defer r.listenMu.Unlock()
+			delete(r.listeners, l)
+			close(ch)
+		})
+	}
+}
+
+// fanOut copies the messages of the subscription to every receiver. A
+// receiver whose buffer is full misses the message rather than stalling
+// the others, and has it counted in its Dropped.
+func (r *RedisProvider) fanOut() {
+	for msg := range r.SubExp.Channel() {
+		if r.faults.dropMessage() {
+			continue
+		}
+		r.listenMu.Lock()
+		for l := range r.listeners {
+			select {
+			case l.ch <- msg:
+			default:
+				l.dropped.Add(1)
+			}
+		}
+		r.listenMu.Unlock()
+	}
+
+	r.listenMu.Lock()
+	defer r.listenMu.Unlock()
+	for l := range r.listeners {
+		delete(r.listeners, l)
+		close(l.ch)
+	}
+}
+
+// Close unsubscribes from the notifications and closes the connections
+func (r *RedisProvider) Close() error {
+	err := r.SubExp.Close()
+	if sec := r.getSecondary(); sec != nil {
+		sec.Close()
+	}
+	if r.history != r.rdb {
+		r.history.Close()
+	}
+	if cerr := r.rdb.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
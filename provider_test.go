@@ -0,0 +1,84 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestSharedProviderSurvivesClose(t *testing.T) {
+	m := miniredis.RunT(t)
+	first := startPlugin(t, m, "10.0.0.10", "10.0.0.20", "1h")
+	second := startPlugin(t, m, "10.0.0.30", "10.0.0.40", "1h")
+	if first.storage != second.storage {
+		t.Fatal("instances with the same uri do not share their provider")
+	}
+
+	const mac = "00:11:22:33:44:55"
+	ip := lease(t, second, mac)
+	if err := first.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expire(t, m, second, mac)
+	eventually(t, "the survivor to free "+ip.String(), func() bool { return second.leases.ipOf(mac) == nil })
+}
+
+func TestFanOutDoesNotStall(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.0.10", "10.0.0.20", "1h")
+
+	// a listener never read from
+	stalled, unlisten := p.storage.Listen()
+	for i := 0; i < listenerBuffer+10; i++ {
+		m.Publish("__keyevent@0__:expired", fmt.Sprintf("foreign:%d", i))
+	}
+
+	const mac = "00:11:22:33:44:55"
+	lease(t, p, mac)
+	expire(t, m, p, mac)
+	eventually(t, "the lease to be freed", func() bool { return p.leases.ipOf(mac) == nil })
+	if n := stalled.Dropped(); n < 11 {
+		t.Errorf("stalled listener dropped %d messages, want at least 11", n)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		unlisten()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("unregistering a full listener blocks")
+	}
+}
+
+func TestSweepDropped(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.0.10", "10.0.0.20", "1h")
+
+	const gone, kept = "00:11:22:33:44:55", "00:11:22:33:44:66"
+	lease(t, p, gone)
+	lease(t, p, kept)
+	// the shadow key expires, its notification dropped
+	advance(p, 2*time.Hour)
+	m.Del(p.storage.ns.shadow + gone)
+	p.listener.dropped.Add(1)
+
+	if err := p.sweepDropped(); err != nil {
+		t.Fatal(err)
+	}
+	if p.leases.ipOf(gone) != nil {
+		t.Error("lease whose notification was dropped is not freed")
+	}
+	if p.leases.ipOf(kept) == nil {
+		t.Error("live lease freed by the sweep")
+	}
+	if p.swept != 1 {
+		t.Errorf("swept %d dropped notifications, want 1", p.swept)
+	}
+}
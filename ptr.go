@@ -0,0 +1,169 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policies applied when the PTR record of a candidate address names another
+// host than the client
+const (
+	// PTRPrefer tries other addresses before granting a mismatching one
+	PTRPrefer = "prefer"
+	// PTRWarn grants the address and emits an EventPTRMismatch
+	PTRWarn = "warn"
+	// PTRCleanup grants the address and emits an EventPTRMismatch asking a
+	// DNS updater to clean the stale record up
+	PTRCleanup = "cleanup"
+)
+
+const (
+	// default time budget of the PTR checks of one allocation
+	defaultPTRTimeout = 200 * time.Millisecond
+	// number of addresses tried by the prefer policy
+	ptrMaxCandidates = 4
+	// lifetime of the cached PTR lookups
+	ptrCacheTTL = 5 * time.Minute
+)
+
+// PTRResolver resolves the names of an address; net.Resolver implements it
+type PTRResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// ptrCacheEntry is a cached PTR lookup
+type ptrCacheEntry struct {
+	names   []string
+	expires time.Time
+}
+
+// ptrChecker looks PTR records up with a cache
+type ptrChecker struct {
+	resolver PTRResolver
+	mu       sync.Mutex
+	cache    map[string]ptrCacheEntry
+	// order is the order the entries were set in, oldest first
+	order arrivals[string]
+	// limit bounds the number of addresses cached, 0 for no bound
+	limit int
+}
+
+// lookup returns the PTR names of ip, without their trailing dot. An
+// address without PTR record has no names.
+func (c *ptrChecker) lookup(ctx context.Context, ip net.IP) ([]string, error) {
+	key := ip.String()
+	c.mu.Lock()
+	e, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.names, nil
+	}
+
+	names, err := c.resolver.LookupAddr(ctx, key)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		names, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, n := range names {
+		names[i] = strings.TrimSuffix(n, ".")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = make(map[string]ptrCacheEntry)
+	}
+	if _, ok := c.cache[key]; !ok && c.limit > 0 && len(c.cache) >= c.limit {
+		evictOldest(c.cache, &c.order)
+	}
+	c.order.set(key)
+	c.cache[key] = ptrCacheEntry{names: names, expires: time.Now().Add(ptrCacheTTL)}
+	return names, nil
+}
+
+func (c *ptrChecker) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.cache)
+}
+
+// ptrMatches reports whether one of the PTR names belongs to hostname, which
+// can be a short name or a fully qualified one
+func ptrMatches(names []string, hostname string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	hostname = strings.TrimSuffix(hostname, ".")
+	for _, n := range names {
+		if strings.EqualFold(n, hostname) {
+			return true
+		}
+		short, _, _ := strings.Cut(n, ".")
+		if strings.EqualFold(short, hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// allocateChecked allocates an address for a new lease of mac, checking its
+// PTR record against hostname. All lookups share the PTR timeout, and a
+// failing or slow lookup lets the candidate through.
+func (p *PluginState) allocateChecked(mac, hostname string) (net.IP, error) {
+	if p.cfg.PTRPolicy == "" || hostname == "" {
+		return p.allocate(mac)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.PTRTimeout)
+	defer cancel()
+
+	var rejected []net.IP
+	defer func() {
+		for _, ip := range rejected {
+			if err := p.allocator.Free(net.IPNet{IP: ip, Mask: net.IPv4Mask(255, 255, 255, 255)}); err != nil {
+				log.Errorf("error when release ip %v, err: %v", ip, err)
+			}
+		}
+	}()
+
+	for {
+		ip, err := p.allocate(mac)
+		if err != nil {
+			if len(rejected) > 0 && errors.Is(err, ErrPoolExhausted) {
+				// the mismatching address is better than none
+				ip, rejected = rejected[0], rejected[1:]
+				return ip, nil
+			}
+			return nil, err
+		}
+
+		names, err := p.ptr.lookup(ctx, ip)
+		if err != nil {
+			log.Debugf("PTR check of %s skipped: %v", ip, err)
+			return ip, nil
+		}
+		if ptrMatches(names, hostname) {
+			return ip, nil
+		}
+
+		detail := fmt.Sprintf("PTR %s does not match client %s", strings.Join(names, ","), hostname)
+		if p.cfg.PTRPolicy == PTRPrefer && len(rejected)+1 < ptrMaxCandidates && ctx.Err() == nil {
+			log.Debugf("skipping %s for MAC %s: %s", ip, mac, detail)
+			rejected = append(rejected, ip)
+			continue
+		}
+		if p.cfg.PTRPolicy == PTRCleanup {
+			detail += ", cleanup requested"
+		}
+		log.Warnf("granting %s to MAC %s: %s", ip, mac, detail)
+		p.emit(Event{Type: EventPTRMismatch, MAC: mac, IP: ip, Detail: detail})
+		return ip, nil
+	}
+}
@@ -0,0 +1,150 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// fakeResolver answers PTR lookups from names, NXDOMAIN for the addresses
+// it has none for, and blocks until the context is done for slow
+type fakeResolver struct {
+	names   map[string][]string
+	slow    bool
+	lookups atomic.Int32
+}
+
+func (r *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.lookups.Add(1)
+	if r.slow {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if names, ok := r.names[addr]; ok {
+		return append([]string(nil), names...), nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+// offeredTo returns the address offered to mac discovering with hostname
+func offeredTo(t *testing.T, p *PluginState, mac, hostname string) net.IP {
+	t.Helper()
+	offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac, dhcpv4.WithOption(dhcpv4.OptHostName(hostname))))
+	if offer == nil {
+		t.Fatalf("no offer to %s", mac)
+	}
+	return offer.YourIPAddr
+}
+
+func TestPTRCheck(t *testing.T) {
+	stale := map[string][]string{"10.0.19.10": {"printer.example.com."}}
+	for _, tc := range []struct {
+		name   string
+		policy string
+		names  map[string][]string
+		want   net.IP
+		detail string
+	}{
+		{"match", PTRPrefer, map[string][]string{"10.0.19.10": {"laptop.example.com."}}, net.IPv4(10, 0, 19, 10), ""},
+		{"NXDOMAIN", PTRPrefer, nil, net.IPv4(10, 0, 19, 10), ""},
+		{"mismatch preferring another address", PTRPrefer, stale, net.IPv4(10, 0, 19, 11), ""},
+		{"mismatch with a warning", PTRWarn, stale, net.IPv4(10, 0, 19, 10),
+			"PTR printer.example.com does not match client laptop"},
+		{"mismatch with a cleanup", PTRCleanup, stale, net.IPv4(10, 0, 19, 10),
+			"PTR printer.example.com does not match client laptop, cleanup requested"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := miniredis.RunT(t)
+			p := startPlugin(t, m, "10.0.19.10", "10.0.19.13", "1h", "ptr_check="+tc.policy)
+			p.ptr.resolver = &fakeResolver{names: tc.names}
+			events := recordEvents(p)
+
+			if got := offeredTo(t, p, "00:11:22:33:44:0a", "laptop"); !got.Equal(tc.want) {
+				t.Errorf("offered %s, want %s", got, tc.want)
+			}
+			if tc.detail == "" {
+				time.Sleep(50 * time.Millisecond)
+				if n := len(events.of(EventPTRMismatch)); n != 0 {
+					t.Errorf("%d PTR mismatch events", n)
+				}
+				return
+			}
+			eventually(t, "the PTR mismatch event", func() bool {
+				ev := events.of(EventPTRMismatch)
+				return len(ev) == 1 && ev[0].Detail == tc.detail
+			})
+		})
+	}
+}
+
+func TestPTRCheckPreferExhausted(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.19.10", "10.0.19.11", "1h", "ptr_check=prefer")
+	p.ptr.resolver = &fakeResolver{names: map[string][]string{
+		"10.0.19.10": {"printer.example.com."},
+		"10.0.19.11": {"scanner.example.com."},
+	}}
+	// a mismatching address is better than none
+	if got := offeredTo(t, p, "00:11:22:33:44:0a", "laptop"); !got.Equal(net.IPv4(10, 0, 19, 10)) {
+		t.Errorf("offered %s, want the first mismatching address", got)
+	}
+	if got := offeredTo(t, p, "00:11:22:33:44:0b", "desktop"); !got.Equal(net.IPv4(10, 0, 19, 11)) {
+		t.Errorf("offered %s, want the other address, freed after the check", got)
+	}
+}
+
+func TestPTRCheckTimeout(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.19.10", "10.0.19.13", "1h", "ptr_check=prefer", "ptr_timeout=50ms")
+	resolver := &fakeResolver{slow: true}
+	p.ptr.resolver = resolver
+
+	start := time.Now()
+	if got := offeredTo(t, p, "00:11:22:33:44:0a", "laptop"); !got.Equal(net.IPv4(10, 0, 19, 10)) {
+		t.Errorf("offered %s after a PTR timeout, want 10.0.19.10", got)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("offer took %s with a PTR timeout of 50ms", elapsed)
+	}
+	if n := resolver.lookups.Load(); n != 1 {
+		t.Errorf("%d lookups, want 1", n)
+	}
+}
+
+func TestPTRCheckSkipped(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.19.10", "10.0.19.13", "1h", "ptr_check=warn")
+	resolver := &fakeResolver{names: map[string][]string{"10.0.19.10": {"printer.example.com."}}}
+	p.ptr.resolver = resolver
+	const mac = "00:11:22:33:44:0a"
+	ip := offeredTo(t, p, mac, "laptop")
+
+	// the request of the offer and the renewals are not checked, nor are
+	// the clients without host name
+	ack := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac,
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)), dhcpv4.WithOption(dhcpv4.OptHostName("laptop"))))
+	if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("request of the offer answered %v", ack)
+	}
+	if typ := renewal(t, p, mac, ip); typ != dhcpv4.MessageTypeAck {
+		t.Fatalf("renewal answered %s", typ)
+	}
+	lease(t, p, "00:11:22:33:44:0b")
+	if n := resolver.lookups.Load(); n != 1 {
+		t.Errorf("%d lookups, want only the one of the new lease", n)
+	}
+
+	// lookups are cached
+	if names, err := p.ptr.lookup(context.Background(), ip); err != nil || strings.Join(names, ",") != "printer.example.com" {
+		t.Errorf("cached lookup: %v, %v", names, err)
+	}
+	if n := resolver.lookups.Load(); n != 1 {
+		t.Errorf("%d lookups after a cached one, want 1", n)
+	}
+}
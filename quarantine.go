@@ -0,0 +1,269 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// REDIS_QUARANTINE_KEY_PREFIX prefixes the addresses withheld from
+// allocation after a conflict, mapped to the MAC observed using them, in
+// the default namespace
+const REDIS_QUARANTINE_KEY_PREFIX = "q:dhcp:"
+
+const (
+	// default time an address is withheld after a conflict, observed or
+	// declined
+	defaultQuarantineTime = time.Hour
+	// sustained and burst rates of accepted ARP observations
+	observationRate  = 10
+	observationBurst = 50
+)
+
+// Quarantine withholds ip from allocation for d, recording the MAC seen
+// using it. Returns false if the address was already quarantined.
+func (r *RedisProvider) Quarantine(ip net.IP, mac string, d time.Duration) (bool, error) {
+	ok, err := r.rdb.SetNX(context.TODO(), r.ns.quarantine+ip.String(), mac, d).Result()
+	if err != nil {
+		return false, unavailable(err)
+	}
+	return ok, nil
+}
+
+// Requarantine sets the expiry of the quarantine of ip to d from now.
+// Returns false if ip is not quarantined.
+func (r *RedisProvider) Requarantine(ip net.IP, d time.Duration) (bool, error) {
+	ok, err := r.rdb.Expire(context.TODO(), r.ns.quarantine+ip.String(), d).Result()
+	if err != nil {
+		return false, unavailable(err)
+	}
+	return ok, nil
+}
+
+// QuarantinedIPs returns the addresses currently in quarantine
+func (r *RedisProvider) QuarantinedIPs(ctx context.Context) ([]net.IP, error) {
+	var (
+		ips    []net.IP
+		cursor uint64
+	)
+	for {
+		keys, next, err := r.rdb.Scan(ctx, cursor, r.ns.quarantine+"*", 1000).Result()
+		if err != nil {
+			return nil, unavailable(err)
+		}
+		for _, key := range keys {
+			if ip := net.ParseIP(key[len(r.ns.quarantine):]).To4(); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		cursor = next
+		if cursor == 0 {
+			return ips, nil
+		}
+	}
+}
+
+// rateLimiter is a token bucket
+type rateLimiter struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token if one is available
+func (l *rateLimiter) allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.last.IsZero() {
+		l.tokens = observationBurst
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * observationRate
+		if l.tokens > observationBurst {
+			l.tokens = observationBurst
+		}
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// reassignments holds the MAC addresses whose next REQUEST is NAKed, so
+// that they move off an address found in conflict
+type reassignments struct {
+	mu   sync.Mutex
+	macs map[string]bool
+}
+
+func (r *reassignments) add(mac string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.macs == nil {
+		r.macs = make(map[string]bool)
+	}
+	r.macs[mac] = true
+}
+
+func (r *reassignments) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.macs)
+}
+
+// has reports whether mac has to move
+func (r *reassignments) has(mac string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.macs[mac]
+}
+
+// take reports whether mac has to move, forgetting it
+func (r *reassignments) take(mac string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ok := r.macs[mac]
+	delete(r.macs, mac)
+	return ok
+}
+
+// Observe ingests an ARP observation of mac using ip, e.g. a gratuitous ARP
+// seen by a relay. If the address is free, or leased to another MAC, it is
+// quarantined and its leaseholder is moved to another address at its next
+// request. Observations matching the lease, or of addresses already in
+// quarantine, are no-ops.
+func (p *PluginState) Observe(ip net.IP, mac string) error {
+	if !p.observations.allow(p.clock.Now()) {
+		p.counters.observationsDropped.Add(1)
+		return fmt.Errorf("observation of %s dropped: rate limit exceeded", ip)
+	}
+	if !p.inRange(ip) || p.cfg.excluded(ip) {
+		return nil
+	}
+	holder := p.leases.macOf(ip)
+	if holder == mac {
+		// the leaseholder is alive, see reclaimIdle
+		if p.cfg.IdleTime > 0 {
+			p.observed.set(mac, p.clock.Now())
+		}
+		return nil
+	}
+
+	fresh, err := p.storage.Quarantine(ip, mac, p.cfg.QuarantineTime)
+	if err != nil || !fresh {
+		return err
+	}
+
+	if holder == "" {
+		// withhold the free address from the allocator
+		if _, err := allocateExact(p.allocator, net.IPNet{IP: ip}); err != nil {
+			log.Warnf("conflict: could not withhold %s from the allocator: %v", ip, err)
+		}
+	} else {
+		if err := p.storage.DeleteRecord(holder); err != nil {
+			log.Errorf("conflict: could not end the lease of %s for %s: %v", ip, holder, err)
+		}
+		p.leases.remove(holder, ip)
+		p.reassign.add(holder)
+	}
+
+	log.Warnf("conflict: %s observed using %s leased to %q, quarantined for %s", mac, ip, holder, p.cfg.QuarantineTime)
+	p.emit(Event{Type: EventConflict, MAC: holder, IP: ip, Detail: "observed " + mac})
+	return nil
+}
+
+// decline quarantines the address a client declined with a DHCPDECLINE,
+// having found it in use, for the decline time. Its lease ends and the
+// address stays withheld from the allocator until the quarantine expires,
+// so that the client gets another one. A decline of another address than
+// the one recorded for mac is ignored.
+func (p *PluginState) decline(req *dhcpv4.DHCPv4, mac string, tr *requestTrace) {
+	ip := req.RequestedIPAddress().To4()
+	record, err := p.storage.GetRecord(mac)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Errorf("Could not get record for %s to decline: %v", mac, err)
+		}
+		tr.step("decline ignored: %v", err)
+		return
+	}
+	if !record.IP.Equal(ip) {
+		log.Warnf("MAC %s declines %s but is leased %s, ignoring", mac, ip, record.IP)
+		tr.step("decline of %s ignored: leased %s", ip, record.IP)
+		return
+	}
+	if !p.inRange(ip) || p.foreign(record) {
+		tr.step("decline of %s ignored: not in the pool", ip)
+		return
+	}
+
+	if _, err := p.storage.Quarantine(ip, mac, p.cfg.DeclineTime); err != nil {
+		log.Errorf("Could not quarantine %s declined by %s: %v", ip, mac, err)
+		tr.step("decline of %s failed: %v", ip, err)
+		return
+	}
+	// withheld until the quarantine is over, see releaseQuarantine
+	if err := p.endLease(mac, record, true); err != nil {
+		log.Errorf("could not end the lease of %s for %s: %v", ip, mac, err)
+	}
+
+	tr.step("%s declined, quarantined for %s", ip, p.cfg.DeclineTime)
+	log.Warnf("conflict: %s declined %s, quarantined for %s", mac, ip, p.cfg.DeclineTime)
+	p.emit(Event{Type: EventConflict, MAC: mac, IP: ip, Detail: "declined"})
+}
+
+// restoreQuarantine withholds the addresses still in quarantine from the
+// allocator, once the stored leases are loaded
+func (p *PluginState) restoreQuarantine() error {
+	ips, err := p.storage.QuarantinedIPs(context.TODO())
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !p.inRange(ip) || p.cfg.excluded(ip) || p.leases.macOf(ip) != "" {
+			continue
+		}
+		if _, err := allocateExact(p.allocator, net.IPNet{IP: ip}); err != nil {
+			log.Errorf("could not withhold quarantined address %s: %v", ip, err)
+		}
+	}
+	return nil
+}
+
+// releaseQuarantine returns an address to the allocator once its quarantine
+// has expired
+func (p *PluginState) releaseQuarantine(key string) {
+	ip := net.ParseIP(strings.TrimPrefix(key, p.storage.ns.quarantine)).To4()
+	if ip == nil || p.withheld(ip) || p.leases.macOf(ip) != "" {
+		return
+	}
+	if err := p.allocator.Free(net.IPNet{IP: ip, Mask: net.IPv4Mask(255, 255, 255, 255)}); err != nil {
+		log.Errorf("error when release ip %v, err: %v", ip, err)
+		return
+	}
+	log.Infof("quarantine of %s is over", ip)
+}
+
+// parseObservation parses the arguments of an `observed <ip> <mac>` command
+func parseObservation(args []string) (net.IP, string, error) {
+	if len(args) != 2 {
+		return nil, "", fmt.Errorf("want <ip> <mac>")
+	}
+	ip := net.ParseIP(args[0]).To4()
+	if ip == nil {
+		return nil, "", fmt.Errorf("invalid IPv4 address %q", args[0])
+	}
+	mac, err := net.ParseMAC(args[1])
+	if err != nil {
+		return nil, "", err
+	}
+	return ip, mac.String(), nil
+}
@@ -0,0 +1,231 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// assertNotOffered has new clients discover until the pool 10.0.8.10-15 is
+// exhausted, and checks that ip is never offered
+func assertNotOffered(t *testing.T, p *PluginState, ip net.IP) {
+	t.Helper()
+	for i := 0; i < 6; i++ {
+		offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, fmt.Sprintf("00:11:22:33:55:%02x", i)))
+		if offer != nil && offer.YourIPAddr.Equal(ip) {
+			t.Fatalf("quarantined address %s offered", ip)
+		}
+	}
+}
+
+func TestObservationMatchingLease(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.8.10", "10.0.8.15", "1h")
+	events := recordEvents(p)
+	const mac = "00:11:22:33:44:0a"
+	ip := lease(t, p, mac)
+
+	if err := p.Observe(ip, mac); err != nil {
+		t.Fatal(err)
+	}
+	if m.Exists(p.storage.ns.quarantine + ip.String()) {
+		t.Error("address quarantined by an observation of its leaseholder")
+	}
+	if holder := p.leases.macOf(ip); holder != mac || p.reassign.has(mac) {
+		t.Errorf("lease of %s moved: held by %q", ip, holder)
+	}
+	if typ := renewal(t, p, mac, ip); typ != dhcpv4.MessageTypeAck {
+		t.Errorf("renewal answered %s, want ACK", typ)
+	}
+	if n := len(events.of(EventConflict)); n != 0 {
+		t.Errorf("%d conflict events", n)
+	}
+}
+
+func TestObservationMismatchingLease(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.8.10", "10.0.8.15", "1h")
+	events := recordEvents(p)
+	const holder, intruder = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+	ip := lease(t, p, holder)
+
+	// the same observation reported twice, once through the control channel
+	if err := p.Observe(ip, intruder); err != nil {
+		t.Fatal(err)
+	}
+	p.handleControl("observed " + ip.String() + " 00-11-22-33-44-0B")
+
+	if got, _ := m.Get(p.storage.ns.quarantine + ip.String()); got != intruder {
+		t.Errorf("quarantine of %s names %q, want %s", ip, got, intruder)
+	}
+	eventually(t, "the conflict event", func() bool { return len(events.of(EventConflict)) == 1 })
+	if ev := events.of(EventConflict)[0]; ev.MAC != holder || !ev.IP.Equal(ip) || ev.Detail != "observed "+intruder {
+		t.Errorf("conflict event %+v", ev)
+	}
+	if _, err := p.storage.GetRecord(holder); err == nil {
+		t.Error("lease of the conflicting address kept")
+	}
+
+	// the leaseholder is moved to another address
+	if typ := renewal(t, p, holder, ip); typ != dhcpv4.MessageTypeNak {
+		t.Errorf("renewal of the conflicting address answered %s, want NAK", typ)
+	}
+	if got := lease(t, p, holder); got.Equal(ip) {
+		t.Error("conflicting address granted again to its leaseholder")
+	}
+	assertNotOffered(t, p, ip)
+	time.Sleep(50 * time.Millisecond)
+	if n := len(events.of(EventConflict)); n != 1 {
+		t.Errorf("%d conflict events for one conflict", n)
+	}
+}
+
+func TestObservationUnleasedAddress(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.8.10", "10.0.8.15", "1h", "quarantine_time=10m")
+	const mac = "00:11:22:33:44:0b"
+	free := net.IPv4(10, 0, 8, 10).To4()
+
+	if err := p.Observe(free, mac); err != nil {
+		t.Fatal(err)
+	}
+	key := p.storage.ns.quarantine + free.String()
+	if ttl := m.TTL(key); ttl != 10*time.Minute {
+		t.Errorf("quarantine of %s for %s, want 10m", free, ttl)
+	}
+	// outside of the pool, nothing to do
+	if err := p.Observe(net.IPv4(10, 0, 9, 10), mac); err != nil || m.Exists(p.storage.ns.quarantine+"10.0.9.10") {
+		t.Errorf("observation outside of the pool: %v", err)
+	}
+	assertNotOffered(t, p, free)
+
+	// the address is back once the quarantine expires
+	m.Del(key)
+	p.handleExpired(key)
+	if ip, err := allocateExact(p.allocator, net.IPNet{IP: free}); err != nil || !ip.IP.Equal(free) {
+		t.Errorf("%s not returned to the allocator after the quarantine: %v", free, err)
+	}
+}
+
+func TestObservationRateLimit(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.8.10", "10.0.8.15", "1h")
+	const mac = "00:11:22:33:44:0b"
+	observe := func(n int) (dropped int) {
+		for i := 0; i < n; i++ {
+			if p.Observe(net.IPv4(10, 0, 9, 1), mac) != nil {
+				dropped++
+			}
+		}
+		return dropped
+	}
+	if dropped := observe(observationBurst + 5); dropped != 5 {
+		t.Errorf("%d observations of a burst dropped, want 5", dropped)
+	}
+	advance(p, time.Second)
+	if dropped := observe(observationRate + 5); dropped != 5 {
+		t.Errorf("%d observations dropped a second later, want 5", dropped)
+	}
+	if n := p.Stats().ObservationsDropped; n != 10 {
+		t.Errorf("%d observations dropped in the stats, want 10", n)
+	}
+}
+
+func TestDecline(t *testing.T) {
+	m := miniredis.RunT(t)
+	args := []string{"10.0.8.10", "10.0.8.15", "1h", "decline_time=20m"}
+	p := startPlugin(t, m, args...)
+	events := recordEvents(p)
+	const mac, other = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+	ip, otherIP := lease(t, p, mac), lease(t, p, other)
+	decline := func(p *PluginState, mac string, ip net.IP) {
+		t.Helper()
+		if resp := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDecline, mac, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)))); resp != nil {
+			t.Errorf("decline answered %v", resp)
+		}
+	}
+
+	// the decline of an address leased to another client is ignored
+	decline(p, mac, otherIP)
+	if m.Exists(p.storage.ns.quarantine+otherIP.String()) || p.leases.macOf(otherIP) != other {
+		t.Errorf("%s quarantined by the decline of a client it is not leased to", otherIP)
+	}
+
+	decline(p, mac, ip)
+	key := p.storage.ns.quarantine + ip.String()
+	if got, _ := m.Get(key); got != mac {
+		t.Errorf("quarantine of %s names %q, want %s", ip, got, mac)
+	}
+	if ttl := m.TTL(key); ttl != 20*time.Minute {
+		t.Errorf("quarantine of %s for %s, want 20m", ip, ttl)
+	}
+	if _, err := p.storage.GetRecord(mac); err == nil {
+		t.Error("lease of the declined address kept")
+	}
+	eventually(t, "the conflict event", func() bool { return len(events.of(EventConflict)) == 1 })
+	if ev := events.of(EventConflict)[0]; ev.MAC != mac || !ev.IP.Equal(ip) || ev.Detail != "declined" {
+		t.Errorf("conflict event %+v", ev)
+	}
+	if got := lease(t, p, mac); got.Equal(ip) {
+		t.Error("declined address granted again to the client")
+	}
+	assertNotOffered(t, p, ip)
+
+	// the quarantine is restored by a new instance, and ends with its key
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p = startPlugin(t, m, args...)
+	if _, err := allocateExact(p.allocator, net.IPNet{IP: ip}); err == nil {
+		t.Fatalf("quarantined %s allocatable after a restart", ip)
+	}
+	m.Del(key)
+	p.handleExpired(key)
+	if got, err := allocateExact(p.allocator, net.IPNet{IP: ip}); err != nil || !got.IP.Equal(ip) {
+		t.Errorf("%s not returned to the allocator after the quarantine: %v", ip, err)
+	}
+}
+
+func TestDeclineEndsLease(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.82.10", "10.0.82.20", "1h", "circuit_quota=1")
+	const mac, next = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+	decline := func(p *PluginState, mac string, ip net.IP) {
+		t.Helper()
+		exchange(t, p, onCircuit(t, dhcpv4.MessageTypeDecline, mac, "port1", dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip))))
+	}
+
+	// the lease ends as by a release: its index entry and its place on the
+	// circuit go with it
+	ip := leaseOn(t, p, mac, "port1")
+	decline(p, mac, ip)
+	if m.Exists(p.storage.ns.index + ip.String()) {
+		t.Errorf("index entry of the declined %s kept", ip)
+	}
+	if got := members(t, m, p, "port1"); len(got) != 0 {
+		t.Errorf("circuit holds %v after the decline", got)
+	}
+	if leaseOn(t, p, next, "port1") == nil {
+		t.Error("circuit quota still counting the declined lease")
+	}
+
+	// the lease of another pool sharing the storage is left to it
+	other := startPlugin(t, m, "10.0.83.10", "10.0.83.20", "1h")
+	const foreign = "00:11:22:33:44:0c"
+	static := net.IPv4(10, 0, 82, 19).To4()
+	if err := other.storage.SaveRecord(foreign, &Record{IP: static, Expires: time.Now().Add(time.Hour), Static: true, Pool: other.poolName()}); err != nil {
+		t.Fatal(err)
+	}
+	decline(p, foreign, static)
+	if _, err := p.storage.GetRecord(foreign); err != nil {
+		t.Errorf("lease of another pool ended by a decline: %v", err)
+	}
+	if m.Exists(p.storage.ns.quarantine + static.String()) {
+		t.Errorf("%s of another pool quarantined", static)
+	}
+}
@@ -0,0 +1,199 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// REDIS_RAMP_KEY holds the lease ramp in progress, so that instances
+// started during the ramp follow it too, in the default namespace
+const REDIS_RAMP_KEY = "x:dhcp:ramp"
+
+// shortest lease granted while ramping down, so that clients are not asked
+// to renew every few seconds right before the deadline
+const rampMinLease = time.Minute
+
+// LeaseRamp shortens the leases ahead of a deadline, e.g. a renumbering:
+// no lease granted during the ramp outlives the deadline by more than
+// rampMinLease, and leases last Target once it passed.
+type LeaseRamp struct {
+	Target   time.Duration
+	Deadline time.Time
+}
+
+// RampProgress is the state of the active leases against a lease ramp
+type RampProgress struct {
+	LeaseRamp
+	// Sampled is when the leases were counted
+	Sampled time.Time
+	// Ending counts the leases ending by the deadline, and Outliving the
+	// others, which the deadline would strand until LatestExpiry
+	Ending       int
+	Outliving    int
+	LatestExpiry time.Time
+}
+
+func (r *LeaseRamp) String() string {
+	return fmt.Sprintf("lease ramp to %s by %s", r.Target, r.Deadline.Format(time.RFC3339))
+}
+
+// cap returns the lease to grant at now instead of d
+func (r *LeaseRamp) cap(now time.Time, d time.Duration) time.Duration {
+	if !now.Before(r.Deadline) {
+		return r.Target
+	}
+	left := r.Deadline.Sub(now)
+	if left < rampMinLease {
+		left = rampMinLease
+	}
+	if d > left {
+		return left
+	}
+	return d
+}
+
+// leaseRamp holds the ramp of a plugin instance and its last progress
+type leaseRamp struct {
+	mu       sync.Mutex
+	ramp     *LeaseRamp
+	progress *RampProgress
+}
+
+func (l *leaseRamp) get() *LeaseRamp {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ramp
+}
+
+func (l *leaseRamp) set(r *LeaseRamp) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ramp = r
+	l.progress = nil
+}
+
+// ParseLeaseRamp parses a lease ramp written as <target> <deadline>, the
+// deadline in RFC 3339 format
+func ParseLeaseRamp(target, deadline string) (*LeaseRamp, error) {
+	d, err := parseDuration(target, leaseBounds)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target lease time: %w", err)
+	}
+	t, err := time.Parse(time.RFC3339, deadline)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deadline %q: %v", deadline, err)
+	}
+	return &LeaseRamp{Target: d, Deadline: t}, nil
+}
+
+// SaveRamp stores the lease ramp, or deletes it if r is nil
+func (r *RedisProvider) SaveRamp(ctx context.Context, ramp *LeaseRamp) error {
+	if ramp == nil {
+		return r.clearCheckpoint(ctx, r.ns.ramp)
+	}
+	return r.saveCheckpoint(ctx, r.ns.ramp, ramp)
+}
+
+// LoadRamp returns the stored lease ramp, or nil
+func (r *RedisProvider) LoadRamp(ctx context.Context) (*LeaseRamp, error) {
+	ramp := &LeaseRamp{}
+	ok, err := r.loadCheckpoint(ctx, r.ns.ramp, ramp)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return ramp, nil
+}
+
+// StartRamp starts ramping the lease time down to target by deadline, on
+// every instance sharing the storage. A deadline in the past only sets the
+// lease time to target.
+func (p *PluginState) StartRamp(ctx context.Context, ramp *LeaseRamp) error {
+	if err := leaseBounds.check(ramp.Target); err != nil {
+		return fmt.Errorf("invalid target lease time: %w", err)
+	}
+	if err := p.storage.SaveRamp(ctx, ramp); err != nil {
+		return err
+	}
+	p.ramp.set(ramp)
+	log.Infof("%s started", ramp)
+	return nil
+}
+
+// StopRamp cancels the lease ramp, restoring the configured lease time
+func (p *PluginState) StopRamp(ctx context.Context) error {
+	if err := p.storage.SaveRamp(ctx, nil); err != nil {
+		return err
+	}
+	p.ramp.set(nil)
+	log.Infof("lease ramp cancelled")
+	return nil
+}
+
+// loadRamp follows the lease ramp stored by another instance, if any
+func (p *PluginState) loadRamp(ctx context.Context) error {
+	ramp, err := p.storage.LoadRamp(ctx)
+	if err != nil {
+		return err
+	}
+	if ramp != nil {
+		if err := leaseBounds.check(ramp.Target); err != nil {
+			// stored by hand, or by a version checking less
+			log.Warnf("ignoring the stored lease ramp: invalid target lease time: %v", err)
+			ramp = nil
+		}
+	}
+	p.ramp.set(ramp)
+	if ramp != nil {
+		log.Infof("following the %s", ramp)
+	}
+	return nil
+}
+
+// sampleRamp counts the active leases ending by the deadline of the ramp
+func (p *PluginState) sampleRamp(ctx context.Context) {
+	ramp := p.ramp.get()
+	if ramp == nil {
+		return
+	}
+	prog := &RampProgress{LeaseRamp: *ramp, Sampled: p.clock.Now()}
+	var cursor uint64
+	for {
+		records, next, err := p.storage.ScanRecords(ctx, cursor, exportChunkSize)
+		if err != nil {
+			log.Warnf("could not sample the progress of the lease ramp: %v", err)
+			return
+		}
+		for _, rec := range records {
+			if !p.inRange(rec.IP) && !rec.Static {
+				continue
+			}
+			if rec.Expires.After(ramp.Deadline) {
+				prog.Outliving++
+				if rec.Expires.After(prog.LatestExpiry) {
+					prog.LatestExpiry = rec.Expires
+				}
+			} else {
+				prog.Ending++
+			}
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+
+	p.ramp.mu.Lock()
+	if p.ramp.ramp == ramp {
+		p.ramp.progress = prog
+	}
+	p.ramp.mu.Unlock()
+	log.Infof("%s: %d leases end by the deadline, %d outlive it", ramp, prog.Ending, prog.Outliving)
+}
+
+// rampProgress returns the last sampled progress of the lease ramp, or nil
+func (p *PluginState) rampProgress() *RampProgress {
+	p.ramp.mu.Lock()
+	defer p.ramp.mu.Unlock()
+	return p.ramp.progress
+}
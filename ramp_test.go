@@ -0,0 +1,125 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestLeaseRampCap(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &LeaseRamp{Target: 10 * time.Minute, Deadline: now.Add(2 * time.Hour)}
+	for _, tc := range []struct {
+		at   time.Duration
+		d    time.Duration
+		want time.Duration
+	}{
+		{0, time.Hour, time.Hour},
+		{0, 4 * time.Hour, 2 * time.Hour},
+		{90 * time.Minute, 4 * time.Hour, 30 * time.Minute},
+		// the floor, right before the deadline
+		{2*time.Hour - 10*time.Second, 4 * time.Hour, rampMinLease},
+		{2 * time.Hour, 4 * time.Hour, 10 * time.Minute},
+		{3 * time.Hour, time.Minute, 10 * time.Minute},
+	} {
+		if got := r.cap(now.Add(tc.at), tc.d); got != tc.want {
+			t.Errorf("lease of %s capped to %s at %s, want %s", tc.d, got, tc.at, tc.want)
+		}
+	}
+}
+
+func TestParseLeaseRamp(t *testing.T) {
+	r, err := ParseLeaseRamp("10m", "2026-01-01T12:00:00Z")
+	if err != nil || r.Target != 10*time.Minute || !r.Deadline.Equal(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("ParseLeaseRamp: %v, %v", r, err)
+	}
+	for _, args := range [][2]string{{"10x", "2026-01-01T12:00:00Z"}, {"0s", "2026-01-01T12:00:00Z"}, {"10m", "tomorrow"}} {
+		if _, err := ParseLeaseRamp(args[0], args[1]); err == nil {
+			t.Errorf("ParseLeaseRamp(%q, %q) succeeded", args[0], args[1])
+		}
+	}
+}
+
+func TestLeaseRamp(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.31.10", "10.0.31.60", "4h")
+	ctx := context.Background()
+	old := lease(t, p, "00:11:22:33:44:00")
+	before, err := p.storage.GetRecord("00:11:22:33:44:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := p.clock.Now().Add(2 * time.Hour).Truncate(time.Second)
+	p.handleControl("lease-ramp 10m " + deadline.Format(time.RFC3339))
+	ramp := p.ramp.get()
+	if ramp == nil || ramp.Target != 10*time.Minute || !ramp.Deadline.Equal(deadline) {
+		t.Fatalf("ramp %v after the control command", ramp)
+	}
+	if stored, err := p.storage.LoadRamp(ctx); err != nil || stored == nil || !stored.Deadline.Equal(deadline) {
+		t.Errorf("stored ramp: %v, %v", stored, err)
+	}
+
+	// a new client every 15 minutes up to the deadline, all renewing
+	leases := make(map[string]net.IP)
+	for i := 0; p.clock.Now().Before(deadline); i++ {
+		mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, byte(i + 1)}.String()
+		leases[mac] = lease(t, p, mac)
+		for mac, ip := range leases {
+			if typ := renewal(t, p, mac, ip); typ != dhcpv4.MessageTypeAck {
+				t.Fatalf("renewal of %s answered %s", mac, typ)
+			}
+			rec, err := p.storage.GetRecord(mac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Expires.After(deadline) {
+				t.Errorf("lease of %s granted during the ramp expires at %s, after the deadline %s", mac, rec.Expires, deadline)
+			}
+		}
+		advance(p, 15*time.Minute)
+	}
+
+	// the leases granted before the ramp outlive it, the others do not
+	p.sampleRamp(ctx)
+	prog := p.Stats().Ramp
+	if prog == nil || prog.Ending != len(leases) || prog.Outliving != 1 || !prog.LatestExpiry.Equal(before.Expires) {
+		t.Errorf("ramp progress %+v, want %d leases ending and the one granted before outliving", prog, len(leases))
+	}
+	if typ := renewal(t, p, "00:11:22:33:44:00", old); typ != dhcpv4.MessageTypeAck {
+		t.Fatalf("renewal of the lease granted before the ramp answered %s", typ)
+	}
+
+	// past the deadline, leases last the target
+	for mac, ip := range leases {
+		renewal(t, p, mac, ip)
+		rec, err := p.storage.GetRecord(mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := p.clock.Now().Add(10 * time.Minute); rec.Expires.Sub(want).Abs() > time.Second {
+			t.Errorf("lease of %s renewed after the deadline expires at %s, want %s", mac, rec.Expires, want)
+		}
+	}
+
+	// instances started during the ramp follow it
+	p.ramp.set(nil)
+	if err := p.loadRamp(ctx); err != nil || p.ramp.get() == nil {
+		t.Errorf("ramp not loaded: %v", err)
+	}
+
+	p.handleControl("lease-ramp cancel")
+	if p.ramp.get() != nil || p.Stats().Ramp != nil {
+		t.Error("ramp left after its cancellation")
+	}
+	if got := p.leaseTime(p.clock.Now(), 0, 0); got != 4*time.Hour {
+		t.Errorf("lease time %s after the ramp was cancelled, want the configured 4h", got)
+	}
+	if stored, err := p.storage.LoadRamp(ctx); err != nil || stored != nil {
+		t.Errorf("stored ramp after its cancellation: %v, %v", stored, err)
+	}
+}
@@ -0,0 +1,170 @@
+package rangeredisplugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+// parseRanges parses the ranges of a pool in the format <start>-<end>,...
+// The ranges are allocated from in that order and must not overlap.
+func parseRanges(val string) ([]ipRange, error) {
+	var ranges []ipRange
+	for _, entry := range strings.Split(val, ",") {
+		start, end, ok := strings.Cut(entry, "-")
+		r := ipRange{Start: net.ParseIP(start).To4(), End: net.ParseIP(end).To4()}
+		if !ok || r.Start == nil || r.End == nil {
+			return nil, fmt.Errorf("invalid range %q, want <start>-<end>", entry)
+		}
+		if bytes.Compare(r.Start, r.End) > 0 {
+			return nil, fmt.Errorf("start of range %q has to be lower than its end", entry)
+		}
+		ranges = append(ranges, r)
+	}
+	sorted := append([]ipRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i].Start, sorted[j].Start) < 0 })
+	for i := 1; i < len(sorted); i++ {
+		if bytes.Compare(sorted[i].Start, sorted[i-1].End) <= 0 {
+			return nil, fmt.Errorf("ranges %s-%s and %s-%s overlap", sorted[i-1].Start, sorted[i-1].End, sorted[i].Start, sorted[i].End)
+		}
+	}
+	return ranges, nil
+}
+
+const (
+	// default shortest prefix of a pool given as a CIDR, against a typo
+	// creating a huge allocator; and the longest one, leaving two
+	// addresses besides the network and broadcast addresses
+	defaultMinPrefixLength = 16
+	maxPrefixLength        = 30
+)
+
+// cidrRange returns the range of the addresses of subnet usable by the
+// clients: all but the network and the broadcast address, and the first
+// address too if gateway is set
+func cidrRange(subnet *net.IPNet, minPrefix int, gateway bool) (ipRange, error) {
+	ones, _ := subnet.Mask.Size()
+	if ones < minPrefix {
+		return ipRange{}, fmt.Errorf("subnet %s is larger than /%d, set min_prefix to allow it", subnet, minPrefix)
+	}
+	if ones > maxPrefixLength {
+		return ipRange{}, fmt.Errorf("subnet %s has no address to lease, want at most /%d", subnet, maxPrefixLength)
+	}
+	network := binary.BigEndian.Uint32(subnet.IP.To4())
+	broadcast := network | ^binary.BigEndian.Uint32(net.IP(subnet.Mask).To4())
+	first := network + 1
+	if gateway {
+		first++
+	}
+	r := ipRange{Start: make(net.IP, 4), End: make(net.IP, 4)}
+	binary.BigEndian.PutUint32(r.Start, first)
+	binary.BigEndian.PutUint32(r.End, broadcast-1)
+	return r, nil
+}
+
+// span returns the lowest and the highest address of ranges
+func span(ranges []ipRange) (net.IP, net.IP) {
+	start, end := ranges[0].Start, ranges[0].End
+	for _, r := range ranges[1:] {
+		if bytes.Compare(r.Start, start) < 0 {
+			start = r.Start
+		}
+		if bytes.Compare(r.End, end) > 0 {
+			end = r.End
+		}
+	}
+	return start, end
+}
+
+// allocationOrder returns the ranges in the order they are allocated from:
+// as configured, or the other way round for a pool allocating down
+func (c *Config) allocationOrder() []ipRange {
+	if c.Direction != DirectionDown {
+		return c.Ranges
+	}
+	order := make([]ipRange, len(c.Ranges))
+	for i, r := range c.Ranges {
+		order[len(order)-1-i] = r
+	}
+	return order
+}
+
+// inGap reports whether ip lies between the ranges, in none of them
+func (c *Config) inGap(ip net.IP) bool {
+	v4 := ip.To4()
+	return v4 != nil && !c.contains(v4) &&
+		bytes.Compare(v4, c.Start.To4()) >= 0 && bytes.Compare(v4, c.End.To4()) <= 0
+}
+
+// rangeAllocator hands out the addresses of several ranges with an
+// allocator per range. A hint is tried in its own range first; the ranges
+// are then tried in order, falling over to the next one when a range is
+// exhausted.
+type rangeAllocator struct {
+	ranges []ipRange
+	inner  []allocators.Allocator
+}
+
+// index returns the position of the range holding ip, or -1
+func (a *rangeAllocator) index(ip net.IP) int {
+	for i, r := range a.ranges {
+		if r.contains(ip) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (a *rangeAllocator) Allocate(hint net.IPNet) (net.IPNet, error) {
+	first := a.index(hint.IP)
+	if first >= 0 {
+		if n, err := a.inner[first].Allocate(hint); err == nil {
+			return n, nil
+		}
+	}
+	err := allocators.ErrNoAddrAvail
+	for i, inner := range a.inner {
+		if i == first {
+			continue
+		}
+		var n net.IPNet
+		if n, err = inner.Allocate(net.IPNet{}); err == nil {
+			return n, nil
+		}
+	}
+	return net.IPNet{}, err
+}
+
+func (a *rangeAllocator) Free(n net.IPNet) error {
+	i := a.index(n.IP)
+	if i < 0 {
+		return fmt.Errorf("%s is in none of the ranges", n.IP)
+	}
+	return a.inner[i].Free(n)
+}
+
+// rangeAddresses calls fn with the addresses of the ranges in allocation
+// order, from the top of each range for a pool allocating down, until fn
+// returns false
+func (c *Config) rangeAddresses(fn func(ip net.IP) bool) {
+	for _, r := range c.allocationOrder() {
+		start := binary.BigEndian.Uint32(r.Start.To4())
+		end := binary.BigEndian.Uint32(r.End.To4())
+		for i := uint32(0); i <= end-start; i++ {
+			n := start + i
+			if c.Direction == DirectionDown {
+				n = end - i
+			}
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, n)
+			if !fn(ip) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestParseRanges(t *testing.T) {
+	ranges, err := parseRanges("10.0.0.150-10.0.0.199,10.0.0.50-10.0.0.99,10.0.0.100-10.0.0.100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// in the configured order
+	if len(ranges) != 3 || !ranges[0].Start.Equal(net.IPv4(10, 0, 0, 150)) || !ranges[1].End.Equal(net.IPv4(10, 0, 0, 99)) {
+		t.Errorf("parsed %v", ranges)
+	}
+	for _, tc := range []struct {
+		val, want string
+	}{
+		{"10.0.0.50", "want <start>-<end>"},
+		{"10.0.0.50-", "want <start>-<end>"},
+		{"10.0.0.50-10.0.0.99,", "want <start>-<end>"},
+		{"10.0.0.50-2001:db8::1", "want <start>-<end>"},
+		{"10.0.0.99-10.0.0.50", "has to be lower than its end"},
+		{"10.0.0.50-10.0.0.99,10.0.0.99-10.0.0.120", "overlap"},
+		{"10.0.0.150-10.0.0.199,10.0.0.50-10.0.0.160", "overlap"},
+	} {
+		if _, err := parseRanges(tc.val); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: %v, want %q", tc.val, err, tc.want)
+		}
+	}
+}
+
+func TestRanges(t *testing.T) {
+	m := miniredis.RunT(t)
+	// the ranges are allocated from in the configured order
+	p := startPlugin(t, m, "10.0.75.150-10.0.75.151,10.0.75.50-10.0.75.51", "1h")
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, lease(t, p, fmt.Sprintf("00:11:22:33:44:%02x", i)).String())
+	}
+	if want := "[10.0.75.150 10.0.75.151 10.0.75.50 10.0.75.51]"; fmt.Sprint(got) != want {
+		t.Errorf("leased %v, want %s", got, want)
+	}
+	if _, err := p.allocate("00:11:22:33:44:ff"); err == nil {
+		t.Error("allocation from exhausted ranges")
+	}
+
+	// an expiry returns the address to its range
+	expire(t, m, p, "00:11:22:33:44:02")
+	eventually(t, "the expiry", func() bool { return p.leases.macOf(net.IPv4(10, 0, 75, 50)) == "" })
+	// its record outlives it by 10 seconds
+	m.Del(p.storage.ns.main + "00:11:22:33:44:02")
+	m.Del(p.storage.ns.index + "10.0.75.50")
+	if ip := lease(t, p, "00:11:22:33:44:10"); !ip.Equal(net.IPv4(10, 0, 75, 50)) {
+		t.Errorf("leased %s after the expiry, want 10.0.75.50", ip)
+	}
+}
+
+func TestRangesReload(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.76.50-10.0.76.51,10.0.76.150-10.0.76.151", "1h")
+	leases := map[string]string{
+		"00:11:22:33:44:0a": "10.0.76.51",
+		"00:11:22:33:44:0b": "10.0.76.150",
+		// between the ranges, e.g. of a range dropped since
+		"00:11:22:33:44:0c": "10.0.76.100",
+	}
+	for mac, ip := range leases {
+		if err := p.storage.SaveRecord(mac, boundRecord(ip, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the leases are loaded into the range holding them, the others skipped
+	logs := captureLog(t)
+	restarted := startPlugin(t, m, "10.0.76.50-10.0.76.51,10.0.76.150-10.0.76.151", "1h")
+	for mac, ip := range leases {
+		held := restarted.leases.ipOf(mac)
+		if inGap := ip == "10.0.76.100"; inGap != (held == nil) || (held != nil && held.String() != ip) {
+			t.Errorf("lease of %s for %s loaded as %v", ip, mac, held)
+		}
+	}
+	if !logs.logged("lease of 10.0.76.100 for MAC 00:11:22:33:44:0c is in none of the ranges") {
+		t.Error("skipped lease not logged")
+	}
+	var got []string
+	for i := 0; i < 2; i++ {
+		got = append(got, lease(t, restarted, fmt.Sprintf("00:11:22:33:55:%02x", i)).String())
+	}
+	if want := "[10.0.76.50 10.0.76.151]"; fmt.Sprint(got) != want {
+		t.Errorf("leased %v, want %s", got, want)
+	}
+}
+
+func TestCIDRRange(t *testing.T) {
+	for _, tc := range []struct {
+		args       []string
+		start, end string
+	}{
+		{[]string{"10.0.78.0/24"}, "10.0.78.1", "10.0.78.254"},
+		// the host bits of the subnet are dropped
+		{[]string{"10.0.78.77/24"}, "10.0.78.1", "10.0.78.254"},
+		{[]string{"10.0.78.0/24", "gateway_first=true"}, "10.0.78.2", "10.0.78.254"},
+		{[]string{"10.0.78.0/30"}, "10.0.78.1", "10.0.78.2"},
+		{[]string{"10.0.78.0/30", "gateway_first=true"}, "10.0.78.2", "10.0.78.2"},
+		{[]string{"10.8.0.0/16"}, "10.8.0.1", "10.8.255.254"},
+		{[]string{"10.8.0.0/15", "min_prefix=15"}, "10.8.0.1", "10.9.255.254"},
+	} {
+		c, err := parseConfig(append([]string{"redis://localhost/0", tc.args[0], "1h"}, tc.args[1:]...))
+		if err != nil {
+			t.Errorf("%v: %v", tc.args, err)
+			continue
+		}
+		if len(c.Ranges) != 1 || c.Start.String() != tc.start || c.End.String() != tc.end {
+			t.Errorf("%v: ranges %v, want %s-%s", tc.args, c.Ranges, tc.start, tc.end)
+		}
+		if !c.subnet().IP.Equal(c.CIDR.IP) || c.subnet().String() != c.CIDR.String() {
+			t.Errorf("%v: pool subnet %s, want %s", tc.args, c.subnet(), c.CIDR)
+		}
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"10.8.0.0/15", "1h"}, "larger than /16, set min_prefix"},
+		{[]string{"10.0.78.0/24", "1h", "min_prefix=25"}, "larger than /25"},
+		{[]string{"10.0.78.0/31", "1h"}, "has no address to lease"},
+		{[]string{"10.0.78.0/32", "1h"}, "has no address to lease"},
+		{[]string{"10.0.78.0/24", "1h", "min_prefix=31"}, "want a prefix length up to 30"},
+		{[]string{"10.0.78.0/33", "1h"}, "invalid IPv4 subnet"},
+		{[]string{"2001:db8::/64", "1h"}, "invalid IPv4 subnet"},
+		// both forms
+		{[]string{"10.0.78.0/24", "10.0.78.200", "1h"}, "either as a CIDR or as IP ranges"},
+		{[]string{"10.0.78.0/24,10.0.79.10-10.0.79.20", "1h"}, "either as a CIDR or as IP ranges"},
+		{[]string{"10.0.78.10", "10.0.78.0/24", "1h"}, "either as a CIDR or as IP ranges"},
+		{[]string{"10.0.78.10", "10.0.78.20", "1h", "gateway_first=true"}, "gateway_first requires the range as a CIDR"},
+		{[]string{"10.0.78.0/24", "1h", "router=10.0.79.1"}, "outside of the pool subnet"},
+	} {
+		if _, err := parseConfig(append([]string{"redis://localhost/0"}, tc.args...)); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%v: %v, want %q", tc.args, err, tc.want)
+		}
+	}
+}
+
+func TestCIDRPool(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.78.0/29", "1h", "gateway_first=true", "router=10.0.78.1")
+	// the network, gateway and broadcast addresses are never leased
+	var got []string
+	for i := 0; i < 5; i++ {
+		got = append(got, lease(t, p, fmt.Sprintf("00:11:22:33:44:%02x", i)).String())
+	}
+	if want := "[10.0.78.2 10.0.78.3 10.0.78.4 10.0.78.5 10.0.78.6]"; fmt.Sprint(got) != want {
+		t.Errorf("leased %v, want %s", got, want)
+	}
+	if _, err := p.allocate("00:11:22:33:44:ff"); err == nil {
+		t.Error("allocation from an exhausted subnet")
+	}
+}
@@ -0,0 +1,87 @@
+package rangeredisplugin
+
+import (
+	"fmt"
+	"net"
+)
+
+// reconcileExternalChange detects a record whose IP differs from the one we
+// know the MAC holds, which means something else rewrote our keyspace. A valid
+// new IP is adopted: the old allocator entry is freed and the new one claimed.
+// Otherwise our own state wins and the record is pointed back at it. Returns
+// true if the record was modified and has to be persisted.
+func (p *PluginState) reconcileExternalChange(mac string, record *Record) bool {
+	held := p.leases.ipOf(mac)
+	if held == nil || held.Equal(record.IP) {
+		return false
+	}
+
+	p.counters.externalReassignments.Add(1)
+	ev := Event{
+		Type:       EventExternalReassignment,
+		MAC:        mac,
+		IP:         record.IP,
+		PreviousIP: held,
+	}
+
+	if err := p.claim(mac, record.IP); err != nil {
+		log.Warnf("record of MAC %s was rewritten externally from %s to %s, keeping %s: %v",
+			mac, held, record.IP, held, err)
+		ev.IP = held
+		ev.Detail = fmt.Sprintf("rejected %s: %v", record.IP, err)
+		p.emit(ev)
+		record.IP = held
+		return true
+	}
+
+	if p.withheld(held) {
+		p.keepForSplit(held)
+	} else if err := p.allocator.Free(net.IPNet{IP: held, Mask: net.IPv4Mask(255, 255, 255, 255)}); err != nil {
+		log.Errorf("error when release ip %v, err: %v", held, err)
+	}
+	if err := p.storage.releaseIndex(mac, held); err != nil {
+		log.Warnf("could not release index entry of %s for %s: %v", held, mac, err)
+	}
+	if err := p.storage.refreshIndex(mac, record); err != nil {
+		log.Warnf("could not refresh index entry of %s for %s: %v", record.IP, mac, err)
+	}
+	p.leases.set(mac, record.IP)
+	log.Warnf("record of MAC %s was rewritten externally from %s to %s, adopted", mac, held, record.IP)
+	p.emit(ev)
+	return false
+}
+
+// claimable fails if ip cannot be claimed for mac because it is outside of
+// the range, excluded or leased to another client
+func (p *PluginState) claimable(mac string, ip net.IP) error {
+	if !p.inRange(ip) {
+		return fmt.Errorf("%w: %s", ErrOutOfRange, ip)
+	}
+	if p.cfg.excluded(ip) {
+		return fmt.Errorf("%w: %s", ErrExcluded, ip)
+	}
+	if p.frozen.has(ip) {
+		return fmt.Errorf("%w: %s", ErrFrozen, ip)
+	}
+	if owner := p.leases.macOf(ip); owner != "" && owner != mac {
+		return fmt.Errorf("%s is leased to %s", ip, owner)
+	}
+	return nil
+}
+
+// claim marks ip as allocated, failing if it is outside of the range or
+// already taken.
+func (p *PluginState) claim(mac string, ip net.IP) error {
+	if err := p.claimable(mac, ip); err != nil {
+		return err
+	}
+	// an address in cooldown is already allocated: take it over
+	if p.cooldown.remove(ip) {
+		if err := p.storage.RemoveCooldown(ip); err != nil {
+			log.Warnf("could not clear the cooldown of %s: %v", ip, err)
+		}
+		return nil
+	}
+	_, err := allocateExact(p.allocator, net.IPNet{IP: ip})
+	return err
+}
@@ -0,0 +1,131 @@
+package rangeredisplugin
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// rewrite points the record of mac at ip the way another tool writing to
+// the keyspace does, leaving the index alone
+func rewrite(t *testing.T, p *PluginState, mac string, ip net.IP) {
+	t.Helper()
+	rec, err := p.storage.GetRecord(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.IP = ip.To4()
+	if err := p.storage.saveRecord(p.storage.rdb, mac, rec); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// renew has mac renew the lease it holds, whatever its address, and returns
+// the address offered
+func renew(t *testing.T, p *PluginState, mac string) net.IP {
+	t.Helper()
+	offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac))
+	if offer == nil {
+		t.Fatalf("no offer to %s", mac)
+	}
+	return offer.YourIPAddr
+}
+
+func TestExternalReassignmentAdopted(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.2.0.10", "10.2.0.20", "1h")
+	events := recordEvents(p)
+	const mac = "00:11:22:33:44:55"
+	held := lease(t, p, mac)
+	moved := net.IPv4(10, 2, 0, 15).To4()
+	rewrite(t, p, mac, moved)
+
+	if ip := renew(t, p, mac); !ip.Equal(moved) {
+		t.Fatalf("renewal offered %s, want the address rewritten %s", ip, moved)
+	}
+	if ip := p.leases.ipOf(mac); !ip.Equal(moved) {
+		t.Errorf("lease table holds %s, want %s", ip, moved)
+	}
+	if owner, err := p.storage.LookupByIP(moved); err != nil || owner != mac {
+		t.Errorf("index of %s = %q, %v, want %s", moved, owner, err, mac)
+	}
+	if owner, _ := p.storage.LookupByIP(held); owner != "" {
+		t.Errorf("index of %s still names %s", held, owner)
+	}
+	// the address held before went back to the pool, the new one left it
+	if _, err := allocateExact(p.allocator, net.IPNet{IP: held}); err != nil {
+		t.Errorf("%s not freed: %v", held, err)
+	}
+	if _, err := allocateExact(p.allocator, net.IPNet{IP: moved}); err == nil {
+		t.Errorf("%s not claimed", moved)
+	}
+
+	if n := p.Stats().ExternalReassignments; n != 1 {
+		t.Errorf("%d external reassignments counted, want 1", n)
+	}
+	eventually(t, "the external-reassignment event", func() bool {
+		return len(events.of(EventExternalReassignment)) == 1
+	})
+	ev := events.of(EventExternalReassignment)[0]
+	if ev.MAC != mac || !ev.IP.Equal(moved) || !ev.PreviousIP.Equal(held) || ev.Detail != "" {
+		t.Errorf("event %+v, want %s moved from %s to %s", ev, mac, held, moved)
+	}
+
+	// the next renewal is an ordinary one
+	renew(t, p, mac)
+	if n := p.Stats().ExternalReassignments; n != 1 {
+		t.Errorf("%d external reassignments counted after a renewal, want 1", n)
+	}
+}
+
+func TestExternalReassignmentRejected(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ip   net.IP
+	}{
+		{"conflicting", nil},
+		{"out of range", net.IPv4(10, 9, 9, 9).To4()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := miniredis.RunT(t)
+			p := startPlugin(t, m, "10.2.1.10", "10.2.1.20", "1h")
+			events := recordEvents(p)
+			const mac, other = "00:11:22:33:44:55", "00:11:22:33:44:66"
+			held := lease(t, p, mac)
+			taken := lease(t, p, other)
+			target := tc.ip
+			if target == nil {
+				target = taken
+			}
+			rewrite(t, p, mac, target)
+
+			if ip := renew(t, p, mac); !ip.Equal(held) {
+				t.Fatalf("renewal offered %s, want %s kept", ip, held)
+			}
+			rec, err := p.storage.GetRecord(mac)
+			if err != nil || !rec.IP.Equal(held) {
+				t.Errorf("record of %s = %v, %v, want it pointed back at %s", mac, rec, err, held)
+			}
+			if ip := p.leases.ipOf(other); !ip.Equal(taken) {
+				t.Errorf("%s holds %s, want %s", other, ip, taken)
+			}
+			if owner, err := p.storage.LookupByIP(taken); err != nil || owner != other {
+				t.Errorf("index of %s = %q, %v, want %s", taken, owner, err, other)
+			}
+
+			if n := p.Stats().ExternalReassignments; n != 1 {
+				t.Errorf("%d external reassignments counted, want 1", n)
+			}
+			eventually(t, "the external-reassignment event", func() bool {
+				return len(events.of(EventExternalReassignment)) == 1
+			})
+			ev := events.of(EventExternalReassignment)[0]
+			if !ev.IP.Equal(held) || !ev.PreviousIP.Equal(held) || !strings.HasPrefix(ev.Detail, "rejected "+target.String()) {
+				t.Errorf("event %+v, want %s kept, %s rejected", ev, held, target)
+			}
+		})
+	}
+}
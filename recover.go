@@ -0,0 +1,142 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+// default number of MAC addresses read from the history by a recovery
+const defaultRecoverLimit = 10000
+
+// preferredIPs holds the address each MAC should preferably get back on its
+// next allocation
+type preferredIPs struct {
+	mu sync.Mutex
+	m  map[string]net.IP
+	// owner maps the preferred addresses back to their MAC
+	owner map[string]string
+}
+
+// take returns and forgets the preferred IP of mac
+func (h *preferredIPs) take(mac string) net.IP {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ip := h.m[mac]
+	delete(h.m, mac)
+	if ip != nil {
+		delete(h.owner, ip.String())
+	}
+	return ip
+}
+
+// otherThan reports whether ip is the preferred IP of a MAC other than mac
+func (h *preferredIPs) otherThan(mac string, ip net.IP) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	owner, ok := h.owner[ip.String()]
+	return ok && owner != mac
+}
+
+// peek returns the preferred IP of mac
+func (h *preferredIPs) peek(mac string) net.IP {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.m[mac]
+}
+
+func (h *preferredIPs) len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.m)
+}
+
+func (h *preferredIPs) set(m map[string]net.IP) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.m = m
+	h.owner = make(map[string]string, len(m))
+	for mac, ip := range m {
+		h.owner[ip.String()] = mac
+	}
+}
+
+// RecoverFromHistory seeds preferred-IP hints from the most recent binding of
+// each MAC address in the history, so that clients re-discovering after the
+// lease keyspace was lost get their old address back when it is still free.
+// Active bindings are never overridden. Returns the number of hints seeded.
+func (p *PluginState) RecoverFromHistory(ctx context.Context) (int, error) {
+	bindings, err := p.storage.LatestBindings(ctx, p.cfg.RecoverLimit)
+	if err != nil {
+		return 0, err
+	}
+
+	hints := make(map[string]net.IP, len(bindings))
+	for mac, ip := range bindings {
+		if p.leases.ipOf(mac) != nil || !p.inRange(ip) {
+			continue
+		}
+		hints[mac] = ip.To4()
+	}
+	p.preferred.set(hints)
+
+	log.Infof("recovery: seeded %d preferred addresses from the history", len(hints))
+	return len(hints), nil
+}
+
+// allocate picks a new address for mac, preferring the one it held before
+// a recovery if that address is still free. The addresses other clients
+// prefer are only handed out once the pool has nothing else.
+func (p *PluginState) allocate(mac string) (net.IP, error) {
+	if ip := p.preferred.take(mac); ip != nil {
+		if err := p.claim(mac, ip); err == nil {
+			log.Infof("recovery: MAC %s got its previous address %s back", mac, ip)
+			return ip, nil
+		}
+	}
+
+	p.releaseCooldown()
+	ip, err := p.allocateUnpreferred(mac)
+	if err != nil {
+		if errors.Is(err, allocators.ErrNoAddrAvail) {
+			if ip := p.takeCooldown(); ip != nil {
+				log.Warnf("pool exhausted, reusing %s before the end of its cooldown", ip)
+				return ip, nil
+			}
+			return nil, fmt.Errorf("%w: %w", ErrPoolExhausted, err)
+		}
+		return nil, err
+	}
+	return ip.IP.To4(), nil
+}
+
+// allocateUnpreferred allocates any address but those other clients than
+// mac prefer, falling back to one of those when the pool is exhausted
+func (p *PluginState) allocateUnpreferred(mac string) (net.IPNet, error) {
+	var skipped []net.IPNet
+	defer func() {
+		for _, ip := range skipped {
+			if err := p.allocator.Free(ip); err != nil {
+				log.Errorf("could not free %s, preferred by another client: %v", ip.IP, err)
+			}
+		}
+	}()
+	for {
+		ip, err := allocatePreferred(p.allocator, net.IPNet{})
+		if err != nil {
+			if len(skipped) > 0 && errors.Is(err, allocators.ErrNoAddrAvail) {
+				ip, skipped = skipped[0], skipped[1:]
+				return ip, nil
+			}
+			return ip, err
+		}
+		if !p.preferred.otherThan(mac, ip.IP) {
+			return ip, nil
+		}
+		skipped = append(skipped, ip)
+	}
+}
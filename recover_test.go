@@ -0,0 +1,119 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// offered returns the address offered to a DISCOVER of mac
+func offered(t *testing.T, p *PluginState, mac string) net.IP {
+	t.Helper()
+	offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac))
+	if offer == nil {
+		t.Fatalf("no offer to %s", mac)
+	}
+	return offer.YourIPAddr
+}
+
+// flushed leases the addresses of the pool 10.7.0.10-10.7.0.20 to macs in
+// order, with the history kept in another redis, then flushes the leases
+// and returns the history
+func flushed(t *testing.T, m *miniredis.Miniredis, macs ...string) *miniredis.Miniredis {
+	t.Helper()
+	h := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.7.0.10", "10.7.0.20", "1h", "history_uri="+redisURI(h))
+	for _, mac := range macs {
+		lease(t, p, mac)
+	}
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	m.FlushAll()
+	return h
+}
+
+func TestRecoverAfterFlush(t *testing.T) {
+	m := miniredis.RunT(t)
+	const a, b, c, other = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c", "00:11:22:33:44:0d"
+	h := flushed(t, m, a, b, c)
+
+	p := startPlugin(t, m, "10.7.0.10", "10.7.0.20", "1h", "history_uri="+redisURI(h), "recover=history")
+	if n := p.preferred.len(); n != 3 {
+		t.Fatalf("%d preferred addresses seeded, want 3", n)
+	}
+	// in another order than before, and after a client never seen
+	hw, _ := net.ParseMAC(other)
+	if ev, err := p.Evaluate(context.Background(), EvaluationRequest{MAC: hw}); err != nil || !ev.IP.Equal(net.IPv4(10, 7, 0, 13)) {
+		t.Errorf("Evaluate for a new client: %v, %v, want 10.7.0.13", ev, err)
+	}
+	if ip := offered(t, p, other); !ip.Equal(net.IPv4(10, 7, 0, 13)) {
+		t.Errorf("new client offered %s, want 10.7.0.13 the others do not prefer", ip)
+	}
+	for mac, want := range map[string]net.IP{
+		c: net.IPv4(10, 7, 0, 12),
+		a: net.IPv4(10, 7, 0, 10),
+		b: net.IPv4(10, 7, 0, 11),
+	} {
+		if ip := offered(t, p, mac); !ip.Equal(want) {
+			t.Errorf("%s offered %s after the recovery, want %s back", mac, ip, want)
+		}
+	}
+}
+
+func TestRecoveryKeepsActiveBindings(t *testing.T) {
+	m := miniredis.RunT(t)
+	const a, b, newcomer = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0e"
+	h := flushed(t, m, a, b)
+
+	// the recovery is invoked once a new client took the address of a
+	p := startPlugin(t, m, "10.7.0.10", "10.7.0.20", "1h", "history_uri="+redisURI(h))
+	if ip := lease(t, p, newcomer); !ip.Equal(net.IPv4(10, 7, 0, 10)) {
+		t.Fatalf("newcomer leased %s", ip)
+	}
+	p.handleControl("recover-history")
+
+	if ip := offered(t, p, a); ip.Equal(net.IPv4(10, 7, 0, 10)) {
+		t.Errorf("%s given the address of an active binding", a)
+	}
+	if ip := offered(t, p, b); !ip.Equal(net.IPv4(10, 7, 0, 11)) {
+		t.Errorf("%s offered %s, want 10.7.0.11 back", b, ip)
+	}
+	if ip := p.leases.ipOf(newcomer); !ip.Equal(net.IPv4(10, 7, 0, 10)) {
+		t.Errorf("newcomer holds %s, want 10.7.0.10", ip)
+	}
+	// the active binding is not overridden either
+	if ip := p.preferred.peek(newcomer); ip != nil {
+		t.Errorf("preferred address %s seeded for an active binding", ip)
+	}
+}
+
+func TestRecoveryLimit(t *testing.T) {
+	m := miniredis.RunT(t)
+	h := flushed(t, m, "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c")
+
+	p := startPlugin(t, m, "10.7.0.10", "10.7.0.20", "1h", "history_uri="+redisURI(h),
+		"recover=history", "recover_limit=2")
+	if n := p.preferred.len(); n != 2 {
+		t.Errorf("%d preferred addresses seeded, want 2", n)
+	}
+}
+
+func TestPreferredAddressesHandedOutWhenExhausted(t *testing.T) {
+	m := miniredis.RunT(t)
+	var macs []string
+	for i := 0; i < 11; i++ {
+		macs = append(macs, fmt.Sprintf("00:11:22:33:44:%02x", i))
+	}
+	h := flushed(t, m, macs...)
+
+	// every address is preferred by a client
+	p := startPlugin(t, m, "10.7.0.10", "10.7.0.20", "1h", "history_uri="+redisURI(h), "recover=history")
+	if ip := offered(t, p, "00:11:22:33:44:ff"); !ip.Equal(net.IPv4(10, 7, 0, 10)) {
+		t.Errorf("new client offered %s, want 10.7.0.10", ip)
+	}
+}
@@ -0,0 +1,190 @@
+package rangeredisplugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// REDIS_REGISTRY_KEY_PREFIX prefixes the registrations of the live
+// instances, keyed by instance ID. They expire unless refreshed, so the
+// registrations of dead instances age out.
+const REDIS_REGISTRY_KEY_PREFIX = "r:dhcp:instance:"
+
+const (
+	// lifetime of a registration without heartbeat
+	registrationTTL = 30 * time.Second
+	// interval between two heartbeats
+	heartbeatInterval = 10 * time.Second
+)
+
+// Policies applied when the range of an instance overlaps the range of
+// another live instance
+const (
+	OverlapRefuse = "refuse"
+	OverlapWarn   = "warn"
+)
+
+// ErrPoolOverlap means the range overlaps the range of another live instance
+var ErrPoolOverlap = errors.New("range overlaps the range of another instance")
+
+// Registration describes a live instance
+type Registration struct {
+	ID      string
+	Host    string
+	Start   net.IP
+	End     net.IP
+	Started time.Time
+	// Leases and Size are the leases and the addresses of the pool, summed
+	// over the instances by the pressure bands
+	Leases int `json:",omitempty"`
+	Size   int `json:",omitempty"`
+}
+
+func (r Registration) overlaps(o Registration) bool {
+	return bytes.Compare(r.Start.To4(), o.End.To4()) <= 0 && bytes.Compare(o.Start.To4(), r.End.To4()) <= 0
+}
+
+// splits reports whether r is the source of split s
+func (r Registration) splits(s *PoolSplit) bool {
+	own := ipRange{Start: r.Start.To4(), End: r.End.To4()}
+	return own.contains(s.Start) && own.contains(s.End)
+}
+
+// newInstanceID returns an ID naming an instance across the servers
+func newInstanceID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// Register writes or refreshes the registration of an instance
+func (r *RedisProvider) Register(ctx context.Context, reg Registration) error {
+	val, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+	return unavailable(r.rdb.Set(ctx, REDIS_REGISTRY_KEY_PREFIX+reg.ID, val, registrationTTL).Err())
+}
+
+// Unregister deletes the registration of an instance
+func (r *RedisProvider) Unregister(ctx context.Context, id string) error {
+	return unavailable(r.rdb.Del(ctx, REDIS_REGISTRY_KEY_PREFIX+id).Err())
+}
+
+// Registrations returns the registrations of the live instances
+func (r *RedisProvider) Registrations(ctx context.Context) ([]Registration, error) {
+	var regs []Registration
+	err := r.scanValues(ctx, REDIS_REGISTRY_KEY_PREFIX, func(id, val string) {
+		var reg Registration
+		if err := json.Unmarshal([]byte(val), &reg); err != nil {
+			log.Warnf("ignoring corrupt registration of instance %s: %v", id, err)
+			return
+		}
+		regs = append(regs, reg)
+	})
+	return regs, err
+}
+
+// register checks the range of the instance against the live instances
+// and registers it. An overlap fails unless the overlap policy is to warn.
+// The registration of predecessor, the instance handing over to us if any,
+// is not an overlap. Overlapping registrations of this host are waited out
+// once, as they are usually left by the process we replace after a crash.
+func (p *PluginState) register(ctx context.Context, predecessor string) error {
+	reg := Registration{
+		ID:      p.id,
+		Start:   p.cfg.Start,
+		End:     p.cfg.End,
+		Started: time.Now(),
+		Size:    p.cfg.size(),
+	}
+	reg.Host, _ = os.Hostname()
+
+	overlaps, err := p.overlapping(ctx, reg, predecessor)
+	if err != nil {
+		return err
+	}
+	local := len(overlaps) > 0
+	for _, o := range overlaps {
+		local = local && o.Host == reg.Host
+	}
+	if local {
+		log.Warnf("range registered by %s on this host, waiting for the registration to age out", overlaps[0].ID)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(registrationTTL):
+		}
+		if overlaps, err = p.overlapping(ctx, reg, predecessor); err != nil {
+			return err
+		}
+	}
+	for _, o := range overlaps {
+		err := fmt.Errorf("%w: %s-%s of %s on %s", ErrPoolOverlap, o.Start, o.End, o.ID, o.Host)
+		if p.cfg.OverlapPolicy != OverlapWarn {
+			return err
+		}
+		log.Errorf("addresses may be leased twice: %v", err)
+	}
+
+	p.registration = reg
+	return p.storage.Register(ctx, reg)
+}
+
+// overlapping returns the registrations of the other live instances whose
+// range overlaps reg
+func (p *PluginState) overlapping(ctx context.Context, reg Registration, predecessor string) ([]Registration, error) {
+	others, err := p.storage.Registrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var overlaps []Registration
+	split, role := p.split.get()
+	for _, o := range others {
+		if role == SplitTarget && split.names(reg) && o.splits(split) {
+			// the source of the split we are the target of
+			continue
+		}
+		if o.ID != reg.ID && o.ID != predecessor && reg.overlaps(o) {
+			overlaps = append(overlaps, o)
+		}
+	}
+	return overlaps, nil
+}
+
+// heartbeat refreshes the registration of the instance until it closes,
+// and samples the utilization of all the pools if there are pressure bands
+func (p *PluginState) heartbeat() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.registration.Leases = p.leases.len()
+			if err := p.storage.Register(context.TODO(), p.registration); err != nil {
+				log.Warnf("could not refresh the registration of the instance: %v", err)
+			}
+			if err := p.syncLeaseLimit(context.TODO()); err != nil {
+				log.Warnf("could not sync the lease limit: %v", err)
+			}
+			p.heartbeatSplit(context.TODO())
+			if len(p.cfg.PressureBands) == 0 {
+				continue
+			}
+			if err := p.samplePressure(context.TODO()); err != nil {
+				log.Warnf("could not sample the utilization of the pools: %v", err)
+			}
+		case <-p.closing:
+			return
+		}
+	}
+}
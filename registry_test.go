@@ -0,0 +1,94 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRegistrationOverlaps(t *testing.T) {
+	reg := func(start, end string) Registration {
+		return Registration{Start: net.ParseIP(start), End: net.ParseIP(end)}
+	}
+	a := reg("10.0.28.10", "10.0.28.20")
+	for _, tc := range []struct {
+		other Registration
+		want  bool
+	}{
+		{reg("10.0.28.15", "10.0.28.25"), true},
+		{reg("10.0.28.0", "10.0.28.10"), true},
+		{reg("10.0.28.12", "10.0.28.13"), true},
+		{reg("10.0.28.0", "10.0.28.255"), true},
+		{reg("10.0.28.21", "10.0.28.30"), false},
+		{reg("10.0.27.10", "10.0.27.20"), false},
+	} {
+		if got := a.overlaps(tc.other); got != tc.want {
+			t.Errorf("%s-%s overlaps %s-%s: %v, want %v", a.Start, a.End, tc.other.Start, tc.other.End, got, tc.want)
+		}
+		if got := tc.other.overlaps(a); got != tc.want {
+			t.Errorf("%s-%s overlaps %s-%s: %v, want %v", tc.other.Start, tc.other.End, a.Start, a.End, got, tc.want)
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	m := miniredis.RunT(t)
+	ctx := context.Background()
+
+	// disjoint ranges both start
+	p := startPlugin(t, m, "10.0.28.10", "10.0.28.20", "1h")
+	q := startPlugin(t, m, "10.0.28.21", "10.0.28.30", "1h")
+	for _, i := range []*PluginState{p, q} {
+		key := REDIS_REGISTRY_KEY_PREFIX + i.id
+		val, err := m.Get(key)
+		if err != nil {
+			t.Fatalf("registration of %s: %v", i.id, err)
+		}
+		var reg Registration
+		if err := json.Unmarshal([]byte(val), &reg); err != nil || !reg.Start.Equal(i.cfg.Start) || !reg.End.Equal(i.cfg.End) {
+			t.Errorf("registration of %s: %s, %v", i.id, val, err)
+		}
+		assertTTL(t, m, key, registrationTTL)
+	}
+
+	// a live instance on another host serves another range
+	other := Registration{ID: "elsewhere-1", Host: "elsewhere", Start: net.IPv4(10, 0, 29, 10), End: net.IPv4(10, 0, 29, 20), Started: time.Now()}
+	if err := p.storage.Register(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	before := len(Instances())
+	_, err := setup4(redisURI(m), "10.0.29.15", "10.0.29.25", "1h")
+	if !errors.Is(err, ErrPoolOverlap) {
+		t.Errorf("overlapping setup: %v, want ErrPoolOverlap", err)
+	}
+	if len(Instances()) != before {
+		t.Error("overlapping instance started")
+	}
+	if regs, err := p.storage.Registrations(ctx); err != nil || len(regs) != 3 {
+		t.Errorf("%d registrations after a refused setup, want 3: %v", len(regs), err)
+	}
+
+	// the overlap is only logged with overlap_policy=warn
+	r := startPlugin(t, m, "10.0.29.5", "10.0.29.10", "1h", "overlap_policy=warn")
+	if !m.Exists(REDIS_REGISTRY_KEY_PREFIX + r.id) {
+		t.Error("instance with an overlap to warn about not registered")
+	}
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if m.Exists(REDIS_REGISTRY_KEY_PREFIX + r.id) {
+		t.Error("registration left by a closed instance")
+	}
+
+	// the registration of a dead instance ages out
+	m.FastForward(registrationTTL)
+	if m.Exists(REDIS_REGISTRY_KEY_PREFIX + other.ID) {
+		t.Fatal("registration without heartbeat still live")
+	}
+	startPlugin(t, m, "10.0.29.15", "10.0.29.25", "1h")
+}
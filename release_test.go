@@ -0,0 +1,42 @@
+package rangeredisplugin
+
+import (
+	"net"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestRelease(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.35.10", "10.0.35.11", "1h")
+	const a, b, c = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c"
+	ipA, ipB := lease(t, p, a), lease(t, p, b)
+
+	// the release of another address is ignored
+	if resp := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRelease, a, dhcpv4.WithClientIP(ipB))); resp != nil {
+		t.Errorf("release answered %v", resp)
+	}
+	if holder := p.leases.macOf(ipB); holder != b {
+		t.Errorf("%s held by %q after another client released it", ipB, holder)
+	}
+	if _, err := p.storage.GetRecord(a); err != nil {
+		t.Errorf("record of %s after a mismatched release: %v", a, err)
+	}
+	// a release without a lease is ignored
+	releaseLease(t, p, c, net.IPv4(10, 0, 35, 12))
+
+	// the address is free right away
+	if resp := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRelease, a, dhcpv4.WithClientIP(ipA))); resp != nil {
+		t.Errorf("release answered %v", resp)
+	}
+	for _, key := range []string{keyPrefix(p, "main") + a, keyPrefix(p, "shadow") + a, keyPrefix(p, "index") + ipA.String()} {
+		if m.Exists(key) {
+			t.Errorf("key %s left after the release", key)
+		}
+	}
+	if got := lease(t, p, c); !got.Equal(ipA) {
+		t.Errorf("leased %s after the release, want %s", got, ipA)
+	}
+}
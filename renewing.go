@@ -0,0 +1,96 @@
+package rangeredisplugin
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// minimum time between two NAKs sent to the same client for an address it
+// has no record of
+const nakInterval = 30 * time.Second
+
+// requestedIP returns the address a client asks for: the requested IP
+// option or ciaddr of a REQUEST, or nil
+func requestedIP(req *dhcpv4.DHCPv4) net.IP {
+	if req.MessageType() != dhcpv4.MessageTypeRequest {
+		return nil
+	}
+	if ip := req.RequestedIPAddress(); ip != nil && !ip.IsUnspecified() {
+		return ip.To4()
+	}
+	if ip := req.ClientIPAddr; ip != nil && !ip.IsUnspecified() {
+		return ip.To4()
+	}
+	return nil
+}
+
+// selectsOther reports whether req is the REQUEST of a client in SELECTING
+// state that chose the offer of another server: it names a server other
+// than server, the identifier of this one, and must stay unanswered (RFC
+// 2131, section 4.3.2). The identifier is set by the server_id plugin, and
+// unknown, nil, if it does not run before this one.
+func selectsOther(req *dhcpv4.DHCPv4, server net.IP) bool {
+	if req.MessageType() != dhcpv4.MessageTypeRequest || server == nil {
+		return false
+	}
+	id := req.ServerIdentifier()
+	return id != nil && !id.Equal(server)
+}
+
+// confirmsOffer reports whether req takes up the offer of record: it
+// requests the address offered, from this server if its identifier is
+// known. Any other REQUEST would have the offer granted to a client that
+// never accepted it.
+func confirmsOffer(req *dhcpv4.DHCPv4, record *Record, server net.IP) bool {
+	if want := requestedIP(req); want == nil || !want.Equal(record.IP) {
+		return false
+	}
+	return server == nil || server.Equal(req.ServerIdentifier())
+}
+
+// nakLimiter limits the NAKs sent to each client
+type nakLimiter struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+	// order is the order the entries were set in, oldest first
+	order arrivals[string]
+	// limit bounds the number of clients remembered, 0 for no bound
+	limit int
+}
+
+// allow reports whether mac may be sent a NAK at now, and records it
+func (l *nakLimiter) allow(mac string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.last == nil {
+		l.last = make(map[string]time.Time)
+	}
+	if t, ok := l.last[mac]; ok && now.Sub(t) < nakInterval {
+		return false
+	}
+	// forget the clients that can be NAKed again
+	if len(l.last) > 1024 {
+		for m, t := range l.last {
+			if now.Sub(t) >= nakInterval {
+				delete(l.last, m)
+				l.order.remove(m)
+			}
+		}
+	}
+	if l.limit > 0 && len(l.last) >= l.limit {
+		evictOldest(l.last, &l.order)
+	}
+	l.order.set(mac)
+	l.last[mac] = now
+	return true
+}
+
+func (l *nakLimiter) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.last)
+}
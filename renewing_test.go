@@ -0,0 +1,197 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestRenewingAdopt(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.16.10", "10.0.16.20", "1h")
+	for _, tc := range []struct {
+		name string
+		mac  string
+		ip   net.IP
+		mod  dhcpv4.Modifier
+	}{
+		{"ciaddr", "00:11:22:33:44:0a", net.IPv4(10, 0, 16, 15).To4(), dhcpv4.WithClientIP(net.IPv4(10, 0, 16, 15))},
+		{"requested IP", "00:11:22:33:44:0b", net.IPv4(10, 0, 16, 16).To4(), dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 16, 16)))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ack := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, tc.mac, tc.mod))
+			if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck || !ack.YourIPAddr.Equal(tc.ip) {
+				t.Fatalf("renewal of an unrecorded free address answered %v, want an ACK of %s", ack, tc.ip)
+			}
+			// adopted leases are written in batches
+			eventually(t, "the adopted record", func() bool {
+				rec, err := p.storage.GetRecord(tc.mac)
+				return err == nil && rec.IP.Equal(tc.ip)
+			})
+			if holder := p.leases.macOf(tc.ip); holder != tc.mac {
+				t.Errorf("%s held by %q, want %s", tc.ip, holder, tc.mac)
+			}
+		})
+	}
+}
+
+func TestRenewingNAK(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.16.10", "10.0.16.20", "1h")
+	taken := lease(t, p, "00:11:22:33:44:0a")
+	for i, ip := range []net.IP{taken, net.IPv4(10, 0, 17, 10)} {
+		mac := fmt.Sprintf("00:11:22:33:44:1%d", i)
+		if typ := renewal(t, p, mac, ip); typ != dhcpv4.MessageTypeNak {
+			t.Errorf("renewal of %s answered %s, want NAK", ip, typ)
+		}
+		if _, err := p.storage.GetRecord(mac); err == nil {
+			t.Errorf("record of %s after the NAK", mac)
+		}
+	}
+	if holder := p.leases.macOf(taken); holder != "00:11:22:33:44:0a" {
+		t.Errorf("%s held by %q after the NAK", taken, holder)
+	}
+}
+
+func TestRenewingNAKRateLimit(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.16.10", "10.0.16.20", "1h")
+	const mac = "00:11:22:33:44:0b"
+	taken := lease(t, p, "00:11:22:33:44:0a")
+
+	if typ := renewal(t, p, mac, taken); typ != dhcpv4.MessageTypeNak {
+		t.Fatalf("first renewal answered %s, want NAK", typ)
+	}
+	advance(p, nakInterval-time.Second)
+	if typ := renewal(t, p, mac, taken); typ != dhcpv4.MessageTypeNone {
+		t.Errorf("renewal within %s answered %s, want it dropped", nakInterval, typ)
+	}
+	if typ := renewal(t, p, "00:11:22:33:44:0c", taken); typ != dhcpv4.MessageTypeNak {
+		t.Errorf("renewal of another client answered %s, want NAK", typ)
+	}
+	advance(p, time.Second)
+	if typ := renewal(t, p, mac, taken); typ != dhcpv4.MessageTypeNak {
+		t.Errorf("renewal after %s answered %s, want NAK", nakInterval, typ)
+	}
+}
+
+func TestNAKLimiterBound(t *testing.T) {
+	l := nakLimiter{limit: 3}
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		if !l.allow(fmt.Sprintf("00:11:22:33:44:%02x", i), now) {
+			t.Errorf("first NAK of client %d refused", i)
+		}
+	}
+	if n := l.len(); n != 3 {
+		t.Errorf("%d clients remembered, want 3", n)
+	}
+}
+
+func TestNakMismatch(t *testing.T) {
+	const mac = "00:11:22:33:44:0a"
+	other := net.IPv4(10, 0, 16, 19).To4()
+	requestOther := func(p *PluginState) *dhcpv4.DHCPv4 {
+		return exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(other))))
+	}
+
+	// by default, the lease is acknowledged instead
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.16.10", "10.0.16.20", "1h")
+	ip := lease(t, p, mac)
+	if ack := requestOther(p); ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck || !ack.YourIPAddr.Equal(ip) {
+		t.Errorf("request of another address answered %v, want an ACK of %s", ack, ip)
+	}
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	p = startPlugin(t, m, "10.0.16.10", "10.0.16.20", "1h", "nak_mismatch=true")
+	if resp := requestOther(p); resp == nil || resp.MessageType() != dhcpv4.MessageTypeNak {
+		t.Errorf("request of another address answered %v, want a NAK", resp)
+	}
+	if holder := p.leases.macOf(other); holder != "" {
+		t.Errorf("requested %s held by %q after the NAK", other, holder)
+	}
+	// the lease is left to the client, which gets it again by discovery
+	if got := lease(t, p, mac); !got.Equal(ip) {
+		t.Errorf("leased %s after the NAK, want %s", got, ip)
+	}
+	if typ := renewal(t, p, mac, ip); typ != dhcpv4.MessageTypeAck {
+		t.Errorf("renewal of the lease answered %s", typ)
+	}
+}
+
+// exchangeWith is exchange for a server whose server_id plugin ran first,
+// setting its identifier server in the reply
+func exchangeWith(t *testing.T, p *PluginState, server net.IP, req *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	t.Helper()
+	resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithServerIP(server), dhcpv4.WithOption(dhcpv4.OptServerIdentifier(server)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.MessageType() == dhcpv4.MessageTypeDiscover {
+		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
+	} else {
+		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+	}
+	out, _ := p.Handler4(req, resp)
+	return out
+}
+
+func TestRenewingOtherServer(t *testing.T) {
+	m := miniredis.RunT(t)
+	ours, other := net.IPv4(10, 0, 81, 1).To4(), net.IPv4(10, 0, 81, 2).To4()
+	p := startPlugin(t, m, "10.0.81.10", "10.0.81.20", "1h", "nak_mismatch=true")
+	const holder, reserved = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+	taken := lease(t, p, holder)
+	if err := p.storage.SetReservation(context.Background(), reserved, net.IPv4(10, 0, 81, 18)); err != nil {
+		t.Fatal(err)
+	}
+	selecting := func(mac string, ip, server net.IP) *dhcpv4.DHCPv4 {
+		return exchangeWith(t, p, ours, newRequest(t, dhcpv4.MessageTypeRequest, mac,
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)), dhcpv4.WithOption(dhcpv4.OptServerIdentifier(server))))
+	}
+
+	// a client choosing the offer of another server is left alone, whatever
+	// it requests: neither adopted, nor NAKed
+	for i, tc := range []struct {
+		name string
+		mac  string
+		ip   net.IP
+	}{
+		{"free address", "00:11:22:33:44:10", net.IPv4(10, 0, 81, 15).To4()},
+		{"address outside of the range", "00:11:22:33:44:11", net.IPv4(10, 0, 82, 15).To4()},
+		{"address leased to another client", "00:11:22:33:44:12", taken},
+		{"other address than its lease", holder, net.IPv4(10, 0, 81, 16).To4()},
+		{"other address than its reservation", reserved, net.IPv4(10, 0, 81, 17).To4()},
+	} {
+		if resp := selecting(tc.mac, tc.ip, other); resp != nil {
+			t.Errorf("%s: answered %s", tc.name, resp.MessageType())
+		}
+		if i < 2 {
+			if _, err := p.storage.GetRecord(tc.mac); err == nil || p.leases.macOf(tc.ip) != "" {
+				t.Errorf("%s: %s adopted for another server", tc.name, tc.ip)
+			}
+		}
+	}
+	if rec, err := p.storage.GetRecord(holder); err != nil || !rec.IP.Equal(taken) {
+		t.Errorf("lease of the client choosing another server: %v, %v", rec, err)
+	}
+
+	// this server, named or not, still adopts and NAKs
+	if ack := selecting("00:11:22:33:44:10", net.IPv4(10, 0, 81, 15), ours); ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck {
+		t.Errorf("request naming this server answered %v, want an ACK", ack)
+	}
+	if resp := selecting(holder, net.IPv4(10, 0, 81, 16), ours); resp == nil || resp.MessageType() != dhcpv4.MessageTypeNak {
+		t.Errorf("mismatch naming this server answered %v, want a NAK", resp)
+	}
+	if typ := renewal(t, p, "00:11:22:33:44:11", net.IPv4(10, 0, 82, 15)); typ != dhcpv4.MessageTypeNak {
+		t.Errorf("renewal outside of the range answered %s, want a NAK", typ)
+	}
+}
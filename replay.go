@@ -0,0 +1,104 @@
+package rangeredisplugin
+
+import (
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// replayWindow is how long the copies of a request, e.g. delivered twice by
+// the socket layer or retried by the server, get the reply to the first one
+const replayWindow = 2 * time.Second
+
+// replyKey identifies the copies of a request
+type replyKey struct {
+	mac string
+	xid dhcpv4.TransactionID
+	typ dhcpv4.MessageType
+}
+
+// replyEntry is the outcome of the first copy of a request, available once
+// done is closed
+type replyEntry struct {
+	done chan struct{}
+	at   time.Time
+	// reply is the encoded reply, nil for a dropped request
+	reply []byte
+	stop  bool
+}
+
+// replyCache remembers the outcome of the requests handled less than
+// replayWindow ago, so that their copies have no other effect than the
+// same reply
+type replyCache struct {
+	mu      sync.Mutex
+	entries map[replyKey]*replyEntry
+	// order is the order the entries were set in, oldest first
+	order arrivals[replyKey]
+	// limit bounds the number of requests remembered, 0 for no bound
+	limit int
+}
+
+// claim returns the entry of the first copy of the request key received
+// at now, and true, or records a new one that complete must be called on
+// and returns false
+func (c *replyCache) claim(key replyKey, now time.Time) (*replyEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[replyKey]*replyEntry)
+	}
+	if e, ok := c.entries[key]; ok && now.Sub(e.at) < replayWindow {
+		return e, true
+	}
+	if _, ok := c.entries[key]; !ok && c.limit > 0 && len(c.entries) >= c.limit {
+		evictOldest(c.entries, &c.order)
+	}
+	e := &replyEntry{done: make(chan struct{}), at: now}
+	c.order.set(key)
+	c.entries[key] = e
+	return e, false
+}
+
+// complete records the outcome of the first copy, releasing the others
+func (e *replyEntry) complete(out *dhcpv4.DHCPv4, stop bool) {
+	if out != nil {
+		e.reply = out.ToBytes()
+	}
+	e.stop = stop
+	close(e.done)
+}
+
+// replay waits for the outcome of the first copy and returns it anew
+func (e *replyEntry) replay() (*dhcpv4.DHCPv4, bool) {
+	<-e.done
+	if e.reply == nil {
+		return nil, e.stop
+	}
+	out, err := dhcpv4.FromBytes(e.reply)
+	if err != nil {
+		log.Errorf("could not decode the reply to replay: %v", err)
+		return nil, true
+	}
+	return out, e.stop
+}
+
+func (c *replyCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// prune forgets the requests received replayWindow before now or earlier
+func (c *replyCache) prune(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.entries {
+		if now.Sub(e.at) >= replayWindow {
+			delete(c.entries, key)
+			c.order.remove(key)
+		}
+	}
+}
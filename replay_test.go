@@ -0,0 +1,91 @@
+package rangeredisplugin
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestReplayedReplies(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.52.10", "10.0.52.20", "1h")
+	events := recordEvents(p)
+	const mac = "00:11:22:33:44:0a"
+
+	// the copies of a request get the same reply, and nothing else
+	discover := newRequest(t, dhcpv4.MessageTypeDiscover, mac)
+	offer := exchange(t, p, discover)
+	if offer == nil {
+		t.Fatal("no offer")
+	}
+	commands, stop := countCommands(m, mac)
+	if again := exchange(t, p, discover); again == nil || !bytes.Equal(again.ToBytes(), offer.ToBytes()) {
+		t.Errorf("copy of the DISCOVER answered %v, want %v", again, offer)
+	}
+	stop()
+	if n := commands.Load(); n != 0 {
+		t.Errorf("%d redis commands for the copy", n)
+	}
+
+	// as do concurrent copies, of which one only is handled
+	request := newRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(offer.YourIPAddr)))
+	replies := make([][]byte, 4)
+	var wg sync.WaitGroup
+	for i := range replies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if ack := exchange(t, p, request); ack != nil {
+				replies[i] = ack.ToBytes()
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, reply := range replies {
+		if reply == nil || !bytes.Equal(reply, replies[0]) {
+			t.Errorf("copy %d of the REQUEST answered %x", i, reply)
+		}
+	}
+	if ack, _ := dhcpv4.FromBytes(replies[0]); ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck {
+		t.Errorf("REQUEST answered %v", ack)
+	}
+	if s := p.Stats(); s.ReplayedReplies != 4 || s.AllocatedLeases != 1 {
+		t.Errorf("%d replies replayed and %d leases allocated, want 4 and 1", s.ReplayedReplies, s.AllocatedLeases)
+	}
+	if history, err := p.storage.History(context.Background(), mac); err != nil || len(history) != 1 {
+		t.Errorf("history %v: %v, want one grant", history, err)
+	}
+	eventually(t, "the grant", func() bool { return len(events.of(EventGrant)) == 1 })
+	time.Sleep(10 * time.Millisecond)
+	if n := len(events.of(EventOffer)) + len(events.of(EventGrant)); n != 2 {
+		t.Errorf("%d offer and grant events, want 2", n)
+	}
+
+	// past the window, the same xid is a request of its own
+	advance(p, replayWindow)
+	exchange(t, p, request)
+	if n := p.Stats().ReplayedReplies; n != 4 {
+		t.Errorf("%d replies replayed past the window", n)
+	}
+}
+
+func TestReplayedDrops(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.52.10", "10.0.52.20", "1h")
+	const mac = "00:11:22:33:44:0a"
+	m.SAdd(REDIS_DENY_KEY, mac)
+	discover := newRequest(t, dhcpv4.MessageTypeDiscover, mac)
+	for i := 0; i < 2; i++ {
+		if offer := exchange(t, p, discover); offer != nil {
+			t.Errorf("copy %d of a dropped request answered %v", i, offer)
+		}
+	}
+	if s := p.Stats(); s.ReplayedReplies != 1 || s.Refusals.Reasons[ReasonDenied] != 1 {
+		t.Errorf("%d replies replayed, refusals %s", s.ReplayedReplies, s.Refusals)
+	}
+}
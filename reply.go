@@ -0,0 +1,113 @@
+package rangeredisplugin
+
+import (
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// nakOptions are the options a DHCPNAK may carry (RFC 2131, table 3): the
+// relay agent information is echoed once the reply is complete
+var nakOptions = map[uint8]bool{
+	dhcpv4.OptionDHCPMessageType.Code():  true,
+	dhcpv4.OptionServerIdentifier.Code(): true,
+	dhcpv4.OptionMessage.Code():          true,
+	dhcpv4.OptionClientIdentifier.Code(): true,
+	dhcpv4.OptionClassIdentifier.Code():  true,
+}
+
+// default renewal and rebinding times, as fractions of the lease time (RFC
+// 2131, section 4.4.5)
+const (
+	defaultT1 = 0.5
+	defaultT2 = 0.875
+)
+
+// parseTimerFraction parses the fraction of the lease time a timer expires
+// at
+func parseTimerFraction(val string) (float64, error) {
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil || !(f > 0 && f <= 1) {
+		return 0, errors.New("want a fraction of the lease time, above 0 and at most 1")
+	}
+	return f, nil
+}
+
+// setLeaseTime announces a lease of d in resp, with the renewal and
+// rebinding times at the fractions t1 and t2 of it, all rounded to seconds.
+// The timers never exceed the lease time.
+func setLeaseTime(resp *dhcpv4.DHCPv4, d time.Duration, t1, t2 float64) {
+	lease := d.Round(time.Second)
+	timer := func(f float64) time.Duration {
+		t := time.Duration(math.Round(f*lease.Seconds())) * time.Second
+		if t > lease {
+			return lease
+		}
+		return t
+	}
+	resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(lease))
+	resp.Options.Update(dhcpv4.OptRenewTimeValue(timer(t1)))
+	resp.Options.Update(dhcpv4.OptRebindingTimeValue(timer(t2)))
+}
+
+// handledType reports whether the plugin acts on DHCPv4 messages of type
+// mt: DISCOVERs and REQUESTs allocate or renew, RELEASEs and DECLINEs end
+// leases. The others are passed on untouched.
+func handledType(mt dhcpv4.MessageType) bool {
+	switch mt {
+	case dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeRequest,
+		dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeDecline:
+		return true
+	}
+	return false
+}
+
+// shapeReply makes resp a reply of type mt to req, setting the fields of
+// the header per RFC 2131 section 4.3 and table 3, whatever the server or
+// earlier plugins left in them: the transaction ID, the flags, the relay
+// address and the client hardware address are those of the request. A
+// DHCPNAK configures nothing, so its addresses and options beyond those of
+// nakOptions are cleared, and it is broadcast by the relay if there is one
+// since the client has no address to receive it on.
+func shapeReply(req, resp *dhcpv4.DHCPv4, mt dhcpv4.MessageType) *dhcpv4.DHCPv4 {
+	resp.OpCode = dhcpv4.OpcodeBootReply
+	resp.HWType = req.HWType
+	resp.HopCount = 0
+	resp.TransactionID = req.TransactionID
+	resp.NumSeconds = 0
+	resp.Flags = req.Flags
+	resp.GatewayIPAddr = req.GatewayIPAddr
+	resp.ClientHWAddr = req.ClientHWAddr
+	resp.Options.Update(dhcpv4.OptMessageType(mt))
+
+	switch mt {
+	case dhcpv4.MessageTypeNak:
+		resp.ClientIPAddr = net.IPv4zero
+		resp.YourIPAddr = net.IPv4zero
+		resp.ServerIPAddr = net.IPv4zero
+		resp.ServerHostName = ""
+		resp.BootFileName = ""
+		for code := range resp.Options {
+			if !nakOptions[code] {
+				delete(resp.Options, code)
+			}
+		}
+		if gw := req.GatewayIPAddr; gw != nil && !gw.IsUnspecified() {
+			resp.SetBroadcast()
+		}
+	case dhcpv4.MessageTypeAck:
+		resp.ClientIPAddr = req.ClientIPAddr
+	default:
+		resp.ClientIPAddr = net.IPv4zero
+	}
+	return resp
+}
+
+// nak turns resp into a DHCPNAK to req
+func nak(req, resp *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	return shapeReply(req, resp, dhcpv4.MessageTypeNak)
+}
@@ -0,0 +1,195 @@
+package rangeredisplugin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// replyTo returns a request of type typ from the client 00:11:22:33:44:0a
+// with the modifiers applied after, and the reply the server built for it,
+// with fields a reply of any type may have been left with by earlier plugins
+func replyTo(t *testing.T, typ dhcpv4.MessageType, mods ...dhcpv4.Modifier) (*dhcpv4.DHCPv4, *dhcpv4.DHCPv4) {
+	t.Helper()
+	hw, _ := net.ParseMAC("00:11:22:33:44:0a")
+	mods = append([]dhcpv4.Modifier{
+		dhcpv4.WithTransactionID(dhcpv4.TransactionID{0xde, 0xad, 0xbe, 0xef}),
+		dhcpv4.WithHwAddr(hw),
+		dhcpv4.WithMessageType(typ),
+		dhcpv4.WithOption(dhcpv4.OptClientIdentifier([]byte{1, 0, 0x11, 0x22, 0x33, 0x44, 0x0a})),
+	}, mods...)
+	req, err := dhcpv4.New(mods...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.NumSeconds = 5
+	if !req.GatewayIPAddr.IsUnspecified() {
+		req.HopCount = 1
+	}
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.HopCount = 1
+	resp.NumSeconds = 5
+	resp.YourIPAddr = net.IPv4(10, 0, 39, 10)
+	resp.ServerIPAddr = net.IPv4(10, 0, 39, 1)
+	resp.ServerHostName = "boot"
+	resp.BootFileName = "pxelinux.0"
+	resp.UpdateOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 39, 1)))
+	resp.UpdateOption(dhcpv4.OptRouter(net.IPv4(10, 0, 39, 1)))
+	resp.UpdateOption(dhcpv4.OptSubnetMask(net.CIDRMask(24, 32)))
+	resp.UpdateOption(dhcpv4.OptIPAddressLeaseTime(time.Hour))
+	return req, resp
+}
+
+func TestShapeReply(t *testing.T) {
+	requested := dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 39, 20)))
+	for _, tc := range []struct {
+		name     string
+		req, typ dhcpv4.MessageType
+		mods     []dhcpv4.Modifier
+	}{
+		{"nak_relayed", dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeNak, []dhcpv4.Modifier{requested, dhcpv4.WithGatewayIP(net.IPv4(192, 0, 2, 1))}},
+		{"nak_broadcast", dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeNak, []dhcpv4.Modifier{requested, dhcpv4.WithBroadcast(true)}},
+		{"ack_renewal", dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeAck, []dhcpv4.Modifier{dhcpv4.WithClientIP(net.IPv4(10, 0, 39, 10))}},
+		{"offer_relayed", dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeOffer, []dhcpv4.Modifier{dhcpv4.WithGatewayIP(net.IPv4(192, 0, 2, 1)), dhcpv4.WithBroadcast(true)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, resp := replyTo(t, tc.req, tc.mods...)
+			out := shapeReply(req, resp, tc.typ)
+
+			// a NAK through a relay is broadcast whatever the client asked
+			if out.TransactionID != req.TransactionID || out.Flags != req.Flags && tc.name != "nak_relayed" ||
+				!out.GatewayIPAddr.Equal(req.GatewayIPAddr) || out.HopCount != 0 || out.NumSeconds != 0 {
+				t.Errorf("header not copied from the request: %s", out.Summary())
+			}
+			if tc.typ == dhcpv4.MessageTypeNak {
+				if !out.YourIPAddr.IsUnspecified() || !out.ServerIPAddr.IsUnspecified() || out.BootFileName != "" {
+					t.Errorf("addresses left on a NAK: %s", out.Summary())
+				}
+				if !out.IsBroadcast() {
+					t.Error("NAK not broadcast")
+				}
+				if out.Options.Has(dhcpv4.OptionRouter) || out.Options.Has(dhcpv4.OptionIPAddressLeaseTime) {
+					t.Errorf("configuration left on a NAK: %s", out.Options)
+				}
+			}
+
+			// the bytes on the wire
+			got := []byte(hex.Dump(out.ToBytes()))
+			golden := filepath.Join("testdata", "reply_"+tc.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("reply:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestPassedTypes(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.39.10", "10.0.39.20", "1h")
+	const mac = "00:11:22:33:44:0a"
+	ip := lease(t, p, mac)
+	// the commands touching the client or its address
+	var touched atomic.Int32
+	m.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		for _, arg := range args {
+			if strings.Contains(arg, mac) || strings.Contains(arg, ip.String()) {
+				touched.Add(1)
+			}
+		}
+		return false
+	})
+	dump := m.Dump()
+
+	types := []dhcpv4.MessageType{dhcpv4.MessageTypeInform, dhcpv4.MessageTypeOffer, dhcpv4.MessageTypeAck,
+		dhcpv4.MessageTypeNak, dhcpv4.MessageType(9), dhcpv4.MessageType(10)}
+	for _, typ := range types {
+		req := newRequest(t, typ, mac, dhcpv4.WithClientIP(ip), dhcpv4.WithGatewayIP(net.IPv4(192, 0, 2, 1)),
+			dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("eth0")))))
+		resp, err := dhcpv4.NewReplyFromRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := resp.ToBytes()
+		out, stop := p.Handler4(req, resp)
+		if out != resp || stop || !bytes.Equal(out.ToBytes(), before) {
+			t.Errorf("%s not passed on untouched: %s", typ, out.Summary())
+		}
+	}
+	if n := touched.Load(); n != 0 {
+		t.Errorf("%d redis commands for the messages passed on", n)
+	}
+	if m.Dump() != dump {
+		t.Error("redis modified by the messages passed on")
+	}
+	if n := p.Stats().TypePassed; n != uint64(len(types)) {
+		t.Errorf("%d messages passed on in the stats, want %d", n, len(types))
+	}
+
+	// the hook sees the messages acted on
+	renewal(t, p, mac, ip)
+	if touched.Load() == 0 {
+		t.Error("no redis command seen for a renewal")
+	}
+}
+
+func TestTimers(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.57.10", "10.0.57.20", "1h", "lease_max=4h")
+	const a, b = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+	timers := func(reply *dhcpv4.DHCPv4) [3]time.Duration {
+		return [3]time.Duration{reply.IPAddressLeaseTime(0), reply.IPAddressRenewalTime(0), reply.IPAddressRebindingTime(0)}
+	}
+
+	// RFC 2131 fractions by default, of each lease time granted
+	ip := lease(t, p, a)
+	ack := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, a, dhcpv4.WithClientIP(ip)))
+	if got, want := timers(ack), [3]time.Duration{time.Hour, 30 * time.Minute, 52*time.Minute + 30*time.Second}; got != want {
+		t.Errorf("timers %v, want %v", got, want)
+	}
+	offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, b, dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(2*time.Hour))))
+	if got, want := timers(offer), [3]time.Duration{2 * time.Hour, time.Hour, 105 * time.Minute}; got != want {
+		t.Errorf("timers %v of a requested lease time, want %v", got, want)
+	}
+
+	// rounded to seconds and capped at the lease time
+	resp, _ := dhcpv4.New()
+	setLeaseTime(resp, 999*time.Millisecond+time.Second, 0.25, 1)
+	if got, want := timers(resp), [3]time.Duration{2 * time.Second, time.Second, 2 * time.Second}; got != want {
+		t.Errorf("timers %v, want %v", got, want)
+	}
+
+	q := startPlugin(t, m, "10.0.57.30", "10.0.57.40", "1h", "t1=0.25", "t2=0.5")
+	ip = lease(t, q, a)
+	if got, want := timers(exchange(t, q, newRequest(t, dhcpv4.MessageTypeRequest, a, dhcpv4.WithClientIP(ip)))), [3]time.Duration{time.Hour, 15 * time.Minute, 30 * time.Minute}; got != want {
+		t.Errorf("timers %v with t1 and t2, want %v", got, want)
+	}
+
+	args := []string{redisURI(m), "10.0.57.30", "10.0.57.40", "1h"}
+	for _, opts := range [][]string{{"t1=0"}, {"t2=1.5"}, {"t1=half"}, {"t1=0.9", "t2=0.8"}} {
+		if _, err := parseConfig(append(args, opts...)); err == nil {
+			t.Errorf("%v accepted", opts)
+		}
+	}
+}
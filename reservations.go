@@ -0,0 +1,263 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// REDIS_RESERVATIONS_KEY is the hash of the static reservations, mapping a
+// client key to the IPv4 address it always gets. Reserved addresses within
+// the range are withheld from the dynamic clients, those outside of it are
+// handed out without allocator entry.
+const REDIS_RESERVATIONS_KEY = "r:dhcp:reservations"
+
+// REDIS_CIRCUIT_RESERVATIONS_KEY is the hash of the reservations by relay
+// circuit, mapping <relay>:<circuit ID> to the IPv4 address the client
+// behind the circuit gets, whatever its MAC address, e.g.
+// `HSET r:dhcp:reservations:circuit 10.1.0.1:eth0/1/3 10.1.0.50`. The
+// circuit ID is the normalized one of option 82, and the relay 0.0.0.0 for
+// an agent leaving giaddr unset. A reservation of the MAC address wins.
+const REDIS_CIRCUIT_RESERVATIONS_KEY = "r:dhcp:reservations:circuit"
+
+// Reservations returns the reservations, skipping the malformed ones
+func (r *RedisProvider) Reservations(ctx context.Context) (map[string]net.IP, error) {
+	vals, err := r.rdb.HGetAll(ctx, REDIS_RESERVATIONS_KEY).Result()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	resv := make(map[string]net.IP, len(vals))
+	for mac, v := range vals {
+		ip := net.ParseIP(v).To4()
+		if ip == nil || !validClientKey(mac) {
+			log.Warnf("ignoring reservation of %q for %q", v, mac)
+			continue
+		}
+		resv[mac] = ip
+	}
+	return resv, nil
+}
+
+// Reservation returns the address reserved for mac, or nil
+func (r *RedisProvider) Reservation(ctx context.Context, mac string) (net.IP, error) {
+	v, err := r.rdb.HGet(ctx, REDIS_RESERVATIONS_KEY, mac).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, unavailable(err)
+	}
+	ip := net.ParseIP(v).To4()
+	if ip == nil {
+		log.Warnf("ignoring reservation of %q for %s", v, mac)
+	}
+	return ip, nil
+}
+
+// CircuitReservations returns the reservations by circuit, skipping the
+// malformed ones
+func (r *RedisProvider) CircuitReservations(ctx context.Context) (map[string]net.IP, error) {
+	vals, err := r.rdb.HGetAll(ctx, REDIS_CIRCUIT_RESERVATIONS_KEY).Result()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	resv := make(map[string]net.IP, len(vals))
+	for id, v := range vals {
+		ip := net.ParseIP(v).To4()
+		if ip == nil {
+			log.Warnf("ignoring reservation of %q for circuit %q", v, id)
+			continue
+		}
+		resv[id] = ip
+	}
+	return resv, nil
+}
+
+// CircuitReservation returns the address reserved for the circuit id, see
+// circuitID, or nil
+func (r *RedisProvider) CircuitReservation(ctx context.Context, id string) (net.IP, error) {
+	v, err := r.rdb.HGet(ctx, REDIS_CIRCUIT_RESERVATIONS_KEY, id).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, unavailable(err)
+	}
+	ip := net.ParseIP(v).To4()
+	if ip == nil {
+		log.Warnf("ignoring reservation of %q for circuit %s", v, id)
+	}
+	return ip, nil
+}
+
+// SetReservation reserves ip for mac, or removes the reservation of mac if
+// ip is nil. A changed reservation applies from the next request of the
+// client; the reserved addresses of the range are withheld at startup and
+// by the reload-reservations control command.
+func (r *RedisProvider) SetReservation(ctx context.Context, mac string, ip net.IP) error {
+	if ip == nil {
+		return unavailable(r.rdb.HDel(ctx, REDIS_RESERVATIONS_KEY, mac).Err())
+	}
+	if ip.To4() == nil {
+		return fmt.Errorf("invalid IPv4 address %s", ip)
+	}
+	return unavailable(r.rdb.HSet(ctx, REDIS_RESERVATIONS_KEY, mac, ip.To4().String()).Err())
+}
+
+// reservedIPs holds the reserved addresses withheld from the allocator, or
+// handed out outside of the range, mapped to their client
+type reservedIPs struct {
+	mu  sync.Mutex
+	ips map[string]string
+}
+
+func (r *reservedIPs) has(ip net.IP) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.ips[ip.String()]
+	return ok
+}
+
+func (r *reservedIPs) set(ip net.IP, mac string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ips == nil {
+		r.ips = make(map[string]string)
+	}
+	r.ips[ip.String()] = mac
+}
+
+func (r *reservedIPs) snapshot() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := make(map[string]string, len(r.ips))
+	for ip, mac := range r.ips {
+		s[ip] = mac
+	}
+	return s
+}
+
+func (r *reservedIPs) remove(ip net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.ips, ip.String())
+}
+
+func (r *reservedIPs) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.ips)
+}
+
+// loadReservations withholds the reserved addresses of the range from the
+// allocator, once the stored leases are loaded, and returns to it those no
+// longer reserved nor leased
+func (p *PluginState) loadReservations(ctx context.Context) error {
+	resv, err := p.storage.Reservations(ctx)
+	if err != nil {
+		return err
+	}
+	circuits, err := p.storage.CircuitReservations(ctx)
+	if err != nil {
+		return err
+	}
+	wanted := make(map[string]bool, len(resv)+len(circuits))
+	for mac, ip := range resv {
+		wanted[ip.String()] = true
+		if err := p.claimReserved(mac, ip); err != nil {
+			log.Errorf("could not withhold %s reserved for MAC %s: %v", ip, mac, err)
+		}
+	}
+	for id, ip := range circuits {
+		if wanted[ip.String()] {
+			log.Warnf("ignoring the reservation of %s for circuit %s: reserved for a MAC address", ip, id)
+			continue
+		}
+		wanted[ip.String()] = true
+		if err := p.holdForCircuit(id, ip); err != nil {
+			log.Errorf("could not withhold %s reserved for circuit %s: %v", ip, id, err)
+		}
+	}
+	for s := range p.reserved.snapshot() {
+		ip := net.ParseIP(s).To4()
+		if wanted[s] {
+			continue
+		}
+		p.reserved.remove(ip)
+		if !p.inRange(ip) || p.cfg.excluded(ip) || p.frozen.has(ip) || p.leases.macOf(ip) != "" {
+			continue
+		}
+		if err := p.allocator.Free(net.IPNet{IP: ip, Mask: net.IPv4Mask(255, 255, 255, 255)}); err != nil {
+			log.Errorf("could not return %s, no longer reserved, to the pool: %v", ip, err)
+		}
+	}
+	log.Infof("loaded %d reservations, %d by circuit", len(resv), len(circuits))
+	return nil
+}
+
+// claimReserved claims ip, reserved for mac. A lease of the address to
+// another client ends, and the client is moved to another address at its
+// next request: the reservation wins.
+func (p *PluginState) claimReserved(mac string, ip net.IP) error {
+	owner := p.leases.macOf(ip)
+	switch {
+	case owner == mac:
+	case owner != "":
+		if err := p.storage.DeleteRecord(owner); err != nil {
+			return fmt.Errorf("could not end the lease of %s for %s: %w", ip, owner, err)
+		}
+		if err := p.storage.releaseIndex(owner, ip); err != nil {
+			log.Warnf("could not release index entry of %s for %s: %v", ip, owner, err)
+		}
+		p.leases.remove(owner, ip)
+		p.offers.drop(owner)
+		p.reassign.add(owner)
+		log.Warnf("lease of %s for MAC %s ended: the address is reserved for %s", ip, owner, mac)
+		p.emit(Event{Type: EventConflict, MAC: owner, IP: ip, Detail: "reserved for " + mac})
+	case p.inRange(ip) && !p.reserved.has(ip):
+		if err := p.claim(mac, ip); err != nil {
+			return err
+		}
+	}
+	p.reserved.set(ip, mac)
+	return nil
+}
+
+// holdForCircuit withholds ip, reserved for the circuit id, from the
+// dynamic clients. Unlike a reservation of a MAC address, it never ends the
+// lease of the address to a client: the reservation is deferred until that
+// lease ends, and the address is then withheld.
+func (p *PluginState) holdForCircuit(id string, ip net.IP) error {
+	owner := "circuit " + id
+	switch holder := p.leases.macOf(ip); {
+	case holder != "":
+		log.Warnf("%s reserved for circuit %s is leased to MAC %s, deferring the reservation until the lease ends", ip, id, holder)
+	case p.inRange(ip) && !p.reserved.has(ip):
+		if err := p.claim(owner, ip); err != nil {
+			return err
+		}
+	}
+	p.reserved.set(ip, owner)
+	return nil
+}
+
+// circuitReservation returns the address reserved for the circuit of req,
+// or nil. If the address is leased to another client than mac, that client
+// is returned too: the reservation waits for its lease to end.
+func (p *PluginState) circuitReservation(ctx context.Context, req *dhcpv4.DHCPv4, circuit, mac string) (net.IP, string, error) {
+	if circuit == "" {
+		return nil, "", nil
+	}
+	ip, err := p.storage.CircuitReservation(ctx, circuitID(relayOf(req), circuit))
+	if ip == nil || err != nil {
+		return nil, "", err
+	}
+	if holder := p.leases.macOf(ip); holder != "" && holder != mac {
+		return ip, holder, nil
+	}
+	return ip, "", nil
+}
@@ -0,0 +1,156 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// assertWithheld fails the test if ip can be allocated by p
+func assertWithheld(t *testing.T, p *PluginState, ip net.IP, after string) {
+	t.Helper()
+	if got, err := allocateExact(p.allocator, net.IPNet{IP: ip}); err == nil {
+		t.Errorf("%s returned reserved %s to the pool", after, got.IP)
+		if err := p.allocator.Free(got); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReservedAddressKeptOnFailedCommit(t *testing.T) {
+	m := miniredis.RunT(t)
+	const mac = "00:11:22:33:44:55"
+	reserved := net.IPv4(10, 0, 0, 15).To4()
+	m.HSet(REDIS_RESERVATIONS_KEY, mac, reserved.String())
+	p := startPlugin(t, m, "10.0.0.10", "10.0.0.20", "1h")
+
+	// the index entry of another client fails the commit
+	m.Set(p.storage.ns.index+reserved.String(), "00:11:22:33:44:66")
+	if out := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac)); out != nil {
+		t.Fatalf("offer %s despite the failed commit", out.YourIPAddr)
+	}
+	assertWithheld(t, p, reserved, "the rollback of the failed commit")
+}
+
+func TestWithheldAddressesStayOutOfThePool(t *testing.T) {
+	m := miniredis.RunT(t)
+	const mac = "00:11:22:33:44:55"
+	reserved := net.IPv4(10, 0, 0, 15).To4()
+	m.HSet(REDIS_RESERVATIONS_KEY, mac, reserved.String())
+	p := startPlugin(t, m, "10.0.0.10", "10.0.0.20", "1h", "cooldown=1m")
+	assertWithheld(t, p, reserved, "setup")
+
+	if got := lease(t, p, mac); !got.Equal(reserved) {
+		t.Fatalf("reserved client leased %s, want %s", got, reserved)
+	}
+	exchange(t, p, newRequest(t, dhcpv4.MessageTypeRelease, mac, dhcpv4.WithClientIP(reserved)))
+	assertWithheld(t, p, reserved, "the release")
+
+	p.releaseQuarantine(p.storage.ns.quarantine + reserved.String())
+	assertWithheld(t, p, reserved, "the end of a quarantine")
+
+	p.cooldown.push(reserved, p.clock.Now().Add(-time.Hour))
+	p.releaseCooldown()
+	assertWithheld(t, p, reserved, "the end of a cooldown")
+
+	if err := p.freeze(context.Background(), reserved); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.unfreeze(context.Background(), reserved); err != nil {
+		t.Fatal(err)
+	}
+	assertWithheld(t, p, reserved, "unfreezing")
+}
+
+// reserveCircuit reserves ip for circuit behind circuitRelay, its circuit ID
+// normalized by the default decoder
+func reserveCircuit(t *testing.T, m *miniredis.Miniredis, circuit string, ip net.IP) {
+	t.Helper()
+	cfg, err := parseConfig([]string{"redis://localhost/0", "10.0.72.10", "10.0.72.12", "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := (&PluginState{cfg: cfg}).decodeAgentInfo(onCircuit(t, dhcpv4.MessageTypeDiscover, "00:00:00:00:00:00", circuit)).CircuitID
+	m.HSet(REDIS_CIRCUIT_RESERVATIONS_KEY, circuitID(circuitRelay, id), ip.String())
+}
+
+func TestCircuitReservation(t *testing.T) {
+	m := miniredis.RunT(t)
+	reserved := net.IPv4(10, 0, 72, 11).To4()
+	reserveCircuit(t, m, "port1", reserved)
+	p := startPlugin(t, m, "10.0.72.10", "10.0.72.12", "1h")
+	assertWithheld(t, p, reserved, "setup")
+	const a, b, c = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c"
+
+	// whatever device is plugged into the port gets the address, once the
+	// lease of the previous one is released or expires
+	if ip := leaseOn(t, p, a, "port1"); !ip.Equal(reserved) {
+		t.Fatalf("leased %s on the reserved circuit, want %s", ip, reserved)
+	}
+	releaseLease(t, p, a, reserved)
+	assertWithheld(t, p, reserved, "the release")
+	if ip := leaseOn(t, p, b, "port1"); !ip.Equal(reserved) {
+		t.Errorf("replacing device leased %s, want %s", ip, reserved)
+	}
+	expire(t, m, p, b)
+	eventually(t, "the expiry", func() bool { return p.leases.macOf(reserved) == "" })
+	assertWithheld(t, p, reserved, "the expiry")
+	if ip := leaseOn(t, p, c, "port1"); !ip.Equal(reserved) {
+		t.Errorf("replacing device leased %s after the expiry, want %s", ip, reserved)
+	}
+
+	// other circuits and the dynamic clients never get it
+	for i, circuit := range []string{"port2", ""} {
+		if ip := leaseOn(t, p, fmt.Sprintf("00:11:22:33:55:%02x", i), circuit); ip == nil || ip.Equal(reserved) {
+			t.Errorf("circuit %q leased %s", circuit, ip)
+		}
+	}
+
+	// a reservation of the MAC address wins
+	mine := net.IPv4(10, 0, 72, 200).To4()
+	m.HSet(REDIS_RESERVATIONS_KEY, "00:11:22:33:44:0d", mine.String())
+	if ip := leaseOn(t, p, "00:11:22:33:44:0d", "port1"); !ip.Equal(mine) {
+		t.Errorf("MAC reservation on the reserved circuit leased %s, want %s", ip, mine)
+	}
+}
+
+func TestCircuitReservationDeferred(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.73.10", "10.0.73.20", "1h")
+	const a, b, c = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c"
+	ip := lease(t, p, a)
+
+	// reserved while leased to another client, the address stays with it
+	reserveCircuit(t, m, "port1", ip)
+	if err := p.loadReservations(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	hw, _ := net.ParseMAC(b)
+	ev, err := p.Evaluate(context.Background(), EvaluationRequest{MAC: hw, GatewayIP: circuitRelay, CircuitID: []byte("port1")})
+	if err != nil || len(ev.Policies) == 0 || !strings.Contains(fmt.Sprint(ev.Policies), "deferred") {
+		t.Errorf("evaluation %v, %v", ev, err)
+	}
+	got := leaseOn(t, p, b, "port1")
+	if got == nil || got.Equal(ip) {
+		t.Fatalf("deferred reservation leased %s", got)
+	}
+	if typ := renewal(t, p, a, ip); typ != dhcpv4.MessageTypeAck {
+		t.Errorf("renewal of the holder answered %s", typ)
+	}
+
+	// once the lease ends, the address is withheld and goes to the circuit
+	releaseLease(t, p, a, ip)
+	assertWithheld(t, p, ip, "the end of the holding lease")
+	if offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, c)); offer == nil || offer.YourIPAddr.Equal(ip) {
+		t.Errorf("dynamic client offered %v", offer)
+	}
+	if offer := exchange(t, p, onCircuit(t, dhcpv4.MessageTypeDiscover, b, "port1")); offer == nil || !offer.YourIPAddr.Equal(ip) {
+		t.Errorf("circuit offered %v, want %s", offer, ip)
+	}
+}
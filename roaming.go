@@ -0,0 +1,162 @@
+package rangeredisplugin
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Policies applied when a client with a lease shows up behind another relay
+const (
+	// RoamingAlert keeps the lease and moves it to the new relay, only
+	// logging the move and emitting an event
+	RoamingAlert = "alert"
+	// RoamingFollow ends the lease, so that the client gets an address
+	// from the pool serving its new location
+	RoamingFollow = "follow"
+	// RoamingHold keeps the lease behind the old relay, and refuses the
+	// client at its new location: REQUESTs are NAKed, DISCOVERs dropped
+	RoamingHold = "hold"
+)
+
+const (
+	// default number of relay changes of a client within the flap window
+	// that raises a flap event
+	defaultFlapThreshold = 3
+	defaultFlapWindow    = time.Minute
+)
+
+// relayOf returns the relay a request came through, 0.0.0.0 for a client
+// on the link of the server, or nil if unknown: a renewing client unicasts
+// to the server whatever relay it is behind
+func relayOf(req *dhcpv4.DHCPv4) net.IP {
+	if gw := req.GatewayIPAddr.To4(); gw != nil && !gw.IsUnspecified() {
+		return gw
+	}
+	if ip := req.ClientIPAddr; ip != nil && !ip.IsUnspecified() {
+		return nil
+	}
+	return net.IPv4zero.To4()
+}
+
+// flapTracker remembers the recent relay changes of each client
+type flapTracker struct {
+	mu    sync.Mutex
+	moves map[string][]time.Time
+	// order is the order the entries were set in, oldest first
+	order arrivals[string]
+	// limit bounds the number of clients remembered, 0 for no bound
+	limit int
+}
+
+// note records a relay change of mac at now, and returns the number of
+// changes within window
+func (f *flapTracker) note(mac string, now time.Time, window time.Duration) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.moves == nil {
+		f.moves = make(map[string][]time.Time)
+	}
+	recent := f.moves[mac][:0]
+	for _, t := range f.moves[mac] {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	if _, ok := f.moves[mac]; !ok && f.limit > 0 && len(f.moves) >= f.limit {
+		evictOldest(f.moves, &f.order)
+	}
+	f.order.set(mac)
+	f.moves[mac] = append(recent, now)
+	return len(f.moves[mac])
+}
+
+func (f *flapTracker) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.moves)
+}
+
+// roamOutcome is what becomes of a request after the roaming policy
+type roamOutcome int
+
+const (
+	// roamStay goes on with the lease, whose relay may have been updated
+	roamStay roamOutcome = iota
+	// roamEnded goes on without the lease, which was ended
+	roamEnded
+	// roamRefused refuses the request
+	roamRefused
+)
+
+// roamed reports whether the lease in record moves to relay from the one
+// it was granted behind
+func roamed(relay net.IP, record *Record) bool {
+	return relay != nil && record.Relay != nil && !record.Relay.Equal(relay)
+}
+
+// roaming returns what the roaming policy makes of the lease in record for
+// a request coming through relay, without applying it
+func (p *PluginState) roaming(relay net.IP, record *Record) roamOutcome {
+	if !roamed(relay, record) {
+		return roamStay
+	}
+	switch p.cfg.Roaming {
+	case RoamingHold:
+		return roamRefused
+	case RoamingFollow:
+		return roamEnded
+	}
+	return roamStay
+}
+
+// roam applies outcome, the roaming policy for the lease of mac, if the
+// request came through another relay than the one of the lease. Records
+// without a relay, stored before relays were recorded, take the one of the
+// request. Returns roamRefused if the lease could not be ended.
+func (p *PluginState) roam(req *dhcpv4.DHCPv4, mac string, record *Record, outcome roamOutcome, tr *requestTrace) roamOutcome {
+	relay := relayOf(req)
+	if !roamed(relay, record) {
+		if relay != nil && record.Relay == nil {
+			record.Relay = relay
+		}
+		return outcome
+	}
+
+	now := p.clock.Now()
+	from := record.Relay
+	move := fmt.Sprintf("from relay %s to %s", from, relay)
+	p.counters.relayMoves.Add(1)
+	tr.step("moved %s", move)
+	if n := p.flaps.note(mac, now, p.cfg.FlapWindow); n >= p.cfg.FlapThreshold {
+		p.counters.relayFlaps.Add(1)
+		log.Warnf("MAC %s flaps between relays: %d moves in %s, last %s", mac, n, p.cfg.FlapWindow, move)
+		p.emit(Event{Type: EventFlap, MAC: mac, IP: record.IP, Detail: fmt.Sprintf("%d moves, last %s", n, move)})
+	}
+
+	switch outcome {
+	case roamRefused:
+		log.Infof("MAC %s leasing %s moved %s, held behind %s", mac, record.IP, move, from)
+		p.emit(Event{Type: EventRoam, MAC: mac, IP: record.IP, Detail: RoamingHold + " " + move})
+		tr.step("roaming hold: refused at %s", relay)
+	case roamEnded:
+		if err := p.storage.DeleteRecord(mac); err != nil {
+			log.Errorf("Could not end the lease of %s for roaming MAC %s: %v", record.IP, mac, err)
+			tr.step("roaming follow: could not end the lease: %v", err)
+			return roamRefused
+		}
+		p.freeLease(mac, record.IP)
+		log.Infof("MAC %s leasing %s moved %s, lease ended", mac, record.IP, move)
+		p.emit(Event{Type: EventRoam, MAC: mac, IP: record.IP, Detail: RoamingFollow + " " + move})
+		tr.step("roaming follow: lease of %s ended", record.IP)
+	default:
+		log.Infof("MAC %s leasing %s moved %s", mac, record.IP, move)
+		p.emit(Event{Type: EventRoam, MAC: mac, IP: record.IP, Detail: RoamingAlert + " " + move})
+		record.Relay = relay
+	}
+	return outcome
+}
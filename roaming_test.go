@@ -0,0 +1,129 @@
+package rangeredisplugin
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var relayA, relayB = net.IPv4(192, 0, 2, 1).To4(), net.IPv4(192, 0, 2, 2).To4()
+
+// requestThrough has mac request ip through relay, and returns the reply
+func requestThrough(t *testing.T, p *PluginState, mac string, ip, relay net.IP) *dhcpv4.DHCPv4 {
+	t.Helper()
+	return exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac,
+		dhcpv4.WithGatewayIP(relay), dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip))))
+}
+
+func TestRelayOf(t *testing.T) {
+	ip := net.IPv4(10, 0, 38, 10)
+	for _, tc := range []struct {
+		name string
+		mods []dhcpv4.Modifier
+		want net.IP
+	}{
+		{"relayed", []dhcpv4.Modifier{dhcpv4.WithGatewayIP(relayA)}, relayA},
+		{"relayed renewal", []dhcpv4.Modifier{dhcpv4.WithGatewayIP(relayA), dhcpv4.WithClientIP(ip)}, relayA},
+		{"unicast renewal", []dhcpv4.Modifier{dhcpv4.WithClientIP(ip)}, nil},
+		{"on the link", nil, net.IPv4zero.To4()},
+	} {
+		req := newRequest(t, dhcpv4.MessageTypeRequest, "00:11:22:33:44:0a", tc.mods...)
+		if got := relayOf(req); !got.Equal(tc.want) {
+			t.Errorf("%s: relay %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRoaming(t *testing.T) {
+	const mac = "00:11:22:33:44:0a"
+	for _, policy := range []string{RoamingAlert, RoamingFollow, RoamingHold} {
+		t.Run(policy, func(t *testing.T) {
+			m := miniredis.RunT(t)
+			p := startPlugin(t, m, "10.0.38.10", "10.0.38.20", "1h", "roaming="+policy)
+			events := recordEvents(p)
+			ip := leaseThrough(t, p, mac, relayA)
+			if rec, err := p.storage.GetRecord(mac); err != nil || !rec.Relay.Equal(relayA) {
+				t.Fatalf("record %+v of the lease through %s: %v", rec, relayA, err)
+			}
+			// unicast renewals do not tell the relay
+			if typ := renewal(t, p, mac, ip); typ != dhcpv4.MessageTypeAck {
+				t.Errorf("unicast renewal answered %s", typ)
+			}
+
+			resp := requestThrough(t, p, mac, ip, relayB)
+			rec, err := p.storage.GetRecord(mac)
+			switch policy {
+			case RoamingAlert:
+				if resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck || !resp.YourIPAddr.Equal(ip) {
+					t.Errorf("request through another relay answered %v", resp)
+				}
+				if err != nil || !rec.Relay.Equal(relayB) {
+					t.Errorf("lease %+v not moved to %s: %v", rec, relayB, err)
+				}
+			case RoamingFollow:
+				if resp == nil || resp.MessageType() != dhcpv4.MessageTypeNak {
+					t.Errorf("request through another relay answered %v", resp)
+				}
+				if err == nil || p.leases.macOf(ip) != "" {
+					t.Error("lease kept")
+				}
+				if got := leaseThrough(t, p, mac, relayB); got == nil {
+					t.Error("no new lease behind the new relay")
+				}
+			case RoamingHold:
+				if resp == nil || resp.MessageType() != dhcpv4.MessageTypeNak {
+					t.Errorf("request through another relay answered %v", resp)
+				}
+				if out := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac, dhcpv4.WithGatewayIP(relayB))); out != nil {
+					t.Errorf("discover through another relay answered %v", out)
+				}
+				if err != nil || !rec.Relay.Equal(relayA) {
+					t.Errorf("lease %+v not held behind %s: %v", rec, relayA, err)
+				}
+				if resp := requestThrough(t, p, mac, ip, relayA); resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+					t.Errorf("request through the relay of the lease answered %v", resp)
+				}
+			}
+
+			want := policy + " from relay 192.0.2.1 to 192.0.2.2"
+			eventually(t, "the roam event", func() bool { return len(events.of(EventRoam)) > 0 })
+			if ev := events.of(EventRoam)[0]; ev.MAC != mac || !ev.IP.Equal(ip) || ev.Detail != want {
+				t.Errorf("roam event %+v, want %q", ev, want)
+			}
+			if s := p.Stats(); s.RelayMoves == 0 || s.RelayFlaps != 0 {
+				t.Errorf("%d moves and %d flaps", s.RelayMoves, s.RelayFlaps)
+			}
+		})
+	}
+}
+
+func TestFlapDetection(t *testing.T) {
+	m := miniredis.RunT(t)
+	// the flaps are reported whatever the policy
+	p := startPlugin(t, m, "10.0.38.10", "10.0.38.20", "1h", "roaming=hold", "flap_threshold=3", "flap_window=1m")
+	events := recordEvents(p)
+	const mac = "00:11:22:33:44:0a"
+	ip := leaseThrough(t, p, mac, relayA)
+
+	for i := 0; i < 3; i++ {
+		requestThrough(t, p, mac, ip, relayB)
+		advance(p, 10*time.Second)
+	}
+	eventually(t, "the flap event", func() bool { return len(events.of(EventFlap)) == 1 })
+	if ev := events.of(EventFlap)[0]; ev.MAC != mac || ev.Detail != "3 moves, last from relay 192.0.2.1 to 192.0.2.2" {
+		t.Errorf("flap event %+v", ev)
+	}
+
+	// the moves out of the window are forgotten
+	advance(p, time.Minute)
+	requestThrough(t, p, mac, ip, relayB)
+	if s := p.Stats(); s.RelayMoves != 4 || s.RelayFlaps != 1 {
+		t.Errorf("%d moves and %d flaps, want 4 and 1", s.RelayMoves, s.RelayFlaps)
+	}
+	if n := p.flaps.len(); n != 1 {
+		t.Errorf("%d clients tracked", n)
+	}
+}
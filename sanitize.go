@@ -0,0 +1,63 @@
+package rangeredisplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+	// default limits of the client and relay supplied strings, in bytes
+	defaultMaxHostname  = 255
+	defaultMaxAgentInfo = 128
+	// maxRecordBytes bounds the size of a serialized record
+	maxRecordBytes = 4096
+	// truncatedMark ends the strings cut to their limit
+	truncatedMark = "..."
+)
+
+// sanitize makes a client or relay supplied string safe to store, log and
+// export: invalid UTF-8 and control characters are replaced by '?', and a
+// string longer than max bytes is cut and ends with truncatedMark.
+func sanitize(s string, max int) string {
+	s = strings.ToValidUTF8(s, "?")
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return '?'
+		}
+		return r
+	}, s)
+	if len(s) <= max {
+		return s
+	}
+	cut := max - len(truncatedMark)
+	if cut < 0 {
+		cut = 0
+	}
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + truncatedMark
+}
+
+// encodeRecord serializes a record, failing with ErrRecordTooLarge rather
+// than writing an oversized value
+func encodeRecord(record *Record) ([]byte, error) {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxRecordBytes {
+		return nil, fmt.Errorf("%w: %d bytes for %s, at most %d", ErrRecordTooLarge, len(b), record.IP, maxRecordBytes)
+	}
+	return b, nil
+}
+
+// hostname returns the sanitized host name (option 12) of req
+func (p *PluginState) hostname(req *dhcpv4.DHCPv4) string {
+	return sanitize(req.HostName(), p.cfg.MaxHostname)
+}
@@ -0,0 +1,125 @@
+package rangeredisplugin
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestSanitize(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"laptop", 255, "laptop"},
+		{"lap\x00top\n", 255, "lap?top?"},
+		{"caf\xc3", 255, "caf?"},
+		{"\x1b[31mred", 255, "?[31mred"},
+		{"abcdefghij", 10, "abcdefghij"},
+		{"abcdefghijk", 10, "abcdefg..."},
+		// the cut does not split a rune
+		{"abcdeféghij", 10, "abcdef..."},
+		{"abcdefghijk", 3, "..."},
+	} {
+		if got := sanitize(tc.in, tc.max); got != tc.want {
+			t.Errorf("sanitize(%q, %d) = %q, want %q", tc.in, tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestRecordTooLarge(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.30.10", "10.0.30.20", "1h")
+	const mac = "00:11:22:33:44:0a"
+	rec := &Record{IP: net.IPv4(10, 0, 30, 10), Expires: time.Now().Add(time.Hour), Hostname: strings.Repeat("a", maxRecordBytes)}
+	if err := p.storage.SaveRecord(mac, rec); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("SaveRecord of an oversized record: %v, want ErrRecordTooLarge", err)
+	}
+	if err := p.storage.CommitAllocation(mac, rec); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("CommitAllocation of an oversized record: %v, want ErrRecordTooLarge", err)
+	}
+	for _, key := range []string{"main", "shadow", "index"} {
+		for _, k := range m.Keys() {
+			if strings.HasPrefix(k, keyPrefix(p, key)) {
+				t.Errorf("%s written for an oversized record", k)
+			}
+		}
+	}
+}
+
+func TestOversizedHostname(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.30.10", "10.0.30.20", "1h", "max_hostname=32")
+	const mac = "00:11:22:33:44:0a"
+	huge := dhcpv4.WithOption(dhcpv4.OptHostName(strings.Repeat("a\x00", 32<<10)))
+	offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac, huge))
+	if offer == nil {
+		t.Fatal("no offer to a client with an oversized host name")
+	}
+	ack := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac, huge,
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(offer.YourIPAddr))))
+	if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("request answered %v", ack)
+	}
+	rec, err := p.storage.GetRecord(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat("a?", 14) + "a" + truncatedMark; rec.Hostname != want {
+		t.Errorf("stored host name %q, want %q", rec.Hostname, want)
+	}
+}
+
+func FuzzSanitize(f *testing.F) {
+	f.Add("laptop", 255)
+	f.Add("caf\xc3\xa9\x00\xff", 5)
+	f.Add(strings.Repeat("é", 200), 64)
+	f.Fuzz(func(t *testing.T, s string, max int) {
+		if max <= len(truncatedMark) || max > 1<<16 {
+			return
+		}
+		got := sanitize(s, max)
+		if len(got) > max || !utf8.ValidString(got) || strings.IndexFunc(got, unicode.IsControl) >= 0 {
+			t.Errorf("sanitize(%q, %d) = %q", s, max, got)
+		}
+	})
+}
+
+// FuzzIngestion feeds client and relay supplied strings through the
+// ingestion of a record
+func FuzzIngestion(f *testing.F) {
+	cfg, err := parseConfig([]string{"redis://localhost:6379/0", "10.0.30.10", "10.0.30.20", "1h",
+		"agent_decoder_relay=192.0.2.1:ascii,192.0.2.2:hex,192.0.2.3:tlv"})
+	if err != nil {
+		f.Fatal(err)
+	}
+	p := &PluginState{cfg: cfg}
+	f.Add("laptop", juniperCircuit, ciscoRemote, byte(1))
+	f.Add(strings.Repeat("\x00\xff", 300), huaweiRemote, isamCircuit, byte(3))
+	f.Add("", []byte{0x00, 0xff, 0x01}, []byte{}, byte(2))
+	f.Fuzz(func(t *testing.T, hostname string, circuit, remote []byte, relay byte) {
+		req := relayed(t, "00:11:22:33:44:0a", net.IPv4(192, 0, 2, relay%4), circuit, remote)
+		req.UpdateOption(dhcpv4.OptHostName(hostname))
+		rec := Record{IP: net.IPv4(10, 0, 30, 10), Expires: time.Now(), Hostname: p.hostname(req)}
+		p.decodeAgentInfo(req).apply(&rec)
+		for field, s := range map[string]string{"hostname": rec.Hostname, "circuit-id": rec.CircuitID, "remote-id": rec.RemoteID} {
+			if !utf8.ValidString(s) || strings.IndexFunc(s, unicode.IsControl) >= 0 {
+				t.Errorf("unsanitized %s %q", field, s)
+			}
+		}
+		if len(rec.Hostname) > cfg.MaxHostname || len(rec.CircuitID) > cfg.MaxAgentInfo || len(rec.RemoteID) > cfg.MaxAgentInfo {
+			t.Errorf("unbounded record %+v", rec)
+		}
+		if _, err := encodeRecord(&rec); err != nil {
+			t.Errorf("record of bounded strings not encoded: %v", err)
+		}
+	})
+}
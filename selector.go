@@ -0,0 +1,95 @@
+package rangeredisplugin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// RelayDirect selects the clients on the link of the server, whose
+// requests come through no relay
+const RelayDirect = "direct"
+
+// RelaySelector picks the requests an instance serves by the relay they
+// came through, so that instances sharing a server each serve the VLANs
+// of their relays. The zero value selects every request.
+type RelaySelector struct {
+	Relays []*net.IPNet
+	// Direct selects the requests of the clients on the link of the server
+	Direct bool
+}
+
+// parseRelaySelector parses a list of relay addresses or subnets, and of
+// RelayDirect, e.g. 10.1.0.1,10.2.0.0/16,direct
+func parseRelaySelector(val string) (RelaySelector, error) {
+	var s RelaySelector
+	for _, entry := range strings.Split(val, ",") {
+		if entry == RelayDirect {
+			s.Direct = true
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			entry += "/32"
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil || n.IP.To4() == nil {
+			return RelaySelector{}, fmt.Errorf("invalid relay %q, want an IPv4 address, subnet or %s", entry, RelayDirect)
+		}
+		s.Relays = append(s.Relays, n)
+	}
+	if len(s.Relays) == 0 && !s.Direct {
+		return RelaySelector{}, errors.New("no relay given")
+	}
+	return s, nil
+}
+
+// any reports whether the selector selects every request
+func (s RelaySelector) any() bool {
+	return len(s.Relays) == 0 && !s.Direct
+}
+
+func (s RelaySelector) String() string {
+	if s.any() {
+		return "any"
+	}
+	var names []string
+	for _, n := range s.Relays {
+		names = append(names, n.String())
+	}
+	if s.Direct {
+		names = append(names, RelayDirect)
+	}
+	return strings.Join(names, ",")
+}
+
+// MarshalText makes the selector read as its argument in the effective
+// configuration
+func (s RelaySelector) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// selects reports whether the instance serves req. A renewal unicast by a
+// client shows no relay, and is served by the instance whose ranges hold
+// the address of the client, or which leased it.
+func (p *PluginState) selects(req *dhcpv4.DHCPv4) bool {
+	s := p.cfg.Relays
+	if s.any() {
+		return true
+	}
+	relay := relayOf(req)
+	switch {
+	case relay == nil:
+		return p.inRange(req.ClientIPAddr) || p.leases.macOf(req.ClientIPAddr) != ""
+	case relay.IsUnspecified():
+		return s.Direct
+	}
+	for _, n := range s.Relays {
+		if n.Contains(relay) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestParseRelaySelector(t *testing.T) {
+	s, err := parseRelaySelector("10.60.0.1,10.61.0.0/16,direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.String(); got != "10.60.0.1/32,10.61.0.0/16,direct" {
+		t.Errorf("selector %s", got)
+	}
+	if got := (RelaySelector{}).String(); got != "any" {
+		t.Errorf("zero selector %s", got)
+	}
+	for _, val := range []string{"", "10.60.0.1,", "2001:db8::1", "relay"} {
+		if _, err := parseRelaySelector(val); err == nil {
+			t.Errorf("%q accepted", val)
+		}
+	}
+}
+
+func TestRelaySelection(t *testing.T) {
+	m := miniredis.RunT(t)
+	a := startPlugin(t, m, "10.0.60.10", "10.0.60.20", "1h", "relay=10.60.0.1")
+	b := startPlugin(t, m, "10.0.61.10", "10.0.61.20", "1h", "relay=10.61.0.0/16,direct")
+	relayA, relayB := net.IPv4(10, 60, 0, 1).To4(), net.IPv4(10, 61, 3, 1).To4()
+	const mac = "00:11:22:33:44:0a"
+
+	// offered returns the address offered by p to a DISCOVER through
+	// relay, nil if p passed it on
+	offered := func(p *PluginState, relay net.IP) net.IP {
+		t.Helper()
+		var mods []dhcpv4.Modifier
+		if relay != nil {
+			mods = append(mods, dhcpv4.WithGatewayIP(relay))
+		}
+		reply := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, mac, mods...))
+		if reply == nil || reply.YourIPAddr.IsUnspecified() {
+			return nil
+		}
+		return reply.YourIPAddr
+	}
+	for _, tc := range []struct {
+		name  string
+		relay net.IP
+		a, b  bool
+	}{
+		{"relay of a", relayA, true, false},
+		{"relay of b", relayB, false, true},
+		{"direct", nil, false, true},
+		{"unknown relay", net.IPv4(10, 62, 0, 1), false, false},
+	} {
+		if got := offered(a, tc.relay) != nil; got != tc.a {
+			t.Errorf("%s: offer of a %t, want %t", tc.name, got, tc.a)
+		}
+		if got := offered(b, tc.relay) != nil; got != tc.b {
+			t.Errorf("%s: offer of b %t, want %t", tc.name, got, tc.b)
+		}
+	}
+	if sa, sb := a.Stats().RelayPassed, b.Stats().RelayPassed; sa != 3 || sb != 2 {
+		t.Errorf("passed %d by a and %d by b, want 3 and 2", sa, sb)
+	}
+
+	// a unicast renewal goes to the instance holding the address
+	ip := requestThrough(t, a, mac, offered(a, relayA), relayA).YourIPAddr
+	renew := newRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithClientIP(ip))
+	if reply := exchange(t, a, renew); reply == nil || reply.MessageType() != dhcpv4.MessageTypeAck {
+		t.Errorf("renewal through a: %v", reply)
+	}
+	if reply := exchange(t, b, newRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithClientIP(ip))); reply == nil || reply.MessageType() != dhcpv4.MessageTypeAck || !reply.YourIPAddr.IsUnspecified() {
+		t.Errorf("renewal through b not passed on: %v", reply)
+	}
+	if rec, err := a.storage.GetRecord(mac); err != nil || rec.Pool != a.poolName() {
+		t.Errorf("record %+v of pool %s: %v", rec, a.poolName(), err)
+	}
+
+	hw, _ := net.ParseMAC(mac)
+	ev, err := b.Evaluate(context.Background(), EvaluationRequest{MAC: hw, GatewayIP: relayA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Action != ActionPass || ev.Reason != ReasonRelay {
+		t.Errorf("Evaluate through the relay of a: %s", ev)
+	}
+}
+
+func TestForeignStatic(t *testing.T) {
+	m := miniredis.RunT(t)
+	a := startPlugin(t, m, "10.0.62.10", "10.0.62.20", "1h")
+	b := startPlugin(t, m, "10.0.63.10", "10.0.63.20", "1h")
+	const ofB, ofNone = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+	static := func(ip string, pool string) *Record {
+		rec := boundRecord(ip, time.Hour)
+		rec.Static, rec.Pool = true, pool
+		return rec
+	}
+	if err := a.storage.SaveRecord(ofB, static("10.0.99.10", b.poolName())); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.storage.SaveRecord(ofNone, static("10.0.99.11", "")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the static lease of b is not reloaded by a, one of no pool is
+	a = startPlugin(t, m, "10.0.62.10", "10.0.62.20", "1h")
+	if ip := a.leases.ipOf(ofB); ip != nil {
+		t.Errorf("static lease %s of another pool reloaded", ip)
+	}
+	if ip := a.leases.ipOf(ofNone); ip == nil {
+		t.Error("static lease of no pool not reloaded")
+	}
+}
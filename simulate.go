@@ -0,0 +1,61 @@
+package rangeredisplugin
+
+import (
+	"fmt"
+	"sort"
+)
+
+// InvariantReport is the outcome of CheckInvariants
+type InvariantReport struct {
+	Leases int
+	// Utilization is the share of the pool leased
+	Utilization float64
+	// Violations lists the broken invariants, empty if all hold
+	Violations []string
+}
+
+// CheckInvariants checks that no address is leased twice and that the
+// allocator agrees with redis, as the simulator does at the end of a
+// replay, see the testing/simulator package. With check_invariants set,
+// the reference model is compared with redis too.
+func (p *PluginState) CheckInvariants() (*InvariantReport, error) {
+	records, err := p.storage.GetAllRecords()
+	if err != nil {
+		return nil, err
+	}
+	return &InvariantReport{
+		Leases:      len(records),
+		Utilization: float64(len(records)) / float64(p.cfg.size()),
+		Violations:  p.checkInvariants(records),
+	}, nil
+}
+
+// Storage returns the storage of the instance, e.g. to program faults
+// into it
+func (p *PluginState) Storage() *RedisProvider {
+	return p.storage
+}
+
+// checkInvariants compares the stored records with the in-memory state
+func (p *PluginState) checkInvariants(records map[string]Record) []string {
+	var violations []string
+	owners := make(map[string]string)
+	for mac, rec := range records {
+		ip := rec.IP.String()
+		if owner, ok := owners[ip]; ok {
+			violations = append(violations, fmt.Sprintf("%s is leased to both %s and %s", ip, owner, mac))
+		}
+		owners[ip] = mac
+		if held := p.leases.ipOf(mac); !rec.IP.Equal(held) {
+			violations = append(violations, fmt.Sprintf("%s holds %s in redis but %v in the allocator", mac, ip, held))
+		}
+	}
+	if n := p.leases.len(); n != len(records) {
+		violations = append(violations, fmt.Sprintf("%d leases in the allocator, %d in redis", n, len(records)))
+	}
+	if p.model != nil {
+		violations = append(violations, p.model.diff(records)...)
+	}
+	sort.Strings(violations)
+	return violations
+}
@@ -0,0 +1,205 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// size of the queue of each event sink
+	sinkQueueSize = 1024
+	// number of attempts to deliver an event to a RetryingEventSink
+	sinkAttempts = 3
+	// delay before the first retry, doubled after each attempt
+	sinkRetryDelay = 100 * time.Millisecond
+	// minimum time between two warnings about the same sink falling behind
+	sinkWarnInterval = time.Minute
+)
+
+// RetryingEventSink is an EventSink reporting its delivery failures. Failed
+// deliveries are retried with an exponential backoff before being dropped.
+type RetryingEventSink interface {
+	EventSink
+	TryHandleEvent(Event) error
+}
+
+// NamedEventSink is an EventSink with a name used in stats and logs
+type NamedEventSink interface {
+	EventSink
+	Name() string
+}
+
+// SinkStats holds the delivery statistics of one event sink
+type SinkStats struct {
+	Name    string
+	Queued  int
+	Dropped uint64
+	Failed  uint64
+}
+
+// sinkQueue buffers the events of one sink, so that a slow sink only drops
+// its own events
+type sinkQueue struct {
+	name    string
+	sink    EventSink
+	ch      chan Event
+	done    chan struct{}
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+	// local is set for the sinks of the instance, e.g. the neighbor table,
+	// which keep the identities of the clients on the host and get them in
+	// privacy mode too
+	local bool
+
+	warnMu   sync.Mutex
+	lastWarn time.Time
+
+	// closeCh and closeSink are done by the first close reaching them, a
+	// close timing out being retried by the next one
+	closeCh, closeSink sync.Once
+}
+
+func newSinkQueue(s EventSink) *sinkQueue {
+	name := fmt.Sprintf("%T", s)
+	if n, ok := s.(NamedEventSink); ok {
+		name = n.Name()
+	}
+	return &sinkQueue{
+		name: name,
+		sink: s,
+		ch:   make(chan Event, sinkQueueSize),
+		done: make(chan struct{}),
+	}
+}
+
+// push queues an event without blocking, dropping it if the queue is full
+func (q *sinkQueue) push(ev Event) {
+	select {
+	case q.ch <- ev:
+	default:
+		q.dropped.Add(1)
+		q.warn()
+	}
+}
+
+// warn logs that the sink falls behind, at most once per sinkWarnInterval
+func (q *sinkQueue) warn() {
+	q.warnMu.Lock()
+	defer q.warnMu.Unlock()
+	if time.Since(q.lastWarn) < sinkWarnInterval {
+		return
+	}
+	q.lastWarn = time.Now()
+	log.Warnf("event sink %s is falling behind, %d events dropped so far", q.name, q.dropped.Load())
+}
+
+// run delivers the queued events until the queue is closed
+func (q *sinkQueue) run() {
+	defer close(q.done)
+	for ev := range q.ch {
+		q.deliver(ev)
+	}
+}
+
+func (q *sinkQueue) deliver(ev Event) {
+	r, ok := q.sink.(RetryingEventSink)
+	if !ok {
+		deliver(q.sink, ev)
+		return
+	}
+
+	delay := sinkRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := tryDeliver(r, ev)
+		if err == nil {
+			return
+		}
+		if attempt == sinkAttempts {
+			q.failed.Add(1)
+			log.Warnf("event sink %s failed to handle %s event after %d attempts: %v", q.name, ev.Type, attempt, err)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// tryDeliver hands an event to a sink, turning its panics into errors
+func tryDeliver(s RetryingEventSink, ev Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.TryHandleEvent(ev)
+}
+
+// close stops accepting events and waits until the queued ones are
+// delivered, then closes the sink if it is an io.Closer. It can be called
+// again once it timed out.
+func (q *sinkQueue) close(ctx context.Context) error {
+	q.closeCh.Do(func() { close(q.ch) })
+	select {
+	case <-q.done:
+	case <-ctx.Done():
+		return fmt.Errorf("event sink %s: %d events not flushed: %w", q.name, len(q.ch), ctx.Err())
+	}
+	var err error
+	q.closeSink.Do(func() {
+		if c, ok := q.sink.(io.Closer); ok {
+			if cerr := c.Close(); cerr != nil {
+				err = fmt.Errorf("event sink %s: %w", q.name, cerr)
+			}
+		}
+	})
+	return err
+}
+
+func (q *sinkQueue) stats() SinkStats {
+	return SinkStats{
+		Name:    q.name,
+		Queued:  len(q.ch),
+		Dropped: q.dropped.Load(),
+		Failed:  q.failed.Load(),
+	}
+}
+
+// Close stops the event delivery of the instance: the events queued for
+// each sink are flushed until ctx is done, and sinks implementing io.Closer
+// are closed. Events emitted afterwards are dropped. The first call also
+// releases the storage, closing it if no other instance shares it.
+func (p *PluginState) Close(ctx context.Context) error {
+	first := false
+	p.closeOnce.Do(func() {
+		close(p.closing)
+		first = true
+	})
+	<-p.dispatched
+	<-p.adoptions.flushed
+
+	p.queuesMu.Lock()
+	queues := p.queues
+	p.queuesMu.Unlock()
+
+	var errs []error
+	for _, q := range queues {
+		if err := q.close(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if first && p.unlisten != nil {
+		if err := p.storage.Unregister(ctx, p.id); err != nil {
+			errs = append(errs, err)
+		}
+		p.unlisten()
+		if err := ReleaseStorage(p.storage); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,185 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// slowSink is a sink stuck on its first event until released
+type slowSink struct {
+	release chan struct{}
+	handled atomic.Int64
+	closed  atomic.Bool
+}
+
+func newSlowSink() *slowSink {
+	return &slowSink{release: make(chan struct{})}
+}
+
+func (s *slowSink) Name() string { return "slow" }
+
+func (s *slowSink) HandleEvent(Event) {
+	<-s.release
+	s.handled.Add(1)
+}
+
+func (s *slowSink) Close() error {
+	s.closed.Store(true)
+	return nil
+}
+
+// flakySink fails the delivery of each event fails times before handling it
+type flakySink struct {
+	mu       sync.Mutex
+	fails    int
+	attempts map[EventType]int
+	handled  []Event
+}
+
+func (s *flakySink) HandleEvent(ev Event) { _ = s.TryHandleEvent(ev) }
+
+func (s *flakySink) TryHandleEvent(ev Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attempts == nil {
+		s.attempts = make(map[EventType]int)
+	}
+	s.attempts[ev.Type]++
+	if s.attempts[ev.Type] <= s.fails {
+		return errors.New("webhook unavailable")
+	}
+	s.handled = append(s.handled, ev)
+	return nil
+}
+
+// addSink makes s a sink of p
+func addSink(p *PluginState, s EventSink) {
+	p.queuesMu.Lock()
+	p.sinks = append(p.sinks, s)
+	p.queuesMu.Unlock()
+}
+
+// sinkStatsOf returns the stats of the sink named name
+func sinkStatsOf(t *testing.T, p *PluginState, name string) SinkStats {
+	t.Helper()
+	for _, s := range p.Stats().Sinks {
+		if s.Name == name {
+			return s
+		}
+	}
+	t.Fatalf("no stats of sink %s", name)
+	return SinkStats{}
+}
+
+func TestSlowSinkIsolated(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.1.0.10", "10.1.0.200", "1h")
+	slow := newSlowSink()
+	defer close(slow.release)
+	addSink(p, slow)
+	fast := recordEvents(p)
+
+	// the leases are answered while the slow sink holds its first event
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		lease(t, p, fmt.Sprintf("00:11:22:33:44:%02x", i))
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("50 leases took %s with a sink stuck", elapsed)
+	}
+	eventually(t, "the grants delivered", func() bool { return len(fast.of(EventGrant)) == 50 })
+
+	// enough events to fill the queue of the slow sink, in batches the
+	// dispatcher keeps up with
+	const n = sinkQueueSize + 500
+	for sent := 0; sent < n; sent += 100 {
+		for i := 0; i < 100; i++ {
+			p.emit(Event{Type: EventExpire, MAC: "00:11:22:33:44:ff"})
+		}
+		eventually(t, "the batch delivered", func() bool { return len(fast.of(EventExpire)) == sent+100 })
+	}
+	if dropped := p.counters.eventsDropped.Load(); dropped != 0 {
+		t.Errorf("%d events dropped for all the sinks", dropped)
+	}
+	s := sinkStatsOf(t, p, "slow")
+	if s.Queued != sinkQueueSize || s.Dropped == 0 {
+		t.Errorf("slow sink stats %+v, want a full queue and drops", s)
+	}
+	if fs := sinkStatsOf(t, p, "*rangeredisplugin.eventRecorder"); fs.Dropped != 0 {
+		t.Errorf("recorder stats %+v, want no drops", fs)
+	}
+}
+
+func TestSinkRetries(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.1.0.10", "10.1.0.200", "1h")
+	recovering := &flakySink{fails: sinkAttempts - 1}
+	failing := &flakySink{fails: sinkAttempts}
+	addSink(p, recovering)
+	addSink(p, failing)
+
+	p.emit(Event{Type: EventGrant, MAC: "00:11:22:33:44:55"})
+	eventually(t, "the retries", func() bool {
+		failing.mu.Lock()
+		defer failing.mu.Unlock()
+		return failing.attempts[EventGrant] == sinkAttempts
+	})
+	eventually(t, "the event handled after the failures", func() bool {
+		recovering.mu.Lock()
+		defer recovering.mu.Unlock()
+		return len(recovering.handled) == 1
+	})
+
+	eventually(t, "the failure counted", func() bool {
+		for _, s := range p.Stats().Sinks {
+			if s.Failed == 1 {
+				return true
+			}
+		}
+		return false
+	})
+	failing.mu.Lock()
+	defer failing.mu.Unlock()
+	if len(failing.handled) != 0 {
+		t.Error("event handled after the last attempt")
+	}
+}
+
+func TestCloseFlushTimeout(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.1.0.10", "10.1.0.200", "1h")
+	slow := newSlowSink()
+	addSink(p, slow)
+	fast := recordEvents(p)
+	for i := 0; i < 3; i++ {
+		p.emit(Event{Type: EventGrant, MAC: "00:11:22:33:44:55"})
+	}
+	eventually(t, "the events delivered", func() bool { return len(fast.of(EventGrant)) == 3 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := p.Close(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "event sink slow") {
+		t.Errorf("Close with a sink stuck: %v, want the sink named", err)
+	}
+	if slow.closed.Load() {
+		t.Error("sink closed before its events were flushed")
+	}
+
+	// closed once flushed
+	close(slow.release)
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := slow.handled.Load(); n != 3 || !slow.closed.Load() {
+		t.Errorf("%d events flushed, sink closed %v, want 3 and closed", n, slow.closed.Load())
+	}
+}
@@ -0,0 +1,555 @@
+package rangeredisplugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// REDIS_SPLIT_KEY holds the pool split in progress, and
+// REDIS_SPLIT_MOVED_KEY the bindings of its sub-range taken over by the
+// target, mapping their MAC address to the ID of the instance, in the
+// default namespace
+const (
+	REDIS_SPLIT_KEY       = "x:dhcp:split"
+	REDIS_SPLIT_MOVED_KEY = "x:dhcp:split:moved"
+)
+
+// default time the source of a split keeps renewing the bindings of the
+// sub-range, shortening them to end by then
+const defaultSplitGrace = time.Hour
+
+// Roles of an instance in a pool split
+const (
+	// SplitSource is the instance whose range contains the sub-range
+	SplitSource = "source"
+	// SplitTarget is an instance whose range lies within the sub-range
+	SplitTarget = "target"
+)
+
+// ErrSplitRunning is returned when a split is started while one is in
+// progress
+var ErrSplitRunning = errors.New("a pool split is already in progress")
+
+// moveBindingScript hands a binding over to the target of a split, if the
+// reverse index still names its client.
+// KEYS: index entry, moved bindings. ARGV: MAC address, target ID
+var moveBindingScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+return 1
+`)
+
+// PoolSplit carves the sub-range Start-End out of the pool of its source
+// for another instance, the target. The source stops allocating from the
+// sub-range at once, shortens the leases it renews there to end by the
+// Deadline and stops renewing them then. The target, started with the
+// sub-range as its range, loads the bindings from the shared storage and
+// takes them over one by one as their clients renew.
+type PoolSplit struct {
+	Start net.IP
+	End   net.IP
+	// From is the ID of the source, To the ID or the host name of the
+	// target
+	From     string
+	To       string
+	Started  time.Time
+	Deadline time.Time
+	// Finished is set once the source gave the sub-range up for good
+	Finished bool `json:",omitempty"`
+}
+
+func (s *PoolSplit) String() string {
+	return fmt.Sprintf("split of %s-%s to %s", s.Start, s.End, s.To)
+}
+
+func (s *PoolSplit) contains(ip net.IP) bool {
+	return ipRange{Start: s.Start.To4(), End: s.End.To4()}.contains(ip)
+}
+
+// names reports whether the target of the split is the instance reg
+func (s *PoolSplit) names(reg Registration) bool {
+	return s.To == reg.ID || s.To == reg.Host
+}
+
+// SplitProgress is the state of the bindings of a split sub-range, as seen
+// by one of its instances
+type SplitProgress struct {
+	PoolSplit
+	Role    string
+	Sampled time.Time
+	// Moved counts the bindings taken over by the target, and Remaining
+	// those of the instance not taken over yet
+	Moved     int
+	Remaining int
+	// Done is set on the source once the deadline passed and it holds no
+	// binding of the sub-range anymore, and on both once it is finished
+	Done bool
+}
+
+// BeginSplit stores a new split, failing if another one is in progress
+func (r *RedisProvider) BeginSplit(ctx context.Context, s *PoolSplit) error {
+	val, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	ok, err := r.rdb.SetNX(ctx, r.ns.split, val, 0).Result()
+	if err != nil {
+		return unavailable(err)
+	}
+	if !ok {
+		return ErrSplitRunning
+	}
+	return nil
+}
+
+// SaveSplit rewrites the split in progress
+func (r *RedisProvider) SaveSplit(ctx context.Context, s *PoolSplit) error {
+	return r.saveCheckpoint(ctx, r.ns.split, s)
+}
+
+// LoadSplit returns the split in progress, or nil
+func (r *RedisProvider) LoadSplit(ctx context.Context) (*PoolSplit, error) {
+	s := &PoolSplit{}
+	ok, err := r.loadCheckpoint(ctx, r.ns.split, s)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return s, nil
+}
+
+// EndSplit deletes the split and its moved bindings
+func (r *RedisProvider) EndSplit(ctx context.Context) error {
+	return unavailable(r.rdb.Del(ctx, r.ns.split, r.ns.splitMoved).Err())
+}
+
+// MoveBinding hands the binding of mac on ip over to the instance id.
+// Returns false if the reverse index names another client.
+func (r *RedisProvider) MoveBinding(ctx context.Context, mac string, ip net.IP, id string) (bool, error) {
+	n, err := moveBindingScript.Run(ctx, r.rdb,
+		[]string{r.ns.index + ip.String(), r.ns.splitMoved}, mac, id).Int()
+	if err != nil {
+		return false, unavailable(err)
+	}
+	return n == 1, nil
+}
+
+// BindingMoved reports whether the binding of mac was taken over
+func (r *RedisProvider) BindingMoved(ctx context.Context, mac string) (bool, error) {
+	ok, err := r.rdb.HExists(ctx, r.ns.splitMoved, mac).Result()
+	return ok, unavailable(err)
+}
+
+// MovedBindings returns the bindings taken over, MAC address to instance
+func (r *RedisProvider) MovedBindings(ctx context.Context) (map[string]string, error) {
+	moved, err := r.rdb.HGetAll(ctx, r.ns.splitMoved).Result()
+	return moved, unavailable(err)
+}
+
+// poolSplit is the split an instance takes part in
+type poolSplit struct {
+	// applying serializes the changes of split, followed from the control
+	// channel and from the storage
+	applying sync.Mutex
+
+	mu    sync.Mutex
+	split *PoolSplit
+	role  string
+	// withheld are the addresses of the sub-range kept out of the
+	// allocator of the source: free at the start of the split or since
+	withheld []net.IP
+	// taken are the bindings of the sub-range served by the target: taken
+	// over, or granted by it
+	taken map[string]bool
+	// aborted is set on the target of an aborted split, which stops
+	// answering
+	aborted  bool
+	progress *SplitProgress
+}
+
+func (s *poolSplit) get() (*PoolSplit, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.split, s.role
+}
+
+func (s *poolSplit) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.withheld) + len(s.taken)
+}
+
+// splitRole returns the role of the instance in split s, if any
+func (p *PluginState) splitRole(s *PoolSplit) string {
+	switch {
+	case s == nil:
+		return ""
+	case s.contains(p.cfg.Start) && s.contains(p.cfg.End):
+		return SplitTarget
+	case p.inRange(s.Start) && p.inRange(s.End):
+		return SplitSource
+	}
+	return ""
+}
+
+// splitTarget reports whether the instance is the target of a split, and
+// shares the storage with its source
+func (p *PluginState) splitTarget() bool {
+	_, role := p.split.get()
+	return role == SplitTarget
+}
+
+// splitAborted reports whether the split the instance was the target of
+// was aborted
+func (p *PluginState) splitAborted() bool {
+	p.split.mu.Lock()
+	defer p.split.mu.Unlock()
+	return p.split.aborted
+}
+
+// StartSplit starts carving start-end out of the range of the instance for
+// the instance to, named by its ID or its host name. The bindings of the
+// sub-range are renewed for grace at most, and left to the target then.
+func (p *PluginState) StartSplit(ctx context.Context, start, end net.IP, to string, grace time.Duration) error {
+	start, end = start.To4(), end.To4()
+	if start == nil || end == nil || bytes.Compare(start, end) > 0 {
+		return errors.New("invalid sub-range")
+	}
+	if to == "" {
+		return errors.New("the target of the split must be named")
+	}
+	if grace < 0 {
+		return errors.New("the grace period cannot be negative")
+	}
+	now := p.clock.Now()
+	s := &PoolSplit{Start: start, End: end, From: p.id, To: to, Started: now, Deadline: now.Add(grace)}
+	if p.splitRole(s) != SplitSource {
+		return fmt.Errorf("%s-%s is not a part of the range %s", start, end, p.poolName())
+	}
+	if err := p.storage.BeginSplit(ctx, s); err != nil {
+		return err
+	}
+	p.applySplit(s)
+	return nil
+}
+
+// AbortSplit cancels the split in progress: the source serves the whole
+// sub-range again and the target stops answering. Aborting a finished
+// split only deletes it, once the source no longer has the sub-range.
+func (p *PluginState) AbortSplit(ctx context.Context) error {
+	if err := p.storage.EndSplit(ctx); err != nil {
+		return err
+	}
+	p.applySplit(nil)
+	return nil
+}
+
+// FinishSplit gives the sub-range up for good, once the source holds no
+// binding in it anymore. The instance must be the source.
+func (p *PluginState) FinishSplit(ctx context.Context) error {
+	s, role := p.split.get()
+	if s == nil || role != SplitSource {
+		return errors.New("not the source of a split")
+	}
+	prog, err := p.sampleSplit(ctx)
+	if err != nil {
+		return err
+	}
+	if !prog.Done {
+		return fmt.Errorf("%s in progress: %d bindings left, deadline %s",
+			s, prog.Remaining, s.Deadline.Format(time.RFC3339))
+	}
+	finished := *s
+	finished.Finished = true
+	if err := p.storage.SaveSplit(ctx, &finished); err != nil {
+		return err
+	}
+	p.applySplit(&finished)
+	return nil
+}
+
+// loadSplit records the split stored in redis at startup, before the
+// registration and the leases are loaded. The source withholds the
+// sub-range once they are, see withholdSplit.
+func (p *PluginState) loadSplit(ctx context.Context) error {
+	s, err := p.storage.LoadSplit(ctx)
+	if err != nil {
+		return err
+	}
+	role := p.splitRole(s)
+	p.split.mu.Lock()
+	p.split.split, p.split.role = s, role
+	p.split.mu.Unlock()
+	if role != "" {
+		log.Infof("%s in progress, instance is the %s", s, role)
+	}
+	return nil
+}
+
+// followSplit follows the split stored by another instance
+func (p *PluginState) followSplit(ctx context.Context) error {
+	s, err := p.storage.LoadSplit(ctx)
+	if err != nil {
+		return err
+	}
+	p.applySplit(s)
+	return nil
+}
+
+// applySplit moves the instance to split s, nil once it is over
+func (p *PluginState) applySplit(s *PoolSplit) {
+	p.split.applying.Lock()
+	defer p.split.applying.Unlock()
+
+	prev, role := p.split.get()
+	if prev != nil && s != nil && (!prev.Start.Equal(s.Start) || !prev.End.Equal(s.End) || !prev.Started.Equal(s.Started)) {
+		// another split replaced the one we knew of
+		p.endSplit(prev, role)
+		prev, role = nil, ""
+	}
+	switch {
+	case prev == nil && s != nil:
+		role = p.splitRole(s)
+		p.split.mu.Lock()
+		p.split.split, p.split.role, p.split.aborted = s, role, false
+		p.split.progress = nil
+		p.split.mu.Unlock()
+		if role == SplitSource {
+			p.withholdSplit()
+		}
+		if role != "" {
+			log.Infof("%s started, instance is the %s, grace until %s", s, role, s.Deadline.Format(time.RFC3339))
+		}
+	case prev != nil && s == nil:
+		p.endSplit(prev, role)
+	case prev != nil && s != nil:
+		p.split.mu.Lock()
+		p.split.split = s
+		p.split.mu.Unlock()
+		if s.Finished && !prev.Finished && role != "" {
+			log.Infof("%s finished", s)
+		}
+	}
+}
+
+// endSplit leaves split s, in which the instance had role
+func (p *PluginState) endSplit(s *PoolSplit, role string) {
+	p.split.mu.Lock()
+	p.split.split, p.split.role, p.split.progress = nil, "", nil
+	withheld := p.split.withheld
+	p.split.withheld, p.split.taken = nil, nil
+	if role == SplitTarget && !s.Finished {
+		p.split.aborted = true
+	}
+	p.split.mu.Unlock()
+
+	switch {
+	case role == "" || s.Finished:
+		if role != "" {
+			log.Infof("%s cleared", s)
+		}
+	case role == SplitSource:
+		p.releaseSplit(s, withheld)
+		log.Warnf("%s aborted, serving the sub-range again", s)
+	case role == SplitTarget:
+		log.Errorf("%s aborted: the source serves the sub-range again, no longer answering", s)
+	}
+}
+
+// withholdSplit takes the free addresses of the sub-range out of the
+// allocator of the source, so that nothing new is leased there
+func (p *PluginState) withholdSplit() {
+	s, _ := p.split.get()
+	start, end := binary.BigEndian.Uint32(s.Start.To4()), binary.BigEndian.Uint32(s.End.To4())
+	var withheld []net.IP
+	for n := start; n <= end && n >= start; n++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, n)
+		if p.leases.macOf(ip) != "" {
+			continue
+		}
+		// taken addresses are excluded, reserved or quarantined
+		if _, err := allocateExact(p.allocator, net.IPNet{IP: ip}); err == nil {
+			withheld = append(withheld, ip)
+		}
+	}
+	p.split.mu.Lock()
+	p.split.withheld = append(p.split.withheld, withheld...)
+	p.split.mu.Unlock()
+	log.Infof("%s: %d free addresses withheld", s, len(withheld))
+}
+
+// keepForSplit notes ip, freed and kept withheld for the target, if it is
+// in the sub-range split off, so that it returns to the allocator should
+// the split be aborted
+func (p *PluginState) keepForSplit(ip net.IP) {
+	p.split.mu.Lock()
+	defer p.split.mu.Unlock()
+	s := p.split.split
+	if s == nil || p.split.role != SplitSource || !s.contains(ip) {
+		return
+	}
+	p.split.withheld = append(p.split.withheld, ip)
+}
+
+// splitOff reports whether ip is in the sub-range split off the pool
+func (p *PluginState) splitOff(ip net.IP) bool {
+	p.split.mu.Lock()
+	defer p.split.mu.Unlock()
+	s := p.split.split
+	return s != nil && p.split.role == SplitSource && s.contains(ip)
+}
+
+// releaseSplit serves the sub-range of an aborted split again: the
+// bindings taken over return to the source, the withheld addresses free
+// of them to the allocator
+func (p *PluginState) releaseSplit(s *PoolSplit, withheld []net.IP) {
+	records, err := p.storage.GetAllRecords()
+	if err != nil {
+		log.Errorf("%s: could not reload the bindings taken over: %v", s, err)
+	}
+	for mac, rec := range records {
+		if s.contains(rec.IP) && p.leases.macOf(rec.IP) == "" {
+			// the allocator held the address meanwhile
+			p.leases.set(mac, rec.IP)
+		}
+	}
+	for _, ip := range withheld {
+		if p.leases.macOf(ip) != "" {
+			continue
+		}
+		if err := p.allocator.Free(net.IPNet{IP: ip, Mask: net.IPv4Mask(255, 255, 255, 255)}); err != nil {
+			log.Errorf("could not return %s to the pool: %v", ip, err)
+		}
+	}
+}
+
+// splitLeaves reports whether the source of a split leaves a request to
+// the target: the binding of the client, or the address it asks for, is in
+// the sub-range, and the binding was taken over, was never ours, or its
+// grace is over. moved is set for a binding taken over. Otherwise, the
+// deadline the binding must end by is returned, zero outside of a split.
+func (p *PluginState) splitLeaves(ctx context.Context, mac string, record *Record, want net.IP, now time.Time) (leave, moved bool, deadline time.Time) {
+	s, role := p.split.get()
+	if role != SplitSource {
+		return false, false, time.Time{}
+	}
+	if record == nil {
+		return want != nil && s.contains(want), false, time.Time{}
+	}
+	if !s.contains(record.IP) {
+		return false, false, time.Time{}
+	}
+	if s.Finished || !now.Before(s.Deadline) || !record.IP.Equal(p.leases.ipOf(mac)) {
+		return true, false, time.Time{}
+	}
+	moved, err := p.storage.BindingMoved(ctx, mac)
+	if err != nil {
+		// keep serving the client until the deadline
+		log.Warnf("could not check whether the binding of MAC %s was taken over: %v", mac, err)
+		return false, false, s.Deadline
+	}
+	if moved {
+		return true, true, time.Time{}
+	}
+	return false, false, s.Deadline
+}
+
+// takeOverBinding takes the binding of record over from the source of a
+// split, if the instance is its target. Returns false if the binding cannot
+// be taken over, and must be left to the source.
+func (p *PluginState) takeOverBinding(mac string, record *Record) bool {
+	s, role := p.split.get()
+	if role != SplitTarget || s.Finished || record == nil || !s.contains(record.IP) {
+		return true
+	}
+	p.split.mu.Lock()
+	taken := p.split.taken[mac]
+	p.split.mu.Unlock()
+	if taken {
+		return true
+	}
+	// a binding written by the instance was granted by it, or taken over
+	// before it restarted: it is not counted as taken over again
+	if record.Pool != p.poolName() {
+		ok, err := p.storage.MoveBinding(context.TODO(), mac, record.IP, p.id)
+		if err != nil {
+			log.Errorf("%s: could not take the binding of %s for MAC %s over: %v", s, record.IP, mac, err)
+			return false
+		}
+		if !ok {
+			log.Warnf("%s: binding of %s for MAC %s not in the index, left to the source", s, record.IP, mac)
+			return false
+		}
+		log.Infof("%s: took the binding of %s for MAC %s over", s, record.IP, mac)
+	}
+	p.split.mu.Lock()
+	if p.split.taken == nil {
+		p.split.taken = make(map[string]bool)
+	}
+	p.split.taken[mac] = true
+	p.split.mu.Unlock()
+	return true
+}
+
+// sampleSplit counts the bindings of the sub-range taken over, and those
+// of the instance left
+func (p *PluginState) sampleSplit(ctx context.Context) (*SplitProgress, error) {
+	s, role := p.split.get()
+	if s == nil || role == "" {
+		return nil, nil
+	}
+	moved, err := p.storage.MovedBindings(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := p.clock.Now()
+	prog := &SplitProgress{PoolSplit: *s, Role: role, Sampled: now, Moved: len(moved)}
+	p.split.mu.Lock()
+	served := make(map[string]bool, len(p.split.taken))
+	for mac := range p.split.taken {
+		served[mac] = true
+	}
+	p.split.mu.Unlock()
+	for mac, ip := range p.leases.snapshot() {
+		if _, ok := moved[mac]; !ok && !served[mac] && s.contains(net.ParseIP(ip)) {
+			prog.Remaining++
+		}
+	}
+	prog.Done = s.Finished || (role == SplitSource && !now.Before(s.Deadline) && prog.Remaining == 0)
+
+	p.split.mu.Lock()
+	if p.split.split == s {
+		p.split.progress = prog
+	}
+	p.split.mu.Unlock()
+	return prog, nil
+}
+
+// splitProgress returns the last sampled progress of the split, or nil
+func (p *PluginState) splitProgress() *SplitProgress {
+	p.split.mu.Lock()
+	defer p.split.mu.Unlock()
+	return p.split.progress
+}
+
+// heartbeatSplit follows the split in progress and samples its progress
+func (p *PluginState) heartbeatSplit(ctx context.Context) {
+	if err := p.followSplit(ctx); err != nil {
+		log.Warnf("could not read the pool split: %v", err)
+		return
+	}
+	if _, err := p.sampleSplit(ctx); err != nil {
+		log.Warnf("could not sample the progress of the pool split: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// splitPool leases the 10 addresses of the source 10.0.46.10-10.0.46.19
+// and two of the sub-range 10.0.46.20-10.0.46.29, to a and b, then splits
+// the sub-range off to an instance of this host with a grace of 30m, and
+// starts it
+func splitPool(t *testing.T, m *miniredis.Miniredis, a, b string) (source, target *PluginState, ipA, ipB net.IP) {
+	t.Helper()
+	source = startPlugin(t, m, "10.0.46.10", "10.0.46.29", "1h")
+	for i := 0; i < 10; i++ {
+		lease(t, source, net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x0a, byte(i)}.String())
+	}
+	ipA, ipB = lease(t, source, a), lease(t, source, b)
+	if !ipA.Equal(net.IPv4(10, 0, 46, 20)) || !ipB.Equal(net.IPv4(10, 0, 46, 21)) {
+		t.Fatalf("leased %s and %s in the sub-range", ipA, ipB)
+	}
+	host, _ := os.Hostname()
+	if err := source.StartSplit(context.Background(), net.IPv4(10, 0, 46, 20), net.IPv4(10, 0, 46, 29), host, 30*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// the target registers over the range of its source
+	target = startPlugin(t, m, "10.0.46.20", "10.0.46.29", "1h")
+	return source, target, ipA, ipB
+}
+
+func TestPoolSplit(t *testing.T) {
+	m := miniredis.RunT(t)
+	const a, b, c = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c"
+	p, q, ipA, ipB := splitPool(t, m, a, b)
+	ctx := context.Background()
+	if err := p.StartSplit(ctx, net.IPv4(10, 0, 46, 28), net.IPv4(10, 0, 46, 29), "other", time.Hour); err != ErrSplitRunning {
+		t.Errorf("second split started: %v", err)
+	}
+
+	// the source allocates nothing more in the sub-range, and renews its
+	// bindings there up to the deadline only
+	if offer := exchange(t, p, newRequest(t, dhcpv4.MessageTypeDiscover, c)); offer != nil {
+		t.Errorf("source offered %s during the split", offer.YourIPAddr)
+	}
+	advance(p, 10*time.Minute)
+	ack := exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, b, dhcpv4.WithClientIP(ipB)))
+	if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck || ack.IPAddressLeaseTime(0) != 20*time.Minute {
+		t.Fatalf("renewal at the source during the grace answered %v", ack)
+	}
+
+	// the target takes a over as it renews, and leases the free addresses
+	if typ := renewal(t, q, a, ipA); typ != dhcpv4.MessageTypeAck {
+		t.Fatalf("renewal at the target answered %s", typ)
+	}
+	if typ := renewal(t, p, a, ipA); typ != dhcpv4.MessageTypeNone {
+		t.Errorf("renewal at the source of a binding taken over answered %s", typ)
+	}
+	if ip := lease(t, q, c); !ip.Equal(net.IPv4(10, 0, 46, 22)) {
+		t.Errorf("target leased %s", ip)
+	}
+	if err := p.FinishSplit(ctx); err == nil {
+		t.Error("split finished with a binding left before the deadline")
+	}
+	if prog := p.Stats().Split; prog == nil || prog.Role != SplitSource || prog.Moved != 1 || prog.Remaining != 1 || prog.Done {
+		t.Errorf("progress of the source %+v", progressOf(prog))
+	}
+	// the lease granted by the target is not one taken over
+	q.heartbeatSplit(ctx)
+	if prog := q.Stats().Split; prog == nil || prog.Role != SplitTarget || prog.Moved != 1 || prog.Remaining != 1 {
+		t.Errorf("progress of the target %+v", progressOf(prog))
+	}
+
+	// past the deadline, the source leaves the binding of b to the target
+	advance(p, 20*time.Minute)
+	if typ := renewal(t, p, b, ipB); typ != dhcpv4.MessageTypeNone {
+		t.Errorf("renewal at the source past the deadline answered %s", typ)
+	}
+	if typ := renewal(t, q, b, ipB); typ != dhcpv4.MessageTypeAck {
+		t.Errorf("renewal at the target past the deadline answered %s", typ)
+	}
+	if err := p.FinishSplit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	p.heartbeatSplit(ctx)
+	q.heartbeatSplit(ctx)
+	for _, prog := range []*SplitProgress{p.Stats().Split, q.Stats().Split} {
+		if prog == nil || !prog.Done || !prog.Finished || prog.Moved != 2 || prog.Remaining != 0 {
+			t.Errorf("progress once finished %+v", progressOf(prog))
+		}
+	}
+	assertIndexed(t, m, q)
+}
+
+func TestPoolSplitAbort(t *testing.T) {
+	m := miniredis.RunT(t)
+	const a, b, c = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c"
+	p, q, ipA, _ := splitPool(t, m, a, b)
+	ctx := context.Background()
+	if typ := renewal(t, q, a, ipA); typ != dhcpv4.MessageTypeAck {
+		t.Fatalf("renewal at the target answered %s", typ)
+	}
+
+	// the source serves the whole sub-range again, the target stops
+	if err := p.AbortSplit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	q.heartbeatSplit(ctx)
+	if typ := renewal(t, q, a, ipA); typ != dhcpv4.MessageTypeNone {
+		t.Errorf("renewal at the target of an aborted split answered %s", typ)
+	}
+	if typ := renewal(t, p, a, ipA); typ != dhcpv4.MessageTypeAck {
+		t.Errorf("renewal at the source of a binding given back answered %s", typ)
+	}
+	if ip := lease(t, p, c); !ip.Equal(net.IPv4(10, 0, 46, 22)) {
+		t.Errorf("source leased %s after the abort", ip)
+	}
+	if p.Stats().Split != nil || m.Exists(REDIS_SPLIT_KEY) || m.Exists(REDIS_SPLIT_MOVED_KEY) {
+		t.Error("split left after the abort")
+	}
+}
+
+// progressOf formats the counts of prog, hidden by the String of the split
+func progressOf(prog *SplitProgress) string {
+	if prog == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%s %s: %d moved, %d remaining, done %t, finished %t", &prog.PoolSplit, prog.Role, prog.Moved, prog.Remaining, prog.Done, prog.Finished)
+}
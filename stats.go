@@ -0,0 +1,268 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+const (
+	// interval between two periodic summaries in the log
+	summaryInterval = 10 * time.Minute
+	// interval between two samples of the connection pool statistics
+	poolSampleInterval = time.Minute
+)
+
+// counters are the monotonic counters of a plugin instance
+type counters struct {
+	externalReassignments atomic.Uint64
+	eventsDropped         atomic.Uint64
+	rejectedHWAddrs       atomic.Uint64
+	disallowedHWAddrs     atomic.Uint64
+	migratedKeys          atomic.Uint64
+	idleReclaims          atomic.Uint64
+	leaseLimitRefusals    atomic.Uint64
+	ignoredNotifications  atomic.Uint64
+	observationsDropped   atomic.Uint64
+	slowPathRejected      atomic.Uint64
+	killSwitchPassed      atomic.Uint64
+	relayPassed           atomic.Uint64
+	typePassed            atomic.Uint64
+	replayedReplies       atomic.Uint64
+	trimmedReplies        atomic.Uint64
+	relayMoves            atomic.Uint64
+	relayFlaps            atomic.Uint64
+	allocatedLeases       atomic.Uint64
+	adoptedLeases         atomic.Uint64
+	adoptionFallbacks     atomic.Uint64
+}
+
+// Stats is a point-in-time snapshot of the plugin's runtime statistics
+type Stats struct {
+	Leases int
+	// DynamicLeases are the leases within the range, StaticLeases the
+	// static addresses adopted outside of it. They add up to Leases.
+	DynamicLeases int
+	StaticLeases  int
+	// ExternalReassignments counts records found rewritten by another
+	// writer, which usually means something else writes to our keyspace
+	ExternalReassignments uint64
+	EventsDropped         uint64
+	// NotificationsDropped counts the notifications dropped while the
+	// instance fell behind, after which its leases are swept for ended ones
+	NotificationsDropped uint64
+	// RejectedHardwareAddresses counts the requests dropped because of an
+	// unsupported hardware type or a malformed address
+	RejectedHardwareAddresses uint64
+	// DisallowedHardwareAddresses counts the requests dropped for a MAC
+	// address matching none of the allowed prefixes
+	DisallowedHardwareAddresses uint64
+	// MigratedKeys counts the records found under a legacy key of their
+	// client, and moved to its current key
+	MigratedKeys uint64
+	// IdleReclaims counts the leases shortened by the idle reclaim
+	IdleReclaims uint64
+	// IgnoredNotifications counts the expiry notifications of keys that
+	// are not shadow keys of this plugin, e.g. of another application
+	IgnoredNotifications uint64
+	// ObservationsDropped counts the ARP observations over the rate limit
+	ObservationsDropped uint64
+	// SlowPathInUse is the number of new allocations in progress, and
+	// SlowPathRejected counts those refused for waiting too long for a slot
+	SlowPathInUse    int
+	SlowPathRejected uint64
+	// AllocatedLeases counts the leases of addresses picked from the pool,
+	// and AdoptedLeases those of addresses clients renewed without a record,
+	// e.g. after redis lost its data. AdoptionsPending is the number of
+	// adoptions waiting to be committed, and AdoptionFallbacks counts the
+	// commits retried alone after their batch failed.
+	AllocatedLeases   uint64
+	AdoptedLeases     uint64
+	AdoptionsPending  int
+	AdoptionFallbacks uint64
+	// RelayMoves counts the clients with a lease seen behind another relay,
+	// and RelayFlaps the flap events raised for them
+	RelayMoves uint64
+	RelayFlaps uint64
+	// KillSwitch is the kill switch in effect, and KillSwitchPassed counts
+	// the packets it passed on
+	KillSwitch       *KillSwitch `json:",omitempty"`
+	KillSwitchPassed uint64
+	// RelayPassed counts the requests passed on as relayed through none of
+	// the relays of the instance, see RelaySelector
+	RelayPassed uint64
+	// TypePassed counts the messages of a type the plugin does not act on,
+	// e.g. DHCPINFORMs, passed on to the next plugins
+	TypePassed uint64
+	// ReplayedReplies counts the copies of a request received within the
+	// replay window, answered with the reply to the first copy
+	ReplayedReplies uint64
+	// TrimmedReplies counts the replies over the maximum message size of
+	// their client, whose least needed options were dropped, see fitReply
+	TrimmedReplies uint64
+	// OpLogDropped counts the operations logged but not appended to the
+	// stream of the operation log
+	OpLogDropped uint64
+	// Refusals counts the clients refused or dropped, by reason
+	Refusals RefusalStats
+	// Pressure is the last sampled utilization of all the pools
+	Pressure *PressureStatus `json:",omitempty"`
+	// Ramp is the last sampled progress of the lease ramp in progress
+	Ramp *RampProgress `json:",omitempty"`
+	// Split is the last sampled progress of the pool split in progress
+	Split *SplitProgress `json:",omitempty"`
+	// LeaseLimit describes the lease limits, if any
+	LeaseLimit *LeaseLimitStatus `json:",omitempty"`
+	// Frozen describes the frozen addresses, unless the freeze is disabled
+	Frozen *FreezeStatus `json:",omitempty"`
+	// Structures holds the number of entries of each in-memory structure
+	Structures map[string]int
+	// Sinks holds the queue depth and drop totals of every event sink
+	Sinks  []SinkStats
+	Memory *MemoryReport `json:",omitempty"`
+	// Pool holds the connection pool statistics of the primary endpoint
+	Pool *redis.PoolStats `json:",omitempty"`
+	// Commands holds the latency of the redis commands by name
+	Commands map[string]CommandLatency
+}
+
+// Stats returns a snapshot of the current statistics
+func (p *PluginState) Stats() Stats {
+	bindings := p.leases.snapshot()
+	static := 0
+	for _, ip := range bindings {
+		if !p.inRange(net.ParseIP(ip)) {
+			static++
+		}
+	}
+	return Stats{
+		Leases:                      len(bindings),
+		DynamicLeases:               len(bindings) - static,
+		StaticLeases:                static,
+		ExternalReassignments:       p.counters.externalReassignments.Load(),
+		EventsDropped:               p.counters.eventsDropped.Load(),
+		NotificationsDropped:        p.listener.Dropped(),
+		RejectedHardwareAddresses:   p.counters.rejectedHWAddrs.Load(),
+		DisallowedHardwareAddresses: p.counters.disallowedHWAddrs.Load(),
+		MigratedKeys:                p.counters.migratedKeys.Load(),
+		IdleReclaims:                p.counters.idleReclaims.Load(),
+		IgnoredNotifications:        p.counters.ignoredNotifications.Load(),
+		ObservationsDropped:         p.counters.observationsDropped.Load(),
+		SlowPathInUse:               p.slowPath.inUse(),
+		SlowPathRejected:            p.counters.slowPathRejected.Load(),
+		AllocatedLeases:             p.counters.allocatedLeases.Load(),
+		AdoptedLeases:               p.counters.adoptedLeases.Load(),
+		AdoptionsPending:            p.adoptions.len(),
+		AdoptionFallbacks:           p.counters.adoptionFallbacks.Load(),
+		RelayMoves:                  p.counters.relayMoves.Load(),
+		RelayFlaps:                  p.counters.relayFlaps.Load(),
+		KillSwitch:                  p.kill.active(),
+		KillSwitchPassed:            p.counters.killSwitchPassed.Load(),
+		RelayPassed:                 p.counters.relayPassed.Load(),
+		TypePassed:                  p.counters.typePassed.Load(),
+		ReplayedReplies:             p.counters.replayedReplies.Load(),
+		TrimmedReplies:              p.counters.trimmedReplies.Load(),
+		OpLogDropped:                p.oplog.streamDropped(),
+		Refusals:                    p.refusals.stats(),
+		Pressure:                    p.pressure.get(),
+		Ramp:                        p.rampProgress(),
+		Split:                       p.splitProgress(),
+		LeaseLimit:                  p.leaseLimitStatus(),
+		Frozen:                      p.freezeStatus(),
+		Structures:                  p.structureSizes(),
+		Sinks:                       p.sinkStats(),
+		Memory:                      p.storage.LastMemoryReport(),
+		Pool:                        p.storage.PoolStats(),
+		Commands:                    p.storage.CommandLatencies(),
+	}
+}
+
+// logMemoryReport writes the outcome of a memory sampling run to the log
+func logMemoryReport(m *MemoryReport) {
+	for name, c := range m.Categories {
+		log.Infof("memory: %d %s keys, ~%d bytes each, ~%d bytes total (%d sampled)",
+			c.Keys, name, c.AverageBytes(), c.EstimatedBytes, c.Sampled)
+	}
+	log.Infof("memory: ~%d bytes per lease record, ~%d bytes total", m.PerRecordBytes(), m.TotalBytes())
+}
+
+// summaryLoop periodically refreshes the sampled statistics and logs a
+// summary, and watches the connection pool for timeouts in between.
+func (p *PluginState) summaryLoop() {
+	summary := time.NewTicker(summaryInterval)
+	defer summary.Stop()
+	pool := time.NewTicker(poolSampleInterval)
+	defer pool.Stop()
+
+	timeouts := p.storage.PoolStats().Timeouts
+	for {
+		select {
+		case <-pool.C:
+			timeouts = checkPoolTimeouts(p.storage.PoolStats(), timeouts)
+		case <-summary.C:
+			p.sampleMemory()
+			p.sampleRamp(context.TODO())
+			p.offers.prune(p.clock.Now(), p.cfg.OfferInterval)
+			p.replies.prune(p.clock.Now())
+			p.deny.prune(p.clock.Now())
+			p.checkMemoryBudget()
+			s := p.Stats()
+			log.Infof("summary: %d leases, %d external reassignments, %d events dropped, %d hardware addresses rejected",
+				s.Leases, s.ExternalReassignments, s.EventsDropped, s.RejectedHardwareAddresses)
+			log.Infof("summary: pool %d conns (%d idle, %d stale), %d hits, %d misses, %d timeouts",
+				s.Pool.TotalConns, s.Pool.IdleConns, s.Pool.StaleConns, s.Pool.Hits, s.Pool.Misses, s.Pool.Timeouts)
+			if s.KillSwitch != nil {
+				log.Warnf("summary: %s active since %s, %d packets passed on",
+					s.KillSwitch, s.KillSwitch.Since.Format(time.RFC3339), s.KillSwitchPassed)
+			}
+			if s.Split != nil {
+				log.Infof("summary: %s, %s: %d bindings taken over, %d left here",
+					&s.Split.PoolSplit, s.Split.Role, s.Split.Moved, s.Split.Remaining)
+			}
+			if s.LeaseLimit != nil && s.LeaseLimit.Reached {
+				log.Warnf("summary: lease limit reached (pool %d, global %d), %d allocations refused",
+					s.LeaseLimit.Pool, s.LeaseLimit.Global, s.LeaseLimit.Refusals)
+			}
+			if len(s.Refusals.Reasons) > 0 {
+				log.Infof("summary: refusals %s", s.Refusals)
+			}
+		}
+	}
+}
+
+// checkPoolTimeouts warns if the pool timed out waiting for a connection
+// since the previous sample, and returns the current count.
+func checkPoolTimeouts(s *redis.PoolStats, last uint32) uint32 {
+	if s.Timeouts > last {
+		log.Warnf("redis connection pool timed out %d times in the last %s (%d conns, %d idle), "+
+			"consider raising pool_size in the uri", s.Timeouts-last, poolSampleInterval, s.TotalConns, s.IdleConns)
+	}
+	return s.Timeouts
+}
+
+// sampleMemory refreshes the memory report and logs it
+func (p *PluginState) sampleMemory() {
+	m, err := p.storage.MemoryUsage(context.TODO())
+	if err != nil {
+		if err != ErrMemoryUnsupported {
+			log.Warnf("could not sample memory usage: %v", err)
+		}
+		return
+	}
+	logMemoryReport(m)
+}
+
+// sinkStats returns the statistics of the event sinks
+func (p *PluginState) sinkStats() []SinkStats {
+	p.queuesMu.Lock()
+	defer p.queuesMu.Unlock()
+
+	stats := make([]SinkStats, 0, len(p.queues))
+	for _, q := range p.queues {
+		stats = append(stats, q.stats())
+	}
+	return stats
+}
@@ -0,0 +1,70 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestPoolTimeouts(t *testing.T) {
+	m := miniredis.RunT(t)
+	r, err := InitStorage(redisURI(m)+"?pool_size=1&pool_timeout=50ms", StorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := r.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	before := r.PoolStats()
+	if before.Timeouts != 0 {
+		t.Fatalf("pool stats %+v after a ping", *before)
+	}
+
+	// the only connection is taken, the next command waits for it in vain
+	conn := r.rdb.Conn()
+	defer conn.Close()
+	if err := conn.Ping(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := r.GetRecord("00:11:22:33:44:55"); !errors.Is(err, ErrStorageUnavailable) {
+			t.Fatalf("GetRecord with the pool exhausted: %v", err)
+		}
+	}
+	after := r.PoolStats()
+	if after.Timeouts != 3 {
+		t.Errorf("%d pool timeouts sampled, want 3", after.Timeouts)
+	}
+	if got := checkPoolTimeouts(after, before.Timeouts); got != 3 {
+		t.Errorf("checkPoolTimeouts returned %d, want 3", got)
+	}
+	if got := checkPoolTimeouts(after, after.Timeouts); got != 3 {
+		t.Errorf("checkPoolTimeouts without new timeouts returned %d, want 3", got)
+	}
+}
+
+func TestPoolStatsReported(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.4.0.10", "10.4.0.20", "1h")
+	lease(t, p, "00:11:22:33:44:55")
+
+	s := p.Stats()
+	if s.Pool == nil || s.Pool.TotalConns == 0 || s.Pool.Hits+s.Pool.Misses == 0 {
+		t.Errorf("stats report pool %+v", s.Pool)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if h := p.Health(ctx); h.Pool == nil || h.Pool.TotalConns == 0 {
+		t.Errorf("health report %+v without the pool stats", h)
+	}
+
+	m.SetError("ERR server is shutting down")
+	defer m.SetError("")
+	if h := p.Health(ctx); h.Status != HealthUnhealthy || h.Pool == nil {
+		t.Errorf("health report %+v of a failing redis, want unhealthy with the pool stats", h)
+	}
+}
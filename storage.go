@@ -3,109 +3,558 @@ package rangeredisplugin
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v9"
 )
 
+// REDIS_KEY_PREFIX and REDIS_SHADOW_KEY_PREFIX prefix the main and the
+// shadow keys of the records of the default namespace, see keySpace
 const REDIS_KEY_PREFIX = "dhcp:"
 const REDIS_SHADOW_KEY_PREFIX = "s:dhcp:"
 
+// REDIS_EXPORT_STATE_KEY holds the checkpoint of an interrupted export, in the
+// default namespace
+const REDIS_EXPORT_STATE_KEY = "x:dhcp:export"
+
+// REDIS_EXTEND_STATE_KEY holds the checkpoint of an interrupted bulk extension,
+// in the default namespace
+const REDIS_EXTEND_STATE_KEY = "x:dhcp:extend"
+
 // Record holds an IP lease record
 type Record struct {
 	IP      net.IP
 	Expires time.Time
+	// normalized relay agent information of the last request
+	CircuitID string `json:",omitempty"`
+	RemoteID  string `json:",omitempty"`
+	// Relay is the relay the last broadcast request came through, 0.0.0.0
+	// for a client on the link of the server
+	Relay net.IP `json:",omitempty"`
+	// Policy describes the lease policy the expiry was computed with, and
+	// Pressure the pressure band in effect then, if any
+	Policy   string `json:",omitempty"`
+	Pressure string `json:",omitempty"`
+	// Hostname is the host name option of the last request naming one
+	Hostname string `json:",omitempty"`
+	// Static is set for an address assigned by an earlier plugin. Outside
+	// of the range, it has no allocator entry.
+	Static bool `json:",omitempty"`
+	// Labels are set by the operator, see REDIS_LABELS_KEY
+	Labels map[string]string `json:",omitempty"`
+	// PrefixLength is the length of a delegated IPv6 prefix, 0 for an
+	// address
+	PrefixLength int `json:",omitempty"`
+	// State is StateOffered for an address offered to a DISCOVER and not
+	// yet requested, which lives for the offer hold only. Records stored
+	// before offers were recorded are bound.
+	State string `json:",omitempty"`
+	// LastSeen is the last request of the client persisted, kept fresh
+	// within half the idle time when the idle reclaim is enabled
+	LastSeen time.Time `json:",omitempty"`
+	// Pool names the pool of the instance that last wrote the lease, see
+	// poolName
+	Pool string `json:",omitempty"`
+	// Link is the MAC address of the DHCPv4 lease of the host of a DHCPv6
+	// lease, whose DUID carries it, see REDIS_LINK_KEY_PREFIX
+	Link string `json:",omitempty"`
 }
 
+// States of a record
+const (
+	StateOffered = "offered"
+	StateBound   = "bound"
+)
+
+// offered reports whether the record is an offer not yet requested
+func (r *Record) offered() bool {
+	return r.State == StateOffered
+}
+
+// RedisProvider stores the lease records in redis, see LeaseStore
 type RedisProvider struct {
 	rdb    *redis.Client
 	SubExp *redis.PubSub
+
+	// ns names the keys of the records
+	ns keySpace
+
+	// faults are injected into the primary endpoint, in tests only
+	faults *faultInjector
+
+	// secondary is the legacy endpoint written to during a migration
+	secMu     sync.RWMutex
+	secondary *redis.Client
+
+	// history is the endpoint storing the past bindings
+	history       *redis.Client
+	historyLength int
+
+	// tolerance is the tolerance of the expiry comparisons
+	tolerance time.Duration
+
+	mem memorySampler
+
+	// caps are the capabilities of the primary endpoint
+	caps StorageCapabilities
+
+	// latency times the commands of all the endpoints
+	latency *latencyHook
+
+	// key and refs register the provider for sharing, see AcquireStorage
+	key  string
+	refs int
+
+	listenMu  sync.Mutex
+	listeners map[*Listener]struct{}
+}
+
+// StorageOptions holds the optional settings of a RedisProvider
+type StorageOptions struct {
+	// SecondaryURI enables the dual-write migration mode: writes are
+	// mirrored to the secondary endpoint and reads fall back to it.
+	SecondaryURI string
+	// HistoryURI is the endpoint of the binding history, the primary if empty
+	HistoryURI string
+	// HistoryLength is the number of bindings kept per MAC, 0 disables it
+	HistoryLength int
+	// ExpiryTolerance is the tolerance of the expiry comparisons
+	ExpiryTolerance time.Duration
+	// Faults enables the fault injection in builds with the faults tag,
+	// see Fault
+	Faults bool
+	// KeyPrefix is the prefix of the main keys of the records, naming their
+	// namespace, REDIS_KEY_PREFIX if empty
+	KeyPrefix string
 }
 
 // Establish connection with Redis. The connStr should be in format
 // "redis://<user>:<pass>@localhost:6379/<db>"
-func InitStorage(connStr string) (*RedisProvider, error) {
-	r := &RedisProvider{}
+func InitStorage(connStr string, opts StorageOptions) (*RedisProvider, error) {
+	r := &RedisProvider{ns: defaultKeySpace}
+	if opts.KeyPrefix != "" {
+		r.ns = newKeySpace(opts.KeyPrefix)
+	}
+	r.latency = newLatencyHook(r.ns)
 
-	opt, err := redis.ParseURL(connStr)
+	opt, err := parseURI(connStr)
 	if err != nil {
 		return nil, err
 	}
 
-	r.rdb = redis.NewClient(opt)
-	_, err = r.rdb.Ping(context.TODO()).Result()
+	r.rdb, r.caps, err = connect(opt, "uri")
 	if err != nil {
 		return nil, err
 	}
+	r.rdb.AddHook(r.latency)
+	if opts.Faults {
+		r.enableFaults()
+	}
+
+	if opts.SecondaryURI != "" {
+		secOpt, err := parseURI(opts.SecondaryURI)
+		if err != nil {
+			return nil, err
+		}
+		if r.secondary, _, err = connect(secOpt, "secondary_uri"); err != nil {
+			if errors.Is(err, errNoDatabase) {
+				return nil, err
+			}
+			r.secondary = redis.NewClient(secOpt)
+			log.Warnf("secondary storage %s is unreachable: %v", redactURI(opts.SecondaryURI), err)
+		}
+		r.secondary.AddHook(r.latency)
+		log.Infof("migration mode: mirroring writes to %s", redactURI(opts.SecondaryURI))
+	}
+
+	r.history = r.rdb
+	r.historyLength = opts.HistoryLength
+	r.tolerance = opts.ExpiryTolerance
+	if opts.HistoryURI != "" {
+		histOpt, err := parseURI(opts.HistoryURI)
+		if err != nil {
+			return nil, err
+		}
+		if r.history, _, err = connect(histOpt, "history_uri"); err != nil {
+			return nil, fmt.Errorf("history storage is unreachable: %w", err)
+		}
+		r.history.AddHook(r.latency)
+	}
 
-	// subscribe to expire info
-	r.SubExp = r.rdb.Subscribe(context.TODO(), "__keyevent@0__:expired")
+	// subscribe to expire info and to the control channel, and wait for the
+	// confirmations so that no notification published after setup is missed
+	channels := []string{expiredChannel(opt.DB), REDIS_CONTROL_CHANNEL}
+	r.SubExp = r.rdb.Subscribe(context.TODO(), channels...)
+	for range channels {
+		msg, err := r.SubExp.Receive(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("could not subscribe to notifications: %w", err)
+		}
+		if _, ok := msg.(*redis.Subscription); !ok {
+			return nil, fmt.Errorf("unexpected %T while subscribing to notifications", msg)
+		}
+	}
 
-	log.Infof("set storage to %s", connStr)
+	log.Infof("set storage to %s (databases: %t)", redactURI(connStr), r.caps.Select)
 	return r, nil
 }
 
+// parseURI parses the redis URI connStr. The errors of the parser quote
+// the URI, so they are reported with its password redacted.
+func parseURI(connStr string) (*redis.Options, error) {
+	opt, err := redis.ParseURL(connStr)
+	if err != nil {
+		return nil, errors.New(strings.ReplaceAll(err.Error(), connStr, redactURI(connStr)))
+	}
+	return opt, nil
+}
+
+// ErrNotificationsDisabled means redis does not publish the expiry
+// notifications the plugin relies on to free addresses
+var ErrNotificationsDisabled = errors.New("keyevent notifications for expired keys are disabled, " +
+	"set notify-keyspace-events to include E and x (e.g. Ex)")
+
+// CheckNotifications verifies that the primary endpoint publishes keyevent
+// notifications for expired keys. Without them leases are never freed.
+func (r *RedisProvider) CheckNotifications(ctx context.Context) error {
+	cfg, err := r.rdb.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		return unavailable(err)
+	}
+	flags := cfg["notify-keyspace-events"]
+	if !strings.Contains(flags, "E") || !strings.ContainsAny(flags, "xA") {
+		return fmt.Errorf("%w (currently %q)", ErrNotificationsDisabled, flags)
+	}
+	return nil
+}
+
+// Ping checks that the primary endpoint is reachable
+func (r *RedisProvider) Ping(ctx context.Context) error {
+	return unavailable(r.rdb.Ping(ctx).Err())
+}
+
+// PoolStats returns the connection pool statistics of the primary endpoint
+func (r *RedisProvider) PoolStats() *redis.PoolStats {
+	return r.rdb.PoolStats()
+}
+
+// getSecondary returns the secondary client, or nil outside of migration mode
+func (r *RedisProvider) getSecondary() *redis.Client {
+	r.secMu.RLock()
+	defer r.secMu.RUnlock()
+	return r.secondary
+}
+
+// Cutover ends the migration mode: the secondary endpoint is dropped and all
+// subsequent reads and writes only go to the primary.
+func (r *RedisProvider) Cutover() error {
+	r.secMu.Lock()
+	sec := r.secondary
+	r.secondary = nil
+	r.secMu.Unlock()
+
+	if sec == nil {
+		return nil
+	}
+	log.Infof("migration cutover: secondary storage dropped")
+	return sec.Close()
+}
+
 // Get Record from Redis. Records are identified by MAC address and a prefix.
+// Returns ErrNotFound if there is no record for mac. In migration mode, a
+// record missing from the primary is looked up in the secondary and copied
+// back to the primary.
 func (r *RedisProvider) GetRecord(mac string) (*Record, error) {
+	record, err := r.getRecord(r.rdb, mac)
+	if !errors.Is(err, ErrNotFound) {
+		return record, err
+	}
+
+	sec := r.getSecondary()
+	if sec == nil {
+		return nil, err
+	}
+	secRecord, secErr := r.getRecord(sec, mac)
+	if secErr != nil {
+		if !errors.Is(secErr, ErrNotFound) {
+			log.Warnf("could not read record for %s from secondary storage: %v", mac, secErr)
+		}
+		return nil, err
+	}
+	if !r.endsBy(secRecord.Expires, time.Now()) {
+		if err := r.saveRecord(r.rdb, mac, secRecord); err != nil {
+			log.Warnf("could not backfill record for %s from secondary storage: %v", mac, err)
+		} else if err := r.refreshIndex(mac, secRecord); err != nil {
+			log.Warnf("could not backfill index entry of %s for %s: %v", secRecord.IP, mac, err)
+		}
+	}
+	return secRecord, nil
+}
+
+func (r *RedisProvider) getRecord(rdb *redis.Client, mac string) (*Record, error) {
 	record := Record{}
 
-	val, err := r.rdb.Get(context.TODO(), REDIS_KEY_PREFIX+mac).Result()
+	val, err := rdb.Get(context.TODO(), r.ns.main+mac).Result()
 	if err != nil {
 		if err == redis.Nil {
-			return &record, nil
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, mac)
 		}
-		return nil, err
+		return nil, unavailable(err)
 	}
 
 	if err = json.Unmarshal([]byte(val), &record); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %s: %w", ErrCorruptRecord, mac, err)
+	}
+	if record.IP == nil {
+		return nil, fmt.Errorf("%w: %s: no IP address", ErrCorruptRecord, mac)
 	}
 
 	return &record, nil
 }
 
-// Get all records from redis. Used in case the DHCP server is restarted.
-func (r *RedisProvider) GetAllRecords() (*[]Record, error) {
-	keys, err := r.rdb.Keys(context.TODO(), REDIS_KEY_PREFIX+"*").Result()
+// Get all records from redis, keyed by MAC address. Used in case the DHCP
+// server is restarted. In migration mode, records of both endpoints are
+// merged and the one expiring last wins.
+func (r *RedisProvider) GetAllRecords() (map[string]Record, error) {
+	merged, err := r.getAllRecords(r.rdb)
+	if err != nil {
+		return nil, err
+	}
+
+	if sec := r.getSecondary(); sec != nil {
+		secRecords, err := r.getAllRecords(sec)
+		if err != nil {
+			log.Warnf("could not load records from secondary storage: %v", err)
+		}
+		for mac, rec := range secRecords {
+			if cur, ok := merged[mac]; !ok || rec.Expires.After(cur.Expires) {
+				merged[mac] = rec
+				if r.endsBy(rec.Expires, time.Now()) {
+					continue
+				}
+				if err := r.saveRecord(r.rdb, mac, &rec); err != nil {
+					log.Warnf("could not backfill record for %s from secondary storage: %v", mac, err)
+				}
+			}
+		}
+	}
+
+	return merged, nil
+}
+
+// getAllRecords returns all valid records of one endpoint, keyed by MAC address
+func (r *RedisProvider) getAllRecords(rdb *redis.Client) (map[string]Record, error) {
+	keys, err := rdb.Keys(context.TODO(), r.ns.main+"*").Result()
 	if err != nil {
 		if err == redis.Nil {
-			return &[]Record{}, nil
+			return map[string]Record{}, nil
 		}
-		return nil, err
+		return nil, unavailable(err)
 	}
 
-	records := make([]Record, 0, len(keys))
+	records := make(map[string]Record, len(keys))
 	for _, key := range keys {
-		record, err := r.GetRecord(key[len(REDIS_KEY_PREFIX):])
-		if err != nil || record.IP == nil {
+		mac := key[len(r.ns.main):]
+		record, err := r.getRecord(rdb, mac)
+		if err != nil {
+			if errors.Is(err, ErrStorageUnavailable) {
+				return nil, err
+			}
 			continue
 		}
 
-		records = append(records, *record)
+		records[mac] = *record
 	}
 
-	return &records, nil
+	return records, nil
 }
 
+// ScanRecords returns one batch of records, keyed by MAC address, of an
+// incremental iteration over the main keys. The iteration starts with
+// cursor 0 and is complete when the returned cursor is 0 again.
+func (r *RedisProvider) ScanRecords(ctx context.Context, cursor uint64, count int64) (map[string]Record, uint64, error) {
+	keys, next, err := r.rdb.Scan(ctx, cursor, r.ns.main+"*", count).Result()
+	if err != nil {
+		return nil, 0, unavailable(err)
+	}
+
+	records := make(map[string]Record, len(keys))
+	if len(keys) == 0 {
+		return records, next, nil
+	}
+	vals, err := r.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, 0, unavailable(err)
+	}
+	for i, val := range vals {
+		str, ok := val.(string)
+		if !ok {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal([]byte(str), &rec); err != nil || rec.IP == nil {
+			continue
+		}
+		records[keys[i][len(r.ns.main):]] = rec
+	}
+	return records, next, nil
+}
+
+// SaveIPAddress persists the record of a MAC address. In migration mode the
+// write is mirrored to the secondary; failures there are only logged.
 func (r *RedisProvider) SaveIPAddress(mac net.HardwareAddr, record *Record) error {
-	recBytes, err := json.Marshal(record)
+	return r.SaveRecord(mac.String(), record)
+}
+
+// SaveRecord is SaveIPAddress for a MAC address in string form
+func (r *RedisProvider) SaveRecord(mac string, record *Record) error {
+	if err := r.saveRecord(r.rdb, mac, record); err != nil {
+		return unavailable(err)
+	}
+	// the index is secondary to the record: its failures must not block renewals
+	if err := r.refreshIndex(mac, record); err != nil {
+		log.Warnf("could not refresh index entry of %s for %s: %v", record.IP, mac, err)
+	}
+
+	if sec := r.getSecondary(); sec != nil {
+		if err := r.saveRecord(sec, mac, record); err != nil {
+			log.Warnf("could not mirror record for %s to secondary storage: %v", mac, err)
+		}
+	}
+	return nil
+}
+
+// DeleteRecord removes the record of a MAC address, its shadow key and
+// its reverse index entry
+func (r *RedisProvider) DeleteRecord(mac string) error {
+	rec, err := r.getRecord(r.rdb, mac)
+	if err != nil && errors.Is(err, ErrStorageUnavailable) {
+		return err
+	}
+	if rec != nil {
+		err = r.deleteIndexed(mac, rec.IP)
+	} else {
+		err = r.deleteRecord(r.rdb, mac)
+	}
+	if err != nil {
+		return unavailable(err)
+	}
+
+	if sec := r.getSecondary(); sec != nil {
+		if err := r.deleteRecord(sec, mac); err != nil {
+			log.Warnf("could not mirror deletion of %s to secondary storage: %v", mac, err)
+		}
+	}
+	return nil
+}
+
+// MissingShadows returns the MAC addresses among macs whose shadow key does
+// not exist.
+func (r *RedisProvider) MissingShadows(macs []string) ([]string, error) {
+	if len(macs) == 0 {
+		return nil, nil
+	}
+	cmds := make([]*redis.IntCmd, len(macs))
+	_, err := r.rdb.Pipelined(context.TODO(), func(pipe redis.Pipeliner) error {
+		for i, mac := range macs {
+			cmds[i] = pipe.Exists(context.TODO(), r.ns.shadow+mac)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	var missing []string
+	for i, cmd := range cmds {
+		if cmd.Val() == 0 {
+			missing = append(missing, macs[i])
+		}
+	}
+	return missing, nil
+}
+
+// ttlUntil returns the TTL of a key expiring at t. Redis would keep a key
+// with a non-positive TTL forever, so the TTL is at least one second.
+func ttlUntil(t time.Time) time.Duration {
+	ttl := time.Until(t).Truncate(time.Millisecond)
+	if ttl < time.Second {
+		return time.Second
+	}
+	return ttl
+}
+
+func (r *RedisProvider) saveRecord(rdb *redis.Client, mac string, record *Record) error {
+	recBytes, err := encodeRecord(record)
 	if err != nil {
 		return err
 	}
 
 	// set the actual key with extra ttl 10s
-	err = r.rdb.Set(context.TODO(),
-		REDIS_KEY_PREFIX+mac.String(), string(recBytes),
-		time.Until(record.Expires.Add(10*time.Second)).Round(time.Second)).Err()
+	err = rdb.Set(context.TODO(),
+		r.ns.main+mac, string(recBytes),
+		ttlUntil(record.Expires.Add(10*time.Second))).Err()
 	if err != nil {
 		return err
 	}
 
 	// set the shadow key to receive notification
-	err = r.rdb.Set(context.TODO(),
-		REDIS_SHADOW_KEY_PREFIX+mac.String(), "",
-		time.Until(record.Expires).Round(time.Second)).Err()
+	err = rdb.Set(context.TODO(),
+		r.ns.shadow+mac, "",
+		ttlUntil(record.Expires)).Err()
 
 	return err
 }
+
+func (r *RedisProvider) deleteRecord(rdb *redis.Client, mac string) error {
+	return rdb.Del(context.TODO(), r.ns.main+mac, r.ns.shadow+mac).Err()
+}
+
+// ExpireAt sets the expiry of the keys of every record to the absolute time
+// derived from its Expires field
+func (r *RedisProvider) ExpireAt(ctx context.Context, records map[string]Record) error {
+	_, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for mac, rec := range records {
+			pipe.PExpireAt(ctx, r.ns.main+mac, rec.Expires.Add(10*time.Second))
+			pipe.PExpireAt(ctx, r.ns.shadow+mac, rec.Expires)
+			pipe.PExpireAt(ctx, r.ns.index+rec.IP.String(), rec.Expires.Add(10*time.Second))
+		}
+		return nil
+	})
+	return unavailable(err)
+}
+
+// loadCheckpoint reads the checkpoint of an interrupted operation stored
+// in key into v. Returns false if there is none.
+func (r *RedisProvider) loadCheckpoint(ctx context.Context, key string, v any) (bool, error) {
+	val, err := r.rdb.Get(ctx, key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return false, nil
+		}
+		return false, unavailable(err)
+	}
+	if err := json.Unmarshal([]byte(val), v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// saveCheckpoint stores the progress of an operation in key
+func (r *RedisProvider) saveCheckpoint(ctx context.Context, key string, v any) error {
+	val, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return unavailable(r.rdb.Set(ctx, key, val, 0).Err())
+}
+
+// clearCheckpoint removes the checkpoint of a completed operation
+func (r *RedisProvider) clearCheckpoint(ctx context.Context, key string) error {
+	return unavailable(r.rdb.Del(ctx, key).Err())
+}
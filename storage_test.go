@@ -0,0 +1,190 @@
+package rangeredisplugin
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// openStorage connects to m with opts, and closes the provider at the end
+// of the test
+func openStorage(t *testing.T, m *miniredis.Miniredis, opts StorageOptions) *RedisProvider {
+	t.Helper()
+	r, err := InitStorage(redisURI(m), opts)
+	if err != nil {
+		t.Fatalf("InitStorage: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// openMigration connects to primary mirroring to secondary
+func openMigration(t *testing.T, primary, secondary *miniredis.Miniredis) *RedisProvider {
+	t.Helper()
+	return openStorage(t, primary, StorageOptions{SecondaryURI: redisURI(secondary)})
+}
+
+// boundRecord returns a record of ip expiring in d, to the second
+func boundRecord(ip string, d time.Duration) *Record {
+	return &Record{IP: net.ParseIP(ip).To4(), Expires: time.Now().Add(d).Truncate(time.Second), State: StateBound}
+}
+
+func TestMigrationMirrorsWrites(t *testing.T) {
+	primary, secondary := miniredis.RunT(t), miniredis.RunT(t)
+	r := openMigration(t, primary, secondary)
+
+	const mac = "00:11:22:33:44:55"
+	if err := r.SaveRecord(mac, boundRecord("10.0.0.10", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for name, m := range map[string]*miniredis.Miniredis{"primary": primary, "secondary": secondary} {
+		if !m.Exists(r.ns.main+mac) || !m.Exists(r.ns.shadow+mac) {
+			t.Errorf("record not written to the %s", name)
+		}
+	}
+
+	if err := r.DeleteRecord(mac); err != nil {
+		t.Fatal(err)
+	}
+	for name, m := range map[string]*miniredis.Miniredis{"primary": primary, "secondary": secondary} {
+		if m.Exists(r.ns.main+mac) || m.Exists(r.ns.shadow+mac) {
+			t.Errorf("record not deleted from the %s", name)
+		}
+	}
+}
+
+func TestMigrationBackfill(t *testing.T) {
+	primary, secondary := miniredis.RunT(t), miniredis.RunT(t)
+	legacy := openStorage(t, secondary, StorageOptions{})
+	const mac, ended = "00:11:22:33:44:55", "00:11:22:33:44:66"
+	rec := boundRecord("10.0.0.10", time.Hour)
+	if err := legacy.SaveRecord(mac, rec); err != nil {
+		t.Fatal(err)
+	}
+	if err := legacy.SaveRecord(ended, boundRecord("10.0.0.11", -time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := openMigration(t, primary, secondary)
+	got, err := r.GetRecord(mac)
+	if err != nil {
+		t.Fatalf("GetRecord: %v", err)
+	}
+	if !got.IP.Equal(rec.IP) || !got.Expires.Equal(rec.Expires) {
+		t.Errorf("GetRecord = %+v, want %+v", got, rec)
+	}
+	if !primary.Exists(r.ns.main + mac) {
+		t.Error("record read from the secondary not copied to the primary")
+	}
+	if owner, err := r.LookupByIP(rec.IP); err != nil || owner != mac {
+		t.Errorf("index of %s = %q, %v after the backfill, want %s", rec.IP, owner, err, mac)
+	}
+
+	// an ended lease is served but not brought back
+	if _, err := r.GetRecord(ended); err != nil {
+		t.Fatalf("GetRecord of an ended lease: %v", err)
+	}
+	if primary.Exists(r.ns.main + ended) {
+		t.Error("ended record copied to the primary")
+	}
+}
+
+func TestMigrationConflicts(t *testing.T) {
+	primary, secondary := miniredis.RunT(t), miniredis.RunT(t)
+	current, legacy := openStorage(t, primary, StorageOptions{}), openStorage(t, secondary, StorageOptions{})
+	const newer, older = "00:11:22:33:44:55", "00:11:22:33:44:66"
+	// the secondary holds the newer lease of newer, the primary that of older
+	for _, w := range []struct {
+		store *RedisProvider
+		mac   string
+		rec   *Record
+	}{
+		{current, newer, boundRecord("10.0.0.10", time.Hour)},
+		{legacy, newer, boundRecord("10.0.0.20", 2*time.Hour)},
+		{current, older, boundRecord("10.0.0.11", 2*time.Hour)},
+		{legacy, older, boundRecord("10.0.0.21", time.Hour)},
+	} {
+		if err := w.store.SaveRecord(w.mac, w.rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := openMigration(t, primary, secondary)
+	all, err := r.GetAllRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for mac, want := range map[string]string{newer: "10.0.0.20", older: "10.0.0.11"} {
+		if rec, ok := all[mac]; !ok || rec.IP.String() != want {
+			t.Errorf("merged record of %s = %v, want %s", mac, all[mac], want)
+		}
+		rec, err := current.GetRecord(mac)
+		if err != nil || rec.IP.String() != want {
+			t.Errorf("primary record of %s = %v, %v, want %s", mac, rec, err, want)
+		}
+	}
+}
+
+func TestMigrationSecondaryOutage(t *testing.T) {
+	primary, secondary := miniredis.RunT(t), miniredis.RunT(t)
+	r := openMigration(t, primary, secondary)
+	secondary.Close()
+
+	const mac = "00:11:22:33:44:55"
+	if err := r.SaveRecord(mac, boundRecord("10.0.0.10", time.Hour)); err != nil {
+		t.Fatalf("SaveRecord with the secondary down: %v", err)
+	}
+	if _, err := r.GetRecord(mac); err != nil {
+		t.Fatalf("GetRecord with the secondary down: %v", err)
+	}
+	if _, err := r.GetRecord("00:11:22:33:44:66"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetRecord of a missing record with the secondary down: %v, want ErrNotFound", err)
+	}
+	if _, err := r.GetAllRecords(); err != nil {
+		t.Errorf("GetAllRecords with the secondary down: %v", err)
+	}
+	if err := r.DeleteRecord(mac); err != nil {
+		t.Errorf("DeleteRecord with the secondary down: %v", err)
+	}
+}
+
+func TestMigrationSecondaryUnreachableAtStart(t *testing.T) {
+	primary := miniredis.RunT(t)
+	down := miniredis.RunT(t)
+	uri := redisURI(down)
+	down.Close()
+
+	r, err := InitStorage(redisURI(primary), StorageOptions{SecondaryURI: uri})
+	if err != nil {
+		t.Fatalf("InitStorage with the secondary down: %v", err)
+	}
+	defer r.Close()
+	if err := r.SaveRecord("00:11:22:33:44:55", boundRecord("10.0.0.10", time.Hour)); err != nil {
+		t.Errorf("SaveRecord: %v", err)
+	}
+}
+
+func TestCutover(t *testing.T) {
+	primary, secondary := miniredis.RunT(t), miniredis.RunT(t)
+	p := startPlugin(t, primary, "10.0.0.10", "10.0.0.20", "1h", "secondary="+redisURI(secondary))
+	const before, after = "00:11:22:33:44:55", "00:11:22:33:44:66"
+	lease(t, p, before)
+	if !secondary.Exists(p.storage.ns.main + before) {
+		t.Fatal("lease not mirrored before the cutover")
+	}
+
+	p.handleControl("cutover")
+	lease(t, p, after)
+	if secondary.Exists(p.storage.ns.main + after) {
+		t.Error("lease mirrored after the cutover")
+	}
+	if !primary.Exists(p.storage.ns.main + after) {
+		t.Error("lease not stored after the cutover")
+	}
+	if err := p.storage.Cutover(); err != nil {
+		t.Errorf("second cutover: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package storagetest_test
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	rangeredisplugin "coredhcpcomplie/coredhcp-rangeredis"
+	"coredhcpcomplie/coredhcp-rangeredis/storagetest"
+)
+
+// clock is a simulated clock shared by the stores of a backend
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// TestFileStore runs the scenarios on a bbolt file, whose time is a
+// simulated clock
+func TestFileStore(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) storagetest.Backend {
+		path := filepath.Join(t.TempDir(), "leases.db")
+		c := &clock{now: time.Now()}
+		return storagetest.Backend{
+			Open: func(t *testing.T, prefix string) rangeredisplugin.LeaseStore {
+				s, err := rangeredisplugin.OpenFileStore(path, prefix)
+				if err != nil {
+					t.Fatalf("OpenFileStore: %v", err)
+				}
+				s.SetClock(c)
+				t.Cleanup(func() {
+					if err := s.Close(); err != nil {
+						t.Errorf("Close: %v", err)
+					}
+				})
+				return s
+			},
+			Advance: func(t *testing.T, d time.Duration) {
+				c.advance(d)
+			},
+		}
+	})
+}
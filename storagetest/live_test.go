@@ -0,0 +1,48 @@
+//go:build redis
+
+package storagetest_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+
+	rangeredisplugin "coredhcpcomplie/coredhcp-rangeredis"
+	"coredhcpcomplie/coredhcp-rangeredis/storagetest"
+)
+
+// TestRedisServer runs the scenarios on the redis server of
+// RANGEREDIS_TEST_URI, flushing its database first. Keyevent notifications
+// of expired keys are enabled on the server.
+func TestRedisServer(t *testing.T) {
+	uri := os.Getenv("RANGEREDIS_TEST_URI")
+	if uri == "" {
+		t.Skip("RANGEREDIS_TEST_URI not set")
+	}
+	opt, err := redis.ParseURL(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storagetest.RunConformance(t, func(t *testing.T) storagetest.Backend {
+		rdb := redis.NewClient(opt)
+		defer rdb.Close()
+		ctx := context.Background()
+		if err := rdb.FlushDB(ctx).Err(); err != nil {
+			t.Fatal(err)
+		}
+		if err := rdb.ConfigSet(ctx, "notify-keyspace-events", "Ex").Err(); err != nil {
+			t.Fatal(err)
+		}
+		return storagetest.Backend{
+			Open: func(t *testing.T, prefix string) rangeredisplugin.LeaseStore {
+				return open(t, uri, prefix)
+			},
+			Advance: func(t *testing.T, d time.Duration) {
+				time.Sleep(d)
+			},
+		}
+	})
+}
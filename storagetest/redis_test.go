@@ -0,0 +1,53 @@
+package storagetest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	rangeredisplugin "coredhcpcomplie/coredhcp-rangeredis"
+	"coredhcpcomplie/coredhcp-rangeredis/storagetest"
+)
+
+// open returns a store of prefix on uri, released at the end of the test
+func open(t *testing.T, uri, prefix string) rangeredisplugin.LeaseStore {
+	t.Helper()
+	r, err := rangeredisplugin.AcquireStorage(uri, rangeredisplugin.StorageOptions{KeyPrefix: prefix})
+	if err != nil {
+		t.Fatalf("AcquireStorage: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := rangeredisplugin.ReleaseStorage(r); err != nil {
+			t.Errorf("ReleaseStorage: %v", err)
+		}
+	})
+	return r
+}
+
+// TestRedisProvider runs the scenarios on miniredis, whose time only moves
+// when fast-forwarded and which publishes no keyevent notifications: the
+// notifications of the keys expiring are published along
+func TestRedisProvider(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) storagetest.Backend {
+		m := miniredis.RunT(t)
+		uri := "redis://" + m.Addr() + "/0"
+		return storagetest.Backend{
+			Open: func(t *testing.T, prefix string) rangeredisplugin.LeaseStore {
+				return open(t, uri, prefix)
+			},
+			Advance: func(t *testing.T, d time.Duration) {
+				var expiring []string
+				for _, key := range m.Keys() {
+					if ttl := m.TTL(key); ttl > 0 && ttl <= d {
+						expiring = append(expiring, key)
+					}
+				}
+				m.FastForward(d)
+				for _, key := range expiring {
+					m.Publish("__keyevent@0__:expired", key)
+				}
+			},
+		}
+	})
+}
@@ -0,0 +1,313 @@
+// Package storagetest pins the semantics of a LeaseStore, documented on
+// rangeredisplugin.LeaseStore, with scenarios every store must pass before
+// the plugin may run on it:
+//
+//   - RoundTrip: a saved record reads back equal, a missing one is
+//     ErrNotFound, saving replaces a record whole and deleting is idempotent
+//   - Expiry: a record reaching its Expires is notified once, stays readable
+//     for the grace period, then is gone; a deleted record is not notified
+//   - ConcurrentWriters: writers racing on one key leave one of the records
+//     written, whole
+//   - LargeValue: a record of 3 KiB of labels reads back equal, one of
+//     64 KiB is refused with ErrRecordTooLarge and the record before kept
+//   - PrefixIsolation: stores of distinct namespaces on one backend see
+//     neither the records nor the expiries of each other
+//   - Enumeration: a complete enumeration returns every record, possibly
+//     twice, in any order, and nothing else
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	rangeredisplugin "coredhcpcomplie/coredhcp-rangeredis"
+)
+
+// grace is the time a record stays readable past its Expires
+const grace = 10 * time.Second
+
+// eventTimeout bounds the delivery of an expiry once it is due
+const eventTimeout = 2 * time.Second
+
+// Backend is a store under test
+type Backend struct {
+	// Open returns the store of the namespace prefix, e.g. a:, closed at
+	// the end of the test. The stores of a backend share its storage.
+	Open func(t *testing.T, prefix string) rangeredisplugin.LeaseStore
+	// Advance moves the time of the backend forward by d: the records
+	// reaching their Expires by then expire, and are notified
+	Advance func(t *testing.T, d time.Duration)
+}
+
+// Factory returns a new, empty backend for each scenario
+type Factory func(t *testing.T) Backend
+
+// RunConformance runs every scenario against the backends of factory, each
+// as a subtest
+func RunConformance(t *testing.T, factory Factory) {
+	for _, sc := range []struct {
+		name string
+		run  func(t *testing.T, b Backend)
+	}{
+		{"RoundTrip", testRoundTrip},
+		{"Expiry", testExpiry},
+		{"ConcurrentWriters", testConcurrentWriters},
+		{"LargeValue", testLargeValue},
+		{"PrefixIsolation", testPrefixIsolation},
+		{"Enumeration", testEnumeration},
+	} {
+		t.Run(sc.name, func(t *testing.T) {
+			sc.run(t, factory(t))
+		})
+	}
+}
+
+// record returns a bound record of ip expiring in d, to the second
+func record(ip string, d time.Duration) *rangeredisplugin.Record {
+	return &rangeredisplugin.Record{
+		IP:      net.ParseIP(ip).To4(),
+		Expires: time.Now().Add(d).Truncate(time.Second),
+		State:   rangeredisplugin.StateBound,
+	}
+}
+
+func mustSave(t *testing.T, s rangeredisplugin.LeaseStore, mac string, rec *rangeredisplugin.Record) {
+	t.Helper()
+	if err := s.SaveRecord(mac, rec); err != nil {
+		t.Fatalf("SaveRecord(%s): %v", mac, err)
+	}
+}
+
+// assertRecord fails the test unless the record of mac reads back as want
+func assertRecord(t *testing.T, s rangeredisplugin.LeaseStore, mac string, want *rangeredisplugin.Record) {
+	t.Helper()
+	got, err := s.GetRecord(mac)
+	if err != nil {
+		t.Fatalf("GetRecord(%s): %v", mac, err)
+	}
+	if !equal(*got, *want) {
+		t.Errorf("GetRecord(%s) = %+v, want %+v", mac, *got, *want)
+	}
+}
+
+// assertMissing fails the test unless mac has no record
+func assertMissing(t *testing.T, s rangeredisplugin.LeaseStore, mac string) {
+	t.Helper()
+	if got, err := s.GetRecord(mac); !errors.Is(err, rangeredisplugin.ErrNotFound) {
+		t.Errorf("GetRecord(%s) = %v, %v, want ErrNotFound", mac, got, err)
+	}
+}
+
+// equal compares records as stored: times to the instant, addresses by
+// value
+func equal(a, b rangeredisplugin.Record) bool {
+	if !a.IP.Equal(b.IP) || !a.Expires.Equal(b.Expires) || !a.LastSeen.Equal(b.LastSeen) || !a.Relay.Equal(b.Relay) {
+		return false
+	}
+	a.IP, b.IP = nil, nil
+	a.Relay, b.Relay = nil, nil
+	a.Expires, b.Expires = time.Time{}, time.Time{}
+	a.LastSeen, b.LastSeen = time.Time{}, time.Time{}
+	if len(a.Labels) == 0 && len(b.Labels) == 0 {
+		a.Labels, b.Labels = nil, nil
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func testRoundTrip(t *testing.T, b Backend) {
+	s := b.Open(t, "conformance:")
+	const mac = "00:11:22:33:44:55"
+	assertMissing(t, s, mac)
+
+	rec := record("10.0.0.10", time.Hour)
+	rec.Hostname = "host"
+	rec.Relay = net.IPv4(192, 0, 2, 1).To4()
+	rec.Labels = map[string]string{"site": "a"}
+	mustSave(t, s, mac, rec)
+	assertRecord(t, s, mac, rec)
+
+	// saving replaces the record whole: fields left out are gone
+	next := record("10.0.0.11", 2*time.Hour)
+	mustSave(t, s, mac, next)
+	assertRecord(t, s, mac, next)
+
+	if err := s.DeleteRecord(mac); err != nil {
+		t.Fatalf("DeleteRecord: %v", err)
+	}
+	assertMissing(t, s, mac)
+	if err := s.DeleteRecord(mac); err != nil {
+		t.Errorf("DeleteRecord of a missing record: %v", err)
+	}
+}
+
+func testExpiry(t *testing.T, b Backend) {
+	s := b.Open(t, "conformance:")
+	expired, stop := s.Expired()
+	defer stop()
+
+	const mac, deleted = "00:11:22:33:44:55", "00:11:22:33:44:66"
+	rec := record("10.0.0.10", 2*time.Second)
+	mustSave(t, s, mac, rec)
+	mustSave(t, s, deleted, record("10.0.0.11", 2*time.Second))
+	if err := s.DeleteRecord(deleted); err != nil {
+		t.Fatalf("DeleteRecord: %v", err)
+	}
+
+	b.Advance(t, 3*time.Second)
+	if got := receive(t, expired); got != mac {
+		t.Fatalf("expiry of %s notified, want %s", got, mac)
+	}
+	// readable until the notification is handled
+	assertRecord(t, s, mac, rec)
+	select {
+	case got := <-expired:
+		t.Errorf("expiry of %s notified again or after its deletion", got)
+	case <-time.After(eventTimeout / 4):
+	}
+
+	b.Advance(t, grace)
+	assertMissing(t, s, mac)
+}
+
+// receive returns the next expiry delivered on ch
+func receive(t *testing.T, ch <-chan string) string {
+	t.Helper()
+	select {
+	case mac, ok := <-ch:
+		if !ok {
+			t.Fatal("expiries closed")
+		}
+		return mac
+	case <-time.After(eventTimeout):
+		t.Fatal("no expiry notified")
+	}
+	return ""
+}
+
+func testConcurrentWriters(t *testing.T, b Backend) {
+	s := b.Open(t, "conformance:")
+	const mac, writers = "00:11:22:33:44:55", 16
+	written := make([]*rangeredisplugin.Record, writers)
+	var wg sync.WaitGroup
+	for i := range written {
+		written[i] = record(fmt.Sprintf("10.0.0.%d", 10+i), time.Duration(i+1)*time.Hour)
+		written[i].Hostname = fmt.Sprintf("writer-%d", i)
+		wg.Add(1)
+		go func(rec *rangeredisplugin.Record) {
+			defer wg.Done()
+			if err := s.SaveRecord(mac, rec); err != nil {
+				t.Errorf("SaveRecord: %v", err)
+			}
+		}(written[i])
+	}
+	wg.Wait()
+
+	got, err := s.GetRecord(mac)
+	if err != nil {
+		t.Fatalf("GetRecord: %v", err)
+	}
+	for _, rec := range written {
+		if equal(*got, *rec) {
+			return
+		}
+	}
+	t.Errorf("GetRecord = %+v, none of the records written", *got)
+}
+
+func testLargeValue(t *testing.T, b Backend) {
+	s := b.Open(t, "conformance:")
+	const mac = "00:11:22:33:44:55"
+	large := record("10.0.0.10", time.Hour)
+	large.Labels = labels(3, 1000)
+	mustSave(t, s, mac, large)
+	assertRecord(t, s, mac, large)
+
+	huge := record("10.0.0.11", time.Hour)
+	huge.Labels = labels(64, 1024)
+	if err := s.SaveRecord(mac, huge); !errors.Is(err, rangeredisplugin.ErrRecordTooLarge) {
+		t.Errorf("SaveRecord of %d labels of 1 KiB: %v, want ErrRecordTooLarge", len(huge.Labels), err)
+	}
+	assertRecord(t, s, mac, large)
+}
+
+// labels returns n labels of size bytes each
+func labels(n, size int) map[string]string {
+	l := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		l[fmt.Sprintf("label-%02d", i)] = strings.Repeat("x", size)
+	}
+	return l
+}
+
+func testPrefixIsolation(t *testing.T, b Backend) {
+	a, other := b.Open(t, "conformance-a:"), b.Open(t, "conformance-b:")
+	expired, stop := other.Expired()
+	defer stop()
+
+	const mac = "00:11:22:33:44:55"
+	mustSave(t, a, mac, record("10.0.0.10", 2*time.Second))
+	assertMissing(t, other, mac)
+	if records := enumerate(t, other); len(records) != 0 {
+		t.Errorf("records of another namespace enumerated: %v", records)
+	}
+	if err := other.DeleteRecord(mac); err != nil {
+		t.Fatalf("DeleteRecord: %v", err)
+	}
+	if _, err := a.GetRecord(mac); err != nil {
+		t.Errorf("record deleted from another namespace: %v", err)
+	}
+
+	b.Advance(t, 3*time.Second)
+	select {
+	case got := <-expired:
+		t.Errorf("expiry of %s notified to another namespace", got)
+	case <-time.After(eventTimeout / 4):
+	}
+}
+
+func testEnumeration(t *testing.T, b Backend) {
+	s := b.Open(t, "conformance:")
+	want := make(map[string]*rangeredisplugin.Record)
+	for i := 0; i < 100; i++ {
+		mac := fmt.Sprintf("00:11:22:33:%02x:%02x", i/256, i%256)
+		want[mac] = record(fmt.Sprintf("10.0.%d.%d", i/200, 10+i%200), time.Hour)
+		mustSave(t, s, mac, want[mac])
+	}
+
+	got := enumerate(t, s)
+	if len(got) != len(want) {
+		t.Errorf("enumerated %d records, want %d", len(got), len(want))
+	}
+	for mac, rec := range want {
+		if g, ok := got[mac]; !ok || !equal(g, *rec) {
+			t.Errorf("record of %s enumerated as %+v, want %+v", mac, g, *rec)
+		}
+	}
+}
+
+// enumerate returns the records of a complete enumeration of s, in small
+// batches
+func enumerate(t *testing.T, s rangeredisplugin.LeaseStore) map[string]rangeredisplugin.Record {
+	t.Helper()
+	all := make(map[string]rangeredisplugin.Record)
+	var cursor uint64
+	for {
+		batch, next, err := s.ScanRecords(context.Background(), cursor, 7)
+		if err != nil {
+			t.Fatalf("ScanRecords: %v", err)
+		}
+		for mac, rec := range batch {
+			all[mac] = rec
+		}
+		if cursor = next; cursor == 0 {
+			return all
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package rangeredisplugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// number of error messages kept for the support bundle
+const recentErrorsSize = 100
+
+// pluginLogger is the part of the coredhcp logger used by the plugin
+type pluginLogger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Printf(format string, args ...interface{})
+	Warn(args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	Errorln(args ...interface{})
+}
+
+// recordingLogger keeps the last error messages logged in recent
+type recordingLogger struct {
+	pluginLogger
+	recent *errorRing
+}
+
+func (l recordingLogger) Errorf(format string, args ...interface{}) {
+	msg := privacy.Load().text(fmt.Sprintf(format, args...))
+	l.recent.add(msg)
+	l.pluginLogger.Errorf("%s", msg)
+}
+
+func (l recordingLogger) Errorln(args ...interface{}) {
+	msg := privacy.Load().text(strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+	l.recent.add(msg)
+	l.pluginLogger.Errorln(msg)
+}
+
+// The other levels only go through the pseudonymizer, the single place the
+// identities of the clients are replaced in the log in privacy mode.
+
+func (l recordingLogger) Debugf(format string, args ...interface{}) {
+	format, args = private(format, args)
+	l.pluginLogger.Debugf(format, args...)
+}
+
+func (l recordingLogger) Infof(format string, args ...interface{}) {
+	format, args = private(format, args)
+	l.pluginLogger.Infof(format, args...)
+}
+
+func (l recordingLogger) Printf(format string, args ...interface{}) {
+	format, args = private(format, args)
+	l.pluginLogger.Printf(format, args...)
+}
+
+func (l recordingLogger) Warnf(format string, args ...interface{}) {
+	format, args = private(format, args)
+	l.pluginLogger.Warnf(format, args...)
+}
+
+func (l recordingLogger) Warn(args ...interface{}) {
+	if ps := privacy.Load(); ps != nil {
+		l.pluginLogger.Warn(ps.text(fmt.Sprint(args...)))
+		return
+	}
+	l.pluginLogger.Warn(args...)
+}
+
+// private formats a log message for the pseudonymizer if enabled, and
+// returns it as is otherwise
+func private(format string, args []interface{}) (string, []interface{}) {
+	if ps := privacy.Load(); ps != nil {
+		return "%s", []interface{}{ps.text(fmt.Sprintf(format, args...))}
+	}
+	return format, args
+}
+
+// LoggedError is an error message of the plugin
+type LoggedError struct {
+	Time    time.Time
+	Message string
+}
+
+// errorRing holds the last size error messages
+type errorRing struct {
+	mu      sync.Mutex
+	entries []LoggedError
+	next    int
+	size    int
+}
+
+func newErrorRing(size int) *errorRing {
+	return &errorRing{size: size}
+}
+
+func (r *errorRing) add(msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e := LoggedError{Time: time.Now(), Message: msg}
+	if len(r.entries) < r.size {
+		r.entries = append(r.entries, e)
+		return
+	}
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % r.size
+}
+
+// snapshot returns the messages, oldest first
+func (r *errorRing) snapshot() []LoggedError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]LoggedError, 0, len(r.entries))
+	out = append(out, r.entries[r.next:]...)
+	return append(out, r.entries[:r.next]...)
+}
+
+// RecentErrors returns the last error messages of the plugin, oldest first
+func RecentErrors() []LoggedError {
+	return log.recent.snapshot()
+}
+
+// SupportInfo is what to attach to a bug report about the plugin
+type SupportInfo struct {
+	Generated time.Time
+	Build     BuildInfo
+	// Args are the plugin arguments, with the passwords of URIs removed
+	Args []string
+	// Config is the configuration the instance runs with
+	Config  *EffectiveConfig
+	Startup *AuditReport `json:",omitempty"`
+	Stats   Stats
+	Health  Health
+	// Consistency counts the issues of a consistency report by kind
+	Consistency      map[string]int `json:",omitempty"`
+	ConsistencyError string         `json:",omitempty"`
+	// Operations are the last logged operations on the addresses of the
+	// issues of the consistency report, only included with the clients
+	Operations []OpLogEntry `json:",omitempty"`
+	Errors     []LoggedError
+	// SlowCommands are the slowest recent redis commands
+	SlowCommands []SlowCommand
+}
+
+// BuildInfo identifies the binary the plugin runs in
+type BuildInfo struct {
+	GoVersion string
+	Main      string
+	Version   string
+	Revision  string `json:",omitempty"`
+	Plugin    string `json:",omitempty"`
+}
+
+func buildInfo() BuildInfo {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return BuildInfo{}
+	}
+	info := BuildInfo{GoVersion: bi.GoVersion, Main: bi.Main.Path, Version: bi.Main.Version}
+	for _, s := range bi.Settings {
+		if s.Key == "vcs.revision" {
+			info.Revision = s.Value
+		}
+	}
+	for _, d := range bi.Deps {
+		if strings.Contains(d.Path, "coredhcp-rangeredis") {
+			info.Plugin = d.Path + "@" + d.Version
+		}
+	}
+	return info
+}
+
+var (
+	macPattern  = regexp.MustCompile(`(?i)\b[0-9a-f]{2}(?:[:-][0-9a-f]{2}){5,19}\b`)
+	ipv4Pattern = regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}\b`)
+	keyPattern  = regexp.MustCompile(`(?i)\b\d+-(?:id-)?[0-9a-f]{4,}\b`)
+)
+
+// redactClients replaces the hardware addresses, client keys and IPv4
+// addresses in s
+func redactClients(s string) string {
+	s = macPattern.ReplaceAllString(s, "<mac>")
+	s = keyPattern.ReplaceAllString(s, "<client>")
+	return ipv4Pattern.ReplaceAllString(s, "<ip>")
+}
+
+// secretOptions are the options whose value is a secret
+var secretOptions = map[string]bool{"privacy_key": true}
+
+// redactSecret hides a secret. Every secret logged or reported by the
+// plugin goes through it, so that they all read the same.
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "xxxxx"
+}
+
+// redactURI removes the password of a URI. A URI that does not parse has
+// its password redacted all the same, as the parse error quotes it whole.
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		scheme, rest, ok := strings.Cut(uri, "://")
+		if !ok {
+			return uri
+		}
+		authority, path, _ := strings.Cut(rest, "/")
+		at := strings.LastIndex(authority, "@")
+		if at < 0 {
+			return uri
+		}
+		user, pass, ok := strings.Cut(authority[:at], ":")
+		if !ok {
+			return uri
+		}
+		redacted := scheme + "://" + user + ":" + redactSecret(pass) + authority[at:]
+		if len(rest) > len(authority) {
+			redacted += "/" + path
+		}
+		return redacted
+	}
+	if u.User == nil {
+		return uri
+	}
+	pass, ok := u.User.Password()
+	if !ok {
+		return uri
+	}
+	u.User = url.UserPassword(u.User.Username(), redactSecret(pass))
+	return u.String()
+}
+
+// redactArg removes the password of a URI argument, given alone or as the
+// value of an option
+func redactArg(arg string) string {
+	prefix, val := "", arg
+	if k, v, ok := strings.Cut(arg, "="); ok && !strings.Contains(k, "/") {
+		prefix, val = k+"=", v
+	}
+	if secretOptions[strings.TrimSuffix(prefix, "=")] {
+		return prefix + redactSecret(val)
+	}
+	if r := redactURI(val); r != val {
+		return prefix + r
+	}
+	return arg
+}
+
+// SupportBundle writes the information to attach to a bug report about the
+// instance to w, as JSON. Addresses and client keys are redacted from the
+// bundle unless includeClients is set, in which case it also holds the
+// issues of the startup audit and the logged operations on the addresses of
+// the inconsistencies. In privacy mode, the clients are pseudonymized.
+func (p *PluginState) SupportBundle(ctx context.Context, w io.Writer, includeClients bool) error {
+	b := SupportInfo{
+		Generated:    time.Now(),
+		Build:        buildInfo(),
+		Stats:        p.Stats(),
+		Health:       p.Health(ctx),
+		Errors:       RecentErrors(),
+		SlowCommands: p.storage.SlowCommands(),
+		Args:         redactArgs(p.cfg.args),
+		Config:       p.EffectiveConfig(),
+	}
+	if p.startup != nil {
+		startup := *p.startup
+		if !includeClients {
+			startup.Issues = nil
+		}
+		b.Startup = &startup
+	}
+	if report, _, err := p.ConsistencyReport(ctx); err != nil {
+		b.ConsistencyError = err.Error()
+	} else {
+		b.Consistency = make(map[string]int)
+		for _, i := range report.Issues {
+			b.Consistency[i.Kind]++
+		}
+		if includeClients {
+			b.Operations = report.Operations
+		}
+	}
+	if !includeClients {
+		for i := range b.Errors {
+			b.Errors[i].Message = redactClients(b.Errors[i].Message)
+		}
+		b.ConsistencyError = redactClients(b.ConsistencyError)
+		b.Health.Error = redactClients(b.Health.Error)
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(b); err != nil {
+		return err
+	}
+	// the single place the identities of the clients are replaced in the
+	// bundle in privacy mode
+	_, err := w.Write(privacy.Load().bytes(buf.Bytes()))
+	return err
+}
@@ -0,0 +1,341 @@
+// Package simulator replays DHCPv4 traffic through an instance of the
+// range-redis plugin running against miniredis, and checks the invariants
+// of its pool at the end: no address leased twice, the allocator agreeing
+// with redis, and the utilization within the expected bounds.
+//
+// The instance runs on a simulated clock jumping from one message to the
+// next, so that a day of traffic replays in seconds. The leases and offers
+// running out in between expire as redis would expire them: their shadow
+// key is deleted and its keyevent notification published, which miniredis
+// does not do on its own. No other key of the plugin expires.
+package simulator
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+
+	rangeredisplugin "coredhcpcomplie/coredhcp-rangeredis"
+)
+
+// channel of the keyevent notifications of the expired keys of database 0
+const expiredChannel = "__keyevent@0__:expired"
+
+// time given to the instance to free the address of an expired lease
+const expiryTimeout = time.Second
+
+// Options configure a replay
+type Options struct {
+	// Args configure the instance after its uri, e.g. 10.0.0.10 10.0.0.250 1h
+	Args []string
+	// Start is the time of the simulated clock at the start of the trace,
+	// the current time if zero
+	Start time.Time
+	// MinUtilization and MaxUtilization bound the share of the pool leased
+	// at the end of the replay, MaxUtilization only if not zero
+	MinUtilization float64
+	MaxUtilization float64
+	// Faults are programmed into the storage before the replay. They need
+	// the faults option in Args, in a build with the faults tag.
+	Faults []rangeredisplugin.Fault
+}
+
+// Report is the outcome of a replay
+type Report struct {
+	Messages int
+	// Answered and Dropped count the DISCOVERs and REQUESTs answered and
+	// left unanswered, and Naks the REQUESTs answered with a NAK
+	Answered int
+	Dropped  int
+	Naks     int
+	// Expired counts the leases and offers that ran out during the replay
+	Expired int
+	Leases  int
+	// Utilization is the share of the pool leased at the end of the replay
+	Utilization float64
+	// Simulated is the time the replay spans on the simulated clock
+	Simulated time.Duration
+	// Violations lists the broken invariants, empty if all hold
+	Violations []string
+	// InjectedFaults counts the storage calls failed or delayed and the
+	// notifications dropped during the replay, see Options.Faults
+	InjectedFaults uint64 `json:",omitempty"`
+}
+
+// Clock is the simulated clock of a replay. It only moves forward.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// Now returns the simulated time
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// set moves the clock to t, unless it is past t already
+func (c *Clock) set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.After(c.now) {
+		c.now = t
+	}
+}
+
+// Run replays trace through a new instance configured with opts, and
+// checks the invariants at the end. The instance and its miniredis are
+// closed before returning. Run must not be called while another instance
+// of the plugin is set up.
+func Run(ctx context.Context, trace []Message, opts Options) (*Report, error) {
+	m, err := miniredis.Run()
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+
+	uri := "redis://" + m.Addr() + "/0"
+	handler, err := rangeredisplugin.Plugin.Setup4(append([]string{uri}, opts.Args...)...)
+	if err != nil {
+		return nil, err
+	}
+	p := instance(uri)
+	if p == nil {
+		return nil, errors.New("the instance set up is not registered")
+	}
+	defer p.Close(context.Background())
+
+	start := opts.Start
+	if start.IsZero() {
+		start = time.Now()
+	}
+	r := &replay{
+		m:       m,
+		p:       p,
+		handler: handler,
+		clock:   &Clock{now: start},
+		bound:   make(map[string]net.IP),
+		offered: make(map[string]net.IP),
+		report:  &Report{},
+	}
+	prefix := p.EffectiveConfig().Config.KeyPrefix
+	if prefix == "" {
+		prefix = rangeredisplugin.REDIS_KEY_PREFIX
+	}
+	r.main, r.shadow, r.index = prefix, "s:"+prefix, "i:"+prefix
+	p.SetClock(r.clock)
+
+	for _, f := range opts.Faults {
+		if err := p.Storage().InjectFault(f); err != nil {
+			return nil, err
+		}
+	}
+	injected := p.Storage().InjectedFaults()
+
+	for i, msg := range trace {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		r.expireUntil(start.Add(msg.At))
+		r.send(msg, i > 0 && retransmits(trace[i-1], msg))
+	}
+	if len(trace) > 0 {
+		r.report.Simulated = trace[len(trace)-1].At
+	}
+
+	check, err := p.CheckInvariants()
+	if err != nil {
+		return nil, err
+	}
+	report := r.report
+	report.Leases = check.Leases
+	report.Utilization = check.Utilization
+	report.Violations = append(report.Violations, check.Violations...)
+	if report.Utilization < opts.MinUtilization {
+		report.Violations = append(report.Violations,
+			fmt.Sprintf("utilization %.3f below %.3f", report.Utilization, opts.MinUtilization))
+	}
+	if opts.MaxUtilization > 0 && report.Utilization > opts.MaxUtilization {
+		report.Violations = append(report.Violations,
+			fmt.Sprintf("utilization %.3f above %.3f", report.Utilization, opts.MaxUtilization))
+	}
+	report.InjectedFaults = p.Storage().InjectedFaults() - injected
+	return report, nil
+}
+
+// retransmits reports whether msg repeats prev
+func retransmits(prev, msg Message) bool {
+	return prev.At == msg.At && prev.Type == msg.Type && bytes.Equal(prev.MAC, msg.MAC)
+}
+
+// instance returns the last instance set up with uri
+func instance(uri string) *rangeredisplugin.PluginState {
+	all := rangeredisplugin.Instances()
+	for i := len(all) - 1; i >= 0; i-- {
+		if args := all[i].EffectiveConfig().Args; len(args) > 0 && args[0] == uri {
+			return all[i]
+		}
+	}
+	return nil
+}
+
+// replay is the state of a replay in progress
+type replay struct {
+	m       *miniredis.Miniredis
+	p       *rangeredisplugin.PluginState
+	handler func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool)
+	clock   *Clock
+	// main, shadow and index prefix the keys of the records
+	main, shadow, index string
+	expiries            expiryQueue
+	// bound and offered hold the address last acknowledged and offered
+	// to each client, and xid the transaction of the last message
+	bound, offered map[string]net.IP
+	xid            dhcpv4.TransactionID
+	report         *Report
+}
+
+// send passes msg through the handler as coredhcp would, a retransmission
+// keeping the transaction of the message before. A client REQUESTs the
+// address it was offered, renews the one it was acknowledged, and releases
+// it.
+func (r *replay) send(msg Message, retransmission bool) {
+	mac := msg.MAC.String()
+	mods := []dhcpv4.Modifier{dhcpv4.WithHwAddr(msg.MAC), dhcpv4.WithMessageType(msg.Type)}
+	switch msg.Type {
+	case dhcpv4.MessageTypeRequest:
+		if ip := r.bound[mac]; ip != nil {
+			mods = append(mods, dhcpv4.WithClientIP(ip))
+		} else if ip := r.offered[mac]; ip != nil {
+			mods = append(mods, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)))
+		}
+	case dhcpv4.MessageTypeRelease:
+		mods = append(mods, dhcpv4.WithClientIP(r.bound[mac]))
+	}
+	req, err := dhcpv4.New(mods...)
+	if err != nil {
+		r.violation("could not build the %s of %s: %v", msg.Type, mac, err)
+		return
+	}
+	if retransmission {
+		req.TransactionID = r.xid
+	}
+	r.xid = req.TransactionID
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	if err != nil {
+		r.violation("could not build the reply to %s: %v", mac, err)
+		return
+	}
+	switch msg.Type {
+	case dhcpv4.MessageTypeDiscover:
+		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
+	case dhcpv4.MessageTypeRequest:
+		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+	}
+
+	r.report.Messages++
+	out, _ := r.handler(req, resp)
+	switch {
+	case msg.Type == dhcpv4.MessageTypeRelease:
+		delete(r.bound, mac)
+	case out == nil:
+		r.report.Dropped++
+	case out.MessageType() == dhcpv4.MessageTypeNak:
+		r.report.Answered++
+		r.report.Naks++
+		delete(r.bound, mac)
+		delete(r.offered, mac)
+	case msg.Type == dhcpv4.MessageTypeDiscover:
+		r.report.Answered++
+		r.offered[mac] = out.YourIPAddr
+	default:
+		r.report.Answered++
+		r.bound[mac] = out.YourIPAddr
+		delete(r.offered, mac)
+	}
+	if rec := r.record(mac); rec != nil {
+		heap.Push(&r.expiries, expiry{at: rec.Expires, mac: mac})
+	}
+}
+
+// expireUntil expires the leases running out before t, in order, and moves
+// the clock to t. A lease renewed at its very expiry is kept.
+func (r *replay) expireUntil(t time.Time) {
+	for len(r.expiries) > 0 && r.expiries[0].at.Before(t) {
+		e := heap.Pop(&r.expiries).(expiry)
+		rec := r.record(e.mac)
+		if rec == nil || !rec.Expires.Equal(e.at) {
+			// ended or extended since
+			continue
+		}
+		r.clock.set(e.at)
+		r.expire(e.mac, rec.IP)
+	}
+	r.clock.set(t)
+}
+
+// expire ends the lease of mac on ip as redis does: its shadow key expires,
+// the notification is published, and the record goes once handled
+func (r *replay) expire(mac string, ip net.IP) {
+	r.m.Del(r.shadow + mac)
+	r.m.Publish(expiredChannel, r.shadow+mac)
+	deadline := time.Now().Add(expiryTimeout)
+	for r.m.Exists(r.index + ip.String()) {
+		if time.Now().After(deadline) {
+			r.violation("the expiry of %s leased to %s was not handled", ip, mac)
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	r.m.Del(r.main + mac)
+	delete(r.bound, mac)
+	delete(r.offered, mac)
+	r.report.Expired++
+}
+
+// record returns the record of mac, or nil
+func (r *replay) record(mac string) *rangeredisplugin.Record {
+	val, err := r.m.Get(r.main + mac)
+	if err != nil {
+		return nil
+	}
+	var rec rangeredisplugin.Record
+	if err := json.Unmarshal([]byte(val), &rec); err != nil || rec.IP == nil {
+		return nil
+	}
+	return &rec
+}
+
+func (r *replay) violation(format string, args ...any) {
+	r.report.Violations = append(r.report.Violations, fmt.Sprintf(format, args...))
+}
+
+// expiry is the end of the lease of a client
+type expiry struct {
+	at  time.Time
+	mac string
+}
+
+// expiryQueue orders the expiries, the earliest first
+type expiryQueue []expiry
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+func (q expiryQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x any)        { *q = append(*q, x.(expiry)) }
+func (q *expiryQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
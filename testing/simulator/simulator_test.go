@@ -0,0 +1,113 @@
+package simulator
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRunGenerated(t *testing.T) {
+	trace, err := Generate(Shape{Clients: 40, Duration: 24 * time.Hour, RenewInterval: 30 * time.Minute, Churn: 0.05, Misbehavior: 0.02, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	report, err := Run(context.Background(), trace, Options{
+		Args:           []string{"10.0.0.10", "10.0.0.250", "1h"},
+		MinUtilization: 0.1,
+		MaxUtilization: 0.2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Violations) > 0 {
+		t.Fatalf("violations: %v", report.Violations)
+	}
+	if report.Messages != len(trace) || report.Dropped != 0 || report.Naks != 0 {
+		t.Errorf("report %+v", report)
+	}
+	if report.Leases != 40 {
+		t.Errorf("%d leases at the end, want 40", report.Leases)
+	}
+	// a day simulated, in far less
+	if report.Simulated < 23*time.Hour || time.Since(start) > time.Minute {
+		t.Errorf("simulated %s in %s", report.Simulated, time.Since(start))
+	}
+}
+
+func TestRunExpiresLeases(t *testing.T) {
+	f, err := os.Open("testdata/trace.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	trace, err := Read(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := Run(context.Background(), trace, Options{
+		Args:  []string{"10.0.0.10", "10.0.0.12", "1h"},
+		Start: time.Date(2026, 3, 29, 0, 30, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Violations) > 0 {
+		t.Fatalf("violations: %v", report.Violations)
+	}
+	// the first client expired, the second released, the third remains
+	if report.Expired != 1 || report.Leases != 1 || report.Dropped != 0 {
+		t.Errorf("report %+v", report)
+	}
+}
+
+func TestRunUtilizationBounds(t *testing.T) {
+	trace, err := Generate(Shape{Clients: 5, Duration: time.Hour, RenewInterval: 30 * time.Minute, Seed: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := Run(context.Background(), trace, Options{
+		Args:           []string{"10.0.0.10", "10.0.0.250", "1h"},
+		MinUtilization: 0.5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Violations) != 1 {
+		t.Fatalf("violations %v, want the utilization below its bound", report.Violations)
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	trace, _ := Generate(Shape{Clients: 1, Duration: time.Hour, RenewInterval: 30 * time.Minute})
+	if _, err := Run(ctx, trace, Options{Args: []string{"10.0.0.10", "10.0.0.250", "1h"}}); err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRunWithInvariantChecker(t *testing.T) {
+	shape := Shape{Clients: 200, Duration: 3 * 24 * time.Hour, RenewInterval: 30 * time.Minute, Churn: 0.2, Misbehavior: 0.05, Seed: 3}
+	if testing.Short() {
+		shape.Clients, shape.Duration = 50, 24*time.Hour
+	}
+	trace, err := Generate(shape)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every allocator mutation and binding is checked as it happens
+	report, err := Run(context.Background(), trace, Options{
+		Args: []string{"10.0.0.10", "10.0.1.250", "1h", "check_invariants=panic"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Violations) > 0 {
+		t.Fatalf("violations: %v", report.Violations)
+	}
+	if report.Messages != len(trace) {
+		t.Errorf("%d of %d messages replayed", report.Messages, len(trace))
+	}
+}
@@ -0,0 +1,133 @@
+package simulator
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Message is one client message of a traffic trace
+type Message struct {
+	// At is the offset of the message from the start of the trace
+	At   time.Duration
+	MAC  net.HardwareAddr
+	Type dhcpv4.MessageType
+}
+
+// Shape describes the synthetic traffic generated by Generate
+type Shape struct {
+	Clients  int
+	Duration time.Duration
+	// RenewInterval is the time between two requests of a client
+	RenewInterval time.Duration
+	// Churn is the probability that a client releases its lease at a
+	// renewal and is replaced by a new one
+	Churn float64
+	// Misbehavior is the probability that a message is sent twice in a
+	// row, as a retransmission
+	Misbehavior float64
+	Seed        int64
+}
+
+// Generate builds a trace following shape. Clients join at a random time
+// within the first renew interval with a DISCOVER and a REQUEST, then renew
+// every RenewInterval. The same shape always generates the same trace.
+func Generate(shape Shape) ([]Message, error) {
+	if shape.Clients <= 0 || shape.Duration <= 0 || shape.RenewInterval <= 0 {
+		return nil, errors.New("clients, duration and renew interval must be positive")
+	}
+
+	rng := rand.New(rand.NewSource(shape.Seed))
+	var (
+		trace []Message
+		next  uint64
+	)
+	newMAC := func() net.HardwareAddr {
+		next++
+		mac := make(net.HardwareAddr, 8)
+		binary.BigEndian.PutUint64(mac, next)
+		// locally administered unicast addresses
+		mac[2] = 0x02
+		return mac[2:]
+	}
+	send := func(at time.Duration, mac net.HardwareAddr, t dhcpv4.MessageType) {
+		msg := Message{At: at, MAC: mac, Type: t}
+		trace = append(trace, msg)
+		if rng.Float64() < shape.Misbehavior {
+			trace = append(trace, msg)
+		}
+	}
+
+	for i := 0; i < shape.Clients; i++ {
+		mac := newMAC()
+		at := time.Duration(rng.Int63n(int64(shape.RenewInterval)))
+		send(at, mac, dhcpv4.MessageTypeDiscover)
+		send(at, mac, dhcpv4.MessageTypeRequest)
+		for at += shape.RenewInterval; at < shape.Duration; at += shape.RenewInterval {
+			if rng.Float64() < shape.Churn {
+				send(at, mac, dhcpv4.MessageTypeRelease)
+				mac = newMAC()
+				send(at, mac, dhcpv4.MessageTypeDiscover)
+			}
+			send(at, mac, dhcpv4.MessageTypeRequest)
+		}
+	}
+
+	sort.SliceStable(trace, func(i, j int) bool { return trace[i].At < trace[j].At })
+	return trace, nil
+}
+
+// Read reads a trace in CSV format, one message per line:
+// <offset>,<mac>,discover|request|release, the offset being a duration
+// from the start of the trace. Lines must be ordered by offset, and # starts
+// a comment.
+func Read(r io.Reader) ([]Message, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 3
+	cr.Comment = '#'
+
+	var trace []Message
+	for {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			return trace, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+
+		at, err := time.ParseDuration(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid offset: %w", line, err)
+		}
+		if len(trace) > 0 && at < trace[len(trace)-1].At {
+			return nil, fmt.Errorf("line %d: offsets are not ordered", line)
+		}
+		mac, err := net.ParseMAC(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		var t dhcpv4.MessageType
+		switch strings.ToLower(fields[2]) {
+		case "discover":
+			t = dhcpv4.MessageTypeDiscover
+		case "request":
+			t = dhcpv4.MessageTypeRequest
+		case "release":
+			t = dhcpv4.MessageTypeRelease
+		default:
+			return nil, fmt.Errorf("line %d: unknown message type %q", line, fields[2])
+		}
+		trace = append(trace, Message{At: at, MAC: mac, Type: t})
+	}
+}
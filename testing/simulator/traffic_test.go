@@ -0,0 +1,72 @@
+package simulator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestGenerateIsDeterministic(t *testing.T) {
+	shape := Shape{Clients: 20, Duration: 6 * time.Hour, RenewInterval: 30 * time.Minute, Churn: 0.1, Misbehavior: 0.05, Seed: 7}
+	first, err := Generate(shape)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Generate(shape)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Fatal("the same shape generated two traces")
+	}
+	for i := 1; i < len(first); i++ {
+		if first[i].At < first[i-1].At {
+			t.Fatalf("message %d at %s before message %d at %s", i, first[i].At, i-1, first[i-1].At)
+		}
+	}
+	if first[len(first)-1].At >= shape.Duration {
+		t.Errorf("last message at %s, past the duration", first[len(first)-1].At)
+	}
+}
+
+func TestGenerateRejectsEmptyShape(t *testing.T) {
+	if _, err := Generate(Shape{Clients: 1, Duration: time.Hour}); err == nil {
+		t.Fatal("no error without a renew interval")
+	}
+}
+
+func TestRead(t *testing.T) {
+	trace, err := Read(strings.NewReader("# comment\n0s,02:00:00:00:00:01,discover\n1s,02:00:00:00:00:01,REQUEST\n1m,02:00:00:00:00:01,release\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dhcpv4.MessageType{dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeRelease}
+	if len(trace) != len(want) {
+		t.Fatalf("read %d messages, want %d", len(trace), len(want))
+	}
+	for i, typ := range want {
+		if trace[i].Type != typ {
+			t.Errorf("message %d is a %s, want a %s", i, trace[i].Type, typ)
+		}
+	}
+	if trace[2].At != time.Minute || trace[2].MAC.String() != "02:00:00:00:00:01" {
+		t.Errorf("last message %+v", trace[2])
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	for name, in := range map[string]string{
+		"offset": "soon,02:00:00:00:00:01,discover\n",
+		"order":  "1m,02:00:00:00:00:01,discover\n0s,02:00:00:00:00:01,request\n",
+		"mac":    "0s,nope,discover\n",
+		"type":   "0s,02:00:00:00:00:01,inform\n",
+		"fields": "0s,02:00:00:00:00:01\n",
+	} {
+		if _, err := Read(strings.NewReader(in)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// Kinds of the entries of a timeline
+const (
+	TimelineGrant    = "grant"
+	TimelineOffer    = "offer"
+	TimelineRenewal  = "renewal"
+	TimelineRelease  = "release"
+	TimelineExpiry   = "expiry"
+	TimelineReassign = "reassignment"
+	TimelineUnbind   = "unbind"
+	TimelineRefusal  = "refusal"
+	// TimelineLink is a DHCPv6 lease of the host of the client, see
+	// REDIS_LINK_KEY_PREFIX
+	TimelineLink = "link"
+	// TimelineGap marks where a source was trimmed or could not be read:
+	// entries of that source are missing before it
+	TimelineGap = "gap"
+)
+
+// Sources of the entries of a timeline
+const (
+	SourceRecord   = "record"
+	SourceHistory  = "history"
+	SourceOpLog    = "oplog"
+	SourceRefusals = "refusals"
+	SourceLink     = "link"
+)
+
+// TimelineEntry is one thing that happened to a client, as told by one of
+// the sources of its timeline
+type TimelineEntry struct {
+	Time   time.Time
+	Kind   string
+	Source string
+	IP     net.IP `json:",omitempty"`
+	Detail string `json:",omitempty"`
+}
+
+// Timeline is the history of a client, oldest first, merged from its
+// current record, the history of its bindings, the operation log and the
+// refusal ledger, with the DHCPv6 leases linked to it. A disabled source
+// contributes nothing; Sources lists the ones that were read.
+type Timeline struct {
+	Client  string
+	Sources []string
+	Entries []TimelineEntry
+}
+
+// History returns the past bindings of mac, most recent first
+func (r *RedisProvider) History(ctx context.Context, mac string) ([]HistoryEntry, error) {
+	vals, err := r.history.LRange(ctx, r.ns.history+mac, 0, -1).Result()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	entries := make([]HistoryEntry, 0, len(vals))
+	for _, val := range vals {
+		var e HistoryEntry
+		if err := json.Unmarshal([]byte(val), &e); err != nil || e.IP == nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Timeline reconstructs the timeline of client, a MAC address, a client key,
+// a DUID carrying a MAC address or, in privacy mode, a pseudonym. The
+// renewals are sampled: only the last one persisted is known, from the
+// record. A source that cannot be read is marked with a gap rather than
+// failing the whole timeline.
+func (p *PluginState) Timeline(ctx context.Context, client string) (*Timeline, error) {
+	if strings.HasPrefix(client, pseudonymPrefix) {
+		var err error
+		if client, err = p.Reveal(ctx, client); err != nil {
+			return nil, err
+		}
+	}
+	if mac, err := net.ParseMAC(client); err == nil && len(mac) == 6 {
+		client = mac.String()
+	} else if b, err := hex.DecodeString(client); err == nil {
+		if id, err := dhcpv6.DUIDFromBytes(b); err == nil {
+			if mac, ok := macFromDUID(id); ok {
+				client = mac.String()
+			}
+		}
+	}
+	client = strings.ToLower(client)
+	t := &Timeline{Client: client}
+	now := p.clock.Now()
+	add := func(e TimelineEntry) {
+		t.Entries = append(t.Entries, e)
+	}
+	gap := func(source string, at time.Time, format string, args ...any) {
+		add(TimelineEntry{Time: at, Kind: TimelineGap, Source: source, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	t.Sources = append(t.Sources, SourceRecord)
+	switch rec, err := p.storage.GetRecord(client); {
+	case err == nil:
+		kind := TimelineRenewal
+		if rec.offered() {
+			kind = TimelineOffer
+		}
+		detail := "until " + rec.Expires.Format(time.RFC3339)
+		if rec.Policy != "" {
+			detail += ", " + rec.Policy
+		}
+		at := rec.LastSeen
+		if at.IsZero() {
+			// records written before the last request was persisted
+			at = now
+		}
+		add(TimelineEntry{Time: at, Kind: kind, Source: SourceRecord, IP: rec.IP, Detail: detail})
+	case !errors.Is(err, ErrNotFound):
+		gap(SourceRecord, now, "could not read the record: %v", err)
+	}
+
+	if p.storage.historyLength > 0 {
+		t.Sources = append(t.Sources, SourceHistory)
+		history, err := p.storage.History(ctx, client)
+		switch {
+		case err != nil:
+			gap(SourceHistory, now, "could not read the history: %v", err)
+		case len(history) >= p.storage.historyLength:
+			// the oldest bindings were trimmed
+			oldest := history[len(history)-1]
+			gap(SourceHistory, oldest.Time.Add(-time.Nanosecond), "grants before %s trimmed, %d kept",
+				oldest.Time.Format(time.RFC3339), p.storage.historyLength)
+		}
+		for _, h := range history {
+			add(TimelineEntry{Time: h.Time, Kind: TimelineGrant, Source: SourceHistory, IP: h.IP})
+		}
+	}
+
+	if p.oplog != nil {
+		t.Sources = append(t.Sources, SourceOpLog)
+		ops := p.oplog.snapshot()
+		if p.cfg.OpLogStream {
+			var err error
+			if ops, err = p.storage.OpLog(ctx, p.poolName()); err != nil {
+				gap(SourceOpLog, now, "could not read the operation log: %v", err)
+			}
+		}
+		if len(ops) > 0 && ops[0].Seq != 1 {
+			gap(SourceOpLog, ops[0].Time.Add(-time.Nanosecond), "operations before #%d trimmed", ops[0].Seq)
+		}
+		for _, o := range ops {
+			if o.MAC != client {
+				continue
+			}
+			add(TimelineEntry{Time: o.Time, Kind: opKind(o), Source: SourceOpLog, IP: o.IP, Detail: o.Caller})
+		}
+	}
+
+	t.Sources = append(t.Sources, SourceRefusals)
+	refusals, err := p.storage.Refusals(ctx, client)
+	switch {
+	case err != nil:
+		gap(SourceRefusals, now, "could not read the refusals: %v", err)
+	case len(refusals) >= refusalsKept:
+		oldest := refusals[len(refusals)-1]
+		gap(SourceRefusals, oldest.Time.Add(-time.Nanosecond), "refusals before %s trimmed, %d kept",
+			oldest.Time.Format(time.RFC3339), refusalsKept)
+	}
+	for _, r := range refusals {
+		detail := r.Reason
+		if r.Detail != "" {
+			detail += ": " + r.Detail
+		}
+		add(TimelineEntry{Time: r.Time, Kind: TimelineRefusal, Source: SourceRefusals, Detail: detail + " (" + r.Pool + ")"})
+	}
+
+	t.Sources = append(t.Sources, SourceLink)
+	switch links, err := p.storage.Links(ctx, client); {
+	case err != nil:
+		gap(SourceLink, now, "could not read the link: %v", err)
+	case links[0] != "":
+		duid := links[0]
+		for _, kind := range []v6Kind{kindAddress, kindPrefix} {
+			rec, err := p.storage.GetRecord6(kind, duid)
+			if err != nil {
+				if !errors.Is(err, ErrNotFound) {
+					gap(SourceLink, now, "could not read the DHCPv6 %s: %v", kind.name, err)
+				}
+				continue
+			}
+			at := rec.LastSeen
+			if at.IsZero() {
+				at = now
+			}
+			add(TimelineEntry{Time: at, Kind: TimelineLink, Source: SourceLink, IP: rec.IP,
+				Detail: fmt.Sprintf("DHCPv6 %s of DUID %s until %s", kind.name, duid, rec.Expires.Format(time.RFC3339))})
+		}
+	}
+
+	sort.SliceStable(t.Entries, func(i, j int) bool {
+		return t.Entries[i].Time.Before(t.Entries[j].Time)
+	})
+	return t, nil
+}
+
+// opKind tells what a binding or unbinding of the operation log was from
+// the functions that made it
+func opKind(o OpLogEntry) string {
+	for _, fn := range strings.Split(o.Caller, " < ") {
+		switch fn {
+		case "handleExpired":
+			return TimelineExpiry
+		case "release", "decline":
+			return TimelineRelease
+		case "reconcileExternalChange", "claim", "reassign", "Observe":
+			return TimelineReassign
+		}
+	}
+	if o.Op == OpBind {
+		return TimelineGrant
+	}
+	return TimelineUnbind
+}
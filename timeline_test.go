@@ -0,0 +1,142 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const timelineGolden = "testdata/timeline.golden"
+
+// rfc3339 matches the times in the details of the timeline entries
+var rfc3339 = regexp.MustCompile(`\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(?:\.\d+)?(?:Z|[+-]\d\d:\d\d)`)
+
+// relativeTimeline returns the timeline t with its times as offsets from
+// start, to compare with a golden file
+func relativeTimeline(t *testing.T, tl *Timeline, start time.Time) []byte {
+	t.Helper()
+	offset := func(at time.Time) string { return "+" + at.Sub(start).Round(time.Second).String() }
+	type entry struct {
+		At     string
+		Kind   string
+		Source string
+		IP     net.IP `json:",omitempty"`
+		Detail string `json:",omitempty"`
+	}
+	out := struct {
+		Client  string
+		Sources []string
+		Entries []entry
+	}{Client: tl.Client, Sources: tl.Sources}
+	for _, e := range tl.Entries {
+		detail := rfc3339.ReplaceAllStringFunc(e.Detail, func(s string) string {
+			at, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return offset(at)
+		})
+		out.Entries = append(out.Entries, entry{At: offset(e.Time), Kind: e.Kind, Source: e.Source, IP: e.IP, Detail: detail})
+	}
+	b, err := json.MarshalIndent(out, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(b, '\n')
+}
+
+func TestTimeline(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.65.10", "10.0.65.12", "1h", "history=2", "oplog=64")
+	// whole seconds, the details of the entries are
+	start := time.Now().Truncate(time.Second)
+	p.SetClock(newFakeClock(start))
+	const mac = "00:11:22:33:44:0a"
+
+	// a scripted lifecycle: grant, renewal, release, refusal, grant,
+	// expiry and grant again
+	ip := lease(t, p, mac)
+	advance(p, 10*time.Minute)
+	renewal(t, p, mac, ip)
+	advance(p, 10*time.Minute)
+	releaseLease(t, p, mac, ip)
+	advance(p, 10*time.Minute)
+	exchange(t, p, newRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(192, 0, 2, 9)))))
+	ledgerOf(t, m, mac, 1)
+	advance(p, 10*time.Minute)
+	lease(t, p, mac)
+	expire(t, m, p, mac)
+	eventually(t, "the expiry", func() bool { return p.leases.ipOf(mac) == nil })
+	// its record and index entry outlive the lease by 10 seconds
+	m.Del(p.storage.ns.main + mac)
+	m.Del(p.storage.ns.index + ip.String())
+	advance(p, 10*time.Minute)
+	lease(t, p, mac)
+
+	// however the client is named, by its MAC address or its DUID-LL
+	var got []byte
+	for _, client := range []string{mac, "00-11-22-33-44-0A", "0003000100112233440a"} {
+		tl, err := p.Timeline(context.Background(), client)
+		if err != nil {
+			t.Fatalf("timeline of %s: %v", client, err)
+		}
+		b := relativeTimeline(t, tl, start)
+		if got != nil && string(b) != string(got) {
+			t.Errorf("timeline of %s:\n%s\nwant:\n%s", client, b, got)
+		}
+		got = b
+	}
+
+	if *update {
+		if err := os.WriteFile(timelineGolden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(timelineGolden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("timeline:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestTimelineSources(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.66.10", "10.0.66.12", "1h", "history=0")
+	const mac = "00:11:22:33:44:0b"
+	ip := lease(t, p, mac)
+
+	// without history nor operation log, the record remains; a source that
+	// cannot be read leaves a gap rather than failing the timeline
+	m.Set(REDIS_REFUSALS_KEY_PREFIX+mac, "not a list")
+	tl, err := p.Timeline(context.Background(), mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{SourceRecord, SourceRefusals, SourceLink}; !reflect.DeepEqual(tl.Sources, want) {
+		t.Errorf("sources %v, want %v", tl.Sources, want)
+	}
+	var kinds []string
+	for _, e := range tl.Entries {
+		kinds = append(kinds, e.Source+"/"+e.Kind)
+		if e.Source == SourceRecord && !e.IP.Equal(ip) {
+			t.Errorf("record entry for %s, want %s", e.IP, ip)
+		}
+	}
+	if want := []string{"record/renewal", "refusals/gap"}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("entries %v, want %v", kinds, want)
+	}
+
+	if _, err := p.Timeline(context.Background(), "00:11:22:33:44:0c"); err != nil {
+		t.Errorf("timeline of an unknown client: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+	// REDIS_TRACE_TARGETS_KEY is the sorted set of the traced clients shared
+	// by all instances, scored by the end of their tracing
+	REDIS_TRACE_TARGETS_KEY = "t:dhcp:targets"
+	// REDIS_TRACE_KEY_PREFIX prefixes the capped list of the traces of a client
+	REDIS_TRACE_KEY_PREFIX = "t:dhcp:trace:"
+)
+
+const (
+	// default time a client is traced for
+	defaultTraceTime = time.Hour
+	// number of trace lines kept per client, and how long they are kept
+	traceLogLength = 1000
+	traceLogTTL    = 24 * time.Hour
+)
+
+// traceTargets holds the clients traced by an instance, with the end of
+// their tracing
+type traceTargets struct {
+	mu      sync.Mutex
+	targets map[string]time.Time
+	// order is the order the entries were set in, oldest first
+	order arrivals[string]
+	// limit bounds the number of targets, 0 for no bound
+	limit int
+}
+
+func (t *traceTargets) add(mac string, until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.targets == nil {
+		t.targets = make(map[string]time.Time)
+	}
+	if _, ok := t.targets[mac]; !ok && t.limit > 0 && len(t.targets) >= t.limit {
+		now := time.Now()
+		for m, u := range t.targets {
+			if !now.Before(u) {
+				delete(t.targets, m)
+				t.order.remove(m)
+			}
+		}
+		if len(t.targets) >= t.limit {
+			evictOldest(t.targets, &t.order)
+		}
+	}
+	t.order.set(mac)
+	t.targets[mac] = until
+}
+
+func (t *traceTargets) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.targets)
+}
+
+// active reports whether mac is traced at now, forgetting it once expired
+func (t *traceTargets) active(mac string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.targets[mac]
+	if ok && !now.Before(until) {
+		delete(t.targets, mac)
+		t.order.remove(mac)
+		return false
+	}
+	return ok
+}
+
+// AddTraceTarget shares a traced client with the other instances
+func (r *RedisProvider) AddTraceTarget(mac string, until time.Time) error {
+	ctx := context.TODO()
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, REDIS_TRACE_TARGETS_KEY, redis.Z{Score: float64(until.Unix()), Member: mac})
+		pipe.ZRemRangeByScore(ctx, REDIS_TRACE_TARGETS_KEY, "-inf", fmt.Sprint(time.Now().Unix()))
+		return nil
+	})
+	return unavailable(err)
+}
+
+// TraceTargets returns the traced clients shared by the instances
+func (r *RedisProvider) TraceTargets(ctx context.Context) (map[string]time.Time, error) {
+	zs, err := r.rdb.ZRangeByScoreWithScores(ctx, REDIS_TRACE_TARGETS_KEY, &redis.ZRangeBy{
+		Min: fmt.Sprint(time.Now().Unix()),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	targets := make(map[string]time.Time, len(zs))
+	for _, z := range zs {
+		if mac, ok := z.Member.(string); ok {
+			targets[mac] = time.Unix(int64(z.Score), 0)
+		}
+	}
+	return targets, nil
+}
+
+// AppendTrace stores the trace lines of one request of mac
+func (r *RedisProvider) AppendTrace(mac string, lines []string) error {
+	ctx := context.TODO()
+	key := REDIS_TRACE_KEY_PREFIX + mac
+	vals := make([]interface{}, len(lines))
+	for i, l := range lines {
+		vals[i] = l
+	}
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, vals...)
+		pipe.LTrim(ctx, key, -traceLogLength, -1)
+		pipe.Expire(ctx, key, traceLogTTL)
+		return nil
+	})
+	return unavailable(err)
+}
+
+// TraceLog returns the stored trace lines of mac, oldest first
+func (r *RedisProvider) TraceLog(ctx context.Context, mac string) ([]string, error) {
+	lines, err := r.rdb.LRange(ctx, REDIS_TRACE_KEY_PREFIX+mac, 0, -1).Result()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	return lines, nil
+}
+
+// Trace logs every decision taken for the requests of mac during d, and
+// shares the target with the other instances if trace_shared is set
+func (p *PluginState) Trace(mac string, d time.Duration) error {
+	until := p.clock.Now().Add(d)
+	p.traced.add(mac, until)
+	log.Infof("tracing MAC %s until %s", mac, until.Format(time.RFC3339))
+	if p.cfg.TraceShared {
+		return p.storage.AddTraceTarget(mac, until)
+	}
+	return nil
+}
+
+// loadTraceTargets picks up the targets shared by the other instances
+func (p *PluginState) loadTraceTargets() error {
+	targets, err := p.storage.TraceTargets(context.TODO())
+	if err != nil {
+		return err
+	}
+	for mac, until := range targets {
+		p.traced.add(mac, until)
+	}
+	return nil
+}
+
+// requestTrace collects the decisions taken for one request of a traced
+// client. A nil *requestTrace traces nothing.
+type requestTrace struct {
+	p     *PluginState
+	mac   string
+	xid   string
+	lines []string
+}
+
+// startTrace returns the trace of req, or nil if its client is not traced
+func (p *PluginState) startTrace(req *dhcpv4.DHCPv4, mac string) *requestTrace {
+	if !p.traced.active(mac, p.clock.Now()) {
+		return nil
+	}
+	t := &requestTrace{p: p, mac: mac, xid: req.TransactionID.String()}
+	t.step("%s from %s via %s", req.MessageType(), mac, req.GatewayIPAddr)
+	return t
+}
+
+// step records a decision
+func (t *requestTrace) step(format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	line := fmt.Sprintf(format, args...)
+	log.Infof("[trace %s %s] %s", t.mac, t.xid, line)
+	t.lines = append(t.lines, t.p.clock.Now().UTC().Format(time.RFC3339Nano)+" "+t.xid+" "+line)
+}
+
+// finish stores the collected decisions if trace_log is set
+func (t *requestTrace) finish() {
+	if t == nil || !t.p.cfg.TraceLog || len(t.lines) == 0 {
+		return
+	}
+	if err := t.p.storage.AppendTrace(t.mac, t.lines); err != nil {
+		log.Warnf("could not store trace of %s: %v", t.mac, err)
+	}
+}
@@ -0,0 +1,93 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// traceLog returns the stored trace lines of mac
+func traceLog(t *testing.T, p *PluginState, mac string) []string {
+	t.Helper()
+	lines, err := p.storage.TraceLog(context.Background(), mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+// assertTraced checks that lines hold each of the steps, in order
+func assertTraced(t *testing.T, lines []string, steps ...string) {
+	t.Helper()
+	i := 0
+	for _, l := range lines {
+		if i < len(steps) && strings.Contains(l, steps[i]) {
+			i++
+		}
+	}
+	if i < len(steps) {
+		t.Errorf("step %q not traced in:\n%s", steps[i], strings.Join(lines, "\n"))
+	}
+}
+
+func TestTrace(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.9.10", "10.0.9.20", "1h", "trace_log=true", "mtu=1400")
+	const mac, other = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+
+	lease(t, p, other)
+	p.handleControl("trace 00-11-22-33-44-0A 10m")
+	ip := lease(t, p, mac)
+	if lines := traceLog(t, p, other); len(lines) != 0 {
+		t.Errorf("client not traced has a trace: %v", lines)
+	}
+	lines := traceLog(t, p, mac)
+	assertTraced(t, lines,
+		"DISCOVER from "+mac, "pool 10.0.9.10-10.0.9.20", "no record", "allocated "+ip.String(),
+		"offer committed", "options added: [Interface MTU]", "answering "+ip.String(),
+		"REQUEST from "+mac, "record found: "+ip.String(), "offer of "+ip.String()+" granted", "answering "+ip.String())
+
+	// the trace ends after its duration
+	advance(p, 5*time.Minute)
+	if typ := renewal(t, p, mac, ip); typ != dhcpv4.MessageTypeAck {
+		t.Fatalf("renewal answered %s", typ)
+	}
+	traced := len(traceLog(t, p, mac))
+	if traced <= len(lines) {
+		t.Error("renewal during the trace not traced")
+	}
+	advance(p, 5*time.Minute)
+	if typ := renewal(t, p, mac, ip); typ != dhcpv4.MessageTypeAck {
+		t.Fatalf("renewal answered %s", typ)
+	}
+	if n := len(traceLog(t, p, mac)); n != traced {
+		t.Errorf("%d lines traced after the end of the trace", n-traced)
+	}
+	if n := p.traced.len(); n != 0 {
+		t.Errorf("%d trace targets left", n)
+	}
+}
+
+func TestTraceShared(t *testing.T) {
+	m := miniredis.RunT(t)
+	a := startPlugin(t, m, "10.0.9.10", "10.0.9.20", "1h", "trace_shared=true", "trace_log=true")
+	const mac = "00:11:22:33:44:0a"
+	if err := a.Trace(mac, 10*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// another instance picks up the target when it starts
+	b := startPlugin(t, m, "10.0.10.10", "10.0.10.20", "1h", "trace_shared=true", "trace_log=true")
+	ip := lease(t, b, mac)
+	assertTraced(t, traceLog(t, b, mac), "allocated "+ip.String())
+
+	// the targets are not shared without the option
+	c := startPlugin(t, m, "10.0.11.10", "10.0.11.20", "1h")
+	if n := c.traced.len(); n != 0 {
+		t.Errorf("%d trace targets picked up without trace_shared", n)
+	}
+}
@@ -0,0 +1,557 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/go-redis/redis/v9"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// Records of the DHCPv6 leases are keyed by the hex of the DUID of their
+// client, under prefixes of their own so that they never collide with the
+// DHCPv4 records.
+const (
+	REDIS_V6_KEY_PREFIX        = "dhcp6:"
+	REDIS_V6_SHADOW_KEY_PREFIX = "s:dhcp6:"
+)
+
+// smallest prefix served, so that its range fits in maxRange6
+const minPrefixLength6 = 128 - 24
+
+// Config6 is the configuration of a DHCPv6 instance
+type Config6 struct {
+	URI       string
+	Start     net.IP
+	End       net.IP
+	LeaseTime time.Duration
+	// Delegation is the pool of the prefixes delegated in IA_PD, split in
+	// prefixes of DelegationLength; no prefix is delegated if nil
+	Delegation       *net.IPNet
+	DelegationLength int
+	// RapidCommit commits the leases of a SOLICIT carrying the Rapid
+	// Commit option, answered with a REPLY
+	RapidCommit bool
+	// PropagatePolicy applies the denylist and the labels of the DHCPv4
+	// lease of the MAC address carried by the DUID of a client, see
+	// correlation
+	PropagatePolicy bool
+}
+
+// config6Options maps every optional key=value argument of a DHCPv6
+// instance to its parser
+var config6Options = map[string]func(c *Config6, val string) error{
+	"delegate": func(c *Config6, val string) error {
+		_, n, err := net.ParseCIDR(val)
+		if err != nil || n.IP.To4() != nil {
+			return errors.New("want an IPv6 prefix")
+		}
+		c.Delegation = n
+		return nil
+	},
+	"delegate_length": func(c *Config6, val string) error {
+		var n int
+		if _, err := fmt.Sscanf(val, "%d", &n); err != nil || n <= 0 || n > 128 {
+			return errors.New("want a prefix length")
+		}
+		c.DelegationLength = n
+		return nil
+	},
+	"rapid_commit": func(c *Config6, val string) error {
+		b, err := strconv.ParseBool(val)
+		c.RapidCommit = b
+		return err
+	},
+	"propagate_policy": func(c *Config6, val string) error {
+		b, err := strconv.ParseBool(val)
+		c.PropagatePolicy = b
+		return err
+	},
+}
+
+// PluginState6 is the data held by a DHCPv6 instance of the plugin
+type PluginState6 struct {
+	LeaseTime time.Duration
+	cfg       *Config6
+	storage   *RedisProvider
+	// addresses are leased in IA_NA, prefixes delegated in IA_PD if set
+	addresses *pool6
+	prefixes  *pool6
+	refusals  *refusalLedger
+	// correlations link the clients to their DHCPv4 leases
+	correlations *correlator
+	// clock gives the time of the leases, see SetClock
+	clock *instanceClock
+}
+
+// parseConfig6 parses the arguments of a DHCPv6 instance:
+// <uri> <start> <end> <lease time>, or <uri> <prefix> <lease time>,
+// followed by optional key=value pairs. The positional arguments may be
+// given by name instead, see positional.
+func parseConfig6(args []string) (*Config6, error) {
+	args, err := positional(args, true)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config6{}
+	n := 4
+	if len(args) > 1 && strings.Contains(args[1], "/") {
+		n = 3
+	}
+	if len(args) < n {
+		return nil, fmt.Errorf("want <uri> <start> <end> <lease time> or <uri> <prefix> <lease time>, got %d arguments", len(args))
+	}
+	if n == 3 {
+		_, pfx, err := net.ParseCIDR(args[1])
+		if err != nil || pfx.IP.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 prefix: %v", args[1])
+		}
+		ones, _ := pfx.Mask.Size()
+		if ones < minPrefixLength6 || ones == 128 {
+			return nil, fmt.Errorf("prefix %s must be between /%d and /127", pfx, minPrefixLength6)
+		}
+		// the subnet-router anycast address is never leased
+		c.Start = make(net.IP, net.IPv6len)
+		copy(c.Start, pfx.IP)
+		binary.BigEndian.PutUint64(c.Start[8:], binary.BigEndian.Uint64(pfx.IP[8:])+1)
+		c.End = make(net.IP, net.IPv6len)
+		for i := range c.End {
+			c.End[i] = pfx.IP[i] | ^pfx.Mask[i]
+		}
+	} else {
+		c.Start = net.ParseIP(args[1])
+		if c.Start == nil || c.Start.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address: %v", args[1])
+		}
+		c.End = net.ParseIP(args[2])
+		if c.End == nil || c.End.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address: %v", args[2])
+		}
+	}
+	c.URI = args[0]
+	if c.URI == "" {
+		return nil, errors.New("uri cannot be empty")
+	}
+	d, err := parseDuration(args[n-1], leaseBounds)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lease time: %w", err)
+	}
+	c.LeaseTime = d
+
+	for _, arg := range args[n:] {
+		key, val, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid argument %q, want key=value", arg)
+		}
+		parse, ok := config6Options[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown option %q, valid options are: delegate, delegate_length, propagate_policy, rapid_commit", key)
+		}
+		if err := parse(c, val); err != nil {
+			return nil, fmt.Errorf("invalid value %q for option %s: %w", val, key, err)
+		}
+	}
+	if (c.Delegation == nil) != (c.DelegationLength == 0) {
+		return nil, errors.New("delegate and delegate_length go together")
+	}
+	if c.Delegation != nil {
+		ones, _ := c.Delegation.Mask.Size()
+		if c.DelegationLength < ones || c.DelegationLength-ones > 24 {
+			return nil, fmt.Errorf("cannot split %s in more than 2^24 prefixes of /%d", c.Delegation, c.DelegationLength)
+		}
+	}
+	return c, nil
+}
+
+// setup6 is the setup function to initialize the handler for DHCPv6
+// traffic.
+func setup6(args ...string) (handler.Handler6, error) {
+	p, err := newPlugin6(args...)
+	if err != nil {
+		return nil, err
+	}
+	return p.Handler6, nil
+}
+
+// newPlugin6 sets a DHCPv6 instance up from its arguments
+func newPlugin6(args ...string) (*PluginState6, error) {
+	cfg, err := parseConfig6(args)
+	if err != nil {
+		return nil, err
+	}
+	p := &PluginState6{cfg: cfg, LeaseTime: cfg.LeaseTime, correlations: newCorrelator(), clock: newInstanceClock()}
+	if p.addresses, err = newAddressPool6(cfg.Start, cfg.End); err != nil {
+		return nil, fmt.Errorf("could not create an allocator: %w", err)
+	}
+	if cfg.Delegation != nil {
+		if p.prefixes, err = newPrefixPool6(cfg.Delegation, cfg.DelegationLength); err != nil {
+			return nil, fmt.Errorf("could not create a prefix allocator: %w", err)
+		}
+	}
+
+	p.storage, err = AcquireStorage(cfg.URI, StorageOptions{})
+	if err != nil {
+		return nil, err
+	}
+	p.refusals = newRefusalLedger(p.storage, fmt.Sprintf("%s-%s", cfg.Start, cfg.End), p.clock)
+	// listen right away, so that no notification is missed during the reload
+	notifications, unlisten := p.storage.Listen()
+	for _, pool := range p.pools() {
+		if err := p.reload(pool); err != nil {
+			unlisten()
+			ReleaseStorage(p.storage)
+			return nil, fmt.Errorf("could not load records: %v", err)
+		}
+	}
+
+	go p.watchNotifications(notifications.C)
+	// DHCPv6 instances are never closed
+	go p.refusals.run(nil)
+	go p.correlateLoop()
+	return p, nil
+}
+
+// pools returns the pools of the instance
+func (p *PluginState6) pools() []*pool6 {
+	if p.prefixes == nil {
+		return []*pool6{p.addresses}
+	}
+	return []*pool6{p.addresses, p.prefixes}
+}
+
+// reload marks the leases stored for pool as in use
+func (p *PluginState6) reload(pool *pool6) error {
+	records, err := p.storage.GetAllRecords6(context.TODO(), pool.kind)
+	if err != nil {
+		return err
+	}
+	for duid, rec := range records {
+		if !pool.fits(rec) {
+			continue
+		}
+		want := pool.net(rec)
+		if _, err := allocateExact(pool.allocator, want); err != nil {
+			log.Warnf("could not reload the %s %s of DUID %s: %v", pool.kind.name, want.String(), duid, err)
+		}
+	}
+	log.Printf("Loaded %d DHCPv6 %s leases", len(records), pool.kind.name)
+	return nil
+}
+
+// Handler6 answers the IA_NA and IA_PD of SOLICIT, REQUEST, RENEW and
+// REBIND messages with the address and the prefix leased to the client,
+// allocating them if needed, and frees them on RELEASE
+func (p *PluginState6) Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	msg, err := req.GetInnerMessage()
+	if err != nil {
+		log.Errorf("could not decode DHCPv6 message: %v", err)
+		return nil, true
+	}
+	switch msg.Type() {
+	case dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind,
+		dhcpv6.MessageTypeRelease:
+	default:
+		return resp, false
+	}
+	na := msg.Options.OneIANA()
+	pd := msg.Options.OneIAPD()
+	if p.prefixes == nil {
+		pd = nil
+	}
+	if na == nil && pd == nil {
+		// nothing for us
+		return resp, false
+	}
+	cid := msg.Options.ClientID()
+	if cid == nil {
+		log.Warnf("Dropping %s without client ID", msg.Type())
+		return nil, true
+	}
+	duid := hex.EncodeToString(cid.ToBytes())
+	corr := p.correlation(duid, cid)
+
+	if msg.Type() == dhcpv6.MessageTypeRelease {
+		if na != nil {
+			p.release(p.addresses, duid)
+		}
+		if pd != nil {
+			p.release(p.prefixes, duid)
+		}
+		return resp, false
+	}
+	if corr.denied {
+		log.Infof("Ignoring %s from DUID %s of denied MAC %s", msg.Type(), duid, corr.mac)
+		p.refusals.note(duid, ReasonDenied, corr.mac)
+		return nil, true
+	}
+
+	// a client renewing or rebinding extends the bindings it has, and is
+	// told of the ones it has not (RFC 8415 sections 18.3.4 and 18.3.5)
+	renewing := msg.Type() == dhcpv6.MessageTypeRenew || msg.Type() == dhcpv6.MessageTypeRebind
+	if na != nil {
+		opt, err := p.answerIANA(duid, na, renewing, corr)
+		if err != nil {
+			log.Errorf("Could not lease IPv6 address for DUID %s: %v", duid, err)
+			p.refusals.note(duid, ReasonStorageError, err.Error())
+			return nil, true
+		}
+		resp.AddOption(opt)
+	}
+	if pd != nil {
+		opt, err := p.answerIAPD(duid, pd, renewing, corr)
+		if err != nil {
+			log.Errorf("Could not delegate IPv6 prefix to DUID %s: %v", duid, err)
+			p.refusals.note(duid, ReasonStorageError, err.Error())
+			return nil, true
+		}
+		resp.AddOption(opt)
+	}
+	if msg.Type() == dhcpv6.MessageTypeSolicit && msg.GetOneOption(dhcpv6.OptionRapidCommit) != nil {
+		p.rapidCommit(resp)
+	}
+	return resp, false
+}
+
+// rapidCommit turns the answer to a SOLICIT with the Rapid Commit option
+// into a REPLY if the instance commits on SOLICIT, or else into the
+// ADVERTISE of the four-message exchange. The leases are stored with their
+// full lease time in both cases, so that the REQUEST following an
+// ADVERTISE gets the same ones.
+func (p *PluginState6) rapidCommit(resp dhcpv6.DHCPv6) {
+	m, ok := resp.(*dhcpv6.Message)
+	if !ok {
+		return
+	}
+	if p.cfg.RapidCommit {
+		m.MessageType = dhcpv6.MessageTypeReply
+		m.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionRapidCommit})
+		return
+	}
+	m.MessageType = dhcpv6.MessageTypeAdvertise
+	m.Options.Del(dhcpv6.OptionRapidCommit)
+}
+
+// answerIANA returns the IA_NA answering ia with the address of duid. An
+// exhausted pool is answered with the NoAddrsAvail status, the renewal of a
+// client without address with the NoBinding status.
+func (p *PluginState6) answerIANA(duid string, ia *dhcpv6.OptIANA, renewing bool, corr correlation) (*dhcpv6.OptIANA, error) {
+	out := &dhcpv6.OptIANA{IaId: ia.IaId}
+	record, _, err := p.lease(p.addresses, duid, renewing, corr)
+	if errors.Is(err, ErrNoBinding) {
+		log.Infof("No IPv6 address to renew for DUID %s", duid)
+		p.refusals.note(duid, ReasonNoBinding, "NoBinding")
+		out.Options.Add(&dhcpv6.OptStatusCode{StatusCode: iana.StatusNoBinding, StatusMessage: "no binding"})
+		return out, nil
+	}
+	if errors.Is(err, ErrPoolExhausted) {
+		log.Warnf("Could not allocate IPv6 address for DUID %s: %v", duid, err)
+		p.refusals.note(duid, ReasonPoolExhausted, "NoAddrsAvail")
+		out.Options.Add(&dhcpv6.OptStatusCode{StatusCode: iana.StatusNoAddrsAvail, StatusMessage: "no addresses available"})
+		return out, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lease := record.Expires.Sub(p.clock.Now()).Round(time.Second)
+	out.T1, out.T2 = lease/2, lease*4/5
+	out.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: record.IP, PreferredLifetime: lease, ValidLifetime: lease})
+	log.Printf("found IPv6 address %s for DUID %s", record.IP, duid)
+	return out, nil
+}
+
+// lease returns the record of duid in pool extended by the lease time,
+// allocating an address or a prefix if it has none fitting the pool. The
+// record it had if it no longer fits is returned too. A client renewing
+// without any record gets ErrNoBinding rather than an allocation. The
+// record names the DHCPv4 lease the client is correlated with, and carries
+// its labels if they are propagated.
+func (p *PluginState6) lease(pool *pool6, duid string, renewing bool, corr correlation) (*Record, *Record, error) {
+	var stale *Record
+	record, err := p.storage.GetRecord6(pool.kind, duid)
+	switch {
+	case err == nil && pool.fits(*record):
+	case err == nil:
+		stale, record = record, nil
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrCorruptRecord):
+		record = nil
+	default:
+		return nil, nil, err
+	}
+
+	fresh := record == nil
+	if fresh && stale == nil && renewing {
+		return nil, nil, ErrNoBinding
+	}
+	if fresh {
+		n, err := allocatePreferred(pool.allocator, net.IPNet{})
+		if err != nil {
+			if errors.Is(err, allocators.ErrNoAddrAvail) {
+				return nil, stale, fmt.Errorf("%w: %w", ErrPoolExhausted, err)
+			}
+			return nil, stale, err
+		}
+		record = pool.record(n)
+	}
+	record.LastSeen = p.clock.Now()
+	record.Expires = record.LastSeen.Add(p.LeaseTime)
+	record.Link = ""
+	if corr.linked {
+		record.Link = corr.mac
+	}
+	if p.cfg.PropagatePolicy {
+		record.Labels = corr.labels
+	}
+	if err := p.storage.SaveRecord6(pool.kind, duid, record); err != nil {
+		if fresh {
+			n := pool.net(*record)
+			if err := pool.allocator.Free(n); err != nil {
+				log.Errorf("Could not roll back allocation of %s: %v", n.String(), err)
+			}
+		}
+		return nil, stale, err
+	}
+	return record, stale, nil
+}
+
+// release ends the lease of duid in pool, if the client has one
+func (p *PluginState6) release(pool *pool6, duid string) {
+	record, err := p.storage.GetRecord6(pool.kind, duid)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Warnf("could not get the DHCPv6 %s of %s to release: %v", pool.kind.name, duid, err)
+		}
+		return
+	}
+	if !pool.fits(*record) {
+		return
+	}
+	if err := p.storage.DeleteRecord6(pool.kind, duid); err != nil {
+		log.Errorf("could not release the %s %s of DUID %s: %v", pool.kind.name, record.IP, duid, err)
+		return
+	}
+	p.free(pool, duid, record)
+}
+
+// free returns the address or prefix of record to pool
+func (p *PluginState6) free(pool *pool6, duid string, record *Record) {
+	n := pool.net(*record)
+	if err := pool.allocator.Free(n); err != nil {
+		log.Errorf("error when release %s %v, err: %v", pool.kind.name, n.String(), err)
+		return
+	}
+	log.Infof("IPv6 %s lease %s for DUID %s is over.", pool.kind.name, n.String(), duid)
+}
+
+// watchNotifications frees the addresses and prefixes of the expired
+// DHCPv6 leases
+func (p *PluginState6) watchNotifications(ch <-chan *redis.Message) {
+	for msg := range ch {
+		if msg.Channel == REDIS_CONTROL_CHANNEL {
+			continue
+		}
+		for _, pool := range p.pools() {
+			duid, ok := strings.CutPrefix(msg.Payload, pool.kind.shadow)
+			if !ok {
+				continue
+			}
+			record, err := p.storage.GetRecord6(pool.kind, duid)
+			if err != nil {
+				if !errors.Is(err, ErrNotFound) {
+					log.Errorf("could not get expired DHCPv6 record of %s: %v", duid, err)
+				}
+				break
+			}
+			if !pool.fits(*record) {
+				// the lease of another instance sharing the storage
+				break
+			}
+			if !p.storage.endsBy(record.Expires, p.clock.Now()) {
+				// renewed right as the shadow key expired, which set it again
+				break
+			}
+			// the record outlives the shadow key: a client returning before
+			// it expires must not find the address it no longer holds
+			if err := p.storage.DeleteRecord6(pool.kind, duid); err != nil {
+				log.Errorf("could not delete expired DHCPv6 record of %s: %v", duid, err)
+				break
+			}
+			p.free(pool, duid, record)
+			break
+		}
+	}
+}
+
+// v6Kind names the keys of one type of DHCPv6 record
+type v6Kind struct {
+	name   string
+	prefix string
+	shadow string
+}
+
+var kindAddress = v6Kind{name: "address", prefix: REDIS_V6_KEY_PREFIX, shadow: REDIS_V6_SHADOW_KEY_PREFIX}
+
+// SaveRecord6 persists the record of a DHCPv6 client, with a shadow key
+// notifying its expiry
+func (r *RedisProvider) SaveRecord6(kind v6Kind, duid string, record *Record) error {
+	recBytes, err := encodeRecord(record)
+	if err != nil {
+		return err
+	}
+	_, err = r.rdb.TxPipelined(context.TODO(), func(pipe redis.Pipeliner) error {
+		pipe.Set(context.TODO(), kind.prefix+duid, string(recBytes), ttlUntil(record.Expires.Add(10*time.Second)))
+		pipe.Set(context.TODO(), kind.shadow+duid, "", ttlUntil(record.Expires))
+		return nil
+	})
+	return unavailable(err)
+}
+
+// DeleteRecord6 deletes the record of a DHCPv6 client, without expiry
+// notification
+func (r *RedisProvider) DeleteRecord6(kind v6Kind, duid string) error {
+	return unavailable(r.rdb.Del(context.TODO(), kind.prefix+duid, kind.shadow+duid).Err())
+}
+
+// GetRecord6 returns the record of a DHCPv6 client
+func (r *RedisProvider) GetRecord6(kind v6Kind, duid string) (*Record, error) {
+	val, err := r.rdb.Get(context.TODO(), kind.prefix+duid).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, duid)
+		}
+		return nil, unavailable(err)
+	}
+	var record Record
+	if err := json.Unmarshal([]byte(val), &record); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrCorruptRecord, duid, err)
+	}
+	if record.IP == nil {
+		return nil, fmt.Errorf("%w: %s: no IP address", ErrCorruptRecord, duid)
+	}
+	return &record, nil
+}
+
+// GetAllRecords6 returns the records of all DHCPv6 clients, keyed by DUID
+func (r *RedisProvider) GetAllRecords6(ctx context.Context, kind v6Kind) (map[string]Record, error) {
+	records := make(map[string]Record)
+	err := r.scanValues(ctx, kind.prefix, func(duid, val string) {
+		var rec Record
+		if err := json.Unmarshal([]byte(val), &rec); err != nil || rec.IP == nil {
+			log.Warnf("ignoring corrupt DHCPv6 record of %s", duid)
+			return
+		}
+		records[duid] = rec
+	})
+	return records, err
+}
@@ -0,0 +1,347 @@
+package rangeredisplugin
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// duidOf returns the DUID-LL of mac
+func duidOf(t *testing.T, mac string) dhcpv6.DUID {
+	t.Helper()
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: hw}
+}
+
+// startPlugin6 sets up a DHCPv6 instance against m, configured with args
+// after the URI. DHCPv6 instances are never closed.
+func startPlugin6(t *testing.T, m *miniredis.Miniredis, args ...string) handler.Handler6 {
+	t.Helper()
+	h, err := setup6(append([]string{redisURI(m)}, args...)...)
+	if err != nil {
+		t.Fatalf("setup6: %v", err)
+	}
+	return h
+}
+
+// exchange6 passes a message of type typ from the DUID of mac, with an
+// IA_NA and the modifiers applied after, through h and returns the reply
+func exchange6(t *testing.T, h handler.Handler6, typ dhcpv6.MessageType, mac string, mods ...dhcpv6.Modifier) *dhcpv6.Message {
+	t.Helper()
+	mods = append([]dhcpv6.Modifier{dhcpv6.WithClientID(duidOf(t, mac)), dhcpv6.WithIAID([4]byte{0, 0, 0, 1})}, mods...)
+	req, err := dhcpv6.NewMessage(mods...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.MessageType = typ
+	var resp *dhcpv6.Message
+	if typ == dhcpv6.MessageTypeSolicit {
+		resp, err = dhcpv6.NewAdvertiseFromSolicit(req)
+	} else {
+		resp, err = dhcpv6.NewReplyFromMessage(req)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := h(req, resp)
+	if out == nil {
+		return nil
+	}
+	return out.(*dhcpv6.Message)
+}
+
+// leased6 returns the address of the IA_NA of resp, nil if it has none
+func leased6(t *testing.T, resp *dhcpv6.Message) net.IP {
+	t.Helper()
+	if resp == nil {
+		t.Fatal("message dropped")
+	}
+	ia := resp.Options.OneIANA()
+	if ia == nil {
+		t.Fatal("no IA_NA in the reply")
+	}
+	if addr := ia.Options.OneAddress(); addr != nil {
+		return addr.IPv6Addr
+	}
+	return nil
+}
+
+func TestParseConfig6(t *testing.T) {
+	cfg, err := parseConfig6([]string{"redis://localhost/0", "2001:db8::/120", "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the subnet-router anycast address is never leased
+	if !cfg.Start.Equal(net.ParseIP("2001:db8::1")) || !cfg.End.Equal(net.ParseIP("2001:db8::ff")) || cfg.LeaseTime != time.Hour {
+		t.Errorf("prefix parsed as %s-%s for %s", cfg.Start, cfg.End, cfg.LeaseTime)
+	}
+	if cfg, err = parseConfig6([]string{"redis://localhost/0", "2001:db8::10", "2001:db8::20", "30m"}); err != nil ||
+		!cfg.Start.Equal(net.ParseIP("2001:db8::10")) || !cfg.End.Equal(net.ParseIP("2001:db8::20")) {
+		t.Errorf("range: %+v, %v", cfg, err)
+	}
+	for _, args := range [][]string{
+		{"redis://localhost/0", "2001:db8::/64", "1h"},
+		{"redis://localhost/0", "2001:db8::/128", "1h"},
+		{"redis://localhost/0", "10.0.0.0/24", "1h"},
+		{"redis://localhost/0", "10.0.0.1", "10.0.0.2", "1h"},
+		{"redis://localhost/0", "2001:db8::10", "1h"},
+		{"", "2001:db8::10", "2001:db8::20", "1h"},
+		{"redis://localhost/0", "2001:db8::/120", "forever"},
+		{"redis://localhost/0", "2001:db8::/120", "1h", "unknown=1"},
+	} {
+		if _, err := parseConfig6(args); err == nil {
+			t.Errorf("parseConfig6(%q) succeeded", args)
+		}
+	}
+}
+
+func TestRangeAllocator6(t *testing.T) {
+	a, err := newRangeAllocator6(net.ParseIP("2001:db8::fe"), net.ParseIP("2001:db8::101"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lowest first, across the byte boundary, and the hint when free
+	var got []string
+	for _, hint := range []string{"", "2001:db8::101", ""} {
+		n, err := a.Allocate(net.IPNet{IP: net.ParseIP(hint)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, n.IP.String())
+	}
+	if want := "[2001:db8::fe 2001:db8::101 2001:db8::ff]"; fmt.Sprint(got) != want {
+		t.Errorf("allocated %v, want %s", got, want)
+	}
+	if n, err := a.Allocate(net.IPNet{IP: net.ParseIP("2001:db8::fe")}); err != nil || !n.IP.Equal(net.ParseIP("2001:db8::100")) {
+		t.Errorf("hint of a used address: %v, %v", n.IP, err)
+	}
+	if _, err := a.Allocate(net.IPNet{}); err == nil {
+		t.Error("allocation from an exhausted range")
+	}
+	if err := a.Free(net.IPNet{IP: net.ParseIP("2001:db8::ff")}); err != nil {
+		t.Errorf("Free: %v", err)
+	}
+	if err := a.Free(net.IPNet{IP: net.ParseIP("2001:db8::ff")}); err == nil {
+		t.Error("double free succeeded")
+	}
+	if err := a.Free(net.IPNet{IP: net.ParseIP("2001:db8::1:ff")}); err == nil {
+		t.Error("free outside of the range succeeded")
+	}
+
+	for _, r := range [][2]string{
+		{"2001:db8::20", "2001:db8::10"},
+		{"2001:db8::", "2001:db8::1:0:0"},
+		{"2001:db8::", "2001:db9::"},
+		{"10.0.0.1", "10.0.0.2"},
+	} {
+		if _, err := newRangeAllocator6(net.ParseIP(r[0]), net.ParseIP(r[1])); err == nil {
+			t.Errorf("allocator of %s-%s created", r[0], r[1])
+		}
+	}
+}
+
+func TestHandler6(t *testing.T) {
+	m := miniredis.RunT(t)
+	args := []string{"2001:db8::10", "2001:db8::11", "1h"}
+	h := startPlugin6(t, m, args...)
+	const a, b, c = "00:11:22:33:44:0a", "00:11:22:33:44:0b", "00:11:22:33:44:0c"
+	first, second := net.ParseIP("2001:db8::10"), net.ParseIP("2001:db8::11")
+
+	// the same address is answered to SOLICIT, REQUEST and RENEW
+	for _, typ := range []dhcpv6.MessageType{dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew} {
+		resp := exchange6(t, h, typ, a)
+		if ip := leased6(t, resp); !ip.Equal(first) {
+			t.Errorf("%s answered %s, want %s", typ, ip, first)
+		}
+		ia := resp.Options.OneIANA()
+		if ia.IaId != [4]byte{0, 0, 0, 1} || ia.T1 != 30*time.Minute || ia.T2 != 48*time.Minute {
+			t.Errorf("%s answered IAID %x with T1 %s and T2 %s", typ, ia.IaId, ia.T1, ia.T2)
+		}
+		if addr := ia.Options.OneAddress(); addr.ValidLifetime != time.Hour || addr.PreferredLifetime != time.Hour {
+			t.Errorf("%s answered lifetimes %s and %s", typ, addr.PreferredLifetime, addr.ValidLifetime)
+		}
+	}
+	if ip := leased6(t, exchange6(t, h, dhcpv6.MessageTypeRequest, b)); !ip.Equal(second) {
+		t.Errorf("second client leased %s, want %s", ip, second)
+	}
+
+	// the records are keyed by DUID apart from the DHCPv4 ones
+	duid := hex.EncodeToString(duidOf(t, a).ToBytes())
+	for _, key := range []string{REDIS_V6_KEY_PREFIX + duid, REDIS_V6_SHADOW_KEY_PREFIX + duid} {
+		if !m.Exists(key) {
+			t.Errorf("no key %s", key)
+		}
+	}
+	assertTTL(t, m, REDIS_V6_SHADOW_KEY_PREFIX+duid, time.Hour)
+	for _, key := range m.Keys() {
+		if key[:len(defaultKeySpace.main)] == defaultKeySpace.main {
+			t.Errorf("DHCPv4 key %s written by the DHCPv6 instance", key)
+		}
+	}
+
+	// an exhausted range is answered with NoAddrsAvail
+	resp := exchange6(t, h, dhcpv6.MessageTypeSolicit, c)
+	if ip := leased6(t, resp); ip != nil {
+		t.Fatalf("%s leased from an exhausted range", ip)
+	}
+	if st := resp.Options.OneIANA().Options.Status(); st == nil || st.StatusCode != iana.StatusNoAddrsAvail {
+		t.Errorf("exhausted range answered status %v", st)
+	}
+	if n := len(m.Keys()); n != 4 {
+		t.Errorf("%d keys, want the 4 of the 2 leases", n)
+	}
+
+	// the expiry of the shadow key returns the address to the range, the
+	// record lingers a little longer
+	val, err := m.Get(REDIS_V6_KEY_PREFIX + duid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec Record
+	if err := json.Unmarshal([]byte(val), &rec); err != nil {
+		t.Fatal(err)
+	}
+	rec.Expires = time.Now().Add(-time.Second)
+	raw, _ := json.Marshal(rec)
+	m.Set(REDIS_V6_KEY_PREFIX+duid, string(raw))
+	m.Del(REDIS_V6_SHADOW_KEY_PREFIX + duid)
+	m.Publish("__keyevent@0__:expired", REDIS_V6_SHADOW_KEY_PREFIX+duid)
+	var ip net.IP
+	eventually(t, "the address freed by the expiry", func() bool {
+		ip = leased6(t, exchange6(t, h, dhcpv6.MessageTypeRequest, c))
+		return ip != nil
+	})
+	if !ip.Equal(first) {
+		t.Errorf("leased %s after the expiry, want %s", ip, first)
+	}
+	if ip := leased6(t, exchange6(t, h, dhcpv6.MessageTypeRenew, a)); ip != nil {
+		t.Errorf("expired lease of %s renewed while leased to another client", ip)
+	}
+
+	// the leases are reloaded by a new instance
+	h = startPlugin6(t, m, args...)
+	if ip := leased6(t, exchange6(t, h, dhcpv6.MessageTypeSolicit, a)); ip != nil {
+		t.Errorf("%s leased again after a reload", ip)
+	}
+	for mac, want := range map[string]net.IP{b: second, c: first} {
+		if ip := leased6(t, exchange6(t, h, dhcpv6.MessageTypeRenew, mac)); !ip.Equal(want) {
+			t.Errorf("%s renewed %s after a reload, want %s", mac, ip, want)
+		}
+	}
+}
+
+func TestRenewWithoutBinding(t *testing.T) {
+	m := miniredis.RunT(t)
+	h := startPlugin6(t, m, "2001:db8::10", "2001:db8::20", "1h", "delegate=2001:db8:100::/54", "delegate_length=56")
+	const a = "00:11:22:33:44:0a"
+	duid := hex.EncodeToString(duidOf(t, a).ToBytes())
+
+	// an unknown DUID is told it has no binding, and gets none
+	for _, typ := range []dhcpv6.MessageType{dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind} {
+		resp := exchange6(t, h, typ, a, withPrefixes(t, "2001:db8:100::/56"))
+		if ip := leased6(t, resp); ip != nil {
+			t.Errorf("%s of an unknown DUID leased %s", typ, ip)
+		}
+		if st := resp.Options.OneIANA().Options.Status(); st == nil || st.StatusCode != iana.StatusNoBinding {
+			t.Errorf("%s of an unknown DUID answered IA_NA status %v", typ, st)
+		}
+		if got := delegated(t, resp); len(got) != 0 {
+			t.Errorf("%s of an unknown DUID delegated %v", typ, got)
+		}
+		if st := resp.Options.OneIAPD().Options.Status(); st == nil || st.StatusCode != iana.StatusNoBinding {
+			t.Errorf("%s of an unknown DUID answered IA_PD status %v", typ, st)
+		}
+	}
+	for _, key := range []string{REDIS_V6_KEY_PREFIX + duid, REDIS_PD_KEY_PREFIX + duid} {
+		if m.Exists(key) {
+			t.Errorf("%s written for an unknown DUID", key)
+		}
+	}
+
+	// once leased, both renew
+	exchange6(t, h, dhcpv6.MessageTypeRequest, a, withPrefixes(t))
+	for _, typ := range []dhcpv6.MessageType{dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind} {
+		resp := exchange6(t, h, typ, a, withPrefixes(t, "2001:db8:100::/56"))
+		if ip := leased6(t, resp); !ip.Equal(net.ParseIP("2001:db8::10")) {
+			t.Errorf("%s leased %s", typ, ip)
+		}
+		if got := delegated(t, resp); got["2001:db8:100::/56"] != time.Hour {
+			t.Errorf("%s delegated %v", typ, got)
+		}
+	}
+}
+
+func TestClock6(t *testing.T) {
+	m := miniredis.RunT(t)
+	p, err := newPlugin6(redisURI(m), "2001:db8::10", "2001:db8::20", "1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the instance lives half an hour behind the system clock
+	clock := newFakeClock(time.Now().Add(-30 * time.Minute))
+	p.SetClock(clock)
+	const a = "00:11:22:33:44:0a"
+
+	resp := exchange6(t, p.Handler6, dhcpv6.MessageTypeRequest, a)
+	if addr := resp.Options.OneIANA().Options.OneAddress(); addr == nil || addr.ValidLifetime != time.Hour {
+		t.Fatalf("leased %v, want an hour by the clock of the instance", addr)
+	}
+	duid := hex.EncodeToString(duidOf(t, a).ToBytes())
+	val, err := m.Get(REDIS_V6_KEY_PREFIX + duid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec Record
+	if err := json.Unmarshal([]byte(val), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if !rec.LastSeen.Equal(clock.Now()) || !rec.Expires.Equal(clock.Now().Add(time.Hour)) {
+		t.Errorf("record seen %s until %s, want %s plus an hour", rec.LastSeen, rec.Expires, clock.Now())
+	}
+}
+
+func TestRapidCommit(t *testing.T) {
+	m := miniredis.RunT(t)
+	h := startPlugin6(t, m, "2001:db8::10", "2001:db8::20", "1h", "rapid_commit=true")
+	const a, b = "00:11:22:33:44:0a", "00:11:22:33:44:0b"
+
+	// a SOLICIT with Rapid Commit is answered with a committed REPLY
+	resp := exchange6(t, h, dhcpv6.MessageTypeSolicit, a, dhcpv6.WithRapidCommit)
+	if resp.MessageType != dhcpv6.MessageTypeReply || resp.GetOneOption(dhcpv6.OptionRapidCommit) == nil {
+		t.Errorf("rapid SOLICIT answered %s, with Rapid Commit %t", resp.MessageType, resp.GetOneOption(dhcpv6.OptionRapidCommit) != nil)
+	}
+	ip := leased6(t, resp)
+	duid := hex.EncodeToString(duidOf(t, a).ToBytes())
+	assertTTL(t, m, REDIS_V6_SHADOW_KEY_PREFIX+duid, time.Hour)
+	if got := leased6(t, exchange6(t, h, dhcpv6.MessageTypeRequest, a)); !got.Equal(ip) {
+		t.Errorf("REQUEST after the rapid commit answered %s, want %s", got, ip)
+	}
+
+	// without the option, the exchange stays four-message
+	if resp := exchange6(t, h, dhcpv6.MessageTypeSolicit, b); resp.MessageType != dhcpv6.MessageTypeAdvertise {
+		t.Errorf("SOLICIT answered %s", resp.MessageType)
+	}
+
+	// without the flag, a rapid SOLICIT is advertised, still stored in full
+	h = startPlugin6(t, m, "2001:db8::30", "2001:db8::40", "1h")
+	resp = exchange6(t, h, dhcpv6.MessageTypeSolicit, b, dhcpv6.WithRapidCommit)
+	if resp.MessageType != dhcpv6.MessageTypeAdvertise || resp.GetOneOption(dhcpv6.OptionRapidCommit) != nil {
+		t.Errorf("rapid SOLICIT without the flag answered %s, with Rapid Commit %t", resp.MessageType, resp.GetOneOption(dhcpv6.OptionRapidCommit) != nil)
+	}
+	ip = leased6(t, resp)
+	assertTTL(t, m, REDIS_V6_SHADOW_KEY_PREFIX+hex.EncodeToString(duidOf(t, b).ToBytes()), time.Hour)
+	if got := leased6(t, exchange6(t, h, dhcpv6.MessageTypeRequest, b)); !got.Equal(ip) {
+		t.Errorf("REQUEST after the ADVERTISE answered %s, want %s", got, ip)
+	}
+}
@@ -0,0 +1,118 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// interval between two samples of the clocks
+	clockSampleInterval = 10 * time.Second
+	// default difference between wall and monotonic time reported as a jump
+	defaultClockJumpThreshold = 30 * time.Second
+)
+
+// ClockStatus describes the wall clock jumps seen by the watchdog
+type ClockStatus struct {
+	Jumps    uint64
+	LastJump time.Time     `json:",omitempty"`
+	LastStep time.Duration `json:",omitempty"`
+}
+
+// clockWatchdog compares the progress of the wall clock with the monotonic
+// clock, which is not affected by clock steps
+type clockWatchdog struct {
+	mu     sync.Mutex
+	status ClockStatus
+}
+
+// Status returns a snapshot of the jumps seen so far
+func (w *clockWatchdog) Status() ClockStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.status
+}
+
+// clockSample is a reading of the monotonic and the wall clock
+type clockSample struct {
+	mono, wall time.Time
+}
+
+// watchClock samples the clocks until the instance is closed, and re-syncs
+// the TTLs of the stored leases after every wall clock jump
+func (p *PluginState) watchClock() {
+	ticker := time.NewTicker(clockSampleInterval)
+	defer ticker.Stop()
+
+	last := clockSample{mono: time.Now(), wall: p.clock.Now()}
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.closing:
+			return
+		}
+		if p.clock.simulated() {
+			// a simulated clock jumps on purpose
+			last = clockSample{mono: time.Now(), wall: p.clock.Now()}
+			continue
+		}
+		last = p.checkClock(last)
+	}
+}
+
+// checkClock compares the progress of both clocks since the last sample,
+// handles a step of the wall clock beyond the threshold, and returns the
+// new sample
+func (p *PluginState) checkClock(last clockSample) clockSample {
+	elapsed := time.Since(last.mono)
+	now := p.clock.Now()
+	step := now.Sub(last.wall) - elapsed
+	if step >= p.cfg.ClockJumpThreshold || -step >= p.cfg.ClockJumpThreshold {
+		p.clockJumped(now, step)
+	}
+	return clockSample{mono: last.mono.Add(elapsed), wall: now}
+}
+
+// clockJumped records a jump of the wall clock and rewrites the TTLs of all
+// leases from their expiry time
+func (p *PluginState) clockJumped(now time.Time, step time.Duration) {
+	p.watchdog.mu.Lock()
+	p.watchdog.status.Jumps++
+	p.watchdog.status.LastJump = now
+	p.watchdog.status.LastStep = step
+	p.watchdog.mu.Unlock()
+
+	log.Errorf("system clock stepped by %s, re-syncing the TTLs of all leases", step.Round(time.Second))
+	p.emit(Event{Type: EventClockJump, Detail: fmt.Sprintf("stepped by %s", step.Round(time.Second))})
+
+	n, err := p.resyncTTLs(context.TODO())
+	if err != nil {
+		log.Errorf("could not re-sync the TTLs after the clock jump: %v", err)
+		return
+	}
+	log.Infof("re-synced the TTLs of %d leases", n)
+}
+
+// resyncTTLs rewrites the TTLs of every stored lease from its expiry time
+func (p *PluginState) resyncTTLs(ctx context.Context) (int, error) {
+	var (
+		cursor uint64
+		total  int
+	)
+	for {
+		records, next, err := p.storage.ScanRecords(ctx, cursor, exportChunkSize)
+		if err != nil {
+			return total, err
+		}
+		if err := p.storage.ExpireAt(ctx, records); err != nil {
+			return total, err
+		}
+		total += len(records)
+		cursor = next
+		if cursor == 0 {
+			return total, nil
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package rangeredisplugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// assertTTL checks that key expires in about want
+func assertTTL(t *testing.T, m *miniredis.Miniredis, key string, want time.Duration) {
+	t.Helper()
+	if ttl := m.TTL(key); ttl < want-time.Second || ttl > want+time.Second {
+		t.Errorf("%s expires in %s, want %s", key, ttl, want)
+	}
+}
+
+func TestClockJump(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.13.10", "10.0.13.20", "1h")
+	events := recordEvents(p)
+	const mac = "00:11:22:33:44:55"
+	ip := lease(t, p, mac)
+
+	// a step below the threshold is not a jump
+	last := clockSample{mono: time.Now(), wall: p.clock.Now()}
+	advance(p, 10*time.Second)
+	last = p.checkClock(last)
+	if n := p.watchdog.Status().Jumps; n != 0 {
+		t.Fatalf("%d jumps after a step of 10s", n)
+	}
+
+	// TTLs written while the clock was off are rewritten after the jump
+	main, shadow, index := p.storage.ns.main+mac, p.storage.ns.shadow+mac, p.storage.ns.index+ip.String()
+	for _, key := range []string{main, shadow, index} {
+		m.SetTTL(key, 5*time.Minute)
+	}
+	advance(p, 5*time.Minute)
+	p.checkClock(last)
+
+	status := p.watchdog.Status()
+	if status.Jumps != 1 || status.LastStep < 5*time.Minute-time.Second || status.LastStep > 5*time.Minute {
+		t.Errorf("watchdog status %+v, want a jump of 5m", status)
+	}
+	if h := p.Health(context.Background()); h.Clock != status {
+		t.Errorf("health reports %+v, want %+v", h.Clock, status)
+	}
+	eventually(t, "the clock jump event", func() bool { return len(events.of(EventClockJump)) == 1 })
+	rec, err := p.storage.GetRecord(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := time.Until(rec.Expires)
+	assertTTL(t, m, main, left+10*time.Second)
+	assertTTL(t, m, shadow, left)
+	assertTTL(t, m, index, left+10*time.Second)
+}
+
+func TestClockJumpBackwards(t *testing.T) {
+	m := miniredis.RunT(t)
+	p := startPlugin(t, m, "10.0.13.10", "10.0.13.20", "1h", "clock_jump_threshold=1m")
+	last := clockSample{mono: time.Now(), wall: p.clock.Now()}
+	advance(p, -2*time.Minute)
+	p.checkClock(last)
+	if status := p.watchdog.Status(); status.Jumps != 1 || status.LastStep > -2*time.Minute {
+		t.Errorf("watchdog status %+v, want a jump of -2m", status)
+	}
+}